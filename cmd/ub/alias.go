@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"ub/internal/config"
+)
+
+// Aliases live in the config file under "aliases". An expansion is one or
+// more ub command lines joined by &&; ub runs them in turn, stopping at the
+// first failure, and appends the alias's own arguments to the last one.
+
+func runAlias(args []string) error {
+	path := config.DefaultPath()
+	cfg, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(args) == 0:
+		names := make([]string, 0, len(cfg.Aliases))
+		for name := range cfg.Aliases {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%s=%s\n", name, cfg.Aliases[name])
+		}
+		return nil
+	case args[0] == "--delete" || args[0] == "-d":
+		if len(args) != 2 {
+			return usageErrorf("usage: ub alias --delete NAME")
+		}
+		if _, ok := cfg.Aliases[args[1]]; !ok {
+			return fmt.Errorf("no alias named %q", args[1])
+		}
+		delete(cfg.Aliases, args[1])
+		return config.Save(path, cfg)
+	}
+	name, expansion, ok := strings.Cut(strings.Join(args, " "), "=")
+	if !ok {
+		if len(args) != 1 {
+			return usageErrorf("usage: ub alias [NAME[=EXPANSION]] | --delete NAME")
+		}
+		expansion, ok := cfg.Aliases[name]
+		if !ok {
+			return fmt.Errorf("no alias named %q", name)
+		}
+		fmt.Printf("%s=%s\n", name, expansion)
+		return nil
+	}
+	expansion = strings.TrimSpace(expansion)
+	if err := validateAlias(name, expansion, cfg.Aliases); err != nil {
+		return usageErrorf("%v", err)
+	}
+	if cfg.Aliases == nil {
+		cfg.Aliases = map[string]string{}
+	}
+	cfg.Aliases[name] = expansion
+	return config.Save(path, cfg)
+}
+
+func validateAlias(name, expansion string, aliases map[string]string) error {
+	if name == "" || strings.HasPrefix(name, "-") || strings.ContainsAny(name, " \t/\\'\"") {
+		return fmt.Errorf("invalid alias name %q", name)
+	}
+	if builtinCommand(name) {
+		return fmt.Errorf("%s is a ub command and cannot be an alias", name)
+	}
+	commands, err := parseAlias(expansion)
+	if err != nil {
+		return err
+	}
+	for _, command := range commands {
+		if _, ok := aliases[command[0]]; ok || command[0] == name {
+			return fmt.Errorf("alias %s runs %s, another alias; aliases cannot refer to aliases", name, command[0])
+		}
+	}
+	return nil
+}
+
+func builtinCommand(name string) bool {
+	return slices.Contains(builtinCommands, name) || readOnlyCommands[name] || historyCommands[name]
+}
+
+// expandAlias returns the command lines args runs when args[0] names an
+// alias. Built-in commands win over aliases.
+func expandAlias(aliases map[string]string, args []string) ([][]string, bool, error) {
+	expansion, ok := aliases[args[0]]
+	if !ok || builtinCommand(args[0]) {
+		return nil, false, nil
+	}
+	commands, err := parseAlias(expansion)
+	if err != nil {
+		return nil, false, fmt.Errorf("alias %s: %w", args[0], err)
+	}
+	for _, command := range commands {
+		if _, nested := aliases[command[0]]; nested && !builtinCommand(command[0]) {
+			return nil, false, fmt.Errorf("alias %s runs %s, another alias; aliases cannot refer to aliases", args[0], command[0])
+		}
+	}
+	last := len(commands) - 1
+	commands[last] = append(commands[last], args[1:]...)
+	return commands, true, nil
+}
+
+// parseAlias splits an expansion into command lines. Words are separated
+// by spaces and may be quoted with ' or ".
+func parseAlias(expansion string) ([][]string, error) {
+	var commands [][]string
+	var command []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	for _, r := range expansion + " " {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if !inWord {
+				continue
+			}
+			if word.String() == "&&" {
+				if len(command) == 0 {
+					return nil, fmt.Errorf("empty command in %q", expansion)
+				}
+				commands, command = append(commands, command), nil
+			} else {
+				command = append(command, word.String())
+			}
+			word.Reset()
+			inWord = false
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", expansion)
+	}
+	if len(command) == 0 {
+		return nil, fmt.Errorf("empty command in %q", expansion)
+	}
+	return append(commands, command), nil
+}
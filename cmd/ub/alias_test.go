@@ -0,0 +1,65 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"ub/internal/config"
+)
+
+func TestExpandAlias(t *testing.T) {
+	aliases := map[string]string{
+		"up":      "update && upgrade",
+		"i2":      `install --jobs 2`,
+		"quoted":  `info "a b" && list`,
+		"install": "uninstall",
+	}
+	tests := []struct {
+		args []string
+		want [][]string
+		ok   bool
+	}{
+		{[]string{"up"}, [][]string{{"update"}, {"upgrade"}}, true},
+		{[]string{"up", "--greedy"}, [][]string{{"update"}, {"upgrade", "--greedy"}}, true},
+		{[]string{"i2", "wget"}, [][]string{{"install", "--jobs", "2", "wget"}}, true},
+		{[]string{"quoted"}, [][]string{{"info", "a b"}, {"list"}}, true},
+		{[]string{"install", "wget"}, nil, false},
+		{[]string{"nope"}, nil, false},
+	}
+	for _, tt := range tests {
+		got, ok, err := expandAlias(aliases, tt.args)
+		if err != nil || ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expandAlias(%q) = %q, %v, %v; want %q, %v", tt.args, got, ok, err, tt.want, tt.ok)
+		}
+	}
+	for _, bad := range []string{"", "update &&", `info "open`, "&& list"} {
+		if _, err := parseAlias(bad); err == nil {
+			t.Errorf("parseAlias(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestAliasCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	t.Setenv("UB_CONFIG", path)
+
+	if err := runAlias([]string{"up=update", "&&", "upgrade"}); err != nil {
+		t.Fatalf("define: %v", err)
+	}
+	for _, args := range [][]string{{"list=info"}, {"down=up"}, {"-x=list"}, {"bad=info 'x"}} {
+		if err := runAlias(args); err == nil {
+			t.Errorf("runAlias(%q) succeeded", args)
+		}
+	}
+	cfg, err := config.Load(path)
+	if err != nil || !reflect.DeepEqual(cfg.Aliases, map[string]string{"up": "update && upgrade"}) {
+		t.Fatalf("aliases = %v, %v", cfg.Aliases, err)
+	}
+	if err := runAlias([]string{"--delete", "up"}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if cfg, _ := config.Load(path); len(cfg.Aliases) != 0 {
+		t.Fatalf("aliases after delete = %v", cfg.Aliases)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"ub/internal/config"
+	"ub/internal/native"
+	"ub/internal/plugin"
+)
+
+func runApply(ctx context.Context, manager *native.Manager, args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "print what would change without changing it")
+	jobs := jobsValue{n: manager.Workers}
+	fs.Var(&jobs, "jobs", "maximum parallel jobs, or auto")
+	linkConflictFlags(fs, manager)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("usage: ub apply [--dry-run] [--jobs N|auto] <manifest.json|manifest.yaml>")
+	}
+	manifest, err := native.LoadManifest(fs.Arg(0))
+	if err != nil {
+		return usageErrorf("%v", err)
+	}
+	useJobs(manager, jobs)
+	if err := manager.CheckNetwork(ctx); err != nil {
+		return err
+	}
+	plugins, err := plugin.Load(ctx, plugin.DefaultDir(config.Dir()))
+	if err != nil {
+		return err
+	}
+	defer plugins.Close()
+	manager.Plugins = plugins
+
+	plan, err := manager.PlanApply(ctx, manifest)
+	if err != nil {
+		return err
+	}
+	for _, line := range applyPlanLines(plan) {
+		fmt.Println(line)
+	}
+	if *dryRun || plan.Empty() {
+		return nil
+	}
+	return manager.Apply(ctx, plan)
+}
+
+func applyPlanLines(plan native.ApplyPlan) []string {
+	if plan.Empty() {
+		return []string{"==> Everything matches the manifest"}
+	}
+	var lines []string
+	if len(plan.Taps) > 0 {
+		taps := make([]string, 0, len(plan.Taps))
+		for _, tap := range plan.Taps {
+			taps = append(taps, tap.Name)
+		}
+		lines = append(lines, "==> Tap: "+strings.Join(taps, ", "))
+	}
+	if len(plan.TapPins) > 0 {
+		pins := make([]string, 0, len(plan.TapPins))
+		for _, pin := range plan.TapPins {
+			pins = append(pins, pin.Formula+" from "+pin.Tap)
+		}
+		lines = append(lines, "==> Build from tap: "+strings.Join(pins, ", "))
+	}
+	if len(plan.Install) > 0 {
+		lines = append(lines, "==> Install: "+strings.Join(plan.Install, ", "))
+	}
+	if len(plan.InstallCasks) > 0 {
+		lines = append(lines, "==> Install casks: "+strings.Join(plan.InstallCasks, ", "))
+	}
+	if len(plan.Upgrade) > 0 {
+		upgrades := make([]string, 0, len(plan.Upgrade))
+		for _, p := range plan.Upgrade {
+			upgrades = append(upgrades, fmt.Sprintf("%s %s -> %s", p.Name, p.InstalledVersion, p.CurrentVersion))
+		}
+		lines = append(lines, "==> Upgrade: "+strings.Join(upgrades, ", "))
+	}
+	for _, group := range []struct {
+		heading string
+		names   []string
+	}{{"Pin", plan.Pin}, {"Pin casks", plan.PinCasks}, {"Unpin", plan.Unpin}, {"Unpin casks", plan.UnpinCasks}} {
+		if len(group.names) > 0 {
+			lines = append(lines, "==> "+group.heading+": "+strings.Join(group.names, ", "))
+		}
+	}
+	if len(plan.Remove) > 0 {
+		lines = append(lines, "==> Remove: "+strings.Join(plan.Remove, ", "))
+	}
+	if len(plan.RemoveCasks) > 0 {
+		lines = append(lines, "==> Remove casks: "+strings.Join(plan.RemoveCasks, ", "))
+	}
+	return lines
+}
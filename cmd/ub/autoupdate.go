@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"html"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"ub/internal/config"
+	"ub/internal/native"
+	"ub/internal/plugin"
+)
+
+const (
+	autoupdateLabel    = "sh.ub.autoupdate"
+	autoupdateUnit     = "ub-autoupdate"
+	autoupdateInterval = 24 * time.Hour
+)
+
+// runServiceCommand runs launchctl or systemctl; tests replace it.
+var runServiceCommand = func(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// autoupdateSchedule is what start installs: a launchd agent on macOS and a
+// systemd user timer elsewhere.
+type autoupdateSchedule struct {
+	Executable string
+	Interval   time.Duration
+	Upgrade    bool
+	Env        map[string]string
+	LogPath    string
+}
+
+func (s autoupdateSchedule) args() []string {
+	args := []string{s.Executable, "autoupdate", "run"}
+	if s.Upgrade {
+		args = append(args, "--upgrade")
+	}
+	return args
+}
+
+func runAutoupdate(ctx context.Context, manager *native.Manager, args []string) error {
+	if len(args) == 0 {
+		return usageErrorf("usage: ub autoupdate start [--interval DURATION] [--upgrade] | stop | status | run [--upgrade]")
+	}
+	switch args[0] {
+	case "start":
+		fs := flag.NewFlagSet("autoupdate start", flag.ContinueOnError)
+		interval := fs.Duration("interval", autoupdateInterval, "time between runs")
+		upgrade := fs.Bool("upgrade", false, "upgrade outdated packages instead of only notifying")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() > 0 {
+			return usageErrorf("autoupdate start takes no arguments")
+		}
+		if *interval < time.Minute {
+			return usageErrorf("--interval must be at least 1m")
+		}
+		executable, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("locate running executable: %w", err)
+		}
+		schedule := autoupdateSchedule{
+			Executable: executable,
+			Interval:   *interval,
+			Upgrade:    *upgrade,
+			Env:        autoupdateEnv(),
+			LogPath:    filepath.Join(manager.Paths.Prefix, "var", "log", "ub-autoupdate.log"),
+		}
+		return startAutoupdate(runtime.GOOS, schedule)
+	case "stop":
+		if len(args) > 1 {
+			return usageErrorf("autoupdate stop takes no arguments")
+		}
+		return stopAutoupdate(runtime.GOOS)
+	case "status":
+		if len(args) > 1 {
+			return usageErrorf("autoupdate status takes no arguments")
+		}
+		files := autoupdateFiles(runtime.GOOS)
+		if _, err := os.Stat(files[0]); err != nil {
+			fmt.Println("Autoupdate is not installed; run `ub autoupdate start`")
+			return nil
+		}
+		fmt.Printf("Autoupdate is installed: %s\n", strings.Join(files, ", "))
+		return nil
+	case "run":
+		fs := flag.NewFlagSet("autoupdate run", flag.ContinueOnError)
+		upgrade := fs.Bool("upgrade", false, "upgrade outdated packages instead of only notifying")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		return runAutoupdateOnce(ctx, manager, *upgrade)
+	}
+	return usageErrorf("unknown autoupdate subcommand %q", args[0])
+}
+
+// runAutoupdateOnce is what the schedule executes: refresh the API cache,
+// then upgrade or post a notification listing what is outdated.
+func runAutoupdateOnce(ctx context.Context, manager *native.Manager, upgrade bool) error {
+	if err := runNativeUpdate(ctx, manager); err != nil {
+		return err
+	}
+	if upgrade {
+		plugins, err := plugin.Load(ctx, plugin.DefaultDir(config.Dir()))
+		if err != nil {
+			return err
+		}
+		defer plugins.Close()
+		manager.Plugins = plugins
+		summary, err := manager.Upgrade(ctx, nil, native.UpgradeOptions{})
+		if err == nil && len(summary.Upgraded) > 0 {
+			_ = notifyDesktop("ub", fmt.Sprintf("Upgraded %d package(s)", len(summary.Upgraded)))
+		}
+		return err
+	}
+	outdated, err := manager.Outdated(ctx, nil, false)
+	if err != nil {
+		return err
+	}
+	if len(outdated) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(outdated))
+	for _, p := range outdated {
+		names = append(names, p.Name)
+	}
+	fmt.Printf("==> %d outdated package(s): %s\n", len(names), strings.Join(names, ", "))
+	if err := notifyDesktop("ub", fmt.Sprintf("%d upgrade(s) available: %s", len(names), strings.Join(names, ", "))); err != nil {
+		fmt.Fprintf(os.Stderr, "notification failed: %v\n", err)
+	}
+	return nil
+}
+
+// autoupdateEnv carries the variables that pick the install tree, so the
+// agent manages the same prefix as the shell that started it.
+func autoupdateEnv() map[string]string {
+	env := map[string]string{"PATH": "/usr/bin:/bin:/usr/sbin:/sbin"}
+	for _, key := range []string{"UB_BASE_DIR", "UB_PREFIX", "UB_CELLAR", "UB_CASKROOM", "UB_CACHE_DIR", "UB_REPOSITORY", "UB_CONFIG", "UB_ARCH", "UB_API_DOMAIN", "HOME"} {
+		if value := strings.TrimSpace(os.Getenv(key)); value != "" {
+			env[key] = value
+		}
+	}
+	return env
+}
+
+// autoupdateFiles lists the files start writes, the one that marks the
+// schedule as installed first.
+func autoupdateFiles(goos string) []string {
+	home, _ := os.UserHomeDir()
+	if goos == "darwin" {
+		return []string{filepath.Join(home, "Library", "LaunchAgents", autoupdateLabel+".plist")}
+	}
+	configHome := strings.TrimSpace(os.Getenv("XDG_CONFIG_HOME"))
+	if configHome == "" {
+		configHome = filepath.Join(home, ".config")
+	}
+	dir := filepath.Join(configHome, "systemd", "user")
+	return []string{filepath.Join(dir, autoupdateUnit+".timer"), filepath.Join(dir, autoupdateUnit+".service")}
+}
+
+func startAutoupdate(goos string, s autoupdateSchedule) error {
+	files := autoupdateFiles(goos)
+	var contents []string
+	if goos == "darwin" {
+		contents = []string{launchdPlist(s)}
+	} else {
+		timer, service := systemdUnits(s)
+		contents = []string{timer, service}
+	}
+	for i, path := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(contents[i]), 0o644); err != nil {
+			return fmt.Errorf("write %s: %w", path, err)
+		}
+	}
+	if s.LogPath != "" {
+		if err := os.MkdirAll(filepath.Dir(s.LogPath), 0o755); err != nil {
+			return err
+		}
+	}
+	if goos == "darwin" {
+		_ = runServiceCommand("launchctl", "unload", files[0])
+		if err := runServiceCommand("launchctl", "load", "-w", files[0]); err != nil {
+			return fmt.Errorf("load launch agent: %w", err)
+		}
+	} else {
+		if err := runServiceCommand("systemctl", "--user", "daemon-reload"); err != nil {
+			return fmt.Errorf("reload systemd user units: %w", err)
+		}
+		if err := runServiceCommand("systemctl", "--user", "enable", "--now", autoupdateUnit+".timer"); err != nil {
+			return fmt.Errorf("enable %s.timer: %w", autoupdateUnit, err)
+		}
+	}
+	mode := "notify about"
+	if s.Upgrade {
+		mode = "upgrade"
+	}
+	fmt.Printf("==> Autoupdate will %s outdated packages every %s\n", mode, s.Interval)
+	return nil
+}
+
+func stopAutoupdate(goos string) error {
+	files := autoupdateFiles(goos)
+	if _, err := os.Stat(files[0]); os.IsNotExist(err) {
+		fmt.Println("Autoupdate is not installed")
+		return nil
+	}
+	if goos == "darwin" {
+		if err := runServiceCommand("launchctl", "unload", "-w", files[0]); err != nil {
+			return fmt.Errorf("unload launch agent: %w", err)
+		}
+	} else if err := runServiceCommand("systemctl", "--user", "disable", "--now", autoupdateUnit+".timer"); err != nil {
+		return fmt.Errorf("disable %s.timer: %w", autoupdateUnit, err)
+	}
+	for _, path := range files {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if goos != "darwin" {
+		_ = runServiceCommand("systemctl", "--user", "daemon-reload")
+	}
+	fmt.Println("==> Autoupdate stopped")
+	return nil
+}
+
+func launchdPlist(s autoupdateSchedule) string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>` + autoupdateLabel + `</string>
+	<key>ProgramArguments</key>
+	<array>
+`)
+	for _, arg := range s.args() {
+		fmt.Fprintf(&b, "\t\t<string>%s</string>\n", html.EscapeString(arg))
+	}
+	b.WriteString("\t</array>\n\t<key>EnvironmentVariables</key>\n\t<dict>\n")
+	for _, key := range sortedKeys(s.Env) {
+		fmt.Fprintf(&b, "\t\t<key>%s</key>\n\t\t<string>%s</string>\n", html.EscapeString(key), html.EscapeString(s.Env[key]))
+	}
+	b.WriteString("\t</dict>\n")
+	fmt.Fprintf(&b, "\t<key>StartInterval</key>\n\t<integer>%d</integer>\n", int(s.Interval.Seconds()))
+	b.WriteString("\t<key>RunAtLoad</key>\n\t<false/>\n\t<key>ProcessType</key>\n\t<string>Background</string>\n")
+	if s.LogPath != "" {
+		fmt.Fprintf(&b, "\t<key>StandardOutPath</key>\n\t<string>%[1]s</string>\n\t<key>StandardErrorPath</key>\n\t<string>%[1]s</string>\n", html.EscapeString(s.LogPath))
+	}
+	b.WriteString("</dict>\n</plist>\n")
+	return b.String()
+}
+
+// systemdUnits returns the timer and the oneshot service it triggers.
+// Output goes to the user journal.
+func systemdUnits(s autoupdateSchedule) (timer, service string) {
+	seconds := int(s.Interval.Seconds())
+	timer = fmt.Sprintf(`[Unit]
+Description=Periodic ub update
+
+[Timer]
+OnBootSec=5min
+OnUnitActiveSec=%ds
+Unit=%s.service
+
+[Install]
+WantedBy=timers.target
+`, seconds, autoupdateUnit)
+
+	var env strings.Builder
+	for _, key := range sortedKeys(s.Env) {
+		fmt.Fprintf(&env, "Environment=%s\n", systemdQuote(key+"="+s.Env[key]))
+	}
+	quoted := make([]string, 0, len(s.args()))
+	for _, arg := range s.args() {
+		quoted = append(quoted, systemdQuote(arg))
+	}
+	service = fmt.Sprintf(`[Unit]
+Description=ub update and upgrade check
+
+[Service]
+Type=oneshot
+%sExecStart=%s
+`, env.String(), strings.Join(quoted, " "))
+	return timer, service
+}
+
+func systemdQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "%", "%%")
+	return `"` + s + `"`
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLaunchdPlistRunsAutoupdateOnInterval(t *testing.T) {
+	plist := launchdPlist(autoupdateSchedule{
+		Executable: "/opt/ub/bin/ub",
+		Interval:   6 * time.Hour,
+		Upgrade:    true,
+		Env:        map[string]string{"UB_BASE_DIR": "/tmp/a&b"},
+		LogPath:    "/opt/ub/var/log/ub-autoupdate.log",
+	})
+	for _, want := range []string{
+		"<string>" + autoupdateLabel + "</string>",
+		"<string>/opt/ub/bin/ub</string>\n\t\t<string>autoupdate</string>\n\t\t<string>run</string>\n\t\t<string>--upgrade</string>",
+		"<key>UB_BASE_DIR</key>\n\t\t<string>/tmp/a&amp;b</string>",
+		"<key>StartInterval</key>\n\t<integer>21600</integer>",
+		"<key>StandardErrorPath</key>\n\t<string>/opt/ub/var/log/ub-autoupdate.log</string>",
+	} {
+		if !strings.Contains(plist, want) {
+			t.Fatalf("plist missing %q:\n%s", want, plist)
+		}
+	}
+}
+
+func TestStartAndStopAutoupdateWithSystemd(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", tmp)
+	var calls []string
+	orig := runServiceCommand
+	runServiceCommand = func(name string, args ...string) error {
+		calls = append(calls, name+" "+strings.Join(args, " "))
+		return nil
+	}
+	t.Cleanup(func() { runServiceCommand = orig })
+
+	schedule := autoupdateSchedule{
+		Executable: "/home/me/ub 1/ub",
+		Interval:   time.Hour,
+		Env:        map[string]string{"UB_BASE_DIR": "/data/50%"},
+	}
+	if _, err := captureStdout(func() error { return startAutoupdate("linux", schedule) }); err != nil {
+		t.Fatalf("startAutoupdate: %v", err)
+	}
+	unitDir := filepath.Join(tmp, "systemd", "user")
+	timer, err := os.ReadFile(filepath.Join(unitDir, autoupdateUnit+".timer"))
+	if err != nil {
+		t.Fatalf("read timer: %v", err)
+	}
+	if !strings.Contains(string(timer), "OnUnitActiveSec=3600s") {
+		t.Fatalf("timer:\n%s", timer)
+	}
+	service, err := os.ReadFile(filepath.Join(unitDir, autoupdateUnit+".service"))
+	if err != nil {
+		t.Fatalf("read service: %v", err)
+	}
+	for _, want := range []string{`ExecStart="/home/me/ub 1/ub" "autoupdate" "run"` + "\n", `Environment="UB_BASE_DIR=/data/50%%"`} {
+		if !strings.Contains(string(service), want) {
+			t.Fatalf("service missing %q:\n%s", want, service)
+		}
+	}
+	if want := "systemctl --user enable --now " + autoupdateUnit + ".timer"; len(calls) != 2 || calls[1] != want {
+		t.Fatalf("calls = %q, want daemon-reload then %q", calls, want)
+	}
+
+	calls = nil
+	if _, err := captureStdout(func() error { return stopAutoupdate("linux") }); err != nil {
+		t.Fatalf("stopAutoupdate: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(unitDir, autoupdateUnit+".timer")); !os.IsNotExist(err) {
+		t.Fatalf("expected timer removed, got err=%v", err)
+	}
+	if len(calls) == 0 || !strings.HasPrefix(calls[0], "systemctl --user disable --now") {
+		t.Fatalf("calls = %q", calls)
+	}
+}
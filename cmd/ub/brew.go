@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"ub/internal/messages"
+	"ub/internal/native"
+)
+
+// brewCommand maps one brew command onto ub. Flags lists the brew flags ub
+// understands, each with its ub spelling; an empty spelling drops the flag
+// because ub already behaves that way. Rejected flags change the meaning of
+// the command too much to ignore.
+type brewCommand struct {
+	ub       string
+	flags    map[string]string
+	rejected map[string]string
+	noNames  string
+}
+
+var (
+	brewKindFlags = map[string]string{"--formula": "--formula", "--formulae": "--formula", "--cask": "--cask", "--casks": "--cask"}
+
+	brewCommands = map[string]brewCommand{
+		"install": {ub: "install", flags: withKindFlags(map[string]string{
+			"--HEAD": "--HEAD", "--only-dependencies": "--only-dependencies", "--ignore-dependencies": "--ignore-dependencies",
+			"--force-bottle": "--force-bottle",
+		}), rejected: map[string]string{
+			"--build-from-source": "ub only pours bottles", "-s": "ub only pours bottles",
+			"--interactive": "ub has no interactive builds", "-i": "ub has no interactive builds",
+		}},
+		"uninstall": {ub: "uninstall", flags: withKindFlags(map[string]string{"--force": "--force", "-f": "--force"})},
+		"upgrade":   {ub: "upgrade", flags: withKindFlags(map[string]string{"--greedy": "--greedy", "-g": "--greedy"})},
+		"list": {ub: "list", flags: map[string]string{"--formula": "", "--formulae": "", "-1": ""}, rejected: map[string]string{
+			"--cask": "ub list only lists formulae", "--casks": "ub list only lists formulae",
+		}, noNames: "ub list does not list the files of a formula"},
+		"info": {ub: "info", flags: withKindFlags(map[string]string{
+			"--json": "--json", "--analytics": "--analytics", "--installed": "--installed",
+		})},
+		"search":    {ub: "search", flags: map[string]string{"--formula": "", "--formulae": "", "--cask": "", "--casks": ""}},
+		"update":    {ub: "update"},
+		"config":    {ub: "config"},
+		"commands":  {ub: "commands"},
+		"--prefix":  {ub: "prefix"},
+		"--version": {ub: "version"},
+	}
+
+	brewAliases = map[string]string{
+		"remove": "uninstall", "rm": "uninstall", "ls": "list", "abv": "info", "-S": "search", "-v": "--version",
+	}
+)
+
+func withKindFlags(flags map[string]string) map[string]string {
+	for flag, ubFlag := range brewKindFlags {
+		flags[flag] = ubFlag
+	}
+	return flags
+}
+
+// translateBrew turns a brew command line into the ub one that does the same
+// thing. Flags come first in the result because ub stops parsing flags at the
+// first name. Warnings name the brew flags that were dropped.
+func translateBrew(args []string) (ubArgs, warnings []string, err error) {
+	if len(args) == 0 {
+		return nil, nil, usageErrorf("usage: ub brew <brew command> [args...]")
+	}
+	name := args[0]
+	if alias, ok := brewAliases[name]; ok {
+		name = alias
+	}
+	cmd, ok := brewCommands[name]
+	if !ok {
+		return nil, nil, usageErrorf("brew %s has no ub equivalent", args[0])
+	}
+
+	var flags, names []string
+	for idx := 1; idx < len(args); idx++ {
+		arg := args[idx]
+		if arg == "--" {
+			names = append(names, args[idx+1:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			names = append(names, arg)
+			continue
+		}
+		key, value, hasValue := strings.Cut(arg, "=")
+		if reason, ok := cmd.rejected[key]; ok {
+			return nil, nil, usageErrorf("brew %s %s is not supported: %s", name, key, reason)
+		}
+		ubFlag, ok := cmd.flags[key]
+		switch {
+		case !ok:
+			warnings = append(warnings, fmt.Sprintf("ignoring brew %s flag %s, which ub does not support", name, arg))
+		case ubFlag == "":
+		case hasValue:
+			flags = append(flags, ubFlag+"="+value)
+		default:
+			flags = append(flags, ubFlag)
+		}
+	}
+	if cmd.noNames != "" && len(names) > 0 {
+		return nil, nil, usageErrorf("brew %s %s is not supported: %s", name, strings.Join(names, " "), cmd.noNames)
+	}
+	ubArgs = append([]string{cmd.ub}, flags...)
+	return append(ubArgs, names...), warnings, nil
+}
+
+func runBrew(ctx context.Context, manager *native.Manager, args []string) error {
+	printOnly := len(args) > 0 && args[0] == "--print"
+	if printOnly {
+		args = args[1:]
+	}
+	ubArgs, warnings, err := translateBrew(args)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		fmt.Fprintln(os.Stderr, messages.Sprintf(messages.Warning, warning))
+	}
+	if printOnly {
+		fmt.Println("ub " + strings.Join(ubArgs, " "))
+		return nil
+	}
+	return dispatch(ctx, manager, ubArgs)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTranslateBrew(t *testing.T) {
+	cases := []struct {
+		args     []string
+		want     string
+		warnings int
+	}{
+		{[]string{"install", "--cask", "docker", "-v"}, "install --cask docker", 1},
+		{[]string{"uninstall", "--cask", "docker"}, "uninstall --cask docker", 0},
+		{[]string{"upgrade", "--formula"}, "upgrade --formula", 0},
+		{[]string{"install", "wget", "--HEAD"}, "install --HEAD wget", 0},
+		{[]string{"rm", "-f", "jq"}, "uninstall --force jq", 0},
+		{[]string{"abv", "--json=v2", "--installed"}, "info --json=v2 --installed", 0},
+		{[]string{"info", "--casks", "firefox"}, "info --cask firefox", 0},
+		{[]string{"ls", "--formula"}, "list", 0},
+		{[]string{"upgrade", "--greedy", "--dry-run"}, "upgrade --greedy", 1},
+		{[]string{"--prefix", "jq"}, "prefix jq", 0},
+		{[]string{"-v"}, "version", 0},
+	}
+	for _, tc := range cases {
+		got, warnings, err := translateBrew(tc.args)
+		if err != nil {
+			t.Fatalf("translateBrew(%v): %v", tc.args, err)
+		}
+		if !reflect.DeepEqual(got, strings.Fields(tc.want)) || len(warnings) != tc.warnings {
+			t.Errorf("translateBrew(%v) = %v, %v; want %q with %d warning(s)", tc.args, got, warnings, tc.want, tc.warnings)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"doctor"},
+		{"install", "--build-from-source", "jq"},
+		{"list", "--cask"},
+		{"list", "jq"},
+	} {
+		if _, _, err := translateBrew(args); err == nil || exitCodeFor(err) != 2 {
+			t.Errorf("translateBrew(%v) error = %v, want a usage error", args, err)
+		}
+	}
+}
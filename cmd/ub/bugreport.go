@@ -0,0 +1,263 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"ub/internal/config"
+	"ub/internal/messages"
+	"ub/internal/native"
+)
+
+type lastCommand struct {
+	Args       []string  `json:"args"`
+	Error      string    `json:"error,omitempty"`
+	ExitCode   int       `json:"exit_code"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+var lastCommandExcluded = map[string]bool{
+	"bugreport": true, "help": true, "-h": true, "--help": true,
+	"version": true, "--version": true, "-v": true,
+}
+
+func lastCommandPath(manager *native.Manager) string {
+	return filepath.Join(manager.Paths.Prefix, "var", "ub", "last-command.json")
+}
+
+func recordLastCommand(manager *native.Manager, args []string, start time.Time, err error) {
+	if len(args) == 0 || lastCommandExcluded[args[0]] {
+		return
+	}
+	rec := lastCommand{
+		Args:       args,
+		ExitCode:   exitCodeFor(err),
+		StartedAt:  start.UTC(),
+		DurationMS: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	data, marshalErr := json.MarshalIndent(rec, "", "  ")
+	if marshalErr != nil {
+		return
+	}
+	path := lastCommandPath(manager)
+	if mkErr := os.MkdirAll(filepath.Dir(path), 0o755); mkErr != nil {
+		return
+	}
+	_ = os.WriteFile(path, data, 0o644)
+}
+
+func runBugreport(ctx context.Context, manager *native.Manager, args []string) error {
+	fs := flag.NewFlagSet("bugreport", flag.ContinueOnError)
+	output := fs.String("output", "", "write a .tar.gz bundle instead of printing markdown")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	home, _ := os.UserHomeDir()
+	s := sanitizer{home: home}
+
+	files := map[string][]byte{}
+	var last *lastCommand
+	if data, err := os.ReadFile(lastCommandPath(manager)); err == nil {
+		var rec lastCommand
+		if json.Unmarshal(data, &rec) == nil {
+			last = &rec
+			files["last-command.json"] = []byte(s.clean(string(data)))
+		}
+	}
+	if data, err := os.ReadFile(config.DefaultPath()); err == nil {
+		files["config.json"] = []byte(s.clean(string(data)))
+	}
+	if last != nil {
+		for _, name := range commandOperands(last.Args) {
+			f, err := manager.Info(ctx, name)
+			if err != nil {
+				continue
+			}
+			data, err := json.MarshalIndent(f, "", "  ")
+			if err == nil {
+				files["formula/"+name+".json"] = data
+			}
+		}
+	}
+	report := bugreportMarkdown(manager, last, os.Environ(), s)
+	files["report.md"] = []byte(report)
+
+	if *output == "" {
+		fmt.Print(report)
+		return nil
+	}
+	if err := writeBundle(*output, files); err != nil {
+		return err
+	}
+	fmt.Println(messages.Sprintf(messages.BugreportWritten, *output))
+	return nil
+}
+
+func bugreportMarkdown(manager *native.Manager, last *lastCommand, environ []string, s sanitizer) string {
+	var b strings.Builder
+	b.WriteString("## ub bug report\n\n")
+	fmt.Fprintf(&b, "- ub: %s\n", version)
+	fmt.Fprintf(&b, "- go: %s\n", runtime.Version())
+	fmt.Fprintf(&b, "- platform: %s/%s\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&b, "- prefix: %s\n", s.clean(manager.Paths.Prefix))
+	fmt.Fprintf(&b, "- repository: %s\n", s.clean(manager.Paths.Repo))
+	fmt.Fprintf(&b, "- cache: %s\n", s.clean(manager.Paths.Cache))
+
+	b.WriteString("\n### Last command\n\n")
+	if last == nil {
+		b.WriteString("No command has been recorded yet.\n")
+	} else {
+		b.WriteString("```\n")
+		fmt.Fprintf(&b, "$ ub %s\n", s.clean(strings.Join(last.Args, " ")))
+		fmt.Fprintf(&b, "exit code: %d after %dms\n", last.ExitCode, last.DurationMS)
+		if last.Error != "" {
+			fmt.Fprintf(&b, "error: %s\n", s.clean(last.Error))
+		}
+		b.WriteString("```\n")
+	}
+
+	b.WriteString("\n### Environment\n\n```\n")
+	for _, line := range bugreportEnv(environ, s) {
+		b.WriteString(line + "\n")
+	}
+	b.WriteString("```\n")
+	return b.String()
+}
+
+var bugreportEnvPrefixes = []string{"UB_", "HOMEBREW_", "OTEL_", "LANG", "LC_", "TERM", "NO_COLOR", "SHELL"}
+
+var secretKeyPattern = regexp.MustCompile(`(?i)(token|secret|password|passwd|auth|key|header|credential)`)
+
+// bugreportEnv keeps only variables relevant to ub and redacts anything that
+// looks like a credential.
+func bugreportEnv(environ []string, s sanitizer) []string {
+	out := make([]string, 0)
+	for _, kv := range environ {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok || !hasAnyPrefix(key, bugreportEnvPrefixes) {
+			continue
+		}
+		if secretKeyPattern.MatchString(key) {
+			value = "[REDACTED]"
+		}
+		out = append(out, key+"="+s.clean(value))
+	}
+	sort.Strings(out)
+	return out
+}
+
+func hasAnyPrefix(value string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// commandValueFlags lists, for each command, the flags that take their value
+// from the next argument when not written as --flag=value.
+var commandValueFlags = map[string][]string{
+	"install":          {"jobs", "bottle-tag", "sha256", "tap", "file", "link-conflicts"},
+	"upgrade":          {"jobs", "link-conflicts"},
+	"apply":            {"jobs", "link-conflicts"},
+	"verify-downloads": {"jobs"},
+	"unbottled":        {"tag"},
+	"plan":             {"file", "f"},
+	"bugreport":        {"output"},
+	"env":              {"shell"},
+	"queue":            {"listen"},
+	"serve":            {"listen", "jobs"},
+	"self-update":      {"channel"},
+	"tap-new":          {"tap", "url", "version"},
+	"mvp-plan":         {"tap", "output"},
+	"mvp-install":      {"tap", "root", "cache", "jobs", "plan"},
+}
+
+// commandOperands returns the non-flag arguments after the command name,
+// skipping the values of the command's flags.
+func commandOperands(args []string) []string {
+	out := make([]string, 0)
+	valueFlags := commandValueFlags[args[0]]
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return append(out, args[i+1:]...)
+		}
+		if arg == "" {
+			continue
+		}
+		if strings.HasPrefix(arg, "-") {
+			name := strings.TrimLeft(arg, "-")
+			if !strings.Contains(name, "=") && slices.Contains(valueFlags, name) {
+				i++
+			}
+			continue
+		}
+		out = append(out, arg)
+	}
+	return out
+}
+
+var (
+	urlCredentialsPattern = regexp.MustCompile(`://[^/\s:@]+:[^/\s@]+@`)
+	bearerPattern         = regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`)
+)
+
+type sanitizer struct {
+	home string
+}
+
+func (s sanitizer) clean(value string) string {
+	if s.home != "" && s.home != "/" {
+		value = strings.ReplaceAll(value, s.home, "~")
+	}
+	value = urlCredentialsPattern.ReplaceAllString(value, "://[REDACTED]@")
+	return bearerPattern.ReplaceAllString(value, "${1}[REDACTED]")
+}
+
+func writeBundle(path string, files map[string][]byte) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	now := time.Now()
+	for _, name := range names {
+		data := files[name]
+		header := &tar.Header{Name: "ub-bugreport/" + name, Mode: 0o644, Size: int64(len(data)), ModTime: now}
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("write bundle: %w", err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			return fmt.Errorf("write bundle: %w", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("write bundle: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("write bundle: %w", err)
+	}
+	return os.WriteFile(path, buf.Bytes(), 0o644)
+}
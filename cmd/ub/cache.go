@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"ub/internal/native"
+)
+
+func runCache(ctx context.Context, manager *native.Manager, args []string) error {
+	if len(args) == 0 {
+		return usageErrorf("usage: ub cache export DEST <formula|cask...> | export --all DEST | import SRC")
+	}
+	switch args[0] {
+	case "export":
+		fs := flag.NewFlagSet("cache export", flag.ContinueOnError)
+		all := fs.Bool("all", false, "export every cached download")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 || *all != (fs.NArg() == 1) {
+			return usageErrorf("usage: ub cache export DEST <formula|cask...> | export --all DEST")
+		}
+		summary, err := manager.ExportCache(ctx, fs.Arg(0), fs.Args()[1:])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("==> Exported %d cached download(s), %s, to %s\n", len(summary.Entries), humanBytes(summary.Bytes), fs.Arg(0))
+		return nil
+	case "import":
+		if len(args) != 2 {
+			return usageErrorf("usage: ub cache import SRC")
+		}
+		summary, err := manager.ImportCache(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("==> Imported %d cached download(s), %s\n", len(summary.Entries), humanBytes(summary.Bytes))
+		return nil
+	}
+	return usageErrorf("unknown cache command %q", args[0])
+}
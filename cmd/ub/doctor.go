@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"ub/internal/native"
+)
+
+func runDoctor(ctx context.Context, manager *native.Manager, args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	fix := fs.Bool("fix", false, "finish interrupted linking and relink half-linked formulae")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usageErrorf("usage: ub doctor [--fix]")
+	}
+	check := manager.CheckLinks
+	if *fix {
+		check = manager.RepairLinks
+	}
+	report, err := check(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range report.Pending {
+		fmt.Printf("Linking %s was interrupted\n", name)
+	}
+	for _, path := range report.Broken {
+		fmt.Printf("Broken link: %s\n", path)
+	}
+	for _, path := range report.Unlinked {
+		fmt.Printf("Missing or stale link: %s\n", path)
+	}
+	if n := report.Problems(); n > 0 {
+		return fmt.Errorf("found %d link problem(s); run ub doctor --fix", n)
+	}
+	fmt.Println("==> The link farm matches the Cellar")
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ub/internal/apitest"
+	"ub/internal/native"
+)
+
+func setupFixtureE2E(t *testing.T) (*apitest.Server, native.Paths) {
+	t.Helper()
+	tmp := t.TempDir()
+	t.Setenv("UB_BASE_DIR", tmp)
+	t.Setenv("HOME", filepath.Join(tmp, "home"))
+	t.Setenv("XDG_DATA_HOME", filepath.Join(tmp, "home", ".local", "share"))
+	t.Setenv("SHELL", "/bin/zsh")
+	if err := os.MkdirAll(filepath.Join(tmp, "home"), 0o755); err != nil {
+		t.Fatalf("mkdir home: %v", err)
+	}
+	server := apitest.New(t)
+	server.Setenv(t)
+	return server, native.DefaultPaths()
+}
+
+func TestE2E_FixtureInstallUpgradeUninstall(t *testing.T) {
+	server, paths := setupFixtureE2E(t)
+	ctx := context.Background()
+
+	// An older keg makes hello outdated against the fixture's 2.12.2.
+	oldKeg := filepath.Join(paths.Cellar, "hello", "2.12.1")
+	if err := os.MkdirAll(filepath.Join(oldKeg, "bin"), 0o755); err != nil {
+		t.Fatalf("mkdir old keg: %v", err)
+	}
+
+	out, err := captureStdout(func() error { return run(ctx, []string{"upgrade", "hello"}) })
+	if err != nil {
+		t.Fatalf("run upgrade: %v\n%s", err, out)
+	}
+	for _, keg := range []string{filepath.Join(paths.Cellar, "hello", "2.12.2", "bin", "hello"), filepath.Join(paths.Cellar, "libgreet", "1.0", "lib", "libgreet.txt")} {
+		if _, err := os.Stat(keg); err != nil {
+			t.Fatalf("expected %s poured: %v", keg, err)
+		}
+	}
+	if _, err := os.Readlink(filepath.Join(paths.Bin, "hello")); err != nil {
+		t.Fatalf("expected hello linked: %v", err)
+	}
+
+	out, err = captureStdout(func() error { return run(ctx, []string{"install", "hello"}) })
+	if err != nil {
+		t.Fatalf("run install: %v", err)
+	}
+	if !strings.Contains(out, "already installed") {
+		t.Fatalf("expected already installed, got:\n%s", out)
+	}
+	if hits := server.Hits("/bottles/hello.tar.gz"); hits != 1 {
+		t.Fatalf("hello bottle downloaded %d times, want 1", hits)
+	}
+
+	if _, err := captureStdout(func() error { return run(ctx, []string{"uninstall", "--force", "hello"}) }); err != nil {
+		t.Fatalf("run uninstall: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(paths.Cellar, "hello")); !os.IsNotExist(err) {
+		t.Fatalf("expected hello removed, got err=%v", err)
+	}
+}
+
+func TestE2E_FixtureCaskInstallAndUninstall(t *testing.T) {
+	_, paths := setupFixtureE2E(t)
+	ctx := context.Background()
+
+	if out, err := captureStdout(func() error { return run(ctx, []string{"install", "greeter"}) }); err != nil {
+		t.Fatalf("run install: %v\n%s", err, out)
+	}
+	appPath := filepath.Join(paths.Applications, "Greeter.app")
+	if _, err := os.Stat(filepath.Join(appPath, "Contents", "Info.plist")); err != nil {
+		t.Fatalf("expected app installed: %v", err)
+	}
+	if _, err := os.Readlink(filepath.Join(paths.Bin, "greeter")); err != nil {
+		t.Fatalf("expected greeter binary linked: %v", err)
+	}
+	settingsPath := filepath.Join(paths.Applications, "Greeter Settings.app")
+	if _, err := os.Stat(filepath.Join(settingsPath, "Contents", "Info.plist")); err != nil {
+		t.Fatalf("expected second app installed under its target name: %v", err)
+	}
+
+	if _, err := captureStdout(func() error { return run(ctx, []string{"uninstall", "--permanent", "greeter"}) }); err != nil {
+		t.Fatalf("run uninstall: %v", err)
+	}
+	if _, err := os.Stat(appPath); !os.IsNotExist(err) {
+		t.Fatalf("expected app removed, got err=%v", err)
+	}
+	if _, err := os.Stat(settingsPath); !os.IsNotExist(err) {
+		t.Fatalf("expected second app removed, got err=%v", err)
+	}
+	if _, err := os.Stat(filepath.Join(paths.Caskroom, "greeter")); !os.IsNotExist(err) {
+		t.Fatalf("expected caskroom entry removed, got err=%v", err)
+	}
+}
+
+func TestE2E_FixtureBrewCaskFlag(t *testing.T) {
+	_, paths := setupFixtureE2E(t)
+	ctx := context.Background()
+
+	if out, err := captureStdout(func() error { return run(ctx, []string{"brew", "install", "--cask", "hello"}) }); err == nil {
+		t.Fatalf("brew install --cask hello should not install the formula\n%s", out)
+	}
+	if _, err := os.Stat(filepath.Join(paths.Cellar, "hello")); !os.IsNotExist(err) {
+		t.Fatalf("hello formula installed for --cask: %v", err)
+	}
+	if out, err := captureStdout(func() error { return run(ctx, []string{"brew", "install", "--cask", "greeter"}) }); err != nil {
+		t.Fatalf("run brew install --cask: %v\n%s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(paths.Caskroom, "greeter")); err != nil {
+		t.Fatalf("expected greeter cask installed: %v", err)
+	}
+	if _, err := captureStdout(func() error { return run(ctx, []string{"uninstall", "--formula", "greeter"}) }); exitCodeFor(err) != exitNotFound {
+		t.Fatalf("uninstall --formula greeter = %v, want not installed", err)
+	}
+	if _, err := captureStdout(func() error { return run(ctx, []string{"brew", "uninstall", "--cask", "greeter"}) }); err != nil {
+		t.Fatalf("run brew uninstall --cask: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(paths.Caskroom, "greeter")); !os.IsNotExist(err) {
+		t.Fatalf("expected caskroom entry removed, got err=%v", err)
+	}
+}
+
+func TestE2E_FixtureFontCaskInstallAndUninstall(t *testing.T) {
+	_, paths := setupFixtureE2E(t)
+	ctx := context.Background()
+
+	if out, err := captureStdout(func() error { return run(ctx, []string{"install", "font-greeter"}) }); err != nil {
+		t.Fatalf("run install: %v\n%s", err, out)
+	}
+	font := filepath.Join(paths.Fonts, "Greeter-Regular.ttf")
+	if _, err := os.Stat(font); err != nil {
+		t.Fatalf("expected font installed: %v", err)
+	}
+
+	if _, err := captureStdout(func() error { return run(ctx, []string{"uninstall", "font-greeter"}) }); err != nil {
+		t.Fatalf("run uninstall: %v", err)
+	}
+	if _, err := os.Stat(font); !os.IsNotExist(err) {
+		t.Fatalf("expected font removed, got err=%v", err)
+	}
+}
+
+func TestE2E_FixtureInstallFromFile(t *testing.T) {
+	_, paths := setupFixtureE2E(t)
+	ctx := context.Background()
+
+	list := filepath.Join(t.TempDir(), "packages.txt")
+	if err := os.WriteFile(list, []byte("# command line tools\nhello\n\n--cask greeter  # the app\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := captureStdout(func() error { return run(ctx, []string{"install", "--file", list}) }); err != nil {
+		t.Fatalf("run install --file: %v\n%s", err, out)
+	}
+	for _, path := range []string{
+		filepath.Join(paths.Cellar, "hello", "2.12.2", "bin", "hello"),
+		filepath.Join(paths.Applications, "Greeter.app", "Contents", "Info.plist"),
+	} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("expected %s installed: %v", path, err)
+		}
+	}
+}
+
+func TestE2E_FixtureOnlyDependenciesAreNotRequested(t *testing.T) {
+	_, paths := setupFixtureE2E(t)
+	ctx := context.Background()
+
+	if out, err := captureStdout(func() error { return run(ctx, []string{"install", "--only-dependencies", "hello"}) }); err != nil {
+		t.Fatalf("run install --only-dependencies: %v\n%s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(paths.Cellar, "hello")); !os.IsNotExist(err) {
+		t.Fatalf("hello should not be installed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(paths.Cellar, "libgreet", "1.0", "INSTALL_RECEIPT.json"))
+	if err != nil {
+		t.Fatalf("read libgreet receipt: %v", err)
+	}
+	var receipt struct {
+		InstalledOnRequest bool `json:"installed_on_request"`
+	}
+	if err := json.Unmarshal(data, &receipt); err != nil {
+		t.Fatal(err)
+	}
+	if receipt.InstalledOnRequest {
+		t.Fatal("libgreet was installed as a dependency but recorded as installed on request")
+	}
+}
+
+func TestE2E_FixturePlanReportsDrift(t *testing.T) {
+	setupFixtureE2E(t)
+	ctx := context.Background()
+
+	manifest := filepath.Join(t.TempDir(), "manifest.json")
+	if err := os.WriteFile(manifest, []byte(`{"formulae": ["hello"]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := captureStdout(func() error { return run(ctx, []string{"plan", "--json", "-f", manifest}) })
+	if exitCodeFor(err) != exitDrift {
+		t.Fatalf("run plan before install: %v\n%s", err, out)
+	}
+	var actions []native.PlanAction
+	if err := json.Unmarshal([]byte(out), &actions); err != nil {
+		t.Fatalf("decode plan output: %v\n%s", err, out)
+	}
+	if len(actions) != 1 || actions[0].Action != "install" || actions[0].Name != "hello" || actions[0].To != "2.12.2" {
+		t.Fatalf("actions = %+v", actions)
+	}
+
+	if out, err := captureStdout(func() error { return run(ctx, []string{"install", "hello"}) }); err != nil {
+		t.Fatalf("run install: %v\n%s", err, out)
+	}
+	if out, err := captureStdout(func() error { return run(ctx, []string{"plan", "-f", manifest}) }); err != nil || !strings.Contains(out, "Everything matches") {
+		t.Fatalf("run plan after install: %v\n%s", err, out)
+	}
+}
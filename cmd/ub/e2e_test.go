@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"os"
@@ -63,7 +64,7 @@ func TestE2E_ResetRemovesCaskAndCache(t *testing.T) {
 		t.Fatalf("write cache file: %v", err)
 	}
 
-	if _, err := captureStdout(func() error { return run([]string{"reset"}) }); err != nil {
+	if _, err := captureStdout(func() error { return run(context.Background(), []string{"reset"}) }); err != nil {
 		t.Fatalf("run reset: %v", err)
 	}
 
@@ -93,7 +94,7 @@ func TestE2E_ListAndPrefix(t *testing.T) {
 		t.Fatalf("mkdir hello: %v", err)
 	}
 
-	listOut, err := captureStdout(func() error { return run([]string{"list"}) })
+	listOut, err := captureStdout(func() error { return run(context.Background(), []string{"list"}) })
 	if err != nil {
 		t.Fatalf("run list: %v", err)
 	}
@@ -101,7 +102,7 @@ func TestE2E_ListAndPrefix(t *testing.T) {
 		t.Fatalf("list output missing formulas: %q", listOut)
 	}
 
-	prefixOut, err := captureStdout(func() error { return run([]string{"prefix", "hello"}) })
+	prefixOut, err := captureStdout(func() error { return run(context.Background(), []string{"prefix", "hello"}) })
 	if err != nil {
 		t.Fatalf("run prefix: %v", err)
 	}
@@ -111,6 +112,27 @@ func TestE2E_ListAndPrefix(t *testing.T) {
 	}
 }
 
+func TestE2E_ReadOnlyCommandsLeavePrefixAlone(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("UB_BASE_DIR", tmp)
+	t.Setenv("UB_NO_STATS", "1")
+
+	paths := native.DefaultPaths()
+	if err := os.MkdirAll(filepath.Join(paths.Cellar, "hello", "2.12.2"), 0o755); err != nil {
+		t.Fatalf("mkdir hello: %v", err)
+	}
+	for _, args := range [][]string{{"list"}, {"prefix"}, {"config"}} {
+		if _, err := captureStdout(func() error { return run(context.Background(), args) }); err != nil {
+			t.Fatalf("run %v: %v", args, err)
+		}
+	}
+	for _, dir := range []string{paths.Bin, paths.Caskroom, paths.Repo} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Fatalf("read-only commands created %s", dir)
+		}
+	}
+}
+
 func captureStdout(fn func() error) (string, error) {
 	old := os.Stdout
 	r, w, err := os.Pipe()
@@ -129,3 +151,87 @@ func captureStdout(fn func() error) (string, error) {
 	}
 	return string(data), runErr
 }
+
+func TestE2E_ExternalCommandDispatch(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("UB_BASE_DIR", tmp)
+	binDir := filepath.Join(tmp, "plugins")
+	if err := os.MkdirAll(binDir, 0o755); err != nil {
+		t.Fatalf("mkdir plugins: %v", err)
+	}
+	script := "#!/bin/sh\necho \"hello $1 from $UB_PREFIX\"\n"
+	if err := os.WriteFile(filepath.Join(binDir, "ub-hello"), []byte(script), 0o755); err != nil {
+		t.Fatalf("write plugin: %v", err)
+	}
+	failing := "#!/bin/sh\nexit 7\n"
+	if err := os.WriteFile(filepath.Join(binDir, "ub-fail"), []byte(failing), 0o755); err != nil {
+		t.Fatalf("write failing plugin: %v", err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	out, err := captureStdout(func() error { return run(context.Background(), []string{"hello", "world"}) })
+	if err != nil {
+		t.Fatalf("run hello: %v", err)
+	}
+	want := "hello world from " + native.DefaultPaths().Prefix
+	if strings.TrimSpace(out) != want {
+		t.Fatalf("external output = %q, want %q", strings.TrimSpace(out), want)
+	}
+
+	_, err = captureStdout(func() error { return run(context.Background(), []string{"fail"}) })
+	if code := exitCodeFor(err); code != 7 {
+		t.Fatalf("exit code = %d, want 7 (err=%v)", code, err)
+	}
+
+	listing, err := captureStdout(func() error { return run(context.Background(), []string{"commands", "--quiet"}) })
+	if err != nil {
+		t.Fatalf("run commands: %v", err)
+	}
+	for _, name := range []string{"install", "hello", "fail"} {
+		if !strings.Contains(listing, name+"\n") {
+			t.Fatalf("commands output missing %q: %q", name, listing)
+		}
+	}
+}
+
+func TestE2E_StatsRecordsCommands(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("UB_BASE_DIR", tmp)
+
+	if _, err := captureStdout(func() error { return run(context.Background(), []string{"list"}) }); err != nil {
+		t.Fatalf("run list: %v", err)
+	}
+	out, err := captureStdout(func() error { return run(context.Background(), []string{"stats"}) })
+	if err != nil {
+		t.Fatalf("run stats: %v", err)
+	}
+	if !strings.Contains(out, "list") || !strings.Contains(out, "Cache hit rate") {
+		t.Fatalf("stats output missing entries: %q", out)
+	}
+}
+
+func TestE2E_HistoryRecordsVersionChanges(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("UB_BASE_DIR", tmp)
+
+	paths := native.DefaultPaths()
+	versionDir := filepath.Join(paths.Caskroom, "cursor", "1.0.0")
+	if err := os.MkdirAll(versionDir, 0o755); err != nil {
+		t.Fatalf("mkdir version dir: %v", err)
+	}
+	receipt := `{"token":"cursor","version":"1.0.0"}`
+	if err := os.WriteFile(filepath.Join(versionDir, "INSTALL_RECEIPT.json"), []byte(receipt), 0o644); err != nil {
+		t.Fatalf("write receipt: %v", err)
+	}
+
+	if _, err := captureStdout(func() error { return run(context.Background(), []string{"reset"}) }); err != nil {
+		t.Fatalf("run reset: %v", err)
+	}
+	out, err := captureStdout(func() error { return run(context.Background(), []string{"history", "cursor"}) })
+	if err != nil {
+		t.Fatalf("run history: %v", err)
+	}
+	if !strings.Contains(out, "ub reset") || !strings.Contains(out, "- cursor (cask) 1.0.0") {
+		t.Fatalf("history output missing reset entry: %q", out)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"ub/internal/native"
+)
+
+// workspaceFor picks the project-local prefix a command runs against:
+// --prefix, then the one `ub env` activated, then the nearest .ub directory
+// above the working directory. A tree chosen with UB_BASE_DIR or UB_PREFIX
+// is not swapped for a discovered one.
+func workspaceFor(opts globalOptions) string {
+	if opts.prefix != "" {
+		return opts.prefix
+	}
+	if dir := strings.TrimSpace(os.Getenv("UB_WORKSPACE")); dir != "" {
+		return dir
+	}
+	if strings.TrimSpace(os.Getenv("UB_BASE_DIR")) != "" || strings.TrimSpace(os.Getenv("UB_PREFIX")) != "" {
+		return ""
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	dir, _ := native.FindWorkspace(cwd)
+	return dir
+}
+
+func runEnv(manager *native.Manager, args []string) error {
+	fs := flag.NewFlagSet("env", flag.ContinueOnError)
+	initialize := fs.Bool("init", false, "create ./.ub when no workspace is active")
+	unset := fs.Bool("unset", false, "print the commands that deactivate the workspace")
+	shell := fs.String("shell", filepath.Base(os.Getenv("SHELL")), "shell to print commands for (sh or fish)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageErrorf("usage: ub env [--init] [--unset] [--shell sh|fish]")
+	}
+	dir := manager.Workspace
+	if dir == "" {
+		if !*initialize || *unset {
+			return fmt.Errorf("no workspace here; run `ub env --init` to create %s, or pass --prefix DIR", native.WorkspaceDir)
+		}
+		dir = native.WorkspaceDir
+	}
+	paths := native.PathsForWorkspace(manager.Paths, dir)
+	if *initialize {
+		if err := os.MkdirAll(paths.Prefix, 0o755); err != nil {
+			return err
+		}
+	}
+	for _, line := range envLines(*shell, paths, !*unset, os.Getenv("PATH"), os.Getenv("UB_WORKSPACE")) {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// envLines are the shell commands that activate the workspace at paths, or
+// deactivate it. Either way PATH loses the link farm of the workspace and
+// of previous, the one active before, so running them twice changes
+// nothing.
+func envLines(shell string, paths native.Paths, activate bool, pathValue, previous string) []string {
+	drop := []string{paths.Bin, paths.Sbin}
+	if previous != "" {
+		prev := native.PathsForWorkspace(paths, previous)
+		drop = append(drop, prev.Bin, prev.Sbin)
+	}
+	var entries []string
+	if activate {
+		entries = append(entries, paths.Bin, paths.Sbin)
+	}
+	for _, entry := range filepath.SplitList(pathValue) {
+		if entry != "" && !slices.Contains(drop, entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	if shell == "fish" {
+		quoted := make([]string, len(entries))
+		for i, entry := range entries {
+			quoted[i] = shellQuote(entry)
+		}
+		lines := []string{"set -e UB_WORKSPACE"}
+		if activate {
+			lines = []string{"set -gx UB_WORKSPACE " + shellQuote(paths.Prefix)}
+		}
+		return append(lines, "set -gx PATH "+strings.Join(quoted, " "))
+	}
+	lines := []string{"unset UB_WORKSPACE"}
+	if activate {
+		lines = []string{"export UB_WORKSPACE=" + shellQuote(paths.Prefix)}
+	}
+	return append(lines, "export PATH="+shellQuote(strings.Join(entries, string(filepath.ListSeparator))))
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
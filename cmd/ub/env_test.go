@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"ub/internal/native"
+)
+
+func TestWorkspaceIsIsolatedAndSharesDownloads(t *testing.T) {
+	server, paths := setupFixtureE2E(t)
+	ctx := context.Background()
+	workspace := filepath.Join(t.TempDir(), native.WorkspaceDir)
+
+	if _, err := captureStdout(func() error { return run(ctx, []string{"--prefix", workspace, "install", "libgreet"}) }); err != nil {
+		t.Fatalf("install into workspace: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(workspace, "Cellar", "libgreet", "1.0")); err != nil {
+		t.Fatalf("expected libgreet in the workspace Cellar: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(paths.Cellar, "libgreet")); !os.IsNotExist(err) {
+		t.Fatalf("expected the global Cellar untouched, got %v", err)
+	}
+
+	t.Setenv("UB_WORKSPACE", workspace)
+	out, err := captureStdout(func() error { return run(ctx, []string{"list"}) })
+	if err != nil || !strings.Contains(out, "libgreet") {
+		t.Fatalf("list in the activated workspace = %q, %v", out, err)
+	}
+
+	t.Setenv("UB_WORKSPACE", "")
+	out, err = captureStdout(func() error { return run(ctx, []string{"list"}) })
+	if err != nil || strings.Contains(out, "libgreet") {
+		t.Fatalf("global list = %q, %v; want no libgreet", out, err)
+	}
+	if _, err := captureStdout(func() error { return run(ctx, []string{"install", "libgreet"}) }); err != nil {
+		t.Fatalf("global install: %v", err)
+	}
+	if hits := server.Hits("/bottles/libgreet.tar.gz"); hits != 1 {
+		t.Fatalf("libgreet downloaded %d times, want 1 from the shared cache", hits)
+	}
+}
+
+func TestParseGlobalPrefixOnlyBeforeCommand(t *testing.T) {
+	opts, rest, err := parseGlobalFlags([]string{"--prefix=./.ub", "install", "jq"})
+	if err != nil || opts.prefix != "./.ub" || !reflect.DeepEqual(rest, []string{"install", "jq"}) {
+		t.Fatalf("--prefix=./.ub parsed as %q, rest %q, %v", opts.prefix, rest, err)
+	}
+	opts, rest, err = parseGlobalFlags([]string{"brew", "--prefix", "jq"})
+	if err != nil || opts.prefix != "" || !reflect.DeepEqual(rest, []string{"brew", "--prefix", "jq"}) {
+		t.Fatalf("brew --prefix parsed as %q, rest %q, %v", opts.prefix, rest, err)
+	}
+	if _, _, err := parseGlobalFlags([]string{"--prefix"}); exitCodeFor(err) != exitUsage {
+		t.Fatalf("expected --prefix without a directory to be a usage error, got %v", err)
+	}
+}
+
+func TestEnvLines(t *testing.T) {
+	paths := native.PathsForWorkspace(native.Paths{}, "/src/app/.ub")
+	pathValue := "/src/app/.ub/bin:/usr/bin:/src/old/.ub/sbin:/bin"
+
+	got := envLines("zsh", paths, true, pathValue, "/src/old/.ub")
+	want := []string{
+		"export UB_WORKSPACE='/src/app/.ub'",
+		"export PATH='/src/app/.ub/bin:/src/app/.ub/sbin:/usr/bin:/bin'",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("activate = %q, want %q", got, want)
+	}
+	got = envLines("fish", paths, false, pathValue, "/src/app/.ub")
+	want = []string{"set -e UB_WORKSPACE", "set -gx PATH '/usr/bin' '/src/old/.ub/sbin' '/bin'"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("deactivate = %q, want %q", got, want)
+	}
+}
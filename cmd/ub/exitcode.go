@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"ub/internal/fetch"
+	"ub/internal/homebrewapi"
+	"ub/internal/lock"
+	"ub/internal/native"
+)
+
+// Exit codes are part of ub's scripting contract; keep README.md in sync.
+const (
+	exitOK          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitDrift       = 3
+	exitNotFound    = 4
+	exitNetwork     = 8
+	exitChecksum    = 16
+	exitLockHeld    = 32
+	exitPartial     = 64
+	exitTimeout     = 124
+	exitInterrupted = 130
+)
+
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string { return e.msg }
+
+// errDrift is returned by ub plan when the machine does not match the
+// manifest, so CI can fail on drift.
+var errDrift = errors.New("installed packages differ from the manifest")
+
+// timeoutError is a command that --timeout cut short.
+type timeoutError struct {
+	after time.Duration
+	err   error
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s: %v", e.after, e.err)
+}
+
+func (e *timeoutError) Unwrap() error { return e.err }
+
+func usageErrorf(format string, args ...any) error {
+	return &usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+func exitCodeFor(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	if errors.Is(err, context.Canceled) {
+		return exitInterrupted
+	}
+	var timeout *timeoutError
+	if errors.As(err, &timeout) {
+		return exitTimeout
+	}
+	var external *externalExitError
+	if errors.As(err, &external) {
+		return external.code
+	}
+	var partial *native.PartialError
+	if errors.As(err, &partial) {
+		return exitPartial
+	}
+	var usage *usageError
+	if errors.As(err, &usage) {
+		return exitUsage
+	}
+	if errors.Is(err, homebrewapi.ErrInvalidName) {
+		return exitUsage
+	}
+	if errors.Is(err, errDrift) || errors.Is(err, native.ErrStateDiverged) {
+		return exitDrift
+	}
+	if errors.Is(err, lock.ErrLocked) {
+		return exitLockHeld
+	}
+	if errors.Is(err, native.ErrChecksumMismatch) {
+		return exitChecksum
+	}
+	if errors.Is(err, native.ErrNotInstalled) || errors.Is(err, native.ErrUnknownGroup) {
+		return exitNotFound
+	}
+	var statusErr *fetch.StatusError
+	if errors.As(err, &statusErr) {
+		if statusErr.StatusCode == 404 {
+			return exitNotFound
+		}
+		return exitNetwork
+	}
+	var networkErr *fetch.NetworkError
+	if errors.As(err, &networkErr) {
+		return exitNetwork
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return exitNetwork
+	}
+	return exitFailure
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"ub/internal/config"
+	"ub/internal/native"
+)
+
+const externalCommandPrefix = "ub-"
+
+var builtinCommands = []string{
+	"install", "upgrade", "apply", "plan", "verify-downloads", "cache", "state", "doctor", "bugreport", "self-update", "unbottled", "reset", "uninstall", "list", "search", "info", "update",
+	"prefix", "which", "config", "env", "alias", "commands", "stats", "history", "snapshot", "generations", "serve", "queue", "autoupdate", "pin-tap", "unpin-tap", "tap-new", "tap", "brew", "mvp-plan", "mvp-install", "help", "version",
+}
+
+type externalExitError struct {
+	name string
+	code int
+}
+
+func (e *externalExitError) Error() string {
+	return fmt.Sprintf("external command %q exited with status %d", e.name, e.code)
+}
+
+func findExternalCommand(name string) (string, bool) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, "-") {
+		return "", false
+	}
+	path, err := exec.LookPath(externalCommandPrefix + name)
+	if err != nil {
+		return "", false
+	}
+	return path, true
+}
+
+func runExternalCommand(ctx context.Context, manager *native.Manager, name, path string, args []string) error {
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), externalCommandEnv(manager)...)
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+			return &externalExitError{name: name, code: exitErr.ExitCode()}
+		}
+		return fmt.Errorf("run external command %q: %w", name, err)
+	}
+	return nil
+}
+
+func externalCommandEnv(manager *native.Manager) []string {
+	env := []string{
+		"UB_PREFIX=" + manager.Paths.Prefix,
+		"UB_REPOSITORY=" + manager.Paths.Repo,
+		"UB_CELLAR=" + manager.Paths.Cellar,
+		"UB_CASKROOM=" + manager.Paths.Caskroom,
+		"UB_CACHE=" + manager.Paths.Cache,
+	}
+	if manager.Workspace != "" {
+		env = append(env, "UB_WORKSPACE="+manager.Workspace)
+	}
+	if self, err := os.Executable(); err == nil {
+		env = append(env, "UB_EXECUTABLE="+self)
+	}
+	return env
+}
+
+func discoverExternalCommands(pathValue string) []string {
+	seen := map[string]bool{}
+	for _, name := range builtinCommands {
+		seen[name] = true
+	}
+	out := make([]string, 0)
+	for _, dir := range filepath.SplitList(pathValue) {
+		if strings.TrimSpace(dir) == "" {
+			continue
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			fileName := entry.Name()
+			if !strings.HasPrefix(fileName, externalCommandPrefix) || entry.IsDir() {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || info.Mode()&0o111 == 0 {
+				continue
+			}
+			name := strings.TrimSuffix(strings.TrimPrefix(fileName, externalCommandPrefix), filepath.Ext(fileName))
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// unknownCommand is the error for a command that is neither built in, an
+// alias nor external, suggesting those spelled like it.
+func unknownCommand(name string) error {
+	candidates := append(append([]string(nil), builtinCommands...), discoverExternalCommands(os.Getenv("PATH"))...)
+	if cfg, err := config.Load(config.DefaultPath()); err == nil {
+		for alias := range cfg.Aliases {
+			candidates = append(candidates, alias)
+		}
+	}
+	if suggestions := native.Suggest(name, candidates); len(suggestions) > 0 {
+		return usageErrorf("unknown command %q; did you mean %s?", name, strings.Join(suggestions, " or "))
+	}
+	return usageErrorf("unknown command %q; run ub commands to list them", name)
+}
+
+func runCommands(args []string) error {
+	quiet := len(args) > 0 && (args[0] == "--quiet" || args[0] == "-q")
+	builtins := append([]string(nil), builtinCommands...)
+	sort.Strings(builtins)
+	externals := discoverExternalCommands(os.Getenv("PATH"))
+	if quiet {
+		for _, name := range append(builtins, externals...) {
+			fmt.Println(name)
+		}
+		return nil
+	}
+	fmt.Println("==> Built-in commands")
+	for _, name := range builtins {
+		fmt.Println(name)
+	}
+	if len(externals) > 0 {
+		fmt.Println("")
+		fmt.Println("==> External commands")
+		for _, name := range externals {
+			fmt.Println(name)
+		}
+	}
+	return nil
+}
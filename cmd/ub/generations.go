@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"ub/internal/native"
+)
+
+// generationCommand reports whether args change the link farm and so get a
+// new generation in generation mode.
+func generationCommand(args []string) bool {
+	switch args[0] {
+	case "install", "i", "upgrade", "apply", "uninstall", "remove", "rm", "reset":
+		return true
+	case "snapshot":
+		return len(args) > 1 && args[1] == "restore"
+	}
+	return false
+}
+
+// finishGeneration commits the generation when the command changed anything
+// worth keeping, and discards it otherwise.
+func finishGeneration(manager *native.Manager, err error) error {
+	var partial *native.PartialError
+	keep := err == nil || errors.As(err, &partial)
+	if commitErr := manager.CommitGeneration(keep); commitErr != nil && err == nil {
+		return commitErr
+	}
+	return err
+}
+
+func runGenerations(manager *native.Manager, args []string) error {
+	if len(args) == 0 || args[0] == "list" || args[0] == "ls" {
+		gens, err := manager.Generations()
+		if err != nil {
+			return err
+		}
+		for _, line := range generationLines(gens) {
+			fmt.Println(line)
+		}
+		return nil
+	}
+	if args[0] != "rollback" || len(args) > 2 {
+		return usageErrorf("usage: ub generations [list] | rollback [N]")
+	}
+	number := 0
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			return usageErrorf("invalid generation %q", args[1])
+		}
+		number = n
+	}
+	gen, err := manager.RollbackGeneration(number)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("==> Switched to generation %d (%s)\n", gen.Number, gen.Command)
+	return nil
+}
+
+func generationLines(gens []native.Generation) []string {
+	if len(gens) == 0 {
+		return []string{`No generations; set "generations": true in the config to enable them`}
+	}
+	lines := make([]string, 0, len(gens))
+	for _, gen := range gens {
+		marker := " "
+		if gen.Current {
+			marker = "*"
+		}
+		lines = append(lines, strings.TrimRight(fmt.Sprintf("%s %4d  %s  %s", marker, gen.Number, gen.Created.Local().Format(time.DateTime), gen.Command), " "))
+	}
+	return lines
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"ub/internal/messages"
+	"ub/internal/native"
+)
+
+// expandGroups replaces each @group in args with its members, keeping the
+// first mention of a package, and returns the groups it expanded.
+func expandGroups(manager *native.Manager, args []string) (names []string, groups map[string][]string, err error) {
+	groups = map[string][]string{}
+	add := func(name string) {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	for _, arg := range args {
+		group, ok := native.GroupName(arg)
+		if !ok {
+			add(arg)
+			continue
+		}
+		members, err := manager.GroupMembers(group)
+		if err != nil {
+			return nil, nil, err
+		}
+		groups[group] = members
+		for _, member := range members {
+			add(member)
+		}
+	}
+	return names, groups, nil
+}
+
+// installedNames lists every installed formula and cask.
+func installedNames(manager *native.Manager) ([]string, error) {
+	formulae, casks, err := manager.InstalledVersions()
+	if err != nil {
+		return nil, err
+	}
+	return append(slices.Collect(maps.Keys(formulae)), slices.Collect(maps.Keys(casks))...), nil
+}
+
+// newMembers drops the members that were installed before the group was,
+// so uninstalling the group leaves them alone.
+func newMembers(members, preinstalled []string) []string {
+	out := make([]string, 0, len(members))
+	for _, member := range members {
+		if !slices.Contains(preinstalled, member) {
+			out = append(out, member)
+		}
+	}
+	return out
+}
+
+// groupRemovals is expandGroups for uninstall: a group stands for what it
+// was installed with, less what another installed group still holds.
+func groupRemovals(manager *native.Manager, args []string) (names, groups []string, err error) {
+	for _, arg := range args {
+		group, ok := native.GroupName(arg)
+		if !ok {
+			if !slices.Contains(names, arg) {
+				names = append(names, arg)
+			}
+			continue
+		}
+		remove, shared, err := manager.GroupRemoval(group)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(shared) > 0 {
+			fmt.Fprintln(os.Stderr, messages.Sprintf(messages.Warning, fmt.Sprintf("keeping %s: also in another installed group", strings.Join(shared, ", "))))
+		}
+		groups = append(groups, group)
+		for _, name := range remove {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names, groups, nil
+}
+
+func runListGroups(manager *native.Manager) error {
+	groups, err := manager.InstalledGroups()
+	if err != nil {
+		return err
+	}
+	formulae, casks, err := manager.InstalledVersions()
+	if err != nil {
+		return err
+	}
+	for _, line := range groupLines(groups, formulae, casks) {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// groupLines lists each installed group and its members, marking members
+// that have since been uninstalled.
+func groupLines(groups []native.InstalledGroup, formulae, casks map[string]string) []string {
+	lines := make([]string, 0)
+	for _, g := range groups {
+		lines = append(lines, fmt.Sprintf("==> @%s", g.Name))
+		for _, member := range g.Members {
+			_, isFormula := formulae[member]
+			_, isCask := casks[member]
+			switch {
+			case isFormula || isCask:
+				lines = append(lines, member)
+			default:
+				lines = append(lines, member+" (not installed)")
+			}
+		}
+	}
+	return lines
+}
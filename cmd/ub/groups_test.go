@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"ub/internal/config"
+	"ub/internal/native"
+)
+
+func TestGroupInstallAndUninstall(t *testing.T) {
+	_, paths := setupFixtureE2E(t)
+	ctx := context.Background()
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	t.Setenv("UB_CONFIG", configPath)
+	data, err := json.Marshal(config.Config{Groups: map[string][]string{
+		"greet": {"hello", "greeter"},
+		"tools": {"greeter"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(configPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := captureStdout(func() error { return run(ctx, []string{"install", "@greet", "@tools"}) }); err != nil {
+		t.Fatalf("install groups: %v", err)
+	}
+	for _, dir := range []string{filepath.Join(paths.Cellar, "hello"), filepath.Join(paths.Caskroom, "greeter")} {
+		if _, err := os.Stat(dir); err != nil {
+			t.Fatalf("expected %s installed: %v", dir, err)
+		}
+	}
+	out, err := captureStdout(func() error { return run(ctx, []string{"list", "--groups"}) })
+	if want := "==> @greet\ngreeter\nhello\n==> @tools\ngreeter\n"; err != nil || out != want {
+		t.Fatalf("list --groups = %q, %v; want %q", out, err, want)
+	}
+
+	if _, err := captureStdout(func() error { return run(ctx, []string{"uninstall", "@greet"}) }); err != nil {
+		t.Fatalf("uninstall group: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(paths.Cellar, "hello")); !os.IsNotExist(err) {
+		t.Fatalf("expected hello removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(paths.Caskroom, "greeter")); err != nil {
+		t.Fatalf("expected greeter kept for @tools: %v", err)
+	}
+	out, err = captureStdout(func() error { return run(ctx, []string{"list", "--groups"}) })
+	if want := "==> @tools\ngreeter\n"; err != nil || out != want {
+		t.Fatalf("list --groups after uninstall = %q, %v; want %q", out, err, want)
+	}
+
+	if err := run(ctx, []string{"install", "@nope"}); exitCodeFor(err) != exitNotFound {
+		t.Fatalf("expected an unknown group to be not found, got %v", err)
+	}
+}
+
+func TestGroupUninstallKeepsMembersInstalledBefore(t *testing.T) {
+	_, paths := setupFixtureE2E(t)
+	ctx := context.Background()
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	t.Setenv("UB_CONFIG", configPath)
+	data, err := json.Marshal(config.Config{Groups: map[string][]string{"greet": {"hello", "greeter"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(configPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := captureStdout(func() error { return run(ctx, []string{"install", "hello"}) }); err != nil {
+		t.Fatalf("install hello: %v", err)
+	}
+	if _, err := captureStdout(func() error { return run(ctx, []string{"install", "@greet"}) }); err != nil {
+		t.Fatalf("install group: %v", err)
+	}
+	if _, err := captureStdout(func() error { return run(ctx, []string{"uninstall", "@greet"}) }); err != nil {
+		t.Fatalf("uninstall group: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(paths.Cellar, "hello")); err != nil {
+		t.Fatalf("expected hello, installed before the group, kept: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(paths.Caskroom, "greeter")); !os.IsNotExist(err) {
+		t.Fatalf("expected greeter removed, got %v", err)
+	}
+}
+
+func TestGroupLines(t *testing.T) {
+	groups := []native.InstalledGroup{{Name: "media", Members: []string{"ffmpeg", "vlc", "x265"}}}
+	got := groupLines(groups, map[string]string{"ffmpeg": "7.0"}, map[string]string{"vlc": "3.0"})
+	want := []string{"==> @media", "ffmpeg", "vlc", "x265 (not installed)"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("groupLines() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"ub/internal/history"
+	"ub/internal/messages"
+	"ub/internal/native"
+)
+
+// historyCommands change the installed set and are recorded in the history log.
+var historyCommands = map[string]bool{
+	"install": true, "i": true, "upgrade": true, "apply": true, "uninstall": true,
+	"remove": true, "rm": true, "reset": true, "snapshot": true,
+}
+
+type installedSnapshot struct {
+	formulae map[string]string
+	casks    map[string]string
+}
+
+func snapshotForHistory(manager *native.Manager, command string) *installedSnapshot {
+	if !historyCommands[command] {
+		return nil
+	}
+	formulae, casks, err := manager.InstalledVersions()
+	if err != nil {
+		return nil
+	}
+	return &installedSnapshot{formulae: formulae, casks: casks}
+}
+
+func recordHistory(manager *native.Manager, before *installedSnapshot, args []string, start time.Time, err error) {
+	if before == nil {
+		return
+	}
+	entry := history.Entry{
+		Time:       start.UTC(),
+		Command:    args[0],
+		Args:       args[1:],
+		DurationMS: time.Since(start).Milliseconds(),
+		Success:    err == nil,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if formulae, casks, snapErr := manager.InstalledVersions(); snapErr == nil {
+		entry.Changes = append(history.Diff(before.formulae, formulae, false), history.Diff(before.casks, casks, true)...)
+	}
+	if appendErr := manager.RecordHistory(entry); appendErr != nil {
+		fmt.Fprintln(os.Stderr, messages.Sprintf(messages.Warning, fmt.Sprintf("failed to record history: %v", appendErr)))
+	}
+}
+
+func runHistory(manager *native.Manager, args []string) error {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	jsonOut := fs.Bool("json", false, "emit machine-readable JSON output")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	entries, err := manager.History()
+	if err != nil {
+		return err
+	}
+	if names := fs.Args(); len(names) > 0 {
+		filtered := entries[:0]
+		for _, entry := range entries {
+			for _, name := range names {
+				if entry.Touches(name) {
+					filtered = append(filtered, entry)
+					break
+				}
+			}
+		}
+		entries = filtered
+	}
+	if *jsonOut {
+		if entries == nil {
+			entries = []history.Entry{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+	for _, line := range historyLines(entries) {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func historyLines(entries []history.Entry) []string {
+	if len(entries) == 0 {
+		return []string{"No history recorded yet"}
+	}
+	var lines []string
+	for _, entry := range entries {
+		result := "ok"
+		if !entry.Success {
+			result = "failed"
+		}
+		command := strings.TrimSpace(entry.Command + " " + strings.Join(entry.Args, " "))
+		lines = append(lines, fmt.Sprintf("==> %s  ub %s  (%s, %s)", entry.Time.Local().Format("2006-01-02 15:04:05"), command,
+			roundDuration(time.Duration(entry.DurationMS)*time.Millisecond), result))
+		for _, c := range entry.Changes {
+			name := c.Name
+			if c.Cask {
+				name += " (cask)"
+			}
+			switch {
+			case c.Before == "":
+				lines = append(lines, fmt.Sprintf("    + %s %s", name, c.After))
+			case c.After == "":
+				lines = append(lines, fmt.Sprintf("    - %s %s", name, c.Before))
+			default:
+				lines = append(lines, fmt.Sprintf("    ~ %s %s -> %s", name, c.Before, c.After))
+			}
+		}
+	}
+	return lines
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"ub/internal/native"
+)
+
+// jsonVersion is brew's --json flag: bare --json means v1, and --json=v2
+// picks the document with both formulae and casks.
+type jsonVersion string
+
+func (v *jsonVersion) String() string { return string(*v) }
+
+func (v *jsonVersion) Set(value string) error {
+	switch value {
+	case "true", "v1":
+		*v = "v1"
+	case "v2":
+		*v = "v2"
+	default:
+		return fmt.Errorf("unsupported JSON version %q (want v1 or v2)", value)
+	}
+	return nil
+}
+
+func (v *jsonVersion) IsBoolFlag() bool { return true }
+
+func runNativeInfo(ctx context.Context, manager *native.Manager, args []string) error {
+	fs := flag.NewFlagSet("info", flag.ContinueOnError)
+	var jsonOut jsonVersion
+	fs.Var(&jsonOut, "json", "emit JSON: v1 (formulae only) or v2 (formulae and casks)")
+	analytics := fs.Bool("analytics", false, "include install analytics in JSON output")
+	formulaOnly := fs.Bool("formula", false, "treat every name as a formula")
+	caskOnly := fs.Bool("cask", false, "treat every name as a cask")
+	installed := fs.Bool("installed", false, "show every installed formula and cask")
+	size := fs.Bool("size", false, "show the download and installed size of installing each formula with its missing dependencies")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *size {
+		if *caskOnly || *installed || *analytics {
+			return usageErrorf("info: --size takes formula names only")
+		}
+		if fs.NArg() == 0 {
+			return usageErrorf("info --size requires a formula name")
+		}
+		return runInfoSize(ctx, manager, fs.Args(), jsonOut != "")
+	}
+	if *formulaOnly && *caskOnly {
+		return usageErrorf("info: --formula and --cask are mutually exclusive")
+	}
+	if *installed && fs.NArg() > 0 {
+		return usageErrorf("info: --installed takes no names")
+	}
+	if !*installed && fs.NArg() == 0 {
+		return usageErrorf("info requires a formula name")
+	}
+	if jsonOut == "v1" && *caskOnly {
+		return usageErrorf("info: --json=v1 has no casks; use --json=v2")
+	}
+	opts := native.InfoOptions{Formula: *formulaOnly || jsonOut == "v1", Cask: *caskOnly, Analytics: *analytics}
+
+	var info native.InfoV2
+	if *installed {
+		formulae, casks, err := manager.InstalledVersions()
+		if err != nil {
+			return err
+		}
+		if info, err = installedInfo(ctx, manager, formulae, casks, opts); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if info, err = manager.InfoJSON(ctx, fs.Args(), opts); err != nil {
+			return err
+		}
+	}
+
+	if jsonOut != "" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if jsonOut == "v1" {
+			return encoder.Encode(info.Formulae)
+		}
+		return encoder.Encode(info)
+	}
+	for _, f := range info.Formulae {
+		versions, _ := f["versions"].(map[string]any)
+		printInfo(f["name"], versions["stable"], f["desc"], f["homepage"])
+		if deps := stringList(f["dependencies"]); len(deps) > 0 {
+			fmt.Println("Dependencies:", strings.Join(deps, ", "))
+		}
+	}
+	for _, c := range info.Casks {
+		printInfo(c["token"], c["version"], c["desc"], c["homepage"])
+	}
+	return nil
+}
+
+func runInfoSize(ctx context.Context, manager *native.Manager, names []string, jsonOut bool) error {
+	footprints := make([]native.Footprint, 0, len(names))
+	for _, name := range names {
+		fp, err := manager.Footprint(ctx, name)
+		if err != nil {
+			return err
+		}
+		footprints = append(footprints, fp)
+	}
+	if jsonOut {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(footprints)
+	}
+	for _, fp := range footprints {
+		for _, line := range footprintLines(fp) {
+			fmt.Println(line)
+		}
+	}
+	return nil
+}
+
+// footprintLines describes fp, one line per keg and a total. Estimated
+// installed sizes are marked with ~.
+func footprintLines(fp native.Footprint) []string {
+	lines := make([]string, 0, len(fp.Items)+3)
+	lines = append(lines, "==> "+fp.Name)
+	for _, item := range fp.Items {
+		lines = append(lines, fmt.Sprintf("%s %s: %s", item.Name, item.Version, sizePair(item.Download, item.Installed, item.Estimated)))
+	}
+	deps := len(fp.Items) - 1
+	what := fp.Name
+	switch {
+	case deps == 1:
+		what += " and 1 dependency"
+	case deps > 1:
+		what += fmt.Sprintf(" and %d dependencies", deps)
+	}
+	lines = append(lines, fmt.Sprintf("Total for %s: %s", what, sizePair(fp.Download, fp.Installed, fp.Estimated)))
+	if len(fp.AlreadyInstalled) > 0 {
+		lines = append(lines, "Already installed: "+strings.Join(fp.AlreadyInstalled, ", "))
+	}
+	return lines
+}
+
+func sizePair(download, installed int64, estimated bool) string {
+	if download == 0 && installed == 0 {
+		return "size unknown"
+	}
+	approx := ""
+	if estimated {
+		approx = "~"
+	}
+	return fmt.Sprintf("%s download, %s%s installed", humanBytes(download), approx, humanBytes(installed))
+}
+
+// installedInfo looks up installed formulae and casks by kind, so a cask
+// that shares a formula's name is still reported as a cask.
+func installedInfo(ctx context.Context, manager *native.Manager, formulae, casks map[string]string, opts native.InfoOptions) (native.InfoV2, error) {
+	info := native.InfoV2{Formulae: []map[string]any{}, Casks: []map[string]any{}}
+	if !opts.Cask {
+		opts := opts
+		opts.Formula = true
+		found, err := manager.InfoJSON(ctx, sortedKeys(formulae), opts)
+		if err != nil {
+			return native.InfoV2{}, err
+		}
+		info.Formulae = found.Formulae
+	}
+	if !opts.Formula {
+		opts := opts
+		opts.Cask = true
+		found, err := manager.InfoJSON(ctx, sortedKeys(casks), opts)
+		if err != nil {
+			return native.InfoV2{}, err
+		}
+		info.Casks = found.Casks
+	}
+	return info, nil
+}
+
+func printInfo(name, version, desc, homepage any) {
+	fmt.Printf("%v (%v)\n", name, version)
+	if s, _ := desc.(string); s != "" {
+		fmt.Println(s)
+	}
+	if s, _ := homepage.(string); s != "" {
+		fmt.Println("Homepage:", s)
+	}
+}
+
+func stringList(value any) []string {
+	items, _ := value.([]any)
+	out := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -1,92 +1,586 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"maps"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"ub/internal/config"
 	"ub/internal/engine"
 	"ub/internal/formula"
 	"ub/internal/graph"
+	"ub/internal/homebrewapi"
+	"ub/internal/messages"
 	"ub/internal/native"
+	"ub/internal/plugin"
+	"ub/internal/stats"
+	"ub/internal/trace"
+
+	"golang.org/x/term"
 )
 
+// version is overridden at release time with -ldflags "-X main.version=...".
+var version = "0.1.0"
+
 func main() {
-	if err := run(os.Args[1:]); err != nil {
-		fmt.Fprintln(os.Stderr, "error:", err)
-		os.Exit(1)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := run(ctx, os.Args[1:])
+	interrupted := ctx.Err() != nil
+	stop()
+	if err != nil {
+		if interrupted {
+			fmt.Fprintln(os.Stderr, messages.Sprintf(messages.Interrupted, err))
+			os.Exit(exitInterrupted)
+		}
+		fmt.Fprintln(os.Stderr, messages.Sprintf(messages.Error, err))
+		os.Exit(exitCodeFor(err))
 	}
 }
 
-func run(args []string) error {
-	manager := native.New(0)
-	if err := manager.EnsureLayout(); err != nil {
+type globalOptions struct {
+	noEmoji bool
+	locale  string
+	color   string
+	arch    string
+	ordered bool
+	// wait is how long to queue for a held install lock; negative waits
+	// indefinitely.
+	wait time.Duration
+	// timeout bounds the whole invocation; zero means no limit.
+	timeout time.Duration
+	// prefix is a project-local prefix to use instead of the global one.
+	prefix string
+}
+
+func parseGlobalFlags(args []string) (globalOptions, []string, error) {
+	opts := globalOptions{}
+	rest := make([]string, 0, len(args))
+	for idx := 0; idx < len(args); idx++ {
+		arg := args[idx]
+		// Flags after the command are its own: `ub brew --prefix` and
+		// `ub install --color` are not ub's global flags.
+		if arg == "--" || len(rest) > 0 {
+			rest = append(rest, args[idx:]...)
+			break
+		}
+		switch {
+		case arg == "--no-emoji" || arg == "--ascii":
+			opts.noEmoji = true
+		case arg == "--locale":
+			if idx+1 >= len(args) {
+				return opts, nil, usageErrorf("--locale requires a value")
+			}
+			idx++
+			opts.locale = args[idx]
+		case strings.HasPrefix(arg, "--locale="):
+			opts.locale = strings.TrimPrefix(arg, "--locale=")
+		case arg == "--color":
+			opts.color = "always"
+		case arg == "--no-color":
+			opts.color = "never"
+		case arg == "--ordered-output":
+			opts.ordered = true
+		case arg == "--wait":
+			opts.wait = -1
+		case strings.HasPrefix(arg, "--wait="):
+			wait, err := time.ParseDuration(strings.TrimPrefix(arg, "--wait="))
+			if err != nil || wait <= 0 {
+				return opts, nil, usageErrorf("--wait needs a positive duration such as 30s or 5m")
+			}
+			opts.wait = wait
+		case arg == "--timeout" || strings.HasPrefix(arg, "--timeout="):
+			value, ok := strings.CutPrefix(arg, "--timeout=")
+			if !ok {
+				if idx+1 >= len(args) {
+					return opts, nil, usageErrorf("--timeout requires a value")
+				}
+				idx++
+				value = args[idx]
+			}
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				return opts, nil, usageErrorf("--timeout needs a positive duration such as 30s or 10m")
+			}
+			opts.timeout = timeout
+		case strings.HasPrefix(arg, "--color="):
+			opts.color = strings.TrimPrefix(arg, "--color=")
+		case arg == "--prefix" || strings.HasPrefix(arg, "--prefix="):
+			value, ok := strings.CutPrefix(arg, "--prefix=")
+			if !ok {
+				if idx+1 >= len(args) {
+					return opts, nil, usageErrorf("--prefix requires a directory")
+				}
+				idx++
+				value = args[idx]
+			}
+			if strings.TrimSpace(value) == "" {
+				return opts, nil, usageErrorf("--prefix requires a directory")
+			}
+			opts.prefix = value
+		case arg == "--arch":
+			if idx+1 >= len(args) {
+				return opts, nil, usageErrorf("--arch requires a value")
+			}
+			idx++
+			opts.arch = args[idx]
+		case strings.HasPrefix(arg, "--arch="):
+			opts.arch = strings.TrimPrefix(arg, "--arch=")
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	return opts, rest, nil
+}
+
+func configureMessages(opts globalOptions, cfg config.Config) error {
+	msgOpts := messages.OptionsFromEnv()
+	if opts.noEmoji {
+		msgOpts.ASCII = true
+	}
+	if opts.locale != "" {
+		msgOpts.Locale = opts.locale
+	}
+	msgOpts.CatalogDir = filepath.Join(config.Dir(), "locales")
+	isTTY := term.IsTerminal(int(os.Stdout.Fd())) && term.IsTerminal(int(os.Stderr.Fd()))
+	color, err := resolveColor(opts.color, cfg.Color, os.Getenv("NO_COLOR"), os.Getenv("TERM"), isTTY)
+	if err != nil {
+		return err
+	}
+	msgOpts.Color = color
+	return messages.Configure(msgOpts)
+}
+
+func resolveColor(flagValue, configValue, noColorEnv, termEnv string, isTTY bool) (bool, error) {
+	mode := strings.ToLower(strings.TrimSpace(flagValue))
+	if mode == "" && noColorEnv != "" {
+		return false, nil
+	}
+	if mode == "" {
+		mode = strings.ToLower(strings.TrimSpace(configValue))
+	}
+	switch mode {
+	case "", "auto":
+		return isTTY && termEnv != "dumb", nil
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	default:
+		return false, usageErrorf("invalid color mode %q (want auto, always, or never)", mode)
+	}
+}
+
+func confirmQuit(app string) bool {
+	fmt.Fprintf(os.Stderr, "%s is running. Quit it now? [y/N] ", app)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+func confirmCleanup() bool {
+	fmt.Fprint(os.Stderr, "Remove old versions of installed formulae to free space? [y/N] ")
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+// readOnlyCommands only read the prefix, so they skip creating it and work
+// without write access to it.
+var readOnlyCommands = map[string]bool{
+	"list": true, "ls": true, "search": true, "info": true, "config": true, "alias": true, "prefix": true, "which": true,
+	"commands": true, "env": true, "history": true, "queue": true, "help": true, "-h": true, "--help": true, "version": true, "--version": true, "-v": true,
+}
+
+// configFreeCommands still run when the config file cannot be read, so a
+// broken config does not hide the help or the paths needed to fix it.
+var configFreeCommands = map[string]bool{
+	"config": true, "help": true, "-h": true, "--help": true, "version": true, "--version": true, "-v": true,
+}
+
+func run(ctx context.Context, args []string) error {
+	opts, args, err := parseGlobalFlags(args)
+	if err != nil {
 		return err
 	}
+	movedConfig, migrateErr := config.Migrate()
+	cfg, loadErr := config.Load(config.DefaultPath())
+	if loadErr != nil && len(args) > 0 && !configFreeCommands[args[0]] {
+		return loadErr
+	}
+	if err := configureMessages(opts, cfg); err != nil {
+		return err
+	}
+	if loadErr != nil {
+		fmt.Fprintln(os.Stderr, messages.Sprintf(messages.Warning, loadErr.Error()))
+	}
+	reportMigration(movedConfig, config.Dir(), migrateErr)
+
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+	}
+	err = runAliased(ctx, opts, cfg, args)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &timeoutError{after: opts.timeout, err: err}
+	}
+	return err
+}
+
+// runAliased runs args, or each command an alias in args expands to.
+func runAliased(ctx context.Context, opts globalOptions, cfg config.Config, args []string) error {
+	if len(args) > 0 {
+		commands, ok, err := expandAlias(cfg.Aliases, args)
+		if err != nil {
+			return usageErrorf("%v", err)
+		}
+		if ok {
+			for _, command := range commands {
+				if err := runCommand(ctx, opts, cfg, command); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return runCommand(ctx, opts, cfg, args)
+}
 
+// runCommand runs one ub command line, without global flags, against the
+// prefix cfg describes.
+func runCommand(ctx context.Context, opts globalOptions, cfg config.Config, args []string) error {
+	manager := native.New(0)
+	if cfg.Paths != (config.Paths{}) {
+		manager.UsePaths(native.ResolvePaths(native.PathOverrides(cfg.Paths)))
+	}
+	if dir := workspaceFor(opts); dir != "" {
+		manager.UseWorkspace(dir)
+	}
+	manager.Protected = cfg.Protected
+	manager.Groups = cfg.Groups
+	manager.AllowSetuid = cfg.AllowSetuid
+	manager.SetCompressCache(cfg.CompressCache)
+	manager.SetStallTimeout(time.Duration(cfg.StallTimeout) * time.Second)
+	manager.DownloadWorkers = cfg.DownloadJobs
+	manager.MinWorkers, manager.MaxWorkers = cfg.MinJobs, cfg.MaxJobs
+	manager.OrderedOutput = opts.ordered || cfg.OrderedOutput
+	manager.LockWait = opts.wait
+	if cfg.LinkConflicts != "" {
+		policy, err := native.ParseLinkConflictPolicy(cfg.LinkConflicts)
+		if err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+		manager.LinkConflicts = policy
+	}
+	if cfg.MinFreeMB != 0 {
+		manager.MinFreeBytes = int64(cfg.MinFreeMB) << 20
+	}
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		manager.ConfirmQuit = confirmQuit
+		manager.ConfirmCleanup = confirmCleanup
+	}
+	arch := opts.arch
+	if arch == "" {
+		arch = os.Getenv("UB_ARCH")
+	}
+	if strings.TrimSpace(arch) != "" {
+		if err := manager.UseArch(arch); err != nil {
+			return usageErrorf("%v", err)
+		}
+	}
 	if len(args) == 0 {
 		printUsage()
 		return nil
 	}
+	if readOnlyCommands[args[0]] {
+		manager.UseReadOnly()
+	} else {
+		movedCache, migrateErr := manager.MigrateCache()
+		reportMigration(movedCache, manager.Paths.Cache, migrateErr)
+		if err := manager.EnsureLayout(); err != nil {
+			return err
+		}
+	}
+
+	recorder := stats.NewRecorder()
+	manager.SetStats(recorder)
+	tracer := trace.ConfigureFromEnv()
+	ctx, span := trace.Start(ctx, "ub."+args[0], trace.String("ub.command", args[0]))
+	before := snapshotForHistory(manager, args[0])
+	generations := cfg.Generations && generationCommand(args)
+	if generations {
+		if err := manager.BeginGeneration(ctx, strings.Join(args, " ")); err != nil {
+			return err
+		}
+	}
+	start := time.Now()
+	err := dispatch(ctx, manager, args)
+	if generations {
+		err = finishGeneration(manager, err)
+	}
+	span.End(err)
+	notifyCompletion(cfg, args, time.Since(start), err)
+	recordCommandStats(manager, args[0], time.Since(start), err, recorder)
+	recordLastCommand(manager, args, start, err)
+	recordHistory(manager, before, args, start, err)
+	flushTraces(tracer)
+	return err
+}
+
+// reportMigration tells the user about a directory moved to its XDG
+// location. A failed move is only a warning; the old location is then
+// left alone.
+func reportMigration(from, to string, err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, messages.Sprintf(messages.Warning, err))
+	} else if from != "" {
+		fmt.Fprintln(os.Stderr, messages.Sprintf(messages.MovedDir, from, to))
+	}
+}
+
+func flushTraces(tracer *trace.Provider) {
+	if tracer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracer.Flush(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, messages.Sprintf(messages.Warning, fmt.Sprintf("failed to export traces: %v", err)))
+	}
+}
 
+func dispatch(ctx context.Context, manager *native.Manager, args []string) error {
 	switch args[0] {
 	case "install", "i":
-		return runNativeInstall(manager, args[1:])
+		return runNativeInstall(ctx, manager, args[1:])
+	case "upgrade":
+		return runNativeUpgrade(ctx, manager, args[1:])
+	case "apply":
+		return runApply(ctx, manager, args[1:])
+	case "plan":
+		return runManifestPlan(ctx, manager, args[1:])
+	case "verify-downloads":
+		return runVerifyDownloads(ctx, manager, args[1:])
+	case "cache":
+		return runCache(ctx, manager, args[1:])
+	case "state":
+		return runState(manager, args[1:])
+	case "doctor":
+		return runDoctor(ctx, manager, args[1:])
+	case "bugreport":
+		return runBugreport(ctx, manager, args[1:])
+	case "self-update":
+		return runSelfUpdate(ctx, args[1:])
+	case "unbottled":
+		return runUnbottled(ctx, manager, args[1:])
 	case "reset":
-		return runNativeReset(manager)
+		return runNativeReset(ctx, manager)
 	case "uninstall", "remove", "rm":
-		return runNativeUninstall(manager, args[1:])
+		return runNativeUninstall(ctx, manager, args[1:])
 	case "list", "ls":
-		return runNativeList(manager)
+		return runNativeList(manager, args[1:])
 	case "search":
-		return runNativeSearch(manager, args[1:])
+		return runNativeSearch(ctx, manager, args[1:])
 	case "info":
-		return runNativeInfo(manager, args[1:])
+		return runNativeInfo(ctx, manager, args[1:])
 	case "update":
-		return runNativeUpdate(manager)
+		return runNativeUpdate(ctx, manager)
 	case "prefix":
 		return runNativePrefix(manager, args[1:])
+	case "which":
+		return runWhich(ctx, manager, args[1:])
 	case "config":
 		return runNativeConfig(manager)
+	case "alias":
+		return runAlias(args[1:])
+	case "env":
+		return runEnv(manager, args[1:])
+	case "commands":
+		return runCommands(args[1:])
+	case "stats":
+		return runStats(manager, args[1:])
+	case "history":
+		return runHistory(manager, args[1:])
+	case "snapshot":
+		return runSnapshot(ctx, manager, args[1:])
+	case "generations":
+		return runGenerations(manager, args[1:])
+	case "serve":
+		return runServe(ctx, manager, args[1:])
+	case "queue":
+		return runQueue(ctx, args[1:])
+	case "autoupdate":
+		return runAutoupdate(ctx, manager, args[1:])
+	case "pin-tap":
+		return runPinTap(manager, args[1:])
+	case "unpin-tap":
+		return runUnpinTap(manager, args[1:])
+	case "tap-new":
+		return runTapNew(ctx, manager, args[1:])
+	case "tap":
+		return runTap(ctx, manager, args[1:])
+	case "brew":
+		return runBrew(ctx, manager, args[1:])
 	case "mvp-plan":
 		return runPlan(args[1:])
 	case "mvp-install":
-		return runInstall(args[1:])
+		return runInstall(ctx, args[1:])
 	case "help", "-h", "--help":
 		printUsage()
 		return nil
 	case "--version", "-v", "version":
-		fmt.Println("ub 0.1.0")
+		fmt.Println("ub " + version)
 		return nil
 	default:
-		return fmt.Errorf("command %q is not implemented yet", args[0])
+		if path, ok := findExternalCommand(args[0]); ok {
+			return runExternalCommand(ctx, manager, args[0], path, args[1:])
+		}
+		return unknownCommand(args[0])
 	}
 }
 
-func runNativeInstall(manager *native.Manager, args []string) error {
+func runNativeInstall(ctx context.Context, manager *native.Manager, args []string) error {
 	fs := flag.NewFlagSet("install", flag.ContinueOnError)
-	jobs := fs.Int("jobs", manager.Workers, "maximum parallel jobs")
+	jobs := jobsValue{n: manager.Workers}
+	fs.Var(&jobs, "jobs", "maximum parallel jobs, or auto")
+	onlyDeps := fs.Bool("only-dependencies", false, "install dependencies but not the named formulae")
+	ignoreDeps := fs.Bool("ignore-dependencies", false, "skip installing dependencies")
+	bottleTag := fs.String("bottle-tag", "", "require this exact bottle tag")
+	forceBottle := fs.Bool("force-bottle", false, "pour any available bottle when none matches this platform")
+	sha := fs.String("sha256", "", "expected checksum of a bottle installed from a file or URL")
+	head := fs.Bool("HEAD", false, "build from the formula's head VCS URL")
+	tapDir := fs.String("tap", "", "formula tap directory with build steps for --HEAD")
+	file := fs.String("file", "", "also install the packages listed in FILE, one per line (- for stdin)")
+	formulaOnly := fs.Bool("formula", false, "treat every name as a formula")
+	caskOnly := fs.Bool("cask", false, "treat every name as a cask")
+	linkConflictFlags(fs, manager)
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
-	names := fs.Args()
-	if len(names) == 0 {
-		return fmt.Errorf("install requires at least one formula")
+	if *formulaOnly && *caskOnly {
+		return usageErrorf("install: --formula and --cask are mutually exclusive")
+	}
+	names, groups, err := expandGroups(manager, fs.Args())
+	if err != nil {
+		return err
+	}
+	var casks []string
+	if *caskOnly {
+		if len(groups) > 0 {
+			return usageErrorf("install: --cask takes cask names, not groups")
+		}
+		names, casks = nil, names
+	}
+	if *file != "" {
+		listed, listedCasks, err := readPackageFile(*file)
+		if err != nil {
+			return usageErrorf("%v", err)
+		}
+		names, casks = append(names, listed...), append(casks, listedCasks...)
+	}
+	if len(names) == 0 && len(casks) == 0 {
+		return usageErrorf("install requires at least one formula")
+	}
+	if *onlyDeps && *ignoreDeps {
+		return usageErrorf("--only-dependencies and --ignore-dependencies are mutually exclusive")
+	}
+	if *sha != "" && len(names) != 1 {
+		return usageErrorf("--sha256 needs exactly one bottle file or URL")
+	}
+	if *tapDir != "" && !*head {
+		return usageErrorf("--tap only applies to --HEAD builds")
+	}
+	useJobs(manager, jobs)
+	if err := manager.CheckNetwork(ctx); err != nil {
+		return err
+	}
+	plugins, err := plugin.Load(ctx, plugin.DefaultDir(config.Dir()))
+	if err != nil {
+		return err
+	}
+	defer plugins.Close()
+	manager.Plugins = plugins
+	opts := native.InstallOptions{
+		OnlyDependencies:   *onlyDeps,
+		IgnoreDependencies: *ignoreDeps,
+		BottleTag:          *bottleTag,
+		ForceBottle:        *forceBottle,
+		BottleSHA256:       *sha,
+		HEAD:               *head,
+		TapDir:             *tapDir,
+		Casks:              casks,
 	}
-	manager.Workers = *jobs
-	if err := manager.Install(context.Background(), names); err != nil {
+	var preinstalled []string
+	if len(groups) > 0 {
+		if preinstalled, err = installedNames(manager); err != nil {
+			return err
+		}
+	}
+	if err := manager.InstallWithOptions(ctx, names, opts); err != nil {
 		return err
 	}
+	for _, group := range slices.Sorted(maps.Keys(groups)) {
+		if err := manager.RecordGroup(group, newMembers(groups[group], preinstalled)); err != nil {
+			return err
+		}
+	}
+	if manager.Arch != "" {
+		return nil
+	}
 	if err := ensurePathEntryInZshrc(manager.Paths.Bin); err != nil {
-		fmt.Fprintf(os.Stderr, "warning: failed to update ~/.zshrc PATH: %v\n", err)
+		fmt.Fprintln(os.Stderr, messages.Sprintf(messages.Warning, fmt.Sprintf("failed to update ~/.zshrc PATH: %v", err)))
 	}
 	return nil
 }
 
+func runNativeUpgrade(ctx context.Context, manager *native.Manager, args []string) error {
+	fs := flag.NewFlagSet("upgrade", flag.ContinueOnError)
+	jobs := jobsValue{n: manager.Workers}
+	fs.Var(&jobs, "jobs", "maximum parallel jobs, or auto")
+	greedy := fs.Bool("greedy", false, "also upgrade casks that update themselves")
+	dryRun := fs.Bool("dry-run", false, "list what would be upgraded, with homepages and release notes, without upgrading")
+	formulaOnly := fs.Bool("formula", false, "only upgrade formulae")
+	caskOnly := fs.Bool("cask", false, "only upgrade casks")
+	linkConflictFlags(fs, manager)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *formulaOnly && *caskOnly {
+		return usageErrorf("upgrade: --formula and --cask are mutually exclusive")
+	}
+	useJobs(manager, jobs)
+	if err := manager.CheckNetwork(ctx); err != nil {
+		return err
+	}
+	plugins, err := plugin.Load(ctx, plugin.DefaultDir(config.Dir()))
+	if err != nil {
+		return err
+	}
+	defer plugins.Close()
+	manager.Plugins = plugins
+	_, err = manager.Upgrade(ctx, fs.Args(), native.UpgradeOptions{Greedy: *greedy, DryRun: *dryRun, Formula: *formulaOnly, Cask: *caskOnly})
+	return err
+}
+
 func ensurePathEntryInZshrc(pathEntry string) error {
 	pathEntry = strings.TrimSpace(pathEntry)
 	if pathEntry == "" {
@@ -141,16 +635,39 @@ func pathContainsDir(pathValue, dir string) bool {
 	return false
 }
 
-func runNativeUninstall(manager *native.Manager, args []string) error {
-	if len(args) == 0 {
-		return fmt.Errorf("uninstall requires at least one formula")
+func runNativeUninstall(ctx context.Context, manager *native.Manager, args []string) error {
+	fs := flag.NewFlagSet("uninstall", flag.ContinueOnError)
+	force := fs.Bool("force", false, "remove all versions and ignore dependents")
+	fs.BoolVar(force, "f", false, "shorthand for --force")
+	permanent := fs.Bool("permanent", false, "delete cask apps instead of moving them to the Trash")
+	formulaOnly := fs.Bool("formula", false, "treat every name as a formula")
+	caskOnly := fs.Bool("cask", false, "treat every name as a cask")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *formulaOnly && *caskOnly {
+		return usageErrorf("uninstall: --formula and --cask are mutually exclusive")
+	}
+	if fs.NArg() == 0 {
+		return usageErrorf("uninstall requires at least one formula")
 	}
-	summary, err := manager.UninstallWithAutoremove(context.Background(), args)
+	names, groups, err := groupRemovals(manager, fs.Args())
 	if err != nil {
 		return err
 	}
-	for _, line := range uninstallSummaryLines(summary) {
-		fmt.Println(line)
+	if len(names) > 0 {
+		summary, err := manager.UninstallWithOptions(ctx, names, native.UninstallOptions{Force: *force, Permanent: *permanent, Formula: *formulaOnly, Cask: *caskOnly})
+		if err != nil {
+			return err
+		}
+		for _, line := range uninstallSummaryLines(summary) {
+			fmt.Println(line)
+		}
+	}
+	for _, group := range groups {
+		if err := manager.ForgetGroup(group); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -173,15 +690,94 @@ func uninstallSummaryLines(summary native.UninstallSummary) []string {
 	return lines
 }
 
-func runNativeReset(manager *native.Manager) error {
-	if err := manager.Reset(); err != nil {
+func runVerifyDownloads(ctx context.Context, manager *native.Manager, args []string) error {
+	fs := flag.NewFlagSet("verify-downloads", flag.ContinueOnError)
+	jobs := jobsValue{n: manager.Workers}
+	fs.Var(&jobs, "jobs", "maximum parallel jobs, or auto")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	useJobs(manager, jobs)
+	summary, err := manager.VerifyDownloads(ctx)
+	for _, line := range verifySummaryLines(summary) {
+		fmt.Println(line)
+	}
+	if err != nil {
+		return err
+	}
+	if len(summary.Corrupt) > 0 {
+		return fmt.Errorf("%d cached download(s) failed verification: %w", len(summary.Corrupt), native.ErrChecksumMismatch)
+	}
+	return nil
+}
+
+func verifySummaryLines(summary native.VerifySummary) []string {
+	lines := make([]string, 0, len(summary.Corrupt)+len(summary.Missing)+1)
+	for _, c := range summary.Corrupt {
+		lines = append(lines, fmt.Sprintf("Quarantined %s (%s) to %s", c.URL, c.Err, c.QuarantinedTo))
+	}
+	for _, url := range summary.Missing {
+		lines = append(lines, fmt.Sprintf("Forgot missing download %s", url))
+	}
+	lines = append(lines, fmt.Sprintf("==> Verified %d cached download(s): %d corrupt, %d missing, %d without a recorded checksum",
+		summary.Verified+len(summary.Corrupt), len(summary.Corrupt), len(summary.Missing), summary.Untracked))
+	return lines
+}
+
+func runUnbottled(ctx context.Context, manager *native.Manager, args []string) error {
+	fs := flag.NewFlagSet("unbottled", flag.ContinueOnError)
+	tag := fs.String("tag", "", "bottle tag to check instead of this host's")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	report, err := manager.BottleReport(ctx, fs.Args(), *tag)
+	if err != nil {
+		return err
+	}
+	for _, line := range unbottledLines(report, *tag) {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func unbottledLines(report []native.BottleStatus, tag string) []string {
+	if tag == "" {
+		tag = runtime.GOOS + "/" + runtime.GOARCH
+	}
+	lines := make([]string, 0, len(report)+1)
+	missing := 0
+	for _, status := range report {
+		if status.Tag != "" {
+			continue
+		}
+		missing++
+		if len(status.Available) == 0 {
+			lines = append(lines, fmt.Sprintf("%s: no bottles", status.Name))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s: bottled only for %s", status.Name, strings.Join(status.Available, ", ")))
+		}
+	}
+	lines = append(lines, fmt.Sprintf("==> %d of %d formulae have no bottle for %s", missing, len(report), tag))
+	return lines
+}
+
+func runNativeReset(ctx context.Context, manager *native.Manager) error {
+	if err := manager.Reset(ctx); err != nil {
 		return err
 	}
 	fmt.Println("Reset complete")
 	return nil
 }
 
-func runNativeList(manager *native.Manager) error {
+func runNativeList(manager *native.Manager, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	groups := fs.Bool("groups", false, "list installed groups and their members")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *groups {
+		return runListGroups(manager)
+	}
 	list, err := manager.ListInstalled()
 	if err != nil {
 		return err
@@ -192,12 +788,12 @@ func runNativeList(manager *native.Manager) error {
 	return nil
 }
 
-func runNativeSearch(manager *native.Manager, args []string) error {
+func runNativeSearch(ctx context.Context, manager *native.Manager, args []string) error {
 	query := ""
 	if len(args) > 0 {
 		query = strings.Join(args, " ")
 	}
-	results, err := manager.Search(context.Background(), query)
+	results, err := manager.Search(ctx, query)
 	if err != nil {
 		return err
 	}
@@ -207,29 +803,11 @@ func runNativeSearch(manager *native.Manager, args []string) error {
 	return nil
 }
 
-func runNativeInfo(manager *native.Manager, args []string) error {
-	if len(args) == 0 {
-		return fmt.Errorf("info requires a formula name")
-	}
-	for _, name := range args {
-		f, err := manager.Info(context.Background(), name)
-		if err != nil {
-			return err
-		}
-		fmt.Printf("%s (%s)\n", f.Name, f.Versions.Stable)
-		fmt.Println(f.Desc)
-		if f.Homepage != "" {
-			fmt.Println("Homepage:", f.Homepage)
-		}
-		if len(f.Dependencies) > 0 {
-			fmt.Println("Dependencies:", strings.Join(f.Dependencies, ", "))
-		}
+func runNativeUpdate(ctx context.Context, manager *native.Manager) error {
+	if err := manager.RequireNetwork(ctx); err != nil {
+		return err
 	}
-	return nil
-}
-
-func runNativeUpdate(manager *native.Manager) error {
-	_, err := manager.Search(context.Background(), "")
+	_, err := manager.Search(ctx, "")
 	if err != nil {
 		return err
 	}
@@ -244,16 +822,14 @@ func runNativePrefix(manager *native.Manager, args []string) error {
 	}
 	name := args[0]
 	formulaDir := filepath.Join(manager.Paths.Cellar, name)
-	versions, err := os.ReadDir(formulaDir)
-	if err != nil {
-		return fmt.Errorf("formula %q is not installed", name)
+	if _, err := os.Stat(formulaDir); err != nil {
+		return fmt.Errorf("formula %q is %w", name, native.ErrNotInstalled)
 	}
-	latest := ""
-	for _, v := range versions {
-		if v.IsDir() && v.Name() > latest {
-			latest = v.Name()
-		}
+	formulae, _, err := manager.InstalledVersions()
+	if err != nil {
+		return err
 	}
+	latest := formulae[name]
 	if latest == "" {
 		return fmt.Errorf("formula %q has no installed versions", name)
 	}
@@ -262,30 +838,46 @@ func runNativePrefix(manager *native.Manager, args []string) error {
 }
 
 func runNativeConfig(manager *native.Manager) error {
+	if manager.Workspace != "" {
+		fmt.Println("UB_WORKSPACE:", manager.Workspace)
+	}
 	fmt.Println("UB_BASE_DIR:", manager.Paths.BaseDir)
 	fmt.Println("UB_PREFIX:", manager.Paths.Prefix)
 	fmt.Println("UB_REPOSITORY:", manager.Paths.Repo)
 	fmt.Println("UB_CELLAR:", manager.Paths.Cellar)
+	fmt.Println("UB_CASKROOM:", manager.Paths.Caskroom)
 	fmt.Println("UB_CACHE:", manager.Paths.Cache)
+	fmt.Println("UB_API_DOMAIN:", homebrewapi.BaseURL())
 	return nil
 }
 
 func runPlan(args []string) error {
 	fs := flag.NewFlagSet("plan", flag.ContinueOnError)
-	tapDir := fs.String("tap", "./taps/core", "formula tap directory")
+	var taps tapList
+	fs.Var(&taps, "tap", "formula tap directory; repeat to search several, earlier first")
+	output := fs.String("output", "", "write the plan to this file for mvp-install --plan")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
 
 	roots := fs.Args()
 	if len(roots) == 0 {
-		return fmt.Errorf("plan requires at least one formula")
+		return usageErrorf("plan requires at least one formula")
 	}
 
-	formulas, plan, err := resolveAndPlan(*tapDir, roots)
+	formulas, plan, err := resolveAndPlan(taps.dirs(), roots)
 	if err != nil {
 		return err
 	}
+	if *output != "" {
+		file, err := graph.NewFile(taps.dirs(), roots, formulas, plan)
+		if err != nil {
+			return err
+		}
+		if err := file.Write(*output); err != nil {
+			return err
+		}
+	}
 
 	fmt.Println("Plan")
 	fmt.Println("- roots:", strings.Join(roots, ", "))
@@ -294,28 +886,67 @@ func runPlan(args []string) error {
 	for idx, layer := range plan.Layers {
 		fmt.Printf("  %d: %s\n", idx, strings.Join(layer, ", "))
 	}
+	fmt.Printf("- critical path: %d (%s)\n", len(plan.CriticalPath), strings.Join(plan.CriticalPath, " -> "))
+	fmt.Println("- max width:", plan.MaxWidth)
+	fmt.Println("- estimated speedup:")
+	for _, jobs := range speedupJobCounts(plan.MaxWidth) {
+		fmt.Printf("  --jobs %d: %.1fx\n", jobs, plan.Speedup(jobs))
+	}
 
 	return nil
 }
 
-func runInstall(args []string) error {
+// speedupJobCounts lists worker counts worth comparing: powers of two up to
+// the widest layer, and the widest layer itself, past which nothing helps.
+func speedupJobCounts(maxWidth int) []int {
+	counts := []int{}
+	for jobs := 1; jobs < maxWidth; jobs *= 2 {
+		counts = append(counts, jobs)
+	}
+	return append(counts, max(maxWidth, 1))
+}
+
+func runInstall(ctx context.Context, args []string) error {
 	fs := flag.NewFlagSet("install", flag.ContinueOnError)
-	tapDir := fs.String("tap", "./taps/core", "formula tap directory")
+	var taps tapList
+	fs.Var(&taps, "tap", "formula tap directory; repeat to search several, earlier first")
 	rootDir := fs.String("root", "./cellar", "installation root")
 	cacheDir := fs.String("cache", "./cache", "download cache directory")
 	jobs := fs.Int("jobs", native.New(0).Workers, "maximum parallel jobs")
+	planPath := fs.String("plan", "", "install exactly the plan written by mvp-plan --output")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
 
 	roots := fs.Args()
-	if len(roots) == 0 {
-		return fmt.Errorf("install requires at least one formula")
-	}
-
-	formulas, plan, err := resolveAndPlan(*tapDir, roots)
-	if err != nil {
-		return err
+	var (
+		formulas map[string]formula.Formula
+		plan     graph.Plan
+		err      error
+	)
+	tapDirs := taps.dirs()
+	if *planPath != "" {
+		if len(roots) > 0 {
+			return usageErrorf("install takes formula names or --plan, not both")
+		}
+		// The plan's own taps are used unless --tap names others.
+		var override formula.Taps
+		if len(taps) > 0 {
+			override = tapDirs
+		}
+		var file graph.File
+		if file, plan, err = graph.ReadFile(*planPath, override); err != nil {
+			return err
+		}
+		formulas = file.Formulas
+		tapDirs = file.Taps
+	} else {
+		if len(roots) == 0 {
+			return usageErrorf("install requires at least one formula")
+		}
+		if formulas, plan, err = resolveAndPlan(tapDirs, roots); err != nil {
+			return err
+		}
 	}
 
 	if err := os.MkdirAll(*rootDir, 0o755); err != nil {
@@ -323,7 +954,7 @@ func runInstall(args []string) error {
 	}
 
 	installer := engine.Installer{
-		TapDir:   mustAbs(*tapDir),
+		Taps:     tapDirs,
 		RootDir:  mustAbs(*rootDir),
 		CacheDir: mustAbs(*cacheDir),
 		Jobs:     *jobs,
@@ -331,8 +962,9 @@ func runInstall(args []string) error {
 
 	fmt.Printf("Installing %d formula(s) with %d job(s)\n", len(formulas), *jobs)
 	fmt.Printf("Execution layers: %d\n", len(plan.Layers))
+	fmt.Printf("Estimated speedup: %.1fx (critical path %d, max width %d)\n", plan.Speedup(*jobs), len(plan.CriticalPath), plan.MaxWidth)
 
-	if err := installer.Install(context.Background(), formulas); err != nil {
+	if err := installer.Install(ctx, formulas); err != nil {
 		return err
 	}
 
@@ -346,8 +978,87 @@ func runInstall(args []string) error {
 	return nil
 }
 
-func resolveAndPlan(tapDir string, roots []string) (map[string]formula.Formula, graph.Plan, error) {
-	formulas, err := formula.ResolveClosure(tapDir, roots)
+// jobsValue is --jobs: a worker count, or auto to tune it from this
+// machine and past download speeds.
+type jobsValue struct {
+	n    int
+	auto bool
+}
+
+func (j *jobsValue) String() string {
+	if j.auto {
+		return "auto"
+	}
+	return strconv.Itoa(j.n)
+}
+
+func (j *jobsValue) Set(value string) error {
+	if value == "auto" {
+		j.auto = true
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return fmt.Errorf("want a positive number or auto, got %q", value)
+	}
+	*j = jobsValue{n: n}
+	return nil
+}
+
+func useJobs(manager *native.Manager, jobs jobsValue) {
+	if !jobs.auto {
+		manager.Workers = jobs.n
+		return
+	}
+	db, _ := stats.Load(stats.Path(manager.Paths.Prefix))
+	manager.UseAutoWorkers(db.Throughput())
+}
+
+// linkConflictFlags adds --overwrite and --link-conflicts, which override
+// the link_conflicts config setting for one command.
+func linkConflictFlags(fs *flag.FlagSet, manager *native.Manager) {
+	fs.BoolFunc("overwrite", "replace files in bin and sbin that ub did not link", func(string) error {
+		manager.LinkConflicts = native.LinkConflictOverwrite
+		return nil
+	})
+	fs.Func("link-conflicts", "what to do about files ub did not link: error, overwrite, skip or backup", func(value string) error {
+		policy, err := native.ParseLinkConflictPolicy(value)
+		manager.LinkConflicts = policy
+		return err
+	})
+}
+
+// tapList collects repeated --tap flags. Each value may also hold several
+// directories separated like PATH.
+type tapList []string
+
+func (t *tapList) String() string {
+	return strings.Join(*t, string(os.PathListSeparator))
+}
+
+func (t *tapList) Set(value string) error {
+	for _, dir := range filepath.SplitList(value) {
+		if strings.TrimSpace(dir) != "" {
+			*t = append(*t, dir)
+		}
+	}
+	return nil
+}
+
+// dirs returns the taps as absolute paths, defaulting to ./taps/core.
+func (t tapList) dirs() formula.Taps {
+	if len(t) == 0 {
+		t = tapList{"./taps/core"}
+	}
+	dirs := make(formula.Taps, 0, len(t))
+	for _, dir := range t {
+		dirs = append(dirs, mustAbs(dir))
+	}
+	return dirs
+}
+
+func resolveAndPlan(taps formula.Taps, roots []string) (map[string]formula.Formula, graph.Plan, error) {
+	formulas, err := taps.ResolveClosure(roots)
 	if err != nil {
 		return nil, graph.Plan{}, err
 	}
@@ -372,21 +1083,61 @@ func printUsage() {
 	fmt.Println("ub: native Homebrew-compatible package manager")
 	fmt.Println("")
 	fmt.Println("Usage:")
-	fmt.Println("  ub install <formula...> [--jobs N]")
+	fmt.Println("  ub [--no-emoji] [--locale LOCALE] [--color=auto|always|never] [--arch x86_64] [--ordered-output] [--wait[=TIMEOUT]] [--timeout DURATION] [--prefix DIR] <command> [args...]")
+	fmt.Println("  ub install <formula...> [--jobs N|auto] [--only-dependencies|--ignore-dependencies]")
+	fmt.Println("  ub install @group...")
+	fmt.Println("  ub install --cask <cask...>")
+	fmt.Println("      [--overwrite|--link-conflicts error|overwrite|skip|backup]")
+	fmt.Println("  ub install --file FILE|- [formula...]")
+	fmt.Println("  ub install <bottle.tar.gz|URL> [--sha256 HASH]")
+	fmt.Println("      [--bottle-tag TAG] [--force-bottle]")
+	fmt.Println("  ub install --HEAD <formula...> [--tap DIR]")
+	fmt.Println("  ub upgrade [formula|cask...] [--formula|--cask] [--greedy] [--dry-run] [--jobs N|auto] [--overwrite]")
+	fmt.Println("  ub apply [--dry-run] [--jobs N|auto] <manifest.json|manifest.yaml>")
+	fmt.Println("  ub plan [--json] -f <manifest.json|manifest.yaml>")
+	fmt.Println("  ub verify-downloads [--jobs N|auto]")
+	fmt.Println("  ub cache export DEST <formula|cask...> | export --all DEST | import SRC")
+	fmt.Println("  ub state verify [--json] | rebuild | export")
+	fmt.Println("  ub doctor [--fix]")
+	fmt.Println("  ub bugreport [--output FILE.tar.gz]")
+	fmt.Println("  ub self-update [--channel stable|dev] [--check] [--force] [--allow-downgrade]")
+	fmt.Println("  ub unbottled [formula...] [--tag TAG]")
 	fmt.Println("  ub reset")
-	fmt.Println("  ub uninstall <formula...>")
-	fmt.Println("  ub list")
-	fmt.Println("  ub info <formula...>")
+	fmt.Println("  ub uninstall <formula...|@group...> [--formula|--cask] [--force] [--permanent]")
+	fmt.Println("  ub list [--groups]")
+	fmt.Println("  ub info [--json[=v1|v2]] [--analytics] [--formula|--cask] [--installed] <formula|cask...>")
+	fmt.Println("  ub info --size [--json] <formula...>")
 	fmt.Println("  ub search [query]")
 	fmt.Println("  ub update")
 	fmt.Println("  ub prefix [formula]")
+	fmt.Println("  ub which <executable>")
 	fmt.Println("  ub config")
+	fmt.Println("  ub env [--init] [--unset] [--shell sh|fish]")
+	fmt.Println("  ub alias [NAME[=EXPANSION]] | --delete NAME")
+	fmt.Println("  ub commands [--quiet]")
+	fmt.Println("  ub stats [--json] [--reset]")
+	fmt.Println("  ub history [--json] [formula|cask...]")
+	fmt.Println("  ub snapshot create [--clone] [NAME] | list | restore NAME | delete NAME")
+	fmt.Println("  ub generations [list] | rollback [N]")
+	fmt.Println("  ub serve [--listen ADDR] [--jobs N]")
+	fmt.Println("  ub queue [--listen ADDR] [--json]")
+	fmt.Println("  ub autoupdate start [--interval DURATION] [--upgrade] | stop | status")
+	fmt.Println("  ub pin-tap [<formula> <tap>]")
+	fmt.Println("  ub unpin-tap <formula>")
 	fmt.Println("")
 	fmt.Println("Defaults:")
 	fmt.Println("  prefix: .../ub")
 	fmt.Println("  repository: .../unbrew")
 	fmt.Println("")
+	fmt.Println("External commands:")
+	fmt.Println("  ub <name> [args...] runs an executable named ub-<name> found on PATH")
+	fmt.Println("")
 	fmt.Println("Prototype engine commands:")
-	fmt.Println("  ub mvp-plan <formula...> [--tap DIR]")
-	fmt.Println("  ub mvp-install <formula...> [--tap DIR] [--root DIR] [--cache DIR] [--jobs N]")
+	fmt.Println("  ub mvp-plan <formula...> [--tap DIR]... [--output PLAN.json]")
+	fmt.Println("  ub mvp-install <formula...|--plan PLAN.json> [--tap DIR]... [--root DIR] [--cache DIR] [--jobs N]")
+	fmt.Println("  ub tap-new --url URL [--version V] [--tap DIR] [--force] <name>")
+	fmt.Println("  ub tap lint [--tap DIR] [--offline] [formula...]")
+	fmt.Println("  ub tap pin-source [--tap DIR] <formula...>")
+	fmt.Println("  ub tap index [--tap DIR]")
+	fmt.Println("  ub brew [--print] <brew command> [args...]")
 }
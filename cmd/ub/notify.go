@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"ub/internal/config"
+	"ub/internal/native"
+)
+
+const defaultNotifyAfter = 10 * time.Second
+
+// notifyDesktop shows a desktop notification through osascript on macOS and
+// notify-send elsewhere.
+var notifyDesktop = func(title, body string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s", appleScriptString(body), appleScriptString(title))
+		return exec.Command("osascript", "-e", script).Run()
+	default:
+		return exec.Command("notify-send", "--app-name=ub", title, body).Run()
+	}
+}
+
+// notifyCompletion tells a user who switched away from a long install that
+// it finished. Only commands that change the prefix notify, and only once
+// they ran for NotifyAfter; a failed notification is not worth a warning.
+func notifyCompletion(cfg config.Config, args []string, elapsed time.Duration, err error) {
+	if !cfg.Notify || len(args) == 0 || !generationCommand(args) {
+		return
+	}
+	threshold := defaultNotifyAfter
+	if cfg.NotifyAfter > 0 {
+		threshold = time.Duration(cfg.NotifyAfter) * time.Second
+	}
+	if elapsed < threshold {
+		return
+	}
+	command := "ub " + strings.Join(args, " ")
+	var partial *native.PartialError
+	body := fmt.Sprintf("Finished in %s", elapsed.Round(time.Second))
+	switch {
+	case errors.As(err, &partial):
+		body = fmt.Sprintf("Partially completed after %s: %v", elapsed.Round(time.Second), err)
+	case err != nil:
+		body = fmt.Sprintf("Failed after %s: %v", elapsed.Round(time.Second), err)
+	}
+	_ = notifyDesktop(command, body)
+}
+
+func appleScriptString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"ub/internal/config"
+)
+
+func TestNotifyCompletion(t *testing.T) {
+	var titles, bodies []string
+	orig := notifyDesktop
+	notifyDesktop = func(title, body string) error {
+		titles = append(titles, title)
+		bodies = append(bodies, body)
+		return nil
+	}
+	t.Cleanup(func() { notifyDesktop = orig })
+
+	cfg := config.Config{Notify: true, NotifyAfter: 5}
+	notifyCompletion(config.Config{}, []string{"install", "ffmpeg"}, time.Minute, nil)
+	notifyCompletion(cfg, []string{"install", "ffmpeg"}, 4*time.Second, nil)
+	notifyCompletion(cfg, []string{"list"}, time.Minute, nil)
+	if len(titles) != 0 {
+		t.Fatalf("unexpected notifications: %q", titles)
+	}
+
+	notifyCompletion(cfg, []string{"install", "ffmpeg"}, 90*time.Second, nil)
+	notifyCompletion(cfg, []string{"upgrade"}, time.Minute, errors.New("network down"))
+	if len(titles) != 2 || titles[0] != "ub install ffmpeg" {
+		t.Fatalf("titles = %q", titles)
+	}
+	if bodies[0] != "Finished in 1m30s" {
+		t.Fatalf("success body = %q", bodies[0])
+	}
+	if !strings.HasPrefix(bodies[1], "Failed after 1m0s: network down") {
+		t.Fatalf("failure body = %q", bodies[1])
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// readPackageFile reads a package list from path, or from stdin when path is
+// "-". Each line names one package; "#" starts a comment, and a leading
+// --cask or --formula says which kind it is instead of looking it up.
+func readPackageFile(path string) (names, casks []string, err error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read package list: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	names, casks, err = parsePackageList(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return names, casks, nil
+}
+
+func parsePackageList(r io.Reader) (names, casks []string, err error) {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		cask := false
+		switch fields[0] {
+		case "--cask", "--casks":
+			cask, fields = true, fields[1:]
+		case "--formula", "--formulae":
+			fields = fields[1:]
+		}
+		if len(fields) != 1 {
+			return nil, nil, fmt.Errorf("line %d: want one package, got %q", line, strings.TrimSpace(text))
+		}
+		if cask {
+			casks = append(casks, fields[0])
+		} else {
+			names = append(names, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return names, casks, nil
+}
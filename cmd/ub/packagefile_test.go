@@ -0,0 +1,21 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePackageList(t *testing.T) {
+	names, casks, err := parsePackageList(strings.NewReader("# dev tools\njq\n  wget   # for scripts\n\n--cask firefox\n--formula hello\n"))
+	if err != nil {
+		t.Fatalf("parsePackageList: %v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"jq", "wget", "hello"}) || !reflect.DeepEqual(casks, []string{"firefox"}) {
+		t.Fatalf("names = %v, casks = %v", names, casks)
+	}
+
+	if _, _, err := parsePackageList(strings.NewReader("jq\njq wget\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected a line 2 error, got %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+
+	"ub/internal/native"
+)
+
+func runPinTap(manager *native.Manager, args []string) error {
+	switch len(args) {
+	case 0:
+		pins, err := manager.TapPins()
+		if err != nil {
+			return err
+		}
+		if len(pins) == 0 {
+			fmt.Println("No formulae are pinned to a tap")
+		}
+		for _, pin := range pins {
+			fmt.Printf("%s\t%s\t%s\n", pin.Formula, pin.Tap, pin.Dir)
+		}
+		return nil
+	case 2:
+		pin, err := manager.PinTap(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("==> %s now builds from %s; run ub upgrade %s to replace the installed keg\n", pin.Formula, pin.Tap, pin.Formula)
+		return nil
+	}
+	return usageErrorf("usage: ub pin-tap [<formula> <tap>]")
+}
+
+func runUnpinTap(manager *native.Manager, args []string) error {
+	if len(args) != 1 {
+		return usageErrorf("usage: ub unpin-tap <formula>")
+	}
+	if err := manager.UnpinTap(args[0]); err != nil {
+		return err
+	}
+	fmt.Printf("==> %s comes from homebrew-core again\n", args[0])
+	return nil
+}
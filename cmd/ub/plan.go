@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"ub/internal/native"
+)
+
+func runManifestPlan(ctx context.Context, manager *native.Manager, args []string) error {
+	fs := flag.NewFlagSet("plan", flag.ContinueOnError)
+	var path string
+	fs.StringVar(&path, "file", "", "manifest to compare against")
+	fs.StringVar(&path, "f", "", "shorthand for --file")
+	jsonOut := fs.Bool("json", false, "print the actions as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if path == "" && fs.NArg() == 1 {
+		path = fs.Arg(0)
+	} else if path == "" || fs.NArg() != 0 {
+		return usageErrorf("usage: ub plan [--json] -f <manifest.json|manifest.yaml>")
+	}
+	manifest, err := native.LoadManifest(path)
+	if err != nil {
+		return usageErrorf("%v", err)
+	}
+	manager.API.Quiet = *jsonOut
+	plan, err := manager.PlanApply(ctx, manifest)
+	if err != nil {
+		return err
+	}
+	actions, err := manager.PlanActions(ctx, plan)
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(actions); err != nil {
+			return err
+		}
+	} else {
+		for _, line := range planLines(actions) {
+			fmt.Println(line)
+		}
+	}
+	if len(actions) > 0 {
+		return errDrift
+	}
+	return nil
+}
+
+func planLines(actions []native.PlanAction) []string {
+	if len(actions) == 0 {
+		return []string{"==> Everything matches the manifest"}
+	}
+	lines := []string{fmt.Sprintf("%-8s %-8s %-24s %-14s %-14s %10s", "ACTION", "KIND", "NAME", "FROM", "TO", "SIZE")}
+	for _, a := range actions {
+		size := "-"
+		if a.Bytes > 0 {
+			size = humanBytes(a.Bytes)
+		}
+		lines = append(lines, fmt.Sprintf("%-8s %-8s %-24s %-14s %-14s %10s", a.Action, a.Kind, a.Name, dashIfEmpty(a.From), dashIfEmpty(a.To), size))
+	}
+	return lines
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"ub/internal/daemon"
+)
+
+func runQueue(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("queue", flag.ContinueOnError)
+	addr := fs.String("listen", daemon.DefaultListenAddr, "address of the ub serve daemon")
+	jsonOut := fs.Bool("json", false, "emit machine-readable JSON output")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usageErrorf("usage: ub queue [--listen ADDR] [--json]")
+	}
+	status, err := daemon.FetchQueue(ctx, *addr)
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(status)
+	}
+	for _, line := range queueLines(status, time.Now()) {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func queueLines(status daemon.QueueStatus, now time.Time) []string {
+	var lines []string
+	if status.Running == nil && len(status.Queued) == 0 {
+		lines = append(lines, "==> Nothing running or queued")
+	}
+	if req := status.Running; req != nil {
+		line := fmt.Sprintf("#%d %s (for %s)", req.ID, strings.Join(req.Names, " "), now.Sub(req.StartedAt).Round(time.Second))
+		if p := req.Progress; p != nil {
+			line += fmt.Sprintf(", %d/%d jobs done", p.DoneJobs, p.Jobs)
+			if p.Bytes > 0 {
+				line += fmt.Sprintf(", %s / %s downloaded", humanBytes(p.DoneBytes), humanBytes(p.Bytes))
+			}
+		}
+		lines = append(lines, "==> Running", line)
+	}
+	if len(status.Downloads) > 0 {
+		lines = append(lines, "==> Downloads")
+		for _, d := range status.Downloads {
+			line := fmt.Sprintf("%s %s", downloadName(d.URL), humanBytes(d.DownloadedBytes))
+			if d.TotalBytes > 0 {
+				line += fmt.Sprintf(" / %s (%d%%)", humanBytes(d.TotalBytes), d.DownloadedBytes*100/d.TotalBytes)
+			}
+			if d.Stalled {
+				line += ", stalled, retrying"
+			} else if d.BytesPerSec > 0 {
+				line += fmt.Sprintf(" at %s/s", humanBytes(int64(d.BytesPerSec)))
+			}
+			lines = append(lines, line)
+		}
+	}
+	if len(status.Queued) > 0 {
+		lines = append(lines, "==> Queued")
+		for _, req := range status.Queued {
+			lines = append(lines, fmt.Sprintf("#%d %s (waiting %s)", req.ID, strings.Join(req.Names, " "), now.Sub(req.EnqueuedAt).Round(time.Second)))
+		}
+	}
+	if len(status.Recent) > 0 {
+		lines = append(lines, "==> Recent")
+		for _, req := range status.Recent {
+			line := fmt.Sprintf("#%d %s %s %s ago", req.ID, strings.Join(req.Names, " "), req.State, now.Sub(req.FinishedAt).Round(time.Second))
+			if req.Error != "" {
+				line += ": " + req.Error
+			}
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// downloadName is what a download is called in the queue: the package of a
+// registry blob, whose own name is only its digest, or the file name.
+func downloadName(url string) string {
+	if before, _, ok := strings.Cut(url, "/blobs/"); ok {
+		return path.Base(before)
+	}
+	return path.Base(url)
+}
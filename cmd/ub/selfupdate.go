@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+
+	"ub/internal/messages"
+	"ub/internal/selfupdate"
+)
+
+func runSelfUpdate(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("self-update", flag.ContinueOnError)
+	channel := fs.String("channel", selfupdate.ChannelStable, "release channel: stable or dev")
+	check := fs.Bool("check", false, "only report whether an update is available")
+	force := fs.Bool("force", false, "reinstall even when already on the latest version")
+	allowDowngrade := fs.Bool("allow-downgrade", false, "install the channel's release even when it is older than this ub")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *channel != selfupdate.ChannelStable && *channel != selfupdate.ChannelDev {
+		return usageErrorf("unknown channel %q (expected stable or dev)", *channel)
+	}
+
+	updater := selfupdate.New()
+	rel, err := updater.LatestRelease(ctx, *channel)
+	if err != nil {
+		return err
+	}
+	if rel.Version() == version && !*force {
+		messages.Println(messages.SelfUpdateCurrent, version)
+		return nil
+	}
+	if selfupdate.CompareVersions(rel.Version(), version) < 0 && !*allowDowngrade {
+		if *check {
+			messages.Println(messages.SelfUpdateCurrent, version)
+			return nil
+		}
+		return fmt.Errorf("the %s channel's ub %s is older than this ub %s; pass --allow-downgrade to install it", *channel, rel.Version(), version)
+	}
+	if *check {
+		messages.Println(messages.SelfUpdateAvailable, version, rel.Version(), *channel)
+		return nil
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("locate running executable: %w", err)
+	}
+	messages.Println(messages.SelfUpdating, version, rel.Version())
+	if err := updater.Install(ctx, rel, runtime.GOOS, runtime.GOARCH, executable); err != nil {
+		return err
+	}
+	messages.Println(messages.SelfUpdated, rel.Version())
+	return nil
+}
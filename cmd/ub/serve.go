@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"ub/internal/config"
+	"ub/internal/daemon"
+	"ub/internal/messages"
+	"ub/internal/native"
+	"ub/internal/plugin"
+	"ub/internal/trace"
+)
+
+// traceFlushInterval is how often ub serve exports finished spans.
+const traceFlushInterval = 10 * time.Second
+
+func runServe(ctx context.Context, manager *native.Manager, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	listen := fs.String("listen", daemon.DefaultListenAddr, "address for the HTTP API and /metrics")
+	jobs := fs.Int("jobs", manager.Workers, "maximum parallel jobs per install")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	manager.Workers = *jobs
+	plugins, err := plugin.Load(ctx, plugin.DefaultDir(config.Dir()))
+	if err != nil {
+		return err
+	}
+	defer plugins.Close()
+	manager.Plugins = plugins
+
+	tokenPath := daemon.TokenPath(manager.Paths.Prefix)
+	token, err := daemon.WriteToken(tokenPath)
+	if err != nil {
+		return fmt.Errorf("write daemon token: %w", err)
+	}
+	server := daemon.New(manager, manager.Stats)
+	server.Token = token
+	manager.Fetch.Observe = server.ObserveDownload
+	manager.Progress = func(p native.PlanProgress) { server.ObserveProgress(daemon.Progress(p)) }
+	// The daemon runs until it is stopped, so its spans are exported as it
+	// goes rather than all at exit, and the rest once it has shut down.
+	stopTraces := trace.FlushEvery(traceFlushInterval, func(err error) {
+		fmt.Fprintln(os.Stderr, messages.Sprintf(messages.Warning, fmt.Sprintf("failed to export traces: %v", err)))
+	})
+	defer stopTraces()
+	fmt.Printf("==> ub daemon listening on http://%s (metrics at /metrics)\n", *listen)
+	fmt.Printf("==> POST /install needs the bearer token in %s\n", tokenPath)
+	return daemon.ListenAndServe(ctx, *listen, server)
+}
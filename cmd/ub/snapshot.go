@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"ub/internal/native"
+)
+
+func runSnapshot(ctx context.Context, manager *native.Manager, args []string) error {
+	if len(args) == 0 {
+		return usageErrorf("usage: ub snapshot create [--clone] [NAME] | list | restore NAME | delete NAME")
+	}
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("snapshot create", flag.ContinueOnError)
+		clone := fs.Bool("clone", false, "hard-link every keg into the snapshot")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() > 1 {
+			return usageErrorf("usage: ub snapshot create [--clone] [NAME]")
+		}
+		snap, err := manager.CreateSnapshot(ctx, fs.Arg(0), *clone)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("==> Created snapshot %s (%d formulae, %d casks)\n", snap.Name, len(snap.Formulae), len(snap.Casks))
+		return nil
+	case "list", "ls":
+		snaps, err := manager.ListSnapshots()
+		if err != nil {
+			return err
+		}
+		for _, line := range snapshotListLines(snaps) {
+			fmt.Println(line)
+		}
+		return nil
+	case "restore":
+		if len(args) != 2 {
+			return usageErrorf("usage: ub snapshot restore NAME")
+		}
+		summary, err := manager.RestoreSnapshot(ctx, args[1])
+		for _, line := range restoreSummaryLines(args[1], summary) {
+			fmt.Println(line)
+		}
+		if err != nil {
+			return err
+		}
+		if len(summary.Unrestorable) > 0 {
+			return &native.PartialError{
+				Completed: append(append([]string{}, summary.Removed...), summary.Relinked...),
+				Err:       fmt.Errorf("%d package(s) could not be restored; reinstall them or use a --clone snapshot", len(summary.Unrestorable)),
+			}
+		}
+		return nil
+	case "delete", "rm":
+		if len(args) != 2 {
+			return usageErrorf("usage: ub snapshot delete NAME")
+		}
+		if err := manager.DeleteSnapshot(args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("==> Deleted snapshot %s\n", args[1])
+		return nil
+	}
+	return usageErrorf("unknown snapshot command %q", args[0])
+}
+
+func snapshotListLines(snaps []native.Snapshot) []string {
+	if len(snaps) == 0 {
+		return []string{"No snapshots"}
+	}
+	lines := []string{fmt.Sprintf("%-24s %-20s %8s %6s %6s", "NAME", "CREATED", "FORMULAE", "CASKS", "CLONED")}
+	for _, snap := range snaps {
+		cloned := "no"
+		if snap.Cloned {
+			cloned = "yes"
+		}
+		lines = append(lines, fmt.Sprintf("%-24s %-20s %8d %6d %6s", snap.Name, snap.Created.Local().Format(time.DateTime),
+			len(snap.Formulae), len(snap.Casks), cloned))
+	}
+	return lines
+}
+
+func restoreSummaryLines(name string, summary native.RestoreSummary) []string {
+	var lines []string
+	if len(summary.Removed) > 0 {
+		lines = append(lines, "Removed: "+strings.Join(summary.Removed, ", "))
+	}
+	if len(summary.Relinked) > 0 {
+		lines = append(lines, "Relinked: "+strings.Join(summary.Relinked, ", "))
+	}
+	for _, item := range summary.Unrestorable {
+		lines = append(lines, "Not restorable (no keg on disk): "+item)
+	}
+	return append(lines, fmt.Sprintf("==> Restored snapshot %s", name))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"ub/internal/native"
+)
+
+func runState(manager *native.Manager, args []string) error {
+	if len(args) == 0 {
+		return usageErrorf("usage: ub state verify [--json] | rebuild | export")
+	}
+	switch args[0] {
+	case "verify":
+		fs := flag.NewFlagSet("state verify", flag.ContinueOnError)
+		jsonOut := fs.Bool("json", false, "emit machine-readable JSON output")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		divergences, err := manager.VerifyState()
+		if err != nil {
+			return err
+		}
+		if *jsonOut {
+			if divergences == nil {
+				divergences = []native.StateDivergence{}
+			}
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(divergences); err != nil {
+				return err
+			}
+		} else {
+			for _, line := range divergenceLines(divergences) {
+				fmt.Println(line)
+			}
+		}
+		if len(divergences) > 0 {
+			return fmt.Errorf("%w in %d place(s); run `ub state rebuild`", native.ErrStateDiverged, len(divergences))
+		}
+		return nil
+	case "rebuild":
+		if len(args) != 1 {
+			return usageErrorf("usage: ub state rebuild")
+		}
+		st, err := manager.RebuildState()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("==> Rebuilt the state store from %d formula(e) and %d cask(s)\n", len(st.Formulae), len(st.Casks))
+		return nil
+	case "export":
+		if len(args) != 1 {
+			return usageErrorf("usage: ub state export")
+		}
+		st, err := manager.StoredState()
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(st)
+	}
+	return usageErrorf("unknown state command %q (expected verify, rebuild or export)", args[0])
+}
+
+func divergenceLines(divergences []native.StateDivergence) []string {
+	if len(divergences) == 0 {
+		return []string{"==> State store matches the Cellar and Caskroom"}
+	}
+	lines := make([]string, 0, len(divergences))
+	for _, d := range divergences {
+		kind := "formula"
+		if d.Cask {
+			kind = "cask"
+		}
+		lines = append(lines, fmt.Sprintf("%s (%s): %s", d.Name, kind, d.Problem))
+	}
+	return lines
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStateVerifyAndRebuild(t *testing.T) {
+	_, paths := setupFixtureE2E(t)
+	ctx := context.Background()
+	if _, err := captureStdout(func() error { return run(ctx, []string{"install", "libgreet"}) }); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	out, err := captureStdout(func() error { return run(ctx, []string{"state", "verify"}) })
+	if err != nil || !strings.Contains(out, "matches") {
+		t.Fatalf("state verify = %q, %v", out, err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(paths.Cellar, "libgreet", "2.0"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	out, err = captureStdout(func() error { return run(ctx, []string{"state", "verify"}) })
+	if exitCodeFor(err) != exitDrift || !strings.Contains(out, "libgreet (formula): indexed versions [1.0], installed [1.0, 2.0]") {
+		t.Fatalf("state verify after a manual change = %q, %v", out, err)
+	}
+
+	out, err = captureStdout(func() error { return run(ctx, []string{"state", "rebuild"}) })
+	if err != nil || !strings.Contains(out, "1 formula(e) and 0 cask(s)") {
+		t.Fatalf("state rebuild = %q, %v", out, err)
+	}
+	if _, err := captureStdout(func() error { return run(ctx, []string{"state", "verify"}) }); err != nil {
+		t.Fatalf("state verify after rebuild: %v", err)
+	}
+	out, err = captureStdout(func() error { return run(ctx, []string{"state", "export"}) })
+	if err != nil || !strings.Contains(out, `"version": "2.0"`) {
+		t.Fatalf("state export = %q, %v", out, err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"ub/internal/messages"
+	"ub/internal/native"
+	"ub/internal/stats"
+)
+
+var statsExcludedCommands = map[string]bool{
+	"stats": true, "serve": true, "queue": true, "help": true, "-h": true, "--help": true,
+	"version": true, "--version": true, "-v": true,
+}
+
+func recordCommandStats(manager *native.Manager, command string, duration time.Duration, err error, recorder *stats.Recorder) {
+	if statsExcludedCommands[command] || envTruthy(os.Getenv("UB_NO_STATS")) {
+		return
+	}
+	recordErr := stats.Record(stats.Path(manager.Paths.Prefix), command, duration, err != nil, recorder.Snapshot())
+	// A read-only command on a prefix it cannot write is expected to fail here.
+	if recordErr != nil && !(readOnlyCommands[command] && (errors.Is(recordErr, os.ErrPermission) || errors.Is(recordErr, syscall.EROFS))) {
+		fmt.Fprintln(os.Stderr, messages.Sprintf(messages.Warning, fmt.Sprintf("failed to record stats: %v", recordErr)))
+	}
+}
+
+func runStats(manager *native.Manager, args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	jsonOut := fs.Bool("json", false, "emit machine-readable JSON output")
+	reset := fs.Bool("reset", false, "clear recorded stats")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	path := stats.Path(manager.Paths.Prefix)
+	if *reset {
+		if err := stats.Reset(path); err != nil {
+			return err
+		}
+		fmt.Println("Stats reset")
+		return nil
+	}
+
+	db, err := stats.Load(path)
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(db)
+	}
+	for _, line := range statsLines(db) {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func statsLines(db stats.Database) []string {
+	if len(db.Commands) == 0 {
+		return []string{"No stats recorded yet"}
+	}
+	names := make([]string, 0, len(db.Commands))
+	for name := range db.Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{
+		fmt.Sprintf("==> Stats since %s", db.Since.Local().Format(time.RFC3339)),
+		fmt.Sprintf("%-14s %6s %8s %10s %10s %10s", "COMMAND", "RUNS", "FAILURES", "AVG", "MAX", "LAST"),
+	}
+	for _, name := range names {
+		c := db.Commands[name]
+		lines = append(lines, fmt.Sprintf("%-14s %6d %8d %10s %10s %10s", name, c.Runs, c.Failures,
+			roundDuration(c.Average()), roundDuration(c.MaxDuration), roundDuration(c.LastDuration)))
+	}
+	lines = append(lines,
+		"",
+		fmt.Sprintf("Cache hit rate:     %.1f%% (%d hits, %d misses)", db.CacheHitRate()*100, db.CacheHits, db.CacheMisses),
+		fmt.Sprintf("Downloaded:         %s", humanBytes(db.BytesDownloaded)),
+		fmt.Sprintf("Download speed:     %s/s per download", humanBytes(int64(db.Throughput()))),
+		fmt.Sprintf("Jobs run:           %d (%d failed)", db.Jobs, db.JobsFailed),
+		fmt.Sprintf("Worker utilization: %.1f%%", db.WorkerUtilization()*100),
+	)
+	return lines
+}
+
+func roundDuration(d time.Duration) string {
+	if d >= time.Second {
+		return d.Round(100 * time.Millisecond).String()
+	}
+	return d.Round(time.Millisecond).String()
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	value := float64(n)
+	suffixes := []string{"KB", "MB", "GB", "TB"}
+	idx := -1
+	for value >= unit && idx < len(suffixes)-1 {
+		value /= unit
+		idx++
+	}
+	return fmt.Sprintf("%.1f%s", value, suffixes[idx])
+}
+
+func envTruthy(raw string) bool {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "1", "true", "yes", "on":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"ub/internal/fetch"
+	"ub/internal/formula"
+	"ub/internal/native"
+)
+
+func runTapNew(ctx context.Context, manager *native.Manager, args []string) error {
+	fs := flag.NewFlagSet("tap-new", flag.ContinueOnError)
+	tapDir := fs.String("tap", "./taps/core", "formula tap directory")
+	sourceURL := fs.String("url", "", "source archive or git repository URL")
+	version := fs.String("version", "", "formula version (default: read from the URL)")
+	force := fs.Bool("force", false, "replace an existing formula file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageErrorf("usage: ub tap-new --url URL [--version V] [--tap DIR] [--force] <name>")
+	}
+	if *sourceURL == "" {
+		return usageErrorf("tap-new requires --url")
+	}
+
+	f := formula.Formula{
+		Name:    fs.Arg(0),
+		Version: *version,
+		Deps:    []string{},
+		Source:  formula.Source{URL: *sourceURL},
+		Build:   formula.Build{Steps: []string{`./configure --prefix="$PREFIX"`, "make", "make install"}},
+	}
+	if f.Version == "" {
+		if f.Version = formula.GuessVersion(*sourceURL); f.Version == "" {
+			return usageErrorf("cannot read a version from %s; pass --version", *sourceURL)
+		}
+	}
+	if !fetch.IsGitURL(*sourceURL) {
+		archive, err := manager.Fetch.Fetch(ctx, *sourceURL)
+		if err != nil {
+			return fmt.Errorf("download source: %w", err)
+		}
+		if f.Source.SHA256, err = fileSHA256(archive); err != nil {
+			return err
+		}
+	}
+	path, err := formula.Save(*tapDir, f, *force)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("==> Created %s\n", path)
+	fmt.Println("Edit deps and build steps, then check it with: ub tap lint", f.Name)
+	return nil
+}
+
+const tapUsage = "usage: ub tap lint [--tap DIR] [--offline] [formula...] | pin-source [--tap DIR] <formula...> | index [--tap DIR]"
+
+func runTap(ctx context.Context, manager *native.Manager, args []string) error {
+	if len(args) == 0 {
+		return usageErrorf(tapUsage)
+	}
+	switch args[0] {
+	case "lint":
+		return runTapLint(ctx, manager, args[1:])
+	case "pin-source":
+		return runTapPinSource(ctx, manager, args[1:])
+	case "index":
+		return runTapIndex(args[1:])
+	default:
+		return usageErrorf(tapUsage)
+	}
+}
+
+func runTapLint(ctx context.Context, manager *native.Manager, args []string) error {
+	fs := flag.NewFlagSet("tap lint", flag.ContinueOnError)
+	tapDir := fs.String("tap", "./taps/core", "formula tap directory")
+	offline := fs.Bool("offline", false, "skip checking that source and patch URLs are reachable")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	opts := formula.LintOptions{}
+	if !*offline {
+		opts.CheckURL = manager.Fetch.Reachable
+	}
+	problems, err := formula.Lint(ctx, *tapDir, fs.Args(), opts)
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problem(s) found in %s", len(problems), *tapDir)
+	}
+	fmt.Println("==> No problems found")
+	return nil
+}
+
+func runTapPinSource(ctx context.Context, manager *native.Manager, args []string) error {
+	fs := flag.NewFlagSet("tap pin-source", flag.ContinueOnError)
+	tapDir := fs.String("tap", "./taps/core", "formula tap directory")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return usageErrorf("usage: ub tap pin-source [--tap DIR] <formula...>")
+	}
+	for _, name := range fs.Args() {
+		sourceURL, err := formula.SourceURL(*tapDir, name)
+		if err != nil {
+			return err
+		}
+		// A version bump may keep the URL, so a cached copy is only trusted
+		// when the server says it is unchanged.
+		archive, err := manager.Fetch.FetchRevalidated(ctx, sourceURL, nil)
+		if err != nil {
+			return fmt.Errorf("download %s source: %w", name, err)
+		}
+		sum, err := fileSHA256(archive)
+		if err != nil {
+			return err
+		}
+		changed, err := formula.PinSource(*tapDir, name, sum)
+		if err != nil {
+			return err
+		}
+		if changed {
+			fmt.Printf("==> Pinned %s source to sha256 %s\n", name, sum)
+		} else {
+			fmt.Printf("==> %s source sha256 is already up to date\n", name)
+		}
+	}
+	return nil
+}
+
+func runTapIndex(args []string) error {
+	fs := flag.NewFlagSet("tap index", flag.ContinueOnError)
+	tapDir := fs.String("tap", "./taps/core", "formula tap directory")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usageErrorf("usage: ub tap index [--tap DIR]")
+	}
+	count, err := formula.WriteIndex(*tapDir)
+	if count > 0 || err == nil {
+		fmt.Printf("==> Indexed %d formula(s) in %s\n", count, filepath.Join(*tapDir, formula.IndexFile))
+	}
+	return err
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := fetch.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", fmt.Errorf("hash %s: %w", path, err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"ub/internal/messages"
+	"ub/internal/native"
+)
+
+func runWhich(ctx context.Context, manager *native.Manager, args []string) error {
+	if len(args) != 1 {
+		return usageErrorf("usage: ub which <executable>")
+	}
+	w, err := manager.Which(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Println(w.Path)
+	for _, hop := range w.Chain {
+		fmt.Printf("  -> %s\n", hop)
+	}
+	switch {
+	case w.Formula != "":
+		fmt.Printf("Provided by %s %s%s\n", w.Formula, w.Version, newerVersion(ctx, manager, w.Formula))
+	case w.Cask != "":
+		fmt.Printf("Provided by cask %s %s%s\n", w.Cask, w.Version, newerVersion(ctx, manager, w.Cask))
+	default:
+		fmt.Println("Not provided by an installed formula or cask")
+	}
+	if found, err := exec.LookPath(args[0]); err == nil && found != w.Path {
+		fmt.Fprintln(os.Stderr, messages.Sprintf(messages.Warning, fmt.Sprintf("PATH finds %s first", found)))
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, messages.Sprintf(messages.Warning, fmt.Sprintf("%s is not on PATH", w.Path)))
+	}
+	return nil
+}
+
+// newerVersion describes the upgrade available for name, if any. A failed
+// check is only mentioned, since the lookup itself worked.
+func newerVersion(ctx context.Context, manager *native.Manager, name string) string {
+	outdated, err := manager.Outdated(ctx, []string{name}, true)
+	if err != nil {
+		return fmt.Sprintf(" (could not check for a newer version: %v)", err)
+	}
+	if len(outdated) > 0 {
+		return fmt.Sprintf(" (%s is available: ub upgrade %s)", outdated[0].CurrentVersion, name)
+	}
+	return ", the newest version"
+}
@@ -3,6 +3,9 @@ module ub
 go 1.24.0
 
 require (
-	golang.org/x/sys v0.41.0 // indirect
-	golang.org/x/term v0.40.0 // indirect
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/term v0.40.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require golang.org/x/sys v0.41.0 // indirect
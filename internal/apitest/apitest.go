@@ -0,0 +1,225 @@
+// Package apitest serves a recorded slice of the Homebrew JSON API, with
+// bottles and cask archives built from testdata, so install, upgrade and
+// uninstall can be tested without reaching formulae.brew.sh or GHCR.
+package apitest
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+)
+
+//go:embed testdata
+var fixtures embed.FS
+
+// Server hosts the bottle and cask archives. Dir holds the rendered API
+// tree, whose URLs point back at the server, for UB_API_FIXTURES.
+type Server struct {
+	*httptest.Server
+	Dir string
+
+	archives map[string][]byte
+	mu       sync.Mutex
+	hits     map[string]int
+}
+
+// New renders the fixtures and starts the server; both are torn down when
+// the test ends.
+func New(t testing.TB) *Server {
+	t.Helper()
+	s := &Server{archives: map[string][]byte{}, hits: map[string]int{}, Dir: t.TempDir()}
+	if err := s.buildArchives(); err != nil {
+		t.Fatalf("build fixture archives: %v", err)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	if err := s.render(); err != nil {
+		t.Fatalf("render API fixtures: %v", err)
+	}
+	return s
+}
+
+// Setenv points the homebrewapi client at the fixtures for the rest of the test.
+func (s *Server) Setenv(t testing.TB) {
+	t.Helper()
+	t.Setenv("UB_API_FIXTURES", s.Dir)
+}
+
+// Hits reports how many times an archive path such as /bottles/hello.tar.gz
+// was downloaded.
+func (s *Server) Hits(urlPath string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits[urlPath]
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	data, ok := s.archives[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if r.Method == http.MethodHead {
+		// Sizing a download ahead of time is not a download.
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		return
+	}
+	s.mu.Lock()
+	s.hits[r.URL.Path]++
+	s.mu.Unlock()
+	_, _ = w.Write(data)
+}
+
+func (s *Server) buildArchives() error {
+	bottles, err := fs.ReadDir(fixtures, "testdata/bottles")
+	if err != nil {
+		return err
+	}
+	for _, entry := range bottles {
+		data, err := tarGz(path.Join("testdata/bottles", entry.Name()))
+		if err != nil {
+			return fmt.Errorf("bottle %s: %w", entry.Name(), err)
+		}
+		s.archives["/bottles/"+entry.Name()+".tar.gz"] = data
+	}
+	casks, err := fs.ReadDir(fixtures, "testdata/casks")
+	if err != nil {
+		return err
+	}
+	for _, entry := range casks {
+		data, err := zipDir(path.Join("testdata/casks", entry.Name()))
+		if err != nil {
+			return fmt.Errorf("cask %s: %w", entry.Name(), err)
+		}
+		s.archives["/casks/"+entry.Name()+".zip"] = data
+	}
+	return nil
+}
+
+// render writes testdata/api into Dir, filling in {{.Server}} and
+// {{sha256 "bottles/<name>"}} or {{sha256 "casks/<token>"}}.
+func (s *Server) render() error {
+	funcs := template.FuncMap{"sha256": func(name string) (string, error) {
+		for urlPath, data := range s.archives {
+			if strings.TrimSuffix(strings.TrimSuffix(urlPath, ".tar.gz"), ".zip") == "/"+name {
+				sum := sha256.Sum256(data)
+				return hex.EncodeToString(sum[:]), nil
+			}
+		}
+		return "", fmt.Errorf("no fixture archive %q", name)
+	}}
+	root := "testdata/api"
+	return fs.WalkDir(fixtures, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		raw, err := fixtures.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		tmpl, err := template.New(p).Funcs(funcs).Parse(string(raw))
+		if err != nil {
+			return err
+		}
+		var out bytes.Buffer
+		if err := tmpl.Execute(&out, struct{ Server string }{s.URL}); err != nil {
+			return err
+		}
+		dst := filepath.Join(s.Dir, filepath.FromSlash(strings.TrimPrefix(p, root+"/")))
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+		return os.WriteFile(dst, out.Bytes(), 0o644)
+	})
+}
+
+// fixtureMode marks scripts executable; embedded files carry no mode bits.
+func fixtureMode(p string, dir bool) int64 {
+	if dir || strings.Contains(p, "/bin/") || strings.Contains(p, "/MacOS/") {
+		return 0o755
+	}
+	return 0o644
+}
+
+// tarGz packs root as a bottle, so entries start with <name>/<version>/.
+func tarGz(root string) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	err := fs.WalkDir(fixtures, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(p, path.Dir(root)+"/")
+		if d.IsDir() {
+			return tw.WriteHeader(&tar.Header{Name: name + "/", Typeflag: tar.TypeDir, Mode: fixtureMode(name, true)})
+		}
+		data, err := fixtures.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: fixtureMode(name, false), Size: int64(len(data))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func zipDir(root string) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	err := fs.WalkDir(fixtures, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == root || d.IsDir() {
+			return err
+		}
+		name := strings.TrimPrefix(p, root+"/")
+		data, err := fixtures.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		hdr := &zip.FileHeader{Name: name, Method: zip.Deflate}
+		hdr.SetMode(os.FileMode(fixtureMode(name, false)))
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,139 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+type Config struct {
+	Color string `json:"color,omitempty"`
+	// Protected packages are never autoremoved, even when nothing depends on them.
+	Protected []string `json:"protected,omitempty"`
+	// AllowSetuid keeps setuid/setgid bits from bottle archives instead of stripping them.
+	AllowSetuid bool `json:"allow_setuid,omitempty"`
+	// Generations keeps every version of the bin/sbin link farm for rollback.
+	Generations bool `json:"generations,omitempty"`
+	// Notify posts a desktop notification when a command that changes the
+	// prefix finishes after running at least NotifyAfter seconds (default 10).
+	Notify      bool `json:"notify,omitempty"`
+	NotifyAfter int  `json:"notify_after,omitempty"`
+	// DownloadJobs bounds concurrent bottle downloads; extraction stays
+	// bounded by --jobs. Zero means twice --jobs.
+	DownloadJobs int `json:"download_jobs,omitempty"`
+	// MinJobs and MaxJobs bound the job counts --jobs auto picks.
+	MinJobs int `json:"min_jobs,omitempty"`
+	MaxJobs int `json:"max_jobs,omitempty"`
+	// OrderedOutput prints install logs in dependency order, as --ordered-output does.
+	OrderedOutput bool `json:"ordered_output,omitempty"`
+	// MinFreeMB is the free space, in MiB, below which extraction pauses.
+	// Zero means 256; negative turns the check off.
+	MinFreeMB int `json:"min_free_mb,omitempty"`
+	// CompressCache stores downloads that are not compressed already gzipped.
+	CompressCache bool `json:"compress_cache,omitempty"`
+	// StallTimeout is how many seconds a download may go without receiving
+	// data before it is retried. Zero means 60; negative turns the check off.
+	StallTimeout int `json:"stall_timeout,omitempty"`
+	// LinkConflicts is what linking does about files in bin and sbin that ub
+	// did not link: error (the default), overwrite, skip or backup.
+	LinkConflicts string `json:"link_conflicts,omitempty"`
+	// Aliases maps a name to the ub command lines, joined by &&, that
+	// "ub NAME" runs.
+	Aliases map[string]string `json:"aliases,omitempty"`
+	// Groups maps a name to the formulae and casks that "ub install @NAME"
+	// installs together.
+	Groups map[string][]string `json:"groups,omitempty"`
+	// Paths moves single locations out of the default layout. The UB_PREFIX,
+	// UB_CELLAR, UB_CASKROOM, UB_CACHE_DIR and UB_REPOSITORY variables win.
+	Paths Paths `json:"paths,omitempty"`
+}
+
+type Paths struct {
+	Prefix     string `json:"prefix,omitempty"`
+	Cellar     string `json:"cellar,omitempty"`
+	Caskroom   string `json:"caskroom,omitempty"`
+	Cache      string `json:"cache,omitempty"`
+	Repository string `json:"repository,omitempty"`
+}
+
+// Dir is ~/.config/ub, or $XDG_CONFIG_HOME/ub on Linux when it is set.
+func Dir() string {
+	if configHome := os.Getenv("XDG_CONFIG_HOME"); runtime.GOOS == "linux" && filepath.IsAbs(configHome) {
+		return filepath.Join(configHome, "ub")
+	}
+	return legacyDir()
+}
+
+func legacyDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil || strings.TrimSpace(home) == "" {
+		return filepath.Join(".", ".config", "ub")
+	}
+	return filepath.Join(home, ".config", "ub")
+}
+
+// Migrate moves ~/.config/ub to Dir when XDG_CONFIG_HOME points elsewhere
+// and nothing is there yet. It returns the old location when it moved it.
+func Migrate() (string, error) {
+	legacy, dir := legacyDir(), Dir()
+	if legacy == dir {
+		return "", nil
+	}
+	if info, err := os.Stat(legacy); err != nil || !info.IsDir() {
+		return "", nil
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return "", nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+		return "", fmt.Errorf("migrate config: %w", err)
+	}
+	if err := os.Rename(legacy, dir); err != nil {
+		return "", fmt.Errorf("migrate config from %s: %w", legacy, err)
+	}
+	return legacy, nil
+}
+
+func DefaultPath() string {
+	if path := strings.TrimSpace(os.Getenv("UB_CONFIG")); path != "" {
+		return path
+	}
+	return filepath.Join(Dir(), "config.json")
+}
+
+func Load(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Config{}, nil
+		}
+		return Config{}, fmt.Errorf("read config %q: %w", path, err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return Config{}, fmt.Errorf("parse config %q: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func Save(path string, cfg Config) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("create config dir: %w", err)
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal config: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write config: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("publish config: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestLoadMissingFileReturnsZeroConfig(t *testing.T) {
+	cfg, err := Load(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Color != "" {
+		t.Fatalf("expected zero config, got %+v", cfg)
+	}
+}
+
+func TestSaveLoadRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "config.json")
+	if err := Save(path, Config{Color: "never", Protected: []string{"jq"}, AllowSetuid: true}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Color != "never" {
+		t.Fatalf("Color = %q, want never", cfg.Color)
+	}
+	if len(cfg.Protected) != 1 || cfg.Protected[0] != "jq" {
+		t.Fatalf("Protected = %v, want [jq]", cfg.Protected)
+	}
+	if !cfg.AllowSetuid {
+		t.Fatalf("AllowSetuid = false, want true")
+	}
+}
+
+func TestMigrateMovesConfigToXDG(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("XDG_CONFIG_HOME is only honored on Linux")
+	}
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, "xdg"))
+	if err := Save(filepath.Join(home, ".config", "ub", "config.json"), Config{Color: "never"}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	from, err := Migrate()
+	if err != nil || from != filepath.Join(home, ".config", "ub") {
+		t.Fatalf("Migrate() = %q, %v", from, err)
+	}
+	if Dir() != filepath.Join(home, "xdg", "ub") {
+		t.Fatalf("Dir() = %q", Dir())
+	}
+	cfg, err := Load(filepath.Join(Dir(), "config.json"))
+	if err != nil || cfg.Color != "never" {
+		t.Fatalf("migrated config = %+v, %v", cfg, err)
+	}
+}
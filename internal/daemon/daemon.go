@@ -0,0 +1,452 @@
+package daemon
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"ub/internal/fetch"
+	"ub/internal/stats"
+)
+
+const DefaultListenAddr = "127.0.0.1:7576"
+
+// recentLimit is how many finished requests /queue reports.
+const recentLimit = 10
+
+type Installer interface {
+	Install(ctx context.Context, names []string) error
+}
+
+type State string
+
+const (
+	StateQueued    State = "queued"
+	StateRunning   State = "running"
+	StateSucceeded State = "succeeded"
+	StateFailed    State = "failed"
+)
+
+type Request struct {
+	ID         int       `json:"id"`
+	Names      []string  `json:"names"`
+	State      State     `json:"state"`
+	Error      string    `json:"error,omitempty"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+	StartedAt  time.Time `json:"started_at,omitempty"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+	// Progress is the running request's progress across all its jobs.
+	Progress *Progress `json:"progress,omitempty"`
+}
+
+// Progress counts an install's jobs and the bytes of its downloads. Bytes
+// covers the downloads whose size is known.
+type Progress struct {
+	Jobs      int   `json:"jobs"`
+	DoneJobs  int   `json:"done_jobs"`
+	Bytes     int64 `json:"bytes"`
+	DoneBytes int64 `json:"done_bytes"`
+}
+
+// Download is one download in progress.
+type Download struct {
+	URL             string  `json:"url"`
+	DownloadedBytes int64   `json:"downloaded_bytes"`
+	TotalBytes      int64   `json:"total_bytes"`
+	BytesPerSec     float64 `json:"bytes_per_sec"`
+	// Stalled is set while a stalled download waits to be retried.
+	Stalled bool `json:"stalled,omitempty"`
+}
+
+// QueueStatus is what GET /queue returns: the running request, the ones
+// waiting behind it, the downloads in flight, and the most recently
+// finished requests, newest first.
+type QueueStatus struct {
+	Running   *Request   `json:"running,omitempty"`
+	Queued    []Request  `json:"queued"`
+	Downloads []Download `json:"downloads"`
+	Recent    []Request  `json:"recent"`
+}
+
+type Server struct {
+	Installer Installer
+	Stats     *stats.Recorder
+	// Token, when set, must come as a bearer token with POST /install, so
+	// only processes that can read the token file queue installs.
+	Token string
+
+	mu       sync.Mutex
+	nextID   int
+	queue    []*Request
+	running  *Request
+	recent   []*Request
+	requests map[int]*Request
+	active   map[string]Download
+	wake     chan struct{}
+
+	installs  int64
+	failures  int64
+	durations *histogram
+}
+
+func New(installer Installer, recorder *stats.Recorder) *Server {
+	return &Server{
+		Installer: installer,
+		Stats:     recorder,
+		requests:  map[int]*Request{},
+		active:    map[string]Download{},
+		wake:      make(chan struct{}, 1),
+		durations: newHistogram([]float64{1, 5, 15, 30, 60, 120, 300, 600, 1800}),
+	}
+}
+
+func (s *Server) Enqueue(names []string) Request {
+	s.mu.Lock()
+	s.nextID++
+	req := &Request{ID: s.nextID, Names: append([]string(nil), names...), State: StateQueued, EnqueuedAt: time.Now().UTC()}
+	s.queue = append(s.queue, req)
+	s.requests[req.ID] = req
+	snapshot := *req
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return snapshot
+}
+
+func (s *Server) Request(id int) (Request, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	req, ok := s.requests[id]
+	if !ok {
+		return Request{}, false
+	}
+	return *req, true
+}
+
+// Run processes queued requests one at a time until ctx is canceled.
+func (s *Server) Run(ctx context.Context) {
+	for {
+		req := s.dequeue()
+		if req == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.wake:
+				continue
+			}
+		}
+		s.process(ctx, req)
+	}
+}
+
+func (s *Server) dequeue() *Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		return nil
+	}
+	req := s.queue[0]
+	s.queue = s.queue[1:]
+	req.State = StateRunning
+	req.StartedAt = time.Now().UTC()
+	s.running = req
+	return req
+}
+
+func (s *Server) process(ctx context.Context, req *Request) {
+	start := time.Now()
+	err := s.Installer.Install(ctx, req.Names)
+	elapsed := time.Since(start)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	req.FinishedAt = time.Now().UTC()
+	if err != nil {
+		req.State = StateFailed
+		req.Error = err.Error()
+		s.failures++
+	} else {
+		req.State = StateSucceeded
+		s.installs++
+	}
+	s.durations.observe(elapsed.Seconds())
+	s.running = nil
+	// Requests that drop off the recent list are forgotten, so a daemon
+	// left running does not keep every request it ever served.
+	for _, old := range s.recent[min(len(s.recent), recentLimit-1):] {
+		delete(s.requests, old.ID)
+	}
+	s.recent = append([]*Request{req}, s.recent[:min(len(s.recent), recentLimit-1)]...)
+}
+
+// ObserveProgress records the running request's progress for /queue. It is
+// meant for native.Manager.Progress.
+func (s *Server) ObserveProgress(p Progress) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running != nil {
+		s.running.Progress = &p
+	}
+}
+
+// ObserveDownload tracks p for /queue. It is meant for fetch.Cache.Observe.
+func (s *Server) ObserveDownload(p fetch.Progress) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p.Done {
+		delete(s.active, p.URL)
+		return
+	}
+	s.active[p.URL] = Download{URL: p.URL, DownloadedBytes: p.DownloadedBytes, TotalBytes: p.TotalBytes, BytesPerSec: p.SpeedBytesPerSec, Stalled: p.Stalled}
+}
+
+func (s *Server) Queue() QueueStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := QueueStatus{Queued: []Request{}, Downloads: []Download{}, Recent: []Request{}}
+	if s.running != nil {
+		running := *s.running
+		if running.Progress != nil {
+			progress := *running.Progress
+			running.Progress = &progress
+		}
+		status.Running = &running
+	}
+	for _, req := range s.queue {
+		status.Queued = append(status.Queued, *req)
+	}
+	for _, d := range s.active {
+		status.Downloads = append(status.Downloads, d)
+	}
+	sort.Slice(status.Downloads, func(i, j int) bool { return status.Downloads[i].URL < status.Downloads[j].URL })
+	for _, req := range s.recent {
+		status.Recent = append(status.Recent, *req)
+	}
+	return status
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok\n")
+	})
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/install", s.handleInstall)
+	mux.HandleFunc("/queue", s.handleQueue)
+	return mux
+}
+
+func (s *Server) handleQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.Queue())
+}
+
+// FetchQueue asks the daemon at addr for its queue.
+func FetchQueue(ctx context.Context, addr string) (QueueStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+"/queue", nil)
+	if err != nil {
+		return QueueStatus{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return QueueStatus{}, fmt.Errorf("reach ub daemon at %s (is ub serve running?): %w", addr, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return QueueStatus{}, fmt.Errorf("ub daemon at %s returned status %d", addr, resp.StatusCode)
+	}
+	var status QueueStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return QueueStatus{}, fmt.Errorf("parse queue: %w", err)
+	}
+	return status, nil
+}
+
+func (s *Server) handleInstall(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// A web page can post to localhost too; browsers always send Origin
+	// with such requests, and cannot send JSON without a preflight.
+	if r.Header.Get("Origin") != "" {
+		http.Error(w, "cross-origin requests are not allowed", http.StatusForbidden)
+		return
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		http.Error(w, "content type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	if s.Token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.Token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "missing or wrong token", http.StatusUnauthorized)
+		return
+	}
+	var body struct {
+		Names []string `json:"names"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	names := make([]string, 0, len(body.Names))
+	for _, name := range body.Names {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		http.Error(w, "names must not be empty", http.StatusBadRequest)
+		return
+	}
+	req := s.Enqueue(names)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(req)
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = io.WriteString(w, s.renderMetrics())
+}
+
+func (s *Server) renderMetrics() string {
+	snap := s.Stats.Snapshot()
+	s.mu.Lock()
+	installs, failures := s.installs, s.failures
+	queued := len(s.queue)
+	durations := s.durations.clone()
+	s.mu.Unlock()
+
+	var b strings.Builder
+	writeMetric(&b, "ub_installs_total", "counter", "Install requests that completed successfully.", installs)
+	writeMetric(&b, "ub_install_failures_total", "counter", "Install requests that failed.", failures)
+	writeMetric(&b, "ub_download_bytes_total", "counter", "Bytes downloaded into the cache.", snap.BytesDownloaded)
+	writeMetric(&b, "ub_cache_hits_total", "counter", "Fetches served from the local cache.", snap.CacheHits)
+	writeMetric(&b, "ub_cache_misses_total", "counter", "Fetches that required a download.", snap.CacheMisses)
+	writeMetric(&b, "ub_queue_depth", "gauge", "Install requests waiting to run.", int64(queued))
+	durations.write(&b, "ub_install_duration_seconds", "Duration of install requests in seconds.")
+	return b.String()
+}
+
+func writeMetric(b *strings.Builder, name, kind, help string, value int64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
+
+type histogram struct {
+	bounds []float64
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	sorted := append([]float64(nil), bounds...)
+	sort.Float64s(sorted)
+	return &histogram{bounds: sorted, counts: make([]int64, len(sorted))}
+}
+
+func (h *histogram) observe(value float64) {
+	for idx, bound := range h.bounds {
+		if value <= bound {
+			h.counts[idx]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (h *histogram) clone() *histogram {
+	out := *h
+	out.counts = append([]int64(nil), h.counts...)
+	return &out
+}
+
+func (h *histogram) write(b *strings.Builder, name, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for idx, bound := range h.bounds {
+		fmt.Fprintf(b, "%s_bucket{le=\"%g\"} %d\n", name, bound, h.counts[idx])
+	}
+	fmt.Fprintf(b, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(b, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(b, "%s_count %d\n", name, h.count)
+}
+
+// TokenPath is where ub serve writes the token for POST /install.
+func TokenPath(prefix string) string {
+	return filepath.Join(prefix, "var", "ub", "serve.token")
+}
+
+// WriteToken writes a new random token to path, readable by its owner only,
+// and returns it.
+func WriteToken(path string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".serve-token-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.WriteString(tmp, token+"\n"); err != nil {
+		_ = tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("write token: %w", err)
+	}
+	return token, nil
+}
+
+func ListenAndServe(ctx context.Context, addr string, s *Server) error {
+	srv := &http.Server{Addr: addr, Handler: s.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	ran := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(ran)
+	}()
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.ListenAndServe() }()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := srv.Shutdown(shutdownCtx)
+		// Let the install in progress wind down, so its spans and stats
+		// are finished before the caller flushes them.
+		<-ran
+		return err
+	}
+}
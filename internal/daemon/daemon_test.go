@@ -0,0 +1,233 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"ub/internal/fetch"
+	"ub/internal/stats"
+)
+
+type fakeInstaller struct {
+	fail map[string]bool
+}
+
+func (f fakeInstaller) Install(_ context.Context, names []string) error {
+	for _, name := range names {
+		if f.fail[name] {
+			return errors.New("boom")
+		}
+	}
+	return nil
+}
+
+func waitForState(t *testing.T, s *Server, id int) Request {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if req, ok := s.Request(id); ok && (req.State == StateSucceeded || req.State == StateFailed) {
+			return req
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("request %d did not finish", id)
+	return Request{}
+}
+
+func TestServerMetricsAfterInstalls(t *testing.T) {
+	recorder := stats.NewRecorder()
+	recorder.CacheHit()
+	recorder.AddDownloaded(4096)
+	s := New(fakeInstaller{fail: map[string]bool{"broken": true}}, recorder)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/install", "application/json", strings.NewReader(`{"names":["jq"]}`))
+	if err != nil {
+		t.Fatalf("post install: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	waitForState(t, s, 1)
+	failed := s.Enqueue([]string{"broken"})
+	if req := waitForState(t, s, failed.ID); req.State != StateFailed || req.Error != "boom" {
+		t.Fatalf("failed request = %+v", req)
+	}
+
+	resp, err = http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("get metrics: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	text := string(body)
+	for _, want := range []string{
+		"ub_installs_total 1",
+		"ub_install_failures_total 1",
+		"ub_download_bytes_total 4096",
+		"ub_cache_hits_total 1",
+		`ub_install_duration_seconds_bucket{le="+Inf"} 2`,
+		"ub_install_duration_seconds_count 2",
+	} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("metrics missing %q:\n%s", want, text)
+		}
+	}
+}
+
+func TestInstallRejectsEmptyNames(t *testing.T) {
+	s := New(fakeInstaller{}, nil)
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/install", "application/json", strings.NewReader(`{"names":[" "]}`))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", resp.StatusCode)
+	}
+}
+
+type blockingInstaller struct {
+	started chan []string
+	release chan struct{}
+}
+
+func (b blockingInstaller) Install(ctx context.Context, names []string) error {
+	b.started <- names
+	<-b.release
+	return nil
+}
+
+func TestQueueShowsRunningDownloadsAndRecent(t *testing.T) {
+	installer := blockingInstaller{started: make(chan []string), release: make(chan struct{})}
+	s := New(installer, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	first := s.Enqueue([]string{"ffmpeg"})
+	<-installer.started
+	second := s.Enqueue([]string{"jq"})
+	s.ObserveDownload(fetch.Progress{URL: "https://ghcr.io/v2/homebrew/core/x265/blobs/sha256:aa", DownloadedBytes: 10, TotalBytes: 40})
+	s.ObserveDownload(fetch.Progress{URL: "https://ghcr.io/v2/homebrew/core/done/blobs/sha256:bb", Done: true})
+
+	status, err := FetchQueue(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("FetchQueue: %v", err)
+	}
+	if status.Running == nil || status.Running.ID != first.ID || status.Running.State != StateRunning {
+		t.Fatalf("running = %+v", status.Running)
+	}
+	if len(status.Queued) != 1 || status.Queued[0].ID != second.ID {
+		t.Fatalf("queued = %+v", status.Queued)
+	}
+	if len(status.Downloads) != 1 || status.Downloads[0].DownloadedBytes != 10 || status.Downloads[0].TotalBytes != 40 {
+		t.Fatalf("downloads = %+v", status.Downloads)
+	}
+
+	installer.release <- struct{}{}
+	<-installer.started
+	installer.release <- struct{}{}
+	waitForState(t, s, second.ID)
+	status = s.Queue()
+	if status.Running != nil || len(status.Queued) != 0 {
+		t.Fatalf("queue not drained: %+v", status)
+	}
+	if len(status.Recent) != 2 || status.Recent[0].ID != second.ID || status.Recent[1].ID != first.ID {
+		t.Fatalf("recent = %+v, want newest first", status.Recent)
+	}
+}
+
+func TestInstallChecksTokenContentTypeAndOrigin(t *testing.T) {
+	s := New(fakeInstaller{}, nil)
+	s.Token = "secret"
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"no token", map[string]string{"Content-Type": "application/json"}, http.StatusUnauthorized},
+		{"wrong token", map[string]string{"Content-Type": "application/json", "Authorization": "Bearer guess"}, http.StatusUnauthorized},
+		{"form post", map[string]string{"Content-Type": "text/plain", "Authorization": "Bearer secret"}, http.StatusUnsupportedMediaType},
+		{"from a web page", map[string]string{"Content-Type": "application/json", "Authorization": "Bearer secret", "Origin": "https://example.com"}, http.StatusForbidden},
+		{"accepted", map[string]string{"Content-Type": "application/json; charset=utf-8", "Authorization": "Bearer secret"}, http.StatusAccepted},
+	} {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/install", strings.NewReader(`{"names":["jq"]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Fatalf("%s: status = %d, want %d", tc.name, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestFinishedRequestsAreForgotten(t *testing.T) {
+	s := New(fakeInstaller{}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	var last Request
+	for range recentLimit + 5 {
+		last = s.Enqueue([]string{"jq"})
+		waitForState(t, s, last.ID)
+	}
+	s.mu.Lock()
+	kept := len(s.requests)
+	s.mu.Unlock()
+	if kept != recentLimit {
+		t.Fatalf("kept %d requests, want %d", kept, recentLimit)
+	}
+	if _, ok := s.Request(last.ID); !ok {
+		t.Fatal("the newest request was forgotten")
+	}
+	if _, ok := s.Request(1); ok {
+		t.Fatal("the oldest request is still kept")
+	}
+}
+
+func TestWriteTokenIsPrivate(t *testing.T) {
+	path := TokenPath(t.TempDir())
+	token, err := WriteToken(path)
+	if err != nil {
+		t.Fatalf("WriteToken: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("token file mode = %v, %v; want 0600", info.Mode().Perm(), err)
+	}
+	if data, _ := os.ReadFile(path); strings.TrimSpace(string(data)) != token || len(token) != 64 {
+		t.Fatalf("token file = %q, token %q", data, token)
+	}
+}
@@ -6,20 +6,24 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"ub/internal/fetch"
 	"ub/internal/formula"
 	"ub/internal/lock"
+	"ub/internal/native"
+	"ub/internal/pipeline"
 	"ub/internal/scheduler"
 )
 
 type Installer struct {
-	TapDir  string
-	RootDir string
+	Taps     formula.Taps
+	RootDir  string
 	CacheDir string
-	Jobs    int
+	Jobs     int
 }
 
 type installReceipt struct {
@@ -36,25 +40,160 @@ type formulaJob struct {
 	fetcher *fetch.Cache
 }
 
-func (j formulaJob) ID() string {
-	return j.formula.Name
+// tapSource builds tap formulas from source through the shared install
+// pipeline. Tap installs have no link step.
+type tapSource struct {
+	formulas map[string]formula.Formula
+	rootDir  string
+	taps     formula.Taps
+	fetcher  *fetch.Cache
 }
 
-func (j formulaJob) Requires() []string {
-	return j.formula.Deps
+func (s tapSource) job(name string) formulaJob {
+	// The receipt names the tap the formula came from; a formula embedded
+	// in a plan file may no longer be found, and then it names none.
+	tapDir, _ := s.taps.Find(name)
+	return formulaJob{formula: s.formulas[name], rootDir: s.rootDir, tapDir: tapDir, fetcher: s.fetcher}
 }
 
-func (j formulaJob) Run(ctx context.Context) error {
-	if _, err := j.fetcher.Fetch(ctx, j.formula.Source.URL); err != nil {
+func (s tapSource) Fetch(ctx context.Context, u *pipeline.Unit) error {
+	dir, err := s.job(u.Name).fetchSource(ctx)
+	if err != nil {
+		return err
+	}
+	u.Artifact = dir
+	return nil
+}
+
+func (s tapSource) Materialize(ctx context.Context, u *pipeline.Unit) error {
+	release, err := scheduler.EnterPhase(ctx, scheduler.PhaseCPU)
+	if err != nil {
 		return err
 	}
-	if err := j.runBuildSteps(ctx); err != nil {
+	defer release()
+	j := s.job(u.Name)
+	if err := j.runBuildSteps(ctx, u.Artifact); err != nil {
 		return err
 	}
-	return j.writeReceipt()
+	if err := j.checkOutputs(); err != nil {
+		return err
+	}
+	u.Dir = j.installDir()
+	return nil
+}
+
+func (s tapSource) Link(context.Context, *pipeline.Unit) error {
+	return nil
+}
+
+func (s tapSource) Receipt(_ context.Context, u *pipeline.Unit) error {
+	return s.job(u.Name).writeReceipt()
+}
+
+// fetchSource checks out or downloads and unpacks the formula's source,
+// applies its patches, and returns the directory to build in.
+func (j formulaJob) fetchSource(ctx context.Context) (string, error) {
+	workDir := filepath.Join(j.rootDir, ".work", j.formula.Name)
+	src := j.formula.Source
+	if src.Branch != "" || src.Tag != "" || src.Revision != "" || fetch.IsGitURL(src.URL) {
+		// Git sources are checked out and built in place.
+		srcDir := filepath.Join(workDir, "src")
+		if err := os.RemoveAll(srcDir); err != nil {
+			return "", fmt.Errorf("clear source dir: %w", err)
+		}
+		if err := os.MkdirAll(workDir, 0o755); err != nil {
+			return "", fmt.Errorf("create work dir: %w", err)
+		}
+		ref := fetch.GitRef{Branch: src.Branch, Tag: src.Tag, Revision: src.Revision}
+		if _, err := j.fetcher.FetchGit(ctx, src.URL, ref, srcDir); err != nil {
+			return "", err
+		}
+		workDir = srcDir
+	} else {
+		archive, err := j.fetcher.Fetch(ctx, src.URL)
+		if err != nil {
+			return "", err
+		}
+		if isSourceArchive(src.URL) {
+			if workDir, err = unpackSource(ctx, archive, workDir); err != nil {
+				return "", err
+			}
+		}
+	}
+	if err := j.applyPatches(ctx, workDir); err != nil {
+		return "", err
+	}
+	return workDir, nil
+}
+
+func (j formulaJob) installDir() string {
+	return filepath.Join(j.rootDir, j.formula.Name, j.formula.Version)
+}
+
+// checkOutputs fails the job when a declared output is missing, or when one
+// under bin, sbin or libexec is not an executable file, so a broken recipe
+// is caught at install time rather than on first use.
+func (j formulaJob) checkOutputs() error {
+	var problems []string
+	for _, out := range j.formula.Build.Outputs {
+		info, err := os.Stat(filepath.Join(j.installDir(), out))
+		if err != nil {
+			problems = append(problems, out+" is missing")
+			continue
+		}
+		switch strings.SplitN(filepath.ToSlash(filepath.Clean(out)), "/", 2)[0] {
+		case "bin", "sbin", "libexec":
+			if !info.Mode().IsRegular() || info.Mode().Perm()&0o111 == 0 {
+				problems = append(problems, out+" is not executable")
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("formula %q build did not produce its outputs: %s", j.formula.Name, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+func isSourceArchive(rawURL string) bool {
+	name := strings.ToLower(path.Base(strings.SplitN(rawURL, "?", 2)[0]))
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz", ".tar.xz", ".txz", ".tar.bz2", ".tbz", ".tbz2", ".zip"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
 }
 
-func (j formulaJob) runBuildSteps(ctx context.Context) error {
+// unpackSource extracts archive into <workDir>/src and returns the directory
+// to build in: the archive's single top-level directory when it has one.
+func unpackSource(ctx context.Context, archive, workDir string) (string, error) {
+	srcDir := filepath.Join(workDir, "src")
+	if err := os.RemoveAll(srcDir); err != nil {
+		return "", fmt.Errorf("clear source dir: %w", err)
+	}
+	if err := os.MkdirAll(srcDir, 0o755); err != nil {
+		return "", fmt.Errorf("create source dir: %w", err)
+	}
+	if err := native.ExtractSource(ctx, archive, srcDir); err != nil {
+		return "", fmt.Errorf("unpack source: %w", err)
+	}
+	entries, err := os.ReadDir(srcDir)
+	if err != nil {
+		return "", fmt.Errorf("read source dir: %w", err)
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		return filepath.Join(srcDir, entries[0].Name()), nil
+	}
+	return srcDir, nil
+}
+
+// applyPatches applies the formula's patches in order, downloading remote
+// ones through the cache and checking their sha256 first.
+func (j formulaJob) applyPatches(ctx context.Context, dir string) error {
+	return formula.ApplyPatches(ctx, j.fetcher, j.formula.Patches, dir)
+}
+
+func (j formulaJob) runBuildSteps(ctx context.Context, workDir string) error {
 	if len(j.formula.Build.Steps) == 0 {
 		select {
 		case <-ctx.Done():
@@ -64,10 +203,13 @@ func (j formulaJob) runBuildSteps(ctx context.Context) error {
 		}
 	}
 
-	workDir := filepath.Join(j.rootDir, ".work", j.formula.Name)
 	if err := os.MkdirAll(workDir, 0o755); err != nil {
 		return fmt.Errorf("create work dir: %w", err)
 	}
+	prefix := j.installDir()
+	if err := os.MkdirAll(prefix, 0o755); err != nil {
+		return fmt.Errorf("create install dir: %w", err)
+	}
 
 	for _, step := range j.formula.Build.Steps {
 		cmd := exec.CommandContext(ctx, "sh", "-c", step)
@@ -75,6 +217,7 @@ func (j formulaJob) runBuildSteps(ctx context.Context) error {
 		cmd.Env = []string{
 			"PATH=/usr/bin:/bin:/usr/sbin:/sbin",
 			"HOME=" + workDir,
+			"PREFIX=" + prefix,
 			"UB_FORMULA_NAME=" + j.formula.Name,
 			"UB_FORMULA_VERSION=" + j.formula.Version,
 		}
@@ -89,7 +232,7 @@ func (j formulaJob) runBuildSteps(ctx context.Context) error {
 }
 
 func (j formulaJob) writeReceipt() error {
-	installDir := filepath.Join(j.rootDir, j.formula.Name, j.formula.Version)
+	installDir := j.installDir()
 	if err := os.MkdirAll(installDir, 0o755); err != nil {
 		return fmt.Errorf("create install dir: %w", err)
 	}
@@ -121,12 +264,18 @@ func (i Installer) Install(ctx context.Context, formulas map[string]formula.Form
 	}
 	defer installLock.Release()
 
-	fetcher := fetch.NewCache(i.CacheDir)
-	jobs := make([]scheduler.Job, 0, len(formulas))
-	for _, f := range formulas {
-		jobs = append(jobs, formulaJob{formula: f, rootDir: i.RootDir, tapDir: i.TapDir, fetcher: fetcher})
+	source := tapSource{formulas: formulas, rootDir: i.RootDir, taps: i.Taps, fetcher: fetch.NewCache(i.CacheDir)}
+	packages := make(map[string]pipeline.Package, len(formulas))
+	for name, f := range formulas {
+		// A source already in the cache hints at how long the build takes.
+		cost, _ := source.fetcher.CachedSize(f.Source.URL)
+		packages[name] = pipeline.Package{Name: name, Version: f.Version, Deps: f.Deps, Cost: cost}
 	}
 
+	jobs, err := pipeline.Jobs(source, packages, nil)
+	if err != nil {
+		return err
+	}
 	executor := scheduler.Executor{Workers: i.Jobs}
 	return executor.Run(ctx, jobs)
 }
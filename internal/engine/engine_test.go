@@ -0,0 +1,136 @@
+package engine
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ub/internal/fetch"
+	"ub/internal/formula"
+)
+
+const greetingPatch = `--- a/greeting.txt
++++ b/greeting.txt
+@@ -1 +1 @@
+-hello
++hello, patched
+`
+
+func TestApplyPatchesInlineAndFetched(t *testing.T) {
+	if _, err := exec.LookPath("patch"); err != nil {
+		t.Skip("patch not available")
+	}
+	tmp := t.TempDir()
+	dir := filepath.Join(tmp, "src")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "greeting.txt"), []byte("hello\n"), 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	second := strings.ReplaceAll(greetingPatch, "-hello\n+hello, patched", "-hello, patched\n+hello, twice")
+	patchFile := filepath.Join(tmp, "second.patch")
+	if err := os.WriteFile(patchFile, []byte(second), 0o644); err != nil {
+		t.Fatalf("write patch: %v", err)
+	}
+	sum := sha256.Sum256([]byte(second))
+
+	job := formulaJob{
+		formula: formula.Formula{Name: "greet", Version: "1.0", Patches: []formula.Patch{
+			{Data: greetingPatch},
+			{URL: "file://" + patchFile, SHA256: hex.EncodeToString(sum[:])},
+		}},
+		fetcher: fetch.NewCache(filepath.Join(tmp, "cache")),
+	}
+	if err := job.applyPatches(context.Background(), dir); err != nil {
+		t.Fatalf("applyPatches: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "greeting.txt"))
+	if err != nil || string(data) != "hello, twice\n" {
+		t.Fatalf("greeting.txt = %q, %v", data, err)
+	}
+
+	job.formula.Patches = []formula.Patch{{URL: "file://" + patchFile, SHA256: strings.Repeat("0", 64)}}
+	if err := job.applyPatches(context.Background(), dir); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+}
+
+func TestUnpackSourceEntersSingleTopLevelDir(t *testing.T) {
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "greet-1.0.tar.gz")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatalf("create archive: %v", err)
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	body := "all:\n"
+	if err := tw.WriteHeader(&tar.Header{Name: "greet-1.0/Makefile", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(body))}); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+	if _, err := tw.Write([]byte(body)); err != nil {
+		t.Fatalf("write body: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("close gzip: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("close archive: %v", err)
+	}
+
+	if !isSourceArchive("https://example.com/greet-1.0.tar.gz?download=1") {
+		t.Fatal("expected .tar.gz URL to be a source archive")
+	}
+	dir, err := unpackSource(context.Background(), archive, filepath.Join(tmp, "work"))
+	if err != nil {
+		t.Fatalf("unpackSource: %v", err)
+	}
+	if want := filepath.Join(tmp, "work", "src", "greet-1.0"); dir != want {
+		t.Fatalf("build dir = %q, want %q", dir, want)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "Makefile")); err != nil || string(data) != body {
+		t.Fatalf("Makefile = %q, %v", data, err)
+	}
+}
+
+func TestInstallChecksDeclaredOutputs(t *testing.T) {
+	tmp := t.TempDir()
+	installer := Installer{RootDir: filepath.Join(tmp, "root"), CacheDir: filepath.Join(tmp, "cache"), Jobs: 1}
+	hello := formula.Formula{Name: "hello", Version: "1.0", Build: formula.Build{
+		Steps:   []string{`mkdir -p "$PREFIX/bin" && echo 'echo hi' > "$PREFIX/bin/hello"`},
+		Outputs: []string{"bin/hello", "share/man/man1/hello.1"},
+	}}
+	err := installer.Install(context.Background(), map[string]formula.Formula{"hello": hello})
+	if err == nil {
+		t.Fatal("expected missing outputs to fail the job")
+	}
+	for _, want := range []string{"bin/hello is not executable", "share/man/man1/hello.1 is missing"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("error %q missing %q", err, want)
+		}
+	}
+	receipt := filepath.Join(installer.RootDir, "hello", "1.0", "INSTALL_RECEIPT.json")
+	if _, err := os.Stat(receipt); !os.IsNotExist(err) {
+		t.Fatalf("expected no receipt after a failed check, got err=%v", err)
+	}
+
+	hello.Build.Steps = append(hello.Build.Steps, `chmod +x "$PREFIX/bin/hello"`)
+	hello.Build.Outputs = []string{"bin/hello"}
+	if err := installer.Install(context.Background(), map[string]formula.Formula{"hello": hello}); err != nil {
+		t.Fatalf("Install: %v", err)
+	}
+	if _, err := os.Stat(receipt); err != nil {
+		t.Fatalf("expected receipt: %v", err)
+	}
+}
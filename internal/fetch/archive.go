@@ -0,0 +1,35 @@
+package fetch
+
+import "bytes"
+
+type ArchiveFormat int
+
+const (
+	FormatUnknown ArchiveFormat = iota
+	FormatTar
+	FormatGzip
+	FormatBzip2
+	FormatXz
+	FormatZip
+)
+
+// SniffLen covers the ustar magic at offset 257.
+const SniffLen = 262
+
+// SniffArchive identifies an archive from its first SniffLen bytes; file
+// names are not trusted, since cask URLs rarely carry an extension.
+func SniffArchive(header []byte) ArchiveFormat {
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")):
+		return FormatZip
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return FormatGzip
+	case bytes.HasPrefix(header, []byte("BZh")):
+		return FormatBzip2
+	case bytes.HasPrefix(header, []byte{0xfd, '7', 'z', 'X', 'Z', 0}):
+		return FormatXz
+	case len(header) >= SniffLen && string(header[257:262]) == "ustar":
+		return FormatTar
+	}
+	return FormatUnknown
+}
@@ -0,0 +1,23 @@
+package fetch
+
+import "testing"
+
+func TestSniffArchive(t *testing.T) {
+	ustar := make([]byte, SniffLen)
+	copy(ustar[257:], "ustar")
+	for _, tc := range []struct {
+		header []byte
+		want   ArchiveFormat
+	}{
+		{[]byte{'P', 'K', 0x03, 0x04, 0x00}, FormatZip},
+		{[]byte{0x1f, 0x8b, 0x08, 0x00}, FormatGzip},
+		{[]byte("BZh91AY&SY"), FormatBzip2},
+		{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00}, FormatXz},
+		{ustar, FormatTar},
+		{[]byte("koly"), FormatUnknown},
+	} {
+		if got := SniffArchive(tc.header); got != tc.want {
+			t.Fatalf("SniffArchive(%q) = %d, want %d", tc.header[:min(len(tc.header), 8)], got, tc.want)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
@@ -16,14 +17,40 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"ub/internal/stats"
+	"ub/internal/trace"
 )
 
 type Cache struct {
-	Dir string
+	Dir   string
+	Stats *stats.Recorder
+	// HTTP and Clock default to a client with a DNS cache and the system clock;
+	// tests replace them to inject network failures and skip backoff waits.
+	HTTP  HTTPDoer
+	Clock Clock
+	// Observe, when set, also receives the progress of every fetch. A fetch
+	// that fails ends with a Done update too.
+	Observe func(Progress)
+	// Validate, when set, checks a download before it is published into
+	// the cache, so a truncated file or an error page is never served from
+	// it. A rejected download fails with ErrInvalidContent and is retried.
+	Validate func(url, path string) error
+	// Compress stores JSON and uncompressed tar downloads gzipped; read
+	// what Fetch returns through Open.
+	Compress bool
+	// StallTimeout abandons a download attempt that waits this long for a
+	// response or for its next bytes, so a large download takes as long as
+	// it needs while it keeps moving. The attempt is retried and resumes
+	// where it stopped. Zero waits forever.
+	StallTimeout time.Duration
 
 	mu            sync.Mutex
 	locks         map[string]*sync.Mutex
+	expected      map[string]int64
 	lastPruneTime time.Time
+	dbMu          sync.Mutex
+	creds         map[string]credential
 }
 
 type Progress struct {
@@ -33,6 +60,53 @@ type Progress struct {
 	SpeedBytesPerSec float64
 	Cached           bool
 	Done             bool
+	// Stalled marks the update sent when an attempt stalled and is about
+	// to be retried; DownloadedBytes is what the attempt had received.
+	Stalled bool
+}
+
+// ErrInvalidContent marks a download that Validate rejected.
+var ErrInvalidContent = errors.New("invalid download")
+
+type StatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d", e.StatusCode)
+}
+
+// HTTPDoer is the subset of *http.Client the cache uses.
+type HTTPDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SystemClock is the production Clock.
+var SystemClock Clock = systemClock{}
+
+func (c *Cache) httpDoer() HTTPDoer {
+	if c.HTTP != nil {
+		return c.HTTP
+	}
+	return defaultHTTP
+}
+
+func (c *Cache) clock() Clock {
+	if c.Clock != nil {
+		return c.Clock
+	}
+	return SystemClock
 }
 
 func NewCache(dir string) *Cache {
@@ -44,9 +118,175 @@ func (c *Cache) Fetch(ctx context.Context, url string) (string, error) {
 }
 
 func (c *Cache) FetchWithProgress(ctx context.Context, url string, onProgress func(Progress)) (string, error) {
+	return c.fetch(ctx, url, onProgress, false)
+}
+
+// FetchRevalidated is FetchWithProgress for URLs whose content changes without
+// the URL changing (version :latest casks). A cached copy is only reused when
+// a HEAD request shows the same ETag or Last-Modified it was downloaded with.
+func (c *Cache) FetchRevalidated(ctx context.Context, url string, onProgress func(Progress)) (string, error) {
+	return c.fetch(ctx, url, onProgress, true)
+}
+
+// CachedSize returns the size of url's cached download without fetching it.
+func (c *Cache) CachedSize(url string) (int64, bool) {
+	path, ok := storedPath(c.cachePathForKey(hash(canonicalizeURL(url))))
+	if local, isLocal := fileURLPath(url); isLocal {
+		path, ok = local, true
+	}
+	if !ok {
+		return 0, false
+	}
+	size, err := entrySize(path)
+	return size, err == nil
+}
+
+// Evict removes url's cached download, so the next fetch downloads it
+// again. It does nothing for file:// URLs, which are not cached.
+func (c *Cache) Evict(url string) error {
+	if _, ok := fileURLPath(url); ok {
+		return nil
+	}
+	key := hash(canonicalizeURL(url))
+	target := c.cachePathForKey(key)
+	lock := c.getLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := removeEntry(target); err != nil {
+		return fmt.Errorf("evict cached download: %w", err)
+	}
+	_ = os.Remove(validatorsPath(target))
+	return nil
+}
+
+// RemoteSize is the size of url's download: the cached copy's size, or the
+// Content-Length of a HEAD request, which for a bottle on ghcr.io is the
+// registry's OCI blob size. It is false when the size is unknown.
+func (c *Cache) RemoteSize(ctx context.Context, url string) (int64, bool) {
+	if size, ok := c.CachedSize(url); ok {
+		return size, true
+	}
+	if _, ok := fileURLPath(url); ok || IsGitURL(url) {
+		return 0, false
+	}
+	bearerToken := ""
+	if token, _, ok, err := c.fetchGHCRTokenForBlobURL(ctx, url); err == nil && ok {
+		bearerToken = token
+	}
+	resp, err := c.doRequest(ctx, http.MethodHead, url, bearerToken)
+	if err != nil {
+		return 0, false
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 || resp.ContentLength <= 0 {
+		return 0, false
+	}
+	return resp.ContentLength, true
+}
+
+// ExpectSize records the size of url's download, found ahead of time, for
+// progress to report when the response has no Content-Length.
+func (c *Cache) ExpectSize(url string, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.expected == nil {
+		c.expected = map[string]int64{}
+	}
+	c.expected[canonicalizeURL(url)] = size
+}
+
+func (c *Cache) expectedSize(url string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	size, ok := c.expected[canonicalizeURL(url)]
+	return size, ok
+}
+
+// Reachable checks that url could be fetched without downloading it: a
+// file:// path must exist, a git repository must answer ls-remote, and an
+// HTTP server must accept a HEAD (or, failing that, a GET) request.
+func (c *Cache) Reachable(ctx context.Context, url string) error {
+	if local, ok := fileURLPath(url); ok {
+		_, err := fetchLocal(url, local, nil)
+		return err
+	}
+	if IsGitURL(url) {
+		_, err := runGit(ctx, "", "ls-remote", "--quiet", strings.TrimPrefix(strings.TrimSpace(url), "git+"), "HEAD")
+		return err
+	}
+	resp, err := c.doRequest(ctx, http.MethodHead, url, "")
+	if err == nil && resp.StatusCode == http.StatusMethodNotAllowed {
+		_ = resp.Body.Close()
+		resp, err = c.doRequest(ctx, http.MethodGet, url, "")
+	}
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return &StatusError{URL: url, StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+type validators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// Provenance records where a cached download came from. It is kept next to
+// the download, so a cache hit reports the original download.
+type Provenance struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	// TokenScope is the registry scope of the bearer token the download
+	// was authorized with.
+	TokenScope   string    `json:"token_scope,omitempty"`
+	DownloadedAt time.Time `json:"downloaded_at,omitzero"`
+}
+
+// Provenance returns what is known about how url's cached download was
+// fetched; for file:// URLs and entries cached by older versions that is
+// only the URL.
+func (c *Cache) Provenance(url string) Provenance {
+	if _, ok := fileURLPath(url); ok {
+		return Provenance{URL: url}
+	}
+	data, err := os.ReadFile(validatorsPath(c.cachePathForKey(hash(canonicalizeURL(url)))))
+	if err != nil {
+		return Provenance{URL: url}
+	}
+	var p Provenance
+	if err := json.Unmarshal(data, &p); err != nil || p.URL == "" {
+		p = Provenance{URL: url}
+	}
+	return p
+}
+
+func (c *Cache) fetch(ctx context.Context, url string, onProgress func(Progress), revalidate bool) (path string, err error) {
 	if strings.TrimSpace(url) == "" {
 		return "", nil
 	}
+	ctx, span := trace.Start(ctx, "ub.fetch", trace.String("url.full", canonicalizeURL(url)))
+	defer func() { span.End(err) }()
+	if observe := c.Observe; observe != nil {
+		report := onProgress
+		onProgress = func(p Progress) {
+			if report != nil {
+				report(p)
+			}
+			observe(p)
+		}
+		defer func() {
+			if err != nil {
+				observe(Progress{URL: url, Done: true})
+			}
+		}()
+	}
+	if local, ok := fileURLPath(url); ok {
+		return fetchLocal(url, local, onProgress)
+	}
 	if err := os.MkdirAll(c.Dir, 0o755); err != nil {
 		return "", fmt.Errorf("create cache dir: %w", err)
 	}
@@ -65,57 +305,114 @@ func (c *Cache) FetchWithProgress(ctx context.Context, url string, onProgress fu
 	lock.Lock()
 	defer lock.Unlock()
 
-	if _, err := os.Stat(target); err == nil {
+	if _, ok := storedPath(target); ok && revalidate && !c.stillFresh(ctx, url, target) {
+		span.SetAttributes(trace.Bool("ub.cache_stale", true))
+		_ = removeEntry(target)
+	}
+	if path, ok := storedPath(target); ok {
+		c.Stats.CacheHit()
+		span.SetAttributes(trace.Bool("ub.cache_hit", true))
 		if onProgress != nil {
-			info, statErr := os.Stat(target)
-			if statErr == nil {
-				onProgress(Progress{URL: url, DownloadedBytes: info.Size(), TotalBytes: info.Size(), Cached: true, Done: true})
+			if size, sizeErr := entrySize(path); sizeErr == nil {
+				onProgress(Progress{URL: url, DownloadedBytes: size, TotalBytes: size, Cached: true, Done: true})
 			}
 		}
-		return target, nil
+		return path, nil
 	}
 
+	c.Stats.CacheMiss()
+	span.SetAttributes(trace.Bool("ub.cache_hit", false))
 	if err := c.downloadWithRetry(ctx, url, target, onProgress); err != nil {
 		return "", err
 	}
 
-	return target, nil
+	path, ok := storedPath(target)
+	if !ok {
+		return "", fmt.Errorf("cached download for %q disappeared", url)
+	}
+	return path, nil
+}
+
+// fileURLPath returns the local path of a file:// URL. Such files are read in
+// place rather than copied into the cache.
+func fileURLPath(raw string) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	return filepath.FromSlash(u.Path), true
+}
+
+func fetchLocal(url, path string, onProgress func(Progress)) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", &StatusError{URL: url, StatusCode: http.StatusNotFound}
+		}
+		return "", err
+	}
+	if onProgress != nil {
+		onProgress(Progress{URL: url, DownloadedBytes: info.Size(), TotalBytes: info.Size(), Cached: true, Done: true})
+	}
+	return path, nil
 }
 
 func (c *Cache) downloadWithRetry(ctx context.Context, url, target string, onProgress func(Progress)) error {
 	const maxAttempts = 3
 	var lastErr error
+	var last Progress
+	report := onProgress
+	if report != nil {
+		report = func(p Progress) {
+			last = p
+			onProgress(p)
+		}
+	}
 
 	for attempt := 1; attempt <= maxAttempts; attempt++ {
-		if err := c.downloadOnce(ctx, url, target, onProgress); err == nil {
+		if err := c.downloadOnce(ctx, url, target, report); err == nil {
 			return nil
 		} else {
 			lastErr = err
 		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 
+		if permanent(lastErr) {
+			return fmt.Errorf("download %q: %w", url, ClassifyNetworkError(url, lastErr))
+		}
 		if attempt == maxAttempts {
 			break
 		}
+		if onProgress != nil && errors.Is(lastErr, ErrStalled) {
+			onProgress(Progress{URL: url, DownloadedBytes: last.DownloadedBytes, TotalBytes: last.TotalBytes, Stalled: true})
+		}
 
 		backoff := time.Duration(attempt*attempt) * 200 * time.Millisecond
 		jitter := time.Duration(rand.Intn(120)) * time.Millisecond
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case <-time.After(backoff + jitter):
+		case <-c.clock().After(backoff + jitter):
 		}
 	}
 
-	return fmt.Errorf("download %q failed after retries: %w", url, lastErr)
+	return fmt.Errorf("download %q failed after retries: %w", url, ClassifyNetworkError(url, lastErr))
 }
 
-func (c *Cache) downloadOnce(ctx context.Context, url, target string, onProgress func(Progress)) error {
-	bearerToken := ""
-	if token, ok, tokenErr := c.fetchGHCRTokenForBlobURL(ctx, url); tokenErr == nil && ok {
-		bearerToken = token
+func (c *Cache) downloadOnce(ctx context.Context, url, target string, onProgress func(Progress)) (err error) {
+	ctx, watch, stop := watchStalls(ctx, c.StallTimeout)
+	defer stop()
+	defer func() { err = stallError(ctx, err) }()
+
+	bearerToken, scope := "", ""
+	if token, tokenScope, ok, tokenErr := c.fetchGHCRTokenForBlobURL(ctx, url); tokenErr == nil && ok {
+		bearerToken, scope = token, tokenScope
 	}
 
-	resp, err := c.doDownloadRequest(ctx, url, bearerToken)
+	part, offset := resumePartial(url, target)
+	resp, err := c.doDownloadRequest(ctx, url, bearerToken, part.rangeHeader(offset))
 	if err != nil {
 		return fmt.Errorf("download request: %w", err)
 	}
@@ -123,12 +420,13 @@ func (c *Cache) downloadOnce(ctx context.Context, url, target string, onProgress
 	if resp.StatusCode == http.StatusUnauthorized {
 		challenge := resp.Header.Get("Www-Authenticate")
 		_ = resp.Body.Close()
-		token, tokenErr := c.fetchBearerToken(ctx, challenge)
+		token, tokenScope, tokenErr := c.fetchBearerToken(ctx, challenge, resp.Request.URL.Host)
 		if tokenErr != nil {
 			return fmt.Errorf("registry authentication required: %w", tokenErr)
 		}
+		scope = tokenScope
 
-		resp, err = c.doDownloadRequest(ctx, url, token)
+		resp, err = c.doDownloadRequest(ctx, url, token, part.rangeHeader(offset))
 		if err != nil {
 			return fmt.Errorf("authenticated download request: %w", err)
 		}
@@ -136,25 +434,49 @@ func (c *Cache) downloadOnce(ctx context.Context, url, target string, onProgress
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0 && contentRangeStart(resp) == offset:
+	case resp.StatusCode >= 200 && resp.StatusCode < 300 && resp.StatusCode != http.StatusPartialContent:
+		// A full response: the server ignored the range, or the file changed.
+		offset = 0
+		part = partial{URL: url, Validators: validatorsFrom(resp.Header)}
+	default:
+		if resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			discardPartial(target)
+		}
+		return &StatusError{URL: url, StatusCode: resp.StatusCode}
 	}
 
-	tmp := target + ".tmp"
-	f, err := os.Create(tmp)
+	tmp := partialPath(target)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err == nil {
+		if err = f.Truncate(offset); err == nil {
+			_, err = f.Seek(offset, io.SeekStart)
+		}
+		if err != nil {
+			_ = f.Close()
+		}
+	}
 	if err != nil {
+		discardPartial(target)
 		return fmt.Errorf("create temp cache file: %w", err)
 	}
+	w := newCheckpointWriter(f, part, target)
 
 	totalBytes := resp.ContentLength
-	start := time.Now()
+	if totalBytes >= 0 {
+		totalBytes += offset
+	} else if size, ok := c.expectedSize(url); ok {
+		totalBytes = size
+	}
+	start := c.clock().Now()
 	var downloaded int64
 	buf := make([]byte, 32*1024)
 
 	if onProgress != nil {
 		onProgress(Progress{
 			URL:              url,
-			DownloadedBytes:  0,
+			DownloadedBytes:  offset,
 			TotalBytes:       totalBytes,
 			SpeedBytesPerSec: 0,
 			Done:             false,
@@ -164,16 +486,17 @@ func (c *Cache) downloadOnce(ctx context.Context, url, target string, onProgress
 	for {
 		n, readErr := resp.Body.Read(buf)
 		if n > 0 {
-			if _, writeErr := f.Write(buf[:n]); writeErr != nil {
+			watch.kick()
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
 				_ = f.Close()
-				_ = os.Remove(tmp)
+				discardPartial(target)
 				return fmt.Errorf("write cache file: %w", writeErr)
 			}
 			downloaded += int64(n)
 		}
 
 		if onProgress != nil {
-			now := time.Now()
+			now := c.clock().Now()
 			elapsed := now.Sub(start).Seconds()
 			speed := 0.0
 			if elapsed > 0 {
@@ -181,7 +504,7 @@ func (c *Cache) downloadOnce(ctx context.Context, url, target string, onProgress
 			}
 			onProgress(Progress{
 				URL:              url,
-				DownloadedBytes:  downloaded,
+				DownloadedBytes:  offset + downloaded,
 				TotalBytes:       totalBytes,
 				SpeedBytesPerSec: speed,
 				Done:             readErr == io.EOF,
@@ -192,36 +515,58 @@ func (c *Cache) downloadOnce(ctx context.Context, url, target string, onProgress
 			break
 		}
 		if readErr != nil {
+			// The partial file and its checkpoints stay for the next attempt.
 			_ = f.Close()
-			_ = os.Remove(tmp)
+			c.Stats.AddDownloaded(downloaded)
 			return fmt.Errorf("write cache file: %w", readErr)
 		}
 	}
 
 	if err := f.Close(); err != nil {
-		_ = os.Remove(tmp)
+		discardPartial(target)
 		return fmt.Errorf("close cache file: %w", err)
 	}
+	if c.Validate != nil {
+		if err := c.Validate(url, tmp); err != nil {
+			discardPartial(target)
+			c.Stats.AddDownloaded(downloaded)
+			return fmt.Errorf("%w: %w", ErrInvalidContent, err)
+		}
+	}
 
-	if err := os.Rename(tmp, target); err != nil {
-		_ = os.Remove(tmp)
+	stored, size, err := publish(tmp, target, c.Compress)
+	if err != nil {
+		discardPartial(target)
 		return fmt.Errorf("publish cache file: %w", err)
 	}
+	_ = os.Remove(resumePath(target))
+	c.Stats.AddDownloaded(downloaded)
+	c.Stats.AddDownloadTime(c.clock().Now().Sub(start))
+	writeEntryMeta(stored, entryMeta{
+		Provenance: Provenance{
+			URL:          url,
+			ETag:         part.Validators.ETag,
+			LastModified: part.Validators.LastModified,
+			TokenScope:   scope,
+			DownloadedAt: c.clock().Now().UTC(),
+		},
+		Size: size,
+	})
 
 	return nil
 }
 
-func (c *Cache) fetchGHCRTokenForBlobURL(ctx context.Context, sourceURL string) (token string, ok bool, err error) {
+func (c *Cache) fetchGHCRTokenForBlobURL(ctx context.Context, sourceURL string) (token, scope string, ok bool, err error) {
 	u, err := url.Parse(sourceURL)
 	if err != nil {
-		return "", false, err
+		return "", "", false, err
 	}
 	if !strings.EqualFold(u.Host, "ghcr.io") {
-		return "", false, nil
+		return "", "", false, nil
 	}
 	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
 	if len(parts) < 5 || parts[0] != "v2" {
-		return "", false, nil
+		return "", "", false, nil
 	}
 	blobIdx := -1
 	for idx, part := range parts {
@@ -231,28 +576,31 @@ func (c *Cache) fetchGHCRTokenForBlobURL(ctx context.Context, sourceURL string)
 		}
 	}
 	if blobIdx < 3 {
-		return "", false, nil
+		return "", "", false, nil
 	}
 	repo := strings.Join(parts[1:blobIdx], "/")
 	if strings.TrimSpace(repo) == "" {
-		return "", false, nil
+		return "", "", false, nil
 	}
 
-	scope := "repository:" + repo + ":pull"
+	scope = "repository:" + repo + ":pull"
 	tokenURL := "https://ghcr.io/token?service=ghcr.io&scope=" + url.QueryEscape(scope)
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL, nil)
 	if err != nil {
-		return "", true, err
+		return "", "", true, err
 	}
 	req.Header.Set("User-Agent", "ub/0.1")
+	if cred, ok := c.credentialFor(u.Host); ok {
+		cred.apply(req)
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.httpDoer().Do(req)
 	if err != nil {
-		return "", true, err
+		return "", "", true, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return "", true, fmt.Errorf("ghcr token endpoint returned status %d", resp.StatusCode)
+		return "", "", true, fmt.Errorf("ghcr token endpoint returned status %d", resp.StatusCode)
 	}
 
 	var tr struct {
@@ -260,39 +608,122 @@ func (c *Cache) fetchGHCRTokenForBlobURL(ctx context.Context, sourceURL string)
 		AccessToken string `json:"access_token"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
-		return "", true, err
+		return "", "", true, err
 	}
 	if tr.Token != "" {
-		return tr.Token, true, nil
+		return tr.Token, scope, true, nil
 	}
 	if tr.AccessToken != "" {
-		return tr.AccessToken, true, nil
+		return tr.AccessToken, scope, true, nil
+	}
+	return "", "", true, fmt.Errorf("ghcr token response missing token")
+}
+
+// stillFresh reports whether the cached target matches upstream. Without
+// validators on both sides there is no way to tell, so the entry is stale.
+func (c *Cache) stillFresh(ctx context.Context, sourceURL, target string) bool {
+	cached, ok := readValidators(target)
+	if !ok {
+		return false
+	}
+	resp, err := c.doRequest(ctx, http.MethodHead, sourceURL, "")
+	if err != nil {
+		return false
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return false
+	}
+	current := validatorsFrom(resp.Header)
+	if cached.ETag != "" && current.ETag != "" {
+		return cached.ETag == current.ETag
+	}
+	if cached.LastModified != "" && current.LastModified != "" {
+		return cached.LastModified == current.LastModified
+	}
+	return false
+}
+
+func validatorsFrom(header http.Header) validators {
+	return validators{ETag: header.Get("ETag"), LastModified: header.Get("Last-Modified")}
+}
+
+func validatorsPath(target string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(target, compressedExt), ".src") + ".meta"
+}
+
+func readValidators(target string) (validators, bool) {
+	data, err := os.ReadFile(validatorsPath(target))
+	if err != nil {
+		return validators{}, false
+	}
+	var v validators
+	if err := json.Unmarshal(data, &v); err != nil {
+		return validators{}, false
 	}
-	return "", true, fmt.Errorf("ghcr token response missing token")
+	return v, v.ETag != "" || v.LastModified != ""
 }
 
-func (c *Cache) doDownloadRequest(ctx context.Context, sourceURL, bearerToken string) (*http.Response, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sourceURL, nil)
+// entryMeta is the .meta sidecar of a cache entry. Its ETag and
+// Last-Modified are also the validators readValidators returns; Size is
+// the download's size when the entry is stored compressed.
+type entryMeta struct {
+	Provenance
+	Size int64 `json:"size,omitempty"`
+}
+
+func writeEntryMeta(target string, meta entryMeta) {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return
+	}
+	_ = os.WriteFile(validatorsPath(target), data, 0o644)
+}
+
+func (c *Cache) doDownloadRequest(ctx context.Context, sourceURL, bearerToken string, header http.Header) (*http.Response, error) {
+	return c.doRequestWithHeader(ctx, http.MethodGet, sourceURL, bearerToken, header)
+}
+
+func (c *Cache) doRequest(ctx context.Context, method, sourceURL, bearerToken string) (*http.Response, error) {
+	return c.doRequestWithHeader(ctx, method, sourceURL, bearerToken, nil)
+}
+
+func (c *Cache) doRequestWithHeader(ctx context.Context, method, sourceURL, bearerToken string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, sourceURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("create request: %w", err)
 	}
-	req.Header.Set("Accept", "application/octet-stream, application/vnd.oci.image.layer.v1.tar+gzip, */*")
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", "application/octet-stream, application/vnd.oci.image.layer.v1.tar+gzip, */*")
+	}
 	req.Header.Set("User-Agent", "ub/0.1")
 	if strings.TrimSpace(bearerToken) != "" {
 		req.Header.Set("Authorization", "Bearer "+bearerToken)
+	} else if cred, ok := c.credentialFor(req.URL.Host); ok {
+		cred.apply(req)
 	}
-	return http.DefaultClient.Do(req)
+	return c.httpDoer().Do(req)
 }
 
-func (c *Cache) fetchBearerToken(ctx context.Context, challenge string) (string, error) {
+// fetchBearerToken answers a registry's challenge. The token endpoint must
+// be https, and gets any credential configured for registryHost only when
+// it is that host or one named in UB_REGISTRY_AUTH_HOSTS, so a challenge
+// cannot send the credential anywhere it likes.
+func (c *Cache) fetchBearerToken(ctx context.Context, challenge, registryHost string) (token, scope string, err error) {
 	realm, service, scope, err := parseBearerChallenge(challenge)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	tokenURL, err := url.Parse(realm)
 	if err != nil {
-		return "", fmt.Errorf("invalid token realm %q: %w", realm, err)
+		return "", "", fmt.Errorf("invalid token realm %q: %w", realm, err)
+	}
+	if tokenURL.Scheme != "https" || tokenURL.Host == "" {
+		return "", "", fmt.Errorf("refusing token realm %q: not an https URL", realm)
 	}
 	query := tokenURL.Query()
 	if service != "" {
@@ -305,18 +736,23 @@ func (c *Cache) fetchBearerToken(ctx context.Context, challenge string) (string,
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
 	if err != nil {
-		return "", fmt.Errorf("create token request: %w", err)
+		return "", "", fmt.Errorf("create token request: %w", err)
 	}
 	req.Header.Set("User-Agent", "ub/0.1")
+	if realmMayAuthenticate(tokenURL.Host, registryHost) {
+		if cred, ok := c.credentialFor(registryHost); ok {
+			cred.apply(req)
+		}
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.httpDoer().Do(req)
 	if err != nil {
-		return "", fmt.Errorf("request token: %w", err)
+		return "", "", fmt.Errorf("request token: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return "", fmt.Errorf("token endpoint returned status %d", resp.StatusCode)
+		return "", "", fmt.Errorf("token endpoint returned status %d", resp.StatusCode)
 	}
 
 	var tr struct {
@@ -324,16 +760,16 @@ func (c *Cache) fetchBearerToken(ctx context.Context, challenge string) (string,
 		AccessToken string `json:"access_token"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
-		return "", fmt.Errorf("decode token response: %w", err)
+		return "", "", fmt.Errorf("decode token response: %w", err)
 	}
 	if strings.TrimSpace(tr.Token) != "" {
-		return tr.Token, nil
+		return tr.Token, scope, nil
 	}
 	if strings.TrimSpace(tr.AccessToken) != "" {
-		return tr.AccessToken, nil
+		return tr.AccessToken, scope, nil
 	}
 
-	return "", fmt.Errorf("token response missing token")
+	return "", "", fmt.Errorf("token response missing token")
 }
 
 func parseBearerChallenge(challenge string) (realm, service, scope string, err error) {
@@ -389,7 +825,7 @@ func (c *Cache) pruneExpired(ctx context.Context) error {
 		minPruneStep = 6 * time.Hour
 	)
 
-	now := time.Now()
+	now := c.clock().Now()
 	c.mu.Lock()
 	if !c.lastPruneTime.IsZero() && now.Sub(c.lastPruneTime) < minPruneStep {
 		c.mu.Unlock()
@@ -409,9 +845,12 @@ func (c *Cache) pruneExpired(ctx context.Context) error {
 		default:
 		}
 		if d.IsDir() {
+			if d.Name() == "git-v0" {
+				return filepath.SkipDir
+			}
 			return nil
 		}
-		if filepath.Ext(path) != ".src" {
+		if ext := filepath.Ext(path); ext != ".src" && ext != compressedExt && ext != ".meta" && ext != ".part" && ext != ".resume" {
 			return nil
 		}
 		info, infoErr := d.Info()
@@ -0,0 +1,81 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	waits []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.waits = append(c.waits, d)
+	now := c.now
+	c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	ch <- now
+	return ch
+}
+
+type doerFunc func(*http.Request) (*http.Response, error)
+
+func (f doerFunc) Do(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestFetchRetriesInjectedNetworkFailures(t *testing.T) {
+	cache := NewCache(t.TempDir())
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	cache.Clock = clock
+	attempts := 0
+	cache.HTTP = doerFunc(func(req *http.Request) (*http.Response, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, syscall.ECONNRESET
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("bottle")), ContentLength: 6, Header: http.Header{}, Request: req}, nil
+	})
+
+	path, err := cache.Fetch(context.Background(), "https://example.com/bottle.tar.gz")
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "bottle" {
+		t.Fatalf("cached %q", data)
+	}
+	if attempts != 3 || len(clock.waits) != 2 {
+		t.Fatalf("attempts = %d, backoff waits = %v", attempts, clock.waits)
+	}
+	if clock.waits[1] <= clock.waits[0] {
+		t.Fatalf("expected growing backoff, got %v", clock.waits)
+	}
+}
+
+func TestFetchReportsPersistentNetworkFailure(t *testing.T) {
+	cache := NewCache(t.TempDir())
+	cache.Clock = &fakeClock{}
+	cache.HTTP = doerFunc(func(*http.Request) (*http.Response, error) {
+		return nil, syscall.ETIMEDOUT
+	})
+	_, err := cache.Fetch(context.Background(), "https://example.com/slow.tar.gz")
+	if !errors.Is(err, syscall.ETIMEDOUT) {
+		t.Fatalf("expected wrapped timeout, got %v", err)
+	}
+}
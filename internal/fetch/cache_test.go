@@ -3,6 +3,7 @@ package fetch
 import (
 	"context"
 	"encoding/hex"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -35,7 +36,7 @@ func TestFetchHandlesBearerAuthChallenge(t *testing.T) {
 
 	tokenValue := "test-token"
 	var serverURL string
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.URL.Path {
 		case "/blob":
 			auth := r.Header.Get("Authorization")
@@ -44,6 +45,7 @@ func TestFetchHandlesBearerAuthChallenge(t *testing.T) {
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
+			w.Header().Set("ETag", `"sdl2-v1"`)
 			_, _ = w.Write([]byte("bottle-bytes"))
 		case "/token":
 			if got := r.URL.Query().Get("service"); got != "ghcr.io" {
@@ -60,6 +62,7 @@ func TestFetchHandlesBearerAuthChallenge(t *testing.T) {
 	}))
 	defer server.Close()
 	serverURL = server.URL
+	cache.HTTP = server.Client()
 
 	path, err := cache.Fetch(context.Background(), server.URL+"/blob")
 	if err != nil {
@@ -73,6 +76,11 @@ func TestFetchHandlesBearerAuthChallenge(t *testing.T) {
 	if strings.TrimSpace(string(data)) != "bottle-bytes" {
 		t.Fatalf("unexpected cached content: %q", string(data))
 	}
+
+	p := cache.Provenance(server.URL + "/blob")
+	if p.URL != server.URL+"/blob" || p.ETag != `"sdl2-v1"` || p.TokenScope != "repository:homebrew/core/sdl2:pull" || p.DownloadedAt.IsZero() {
+		t.Fatalf("unexpected provenance: %+v", p)
+	}
 }
 
 func TestFetchWithProgressReportsDone(t *testing.T) {
@@ -149,3 +157,82 @@ func TestHashUsesLittleEndianDigestEncoding(t *testing.T) {
 		t.Fatalf("expected 8-byte digest, got %d", len(decoded))
 	}
 }
+
+func TestFetchRevalidatedRefreshesChangedUpstream(t *testing.T) {
+	var mu sync.Mutex
+	body, etag := "v1", `"v1"`
+	gets := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("ETag", etag)
+		if r.Method == http.MethodGet {
+			gets++
+			_, _ = w.Write([]byte(body))
+		}
+	}))
+	defer server.Close()
+
+	cache := NewCache(t.TempDir())
+	fetchBody := func() string {
+		t.Helper()
+		path, err := cache.FetchRevalidated(context.Background(), server.URL+"/latest.zip", nil)
+		if err != nil {
+			t.Fatalf("FetchRevalidated: %v", err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read cached file: %v", err)
+		}
+		return string(data)
+	}
+
+	if got := fetchBody(); got != "v1" {
+		t.Fatalf("first fetch = %q, want v1", got)
+	}
+	if got := fetchBody(); got != "v1" || gets != 1 {
+		t.Fatalf("unchanged upstream: body %q after %d GETs, want v1 after 1", got, gets)
+	}
+
+	mu.Lock()
+	body, etag = "v2", `"v2"`
+	mu.Unlock()
+	if got := fetchBody(); got != "v2" || gets != 2 {
+		t.Fatalf("changed upstream: body %q after %d GETs, want v2 after 2", got, gets)
+	}
+
+	path, err := cache.Fetch(context.Background(), server.URL+"/latest.zip")
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if !strings.HasSuffix(path, ".src") || gets != 2 {
+		t.Fatalf("expected plain Fetch to reuse cache without revalidating, GETs = %d", gets)
+	}
+}
+
+func TestExpectedSizeFillsInMissingContentLength(t *testing.T) {
+	body := strings.Repeat("x", 100_000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Flushing first sends the body chunked, without a Content-Length.
+		w.(http.Flusher).Flush()
+		_, _ = io.WriteString(w, body)
+	}))
+	defer server.Close()
+	cache := NewCache(t.TempDir())
+	totals := func(url string) []int64 {
+		var seen []int64
+		if _, err := cache.FetchWithProgress(context.Background(), url, func(p Progress) { seen = append(seen, p.TotalBytes) }); err != nil {
+			t.Fatalf("Fetch: %v", err)
+		}
+		return seen
+	}
+	if seen := totals(server.URL + "/a"); seen[0] != -1 {
+		t.Fatalf("expected an unknown total without Content-Length, got %v", seen)
+	}
+	cache.ExpectSize(server.URL+"/b", int64(len(body)))
+	for _, total := range totals(server.URL + "/b") {
+		if total != int64(len(body)) {
+			t.Fatalf("total = %d, want %d", total, len(body))
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package fetch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ChecksumEntry records a cached artifact whose digest was verified against
+// formula or cask metadata when it was downloaded.
+type ChecksumEntry struct {
+	URL        string    `json:"url"`
+	SHA256     string    `json:"sha256"`
+	VerifiedAt time.Time `json:"verified_at"`
+}
+
+func (c *Cache) checksumsPath() string {
+	return filepath.Join(c.Dir, "checksums.json")
+}
+
+// Checksums returns the database keyed by absolute cache path. Only files
+// in the cache are tracked: a file:// mirror is read in place, and is the
+// user's to look after.
+func (c *Cache) Checksums() (map[string]ChecksumEntry, error) {
+	c.dbMu.Lock()
+	defer c.dbMu.Unlock()
+	return c.loadChecksumsLocked()
+}
+
+func (c *Cache) RecordChecksum(path, url, sha256 string) error {
+	if !c.holds(path) {
+		return nil
+	}
+	return c.updateChecksums(func(db map[string]ChecksumEntry) {
+		db[path] = ChecksumEntry{URL: url, SHA256: sha256, VerifiedAt: c.clock().Now().UTC()}
+	})
+}
+
+func (c *Cache) ForgetChecksum(path string) error {
+	return c.updateChecksums(func(db map[string]ChecksumEntry) {
+		delete(db, path)
+	})
+}
+
+// Quarantine moves a corrupt cache entry out of the way so the next fetch
+// downloads it again, and drops it from the checksum database.
+func (c *Cache) Quarantine(path string) (string, error) {
+	if !c.holds(path) {
+		return "", fmt.Errorf("quarantine %s: not in the cache", path)
+	}
+	dir := filepath.Join(c.Dir, "quarantine")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("create quarantine dir: %w", err)
+	}
+	dst := filepath.Join(dir, filepath.Base(path))
+	if err := os.Rename(path, dst); err != nil {
+		return "", fmt.Errorf("quarantine %s: %w", path, err)
+	}
+	_ = os.Remove(validatorsPath(path))
+	if err := c.ForgetChecksum(path); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// Entries lists every cached artifact, sorted.
+func (c *Cache) Entries() ([]string, error) {
+	root := filepath.Join(c.Dir, "archive-v0")
+	out := make([]string, 0)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() && (filepath.Ext(path) == ".src" || filepath.Ext(path) == compressedExt) {
+			out = append(out, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func (c *Cache) updateChecksums(update func(map[string]ChecksumEntry)) error {
+	c.dbMu.Lock()
+	defer c.dbMu.Unlock()
+	db, err := c.loadChecksumsLocked()
+	if err != nil {
+		return err
+	}
+	update(db)
+	rel := make(map[string]ChecksumEntry, len(db))
+	for path, entry := range db {
+		if r, err := filepath.Rel(c.Dir, path); err == nil {
+			path = r
+		}
+		rel[path] = entry
+	}
+	data, err := json.MarshalIndent(rel, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode checksum database: %w", err)
+	}
+	if err := os.MkdirAll(c.Dir, 0o755); err != nil {
+		return fmt.Errorf("create cache dir: %w", err)
+	}
+	tmp := c.checksumsPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("write checksum database: %w", err)
+	}
+	if err := os.Rename(tmp, c.checksumsPath()); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("publish checksum database: %w", err)
+	}
+	return nil
+}
+
+// loadChecksumsLocked reads the database; paths are stored relative to the
+// cache dir so the cache can be moved.
+func (c *Cache) loadChecksumsLocked() (map[string]ChecksumEntry, error) {
+	data, err := os.ReadFile(c.checksumsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]ChecksumEntry{}, nil
+		}
+		return nil, fmt.Errorf("read checksum database: %w", err)
+	}
+	var rel map[string]ChecksumEntry
+	if err := json.Unmarshal(data, &rel); err != nil {
+		return nil, fmt.Errorf("parse checksum database: %w", err)
+	}
+	db := make(map[string]ChecksumEntry, len(rel))
+	for path, entry := range rel {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(c.Dir, path)
+		}
+		if c.holds(path) {
+			db[path] = entry
+		}
+	}
+	return db, nil
+}
+
+// holds reports whether path is inside the cache dir.
+func (c *Cache) holds(path string) bool {
+	rel, err := filepath.Rel(c.Dir, path)
+	return err == nil && filepath.IsLocal(rel)
+}
@@ -0,0 +1,168 @@
+package fetch
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// A compressed cache entry is stored gzipped as <key>.srcz instead of
+// <key>.src, and its .meta sidecar records the uncompressed size. Only
+// downloads that are not compressed already are worth it: JSON API
+// documents and plain tar archives. Bottles, zips and compressed tarballs
+// are stored as downloaded.
+
+const compressedExt = ".srcz"
+
+func compressedPath(target string) string {
+	return strings.TrimSuffix(target, ".src") + compressedExt
+}
+
+// compressible reports whether a download starting with header is JSON or
+// an uncompressed tar.
+func compressible(header []byte) bool {
+	if trimmed := bytes.TrimLeft(header, " \t\r\n"); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return true
+	}
+	return SniffArchive(header) == FormatTar
+}
+
+// storedPath returns where target's entry is stored, compressed or not.
+func storedPath(target string) (string, bool) {
+	if _, err := os.Stat(target); err == nil {
+		return target, true
+	}
+	if _, err := os.Stat(compressedPath(target)); err == nil {
+		return compressedPath(target), true
+	}
+	return "", false
+}
+
+func removeEntry(target string) error {
+	err := os.Remove(target)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(compressedPath(target)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// entrySize is the size of the download a stored entry holds.
+func entrySize(path string) (int64, error) {
+	if strings.HasSuffix(path, compressedExt) {
+		if data, err := os.ReadFile(validatorsPath(path)); err == nil {
+			var meta entryMeta
+			if json.Unmarshal(data, &meta) == nil && meta.Size > 0 {
+				return meta.Size, nil
+			}
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// publish moves the finished download tmp into place as target's entry,
+// gzipped when compress is set and the download is compressible. It
+// returns the stored path and, for a compressed entry, the download's size.
+func publish(tmp, target string, compress bool) (path string, size int64, err error) {
+	if compress {
+		path, size, err = compressFile(tmp, target)
+		if err != nil || path != "" {
+			return path, size, err
+		}
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		return "", 0, err
+	}
+	_ = os.Remove(compressedPath(target))
+	return target, 0, nil
+}
+
+// compressFile gzips tmp into target's compressed entry and removes tmp.
+// It returns an empty path, and leaves tmp alone, when tmp is not worth
+// compressing.
+func compressFile(tmp, target string) (string, int64, error) {
+	in, err := os.Open(tmp)
+	if err != nil {
+		return "", 0, err
+	}
+	defer in.Close()
+	br := bufio.NewReader(in)
+	if header, _ := br.Peek(SniffLen); !compressible(header) {
+		return "", 0, nil
+	}
+	dst := compressedPath(target)
+	out, err := os.Create(dst + ".tmp")
+	if err != nil {
+		return "", 0, err
+	}
+	gz := gzip.NewWriter(out)
+	size, err := io.Copy(gz, br)
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(dst+".tmp", dst)
+	}
+	if err != nil {
+		_ = os.Remove(dst + ".tmp")
+		return "", 0, fmt.Errorf("compress cache entry: %w", err)
+	}
+	_ = os.Remove(tmp)
+	_ = os.Remove(target)
+	return dst, size, nil
+}
+
+// Open opens a file Fetch returned for reading, decompressing it when it
+// is a compressed cache entry.
+func Open(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, compressedExt) {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("decompress %s: %w", path, err)
+	}
+	return gzipFile{gz, f}, nil
+}
+
+// ReadFile is os.ReadFile for a file Fetch returned.
+func ReadFile(path string) ([]byte, error) {
+	r, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g gzipFile) Close() error {
+	err := g.Reader.Close()
+	if closeErr := g.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
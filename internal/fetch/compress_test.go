@@ -0,0 +1,74 @@
+package fetch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCompressedCacheReadsThrough(t *testing.T) {
+	doc := `{"formulae":[` + strings.Repeat(`{"name":"hello","desc":"greets"},`, 200) + `{}]}`
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	_, _ = gz.Write([]byte("bottle"))
+	_ = gz.Close()
+	gets := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gets++
+		switch r.URL.Path {
+		case "/formula.json":
+			_, _ = w.Write([]byte(doc))
+		case "/hello.tar.gz":
+			_, _ = w.Write(gzipped.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	cache := NewCache(t.TempDir())
+	cache.Compress = true
+	ctx := context.Background()
+
+	for range 2 {
+		path, err := cache.Fetch(ctx, server.URL+"/formula.json")
+		if err != nil {
+			t.Fatalf("Fetch: %v", err)
+		}
+		if !strings.HasSuffix(path, compressedExt) {
+			t.Fatalf("expected a compressed entry, got %s", path)
+		}
+		info, err := os.Stat(path)
+		if err != nil || info.Size() >= int64(len(doc)) {
+			t.Fatalf("compressed entry is %d bytes for a %d byte download (%v)", info.Size(), len(doc), err)
+		}
+		if data, err := ReadFile(path); err != nil || string(data) != doc {
+			t.Fatalf("ReadFile = %d bytes, %v", len(data), err)
+		}
+	}
+	if gets != 1 {
+		t.Fatalf("server hit %d times, want 1", gets)
+	}
+	if size, ok := cache.CachedSize(server.URL + "/formula.json"); !ok || size != int64(len(doc)) {
+		t.Fatalf("CachedSize = %d, %v, want %d", size, ok, len(doc))
+	}
+
+	path, err := cache.Fetch(ctx, server.URL+"/hello.tar.gz")
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || !strings.HasSuffix(path, ".src") || !bytes.Equal(data, gzipped.Bytes()) {
+		t.Fatalf("expected the gzip download stored as is at %s (%v)", path, err)
+	}
+
+	if err := cache.Evict(server.URL + "/formula.json"); err != nil {
+		t.Fatalf("Evict: %v", err)
+	}
+	if _, ok := cache.CachedSize(server.URL + "/formula.json"); ok {
+		t.Fatal("expected the compressed entry evicted")
+	}
+}
@@ -0,0 +1,292 @@
+package fetch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// credential is sent to a host either as a bearer token or as basic auth.
+// Registries get the basic form on their token endpoint.
+type credential struct {
+	Username string
+	Password string
+	Token    string
+}
+
+func (c credential) apply(req *http.Request) {
+	switch {
+	case c.Token != "":
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	case c.Username != "" || c.Password != "":
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+}
+
+// credentialFor resolves and caches the credential for host, which may
+// include a port. Lookups that find nothing are cached too.
+func (c *Cache) credentialFor(host string) (credential, bool) {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if host == "" {
+		return credential{}, false
+	}
+	c.mu.Lock()
+	cred, ok := c.creds[host]
+	c.mu.Unlock()
+	if !ok {
+		cred, _ = lookupCredential(host)
+		c.mu.Lock()
+		if c.creds == nil {
+			c.creds = map[string]credential{}
+		}
+		c.creds[host] = cred
+		c.mu.Unlock()
+	}
+	return cred, cred != credential{}
+}
+
+// lookupCredential checks UB_GITHUB_TOKEN for GitHub hosts, then the docker
+// config, then ~/.netrc.
+func lookupCredential(host string) (credential, bool) {
+	if cred, ok := githubCredential(host); ok {
+		return cred, true
+	}
+	if cred, ok := dockerCredential(host); ok {
+		return cred, true
+	}
+	return netrcCredential(host)
+}
+
+// realmMayAuthenticate reports whether a registry's credential may be sent
+// to the token endpoint at realmHost: the registry itself, or a host listed,
+// comma-separated, in UB_REGISTRY_AUTH_HOSTS, such as auth.docker.io for
+// Docker Hub.
+func realmMayAuthenticate(realmHost, registryHost string) bool {
+	if strings.EqualFold(realmHost, registryHost) {
+		return true
+	}
+	for _, allowed := range strings.Split(os.Getenv("UB_REGISTRY_AUTH_HOSTS"), ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed != "" && (strings.EqualFold(allowed, realmHost) || strings.EqualFold(allowed, hostname(realmHost))) {
+			return true
+		}
+	}
+	return false
+}
+
+func hostname(host string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		return name
+	}
+	return host
+}
+
+func githubCredential(host string) (credential, bool) {
+	token := strings.TrimSpace(os.Getenv("UB_GITHUB_TOKEN"))
+	if token == "" {
+		return credential{}, false
+	}
+	switch hostname(host) {
+	case "ghcr.io":
+		return credential{Username: "ub", Password: token}, true
+	case "github.com", "api.github.com", "raw.githubusercontent.com":
+		return credential{Token: token}, true
+	}
+	return credential{}, false
+}
+
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+	CredHelpers map[string]string `json:"credHelpers"`
+	CredsStore  string            `json:"credsStore"`
+}
+
+func dockerConfigPath() string {
+	if dir := strings.TrimSpace(os.Getenv("DOCKER_CONFIG")); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// dockerRegistryKey normalizes a config.json key or request host so that
+// "https://index.docker.io/v1/" and "registry-1.docker.io" compare equal.
+func dockerRegistryKey(raw string) string {
+	key := strings.ToLower(strings.TrimSpace(raw))
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	key, _, _ = strings.Cut(key, "/")
+	switch key {
+	case "registry-1.docker.io", "docker.io":
+		return "index.docker.io"
+	}
+	return key
+}
+
+func dockerCredential(host string) (credential, bool) {
+	path := dockerConfigPath()
+	if path == "" {
+		return credential{}, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return credential{}, false
+	}
+	var cfg dockerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return credential{}, false
+	}
+	want := dockerRegistryKey(host)
+	for key, helper := range cfg.CredHelpers {
+		if dockerRegistryKey(key) == want {
+			return dockerHelperCredential(helper, key)
+		}
+	}
+	for key, entry := range cfg.Auths {
+		if dockerRegistryKey(key) != want {
+			continue
+		}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				continue
+			}
+			user, pass, ok := strings.Cut(string(decoded), ":")
+			if ok {
+				return credential{Username: user, Password: pass}, true
+			}
+		}
+		if entry.Username != "" || entry.Password != "" {
+			return credential{Username: entry.Username, Password: entry.Password}, true
+		}
+		if cfg.CredsStore != "" {
+			return dockerHelperCredential(cfg.CredsStore, key)
+		}
+	}
+	return credential{}, false
+}
+
+// dockerHelperCredential runs docker-credential-<helper> get, the protocol
+// docker uses for keychain-backed logins.
+func dockerHelperCredential(helper, serverURL string) (credential, bool) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	out, err := cmd.Output()
+	if err != nil {
+		return credential{}, false
+	}
+	var resp struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(out, &resp); err != nil || resp.Secret == "" {
+		return credential{}, false
+	}
+	// "<token>" marks an identity token, which needs an OAuth exchange.
+	if resp.Username == "<token>" {
+		return credential{}, false
+	}
+	return credential{Username: resp.Username, Password: resp.Secret}, true
+}
+
+func netrcPath() string {
+	if path := strings.TrimSpace(os.Getenv("NETRC")); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+func netrcCredential(host string) (credential, bool) {
+	path := netrcPath()
+	if path == "" {
+		return credential{}, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return credential{}, false
+	}
+	return parseNetrc(data, hostname(host))
+}
+
+// parseNetrc returns the login and password for machine. The default entry
+// is ignored so credentials are never sent to hosts not named explicitly.
+// macdef bodies run until the next blank line.
+func parseNetrc(data []byte, machine string) (credential, bool) {
+	var (
+		tokens  []string
+		inMacro bool
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inMacro {
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		for i, field := range fields {
+			if field == "macdef" {
+				fields = fields[:i]
+				inMacro = true
+				break
+			}
+		}
+		tokens = append(tokens, fields...)
+	}
+
+	var (
+		found   credential
+		current *credential
+	)
+	for i := 0; i < len(tokens); i++ {
+		switch tokens[i] {
+		case "machine":
+			current = nil
+			if i+1 < len(tokens) {
+				i++
+				if strings.EqualFold(tokens[i], machine) && found == (credential{}) {
+					current = &found
+				}
+			}
+		case "default":
+			current = nil
+		case "login":
+			if i+1 < len(tokens) {
+				i++
+				if current != nil {
+					current.Username = tokens[i]
+				}
+			}
+		case "password":
+			if i+1 < len(tokens) {
+				i++
+				if current != nil {
+					current.Password = tokens[i]
+				}
+			}
+		case "account":
+			i++
+		}
+	}
+	return found, found != credential{}
+}
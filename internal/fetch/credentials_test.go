@@ -0,0 +1,159 @@
+package fetch
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseNetrc(t *testing.T) {
+	data := []byte(`# internal mirror
+machine other.example.com login nobody password nope
+machine bottles.example.com
+  login deploy
+  password s3cret
+macdef init
+  cd /pub
+  machine bottles.example.com login wrong password wrong
+
+default login anonymous password guest
+`)
+	cred, ok := parseNetrc(data, "bottles.example.com")
+	if !ok || cred.Username != "deploy" || cred.Password != "s3cret" {
+		t.Fatalf("parseNetrc = %+v, %v", cred, ok)
+	}
+	if cred, ok := parseNetrc(data, "unknown.example.com"); ok {
+		t.Fatalf("default entry should not match other hosts, got %+v", cred)
+	}
+}
+
+func TestDockerCredential(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", dir)
+	config := `{"auths":{
+		"https://index.docker.io/v1/":{"auth":"` + base64.StdEncoding.EncodeToString([]byte("hub:hubpass")) + `"},
+		"registry.internal:5000":{"username":"ci","password":"cipass"}
+	}}`
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0o600); err != nil {
+		t.Fatalf("write docker config: %v", err)
+	}
+	if cred, ok := dockerCredential("registry-1.docker.io"); !ok || cred.Username != "hub" || cred.Password != "hubpass" {
+		t.Fatalf("docker hub credential = %+v, %v", cred, ok)
+	}
+	if cred, ok := dockerCredential("registry.internal:5000"); !ok || cred.Username != "ci" || cred.Password != "cipass" {
+		t.Fatalf("registry credential = %+v, %v", cred, ok)
+	}
+	if _, ok := dockerCredential("ghcr.io"); ok {
+		t.Fatal("unexpected credential for ghcr.io")
+	}
+}
+
+func TestGitHubTokenCredential(t *testing.T) {
+	t.Setenv("UB_GITHUB_TOKEN", "ghp_test")
+	if cred, ok := githubCredential("ghcr.io"); !ok || cred.Password != "ghp_test" || cred.Token != "" {
+		t.Fatalf("ghcr credential = %+v, %v", cred, ok)
+	}
+	if cred, ok := githubCredential("api.github.com"); !ok || cred.Token != "ghp_test" {
+		t.Fatalf("github credential = %+v, %v", cred, ok)
+	}
+	if _, ok := githubCredential("example.com"); ok {
+		t.Fatal("token must not be sent to other hosts")
+	}
+}
+
+func TestFetchUsesNetrcCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "deploy" || pass != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("private-bottle"))
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("parse server url: %v", err)
+	}
+	netrc := filepath.Join(t.TempDir(), "netrc")
+	if err := os.WriteFile(netrc, []byte("machine "+u.Hostname()+" login deploy password s3cret\n"), 0o600); err != nil {
+		t.Fatalf("write netrc: %v", err)
+	}
+	t.Setenv("NETRC", netrc)
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	cache := NewCache(t.TempDir())
+	path, err := cache.Fetch(context.Background(), server.URL+"/bottle.tar.gz")
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "private-bottle" {
+		t.Fatalf("fetched %q, %v", data, err)
+	}
+}
+
+func TestRegistryCredentialsOnlyReachAllowedRealms(t *testing.T) {
+	var tokenAuth string
+	tokens := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenAuth = r.Header.Get("Authorization")
+		_, _ = w.Write([]byte(`{"token":"registry-token"}`))
+	}))
+	defer tokens.Close()
+	realm := tokens.URL + "/token"
+	registry := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer registry-token" {
+			w.Header().Set("Www-Authenticate", `Bearer realm="`+realm+`",service="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("private-bottle"))
+	}))
+	defer registry.Close()
+
+	u, err := url.Parse(registry.URL)
+	if err != nil {
+		t.Fatalf("parse server url: %v", err)
+	}
+	netrc := filepath.Join(t.TempDir(), "netrc")
+	if err := os.WriteFile(netrc, []byte("machine "+u.Hostname()+" login deploy password s3cret\n"), 0o600); err != nil {
+		t.Fatalf("write netrc: %v", err)
+	}
+	t.Setenv("NETRC", netrc)
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	t.Setenv("UB_REGISTRY_AUTH_HOSTS", "")
+
+	cache := NewCache(t.TempDir())
+	cache.HTTP = registry.Client()
+	if _, err := cache.Fetch(context.Background(), registry.URL+"/a.tar.gz"); err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if tokenAuth != "" {
+		t.Fatalf("credentials sent to a realm on another host: %q", tokenAuth)
+	}
+
+	t.Setenv("UB_REGISTRY_AUTH_HOSTS", "example.com, "+strings.TrimPrefix(tokens.URL, "https://"))
+	cache = NewCache(t.TempDir())
+	cache.HTTP = registry.Client()
+	if _, err := cache.Fetch(context.Background(), registry.URL+"/b.tar.gz"); err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if want := "Basic " + base64.StdEncoding.EncodeToString([]byte("deploy:s3cret")); tokenAuth != want {
+		t.Fatalf("token endpoint got %q, want %q", tokenAuth, want)
+	}
+}
+
+func TestBearerTokenRefusesPlainHTTPRealms(t *testing.T) {
+	cache := NewCache(t.TempDir())
+	_, _, err := cache.fetchBearerToken(context.Background(), `Bearer realm="http://ghcr.io/token",service="ghcr.io"`, "ghcr.io")
+	if err == nil || !strings.Contains(err.Error(), "not an https URL") {
+		t.Fatalf("expected an http realm refused, got %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package fetch
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// resolveTTL is how long a host's addresses are reused. Go's resolver
+	// does not report record TTLs, so this is a short fixed window.
+	resolveTTL = 5 * time.Minute
+	// fallbackDelay is how long one connection attempt runs alone before
+	// the next address is tried alongside it, as RFC 8305 recommends.
+	fallbackDelay = 250 * time.Millisecond
+)
+
+// defaultHTTP is the client a Cache uses unless HTTP is set. It resolves
+// each host once per resolveTTL instead of on every request, which adds up
+// over the hundreds of small metadata requests in a large install.
+var defaultHTTP = &http.Client{Transport: newTransport()}
+
+func newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	d := &dialer{
+		dns:           &dnsCache{lookup: lookupIP, now: time.Now},
+		dial:          (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		fallbackDelay: fallbackDelay,
+	}
+	transport.DialContext = d.DialContext
+	return transport
+}
+
+func lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+type dnsEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+type dnsCache struct {
+	lookup func(ctx context.Context, host string) ([]net.IP, error)
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+func (c *dnsCache) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && c.now().Before(entry.expires) {
+		return entry.ips, nil
+	}
+	ips, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = map[string]dnsEntry{}
+	}
+	c.entries[host] = dnsEntry{ips: ips, expires: c.now().Add(resolveTTL)}
+	c.mu.Unlock()
+	return ips, nil
+}
+
+// forget drops host, so a host that moved is looked up again.
+func (c *dnsCache) forget(host string) {
+	c.mu.Lock()
+	delete(c.entries, host)
+	c.mu.Unlock()
+}
+
+// dialer connects through dnsCache and races the addresses it returns
+// Happy Eyeballs style: IPv6 and IPv4 alternate, and each attempt gets
+// fallbackDelay before the next one starts, so a broken IPv6 route costs a
+// quarter second instead of a connect timeout.
+type dialer struct {
+	dns           *dnsCache
+	dial          func(ctx context.Context, network, address string) (net.Conn, error)
+	fallbackDelay time.Duration
+}
+
+func (d *dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.dial(ctx, network, address)
+	}
+	ips, err := d.dns.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips = interleave(ips, network)
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no " + network + " address", Name: host, IsNotFound: true}
+	}
+	conn, err := d.race(ctx, network, ips, port)
+	if err != nil {
+		d.dns.forget(host)
+	}
+	return conn, err
+}
+
+// interleave orders ips IPv6 first, alternating families, and drops the
+// ones network cannot reach.
+func interleave(ips []net.IP, network string) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	switch network {
+	case "tcp4":
+		return v4
+	case "tcp6":
+		return v6
+	}
+	out := make([]net.IP, 0, len(ips))
+	for len(v4) > 0 || len(v6) > 0 {
+		if len(v6) > 0 {
+			out, v6 = append(out, v6[0]), v6[1:]
+		}
+		if len(v4) > 0 {
+			out, v4 = append(out, v4[0]), v4[1:]
+		}
+	}
+	return out
+}
+
+func (d *dialer) race(ctx context.Context, network string, ips []net.IP, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(ips))
+	next, pending := 0, 0
+	start := func() {
+		address := net.JoinHostPort(ips[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := d.dial(ctx, network, address)
+			results <- result{conn, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(d.fallbackDelay)
+	defer timer.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Attempts still running are cancelled on return; close
+				// any that connect anyway.
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+		case <-timer.C:
+		}
+		if next < len(ips) {
+			start()
+			timer.Reset(d.fallbackDelay)
+		}
+	}
+	return nil, firstErr
+}
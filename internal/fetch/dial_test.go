@@ -0,0 +1,114 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDNSCacheReusesLookups(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	lookups := 0
+	cache := &dnsCache{
+		lookup: func(ctx context.Context, host string) ([]net.IP, error) {
+			lookups++
+			return []net.IP{net.ParseIP("192.0.2.1")}, nil
+		},
+		now: func() time.Time { return now },
+	}
+	for range 3 {
+		if _, err := cache.resolve(context.Background(), "formulae.brew.sh"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lookups != 1 {
+		t.Fatalf("lookups = %d, want 1", lookups)
+	}
+	now = now.Add(resolveTTL)
+	cache.resolve(context.Background(), "formulae.brew.sh")
+	cache.forget("formulae.brew.sh")
+	cache.resolve(context.Background(), "formulae.brew.sh")
+	if lookups != 3 {
+		t.Fatalf("lookups = %d, want 3 after expiry and forget", lookups)
+	}
+}
+
+func TestInterleavePrefersIPv6AndAlternates(t *testing.T) {
+	ips := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")}
+	got := interleave(ips, "tcp")
+	want := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2"}
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Fatalf("interleave = %v, want %v", got, want)
+		}
+	}
+	if got := interleave(ips, "tcp4"); len(got) != 2 || got[0].To4() == nil {
+		t.Fatalf("tcp4 kept %v", got)
+	}
+}
+
+func TestDialerFallsBackFromHungAddress(t *testing.T) {
+	var mu sync.Mutex
+	var dialed []string
+	d := &dialer{
+		dns: &dnsCache{
+			lookup: func(ctx context.Context, host string) ([]net.IP, error) {
+				return []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")}, nil
+			},
+			now: time.Now,
+		},
+		dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			mu.Lock()
+			dialed = append(dialed, address)
+			mu.Unlock()
+			if address == "[2001:db8::1]:443" {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			client, server := net.Pipe()
+			server.Close()
+			return client, nil
+		},
+		fallbackDelay: 10 * time.Millisecond,
+	}
+	conn, err := d.DialContext(context.Background(), "tcp", "ghcr.io:443")
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	conn.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dialed) != 2 || dialed[0] != "[2001:db8::1]:443" || dialed[1] != "192.0.2.1:443" {
+		t.Fatalf("dialed %v", dialed)
+	}
+}
+
+func TestDialerForgetsHostWhenEveryAddressFails(t *testing.T) {
+	lookups := 0
+	d := &dialer{
+		dns: &dnsCache{
+			lookup: func(ctx context.Context, host string) ([]net.IP, error) {
+				lookups++
+				return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")}, nil
+			},
+			now: time.Now,
+		},
+		dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+		},
+		fallbackDelay: time.Hour,
+	}
+	for range 2 {
+		_, err := d.DialContext(context.Background(), "tcp", "example.com:443")
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Fatalf("DialContext error = %v", err)
+		}
+	}
+	if lookups != 2 {
+		t.Fatalf("lookups = %d, want a fresh lookup after failure", lookups)
+	}
+}
@@ -0,0 +1,179 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"ub/internal/trace"
+)
+
+// GitRef pins a git checkout. Revision wins over Tag, and Tag over Branch;
+// with all three empty the remote's default branch is used.
+type GitRef struct {
+	Branch   string
+	Tag      string
+	Revision string
+}
+
+// validate rejects refs git would read as options, since they come from
+// formula files.
+func (r GitRef) validate() error {
+	for _, field := range []struct{ name, value string }{
+		{"branch", r.Branch},
+		{"tag", r.Tag},
+		{"revision", r.Revision},
+	} {
+		if strings.HasPrefix(field.value, "-") {
+			return fmt.Errorf("git %s %q must not start with -", field.name, field.value)
+		}
+	}
+	return nil
+}
+
+// IsGitURL reports whether a source URL names a git repository rather than
+// an archive: a git:// or git+ scheme, or a path ending in .git.
+func IsGitURL(raw string) bool {
+	raw = strings.TrimSpace(raw)
+	return strings.HasPrefix(raw, "git://") || strings.HasPrefix(raw, "git+") || strings.HasSuffix(strings.TrimRight(raw, "/"), ".git")
+}
+
+// FetchGit checks out ref of the repository at rawURL into dst, which must
+// not exist yet, and returns the full commit id. Each repository has a bare
+// mirror under <Dir>/git-v0 that later calls reuse: pinned revisions and
+// tags already in the mirror need no network at all, and branches are
+// updated with a shallow fetch. dst is a normal clone whose origin is
+// rawURL, so builds that run git describe still work.
+func (c *Cache) FetchGit(ctx context.Context, rawURL string, ref GitRef, dst string) (revision string, err error) {
+	remote := strings.TrimPrefix(strings.TrimSpace(rawURL), "git+")
+	if remote == "" {
+		return "", fmt.Errorf("git URL is required")
+	}
+	if strings.HasPrefix(remote, "-") {
+		return "", fmt.Errorf("git URL %q must not start with -", remote)
+	}
+	if err := ref.validate(); err != nil {
+		return "", err
+	}
+	ctx, span := trace.Start(ctx, "ub.fetch_git", trace.String("url.full", canonicalizeURL(remote)))
+	defer func() { span.End(err) }()
+
+	key := hash(canonicalizeURL(remote))
+	mirror := filepath.Join(c.Dir, "git-v0", key+".git")
+	lock := c.getLock("git:" + key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, err := os.Stat(filepath.Join(mirror, "HEAD")); err != nil {
+		if err := os.MkdirAll(filepath.Dir(mirror), 0o755); err != nil {
+			return "", fmt.Errorf("create git cache dir: %w", err)
+		}
+		if _, err := runGit(ctx, "", "init", "--quiet", "--bare", "--", mirror); err != nil {
+			return "", err
+		}
+	}
+
+	revision, cached := c.cachedGitRevision(ctx, mirror, ref)
+	span.SetAttributes(trace.Bool("ub.cache_hit", cached))
+	if cached {
+		c.Stats.CacheHit()
+	} else {
+		c.Stats.CacheMiss()
+		if revision, err = fetchGitRef(ctx, mirror, remote, ref); err != nil {
+			return "", err
+		}
+	}
+	if _, err := runGit(ctx, mirror, "update-ref", "refs/heads/ub-checkout", revision); err != nil {
+		return "", err
+	}
+
+	if _, err := runGit(ctx, "", "clone", "--quiet", "--no-checkout", "--single-branch", "--branch", "ub-checkout", "--", mirror, dst); err != nil {
+		return "", err
+	}
+	if _, err := runGit(ctx, dst, "checkout", "--quiet", "--detach", revision, "--"); err != nil {
+		return "", err
+	}
+	if _, err := runGit(ctx, dst, "remote", "set-url", "--", "origin", remote); err != nil {
+		return "", err
+	}
+	_, _ = runGit(ctx, dst, "branch", "--quiet", "-D", "ub-checkout")
+	return revision, nil
+}
+
+// cachedGitRevision resolves refs that cannot move (a commit, or a tag
+// fetched before) from the mirror alone.
+func (c *Cache) cachedGitRevision(ctx context.Context, mirror string, ref GitRef) (string, bool) {
+	var spec string
+	switch {
+	case ref.Revision != "":
+		spec = ref.Revision
+	case ref.Tag != "":
+		spec = "refs/tags/" + ref.Tag
+	default:
+		return "", false
+	}
+	out, err := runGit(ctx, mirror, "rev-parse", "--verify", "--quiet", spec+"^{commit}")
+	if err != nil {
+		return "", false
+	}
+	return out, true
+}
+
+func fetchGitRef(ctx context.Context, mirror, remote string, ref GitRef) (string, error) {
+	switch {
+	case ref.Revision != "":
+		// Servers may refuse to serve a bare commit id; fall back to the
+		// full history and look it up there.
+		if _, err := runGit(ctx, mirror, "fetch", "--quiet", "--depth", "1", "--", remote, ref.Revision); err != nil {
+			args := []string{"fetch", "--quiet", "--tags"}
+			if _, statErr := os.Stat(filepath.Join(mirror, "shallow")); statErr == nil {
+				args = append(args, "--unshallow")
+			}
+			args = append(args, "--", remote, "+refs/heads/*:refs/remotes/origin/*")
+			if _, err := runGit(ctx, mirror, args...); err != nil {
+				return "", err
+			}
+		}
+		out, err := runGit(ctx, mirror, "rev-parse", "--verify", "--quiet", ref.Revision+"^{commit}")
+		if err != nil {
+			return "", fmt.Errorf("revision %s not found in %s", ref.Revision, remote)
+		}
+		return out, nil
+	case ref.Tag != "":
+		if _, err := runGit(ctx, mirror, "fetch", "--quiet", "--depth", "1", "--", remote, "+refs/tags/"+ref.Tag+":refs/tags/"+ref.Tag); err != nil {
+			return "", err
+		}
+		return runGit(ctx, mirror, "rev-parse", "refs/tags/"+ref.Tag+"^{commit}")
+	default:
+		source := "HEAD"
+		if ref.Branch != "" {
+			source = "refs/heads/" + ref.Branch
+		}
+		if _, err := runGit(ctx, mirror, "fetch", "--quiet", "--depth", "1", "--", remote, source); err != nil {
+			return "", err
+		}
+		return runGit(ctx, mirror, "rev-parse", "FETCH_HEAD^{commit}")
+	}
+}
+
+// runGit runs git in dir (or the current directory) and returns trimmed
+// stdout; stderr is folded into the error.
+func runGit(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %w: %s", args[0], err, msg)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
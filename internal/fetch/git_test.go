@@ -0,0 +1,136 @@
+package fetch
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gitRepo makes a repository with two commits on main, the first tagged v1,
+// and returns its path and both commit ids.
+func gitRepo(t *testing.T) (dir, first, second string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	dir = t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		out, err := runGit(context.Background(), dir, append([]string{"-c", "user.name=ub", "-c", "user.email=ub@example.com"}, args...)...)
+		if err != nil {
+			t.Fatalf("git %v: %v", args, err)
+		}
+		return out
+	}
+	git("init", "--quiet", "--initial-branch", "main")
+	for i, body := range []string{"one\n", "two\n"} {
+		if err := os.WriteFile(filepath.Join(dir, "VERSION"), []byte(body), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		git("add", "VERSION")
+		git("commit", "--quiet", "-m", body)
+		if i == 0 {
+			git("tag", "v1")
+			first = git("rev-parse", "HEAD")
+		}
+	}
+	return dir, first, git("rev-parse", "HEAD")
+}
+
+func TestFetchGitPinsRefs(t *testing.T) {
+	repo, first, second := gitRepo(t)
+	cache := NewCache(t.TempDir())
+	url := "file://" + repo
+	ctx := context.Background()
+
+	cases := []struct {
+		ref  GitRef
+		want string
+		body string
+	}{
+		{GitRef{}, second, "two\n"},
+		{GitRef{Branch: "main"}, second, "two\n"},
+		{GitRef{Tag: "v1"}, first, "one\n"},
+		{GitRef{Revision: first}, first, "one\n"},
+	}
+	for i, tc := range cases {
+		dst := filepath.Join(t.TempDir(), "src")
+		rev, err := cache.FetchGit(ctx, url, tc.ref, dst)
+		if err != nil {
+			t.Fatalf("case %d FetchGit(%+v): %v", i, tc.ref, err)
+		}
+		if rev != tc.want {
+			t.Fatalf("case %d revision = %s, want %s", i, rev, tc.want)
+		}
+		data, err := os.ReadFile(filepath.Join(dst, "VERSION"))
+		if err != nil || string(data) != tc.body {
+			t.Fatalf("case %d VERSION = %q, %v; want %q", i, data, err, tc.body)
+		}
+		origin, err := runGit(ctx, dst, "remote", "get-url", "origin")
+		if err != nil || origin != url {
+			t.Fatalf("case %d origin = %q, %v", i, origin, err)
+		}
+	}
+}
+
+func TestFetchGitReusesMirrorForPinnedRefs(t *testing.T) {
+	repo, first, _ := gitRepo(t)
+	cache := NewCache(t.TempDir())
+	url := "file://" + repo
+	ctx := context.Background()
+
+	if _, err := cache.FetchGit(ctx, url, GitRef{Tag: "v1"}, filepath.Join(t.TempDir(), "a")); err != nil {
+		t.Fatalf("first FetchGit: %v", err)
+	}
+	if err := os.RemoveAll(repo); err != nil {
+		t.Fatalf("remove origin: %v", err)
+	}
+	for _, ref := range []GitRef{{Tag: "v1"}, {Revision: first}} {
+		rev, err := cache.FetchGit(ctx, url, ref, filepath.Join(t.TempDir(), "b"))
+		if err != nil {
+			t.Fatalf("offline FetchGit(%+v): %v", ref, err)
+		}
+		if rev != first {
+			t.Fatalf("revision = %s, want %s", rev, first)
+		}
+	}
+	if _, err := cache.FetchGit(ctx, url, GitRef{Branch: "main"}, filepath.Join(t.TempDir(), "c")); err == nil {
+		t.Fatal("expected a branch fetch to need the remote")
+	}
+}
+
+func TestFetchGitRejectsOptionLikeRefs(t *testing.T) {
+	cache := NewCache(t.TempDir())
+	ctx := context.Background()
+	for _, tc := range []struct {
+		url string
+		ref GitRef
+	}{
+		{"https://example.com/repo.git", GitRef{Branch: "--upload-pack=touch /tmp/pwned"}},
+		{"https://example.com/repo.git", GitRef{Tag: "-v1"}},
+		{"https://example.com/repo.git", GitRef{Revision: "--output=/tmp/x"}},
+		{"--upload-pack=sh", GitRef{}},
+	} {
+		dst := filepath.Join(t.TempDir(), "src")
+		if _, err := cache.FetchGit(ctx, tc.url, tc.ref, dst); err == nil || !strings.Contains(err.Error(), "must not start with -") {
+			t.Errorf("FetchGit(%q, %+v) = %v, want a refusal", tc.url, tc.ref, err)
+		}
+	}
+}
+
+func TestIsGitURL(t *testing.T) {
+	for raw, want := range map[string]bool{
+		"https://github.com/jqlang/jq.git":     true,
+		"git://example.com/repo":               true,
+		"git+https://example.com/repo":         true,
+		"https://example.com/jq-1.7.tar.gz":    false,
+		"https://github.com/jqlang/jq/archive": false,
+	} {
+		if got := IsGitURL(raw); got != want {
+			t.Fatalf("IsGitURL(%q) = %v, want %v", raw, got, want)
+		}
+	}
+}
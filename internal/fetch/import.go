@@ -0,0 +1,71 @@
+package fetch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Lookup returns where url's download is cached, without fetching it.
+func (c *Cache) Lookup(url string) (string, bool) {
+	if _, ok := fileURLPath(url); ok {
+		return "", false
+	}
+	return storedPath(c.cachePathForKey(hash(canonicalizeURL(url))))
+}
+
+// EntryProvenance reads the provenance recorded next to a cached entry, as
+// listed by Entries. It is false for entries cached before ub recorded it.
+func EntryProvenance(path string) (Provenance, bool) {
+	data, err := os.ReadFile(validatorsPath(path))
+	if err != nil {
+		return Provenance{}, false
+	}
+	var p Provenance
+	if json.Unmarshal(data, &p) != nil || p.URL == "" {
+		return Provenance{}, false
+	}
+	return p, true
+}
+
+// Import caches the contents of r as the download of p.URL, as though it
+// had been fetched from there, replacing any cached copy. Validate and
+// Compress apply as they do to a download.
+func (c *Cache) Import(r io.Reader, p Provenance) (string, error) {
+	key := hash(canonicalizeURL(p.URL))
+	target := c.cachePathForKey(key)
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return "", fmt.Errorf("create cache shard dir: %w", err)
+	}
+	lock := c.getLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	tmp := partialPath(target)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", fmt.Errorf("create temp cache file: %w", err)
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && c.Validate != nil {
+		if err = c.Validate(p.URL, tmp); err != nil {
+			err = fmt.Errorf("%w: %w", ErrInvalidContent, err)
+		}
+	}
+	if err != nil {
+		discardPartial(target)
+		return "", err
+	}
+	stored, size, err := publish(tmp, target, c.Compress)
+	if err != nil {
+		discardPartial(target)
+		return "", fmt.Errorf("publish cache file: %w", err)
+	}
+	writeEntryMeta(stored, entryMeta{Provenance: p, Size: size})
+	return stored, nil
+}
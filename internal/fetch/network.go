@@ -0,0 +1,128 @@
+package fetch
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type NetworkErrorKind string
+
+const (
+	NetworkDNS     NetworkErrorKind = "dns"
+	NetworkTLS     NetworkErrorKind = "tls"
+	NetworkProxy   NetworkErrorKind = "proxy"
+	NetworkTimeout NetworkErrorKind = "timeout"
+	NetworkStalled NetworkErrorKind = "stalled"
+	NetworkConnect NetworkErrorKind = "connect"
+	NetworkOutage  NetworkErrorKind = "outage"
+)
+
+var networkHints = map[NetworkErrorKind]string{
+	NetworkDNS:     "cannot resolve %s; check that you are online and that DNS works",
+	NetworkTLS:     "the certificate presented for %s is not trusted; a proxy or security tool may be intercepting HTTPS (add its CA to the system trust store or SSL_CERT_FILE)",
+	NetworkProxy:   "the proxy for %s failed; check HTTPS_PROXY, HTTP_PROXY and NO_PROXY",
+	NetworkTimeout: "%s did not answer in time; the network may be down or very slow",
+	NetworkStalled: "%s stopped sending data partway through; the network may be down or very slow",
+	NetworkConnect: "cannot connect to %s; check that you are online and no firewall blocks it",
+	NetworkOutage:  "%s is up but failing; the service may be having an outage, try again later",
+}
+
+// NetworkError is a failed request whose cause has been narrowed down
+// enough to tell the user what to fix.
+type NetworkError struct {
+	Kind NetworkErrorKind
+	Host string
+	Err  error
+}
+
+func (e *NetworkError) Error() string {
+	return fmt.Sprintf(networkHints[e.Kind], e.Host) + ": " + e.Err.Error()
+}
+
+func (e *NetworkError) Unwrap() error { return e.Err }
+
+// ClassifyNetworkError wraps err in a NetworkError when its cause is
+// recognized, and returns it unchanged otherwise.
+func ClassifyNetworkError(rawURL string, err error) error {
+	kind, ok := networkErrorKind(err)
+	if !ok {
+		return err
+	}
+	host := rawURL
+	if u, parseErr := url.Parse(rawURL); parseErr == nil && u.Host != "" {
+		host = u.Host
+	}
+	return &NetworkError{Kind: kind, Host: host, Err: err}
+}
+
+func networkErrorKind(err error) (NetworkErrorKind, bool) {
+	var (
+		networkErr *NetworkError
+		dnsErr     *net.DNSError
+		opErr      *net.OpError
+		statusErr  *StatusError
+		unknownCA  x509.UnknownAuthorityError
+		invalid    x509.CertificateInvalidError
+		hostname   x509.HostnameError
+		verify     *tls.CertificateVerificationError
+		record     tls.RecordHeaderError
+		netErr     net.Error
+	)
+	switch {
+	case err == nil || errors.As(err, &networkErr):
+		return "", false
+	case errors.As(err, &opErr) && opErr.Op == "proxyconnect":
+		return NetworkProxy, true
+	case errors.As(err, &dnsErr):
+		return NetworkDNS, true
+	case errors.As(err, &unknownCA), errors.As(err, &invalid), errors.As(err, &hostname),
+		errors.As(err, &verify), errors.As(err, &record):
+		return NetworkTLS, true
+	case errors.As(err, &statusErr):
+		switch {
+		case statusErr.StatusCode == http.StatusProxyAuthRequired:
+			return NetworkProxy, true
+		case statusErr.StatusCode >= 500:
+			return NetworkOutage, true
+		}
+		return "", false
+	case errors.Is(err, ErrStalled):
+		return NetworkStalled, true
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return NetworkTimeout, true
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return NetworkConnect, true
+	}
+	return "", false
+}
+
+// permanent reports whether retrying err cannot help: DNS, certificate
+// and proxy failures do not fix themselves within a few seconds.
+func permanent(err error) bool {
+	kind, ok := networkErrorKind(err)
+	return ok && (kind == NetworkDNS || kind == NetworkTLS || kind == NetworkProxy)
+}
+
+// Probe checks within timeout that the server behind rawURL answers, so a
+// command can fail at once with a NetworkError instead of hanging on its
+// first download. Any answer below 500 means the network works.
+func (c *Cache) Probe(ctx context.Context, rawURL string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := c.Reachable(ctx, rawURL)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode < 500 && statusErr.StatusCode != http.StatusProxyAuthRequired {
+		return nil
+	}
+	if err != nil {
+		return ClassifyNetworkError(rawURL, err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package fetch
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClassifyNetworkError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		kind NetworkErrorKind
+	}{
+		{"dns", &net.DNSError{Err: "no such host", Name: "formulae.brew.sh", IsNotFound: true}, NetworkDNS},
+		{"intercepted tls", x509.UnknownAuthorityError{}, NetworkTLS},
+		{"proxy", &net.OpError{Op: "proxyconnect", Net: "tcp", Err: syscall.ECONNREFUSED}, NetworkProxy},
+		{"proxy auth", &StatusError{StatusCode: http.StatusProxyAuthRequired}, NetworkProxy},
+		{"outage", &StatusError{StatusCode: http.StatusBadGateway}, NetworkOutage},
+		{"refused", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, NetworkConnect},
+		{"timeout", context.DeadlineExceeded, NetworkTimeout},
+	}
+	for _, tt := range tests {
+		err := ClassifyNetworkError("https://formulae.brew.sh/api/formula.jws.json", tt.err)
+		var networkErr *NetworkError
+		if !errors.As(err, &networkErr) || networkErr.Kind != tt.kind {
+			t.Errorf("%s: got %v, want kind %s", tt.name, err, tt.kind)
+			continue
+		}
+		if networkErr.Host != "formulae.brew.sh" || !errors.Is(err, tt.err) {
+			t.Errorf("%s: host %q, unwrap lost %v", tt.name, networkErr.Host, tt.err)
+		}
+	}
+	for _, err := range []error{&StatusError{StatusCode: http.StatusNotFound}, errors.New("disk full")} {
+		if got := ClassifyNetworkError("https://example.com/x", err); got != err {
+			t.Errorf("ClassifyNetworkError(%v) = %v, want it unchanged", err, got)
+		}
+	}
+}
+
+func TestFetchDoesNotRetryDNSFailures(t *testing.T) {
+	cache := NewCache(t.TempDir())
+	cache.Clock = &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	attempts := 0
+	cache.HTTP = doerFunc(func(req *http.Request) (*http.Response, error) {
+		attempts++
+		return nil, &net.DNSError{Err: "no such host", Name: req.URL.Host, IsNotFound: true}
+	})
+
+	_, err := cache.Fetch(context.Background(), "https://example.com/bottle.tar.gz")
+	var networkErr *NetworkError
+	if !errors.As(err, &networkErr) || networkErr.Kind != NetworkDNS {
+		t.Fatalf("Fetch error = %v, want a DNS NetworkError", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("attempts = %d, want 1", attempts)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	cache := NewCache(t.TempDir())
+	status := http.StatusNotFound
+	cache.HTTP = doerFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Method != http.MethodHead {
+			t.Fatalf("probe used %s", req.Method)
+		}
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader("")), Header: http.Header{}, Request: req}, nil
+	})
+	if err := cache.Probe(context.Background(), "https://example.com/api/formula.jws.json", time.Second); err != nil {
+		t.Fatalf("Probe with a 404 answer: %v", err)
+	}
+
+	status = http.StatusServiceUnavailable
+	err := cache.Probe(context.Background(), "https://example.com/api/formula.jws.json", time.Second)
+	var networkErr *NetworkError
+	if !errors.As(err, &networkErr) || networkErr.Kind != NetworkOutage {
+		t.Fatalf("Probe with a 503 answer = %v, want an outage", err)
+	}
+
+	cache.HTTP = doerFunc(func(req *http.Request) (*http.Response, error) {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})
+	err = cache.Probe(context.Background(), "https://example.com/api/formula.jws.json", 10*time.Millisecond)
+	if !errors.As(err, &networkErr) || networkErr.Kind != NetworkTimeout {
+		t.Fatalf("Probe of a hung server = %v, want a timeout", err)
+	}
+}
@@ -0,0 +1,53 @@
+package fetch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OCIIndexEntry is one image in an OCI image index, such as the bottle for
+// one platform in a Homebrew package's index on ghcr.io.
+type OCIIndexEntry struct {
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// maxIndexSize bounds an image index read into memory.
+const maxIndexSize = 16 << 20
+
+// OCIIndex reads the image index tagged tag from the registry repository
+// that blobURL, a distribution API blob URL (/v2/<repo>/blobs/<digest>),
+// belongs to. Indexes are small and change with every tag, so they are not
+// cached.
+func (c *Cache) OCIIndex(ctx context.Context, blobURL, tag string) ([]OCIIndexEntry, error) {
+	repo, _, ok := strings.Cut(blobURL, "/blobs/")
+	if !ok || !strings.Contains(repo, "/v2/") {
+		return nil, fmt.Errorf("%s is not a registry blob URL", blobURL)
+	}
+	manifestURL := repo + "/manifests/" + url.PathEscape(tag)
+	bearerToken := ""
+	if token, _, ok, err := c.fetchGHCRTokenForBlobURL(ctx, blobURL); err == nil && ok {
+		bearerToken = token
+	}
+	header := http.Header{"Accept": {"application/vnd.oci.image.index.v1+json"}}
+	resp, err := c.doRequestWithHeader(ctx, http.MethodGet, manifestURL, bearerToken, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{URL: manifestURL, StatusCode: resp.StatusCode}
+	}
+	var index struct {
+		Manifests []OCIIndexEntry `json:"manifests"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxIndexSize)).Decode(&index); err != nil {
+		return nil, fmt.Errorf("parse image index %s: %w", manifestURL, err)
+	}
+	return index.Manifests, nil
+}
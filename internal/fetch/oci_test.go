@@ -0,0 +1,32 @@
+package fetch
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOCIIndexReadsAnnotations(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/homebrew/core/hello/manifests/2.12.2_1" || r.Header.Get("Accept") != "application/vnd.oci.image.index.v1+json" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`{"schemaVersion":2,"manifests":[{"digest":"sha256:m1","annotations":{"sh.brew.bottle.digest":"aa","sh.brew.bottle.installed_size":"4096"}}]}`))
+	}))
+	defer server.Close()
+	cache := NewCache(t.TempDir())
+	ctx := context.Background()
+
+	entries, err := cache.OCIIndex(ctx, server.URL+"/v2/homebrew/core/hello/blobs/sha256:aa", "2.12.2_1")
+	if err != nil {
+		t.Fatalf("OCIIndex: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Digest != "sha256:m1" || entries[0].Annotations["sh.brew.bottle.installed_size"] != "4096" {
+		t.Fatalf("entries = %+v", entries)
+	}
+	if _, err := cache.OCIIndex(ctx, server.URL+"/bottles/hello.tar.gz", "2.12.2"); err == nil {
+		t.Fatal("expected an error for a URL outside a registry")
+	}
+}
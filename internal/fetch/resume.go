@@ -0,0 +1,169 @@
+package fetch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// checkpointSize is how much of a partial download one checkpoint covers.
+const checkpointSize = 1 << 20
+
+// partial is the saved state of an interrupted download. It sits next to
+// the partial file and holds the sha256 of each checkpointSize block
+// written so far, so a resumed download only trusts the blocks that still
+// match: after a power loss the file may hold less, or other, data than
+// was written.
+type partial struct {
+	URL         string     `json:"url"`
+	Validators  validators `json:"validators"`
+	Checkpoints []string   `json:"checkpoints"`
+}
+
+func partialPath(target string) string {
+	return strings.TrimSuffix(target, ".src") + ".part"
+}
+
+func resumePath(target string) string {
+	return strings.TrimSuffix(target, ".src") + ".resume"
+}
+
+func discardPartial(target string) {
+	_ = os.Remove(partialPath(target))
+	_ = os.Remove(resumePath(target))
+}
+
+// ifRange is the validator a resumed request is conditional on. Without
+// one the server cannot promise the rest belongs to the same file, so the
+// download is not resumable.
+func (p partial) ifRange() string {
+	if p.Validators.ETag != "" && !strings.HasPrefix(p.Validators.ETag, "W/") {
+		return p.Validators.ETag
+	}
+	return p.Validators.LastModified
+}
+
+func (p partial) save(path string) error {
+	if p.ifRange() == "" {
+		return nil
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// resumePartial returns the saved state of target's interrupted download
+// of url and how many bytes of it verify against their checkpoints. Zero
+// means start over.
+func resumePartial(url, target string) (partial, int64) {
+	data, err := os.ReadFile(resumePath(target))
+	if err != nil {
+		return partial{}, 0
+	}
+	var p partial
+	if json.Unmarshal(data, &p) != nil || p.URL != url || p.ifRange() == "" {
+		discardPartial(target)
+		return partial{}, 0
+	}
+	f, err := os.Open(partialPath(target))
+	if err != nil {
+		return partial{}, 0
+	}
+	defer f.Close()
+	buf := make([]byte, checkpointSize)
+	verified := 0
+	for verified < len(p.Checkpoints) {
+		if _, err := io.ReadFull(f, buf); err != nil {
+			break
+		}
+		sum := sha256.Sum256(buf)
+		if hex.EncodeToString(sum[:]) != p.Checkpoints[verified] {
+			break
+		}
+		verified++
+	}
+	p.Checkpoints = p.Checkpoints[:verified]
+	return p, int64(verified) * checkpointSize
+}
+
+// rangeHeader asks for the rest of p from offset, if the server still has
+// the same file.
+func (p partial) rangeHeader(offset int64) http.Header {
+	if offset == 0 {
+		return nil
+	}
+	return http.Header{
+		"Range":    {"bytes=" + strconv.FormatInt(offset, 10) + "-"},
+		"If-Range": {p.ifRange()},
+	}
+}
+
+// contentRangeStart is the first byte of a 206 response, or -1.
+func contentRangeStart(resp *http.Response) int64 {
+	spec, ok := strings.CutPrefix(resp.Header.Get("Content-Range"), "bytes ")
+	if !ok {
+		return -1
+	}
+	first, _, ok := strings.Cut(spec, "-")
+	if !ok {
+		return -1
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return start
+}
+
+// checkpointWriter writes a download to its partial file and saves a
+// checkpoint after every checkpointSize bytes. It must start at a block
+// boundary.
+type checkpointWriter struct {
+	f     *os.File
+	part  partial
+	path  string
+	block interface {
+		io.Writer
+		Sum([]byte) []byte
+		Reset()
+	}
+	inBlock int
+}
+
+func newCheckpointWriter(f *os.File, part partial, target string) *checkpointWriter {
+	return &checkpointWriter{f: f, part: part, path: resumePath(target), block: sha256.New()}
+}
+
+func (w *checkpointWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), checkpointSize-w.inBlock)
+		if _, err := w.f.Write(p[:n]); err != nil {
+			return written, err
+		}
+		w.block.Write(p[:n])
+		w.inBlock += n
+		written += n
+		p = p[n:]
+		if w.inBlock == checkpointSize {
+			w.part.Checkpoints = append(w.part.Checkpoints, hex.EncodeToString(w.block.Sum(nil)))
+			w.block.Reset()
+			w.inBlock = 0
+			if err := w.part.save(w.path); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
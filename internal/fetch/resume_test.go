@@ -0,0 +1,130 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// failingBody returns an error once limit bytes have been read, like a
+// connection dropped mid-download.
+type failingBody struct {
+	io.ReadCloser
+	limit int
+}
+
+func (b *failingBody) Read(p []byte) (int, error) {
+	if b.limit <= 0 {
+		return 0, errors.New("connection reset")
+	}
+	if len(p) > b.limit {
+		p = p[:b.limit]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.limit -= n
+	return n, err
+}
+
+func TestFetchResumesVerifiedPrefix(t *testing.T) {
+	blob := bytes.Repeat([]byte("0123456789abcdef"), (3*checkpointSize+checkpointSize/2)/16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "bottle.tar.gz", time.Time{}, bytes.NewReader(blob))
+	}))
+	defer server.Close()
+
+	cache := NewCache(t.TempDir())
+	cache.Clock = &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var ranges []string
+	// Each request drops after the next number of bytes; retries resume
+	// and drop again at once.
+	drops := []int{2*checkpointSize + 100, 1, 1}
+	cache.HTTP = doerFunc(func(req *http.Request) (*http.Response, error) {
+		ranges = append(ranges, req.Header.Get("Range"))
+		resp, err := server.Client().Do(req)
+		if err == nil && len(drops) > 0 {
+			resp.Body = &failingBody{ReadCloser: resp.Body, limit: drops[0]}
+			drops = drops[1:]
+		}
+		return resp, err
+	})
+	url := server.URL + "/bottle.tar.gz"
+	target := cache.cachePathForKey(hash(canonicalizeURL(url)))
+
+	if _, err := cache.Fetch(context.Background(), url); err == nil {
+		t.Fatal("expected the dropped download to fail")
+	}
+	if len(ranges) != 3 || ranges[1] != "bytes=2097152-" {
+		t.Fatalf("retries sent ranges %q, want them to resume", ranges)
+	}
+	if p, offset := resumePartial(url, target); offset != 2*checkpointSize || len(p.Checkpoints) != 2 {
+		t.Fatalf("partial = %d checkpoints, offset %d", len(p.Checkpoints), offset)
+	}
+
+	// Simulate a power loss that garbled the second block on disk.
+	f, err := os.OpenFile(partialPath(target), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("garbage"), checkpointSize+10)
+	f.Close()
+
+	ranges = nil
+	path, err := cache.Fetch(context.Background(), url)
+	if err != nil {
+		t.Fatalf("resumed fetch: %v", err)
+	}
+	if len(ranges) != 1 || ranges[0] != "bytes=1048576-" {
+		t.Fatalf("resumed with ranges %q, want only the verified first block kept", ranges)
+	}
+	if data, _ := os.ReadFile(path); !bytes.Equal(data, blob) {
+		t.Fatalf("resumed download differs from the original (%d bytes, want %d)", len(data), len(blob))
+	}
+	for _, leftover := range []string{partialPath(target), resumePath(target)} {
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Fatalf("%s left behind: %v", leftover, err)
+		}
+	}
+}
+
+func TestFetchRestartsWhenFileChanged(t *testing.T) {
+	blob := bytes.Repeat([]byte("x"), 2*checkpointSize)
+	etag := `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "bottle.tar.gz", time.Time{}, bytes.NewReader(blob))
+	}))
+	defer server.Close()
+
+	cache := NewCache(t.TempDir())
+	cache.Clock = &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	drops := []int{checkpointSize + 1, 1, 1}
+	cache.HTTP = doerFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := server.Client().Do(req)
+		if err == nil && len(drops) > 0 {
+			resp.Body = &failingBody{ReadCloser: resp.Body, limit: drops[0]}
+			drops = drops[1:]
+		}
+		return resp, err
+	})
+	url := server.URL + "/bottle.tar.gz"
+	if _, err := cache.Fetch(context.Background(), url); err == nil {
+		t.Fatal("expected the dropped download to fail")
+	}
+
+	etag = `"v2"`
+	blob = bytes.Repeat([]byte("y"), 2*checkpointSize)
+	path, err := cache.Fetch(context.Background(), url)
+	if err != nil {
+		t.Fatalf("fetch after change: %v", err)
+	}
+	if data, _ := os.ReadFile(path); !bytes.Equal(data, blob) {
+		t.Fatal("download mixed the old and new file")
+	}
+}
@@ -0,0 +1,61 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// MetadataStallTimeout is the StallTimeout of API document fetches.
+	MetadataStallTimeout = 30 * time.Second
+	// DownloadStallTimeout is the StallTimeout of bottle and cask downloads,
+	// which can sit behind a slow redirect or a cold CDN edge for a while.
+	DownloadStallTimeout = 60 * time.Second
+)
+
+// ErrStalled marks a download attempt that received nothing for longer
+// than the cache's StallTimeout.
+var ErrStalled = errors.New("download stalled")
+
+// stallWatch cancels its context once kick has not been called for the
+// timeout. A zero timeout never fires.
+type stallWatch struct {
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func watchStalls(ctx context.Context, timeout time.Duration) (context.Context, *stallWatch, context.CancelFunc) {
+	if timeout <= 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, &stallWatch{}, cancel
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	w := &stallWatch{timeout: timeout}
+	w.timer = time.AfterFunc(timeout, func() {
+		cancel(fmt.Errorf("%w: nothing received for %s", ErrStalled, timeout))
+	})
+	return ctx, w, func() {
+		w.timer.Stop()
+		cancel(nil)
+	}
+}
+
+func (w *stallWatch) kick() {
+	if w.timer != nil {
+		w.timer.Reset(w.timeout)
+	}
+}
+
+// stallError returns why ctx's watch fired in place of err, which is then
+// only the context cancellation it caused.
+func stallError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if cause := context.Cause(ctx); errors.Is(cause, ErrStalled) {
+		return cause
+	}
+	return err
+}
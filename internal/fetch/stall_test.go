@@ -0,0 +1,78 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// stallingBody hands over limit bytes, then blocks until its request is
+// abandoned, like a server that stops sending mid-response.
+type stallingBody struct {
+	io.ReadCloser
+	ctx   context.Context
+	limit int
+}
+
+func (b *stallingBody) Read(p []byte) (int, error) {
+	if b.limit <= 0 {
+		<-b.ctx.Done()
+		return 0, b.ctx.Err()
+	}
+	if len(p) > b.limit {
+		p = p[:b.limit]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.limit -= n
+	return n, err
+}
+
+func TestFetchRetriesStalledDownload(t *testing.T) {
+	blob := bytes.Repeat([]byte("bottle"), 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "bottle.tar.gz", time.Time{}, bytes.NewReader(blob))
+	}))
+	defer server.Close()
+
+	cache := NewCache(t.TempDir())
+	cache.Clock = &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	cache.StallTimeout = 50 * time.Millisecond
+	var stalled []Progress
+	stalls := 1
+	cache.HTTP = doerFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := server.Client().Do(req)
+		if err == nil && stalls > 0 {
+			resp.Body = &stallingBody{ReadCloser: resp.Body, ctx: req.Context(), limit: 100}
+			stalls--
+		}
+		return resp, err
+	})
+
+	path, err := cache.FetchWithProgress(context.Background(), server.URL+"/bottle.tar.gz", func(p Progress) {
+		if p.Stalled {
+			stalled = append(stalled, p)
+		}
+	})
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if len(stalled) != 1 || stalled[0].DownloadedBytes != 100 || stalled[0].TotalBytes != int64(len(blob)) {
+		t.Fatalf("stalled updates = %+v, want one at 100 bytes", stalled)
+	}
+	if data, _ := os.ReadFile(path); !bytes.Equal(data, blob) {
+		t.Fatalf("downloaded %d bytes, want %d", len(data), len(blob))
+	}
+
+	stalls = 3
+	_, err = cache.Fetch(context.Background(), server.URL+"/other.tar.gz")
+	var networkErr *NetworkError
+	if !errors.Is(err, ErrStalled) || !errors.As(err, &networkErr) || networkErr.Kind != NetworkStalled {
+		t.Fatalf("expected a stalled download error, got %v", err)
+	}
+}
@@ -1,20 +1,44 @@
 package formula
 
 import (
-	"encoding/json"
 	"fmt"
-	"os"
 	"path/filepath"
-	"sort"
+	"strings"
 )
 
 type Source struct {
 	URL    string `json:"url"`
 	SHA256 string `json:"sha256"`
+	// Branch, Tag and Revision pin a git source; setting any of them marks
+	// URL as a repository even without a .git suffix.
+	Branch   string `json:"branch,omitempty"`
+	Tag      string `json:"tag,omitempty"`
+	Revision string `json:"revision,omitempty"`
 }
 
 type Build struct {
 	Steps []string `json:"steps"`
+	// Outputs are paths relative to the install dir that the steps must
+	// produce, such as "bin/hello".
+	Outputs []string `json:"outputs,omitempty"`
+}
+
+// Patch is applied to the unpacked source before the build steps run. It is
+// either downloaded from URL, which then needs SHA256, or given inline as
+// Data. Strip is the -p level and defaults to 1.
+type Patch struct {
+	URL    string `json:"url,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Data   string `json:"data,omitempty"`
+	Strip  *int   `json:"strip,omitempty"`
+}
+
+// StripLevel returns the -p argument for the patch.
+func (p Patch) StripLevel() int {
+	if p.Strip == nil {
+		return 1
+	}
+	return *p.Strip
 }
 
 type Formula struct {
@@ -22,79 +46,60 @@ type Formula struct {
 	Version string   `json:"version"`
 	Deps    []string `json:"deps"`
 	Source  Source   `json:"source"`
+	Patches []Patch  `json:"patches,omitempty"`
 	Build   Build    `json:"build"`
 }
 
+// Validate checks the fields JSON decoding cannot. Errors are *FieldError.
 func (f Formula) Validate() error {
+	invalid := func(field, problem, expected string) error {
+		return &FieldError{Formula: f.Name, Field: field, Problem: problem, Expected: expected}
+	}
 	if f.Name == "" {
-		return fmt.Errorf("formula missing name")
+		return invalid("name", "is required", "a formula name")
+	}
+	if err := ValidName(f.Name); err != nil {
+		return invalid("name", err.Error(), "a name such as hello or tools/ripgrep")
+	}
+	for i, dep := range f.Deps {
+		if err := ValidName(dep); err != nil {
+			return invalid(fmt.Sprintf("deps[%d]", i), err.Error(), "a formula name such as libfoo or tools/ripgrep")
+		}
 	}
 	if f.Version == "" {
-		return fmt.Errorf("formula %q missing version", f.Name)
+		return invalid("version", "is required", "a version string")
+	}
+	for i, out := range f.Build.Outputs {
+		clean := filepath.Clean(out)
+		if out == "" || filepath.IsAbs(out) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+			return invalid(fmt.Sprintf("build.outputs[%d]", i), fmt.Sprintf("%q is not inside the install dir", out), "a relative path such as bin/hello")
+		}
+	}
+	for i, p := range f.Patches {
+		field := fmt.Sprintf("patches[%d]", i)
+		switch {
+		case p.URL == "" && p.Data == "":
+			return invalid(field, "needs a url or data", "exactly one of url or data")
+		case p.URL != "" && p.Data != "":
+			return invalid(field, "sets both url and data", "exactly one of url or data")
+		case p.URL != "" && p.SHA256 == "":
+			return invalid(field+".sha256", "is required with url", "the sha256 of the patch file")
+		case p.StripLevel() < 0:
+			return invalid(field+".strip", "is negative", "0 or more")
+		}
 	}
 	return nil
 }
 
 func LoadByName(tapDir, name string) (Formula, error) {
-	file := filepath.Join(tapDir, name+".json")
-	data, err := os.ReadFile(file)
-	if err != nil {
-		return Formula{}, fmt.Errorf("read formula %q: %w", name, err)
-	}
-
-	var f Formula
-	if err := json.Unmarshal(data, &f); err != nil {
-		return Formula{}, fmt.Errorf("parse formula %q: %w", name, err)
-	}
-	if f.Name == "" {
-		f.Name = name
-	}
-	if err := f.Validate(); err != nil {
-		return Formula{}, err
-	}
+	return Taps{tapDir}.Load(name)
+}
 
-	return f, nil
+// Digest returns the sha256 of the formula file for name.
+func Digest(tapDir, name string) (string, error) {
+	return Taps{tapDir}.Digest(name)
 }
 
 func ResolveClosure(tapDir string, roots []string) (map[string]Formula, error) {
-	seen := map[string]Formula{}
-	visiting := map[string]bool{}
-
-	var dfs func(string) error
-	dfs = func(name string) error {
-		if _, ok := seen[name]; ok {
-			return nil
-		}
-		if visiting[name] {
-			return fmt.Errorf("dependency cycle detected at %q", name)
-		}
-		visiting[name] = true
-
-		f, err := LoadByName(tapDir, name)
-		if err != nil {
-			return err
-		}
-
-		sort.Strings(f.Deps)
-		for _, dep := range f.Deps {
-			if dep == f.Name {
-				return fmt.Errorf("formula %q cannot depend on itself", f.Name)
-			}
-			if err := dfs(dep); err != nil {
-				return fmt.Errorf("resolve dep %q for %q: %w", dep, name, err)
-			}
-		}
-
-		visiting[name] = false
-		seen[name] = f
-		return nil
-	}
-
-	for _, root := range roots {
-		if err := dfs(root); err != nil {
-			return nil, err
-		}
-	}
-
-	return seen, nil
+	return Taps{tapDir}.ResolveClosure(roots)
 }
@@ -1,8 +1,11 @@
 package formula
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -33,3 +36,187 @@ func TestResolveClosure(t *testing.T) {
 		t.Fatalf("expected 2 formulas, got %d", len(all))
 	}
 }
+
+func TestValidateRejectsIncompletePatches(t *testing.T) {
+	for _, p := range []Patch{
+		{},
+		{URL: "https://example.com/fix.patch"},
+		{URL: "https://example.com/fix.patch", SHA256: "abc", Data: "diff"},
+	} {
+		f := Formula{Name: "a", Version: "1.0.0", Patches: []Patch{p}}
+		if err := f.Validate(); err == nil {
+			t.Fatalf("expected %+v to be rejected", p)
+		}
+	}
+}
+
+func TestValidateRejectsOutputsOutsideInstallDir(t *testing.T) {
+	for _, out := range []string{"", "/usr/bin/hello", "../hello", "."} {
+		f := Formula{Name: "a", Version: "1.0.0", Build: Build{Outputs: []string{out}}}
+		if err := f.Validate(); err == nil {
+			t.Fatalf("expected output %q to be rejected", out)
+		}
+	}
+	f := Formula{Name: "a", Version: "1.0.0", Build: Build{Outputs: []string{"bin/hello"}}}
+	if err := f.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+}
+
+func TestLintReportsTapProblems(t *testing.T) {
+	tap := t.TempDir()
+	files := map[string]string{
+		"a.json":     `{"name": "a", "version": "1.0", "deps": ["b", "missing"], "source": {"url": "https://example.com/a-1.0.tar.gz"}}`,
+		"b.json":     `{"name": "b", "version": "1.0", "deps": ["a"]}`,
+		"c.json":     `{"name": "c", "version": "1.0", "bulid": {}}`,
+		"d.json":     `{"name": "dee", "version": "1.0", "source": {"url": "https://example.com/d.git"}}`,
+		"clean.json": `{"name": "clean", "version": "1.0", "deps": []}`,
+	}
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(tap, name), []byte(body), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	var checked []string
+	problems, err := Lint(context.Background(), tap, nil, LintOptions{CheckURL: func(_ context.Context, url string) error {
+		checked = append(checked, url)
+		if strings.HasSuffix(url, ".git") {
+			return fmt.Errorf("repository not found")
+		}
+		return nil
+	}})
+	if err != nil {
+		t.Fatalf("Lint: %v", err)
+	}
+	var got []string
+	for _, p := range problems {
+		got = append(got, p.String())
+	}
+	want := []string{
+		`a: depends on "missing", which is not in the tap`,
+		"a: source has no sha256",
+		"a: dependency cycle: a -> b -> a",
+		"c: " + filepath.Join(tap, "c.json") + `:1:33: bulid: is not a formula field; did you mean "build"?`,
+		`d: name "dee" does not match the file name`,
+		"d: https://example.com/d.git is unreachable: repository not found",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("problems:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if len(checked) != 2 {
+		t.Fatalf("checked %v, want the two source URLs", checked)
+	}
+
+	for url, want := range map[string]string{
+		"https://ftp.gnu.org/gnu/hello/hello-2.12.1.tar.gz":         "2.12.1",
+		"https://github.com/jqlang/jq/archive/refs/tags/v1.7.1.zip": "1.7.1",
+		"https://example.com/download?file=latest":                  "",
+	} {
+		if got := GuessVersion(url); got != want {
+			t.Fatalf("GuessVersion(%q) = %q, want %q", url, got, want)
+		}
+	}
+}
+
+func TestLoadByNameReportsFieldAndPosition(t *testing.T) {
+	tap := t.TempDir()
+	for body, want := range map[string]string{
+		"{\n  \"name\": \"a\",\n  \"version\": \"1.0\",\n  \"depps\": [\"b\"]\n}":                   `a.json:4:3: depps: is not a formula field; did you mean "deps"?`,
+		"{\n  \"name\": \"a\",\n  \"version\": \"1.0\",\n  \"deps\": \"b\"\n}":                      "a.json:4:3: deps: got a JSON string (want a list of strings)\n  example: \"deps\": [\"libfoo\"]",
+		"{\n  \"name\": \"a\",\n  \"version\": \"1.0\",\n  \"patches\": [{\"data\": \"x\"}, {}]\n}": "a.json:4:30: patches[1]: needs a url or data (want exactly one of url or data)",
+		"{\n  \"name\": \"a\",\n  \"version\": \"1.0\",\n}":                                         "a.json:4:1: invalid JSON: invalid character '}' looking for beginning of object key string",
+	} {
+		if err := os.WriteFile(filepath.Join(tap, "a.json"), []byte(body), 0o644); err != nil {
+			t.Fatalf("write formula: %v", err)
+		}
+		_, err := LoadByName(tap, "a")
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("LoadByName error = %v\nwant %q", err, want)
+		}
+	}
+}
+
+func TestPinSourceEditsFileInPlace(t *testing.T) {
+	tap := t.TempDir()
+	original := "{\n  \"name\": \"hello\",\n  \"version\": \"1.0.0\",\n  \"source\": {\n    \"url\": \"https://example.com/hello.tar.gz\"\n  },\n  \"build\": {\"steps\": []}\n}\n"
+	file := filepath.Join(tap, "hello.json")
+	if err := os.WriteFile(file, []byte(original), 0o644); err != nil {
+		t.Fatalf("write formula: %v", err)
+	}
+	first, second := strings.Repeat("a", 64), strings.Repeat("b", 64)
+
+	for _, sum := range []string{first, second} {
+		changed, err := PinSource(tap, "hello", sum)
+		if err != nil || !changed {
+			t.Fatalf("PinSource(%s) = %v, %v", sum[:1], changed, err)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("read formula: %v", err)
+		}
+		want := strings.Replace(original, "hello.tar.gz\"\n", "hello.tar.gz\",\n    \"sha256\": \""+sum+"\"\n", 1)
+		if string(data) != want {
+			t.Fatalf("formula after pinning:\n%s\nwant:\n%s", data, want)
+		}
+	}
+	if changed, err := PinSource(tap, "hello", second); err != nil || changed {
+		t.Fatalf("re-pinning the same sum = %v, %v", changed, err)
+	}
+}
+
+func TestTapsResolveNamespacedFormulasByPrecedence(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+	write := func(tap, name, body string) {
+		t.Helper()
+		path := filepath.Join(tap, filepath.FromSlash(name)+".json")
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	write(first, "tools/ripgrep", `{"name": "tools/ripgrep", "version": "14.1.0", "deps": ["libs/pcre2"]}`)
+	write(second, "tools/ripgrep", `{"name": "tools/ripgrep", "version": "13.0.0"}`)
+	write(second, "libs/pcre2", `{"version": "10.42"}`)
+	write(second, ".git/config", `{}`)
+
+	taps := Taps{first, second}
+	all, err := taps.ResolveClosure([]string{"tools/ripgrep"})
+	if err != nil {
+		t.Fatalf("ResolveClosure: %v", err)
+	}
+	if all["tools/ripgrep"].Version != "14.1.0" || all["libs/pcre2"].Name != "libs/pcre2" {
+		t.Fatalf("closure = %+v", all)
+	}
+	names, err := taps.Names()
+	if err != nil || strings.Join(names, " ") != "libs/pcre2 tools/ripgrep" {
+		t.Fatalf("Names = %v, %v", names, err)
+	}
+	if _, err := taps.Load("../escape"); err == nil {
+		t.Fatal("expected a name outside the tap to be rejected")
+	}
+
+	if count, err := WriteIndex(second); err != nil || count != 2 {
+		t.Fatalf("WriteIndex = %d, %v", count, err)
+	}
+	write(second, "unindexed", `{"version": "1.0"}`)
+	if _, err := Save(second, Formula{Name: "tools/fd", Version: "10.2.0"}, false); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	names, err = Taps{second}.Names()
+	if err != nil || strings.Join(names, " ") != "libs/pcre2 tools/fd tools/ripgrep" {
+		t.Fatalf("indexed Names = %v, %v", names, err)
+	}
+
+	// A broken formula is left out of a rebuilt index instead of losing it.
+	write(second, "broken", `{"version": `)
+	count, err := WriteIndex(second)
+	if err == nil || !strings.Contains(err.Error(), "broken") || count != 4 {
+		t.Fatalf("WriteIndex with a broken formula = %d, %v", count, err)
+	}
+	names, err = Taps{second}.Names()
+	if err != nil || strings.Join(names, " ") != "libs/pcre2 tools/fd tools/ripgrep unindexed" {
+		t.Fatalf("Names after a partial index = %v, %v", names, err)
+	}
+}
@@ -0,0 +1,252 @@
+package formula
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"ub/internal/fetch"
+)
+
+// Problem is one lint finding for a tap formula.
+type Problem struct {
+	Formula string
+	Message string
+}
+
+func (p Problem) String() string {
+	return p.Formula + ": " + p.Message
+}
+
+type LintOptions struct {
+	// CheckURL is asked about every source and patch URL; nil skips the
+	// network checks.
+	CheckURL func(ctx context.Context, url string) error
+}
+
+// Lint checks the named formulae, or every formula in tapDir when names is
+// empty. Problems are sorted by formula; the error is only for a tap that
+// cannot be read at all.
+func Lint(ctx context.Context, tapDir string, names []string, opts LintOptions) ([]Problem, error) {
+	if len(names) == 0 {
+		var err error
+		if names, err = tapNames(tapDir); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(names)
+
+	var problems []Problem
+	report := func(name, format string, args ...any) {
+		problems = append(problems, Problem{Formula: name, Message: fmt.Sprintf(format, args...)})
+	}
+	loaded := map[string]Formula{}
+	for _, name := range names {
+		f, err := loadStrict(tapDir, name)
+		if err != nil {
+			report(name, "%v", err)
+			continue
+		}
+		loaded[name] = f
+		if f.Name != "" && f.Name != name {
+			report(name, "name %q does not match the file name", f.Name)
+		}
+		if err := f.Validate(); err != nil {
+			file := formulaFile(tapDir, name)
+			data, _ := os.ReadFile(file)
+			report(name, "%v", locate(err, file, data))
+		}
+		for _, dep := range f.Deps {
+			if dep == name {
+				report(name, "depends on itself")
+			} else if _, err := (Taps{tapDir}).Find(dep); err != nil {
+				report(name, "depends on %q, which is not in the tap", dep)
+			}
+		}
+		if f.Source.URL != "" {
+			if !fetch.IsGitURL(f.Source.URL) && f.Source.SHA256 == "" {
+				report(name, "source has no sha256")
+			}
+			if f.Source.SHA256 != "" && !isSHA256(f.Source.SHA256) {
+				report(name, "source sha256 %q is not 64 hex digits", f.Source.SHA256)
+			}
+		}
+		for i, p := range f.Patches {
+			if p.SHA256 != "" && !isSHA256(p.SHA256) {
+				report(name, "patch %d sha256 %q is not 64 hex digits", i+1, p.SHA256)
+			}
+		}
+		if opts.CheckURL != nil {
+			urls := []string{f.Source.URL}
+			for _, p := range f.Patches {
+				urls = append(urls, p.URL)
+			}
+			for _, u := range urls {
+				if u == "" {
+					continue
+				}
+				if err := opts.CheckURL(ctx, u); err != nil {
+					report(name, "%s is unreachable: %v", u, err)
+				}
+			}
+		}
+	}
+
+	for _, cycle := range findCycles(tapDir, loaded) {
+		report(cycle[0], "dependency cycle: %s", strings.Join(cycle, " -> "))
+	}
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Formula < problems[j].Formula })
+	return problems, nil
+}
+
+// loadStrict is LoadByName without defaults or validation.
+func loadStrict(tapDir, name string) (Formula, error) {
+	if err := ValidName(name); err != nil {
+		return Formula{}, fmt.Errorf("formula name %w", err)
+	}
+	file := formulaFile(tapDir, name)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return Formula{}, fmt.Errorf("read formula: %w", err)
+	}
+	return decodeFormula(file, data)
+}
+
+// findCycles walks the dependency graph from the linted formulae, loading
+// dependencies from the tap as needed, and returns each cycle once,
+// starting from its smallest name.
+func findCycles(tapDir string, loaded map[string]Formula) [][]string {
+	deps := func(name string) []string {
+		f, ok := loaded[name]
+		if !ok {
+			var err error
+			if f, err = loadStrict(tapDir, name); err != nil {
+				return nil
+			}
+			loaded[name] = f
+		}
+		return f.Deps
+	}
+	roots := make([]string, 0, len(loaded))
+	for name := range loaded {
+		roots = append(roots, name)
+	}
+	sort.Strings(roots)
+
+	var cycles [][]string
+	seen := map[string]bool{}
+	done := map[string]bool{}
+	var stack []string
+	onStack := map[string]int{}
+	var visit func(string)
+	visit = func(name string) {
+		if done[name] {
+			return
+		}
+		if idx, ok := onStack[name]; ok {
+			cycle := append([]string(nil), stack[idx:]...)
+			start := 0
+			for i, n := range cycle {
+				if n < cycle[start] {
+					start = i
+				}
+			}
+			cycle = append(cycle[start:], cycle[:start]...)
+			cycle = append(cycle, cycle[0])
+			if key := strings.Join(cycle, " "); !seen[key] {
+				seen[key] = true
+				cycles = append(cycles, cycle)
+			}
+			return
+		}
+		onStack[name] = len(stack)
+		stack = append(stack, name)
+		for _, dep := range deps(name) {
+			if dep != name {
+				visit(dep)
+			}
+		}
+		stack = stack[:len(stack)-1]
+		delete(onStack, name)
+		done[name] = true
+	}
+	for _, root := range roots {
+		visit(root)
+	}
+	return cycles
+}
+
+func isSHA256(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == 32
+}
+
+var versionPattern = regexp.MustCompile(`[-_]v?(\d+(?:\.\d+)+[a-z0-9.-]*)$|^v?(\d+(?:\.\d+)+[a-z0-9.-]*)$`)
+
+// GuessVersion reads a version from an archive URL's file name, as in
+// hello-2.12.1.tar.gz or v1.7.1.zip. It returns "" when there is none.
+func GuessVersion(rawURL string) string {
+	name := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		name = u.Path
+	}
+	name = path.Base(name)
+	for _, ext := range []string{".tar.gz", ".tar.xz", ".tar.bz2", ".tgz", ".tar", ".zip"} {
+		if strings.HasSuffix(name, ext) {
+			name = strings.TrimSuffix(name, ext)
+			break
+		}
+	}
+	m := versionPattern.FindStringSubmatch(name)
+	if m == nil {
+		return ""
+	}
+	if m[1] != "" {
+		return m[1]
+	}
+	return m[2]
+}
+
+// Save writes f to <tapDir>/<name>.json and returns the path. An existing
+// file is only replaced when overwrite is set. A tap index, if there is
+// one, is updated to include f.
+func Save(tapDir string, f Formula, overwrite bool) (string, error) {
+	if err := f.Validate(); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("marshal formula %q: %w", f.Name, err)
+	}
+	file := formulaFile(tapDir, f.Name)
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return "", fmt.Errorf("create tap dir: %w", err)
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !overwrite {
+		flags |= os.O_EXCL
+	}
+	out, err := os.OpenFile(file, flags, 0o644)
+	if err != nil {
+		if os.IsExist(err) {
+			return "", fmt.Errorf("formula %q already exists at %s", f.Name, file)
+		}
+		return "", fmt.Errorf("write formula %q: %w", f.Name, err)
+	}
+	if _, err := out.Write(append(data, '\n')); err != nil {
+		_ = out.Close()
+		return "", fmt.Errorf("write formula %q: %w", f.Name, err)
+	}
+	if err := out.Close(); err != nil {
+		return "", fmt.Errorf("write formula %q: %w", f.Name, err)
+	}
+	return file, addToIndex(tapDir, f)
+}
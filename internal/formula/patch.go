@@ -0,0 +1,70 @@
+package formula
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"ub/internal/fetch"
+)
+
+// ApplyPatches applies patches to dir in order, downloading remote ones
+// through fetcher and checking their sha256 first.
+func ApplyPatches(ctx context.Context, fetcher *fetch.Cache, patches []Patch, dir string) error {
+	if len(patches) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("create work dir: %w", err)
+	}
+	for i, p := range patches {
+		data := []byte(p.Data)
+		if p.URL != "" {
+			cached, err := fetcher.Fetch(ctx, p.URL)
+			if err != nil {
+				return fmt.Errorf("fetch patch %d: %w", i+1, err)
+			}
+			if data, err = os.ReadFile(cached); err != nil {
+				return fmt.Errorf("read patch %d: %w", i+1, err)
+			}
+			sum := sha256.Sum256(data)
+			if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, p.SHA256) {
+				return fmt.Errorf("patch %d checksum mismatch: got %s, want %s", i+1, got, p.SHA256)
+			}
+		}
+		if err := applyPatch(ctx, dir, data, p.StripLevel()); err != nil {
+			return fmt.Errorf("apply patch %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// applyPatch uses git apply inside git checkouts and patch(1) elsewhere.
+func applyPatch(ctx context.Context, dir string, data []byte, strip int) error {
+	level := "-p" + strconv.Itoa(strip)
+	var cmd *exec.Cmd
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		cmd = exec.CommandContext(ctx, "git", "apply", "--whitespace=nowarn", level)
+	} else {
+		cmd = exec.CommandContext(ctx, "patch", "--batch", "--silent", level)
+	}
+	cmd.Dir = dir
+	cmd.Stdin = bytes.NewReader(data)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(out.String()); msg != "" {
+			return fmt.Errorf("%s: %w: %s", cmd.Args[0], err, msg)
+		}
+		return fmt.Errorf("%s: %w", cmd.Args[0], err)
+	}
+	return nil
+}
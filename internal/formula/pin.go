@@ -0,0 +1,102 @@
+package formula
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"ub/internal/fetch"
+)
+
+var (
+	sha256Value = regexp.MustCompile(`^"sha256"\s*:\s*"(?:[^"\\]|\\.)*"`)
+	urlValue    = regexp.MustCompile(`^"url"\s*:\s*"(?:[^"\\]|\\.)*"`)
+)
+
+// SourceURL returns the archive URL of a formula's source, or an error when
+// it has none or the source is a git repository, which is pinned by
+// revision rather than checksum.
+func SourceURL(tapDir, name string) (string, error) {
+	f, err := LoadByName(tapDir, name)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case f.Source.URL == "":
+		return "", fmt.Errorf("formula %q has no source url", name)
+	case fetch.IsGitURL(f.Source.URL):
+		return "", fmt.Errorf("formula %q source is a git repository; pin a revision instead", name)
+	}
+	return f.Source.URL, nil
+}
+
+// PinSource writes sum as the source sha256 of the formula file for name,
+// editing the file in place so its layout and key order survive. It
+// reports whether the file changed.
+func PinSource(tapDir, name, sum string) (bool, error) {
+	if !isSHA256(sum) {
+		return false, fmt.Errorf("invalid sha256 %q", sum)
+	}
+	if err := ValidName(name); err != nil {
+		return false, fmt.Errorf("formula name %w", err)
+	}
+	file := formulaFile(tapDir, name)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return false, fmt.Errorf("read formula %q: %w", name, err)
+	}
+	f, err := decodeFormula(file, data)
+	if err != nil {
+		return false, err
+	}
+	if strings.EqualFold(f.Source.SHA256, sum) {
+		return false, nil
+	}
+
+	var shaAt, urlAt int64 = -1, -1
+	for _, k := range keyPositions(data) {
+		switch k.path {
+		case "source.sha256":
+			shaAt = k.offset
+		case "source.url":
+			urlAt = k.offset
+		}
+	}
+	var out []byte
+	switch {
+	case shaAt >= 0:
+		end := shaAt + int64(len(sha256Value.Find(data[shaAt:])))
+		out = splice(data, shaAt, end, fmt.Sprintf(`"sha256": %q`, sum))
+	case urlAt >= 0:
+		end := urlAt + int64(len(urlValue.Find(data[urlAt:])))
+		lineStart := int64(strings.LastIndexByte(string(data[:urlAt]), '\n') + 1)
+		sep := ", "
+		if indent := data[lineStart:urlAt]; strings.TrimSpace(string(indent)) == "" {
+			sep = ",\n" + string(indent)
+		}
+		out = splice(data, end, end, fmt.Sprintf(`%s"sha256": %q`, sep, sum))
+	default:
+		return false, fmt.Errorf("formula %q has no source url", name)
+	}
+	if pinned, err := decodeFormula(file, out); err != nil || pinned.Source.SHA256 != sum {
+		return false, fmt.Errorf("formula %q: could not rewrite the source sha256 in place", name)
+	}
+
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, out, 0o644); err != nil {
+		return false, fmt.Errorf("write formula %q: %w", name, err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		_ = os.Remove(tmp)
+		return false, fmt.Errorf("write formula %q: %w", name, err)
+	}
+	return true, nil
+}
+
+func splice(data []byte, start, end int64, insert string) []byte {
+	out := make([]byte, 0, len(data)+len(insert))
+	out = append(out, data[:start]...)
+	out = append(out, insert...)
+	return append(out, data[end:]...)
+}
@@ -0,0 +1,272 @@
+package formula
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// FieldError is a formula that does not match the schema. Field is a JSON
+// path such as "deps" or "patches[1].sha256"; Line and Column are zero when
+// the position is unknown.
+type FieldError struct {
+	Formula  string
+	File     string
+	Line     int
+	Column   int
+	Field    string
+	Problem  string
+	Expected string
+}
+
+func (e *FieldError) Error() string {
+	var b strings.Builder
+	switch {
+	case e.File != "" && e.Line > 0:
+		fmt.Fprintf(&b, "%s:%d:%d: ", e.File, e.Line, e.Column)
+	case e.File != "":
+		b.WriteString(e.File + ": ")
+	default:
+		fmt.Fprintf(&b, "formula %q: ", e.Formula)
+	}
+	if e.Field != "" {
+		b.WriteString(e.Field + ": ")
+	}
+	b.WriteString(e.Problem)
+	if e.Expected != "" {
+		b.WriteString(" (want " + e.Expected + ")")
+	}
+	if example, ok := fieldExamples[schemaPath(e.Field)]; ok && example != "" {
+		b.WriteString("\n  example: " + example)
+	}
+	return b.String()
+}
+
+// fieldExamples lists every field a formula file may contain, keyed by its
+// path without array indexes, with a snippet to show next to errors.
+var fieldExamples = map[string]string{
+	"name":            `"name": "hello"`,
+	"version":         `"version": "1.0.0"`,
+	"deps":            `"deps": ["libfoo"]`,
+	"source":          `"source": {"url": "https://example.com/hello-1.0.0.tar.gz", "sha256": "<64 hex digits>"}`,
+	"source.url":      `"url": "https://example.com/hello-1.0.0.tar.gz"`,
+	"source.sha256":   `"sha256": "<64 hex digits>"`,
+	"source.branch":   `"branch": "main"`,
+	"source.tag":      `"tag": "v1.0.0"`,
+	"source.revision": `"revision": "<commit id>"`,
+	"patches":         `"patches": [{"url": "https://example.com/fix.patch", "sha256": "<64 hex digits>"}]`,
+	"patches.url":     `"url": "https://example.com/fix.patch"`,
+	"patches.sha256":  `"sha256": "<64 hex digits>"`,
+	"patches.data":    `"data": "--- a/Makefile\n+++ b/Makefile\n..."`,
+	"patches.strip":   `"strip": 1`,
+	"build":           `"build": {"steps": ["make install"]}`,
+	"build.steps":     `"steps": ["./configure --prefix=\"$PREFIX\"", "make install"]`,
+	"build.outputs":   `"outputs": ["bin/hello"]`,
+}
+
+var indexPattern = regexp.MustCompile(`\[\d+\]`)
+
+func schemaPath(field string) string {
+	return indexPattern.ReplaceAllString(field, "")
+}
+
+// decodeFormula parses a formula file strictly: unknown keys are errors, and
+// every error names the field and its position in file.
+func decodeFormula(file string, data []byte) (Formula, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var f Formula
+	err := dec.Decode(&f)
+	if err == nil {
+		return f, nil
+	}
+	fe := &FieldError{File: file, Problem: err.Error()}
+	keys := keyPositions(data)
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		// Offset counts the bytes read, including the offending one.
+		fe.Line, fe.Column = lineColumn(data, max(syntaxErr.Offset-1, 0))
+		fe.Problem = "invalid JSON: " + strings.TrimPrefix(syntaxErr.Error(), "json: ")
+	case errors.As(err, &typeErr):
+		fe.Field = typeErr.Field
+		for _, k := range keys {
+			if schemaPath(k.path) == typeErr.Field {
+				fe.Field = k.path
+				fe.Line, fe.Column = lineColumn(data, k.offset)
+				break
+			}
+		}
+		fe.Problem = "got a JSON " + typeErr.Value
+		fe.Expected = describeType(typeErr.Type)
+	case strings.HasPrefix(err.Error(), `json: unknown field "`):
+		name := strings.TrimSuffix(strings.TrimPrefix(err.Error(), `json: unknown field "`), `"`)
+		fe.Problem = "is not a formula field"
+		for _, k := range keys {
+			if _, known := fieldExamples[schemaPath(k.path)]; !known && lastSegment(k.path) == name {
+				fe.Field = k.path
+				fe.Line, fe.Column = lineColumn(data, k.offset)
+				if guess := closestField(k.path); guess != "" {
+					fe.Problem += fmt.Sprintf(`; did you mean "%s"?`, guess)
+				}
+				break
+			}
+		}
+		if fe.Field == "" {
+			fe.Field = name
+		}
+	}
+	return Formula{}, fe
+}
+
+// locate fills in the file position of a FieldError from Validate.
+func locate(err error, file string, data []byte) error {
+	var fe *FieldError
+	if !errors.As(err, &fe) {
+		return err
+	}
+	fe.File = file
+	for _, k := range keyPositions(data) {
+		if k.path == fe.Field {
+			fe.Line, fe.Column = lineColumn(data, k.offset)
+			break
+		}
+	}
+	return err
+}
+
+func describeType(t reflect.Type) string {
+	if t == nil {
+		return ""
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Int, reflect.Int64, reflect.Pointer:
+		return "a number"
+	case reflect.Struct, reflect.Map:
+		return "an object"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.String {
+			return "a list of strings"
+		}
+		return "a list of objects"
+	}
+	return t.String()
+}
+
+type keyPosition struct {
+	path   string
+	offset int64
+}
+
+// keyPositions lists every object key in data with its JSON path and the
+// offset of its opening quote, plus the opening bracket of objects and
+// arrays inside arrays. It stops quietly at the first syntax error.
+func keyPositions(data []byte) []keyPosition {
+	var out []keyPosition
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var walk func(path string) error
+	walk = func(path string) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if _, ok := tok.(json.Delim); ok && strings.HasSuffix(path, "]") {
+			out = append(out, keyPosition{path: path, offset: dec.InputOffset() - 1})
+		}
+		switch tok {
+		case json.Delim('{'):
+			for dec.More() {
+				tok, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				key, _ := tok.(string)
+				child := key
+				if path != "" {
+					child = path + "." + key
+				}
+				out = append(out, keyPosition{path: child, offset: dec.InputOffset() - int64(len(key)) - 2})
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				if err := walk(fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		}
+		return err
+	}
+	_ = walk("")
+	return out
+}
+
+func lineColumn(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	return line, len(before) - bytes.LastIndexByte(before, '\n')
+}
+
+func lastSegment(path string) string {
+	return path[strings.LastIndex(path, ".")+1:]
+}
+
+// closestField suggests the known field next to path whose name is within
+// two edits of path's last segment.
+func closestField(path string) string {
+	parent := ""
+	if idx := strings.LastIndex(path, "."); idx >= 0 {
+		parent = schemaPath(path[:idx]) + "."
+	}
+	name := lastSegment(path)
+	candidates := make([]string, 0, len(fieldExamples))
+	for field := range fieldExamples {
+		if strings.HasPrefix(field, parent) && !strings.Contains(field[len(parent):], ".") {
+			candidates = append(candidates, field[len(parent):])
+		}
+	}
+	sort.Strings(candidates)
+	best, bestDist := "", 3
+	for _, candidate := range candidates {
+		if d := editDistance(name, candidate); d < bestDist {
+			best, bestDist = candidate, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,265 @@
+package formula
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"ub/internal/pipeline"
+)
+
+// IndexFile lists the formulae of a tap so they can be enumerated without
+// walking its directories.
+const IndexFile = ".index.json"
+
+// Taps is a list of tap directories searched in order: when two taps hold a
+// formula of the same name, the earlier one wins. Formula names map to
+// paths inside a tap, so tools/ripgrep is <tap>/tools/ripgrep.json.
+type Taps []string
+
+// ValidName checks that name is a formula name that stays inside its tap:
+// slash-separated segments without empty, "." or ".." parts.
+func ValidName(name string) error {
+	if name == "" {
+		return fmt.Errorf("is empty")
+	}
+	if strings.Contains(name, `\`) {
+		return fmt.Errorf("%q contains a backslash", name)
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "" || segment == "." || segment == ".." || strings.HasPrefix(segment, ".") {
+			return fmt.Errorf("%q is not a valid formula name", name)
+		}
+	}
+	return nil
+}
+
+func formulaFile(tapDir, name string) string {
+	return filepath.Join(tapDir, filepath.FromSlash(name)+".json")
+}
+
+// Find returns the first tap that holds name.
+func (t Taps) Find(name string) (string, error) {
+	if err := ValidName(name); err != nil {
+		return "", fmt.Errorf("formula name %w", err)
+	}
+	for _, dir := range t {
+		if info, err := os.Stat(formulaFile(dir, name)); err == nil && info.Mode().IsRegular() {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("read formula %q: not found in %s: %w", name, strings.Join(t, ", "), fs.ErrNotExist)
+}
+
+func (t Taps) Load(name string) (Formula, error) {
+	dir, err := t.Find(name)
+	if err != nil {
+		return Formula{}, err
+	}
+	file := formulaFile(dir, name)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return Formula{}, fmt.Errorf("read formula %q: %w", name, err)
+	}
+
+	f, err := decodeFormula(file, data)
+	if err != nil {
+		return Formula{}, err
+	}
+	if f.Name == "" {
+		f.Name = name
+	}
+	if err := f.Validate(); err != nil {
+		return Formula{}, locate(err, file, data)
+	}
+	return f, nil
+}
+
+// Digest returns the sha256 of the formula file that Load would read.
+func (t Taps) Digest(name string) (string, error) {
+	dir, err := t.Find(name)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(formulaFile(dir, name))
+	if err != nil {
+		return "", fmt.Errorf("read formula %q: %w", name, err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (t Taps) ResolveClosure(roots []string) (map[string]Formula, error) {
+	seen := map[string]Formula{}
+	lookup := func(_ context.Context, name string) (pipeline.Package, error) {
+		f, err := t.Load(name)
+		if err != nil {
+			return pipeline.Package{}, err
+		}
+		sort.Strings(f.Deps)
+		for _, dep := range f.Deps {
+			if dep == f.Name {
+				return pipeline.Package{}, fmt.Errorf("formula %q cannot depend on itself", f.Name)
+			}
+		}
+		seen[name] = f
+		return pipeline.Package{Name: name, Version: f.Version, Deps: f.Deps}, nil
+	}
+	if _, err := pipeline.Resolve(context.Background(), roots, lookup, pipeline.PlanOptions{}); err != nil {
+		return nil, err
+	}
+	return seen, nil
+}
+
+// Names lists every formula across the taps once, sorted.
+func (t Taps) Names() ([]string, error) {
+	seen := map[string]bool{}
+	var names []string
+	for _, dir := range t {
+		list, err := tapNames(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range list {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+type tapIndex struct {
+	Formulas []indexEntry `json:"formulas"`
+}
+
+type indexEntry struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// tapNames reads the tap's index when it has one and walks it otherwise.
+// Hidden files and directories are skipped, so .git and the index itself
+// never look like formulae.
+func tapNames(dir string) ([]string, error) {
+	if data, err := os.ReadFile(filepath.Join(dir, IndexFile)); err == nil {
+		var index tapIndex
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, fmt.Errorf("parse tap index %s: %w", filepath.Join(dir, IndexFile), err)
+		}
+		names := make([]string, 0, len(index.Formulas))
+		for _, entry := range index.Formulas {
+			names = append(names, entry.Name)
+		}
+		return names, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("read tap index: %w", err)
+	}
+	return walkTap(dir)
+}
+
+// walkTap lists the formulae in the tap's directories, ignoring its index.
+func walkTap(dir string) ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, strings.TrimSuffix(filepath.ToSlash(rel), ".json"))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read tap %q: %w", dir, err)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// WriteIndex walks tapDir and records every formula it finds in IndexFile,
+// replacing any previous index. Formulae that fail to load are reported
+// rather than indexed: the index lists the rest, and the error names each
+// failure.
+func WriteIndex(tapDir string) (int, error) {
+	names, err := walkTap(tapDir)
+	if err != nil {
+		return 0, err
+	}
+	index := tapIndex{Formulas: make([]indexEntry, 0, len(names))}
+	var failures []error
+	for _, name := range names {
+		f, err := Taps{tapDir}.Load(name)
+		if err != nil {
+			failures = append(failures, err)
+			continue
+		}
+		index.Formulas = append(index.Formulas, indexEntry{Name: name, Version: f.Version})
+	}
+	if err := writeIndex(tapDir, index); err != nil {
+		return 0, err
+	}
+	return len(index.Formulas), errors.Join(failures...)
+}
+
+// addToIndex records name in the tap's index, if the tap has one.
+func addToIndex(tapDir string, f Formula) error {
+	data, err := os.ReadFile(filepath.Join(tapDir, IndexFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read tap index: %w", err)
+	}
+	var index tapIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return fmt.Errorf("parse tap index %s: %w", filepath.Join(tapDir, IndexFile), err)
+	}
+	entries := index.Formulas[:0]
+	for _, entry := range index.Formulas {
+		if entry.Name != f.Name {
+			entries = append(entries, entry)
+		}
+	}
+	index.Formulas = append(entries, indexEntry{Name: f.Name, Version: f.Version})
+	sort.Slice(index.Formulas, func(i, j int) bool { return index.Formulas[i].Name < index.Formulas[j].Name })
+	return writeIndex(tapDir, index)
+}
+
+func writeIndex(tapDir string, index tapIndex) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal tap index: %w", err)
+	}
+	path := filepath.Join(tapDir, IndexFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write tap index: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("write tap index: %w", err)
+	}
+	return nil
+}
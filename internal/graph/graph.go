@@ -1,15 +1,27 @@
 package graph
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"reflect"
 	"sort"
 
 	"ub/internal/formula"
+	"ub/internal/scheduler"
 )
 
 type Plan struct {
 	Order  []string
 	Layers [][]string
+	// CriticalPath is the longest dependency chain, dependencies first. No
+	// number of workers installs the plan in fewer steps than its length.
+	CriticalPath []string
+	// MaxWidth is the largest layer: more workers than this never help.
+	MaxWidth int
+
+	dependents map[string][]string
+	requires   map[string][]string
 }
 
 func BuildPlan(formulas map[string]formula.Formula) (Plan, error) {
@@ -70,5 +82,174 @@ func BuildPlan(formulas map[string]formula.Formula) (Plan, error) {
 		return Plan{}, fmt.Errorf("dependency graph contains a cycle")
 	}
 
-	return Plan{Order: order, Layers: layers}, nil
+	plan := Plan{Order: order, Layers: layers, dependents: dependents, requires: map[string][]string{}}
+	for name, f := range formulas {
+		plan.requires[name] = f.Deps
+	}
+	for _, layer := range layers {
+		plan.MaxWidth = max(plan.MaxWidth, len(layer))
+	}
+	heights := plan.heights()
+	var next []string
+	if len(layers) > 0 {
+		next = layers[0]
+	}
+	for len(next) > 0 {
+		best := next[0]
+		for _, name := range next[1:] {
+			if heights[name] > heights[best] || (heights[name] == heights[best] && name < best) {
+				best = name
+			}
+		}
+		plan.CriticalPath = append(plan.CriticalPath, best)
+		next = dependents[best]
+	}
+	return plan, nil
+}
+
+// heights is the length of the longest chain from each formula to one that
+// nothing depends on, counting both ends.
+func (p Plan) heights() map[string]int {
+	heights := make(map[string]int, len(p.Order))
+	for i := len(p.Order) - 1; i >= 0; i-- {
+		name := p.Order[i]
+		heights[name] = 1
+		for _, dependent := range p.dependents[name] {
+			heights[name] = max(heights[name], heights[dependent]+1)
+		}
+	}
+	return heights
+}
+
+// Steps estimates how many rounds workers need for the plan when every
+// formula takes the same time. Like the scheduler, each round starts the
+// runnable formulas with the longest chains behind them first.
+func (p Plan) Steps(workers int) int {
+	if workers < 1 {
+		workers = 1
+	}
+	heights := p.heights()
+	waiting := make(map[string]int, len(p.requires))
+	for name, deps := range p.requires {
+		waiting[name] = len(deps)
+	}
+	var ready []string
+	for _, name := range p.Order {
+		if waiting[name] == 0 {
+			ready = append(ready, name)
+		}
+	}
+	steps := 0
+	for len(ready) > 0 {
+		sort.Slice(ready, func(i, j int) bool {
+			if heights[ready[i]] != heights[ready[j]] {
+				return heights[ready[i]] > heights[ready[j]]
+			}
+			return ready[i] < ready[j]
+		})
+		n := min(workers, len(ready))
+		running := ready[:n]
+		ready = append([]string(nil), ready[n:]...)
+		for _, name := range running {
+			for _, dependent := range p.dependents[name] {
+				if waiting[dependent]--; waiting[dependent] == 0 {
+					ready = append(ready, dependent)
+				}
+			}
+		}
+		steps++
+	}
+	return steps
+}
+
+// Speedup estimates how much faster workers install the plan than one
+// worker would, assuming every formula takes the same time.
+func (p Plan) Speedup(workers int) float64 {
+	steps := p.Steps(workers)
+	if steps == 0 {
+		return 1
+	}
+	return float64(len(p.Order)) / float64(steps)
+}
+
+// Graph returns the plan's dependency graph for scheduling, so callers turn
+// a plan into jobs with Graph().Jobs instead of building their own.
+func (p Plan) Graph() scheduler.Graph {
+	g := make(scheduler.Graph, len(p.requires))
+	for name, deps := range p.requires {
+		g[name] = append([]string(nil), deps...)
+	}
+	return g
+}
+
+// File is a reviewed plan written by mvp-plan. mvp-install executes the
+// formulas it embeds instead of resolving again, after checking that the taps
+// still hold the formula files the plan was made from.
+type File struct {
+	Roots    []string                   `json:"roots"`
+	Taps     formula.Taps               `json:"taps"`
+	Formulas map[string]formula.Formula `json:"formulas"`
+	Layers   [][]string                 `json:"layers"`
+	// Digests maps each formula to the sha256 of the file Taps resolves it to.
+	Digests map[string]string `json:"digests"`
+}
+
+func NewFile(taps formula.Taps, roots []string, formulas map[string]formula.Formula, plan Plan) (File, error) {
+	digests := make(map[string]string, len(formulas))
+	for name := range formulas {
+		digest, err := taps.Digest(name)
+		if err != nil {
+			return File{}, err
+		}
+		digests[name] = digest
+	}
+	return File{Roots: roots, Taps: taps, Formulas: formulas, Layers: plan.Layers, Digests: digests}, nil
+}
+
+func (f File) Write(path string) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal plan: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write plan: %w", err)
+	}
+	return nil
+}
+
+// ReadFile loads a plan file and checks it against its taps, or against
+// taps instead when given: every formula must still resolve to an unchanged
+// file, and the layers must follow from the formulas.
+func ReadFile(path string, taps formula.Taps) (File, Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return File{}, Plan{}, fmt.Errorf("read plan: %w", err)
+	}
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		return File{}, Plan{}, fmt.Errorf("parse plan %s: %w", path, err)
+	}
+	if len(f.Formulas) == 0 {
+		return File{}, Plan{}, fmt.Errorf("plan %s has no formulas", path)
+	}
+	if len(taps) > 0 {
+		f.Taps = taps
+	}
+	for name := range f.Formulas {
+		digest, err := f.Taps.Digest(name)
+		if err != nil {
+			return File{}, Plan{}, err
+		}
+		if digest != f.Digests[name] {
+			return File{}, Plan{}, fmt.Errorf("formula %q changed since the plan was written; run mvp-plan again", name)
+		}
+	}
+	plan, err := BuildPlan(f.Formulas)
+	if err != nil {
+		return File{}, Plan{}, err
+	}
+	if !reflect.DeepEqual(plan.Layers, f.Layers) {
+		return File{}, Plan{}, fmt.Errorf("plan %s layers do not match its formulas", path)
+	}
+	return f, plan, nil
 }
@@ -1,6 +1,9 @@
 package graph
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"ub/internal/formula"
@@ -26,6 +29,9 @@ func TestBuildPlanLayers(t *testing.T) {
 	if plan.Layers[0][0] != "a" {
 		t.Fatalf("expected first layer to contain a, got %v", plan.Layers[0])
 	}
+	if g := plan.Graph(); len(g) != 4 || strings.Join(g["d"], ",") != "b,c" || g.Check() != nil {
+		t.Fatalf("unexpected scheduler graph: %v", g)
+	}
 }
 
 func TestBuildPlanCycle(t *testing.T) {
@@ -38,3 +44,80 @@ func TestBuildPlanCycle(t *testing.T) {
 		t.Fatal("expected cycle detection error")
 	}
 }
+
+func TestPlanFileRejectsChangedFormulas(t *testing.T) {
+	tap := t.TempDir()
+	write := func(name, body string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(tap, name+".json"), []byte(body), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	write("a", `{"name": "a", "version": "1.0.0"}`)
+	write("b", `{"name": "b", "version": "1.0.0", "deps": ["a"]}`)
+	formulas, err := formula.ResolveClosure(tap, []string{"b"})
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	plan, err := BuildPlan(formulas)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	file, err := NewFile(formula.Taps{tap}, []string{"b"}, formulas, plan)
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "plan.json")
+	if err := file.Write(path); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	got, gotPlan, err := ReadFile(path, nil)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if len(got.Formulas) != 2 || len(gotPlan.Layers) != 2 {
+		t.Fatalf("plan = %+v, layers %v", got, gotPlan.Layers)
+	}
+
+	// Taps given by the caller win over the ones the plan was written with.
+	other := t.TempDir()
+	if _, _, err := ReadFile(path, formula.Taps{other}); err == nil {
+		t.Fatal("expected the plan to be checked against the given taps")
+	}
+
+	write("a", `{"name": "a", "version": "1.0.1"}`)
+	if _, _, err := ReadFile(path, nil); err == nil || !strings.Contains(err.Error(), `formula "a" changed`) {
+		t.Fatalf("expected changed formula error, got %v", err)
+	}
+}
+
+func TestPlanEstimatesParallelism(t *testing.T) {
+	formulas := map[string]formula.Formula{
+		"a": {Name: "a", Version: "1.0.0"},
+		"b": {Name: "b", Version: "1.0.0", Deps: []string{"a"}},
+		"c": {Name: "c", Version: "1.0.0", Deps: []string{"b"}},
+		"x": {Name: "x", Version: "1.0.0"},
+		"y": {Name: "y", Version: "1.0.0"},
+		"z": {Name: "z", Version: "1.0.0"},
+	}
+	plan, err := BuildPlan(formulas)
+	if err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	if got := strings.Join(plan.CriticalPath, " "); got != "a b c" {
+		t.Fatalf("critical path = %s", got)
+	}
+	if plan.MaxWidth != 4 {
+		t.Fatalf("max width = %d, want 4", plan.MaxWidth)
+	}
+	// Starting the chain first lets two workers finish in three rounds.
+	for workers, want := range map[int]int{1: 6, 2: 3, 4: 3, 16: 3} {
+		if got := plan.Steps(workers); got != want {
+			t.Fatalf("Steps(%d) = %d, want %d", workers, got, want)
+		}
+	}
+	if got := plan.Speedup(2); got != 2 {
+		t.Fatalf("Speedup(2) = %v, want 2", got)
+	}
+}
@@ -0,0 +1,88 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+type Change struct {
+	Name   string `json:"name"`
+	Cask   bool   `json:"cask,omitempty"`
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+type Entry struct {
+	Time       time.Time `json:"time"`
+	Command    string    `json:"command"`
+	Args       []string  `json:"args,omitempty"`
+	Changes    []Change  `json:"changes,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Touches reports whether the entry changed the named package.
+func (e Entry) Touches(name string) bool {
+	for _, c := range e.Changes {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Path is where older versions of ub kept the history log, before the
+// state store took it in.
+func Path(prefix string) string {
+	return filepath.Join(prefix, "var", "ub", "history.jsonl")
+}
+
+// Load returns every entry in the log at path, which holds one JSON entry
+// per line, oldest first. Lines that fail to parse are skipped.
+func Load(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read history: %w", err)
+	}
+	defer f.Close()
+	var out []Entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var entry Entry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			out = append(out, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read history: %w", err)
+	}
+	return out, nil
+}
+
+// Diff lists packages whose version differs between two name->version
+// snapshots. An empty Before means installed; an empty After means removed.
+func Diff(before, after map[string]string, cask bool) []Change {
+	var out []Change
+	for name, prev := range before {
+		if next := after[name]; next != prev {
+			out = append(out, Change{Name: name, Cask: cask, Before: prev, After: next})
+		}
+	}
+	for name, next := range after {
+		if _, ok := before[name]; !ok {
+			out = append(out, Change{Name: name, Cask: cask, After: next})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
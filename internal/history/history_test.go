@@ -0,0 +1,65 @@
+package history
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	path := Path(t.TempDir())
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	first := Entry{Time: time.Unix(1, 0).UTC(), Command: "install", Args: []string{"jq"}, Changes: []Change{{Name: "jq", After: "1.7"}}, Success: true}
+	second := Entry{Time: time.Unix(2, 0).UTC(), Command: "upgrade", Changes: []Change{{Name: "jq", Before: "1.7", After: "1.8"}}, Success: true}
+	var log []byte
+	for _, entry := range []Entry{first, second} {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		log = append(append(log, data...), '\n')
+	}
+	log = append(log, "{truncated\n"...)
+	if err := os.WriteFile(path, log, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(entries) != 2 || entries[1].Command != "upgrade" || entries[1].Changes[0].Before != "1.7" {
+		t.Fatalf("entries = %+v", entries)
+	}
+	if !entries[0].Touches("jq") || entries[0].Touches("wget") {
+		t.Fatalf("Touches mismatch for %+v", entries[0])
+	}
+
+	missing, err := Load(filepath.Join(t.TempDir(), "none.jsonl"))
+	if err != nil || missing != nil {
+		t.Fatalf("missing history = %v, %v", missing, err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	before := map[string]string{"ffmpeg": "7.1", "lame": "3.100", "x264": "r3108"}
+	after := map[string]string{"ffmpeg": "8.0.1", "lame": "3.100", "opus": "1.5.2"}
+	changes := Diff(before, after, false)
+	want := []Change{
+		{Name: "ffmpeg", Before: "7.1", After: "8.0.1"},
+		{Name: "opus", After: "1.5.2"},
+		{Name: "x264", Before: "r3108"},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("changes = %+v, want %+v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Fatalf("changes[%d] = %+v, want %+v", i, changes[i], want[i])
+		}
+	}
+}
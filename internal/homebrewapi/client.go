@@ -1,32 +1,104 @@
 package homebrewapi
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
+	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"ub/internal/fetch"
+	"ub/internal/messages"
+	"ub/internal/stats"
 )
 
 const (
-	baseURL         = "https://formulae.brew.sh/api"
+	defaultBaseURL  = "https://formulae.brew.sh/api"
 	formulaListPath = "/formula.json"
 )
 
 type Client struct {
-	fetcher *fetch.Cache
-	repoDir string
-	repoMu  sync.Mutex
+	fetcher    *fetch.Cache
+	baseURL    string
+	repoDir    string
+	repoMu     sync.Mutex
 	repoSynced bool
+	// Quiet suppresses the status lines printed while syncing, for
+	// commands whose stdout is machine-readable.
+	Quiet bool
+
+	indexMu   sync.Mutex
+	indexes   map[string]map[string]json.RawMessage
+	staleOnce sync.Once
 }
 
 func New(cacheDir, repoDir string) *Client {
-	return &Client{fetcher: fetch.NewCache(filepath.Join(cacheDir, "api")), repoDir: repoDir}
+	fetcher := fetch.NewCache(filepath.Join(cacheDir, "api"))
+	fetcher.Validate = validateFile
+	fetcher.StallTimeout = fetch.MetadataStallTimeout
+	return &Client{fetcher: fetcher, baseURL: BaseURL(), repoDir: repoDir}
+}
+
+// BaseURL is the API root: UB_API_DOMAIN when set, formulae.brew.sh otherwise.
+// A bare directory path is read as a file:// mirror. UB_API_FIXTURES names a
+// fixture directory that wins over both, so tests never reach the network.
+func BaseURL() string {
+	domain := strings.TrimSpace(os.Getenv("UB_API_FIXTURES"))
+	if domain == "" {
+		domain = strings.TrimSpace(os.Getenv("UB_API_DOMAIN"))
+	}
+	if domain == "" {
+		return defaultBaseURL
+	}
+	if filepath.IsAbs(domain) {
+		domain = (&url.URL{Scheme: "file", Path: filepath.ToSlash(domain)}).String()
+	}
+	return strings.TrimRight(domain, "/")
+}
+
+func (c *Client) SetStats(recorder *stats.Recorder) {
+	c.fetcher.Stats = recorder
+}
+
+// SetCompress stores API documents in the download cache gzipped.
+func (c *Client) SetCompress(compress bool) {
+	c.fetcher.Compress = compress
+}
+
+// Cache is the download cache API documents are kept in.
+func (c *Client) Cache() *fetch.Cache {
+	return c.fetcher
+}
+
+// DocumentURLs lists the URLs of the indexes and of the documents for the
+// named formulae and casks: what installing them offline reads.
+func (c *Client) DocumentURLs(formulae, casks []string) []string {
+	urls := []string{c.baseURL + "/formula.jws.json", c.baseURL + "/cask.jws.json", c.baseURL + formulaListPath}
+	for _, name := range formulae {
+		urls = append(urls, c.documentURL("formula", name))
+	}
+	for _, token := range casks {
+		urls = append(urls, c.documentURL("cask", token))
+	}
+	return urls
+}
+
+// Probe checks that the API answers within timeout. A file:// mirror has no
+// network to check.
+func (c *Client) Probe(ctx context.Context, timeout time.Duration) error {
+	if strings.HasPrefix(c.baseURL, "file:") {
+		return nil
+	}
+	return c.fetcher.Probe(ctx, c.baseURL+"/formula.jws.json", timeout)
 }
 
 type FormulaSummary struct {
@@ -46,9 +118,30 @@ type Formula struct {
 	Desc         string   `json:"desc"`
 	Homepage     string   `json:"homepage"`
 	Dependencies []string `json:"dependencies"`
-	Versions     struct {
+	// BuildDependencies are only needed when building from source (--HEAD).
+	BuildDependencies []string `json:"build_dependencies"`
+	// UsesFromMacOS are dependencies macOS already provides. Each is a name,
+	// or an object mapping a name to "build", "test" or a list of them.
+	UsesFromMacOS []json.RawMessage `json:"uses_from_macos"`
+	Versions      struct {
 		Stable string `json:"stable"`
+		Head   string `json:"head"`
 	} `json:"versions"`
+	// Revision counts rebuilds of the same stable version; bottles are
+	// tagged <stable>_<revision> when it is not zero.
+	Revision int `json:"revision"`
+	URLs     struct {
+		// Stable is where the current version's source comes from.
+		Stable struct {
+			URL string `json:"url"`
+			Tag string `json:"tag"`
+		} `json:"stable"`
+		Head struct {
+			URL    string `json:"url"`
+			Branch string `json:"branch"`
+			Using  string `json:"using"`
+		} `json:"head"`
+	} `json:"urls"`
 	Bottle struct {
 		Stable struct {
 			Files map[string]BottleFile `json:"files"`
@@ -56,25 +149,112 @@ type Formula struct {
 	} `json:"bottle"`
 }
 
+// macOSProvidesDependencies is whether the system has what uses_from_macos
+// names. Everywhere else brew installs those like any other dependency.
+var macOSProvidesDependencies = runtime.GOOS == "darwin"
+
+// MacOSDependencies splits UsesFromMacOS into what the formula needs when it
+// runs and what only building it needs. Test-only entries are left out.
+func (f Formula) MacOSDependencies() (needed, build []string) {
+	for _, raw := range f.UsesFromMacOS {
+		var name string
+		if err := json.Unmarshal(raw, &name); err == nil {
+			needed = append(needed, name)
+			continue
+		}
+		var tagged map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &tagged); err != nil {
+			continue
+		}
+		for _, name := range slices.Sorted(maps.Keys(tagged)) {
+			rawTags := tagged[name]
+			var tags []string
+			var one string
+			if err := json.Unmarshal(rawTags, &one); err == nil {
+				tags = []string{one}
+			} else if err := json.Unmarshal(rawTags, &tags); err != nil {
+				continue
+			}
+			switch {
+			case slices.Contains(tags, "build"):
+				build = append(build, name)
+			case slices.Contains(tags, "test"):
+			default:
+				needed = append(needed, name)
+			}
+		}
+	}
+	return needed, build
+}
+
+// addMacOSDependencies adds UsesFromMacOS to Dependencies and
+// BuildDependencies, as brew does off macOS.
+func (f *Formula) addMacOSDependencies() {
+	needed, build := f.MacOSDependencies()
+	for _, name := range needed {
+		if !slices.Contains(f.Dependencies, name) {
+			f.Dependencies = append(f.Dependencies, name)
+		}
+	}
+	for _, name := range build {
+		if !slices.Contains(f.BuildDependencies, name) && !slices.Contains(f.Dependencies, name) {
+			f.BuildDependencies = append(f.BuildDependencies, name)
+		}
+	}
+}
+
 type CaskBinaryArtifact struct {
 	Source string
 	Target string
 }
 
 type Cask struct {
-	Token     string                       `json:"token"`
-	Name      []string                     `json:"name"`
-	Desc      string                       `json:"desc"`
-	Homepage  string                       `json:"homepage"`
-	URL       string                       `json:"url"`
-	Version   string                       `json:"version"`
-	SHA256    string                       `json:"sha256"`
-	Artifacts []map[string]json.RawMessage `json:"artifacts"`
+	Token       string                       `json:"token"`
+	Name        []string                     `json:"name"`
+	Desc        string                       `json:"desc"`
+	Homepage    string                       `json:"homepage"`
+	URL         string                       `json:"url"`
+	Version     string                       `json:"version"`
+	SHA256      string                       `json:"sha256"`
+	AutoUpdates bool                         `json:"auto_updates"`
+	Artifacts   []map[string]json.RawMessage `json:"artifacts"`
+}
+
+// CaskAppArtifact is one app stanza. Target, when set, renames the bundle
+// in the Applications directory.
+type CaskAppArtifact struct {
+	Source string
+	Target string
 }
 
 func (c Cask) AppArtifact() string {
+	apps := c.AppArtifacts()
+	if len(apps) == 0 {
+		return ""
+	}
+	return apps[0].Source
+}
+
+// AppArtifacts returns every app stanza in declaration order; suites ship
+// several bundles.
+func (c Cask) AppArtifacts() []CaskAppArtifact {
+	return c.stanzas("app")
+}
+
+// FontArtifacts returns the font files, relative to the extracted archive,
+// that font-* casks install.
+func (c Cask) FontArtifacts() []string {
+	out := make([]string, 0)
+	for _, font := range c.stanzas("font") {
+		out = append(out, font.Source)
+	}
+	return out
+}
+
+func (c Cask) stanzas(kind string) []CaskAppArtifact {
+	out := make([]CaskAppArtifact, 0)
 	for _, artifact := range c.Artifacts {
-		raw, ok := artifact["app"]
+		raw, ok := artifact[kind]
 		if !ok {
 			continue
 		}
@@ -83,14 +263,21 @@ func (c Cask) AppArtifact() string {
 			continue
 		}
 		var app string
-		if err := json.Unmarshal(payload[0], &app); err != nil {
+		if err := json.Unmarshal(payload[0], &app); err != nil || strings.TrimSpace(app) == "" {
 			continue
 		}
-		if strings.TrimSpace(app) != "" {
-			return app
+		entry := CaskAppArtifact{Source: app}
+		if len(payload) > 1 {
+			var opts struct {
+				Target string `json:"target"`
+			}
+			if err := json.Unmarshal(payload[1], &opts); err == nil {
+				entry.Target = strings.TrimSpace(opts.Target)
+			}
 		}
+		out = append(out, entry)
 	}
-	return ""
+	return out
 }
 
 func (c Cask) BinaryArtifacts() []CaskBinaryArtifact {
@@ -122,19 +309,55 @@ func (c Cask) BinaryArtifacts() []CaskBinaryArtifact {
 	return out
 }
 
+// QuitBundleIDs returns the bundle identifiers named by the cask's
+// uninstall quit stanza.
+func (c Cask) QuitBundleIDs() []string {
+	var out []string
+	for _, artifact := range c.Artifacts {
+		raw, ok := artifact["uninstall"]
+		if !ok {
+			continue
+		}
+		var payload []map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &payload); err != nil {
+			continue
+		}
+		for _, directives := range payload {
+			quit, ok := directives["quit"]
+			if !ok {
+				continue
+			}
+			var one string
+			if err := json.Unmarshal(quit, &one); err == nil {
+				if strings.TrimSpace(one) != "" {
+					out = append(out, strings.TrimSpace(one))
+				}
+				continue
+			}
+			var many []string
+			if err := json.Unmarshal(quit, &many); err == nil {
+				for _, id := range many {
+					if strings.TrimSpace(id) != "" {
+						out = append(out, strings.TrimSpace(id))
+					}
+				}
+			}
+		}
+	}
+	return out
+}
+
 func (c *Client) FormulaList(ctx context.Context) ([]FormulaSummary, error) {
 	if err := c.ensureLocalRepository(ctx); err != nil {
 		return nil, err
 	}
-	url := baseURL + formulaListPath
-	file, err := c.fetcher.Fetch(ctx, url)
+	data, err := c.fetchDocument(ctx, c.baseURL+formulaListPath)
 	if err != nil {
+		if list, staleErr := c.staleFormulaList(); staleErr == nil && c.Degrade(err) {
+			return list, nil
+		}
 		return nil, err
 	}
-	data, err := os.ReadFile(file)
-	if err != nil {
-		return nil, fmt.Errorf("read formula list: %w", err)
-	}
 
 	var list []FormulaSummary
 	if err := json.Unmarshal(data, &list); err != nil {
@@ -144,24 +367,11 @@ func (c *Client) FormulaList(ctx context.Context) ([]FormulaSummary, error) {
 }
 
 func (c *Client) FormulaByName(ctx context.Context, name string) (Formula, error) {
-	if err := c.ensureLocalRepository(ctx); err != nil {
-		return Formula{}, err
-	}
-	name = strings.TrimSpace(name)
-	if name == "" {
-		return Formula{}, fmt.Errorf("formula name is required")
-	}
-	url := fmt.Sprintf("%s/formula/%s.json", baseURL, name)
-	file, err := c.fetcher.Fetch(ctx, url)
+	data, err := c.document(ctx, "formula", name)
 	if err != nil {
 		return Formula{}, err
 	}
 
-	data, err := os.ReadFile(file)
-	if err != nil {
-		return Formula{}, fmt.Errorf("read formula %q metadata: %w", name, err)
-	}
-
 	var f Formula
 	if err := json.Unmarshal(data, &f); err != nil {
 		return Formula{}, fmt.Errorf("parse formula %q metadata: %w", name, err)
@@ -169,26 +379,33 @@ func (c *Client) FormulaByName(ctx context.Context, name string) (Formula, error
 	if f.Name == "" {
 		return Formula{}, fmt.Errorf("formula %q metadata is missing name", name)
 	}
+	if !macOSProvidesDependencies {
+		f.addMacOSDependencies()
+	}
 	return f, nil
 }
 
-func (c *Client) CaskByName(ctx context.Context, name string) (Cask, error) {
-	if err := c.ensureLocalRepository(ctx); err != nil {
-		return Cask{}, err
-	}
-	name = strings.TrimSpace(name)
-	if name == "" {
-		return Cask{}, fmt.Errorf("cask name is required")
+// FormulaJSON returns a formula's API document with every field kept, in
+// the shape brew prints for `info --json`.
+func (c *Client) FormulaJSON(ctx context.Context, name string) (map[string]any, error) {
+	data, err := c.document(ctx, "formula", name)
+	if err != nil {
+		return nil, err
 	}
-	url := fmt.Sprintf("%s/cask/%s.json", baseURL, name)
-	file, err := c.fetcher.Fetch(ctx, url)
+	doc, err := decodeDocument(data)
 	if err != nil {
-		return Cask{}, err
+		return nil, fmt.Errorf("parse formula %q metadata: %w", name, err)
+	}
+	if doc["name"] == nil {
+		return nil, fmt.Errorf("formula %q metadata is missing name", name)
 	}
+	return doc, nil
+}
 
-	data, err := os.ReadFile(file)
+func (c *Client) CaskByName(ctx context.Context, name string) (Cask, error) {
+	data, err := c.document(ctx, "cask", name)
 	if err != nil {
-		return Cask{}, fmt.Errorf("read cask %q metadata: %w", name, err)
+		return Cask{}, err
 	}
 
 	var cask Cask
@@ -201,6 +418,53 @@ func (c *Client) CaskByName(ctx context.Context, name string) (Cask, error) {
 	return cask, nil
 }
 
+// CaskJSON is FormulaJSON for casks.
+func (c *Client) CaskJSON(ctx context.Context, name string) (map[string]any, error) {
+	data, err := c.document(ctx, "cask", name)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := decodeDocument(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse cask %q metadata: %w", name, err)
+	}
+	if doc["token"] == nil {
+		return nil, fmt.Errorf("cask %q metadata is missing token", name)
+	}
+	return doc, nil
+}
+
+// document fetches the API file for one formula or cask; kind is "formula"
+// or "cask".
+func (c *Client) document(ctx context.Context, kind, name string) ([]byte, error) {
+	name, err := CanonicalName(kind, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.ensureLocalRepository(ctx); err != nil {
+		return nil, err
+	}
+	data, err := c.fetchDocument(ctx, c.documentURL(kind, name))
+	if err != nil {
+		if doc, ok := c.indexEntry(kind, name); ok && c.Degrade(err) {
+			return doc, nil
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// decodeDocument keeps numbers as written so re-encoding changes nothing.
+func decodeDocument(data []byte) (map[string]any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc map[string]any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
 func (c *Client) ensureLocalRepository(ctx context.Context) error {
 	c.repoMu.Lock()
 	if c.repoSynced {
@@ -218,17 +482,24 @@ func (c *Client) ensureLocalRepository(ctx context.Context) error {
 
 	files := []string{"cask.jws.json", "formula.jws.json"}
 	for _, fileName := range files {
-		url := baseURL + "/" + fileName
+		url := c.baseURL + "/" + fileName
+		target := filepath.Join(c.repoDir, fileName)
 		source, err := c.fetcher.Fetch(ctx, url)
 		if err != nil {
+			if _, statErr := os.Stat(target); statErr == nil && c.Degrade(err) {
+				continue
+			}
 			return err
 		}
-		target := filepath.Join(c.repoDir, fileName)
 		if err := copyFile(source, target); err != nil {
 			return err
 		}
 		if info, err := os.Stat(source); err == nil {
-			fmt.Printf("✔︎ JSON API %-56s Downloaded %8s/%8s\n", fileName, formatSize(info.Size()), formatSize(info.Size()))
+			// The copy keeps the download time, which IndexAge reports.
+			_ = os.Chtimes(target, info.ModTime(), info.ModTime())
+			if size, ok := c.fetcher.CachedSize(url); ok && !c.Quiet {
+				messages.Println(messages.APIDownloaded, fileName, formatSize(size), formatSize(size))
+			}
 		}
 	}
 
@@ -239,7 +510,7 @@ func (c *Client) ensureLocalRepository(ctx context.Context) error {
 }
 
 func copyFile(source, target string) error {
-	in, err := os.Open(source)
+	in, err := fetch.Open(source)
 	if err != nil {
 		return fmt.Errorf("open source %q: %w", source, err)
 	}
@@ -67,3 +67,60 @@ func TestCaskBinaryArtifactsWithoutTarget(t *testing.T) {
 		t.Fatalf("target = %q, want empty", bins[0].Target)
 	}
 }
+
+func TestCaskQuitBundleIDs(t *testing.T) {
+	c := Cask{
+		Artifacts: []map[string]json.RawMessage{
+			{"app": json.RawMessage(`["Cursor.app"]`)},
+			{"uninstall": json.RawMessage(`[
+				{"quit": "com.todesktop.230313mzl4w4u92", "delete": "/tmp/x"},
+				{"quit": ["com.example.helper", " "]}
+			]`)},
+		},
+	}
+	got := c.QuitBundleIDs()
+	if len(got) != 2 || got[0] != "com.todesktop.230313mzl4w4u92" || got[1] != "com.example.helper" {
+		t.Fatalf("QuitBundleIDs() = %v", got)
+	}
+}
+
+func TestCaskAppArtifactsMultiple(t *testing.T) {
+	c := Cask{
+		Artifacts: []map[string]json.RawMessage{
+			{"app": json.RawMessage(`["LibreOffice.app"]`)},
+			{"binary": json.RawMessage(`["$APPDIR/LibreOffice.app/Contents/MacOS/soffice"]`)},
+			{"app": json.RawMessage(`["LibreOffice Language Pack.app", {"target": "LibreOffice Deutsch.app"}]`)},
+		},
+	}
+
+	apps := c.AppArtifacts()
+	if len(apps) != 2 {
+		t.Fatalf("AppArtifacts() len = %d, want 2", len(apps))
+	}
+	if apps[0].Source != "LibreOffice.app" || apps[0].Target != "" {
+		t.Fatalf("apps[0] = %#v", apps[0])
+	}
+	if apps[1].Source != "LibreOffice Language Pack.app" || apps[1].Target != "LibreOffice Deutsch.app" {
+		t.Fatalf("apps[1] = %#v", apps[1])
+	}
+	if got := c.AppArtifact(); got != "LibreOffice.app" {
+		t.Fatalf("AppArtifact() = %q, want first app", got)
+	}
+}
+
+func TestCaskFontArtifacts(t *testing.T) {
+	c := Cask{
+		Artifacts: []map[string]json.RawMessage{
+			{"font": json.RawMessage(`["ttf/FiraCode-Bold.ttf"]`)},
+			{"font": json.RawMessage(`["ttf/FiraCode-Regular.ttf"]`)},
+		},
+	}
+
+	fonts := c.FontArtifacts()
+	if len(fonts) != 2 || fonts[0] != "ttf/FiraCode-Bold.ttf" || fonts[1] != "ttf/FiraCode-Regular.ttf" {
+		t.Fatalf("FontArtifacts() = %#v", fonts)
+	}
+	if got := c.AppArtifact(); got != "" {
+		t.Fatalf("AppArtifact() = %q, want empty for a font cask", got)
+	}
+}
@@ -0,0 +1,49 @@
+package homebrewapi
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMacOSDependencies(t *testing.T) {
+	var f Formula
+	if err := json.Unmarshal([]byte(`{"uses_from_macos": ["zlib", {"curl": "build"}, {"python": ["build", "test"]}, {"expect": "test"}, {"libxml2": []}]}`), &f); err != nil {
+		t.Fatal(err)
+	}
+	needed, build := f.MacOSDependencies()
+	if !reflect.DeepEqual(needed, []string{"zlib", "libxml2"}) || !reflect.DeepEqual(build, []string{"curl", "python"}) {
+		t.Fatalf("MacOSDependencies() = %q, %q", needed, build)
+	}
+}
+
+func TestFormulaByNameInstallsMacOSDependenciesElsewhere(t *testing.T) {
+	mirror := t.TempDir()
+	writeMirrorFile(t, mirror, "formula.jws.json", `{}`)
+	writeMirrorFile(t, mirror, "cask.jws.json", `{}`)
+	writeMirrorFile(t, mirror, "formula.json", `[{"name":"git","full_name":"git"}]`)
+	writeMirrorFile(t, mirror, "formula/git.json", `{"name":"git","dependencies":["gettext","pcre2"],"uses_from_macos":["curl","zlib",{"pcre2":"build"}]}`)
+	t.Setenv("UB_API_FIXTURES", "")
+	t.Setenv("UB_API_DOMAIN", "file://"+filepath.ToSlash(mirror))
+	tmp := t.TempDir()
+	client := New(filepath.Join(tmp, "cache"), filepath.Join(tmp, "repo"))
+	original := macOSProvidesDependencies
+	t.Cleanup(func() { macOSProvidesDependencies = original })
+
+	for _, provided := range []bool{true, false} {
+		macOSProvidesDependencies = provided
+		f, err := client.FormulaByName(context.Background(), "git")
+		if err != nil {
+			t.Fatalf("FormulaByName: %v", err)
+		}
+		want := []string{"gettext", "pcre2"}
+		if !provided {
+			want = append(want, "curl", "zlib")
+		}
+		if !reflect.DeepEqual(f.Dependencies, want) || len(f.BuildDependencies) != 0 {
+			t.Fatalf("on macOS %v: dependencies %q, build %q; want %q", provided, f.Dependencies, f.BuildDependencies, want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package homebrewapi
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ub/internal/fetch"
+)
+
+func writeMirrorFile(t *testing.T, root, rel, body string) {
+	t.Helper()
+	path := filepath.Join(root, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatalf("write %s: %v", rel, err)
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	t.Setenv("UB_API_FIXTURES", "")
+	t.Setenv("UB_API_DOMAIN", "")
+	if got := BaseURL(); got != defaultBaseURL {
+		t.Fatalf("BaseURL() = %q", got)
+	}
+	t.Setenv("UB_API_DOMAIN", "https://mirror.internal/api/")
+	if got := BaseURL(); got != "https://mirror.internal/api" {
+		t.Fatalf("BaseURL() = %q", got)
+	}
+	t.Setenv("UB_API_DOMAIN", "/srv/ub mirror")
+	if got := BaseURL(); got != "file:///srv/ub%20mirror" {
+		t.Fatalf("BaseURL() = %q", got)
+	}
+	t.Setenv("UB_API_FIXTURES", "/tmp/fixtures")
+	if got := BaseURL(); got != "file:///tmp/fixtures" {
+		t.Fatalf("UB_API_FIXTURES should win, got %q", got)
+	}
+}
+
+func TestClientReadsFileMirror(t *testing.T) {
+	mirror := t.TempDir()
+	writeMirrorFile(t, mirror, "formula.jws.json", `{}`)
+	writeMirrorFile(t, mirror, "cask.jws.json", `{}`)
+	writeMirrorFile(t, mirror, "formula.json", `[{"name":"jq","full_name":"jq"}]`)
+	writeMirrorFile(t, mirror, "formula/jq.json", `{"name":"jq","versions":{"stable":"1.7.1"}}`)
+	writeMirrorFile(t, mirror, "cask/cursor.json", `{"token":"cursor","version":"2.5.17"}`)
+	t.Setenv("UB_API_FIXTURES", "")
+	t.Setenv("UB_API_DOMAIN", "file://"+filepath.ToSlash(mirror))
+
+	tmp := t.TempDir()
+	client := New(filepath.Join(tmp, "cache"), filepath.Join(tmp, "repo"))
+	ctx := context.Background()
+	f, err := client.FormulaByName(ctx, "jq")
+	if err != nil {
+		t.Fatalf("FormulaByName: %v", err)
+	}
+	if f.Versions.Stable != "1.7.1" {
+		t.Fatalf("stable = %q", f.Versions.Stable)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "repo", "formula.jws.json")); err != nil {
+		t.Fatalf("expected repository copy: %v", err)
+	}
+	cask, err := client.CaskByName(ctx, "cursor")
+	if err != nil || cask.Version != "2.5.17" {
+		t.Fatalf("CaskByName = %+v, %v", cask, err)
+	}
+	list, err := client.FormulaList(ctx)
+	if err != nil || len(list) != 1 {
+		t.Fatalf("FormulaList = %v, %v", list, err)
+	}
+
+	_, err = client.FormulaByName(ctx, "missing")
+	var statusErr *fetch.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != 404 {
+		t.Fatalf("expected 404 status error for missing formula, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package homebrewapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientFallsBackToIndexWhenAPIIsDown(t *testing.T) {
+	formulae, _ := json.Marshal([]map[string]any{
+		{"name": "jq", "full_name": "jq", "desc": "JSON processor", "versions": map[string]string{"stable": "1.7.1"}},
+		{"name": "wget", "full_name": "wget", "versions": map[string]string{"stable": "1.25.0"}},
+	})
+	index, _ := json.Marshal(map[string]any{"payload": string(formulae), "signatures": []any{}})
+	var down atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.Path {
+		case "/formula.jws.json":
+			_, _ = w.Write(index)
+		case "/cask.jws.json":
+			_, _ = w.Write([]byte(`{}`))
+		case "/formula/jq.json":
+			_, _ = w.Write([]byte(`{"name":"jq","versions":{"stable":"1.7.1"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	t.Setenv("UB_API_FIXTURES", "")
+	t.Setenv("UB_API_DOMAIN", server.URL)
+	t.Setenv(publicKeyEnv, "")
+	repo := t.TempDir()
+	ctx := context.Background()
+
+	client := New(t.TempDir(), repo)
+	client.Quiet = true
+	if _, err := client.FormulaByName(ctx, "jq"); err != nil {
+		t.Fatalf("FormulaByName while up: %v", err)
+	}
+	past := time.Now().Add(-5 * time.Hour)
+	if err := os.Chtimes(filepath.Join(repo, "formula.jws.json"), past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	// A fresh download cache, as after the cached documents expired.
+	down.Store(true)
+	client = New(t.TempDir(), repo)
+	client.fetcher.Clock = instantClock{}
+	if age, ok := client.IndexAge(); !ok || formatAge(age) != "5 hours" {
+		t.Fatalf("IndexAge = %s, %v", age, ok)
+	}
+	f, err := client.FormulaByName(ctx, "wget")
+	if err != nil || f.Versions.Stable != "1.25.0" {
+		t.Fatalf("FormulaByName while down = %+v, %v", f, err)
+	}
+	list, err := client.FormulaList(ctx)
+	if err != nil || len(list) != 2 || list[0].Name != "jq" || list[0].Desc != "JSON processor" {
+		t.Fatalf("FormulaList while down = %+v, %v", list, err)
+	}
+	if _, err := client.FormulaByName(ctx, "missing"); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("expected the outage for a name the index lacks, got %v", err)
+	}
+	if names := client.IndexNames("formula"); strings.Join(names, " ") != "jq wget" {
+		t.Fatalf("IndexNames = %q", names)
+	}
+}
+
+func TestFormatAge(t *testing.T) {
+	for age, want := range map[time.Duration]string{
+		90 * time.Minute:    "90 minutes",
+		26 * time.Hour:      "26 hours",
+		10 * 24 * time.Hour: "10 days",
+	} {
+		if got := formatAge(age); got != want {
+			t.Errorf("formatAge(%s) = %q, want %q", age, got, want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package homebrewapi
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type instantClock struct{}
+
+func (instantClock) Now() time.Time { return time.Now() }
+
+func (instantClock) After(time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- time.Now()
+	return ch
+}
+
+// flakyAPI serves an HTML error page for the first request to jq.json and
+// the real document after that.
+func flakyAPI(t *testing.T) (*Client, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/formula/jq.json" {
+			http.NotFound(w, r)
+			return
+		}
+		if hits.Add(1) == 1 {
+			_, _ = w.Write([]byte("<html><body>502 Bad Gateway</body></html>"))
+			return
+		}
+		_, _ = w.Write([]byte(`{"name":"jq","versions":{"stable":"1.7.1"}}`))
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("UB_API_FIXTURES", "")
+	t.Setenv("UB_API_DOMAIN", server.URL)
+	client := New(t.TempDir(), "")
+	client.fetcher.Clock = instantClock{}
+	return client, &hits
+}
+
+func TestClientRejectsInvalidDownloads(t *testing.T) {
+	client, hits := flakyAPI(t)
+	f, err := client.FormulaByName(context.Background(), "jq")
+	if err != nil || f.Versions.Stable != "1.7.1" {
+		t.Fatalf("FormulaByName = %+v, %v", f, err)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("server hit %d times, want 2", n)
+	}
+}
+
+func TestClientEvictsPoisonedCacheEntries(t *testing.T) {
+	client, hits := flakyAPI(t)
+	// Without validation the error page is cached, as older versions did.
+	client.fetcher.Validate = nil
+	f, err := client.FormulaByName(context.Background(), "jq")
+	if err != nil || f.Versions.Stable != "1.7.1" {
+		t.Fatalf("FormulaByName = %+v, %v", f, err)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("server hit %d times, want 2", n)
+	}
+}
+
+func TestValidateDocument(t *testing.T) {
+	t.Setenv(publicKeyEnv, "")
+	for data, wantErr := range map[string]string{
+		`{"name":"jq"}`:             "",
+		`{"name":"j`:                "not valid JSON",
+		"\n<!DOCTYPE html><html>":   "an HTML page",
+		`{"payload":"{\"formulae"}`: "payload is not valid JSON",
+	} {
+		url := "https://formulae.brew.sh/api/formula/jq.json"
+		if strings.Contains(data, "payload") {
+			url = "https://formulae.brew.sh/api/formula.jws.json"
+		}
+		err := validateDocument(url, []byte(data))
+		if wantErr == "" && err != nil || wantErr != "" && (err == nil || !strings.Contains(err.Error(), wantErr)) {
+			t.Errorf("validateDocument(%q) = %v, want %q", data, err, wantErr)
+		}
+	}
+}
+
+func TestVerifyJWS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := `[{"name":"jq"}]`
+	protected := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"PS512","b64":false,"crit":["b64"]}`))
+	digest := sha512.Sum512([]byte(protected + "." + payload))
+	signature, err := rsa.SignPSS(rand.Reader, key, crypto.SHA512, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jws := func(payload string) []byte {
+		data, _ := json.Marshal(map[string]any{
+			"payload":    payload,
+			"signatures": []map[string]string{{"protected": protected, "signature": base64.RawURLEncoding.EncodeToString(signature)}},
+		})
+		return data
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "api.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(publicKeyEnv, keyFile)
+
+	url := "https://formulae.brew.sh/api/formula.jws.json"
+	if err := validateDocument(url, jws(payload)); err != nil {
+		t.Fatalf("valid signature rejected: %v", err)
+	}
+	if err := validateDocument(url, jws(`[{"name":"jq2"}]`)); err == nil || !strings.Contains(err.Error(), "does not verify") {
+		t.Fatalf("expected a signature error for a changed payload, got %v", err)
+	}
+	if err := validateDocument(url, []byte(`{}`)); err == nil || !strings.Contains(err.Error(), "no payload") {
+		t.Fatalf("expected an unsigned file to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package homebrewapi
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// ErrInvalidName is wrapped by every InvalidNameError.
+var ErrInvalidName = errors.New("invalid name")
+
+// InvalidNameError is a formula or cask name that cannot be looked up in
+// the API, caught before any request is made.
+type InvalidNameError struct {
+	Kind   string
+	Name   string
+	Reason string
+}
+
+func (e *InvalidNameError) Error() string {
+	return fmt.Sprintf("invalid %s name %q: %s", e.Kind, e.Name, e.Reason)
+}
+
+func (e *InvalidNameError) Unwrap() error { return ErrInvalidName }
+
+// apiTaps are the taps the API serves, by kind.
+var apiTaps = map[string]string{"formula": "homebrew/core", "cask": "homebrew/cask"}
+
+// validName matches every formula name and cask token in homebrew/core and
+// homebrew/cask, such as python@3.12, libxml++ and font-fira-code.
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9@._+-]*$`)
+
+// CanonicalName checks a formula name or cask token, for kind "formula" or
+// "cask", and strips a homebrew/core/ or homebrew/cask/ qualifier.
+func CanonicalName(kind, name string) (string, error) {
+	name = strings.TrimSpace(name)
+	invalid := func(reason string) (string, error) {
+		return "", &InvalidNameError{Kind: kind, Name: name, Reason: reason}
+	}
+	if name == "" {
+		return invalid("a name is required")
+	}
+	if parts := strings.Split(name, "/"); len(parts) > 1 {
+		if len(parts) != 3 {
+			return invalid("a qualified name is tap user/repo/name")
+		}
+		tap := strings.ToLower(parts[0] + "/" + parts[1])
+		if tap != apiTaps[kind] {
+			return invalid(fmt.Sprintf("the Homebrew API only serves %s from %s", plural(kind), apiTaps[kind]))
+		}
+		name = parts[2]
+	}
+	if !validName.MatchString(name) {
+		return invalid("use letters, digits and @ . _ + - only")
+	}
+	return name, nil
+}
+
+func plural(kind string) string {
+	if kind == "formula" {
+		return "formulae"
+	}
+	return kind + "s"
+}
+
+// documentURL is the API document for a name CanonicalName accepted.
+func (c *Client) documentURL(kind, name string) string {
+	return fmt.Sprintf("%s/%s/%s.json", c.baseURL, kind, url.PathEscape(name))
+}
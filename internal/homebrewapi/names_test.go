@@ -0,0 +1,41 @@
+package homebrewapi
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCanonicalName(t *testing.T) {
+	valid := map[string]string{
+		"wget":               "wget",
+		" python@3.12 ":      "python@3.12",
+		"libxml++":           "libxml++",
+		"homebrew/core/wget": "wget",
+		"Homebrew/Core/wget": "wget",
+		"font-fira-code":     "font-fira-code",
+	}
+	for name, want := range valid {
+		if got, err := CanonicalName("formula", name); err != nil || got != want {
+			t.Errorf("CanonicalName(%q) = %q, %v; want %q", name, got, err, want)
+		}
+	}
+	for _, name := range []string{"", "a b", "../etc/passwd", "wget?x=1", "-rf", ".hidden", "homebrew/cask/firefox", "user/tap/thing", "a/b", "wget%2F"} {
+		if _, err := CanonicalName("formula", name); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("CanonicalName(%q) = %v, want an invalid name", name, err)
+		}
+	}
+	if got, err := CanonicalName("cask", "homebrew/cask/firefox"); err != nil || got != "firefox" {
+		t.Errorf("CanonicalName(cask, homebrew/cask/firefox) = %q, %v", got, err)
+	}
+}
+
+func TestInvalidNameMakesNoRequest(t *testing.T) {
+	t.Setenv("UB_API_FIXTURES", "")
+	t.Setenv("UB_API_DOMAIN", "http://127.0.0.1:1")
+	client := New(t.TempDir(), t.TempDir())
+	var invalid *InvalidNameError
+	if _, err := client.FormulaByName(context.Background(), "wget/../../x"); !errors.As(err, &invalid) || invalid.Kind != "formula" {
+		t.Fatalf("expected an InvalidNameError, got %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+package homebrewapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"ub/internal/fetch"
+	"ub/internal/messages"
+)
+
+// The local repository keeps the last formula and cask indexes that
+// downloaded, stamped with when they did. While the API is unreachable
+// they stand in for it, so installs and searches keep working from
+// metadata that is a little old instead of failing outright.
+
+var indexFiles = map[string]string{"formula": "formula.jws.json", "cask": "cask.jws.json"}
+
+// unreachable reports whether err means the API could not be reached, as
+// opposed to, say, a name it does not know.
+func unreachable(err error) bool {
+	var networkErr *fetch.NetworkError
+	return errors.As(err, &networkErr)
+}
+
+// IndexAge is how long ago the last-known-good formula index was
+// downloaded. It is false when there is none.
+func (c *Client) IndexAge() (time.Duration, bool) {
+	if c.repoDir == "" {
+		return 0, false
+	}
+	info, err := os.Stat(filepath.Join(c.repoDir, indexFiles["formula"]))
+	if err != nil {
+		return 0, false
+	}
+	return time.Since(info.ModTime()), true
+}
+
+// Degrade reports whether the client can carry on from its last-known-good
+// index after err, a failure to reach the API, and warns, once, how old
+// that index is.
+func (c *Client) Degrade(err error) bool {
+	if !unreachable(err) {
+		return false
+	}
+	age, ok := c.IndexAge()
+	if !ok {
+		return false
+	}
+	c.staleOnce.Do(func() {
+		fmt.Fprintln(os.Stderr, messages.Sprintf(messages.Warning, fmt.Sprintf("the Homebrew API is unreachable, so metadata is %s old: %v", formatAge(age), err)))
+	})
+	return true
+}
+
+// indexEntry returns the document for one formula or cask from the
+// last-known-good index.
+func (c *Client) indexEntry(kind, name string) ([]byte, bool) {
+	entries, err := c.index(kind)
+	if err != nil {
+		return nil, false
+	}
+	doc, ok := entries[name]
+	return doc, ok
+}
+
+// index decodes the last-known-good index for kind into documents keyed by
+// name, full name and token.
+func (c *Client) index(kind string) (map[string]json.RawMessage, error) {
+	c.indexMu.Lock()
+	defer c.indexMu.Unlock()
+	if entries, ok := c.indexes[kind]; ok {
+		return entries, nil
+	}
+	data, err := os.ReadFile(filepath.Join(c.repoDir, indexFiles[kind]))
+	if err != nil {
+		return nil, err
+	}
+	// Mirrors may serve the array itself instead of a JWS envelope.
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] != '[' {
+		var doc jwsDocument
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		data = []byte(doc.Payload)
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse %s index: %w", kind, err)
+	}
+	entries := make(map[string]json.RawMessage, len(raw))
+	for _, doc := range raw {
+		var keys struct {
+			Name      string `json:"name"`
+			FullName  string `json:"full_name"`
+			Token     string `json:"token"`
+			FullToken string `json:"full_token"`
+		}
+		if json.Unmarshal(doc, &keys) != nil {
+			continue
+		}
+		for _, key := range []string{keys.Name, keys.FullName, keys.Token, keys.FullToken} {
+			if key != "" {
+				entries[key] = doc
+			}
+		}
+	}
+	if c.indexes == nil {
+		c.indexes = map[string]map[string]json.RawMessage{}
+	}
+	c.indexes[kind] = entries
+	return entries, nil
+}
+
+// IndexNames lists the formula names or cask tokens, for kind "formula" or
+// "cask", in the last-known-good index, without going to the network.
+func (c *Client) IndexNames(kind string) []string {
+	if c.repoDir == "" {
+		return nil
+	}
+	entries, err := c.index(kind)
+	if err != nil {
+		return nil
+	}
+	seen := map[string]bool{}
+	var names []string
+	for _, doc := range entries {
+		var keys struct {
+			Name  string `json:"name"`
+			Token string `json:"token"`
+		}
+		if json.Unmarshal(doc, &keys) != nil {
+			continue
+		}
+		if name := keys.Name + keys.Token; name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// staleFormulaList is FormulaList from the last-known-good index.
+func (c *Client) staleFormulaList() ([]FormulaSummary, error) {
+	entries, err := c.index("formula")
+	if err != nil {
+		return nil, err
+	}
+	list := make([]FormulaSummary, 0, len(entries))
+	seen := map[string]bool{}
+	for _, doc := range entries {
+		var summary FormulaSummary
+		if json.Unmarshal(doc, &summary) != nil || summary.Name == "" || seen[summary.Name] {
+			continue
+		}
+		seen[summary.Name] = true
+		list = append(list, summary)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+func formatAge(age time.Duration) string {
+	switch {
+	case age < 2*time.Hour:
+		return fmt.Sprintf("%d minutes", int(age.Minutes()))
+	case age < 72*time.Hour:
+		return fmt.Sprintf("%d hours", int(age.Hours()))
+	}
+	return fmt.Sprintf("%d days", int(age.Hours()/24))
+}
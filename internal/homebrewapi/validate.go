@@ -0,0 +1,155 @@
+package homebrewapi
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"ub/internal/fetch"
+)
+
+// publicKeyEnv names a PEM file holding the RSA key the API's JWS files are
+// signed with. When it is set, unsigned or badly signed JWS files are
+// rejected.
+const publicKeyEnv = "UB_API_PUBLIC_KEY"
+
+// fetchDocument fetches an API file and returns its contents. A cached copy
+// that does not validate, such as one cached before downloads were checked,
+// is evicted and downloaded once more.
+func (c *Client) fetchDocument(ctx context.Context, url string) ([]byte, error) {
+	for retried := false; ; retried = true {
+		file, err := c.fetcher.Fetch(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		data, err := fetch.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", path.Base(url), err)
+		}
+		err = validateDocument(url, data)
+		if err == nil {
+			return data, nil
+		}
+		if evictErr := c.fetcher.Evict(url); evictErr != nil || retried {
+			return nil, err
+		}
+	}
+}
+
+// validateFile is the API cache's Validate hook.
+func validateFile(url, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return validateDocument(url, data)
+}
+
+// validateDocument rejects an API file that does not parse, such as a
+// truncated download or an HTML error page served with a 200, and a JWS
+// file whose signature does not verify when UB_API_PUBLIC_KEY is set.
+func validateDocument(url string, data []byte) error {
+	name := path.Base(url)
+	if !json.Valid(data) {
+		if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '<' {
+			return fmt.Errorf("%s is an HTML page, not JSON", name)
+		}
+		return fmt.Errorf("%s is not valid JSON (truncated download?)", name)
+	}
+	if !strings.HasSuffix(name, ".jws.json") {
+		return nil
+	}
+	key, err := apiPublicKey()
+	if err != nil {
+		return err
+	}
+	if err := verifyJWS(data, key); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+type jwsDocument struct {
+	Payload    string `json:"payload"`
+	Signatures []struct {
+		Protected string `json:"protected"`
+		Signature string `json:"signature"`
+	} `json:"signatures"`
+}
+
+type jwsHeader struct {
+	Alg string `json:"alg"`
+	B64 *bool  `json:"b64"`
+}
+
+// verifyJWS checks a Homebrew API JWS file: its payload must be JSON, and
+// when key is set, one of its signatures must be a PS512 signature by key
+// over the unencoded payload (RFC 7797), as brew checks them.
+func verifyJWS(data []byte, key *rsa.PublicKey) error {
+	var doc jwsDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("parse JWS: %w", err)
+	}
+	if doc.Payload != "" && !json.Valid([]byte(doc.Payload)) {
+		return fmt.Errorf("JWS payload is not valid JSON")
+	}
+	if key == nil {
+		return nil
+	}
+	if doc.Payload == "" {
+		return fmt.Errorf("JWS has no payload")
+	}
+	for _, sig := range doc.Signatures {
+		rawHeader, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sig.Protected, "="))
+		if err != nil {
+			continue
+		}
+		var header jwsHeader
+		if json.Unmarshal(rawHeader, &header) != nil || header.Alg != "PS512" || header.B64 == nil || *header.B64 {
+			continue
+		}
+		signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sig.Signature, "="))
+		if err != nil {
+			continue
+		}
+		digest := sha512.Sum512([]byte(sig.Protected + "." + doc.Payload))
+		if rsa.VerifyPSS(key, crypto.SHA512, digest[:], signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("JWS signature does not verify")
+}
+
+func apiPublicKey() (*rsa.PublicKey, error) {
+	file := strings.TrimSpace(os.Getenv(publicKeyEnv))
+	if file == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", publicKeyEnv, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s %s is not a PEM file", publicKeyEnv, file)
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", publicKeyEnv, err)
+	}
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s %s is not an RSA key", publicKeyEnv, file)
+	}
+	return key, nil
+}
@@ -1,17 +1,74 @@
 package lock
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"ub/internal/messages"
 )
 
+var ErrLocked = errors.New("install root is already locked")
+
+// pollInterval is how often AcquireWait retries a held lock.
+var pollInterval = 250 * time.Millisecond
+
+// linkLock puts a reclaimed lock back; tests replace it to race reclaim.
+var linkLock = os.Link
+
 type FileLock struct {
 	path string
 	held bool
 }
 
+// Holder describes the process that holds a lock, as recorded in the lock
+// file: its pid, command line and boot session, one per line.
+type Holder struct {
+	PID     int
+	Command string
+	Boot    string
+	Since   time.Time
+}
+
+func (h Holder) String() string {
+	var b strings.Builder
+	if h.PID > 0 {
+		fmt.Fprintf(&b, "pid %d", h.PID)
+	} else {
+		b.WriteString("an unknown process")
+	}
+	if h.Command != "" {
+		fmt.Fprintf(&b, " (%s)", h.Command)
+	}
+	if !h.Since.IsZero() {
+		fmt.Fprintf(&b, " for %s", time.Since(h.Since).Round(time.Second))
+	}
+	return b.String()
+}
+
+// LockedError is returned when another process holds the lock. It matches
+// ErrLocked with errors.Is.
+type LockedError struct {
+	Path   string
+	Holder Holder
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%v: %s is held by %s", ErrLocked, e.Path, e.Holder)
+}
+
+func (e *LockedError) Is(target error) bool { return target == ErrLocked }
+
 func Acquire(rootDir string) (*FileLock, error) {
 	if err := os.MkdirAll(rootDir, 0o755); err != nil {
 		return nil, fmt.Errorf("create root dir for lock: %w", err)
@@ -19,13 +76,26 @@ func Acquire(rootDir string) (*FileLock, error) {
 
 	path := filepath.Join(rootDir, ".ub.lock")
 	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
-	if err != nil {
+	if os.IsExist(err) {
+		holder := readHolder(path)
+		reason := staleReason(holder)
+		if reason == "" {
+			return nil, &LockedError{Path: path, Holder: holder}
+		}
+		if err := reclaim(path, holder); err != nil {
+			return nil, err
+		}
+		fmt.Fprintln(os.Stderr, messages.Sprintf(messages.Warning, messages.Sprintf(messages.StaleLockRemoved, path, holder, reason)))
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
 		if os.IsExist(err) {
-			return nil, fmt.Errorf("install root is already locked: %s", path)
+			return nil, &LockedError{Path: path, Holder: readHolder(path)}
 		}
+	}
+	if err != nil {
 		return nil, fmt.Errorf("acquire lock: %w", err)
 	}
-	if _, err := f.WriteString(strconv.Itoa(os.Getpid())); err != nil {
+	record := strconv.Itoa(os.Getpid()) + "\n" + strings.Join(os.Args, " ") + "\n" + bootID() + "\n"
+	if _, err := f.WriteString(record); err != nil {
 		_ = f.Close()
 		_ = os.Remove(path)
 		return nil, fmt.Errorf("write lock pid: %w", err)
@@ -38,6 +108,145 @@ func Acquire(rootDir string) (*FileLock, error) {
 	return &FileLock{path: path, held: true}, nil
 }
 
+// AcquireWait is Acquire that queues behind a held lock for up to wait, or
+// until ctx is done when wait is negative. onWait, if set, is called once
+// with the holder when ub starts waiting.
+func AcquireWait(ctx context.Context, rootDir string, wait time.Duration, onWait func(Holder)) (*FileLock, error) {
+	l, err := Acquire(rootDir)
+	var locked *LockedError
+	if wait == 0 || !errors.As(err, &locked) {
+		return l, err
+	}
+	if onWait != nil {
+		onWait(locked.Holder)
+	}
+	if wait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, wait)
+		defer cancel()
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, fmt.Errorf("gave up after waiting %s: %w", wait, locked)
+			}
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+		l, err = Acquire(rootDir)
+		if !errors.As(err, &locked) {
+			return l, err
+		}
+	}
+}
+
+func readHolder(path string) Holder {
+	var h Holder
+	f, err := os.Open(path)
+	if err != nil {
+		return h
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil {
+		h.Since = info.ModTime()
+	}
+	scanner := bufio.NewScanner(f)
+	if scanner.Scan() {
+		h.PID, _ = strconv.Atoi(strings.TrimSpace(scanner.Text()))
+	}
+	if scanner.Scan() {
+		h.Command = strings.TrimSpace(scanner.Text())
+	}
+	if scanner.Scan() {
+		h.Boot = strings.TrimSpace(scanner.Text())
+	}
+	return h
+}
+
+// staleReason says why holder no longer holds its lock, or returns "" when
+// it may still. Locks from before the pid was recorded, or caught half
+// written, are never stale.
+func staleReason(h Holder) string {
+	if h.PID <= 0 {
+		return ""
+	}
+	if boot := bootID(); h.Boot != "" && boot != "" && h.Boot != boot {
+		return "the system has restarted since"
+	}
+	if !processAlive(h.PID) {
+		return "the process is gone"
+	}
+	return ""
+}
+
+// reclaim removes a stale lock file, unless another process replaced it
+// after it was read. Reading the holder and then removing the path would
+// race with that process, so the file is first renamed to a name only this
+// process uses and checked there; a live lock taken in the meantime is put
+// back.
+func reclaim(path string, stale Holder) error {
+	claimed := fmt.Sprintf("%s.reclaim-%d-%d", path, os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(path, claimed); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("remove stale lock: %w", err)
+	}
+	if current := readHolder(claimed); current != stale {
+		// os.Link fails rather than replace a lock taken since. The claimed
+		// file is then the only copy of a live lock, so it stays.
+		if err := linkLock(claimed, path); err != nil {
+			if os.IsExist(err) {
+				return &LockedError{Path: path, Holder: current}
+			}
+			return fmt.Errorf("restore lock from %s: %w", claimed, err)
+		}
+		_ = os.Remove(claimed)
+		return &LockedError{Path: path, Holder: current}
+	}
+	if err := os.Remove(claimed); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove stale lock: %w", err)
+	}
+	return nil
+}
+
+func processAlive(pid int) bool {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// Signal 0 only checks the pid; EPERM means it exists as another user.
+	err = proc.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+var (
+	bootOnce sync.Once
+	bootSeen string
+)
+
+// bootID identifies the current boot session, or is "" where unknown.
+func bootID() string {
+	bootOnce.Do(func() {
+		switch runtime.GOOS {
+		case "linux":
+			data, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+			if err == nil {
+				bootSeen = strings.TrimSpace(string(data))
+			}
+		case "darwin":
+			out, err := exec.Command("sysctl", "-n", "kern.bootsessionuuid").Output()
+			if err == nil {
+				bootSeen = strings.TrimSpace(string(out))
+			}
+		}
+	})
+	return bootSeen
+}
+
 func (l *FileLock) Release() error {
 	if l == nil || !l.held {
 		return nil
@@ -0,0 +1,147 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcquireReportsHolder(t *testing.T) {
+	dir := t.TempDir()
+	held, err := Acquire(dir)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer held.Release()
+
+	_, err = Acquire(dir)
+	var locked *LockedError
+	if !errors.As(err, &locked) || !errors.Is(err, ErrLocked) {
+		t.Fatalf("second Acquire error = %v, want LockedError", err)
+	}
+	if locked.Holder.PID != os.Getpid() || locked.Holder.Command != strings.Join(os.Args, " ") || locked.Holder.Since.IsZero() {
+		t.Fatalf("unexpected holder: %+v", locked.Holder)
+	}
+	if !strings.Contains(err.Error(), "held by pid ") {
+		t.Fatalf("error does not name the holder: %v", err)
+	}
+}
+
+func TestAcquireWaitQueuesUntilRelease(t *testing.T) {
+	defer func(interval time.Duration) { pollInterval = interval }(pollInterval)
+	pollInterval = 10 * time.Millisecond
+	dir := t.TempDir()
+	held, err := Acquire(dir)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	if _, err := AcquireWait(context.Background(), dir, 30*time.Millisecond, nil); !errors.Is(err, ErrLocked) {
+		t.Fatalf("AcquireWait with timeout = %v, want ErrLocked", err)
+	}
+
+	waited := 0
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		held.Release()
+	}()
+	l, err := AcquireWait(context.Background(), dir, -1, func(Holder) { waited++ })
+	if err != nil {
+		t.Fatalf("AcquireWait: %v", err)
+	}
+	defer l.Release()
+	if waited != 1 {
+		t.Fatalf("onWait called %d times, want 1", waited)
+	}
+}
+
+func TestAcquireReclaimsStaleLocks(t *testing.T) {
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("cannot run true: %v", err)
+	}
+	deadPID := cmd.Process.Pid
+
+	cases := map[string]string{
+		"dead pid":   fmt.Sprintf("%d\nub install jq\n%s\n", deadPID, bootID()),
+		"old boot":   fmt.Sprintf("%d\nub install jq\nsome-earlier-boot\n", os.Getpid()),
+		"pid only":   fmt.Sprintf("%d", deadPID),
+		"live pid":   fmt.Sprintf("%d\nub install jq\n%s\n", os.Getpid(), bootID()),
+		"unreadable": "",
+	}
+	for name, content := range cases {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, ".ub.lock"), []byte(content), 0o644); err != nil {
+				t.Fatalf("write lock: %v", err)
+			}
+			l, err := Acquire(dir)
+			wantStale := name == "dead pid" || name == "pid only" || (name == "old boot" && bootID() != "")
+			if wantStale {
+				if err != nil {
+					t.Fatalf("Acquire should reclaim a stale lock: %v", err)
+				}
+				l.Release()
+			} else if !errors.Is(err, ErrLocked) {
+				t.Fatalf("Acquire error = %v, want ErrLocked", err)
+			}
+		})
+	}
+}
+
+func TestReclaimKeepsALockTakenSince(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, ".ub.lock")
+	live := fmt.Sprintf("%d\nub install wget\n%s\n", os.Getpid(), bootID())
+	if err := os.WriteFile(path, []byte(live), 0o644); err != nil {
+		t.Fatalf("write lock: %v", err)
+	}
+	// The stale holder read earlier has been replaced by a live one.
+	err := reclaim(path, Holder{PID: 1, Command: "ub install jq"})
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("reclaim error = %v, want ErrLocked", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != live {
+		t.Fatalf("lock file = %q, %v; want the live lock kept", data, err)
+	}
+	if leftovers, _ := filepath.Glob(path + ".reclaim-*"); len(leftovers) != 0 {
+		t.Fatalf("left %v behind", leftovers)
+	}
+}
+
+func TestReclaimKeepsALiveLockWhenAnotherIsTakenMeanwhile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, ".ub.lock")
+	live := fmt.Sprintf("%d\nub install wget\n%s\n", os.Getpid(), bootID())
+	if err := os.WriteFile(path, []byte(live), 0o644); err != nil {
+		t.Fatalf("write lock: %v", err)
+	}
+	// A third process takes the lock while it is renamed away.
+	third := "1\nub install jq\n\n"
+	restore := linkLock
+	t.Cleanup(func() { linkLock = restore })
+	linkLock = func(oldname, newname string) error {
+		if err := os.WriteFile(newname, []byte(third), 0o644); err != nil {
+			return err
+		}
+		return os.Link(oldname, newname)
+	}
+
+	err := reclaim(path, Holder{PID: 1, Command: "ub install jq"})
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("reclaim error = %v, want ErrLocked", err)
+	}
+	claimed, _ := filepath.Glob(path + ".reclaim-*")
+	if len(claimed) != 1 {
+		t.Fatalf("claimed files = %v, want the live lock kept", claimed)
+	}
+	if data, err := os.ReadFile(claimed[0]); err != nil || string(data) != live {
+		t.Fatalf("claimed lock = %q, %v; want the live lock", data, err)
+	}
+}
@@ -0,0 +1,320 @@
+package messages
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type Key string
+
+const (
+	FetchingDownloads    Key = "fetching_downloads"
+	UsingWorkers         Key = "using_workers"
+	InstallingDeps       Key = "installing_dependencies"
+	Installing           Key = "installing"
+	InstallingDependency Key = "installing_dependency"
+	Pouring              Key = "pouring"
+	Poured               Key = "poured"
+	AlreadyInstalled     Key = "already_installed"
+	SummaryHeader        Key = "summary_header"
+	SummaryItem          Key = "summary_item"
+	InterruptedNone      Key = "interrupted_none"
+	InterruptedSome      Key = "interrupted_some"
+	UsingCached          Key = "using_cached"
+	DownloadProgress     Key = "download_progress"
+	DownloadStalled      Key = "download_stalled"
+	UninstallProgress    Key = "uninstall_progress"
+	BottleLabel          Key = "bottle_label"
+	CaskLabel            Key = "cask_label"
+	UninstallLabel       Key = "uninstall_label"
+	UninstallCaskLabel   Key = "uninstall_cask_label"
+	DownloadingCask      Key = "downloading_cask"
+	InstallingCask       Key = "installing_cask"
+	MovingApp            Key = "moving_app"
+	MovingFont           Key = "moving_font"
+	LinkingBinary        Key = "linking_binary"
+	CaskInstalled        Key = "cask_installed"
+	APIDownloaded        Key = "api_downloaded"
+	Warning              Key = "warning"
+	Error                Key = "error"
+	Interrupted          Key = "interrupted"
+	UpgradingOutdated    Key = "upgrading_outdated"
+	UpgradeItem          Key = "upgrade_item"
+	WouldUpgrade         Key = "would_upgrade"
+	UpgradeHomepage      Key = "upgrade_homepage"
+	UpgradeReleaseNotes  Key = "upgrade_release_notes"
+	NothingToUpgrade     Key = "nothing_to_upgrade"
+	SkippingAutoUpdates  Key = "skipping_auto_updates"
+	SkippingPinned       Key = "skipping_pinned"
+	ForceRequiredBy      Key = "force_required_by"
+	CrossTagBottle       Key = "cross_tag_bottle"
+	BugreportWritten     Key = "bugreport_written"
+	SelfUpdateCurrent    Key = "self_update_current"
+	SelfUpdateAvailable  Key = "self_update_available"
+	SelfUpdating         Key = "self_updating"
+	SelfUpdated          Key = "self_updated"
+	InstallStatus        Key = "install_status"
+	InstallStatusBytes   Key = "install_status_bytes"
+	InstallStatusStalled Key = "install_status_stalled"
+	MovedToTrash         Key = "moved_to_trash"
+	BuildingHead         Key = "building_head"
+	WaitingForLock       Key = "waiting_for_lock"
+	StaleLockRemoved     Key = "stale_lock_removed"
+	MovedDir             Key = "moved_dir"
+	LowDiskSpace         Key = "low_disk_space"
+	RemovedOldKegs       Key = "removed_old_kegs"
+	BackedUpFile         Key = "backed_up_file"
+)
+
+var english = map[Key]string{
+	FetchingDownloads:    "{heading} Fetching downloads for: %s",
+	UsingWorkers:         "{heading} Using %d worker(s)",
+	InstallingDeps:       "{heading} Installing dependencies for %s: %s",
+	Installing:           "%s Installing %s",
+	InstallingDependency: "%s Installing dependency: %s",
+	Pouring:              "%s Pouring %s",
+	Poured:               "{beer}  %s: %d files, %s",
+	AlreadyInstalled:     "{heading} %s (%s) already installed",
+	SummaryHeader:        "{heading} Summary",
+	SummaryItem:          "- %s",
+	InterruptedNone:      "{heading} Interrupted before any formula was installed",
+	InterruptedSome:      "{heading} Interrupted; completed: %s",
+	UsingCached:          "{check} %-64s Using cached file",
+	DownloadProgress:     "{download} %-*s %s%s %8s elapsed %s eta %s",
+	DownloadStalled:      "{download} %-*s %s%s stalled, retrying",
+	UninstallProgress:    "{trash} %-*s %s %s elapsed %s eta %s",
+	BottleLabel:          "Bottle %s (%s)",
+	CaskLabel:            "Cask %s",
+	UninstallLabel:       "Uninstall %s",
+	UninstallCaskLabel:   "Uninstall cask %s",
+	DownloadingCask:      "{heading} Downloading Cask %s",
+	InstallingCask:       "{heading} Installing Cask %s",
+	MovingApp:            "{heading} Moving App '%s' to '%s'",
+	MovingFont:           "{heading} Moving Font '%s' to '%s'",
+	LinkingBinary:        "{heading} Linking Binary '%s' to '%s'",
+	CaskInstalled:        "{beer}  %s was successfully installed!",
+	APIDownloaded:        "{check} JSON API %-56s Downloaded %8s/%8s",
+	Warning:              "{warning} %v",
+	Error:                "{error} %v",
+	Interrupted:          "{interrupted} %v",
+	UpgradingOutdated:    "{heading} Upgrading %d outdated package(s):",
+	UpgradeItem:          "%s %s -> %s",
+	WouldUpgrade:         "{heading} Would upgrade %d outdated package(s):",
+	UpgradeHomepage:      "  Homepage: %s",
+	UpgradeReleaseNotes:  "  Release notes: %s",
+	NothingToUpgrade:     "{heading} Everything is up to date",
+	SkippingAutoUpdates:  "{heading} Skipping casks that auto-update (use --greedy to include): %s",
+	SkippingPinned:       "{heading} Not upgrading pinned packages: %s",
+	ForceRequiredBy:      "removing %s although it is required by %s",
+	CrossTagBottle:       "pouring %s bottle built for %s instead of %s",
+	BugreportWritten:     "{heading} Wrote bug report to %s; review it before attaching it to an issue",
+	SelfUpdateCurrent:    "{heading} ub %s is already the latest version",
+	SelfUpdateAvailable:  "{heading} ub %s -> %s is available on the %s channel",
+	SelfUpdating:         "{heading} Updating ub %s -> %s",
+	SelfUpdated:          "{beer}  ub %s installed",
+	InstallStatus:        "{heading} %d/%d done, %d downloading, %d extracting, %d queued %8s",
+	InstallStatusBytes:   "{heading} %d/%d done, %d downloading, %d extracting, %d queued, %s/%s %8s eta %s",
+	InstallStatusStalled: ", %d stalled, retrying",
+	MovedToTrash:         "{heading} Moved %s to the Trash: %s",
+	BuildingHead:         "{heading} Building %s from %s",
+	WaitingForLock:       "{heading} Waiting for %s, held by %s",
+	StaleLockRemoved:     "removed stale lock %s left by %s: %s",
+	MovedDir:             "{heading} Moved %s to %s",
+	LowDiskSpace:         "only %s free on %s, below the %s floor; pausing extraction",
+	RemovedOldKegs:       "{heading} Removed %d old keg(s), freeing %s",
+	BackedUpFile:         "{heading} Backed up %s to %s",
+}
+
+var emojiSymbols = map[string]string{
+	"heading":     "==>",
+	"beer":        "🍺",
+	"check":       "✔︎",
+	"download":    "⬇",
+	"trash":       "🗑",
+	"warning":     "warning:",
+	"error":       "error:",
+	"interrupted": "interrupted:",
+}
+
+var asciiSymbols = map[string]string{
+	"heading":     "==>",
+	"beer":        "[ok]",
+	"check":       "[ok]",
+	"download":    "v",
+	"trash":       "x",
+	"warning":     "warning:",
+	"error":       "error:",
+	"interrupted": "interrupted:",
+}
+
+const ansiReset = "\033[0m"
+
+var symbolColors = map[string]string{
+	"heading":     "\033[1;34m",
+	"check":       "\033[32m",
+	"warning":     "\033[1;33m",
+	"error":       "\033[1;31m",
+	"interrupted": "\033[1;31m",
+}
+
+type Options struct {
+	Locale string
+	ASCII  bool
+	Color  bool
+	// CatalogDir holds optional <locale>.json files overriding built-in strings.
+	CatalogDir string
+}
+
+type catalog struct {
+	strings map[Key]string
+	symbols map[string]string
+	ascii   bool
+}
+
+var (
+	mu      sync.RWMutex
+	current = catalog{strings: english, symbols: emojiSymbols}
+)
+
+func Configure(opts Options) error {
+	next := catalog{strings: english, symbols: emojiSymbols, ascii: opts.ASCII}
+	if opts.ASCII {
+		next.symbols = asciiSymbols
+	}
+	if opts.Color {
+		next.symbols = colorize(next.symbols)
+	}
+	locale := normalizeLocale(opts.Locale)
+	if locale != "" && locale != "en" && strings.TrimSpace(opts.CatalogDir) != "" {
+		overrides, err := loadCatalog(opts.CatalogDir, locale)
+		if err != nil {
+			return err
+		}
+		if len(overrides) > 0 {
+			merged := make(map[Key]string, len(english))
+			for k, v := range english {
+				merged[k] = v
+			}
+			for k, v := range overrides {
+				merged[k] = v
+			}
+			next.strings = merged
+		}
+	}
+
+	mu.Lock()
+	current = next
+	mu.Unlock()
+	return nil
+}
+
+func OptionsFromEnv() Options {
+	opts := Options{Locale: os.Getenv("UB_LOCALE")}
+	if opts.Locale == "" {
+		opts.Locale = firstNonEmpty(os.Getenv("LC_ALL"), os.Getenv("LC_MESSAGES"), os.Getenv("LANG"))
+	}
+	if envBool(os.Getenv("UB_NO_EMOJI")) || os.Getenv("TERM") == "dumb" {
+		opts.ASCII = true
+	}
+	return opts
+}
+
+func ASCII() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current.ascii
+}
+
+func Sprintf(key Key, args ...any) string {
+	mu.RLock()
+	template, ok := current.strings[key]
+	symbols := current.symbols
+	mu.RUnlock()
+	if !ok {
+		template = english[key]
+	}
+	return fmt.Sprintf(expandSymbols(template, symbols), args...)
+}
+
+func Println(key Key, args ...any) {
+	fmt.Println(Sprintf(key, args...))
+}
+
+func colorize(symbols map[string]string) map[string]string {
+	out := make(map[string]string, len(symbols))
+	for name, symbol := range symbols {
+		if code, ok := symbolColors[name]; ok {
+			symbol = code + symbol + ansiReset
+		}
+		out[name] = symbol
+	}
+	return out
+}
+
+func expandSymbols(template string, symbols map[string]string) string {
+	if !strings.Contains(template, "{") {
+		return template
+	}
+	for name, symbol := range symbols {
+		template = strings.ReplaceAll(template, "{"+name+"}", symbol)
+	}
+	return template
+}
+
+func loadCatalog(dir, locale string) (map[Key]string, error) {
+	candidates := []string{locale}
+	if lang, _, ok := strings.Cut(locale, "_"); ok {
+		candidates = append(candidates, lang)
+	}
+	for _, name := range candidates {
+		data, err := os.ReadFile(filepath.Join(dir, name+".json"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("read message catalog %q: %w", name, err)
+		}
+		var raw map[string]string
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("parse message catalog %q: %w", name, err)
+		}
+		out := make(map[Key]string, len(raw))
+		for k, v := range raw {
+			out[Key(k)] = v
+		}
+		return out, nil
+	}
+	return nil, nil
+}
+
+func normalizeLocale(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if raw == "" || raw == "C" || raw == "POSIX" {
+		return ""
+	}
+	if idx := strings.IndexAny(raw, ".@"); idx >= 0 {
+		raw = raw[:idx]
+	}
+	return strings.ReplaceAll(raw, "-", "_")
+}
+
+func envBool(raw string) bool {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "1", "true", "yes", "on":
+		return true
+	}
+	return false
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
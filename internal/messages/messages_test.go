@@ -0,0 +1,60 @@
+package messages
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSprintfASCIIMode(t *testing.T) {
+	t.Cleanup(func() { _ = Configure(Options{}) })
+
+	if err := Configure(Options{}); err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+	if got := Sprintf(Poured, "/c/jq/1.7", 3, "1.0KB"); got != "🍺  /c/jq/1.7: 3 files, 1.0KB" {
+		t.Fatalf("emoji Sprintf() = %q", got)
+	}
+
+	if err := Configure(Options{ASCII: true}); err != nil {
+		t.Fatalf("configure ascii: %v", err)
+	}
+	if got := Sprintf(Poured, "/c/jq/1.7", 3, "1.0KB"); got != "[ok]  /c/jq/1.7: 3 files, 1.0KB" {
+		t.Fatalf("ascii Sprintf() = %q", got)
+	}
+	if !ASCII() {
+		t.Fatal("expected ASCII() to report true")
+	}
+}
+
+func TestConfigureLoadsLocaleCatalog(t *testing.T) {
+	t.Cleanup(func() { _ = Configure(Options{}) })
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "de.json"), []byte(`{"summary_header": "{heading} Zusammenfassung"}`), 0o644); err != nil {
+		t.Fatalf("write catalog: %v", err)
+	}
+	if err := Configure(Options{Locale: "de_DE.UTF-8", CatalogDir: dir}); err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+	if got := Sprintf(SummaryHeader); got != "==> Zusammenfassung" {
+		t.Fatalf("localized Sprintf() = %q", got)
+	}
+	if got := Sprintf(SummaryItem, "jq"); got != "- jq" {
+		t.Fatalf("fallback Sprintf() = %q", got)
+	}
+}
+
+func TestSprintfColorWrapsSymbols(t *testing.T) {
+	t.Cleanup(func() { _ = Configure(Options{}) })
+
+	if err := Configure(Options{Color: true}); err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+	if got := Sprintf(SummaryHeader); got != "\033[1;34m==>\033[0m Summary" {
+		t.Fatalf("colored heading = %q", got)
+	}
+	if got := Sprintf(Error, "boom"); got != "\033[1;31merror:\033[0m boom" {
+		t.Fatalf("colored error = %q", got)
+	}
+}
@@ -0,0 +1,495 @@
+package native
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"ub/internal/formula"
+	"ub/internal/homebrewapi"
+)
+
+// Manifest is the desired state ub apply converges the machine to. It is
+// read from JSON, or from YAML when the file ends in .yaml or .yml.
+type Manifest struct {
+	Formulae []ManifestEntry `json:"formulae"`
+	Casks    []ManifestEntry `json:"casks"`
+	// Taps are cloned when missing, so formulae can be built from them.
+	Taps []ManifestTap `json:"taps"`
+}
+
+// ManifestTap is a user/repo tap. A bare string is shorthand for
+// {"name": ...}.
+type ManifestTap struct {
+	Name string `json:"name"`
+	// URL is the git repository to clone, github.com/user/homebrew-repo by
+	// default.
+	URL string `json:"url,omitempty"`
+}
+
+func (t *ManifestTap) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*t = ManifestTap{Name: name}
+		return nil
+	}
+	type tap ManifestTap
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode((*tap)(t))
+}
+
+func (t *ManifestTap) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*t = ManifestTap{Name: node.Value}
+		return nil
+	}
+	type tap ManifestTap
+	return decodeYAMLStrict(node, (*tap)(t))
+}
+
+const (
+	StatePresent = "present"
+	StateLatest  = "latest"
+	StateAbsent  = "absent"
+)
+
+// ManifestEntry is one package in a Manifest. A bare string is shorthand
+// for {"name": ...}.
+type ManifestEntry struct {
+	Name string `json:"name"`
+	// State is present (the default), latest, or absent.
+	State string `json:"state,omitempty"`
+	// Version, when set, must match the installed version: exactly, or up
+	// to a "." or "_" boundary, so "22" accepts 22.1.0.
+	Version string `json:"version,omitempty"`
+	// Pinned never upgrades the installed version, here or in ub upgrade.
+	Pinned bool `json:"pinned,omitempty"`
+	// Tap builds a formula from this tap, as ub pin-tap does.
+	Tap string `json:"tap,omitempty"`
+}
+
+func (e *ManifestEntry) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*e = ManifestEntry{Name: name}
+		return nil
+	}
+	type entry ManifestEntry
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode((*entry)(e))
+}
+
+func (e *ManifestEntry) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*e = ManifestEntry{Name: node.Value}
+		return nil
+	}
+	type entry ManifestEntry
+	return decodeYAMLStrict(node, (*entry)(e))
+}
+
+// decodeYAMLStrict decodes node into v, rejecting unknown fields as the
+// top-level decoder does; yaml.Node.Decode on its own accepts them.
+func decodeYAMLStrict(node *yaml.Node, v any) error {
+	data, err := yaml.Marshal(node)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	return dec.Decode(v)
+}
+
+func LoadManifest(path string) (Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("read manifest: %w", err)
+	}
+	var manifest Manifest
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&manifest)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&manifest)
+	}
+	if err != nil {
+		return Manifest{}, fmt.Errorf("parse manifest %s: %w", path, err)
+	}
+	if err := manifest.validate(); err != nil {
+		return Manifest{}, fmt.Errorf("manifest %s: %w", path, err)
+	}
+	return manifest, nil
+}
+
+func (m Manifest) validate() error {
+	seen := map[string]bool{}
+	for _, tap := range m.Taps {
+		if !tapNamePattern.MatchString(tap.Name) {
+			return fmt.Errorf("tap %q is not a user/repo name", tap.Name)
+		}
+		if seen["tap "+tap.Name] {
+			return fmt.Errorf("tap %s is listed twice", tap.Name)
+		}
+		seen["tap "+tap.Name] = true
+	}
+	for _, group := range []struct {
+		kind    string
+		entries []ManifestEntry
+	}{{"formula", m.Formulae}, {"cask", m.Casks}} {
+		for _, e := range group.entries {
+			if strings.TrimSpace(e.Name) == "" {
+				return fmt.Errorf("%s entry without a name", group.kind)
+			}
+			key := group.kind + " " + e.Name
+			if seen[key] {
+				return fmt.Errorf("%s %s is listed twice", group.kind, e.Name)
+			}
+			seen[key] = true
+			if e.Tap != "" && group.kind == "cask" {
+				return fmt.Errorf("cask %s cannot be built from a tap", e.Name)
+			}
+			switch e.State {
+			case "", StatePresent, StateLatest:
+			case StateAbsent:
+				if e.Version != "" || e.Pinned || e.Tap != "" {
+					return fmt.Errorf("%s %s is absent but has a version, pin or tap", group.kind, e.Name)
+				}
+			default:
+				return fmt.Errorf("%s %s has unknown state %q (want present, latest or absent)", group.kind, e.Name, e.State)
+			}
+		}
+	}
+	return nil
+}
+
+// ApplyPlan is what Apply changes. It is empty when the machine already
+// matches the manifest.
+type ApplyPlan struct {
+	Taps []ManifestTap
+	// TapPins are formulae to build from a tap from now on.
+	TapPins      []TapPin
+	Install      []string
+	InstallCasks []string
+	Upgrade      []OutdatedPackage
+	Pin          []string
+	PinCasks     []string
+	Unpin        []string
+	UnpinCasks   []string
+	Remove       []string
+	RemoveCasks  []string
+}
+
+func (p ApplyPlan) Empty() bool {
+	return len(p.Taps) == 0 && len(p.TapPins) == 0 && len(p.Install) == 0 && len(p.InstallCasks) == 0 && len(p.Upgrade) == 0 &&
+		len(p.Pin) == 0 && len(p.PinCasks) == 0 && len(p.Unpin) == 0 && len(p.UnpinCasks) == 0 && len(p.Remove) == 0 && len(p.RemoveCasks) == 0
+}
+
+// versionMatches reports whether version satisfies want, as described on
+// ManifestEntry.Version.
+func versionMatches(version, want string) bool {
+	if want == "" || version == want {
+		return true
+	}
+	rest, ok := strings.CutPrefix(version, want)
+	return ok && (rest[0] == '.' || rest[0] == '_')
+}
+
+// PlanApply compares manifest with what is installed. It fails when an
+// entry asks for a version the API or its tap no longer offers, since ub
+// can only install the current one.
+func (m *Manager) PlanApply(ctx context.Context, manifest Manifest) (ApplyPlan, error) {
+	if err := manifest.validate(); err != nil {
+		return ApplyPlan{}, err
+	}
+	formulae, casks, err := m.InstalledVersions()
+	if err != nil {
+		return ApplyPlan{}, err
+	}
+	tapPins, err := m.tapPins()
+	if err != nil {
+		return ApplyPlan{}, err
+	}
+	pinnedFormulae, pinnedCasks, err := m.pins()
+	if err != nil {
+		return ApplyPlan{}, err
+	}
+	var plan ApplyPlan
+	cloning := map[string]bool{}
+	for _, tap := range manifest.Taps {
+		if _, err := m.resolveTap(tap.Name); err != nil {
+			plan.Taps = append(plan.Taps, tap)
+			cloning[tap.Name] = true
+		}
+	}
+	for _, e := range manifest.Formulae {
+		installed, ok := formulae[e.Name]
+		planPin(&plan.Pin, &plan.Unpin, e, pinnedFormulae[e.Name])
+		if e.State == StateAbsent {
+			if ok {
+				plan.Remove = append(plan.Remove, e.Name)
+			}
+			continue
+		}
+		var current string
+		var outdated bool
+		if e.Tap != "" {
+			if pin, pinned := tapPins[e.Name]; !pinned || pin.Tap != e.Tap {
+				plan.TapPins = append(plan.TapPins, TapPin{Formula: e.Name, Tap: e.Tap})
+			}
+			// A tap that is yet to be cloned cannot say what it offers;
+			// the install or upgrade finds out.
+			if !cloning[e.Tap] {
+				dir, err := m.resolveTap(e.Tap)
+				if err != nil {
+					return ApplyPlan{}, err
+				}
+				f, err := formula.LoadByName(dir, e.Name)
+				if err != nil {
+					return ApplyPlan{}, fmt.Errorf("tap %s: %w", e.Tap, err)
+				}
+				current = f.Version
+				outdated = ok && !m.pinnedCurrent(TapPin{Formula: e.Name, Tap: e.Tap, Dir: dir}, f)
+			}
+		} else {
+			f, err := m.API.FormulaByName(ctx, e.Name)
+			if err != nil {
+				return ApplyPlan{}, err
+			}
+			current = f.Versions.Stable
+			outdated = ok && !formulaVersionCurrent(installed, current) && !strings.HasPrefix(installed, headKegPrefix)
+		}
+		if err := planEntry(&plan, e, "formula", installed, ok, current, outdated); err != nil {
+			return ApplyPlan{}, err
+		}
+	}
+	for _, e := range manifest.Casks {
+		_, ok := casks[e.Name]
+		planPin(&plan.PinCasks, &plan.UnpinCasks, e, pinnedCasks[e.Name])
+		if e.State == StateAbsent {
+			if ok {
+				plan.RemoveCasks = append(plan.RemoveCasks, e.Name)
+			}
+			continue
+		}
+		cask, err := m.API.CaskByName(ctx, e.Name)
+		if err != nil {
+			return ApplyPlan{}, err
+		}
+		current := strings.TrimSpace(cask.Version)
+		if current == "" {
+			current = "latest"
+		}
+		installed, outdated := "", false
+		if ok {
+			receipt, err := m.readCaskReceipt(e.Name)
+			if err != nil {
+				return ApplyPlan{}, err
+			}
+			installed = receipt.Version
+			outdated = caskUpgradeDecision(installed, current, cask.AutoUpdates, true) == caskUpgrade
+		}
+		if err := planEntry(&plan, e, "cask", installed, ok, current, outdated); err != nil {
+			return ApplyPlan{}, err
+		}
+	}
+	return plan, nil
+}
+
+// planPin adds e to pin or unpin when whether it is pinned is to change.
+func planPin(pin, unpin *[]string, e ManifestEntry, pinned bool) {
+	switch {
+	case e.Pinned && !pinned:
+		*pin = append(*pin, e.Name)
+	case !e.Pinned && pinned:
+		*unpin = append(*unpin, e.Name)
+	}
+}
+
+// planEntry adds what e needs installed or upgraded to plan. current is
+// empty when it is not known yet.
+func planEntry(plan *ApplyPlan, e ManifestEntry, kind, installed string, isInstalled bool, current string, outdated bool) error {
+	if isInstalled && versionMatches(installed, e.Version) && (e.Pinned || e.State != StateLatest || !outdated) {
+		return nil
+	}
+	if isInstalled && e.Pinned {
+		return fmt.Errorf("%s %s is pinned at %s, which does not match version %s", kind, e.Name, installed, e.Version)
+	}
+	if current != "" && !versionMatches(current, e.Version) {
+		return fmt.Errorf("%s %s wants version %s, but the current version is %s", kind, e.Name, e.Version, current)
+	}
+	switch {
+	case !isInstalled && kind == "cask":
+		plan.InstallCasks = append(plan.InstallCasks, e.Name)
+	case !isInstalled:
+		plan.Install = append(plan.Install, e.Name)
+	default:
+		plan.Upgrade = append(plan.Upgrade, OutdatedPackage{Name: e.Name, Cask: kind == "cask", InstalledVersion: installed, CurrentVersion: current})
+	}
+	return nil
+}
+
+// Apply carries out plan: taps and tap pins first, so installs build from
+// them, then unpins, installs, upgrades and pins, and removals last, so
+// autoremove sees the dependencies of everything the manifest keeps.
+func (m *Manager) Apply(ctx context.Context, plan ApplyPlan) error {
+	for _, tap := range plan.Taps {
+		if err := m.CloneTap(ctx, tap.Name, tap.URL); err != nil {
+			return err
+		}
+	}
+	for _, pin := range plan.TapPins {
+		if _, err := m.PinTap(pin.Formula, pin.Tap); err != nil {
+			return err
+		}
+	}
+	for _, name := range plan.Unpin {
+		if err := m.Unpin(name, false); err != nil {
+			return err
+		}
+	}
+	for _, token := range plan.UnpinCasks {
+		if err := m.Unpin(token, true); err != nil {
+			return err
+		}
+	}
+	if len(plan.Install) > 0 || len(plan.InstallCasks) > 0 {
+		if err := m.InstallWithOptions(ctx, plan.Install, InstallOptions{Casks: plan.InstallCasks}); err != nil {
+			return err
+		}
+	}
+	if len(plan.Upgrade) > 0 {
+		names := make([]string, 0, len(plan.Upgrade))
+		for _, p := range plan.Upgrade {
+			names = append(names, p.Name)
+		}
+		if _, err := m.Upgrade(ctx, names, UpgradeOptions{Greedy: true}); err != nil {
+			return err
+		}
+	}
+	for _, name := range plan.Pin {
+		if err := m.Pin(name, false); err != nil {
+			return err
+		}
+	}
+	for _, token := range plan.PinCasks {
+		if err := m.Pin(token, true); err != nil {
+			return err
+		}
+	}
+	// A formula and a cask can share a name, so each kind is removed as
+	// that kind. Every keg of a formula goes, or it would still be present.
+	if len(plan.Remove) > 0 {
+		if _, err := m.UninstallWithOptions(ctx, plan.Remove, UninstallOptions{Formula: true, AllVersions: true}); err != nil {
+			return err
+		}
+	}
+	if len(plan.RemoveCasks) > 0 {
+		if _, err := m.UninstallWithOptions(ctx, plan.RemoveCasks, UninstallOptions{Cask: true}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PlanAction is one change in an ApplyPlan, as ub plan reports it.
+type PlanAction struct {
+	Action string `json:"action"`
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+	// Bytes is the download size of an install or upgrade, or the disk
+	// space a removal frees; zero when unknown.
+	Bytes int64 `json:"bytes"`
+}
+
+// PlanActions describes plan with versions and sizes. Dependencies an
+// install pulls in are not listed.
+func (m *Manager) PlanActions(ctx context.Context, plan ApplyPlan) ([]PlanAction, error) {
+	actions := make([]PlanAction, 0)
+	for _, tap := range plan.Taps {
+		actions = append(actions, PlanAction{Action: "tap", Kind: "tap", Name: tap.Name})
+	}
+	tapPins, err := m.tapPins()
+	if err != nil {
+		return nil, err
+	}
+	for _, pin := range plan.TapPins {
+		actions = append(actions, PlanAction{Action: "pin-tap", Kind: "formula", Name: pin.Formula, To: pin.Tap})
+		tapPins[pin.Formula] = pin
+	}
+	for _, name := range plan.Install {
+		// A formula built from a tap has no bottle to size.
+		if _, ok := tapPins[name]; ok {
+			actions = append(actions, PlanAction{Action: "install", Kind: "formula", Name: name})
+			continue
+		}
+		f, err := m.API.FormulaByName(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, PlanAction{Action: "install", Kind: "formula", Name: name, To: f.Versions.Stable, Bytes: m.formulaDownloadSize(ctx, f)})
+	}
+	for _, token := range plan.InstallCasks {
+		cask, err := m.API.CaskByName(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		size, _ := m.Fetch.RemoteSize(ctx, cask.URL)
+		actions = append(actions, PlanAction{Action: "install", Kind: "cask", Name: token, To: cask.Version, Bytes: size})
+	}
+	for _, p := range plan.Upgrade {
+		action := PlanAction{Action: "upgrade", Kind: "formula", Name: p.Name, From: p.InstalledVersion, To: p.CurrentVersion}
+		if p.Cask {
+			action.Kind = "cask"
+			if cask, err := m.API.CaskByName(ctx, p.Name); err == nil {
+				action.Bytes, _ = m.Fetch.RemoteSize(ctx, cask.URL)
+			}
+		} else if f, err := m.API.FormulaByName(ctx, p.Name); err == nil {
+			action.Bytes = m.formulaDownloadSize(ctx, f)
+		}
+		actions = append(actions, action)
+	}
+	for _, group := range []struct {
+		action, kind string
+		names        []string
+	}{{"pin", "formula", plan.Pin}, {"pin", "cask", plan.PinCasks}, {"unpin", "formula", plan.Unpin}, {"unpin", "cask", plan.UnpinCasks}} {
+		for _, name := range group.names {
+			actions = append(actions, PlanAction{Action: group.action, Kind: group.kind, Name: name})
+		}
+	}
+	formulae, casks, err := m.InstalledVersions()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range plan.Remove {
+		_, size, _ := m.formulaStats(ctx, filepath.Join(m.Paths.Cellar, name))
+		actions = append(actions, PlanAction{Action: "remove", Kind: "formula", Name: name, From: formulae[name], Bytes: size})
+	}
+	for _, token := range plan.RemoveCasks {
+		_, size, _ := dirStats(ctx, filepath.Join(m.Paths.Caskroom, token))
+		actions = append(actions, PlanAction{Action: "remove", Kind: "cask", Name: token, From: casks[token], Bytes: size})
+	}
+	return actions, nil
+}
+
+func (m *Manager) formulaDownloadSize(ctx context.Context, f homebrewapi.Formula) int64 {
+	bottle, _, err := selectBottle(f, m.bottleTags(), InstallOptions{})
+	if err != nil {
+		return 0
+	}
+	size, _ := m.Fetch.RemoteSize(ctx, bottle.URL)
+	return size
+}
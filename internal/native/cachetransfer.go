@@ -0,0 +1,368 @@
+package native
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"ub/internal/fetch"
+)
+
+// A cache export holds cached downloads and API documents together with a
+// manifest of their URLs and digests, so a machine with network access can
+// seed the download caches of machines without it. It is a directory, or a
+// tar file when the destination ends in .tar, .tar.gz or .tgz.
+
+const cacheManifestName = "ub-cache.json"
+
+type CacheEntry struct {
+	URL string `json:"url"`
+	// API marks an API document rather than a bottle or cask download.
+	API    bool   `json:"api,omitempty"`
+	File   string `json:"file"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+	// Verified marks a download whose digest was checked against its formula
+	// or cask when it was downloaded.
+	Verified   bool             `json:"verified,omitempty"`
+	Provenance fetch.Provenance `json:"provenance"`
+}
+
+type cacheManifest struct {
+	Entries []CacheEntry `json:"entries"`
+}
+
+type CacheTransferSummary struct {
+	Entries []CacheEntry
+	Bytes   int64
+}
+
+type cacheSelection struct {
+	url string
+	api bool
+}
+
+// ExportCache writes the cached downloads of the named formulae, their
+// dependencies and the named casks, with the API documents installing them
+// reads, to dest. With no names it exports every cached download. A named
+// package whose download is not cached is an error, before anything is
+// written.
+func (m *Manager) ExportCache(ctx context.Context, dest string, names []string) (CacheTransferSummary, error) {
+	selected, err := m.selectCacheEntries(ctx, names)
+	if err != nil {
+		return CacheTransferSummary{}, err
+	}
+	w, err := newExportWriter(dest)
+	if err != nil {
+		return CacheTransferSummary{}, err
+	}
+	summary, err := m.exportCache(ctx, w, selected)
+	if closeErr := w.close(err == nil); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return CacheTransferSummary{}, err
+	}
+	return summary, nil
+}
+
+func (m *Manager) exportCache(ctx context.Context, w exportWriter, selected []cacheSelection) (CacheTransferSummary, error) {
+	checksums, err := m.Fetch.Checksums()
+	if err != nil {
+		return CacheTransferSummary{}, err
+	}
+	var summary CacheTransferSummary
+	for i, sel := range selected {
+		if err := ctx.Err(); err != nil {
+			return summary, err
+		}
+		cache := m.cacheFor(sel.api)
+		stored, ok := cache.Lookup(sel.url)
+		if !ok {
+			continue
+		}
+		size, _ := cache.CachedSize(sel.url)
+		entry := CacheEntry{
+			URL:        sel.url,
+			API:        sel.api,
+			File:       fmt.Sprintf("files/%04d-%s", i+1, exportFileName(sel.url)),
+			Size:       size,
+			Provenance: cache.Provenance(sel.url),
+		}
+		r, err := fetch.Open(stored)
+		if err != nil {
+			return summary, err
+		}
+		h := sha256.New()
+		err = w.add(entry.File, size, io.TeeReader(r, h))
+		_ = r.Close()
+		if err != nil {
+			return summary, fmt.Errorf("export %s: %w", sel.url, err)
+		}
+		entry.SHA256 = hex.EncodeToString(h.Sum(nil))
+		if recorded, ok := checksums[stored]; !sel.api && ok && strings.EqualFold(recorded.SHA256, entry.SHA256) {
+			entry.Verified = true
+		}
+		summary.Entries = append(summary.Entries, entry)
+		summary.Bytes += size
+	}
+	data, err := json.MarshalIndent(cacheManifest{Entries: summary.Entries}, "", "  ")
+	if err != nil {
+		return summary, err
+	}
+	data = append(data, '\n')
+	if err := w.add(cacheManifestName, int64(len(data)), bytes.NewReader(data)); err != nil {
+		return summary, err
+	}
+	return summary, nil
+}
+
+func (m *Manager) cacheFor(api bool) *fetch.Cache {
+	if api {
+		return m.API.Cache()
+	}
+	return m.Fetch
+}
+
+func exportFileName(url string) string {
+	name := path.Base(strings.SplitN(url, "?", 2)[0])
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' {
+			return '-'
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == ".." {
+		return "download"
+	}
+	return name
+}
+
+// selectCacheEntries lists what ExportCache exports for names.
+func (m *Manager) selectCacheEntries(ctx context.Context, names []string) ([]cacheSelection, error) {
+	var selected []cacheSelection
+	if len(names) == 0 {
+		for _, api := range []bool{false, true} {
+			paths, err := m.cacheFor(api).Entries()
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range paths {
+				// Entries cached before ub recorded their URL cannot be told apart.
+				if provenance, ok := fetch.EntryProvenance(p); ok {
+					selected = append(selected, cacheSelection{url: provenance.URL, api: api})
+				}
+			}
+		}
+		return selected, nil
+	}
+
+	var formulae, casks, missing []string
+	seen := map[string]bool{}
+	queue := append([]string{}, names...)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		f, err := m.API.FormulaByName(ctx, name)
+		if err != nil {
+			cask, caskErr := m.API.CaskByName(ctx, name)
+			if caskErr != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			casks = append(casks, cask.Token)
+			url, err := m.Plugins.RewriteURL(cask.Token, cask.URL)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := m.Fetch.Lookup(url); !ok {
+				missing = append(missing, cask.Token)
+			}
+			selected = append(selected, cacheSelection{url: url})
+			continue
+		}
+		formulae = append(formulae, f.Name)
+		queue = append(queue, f.Dependencies...)
+		// Every cached bottle goes, whatever its tag, so one export can
+		// seed machines of several platforms.
+		cached := 0
+		for _, tag := range slices.Sorted(maps.Keys(f.Bottle.Stable.Files)) {
+			url, err := m.Plugins.RewriteURL(f.Name, f.Bottle.Stable.Files[tag].URL)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := m.Fetch.Lookup(url); ok {
+				selected = append(selected, cacheSelection{url: url})
+				cached++
+			}
+		}
+		if cached == 0 {
+			missing = append(missing, f.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("no cached download for %s; install or fetch it on this machine first", joinWithAnd(missing))
+	}
+	for _, url := range m.API.DocumentURLs(formulae, casks) {
+		selected = append(selected, cacheSelection{url: url, api: true})
+	}
+	return selected, nil
+}
+
+// ImportCache adds the downloads in a cache export to the download caches,
+// checking each against the digest in its manifest first.
+func (m *Manager) ImportCache(ctx context.Context, src string) (CacheTransferSummary, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return CacheTransferSummary{}, err
+	}
+	dir := src
+	if !info.IsDir() {
+		if err := os.MkdirAll(m.Paths.Cache, 0o755); err != nil {
+			return CacheTransferSummary{}, err
+		}
+		if dir, err = os.MkdirTemp(m.Paths.Cache, ".ub-import-"); err != nil {
+			return CacheTransferSummary{}, err
+		}
+		defer os.RemoveAll(dir)
+		if err := extractArchive(ctx, src, dir, extractOptions{}); err != nil {
+			return CacheTransferSummary{}, fmt.Errorf("unpack %s: %w", src, err)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, cacheManifestName))
+	if err != nil {
+		return CacheTransferSummary{}, fmt.Errorf("%s is not a cache export: %w", src, err)
+	}
+	var manifest cacheManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return CacheTransferSummary{}, fmt.Errorf("parse %s: %w", cacheManifestName, err)
+	}
+
+	var summary CacheTransferSummary
+	for _, entry := range manifest.Entries {
+		if err := ctx.Err(); err != nil {
+			return summary, err
+		}
+		if entry.URL == "" || !filepath.IsLocal(entry.File) {
+			return summary, fmt.Errorf("%s: invalid entry for %q", cacheManifestName, entry.URL)
+		}
+		file := filepath.Join(dir, filepath.FromSlash(entry.File))
+		if err := verifySHA256(file, entry.SHA256); err != nil {
+			return summary, fmt.Errorf("import %s: %w", entry.URL, err)
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return summary, err
+		}
+		provenance := entry.Provenance
+		provenance.URL = entry.URL
+		stored, err := m.cacheFor(entry.API).Import(f, provenance)
+		_ = f.Close()
+		if err != nil {
+			return summary, fmt.Errorf("import %s: %w", entry.URL, err)
+		}
+		if entry.Verified && !entry.API {
+			if err := m.Fetch.RecordChecksum(stored, entry.URL, entry.SHA256); err != nil {
+				return summary, err
+			}
+		}
+		summary.Entries = append(summary.Entries, entry)
+		summary.Bytes += entry.Size
+	}
+	return summary, nil
+}
+
+type exportWriter interface {
+	add(name string, size int64, r io.Reader) error
+	// close finishes the export, or removes what was written unless ok.
+	close(ok bool) error
+}
+
+func newExportWriter(dest string) (exportWriter, error) {
+	switch {
+	case strings.HasSuffix(dest, ".tar"), strings.HasSuffix(dest, ".tar.gz"), strings.HasSuffix(dest, ".tgz"):
+		f, err := os.Create(dest)
+		if err != nil {
+			return nil, err
+		}
+		w := &tarExport{file: f, path: dest}
+		var out io.Writer = f
+		if !strings.HasSuffix(dest, ".tar") {
+			w.gz = gzip.NewWriter(f)
+			out = w.gz
+		}
+		w.tw = tar.NewWriter(out)
+		return w, nil
+	}
+	if err := os.MkdirAll(filepath.Join(dest, "files"), 0o755); err != nil {
+		return nil, err
+	}
+	return dirExport{dir: dest}, nil
+}
+
+type dirExport struct {
+	dir string
+}
+
+func (d dirExport) add(name string, _ int64, r io.Reader) error {
+	f, err := os.Create(filepath.Join(d.dir, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (d dirExport) close(bool) error { return nil }
+
+type tarExport struct {
+	file *os.File
+	path string
+	gz   *gzip.Writer
+	tw   *tar.Writer
+}
+
+func (t *tarExport) add(name string, size int64, r io.Reader) error {
+	if err := t.tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: size, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	n, err := io.Copy(t.tw, r)
+	if err == nil && n != size {
+		err = fmt.Errorf("read %d bytes, expected %d", n, size)
+	}
+	return err
+}
+
+func (t *tarExport) close(ok bool) error {
+	err := t.tw.Close()
+	if t.gz != nil {
+		if gzErr := t.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	if closeErr := t.file.Close(); err == nil {
+		err = closeErr
+	}
+	if !ok || err != nil {
+		_ = os.Remove(t.path)
+	}
+	return err
+}
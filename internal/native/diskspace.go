@@ -0,0 +1,137 @@
+package native
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"ub/internal/messages"
+)
+
+// Before each extraction ub checks the free space on the filesystem it
+// extracts to. Below MinFreeBytes it stops starting extractions, warns,
+// offers to remove old kegs, and waits for space to come back, so a full
+// disk surfaces as one clear error instead of ENOSPC halfway through a tar.
+
+const (
+	defaultMinFreeBytes = 256 << 20
+	defaultSpaceWait    = 2 * time.Minute
+	spacePollInterval   = 5 * time.Second
+)
+
+var ErrLowDiskSpace = errors.New("not enough free disk space")
+
+func statfsFree(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+func (m *Manager) freeSpace(dir string) (int64, error) {
+	if m.FreeSpace != nil {
+		return m.FreeSpace(dir)
+	}
+	return statfsFree(dir)
+}
+
+// waitForSpace returns once dir's filesystem has MinFreeBytes free. Callers
+// hold no extraction slot while it waits. It gives up after SpaceWait.
+func (m *Manager) waitForSpace(ctx context.Context, dir string, reporter *installReporter) error {
+	if m.MinFreeBytes <= 0 {
+		return nil
+	}
+	m.spaceMu.Lock()
+	defer m.spaceMu.Unlock()
+	free, err := m.freeSpace(dir)
+	// A filesystem that cannot report its free space is not checked.
+	if err != nil || free >= m.MinFreeBytes {
+		return nil
+	}
+	reporter.printWarning(messages.Sprintf(messages.LowDiskSpace, formatSize(free), dir, formatSize(m.MinFreeBytes)))
+	if !m.cleanupOffered && m.ConfirmCleanup != nil {
+		m.cleanupOffered = true
+		if m.ConfirmCleanup() {
+			removed, freed, err := m.removeOldKegs(ctx)
+			if err != nil {
+				return fmt.Errorf("remove old kegs: %w", err)
+			}
+			reporter.println("", messages.Sprintf(messages.RemovedOldKegs, removed, formatSize(freed)))
+		}
+	}
+	deadline := m.clock().Now().Add(m.SpaceWait)
+	for {
+		if free, err = m.freeSpace(dir); err != nil || free >= m.MinFreeBytes {
+			return nil
+		}
+		if !m.clock().Now().Before(deadline) {
+			return fmt.Errorf("%w: %s free on %s, below the %s floor", ErrLowDiskSpace, formatSize(free), dir, formatSize(m.MinFreeBytes))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-m.clock().After(spacePollInterval):
+		}
+	}
+}
+
+// removeOldKegs removes every keg but the newest finished one of each
+// formula. A keg without a manifest may still be extracting, so a formula
+// whose kegs all lack one is left alone.
+func (m *Manager) removeOldKegs(ctx context.Context) (removed int, freed int64, err error) {
+	formulae, err := os.ReadDir(m.Paths.Cellar)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+	for _, f := range formulae {
+		if !f.IsDir() || f.Name()[0] == '.' {
+			continue
+		}
+		formulaDir := filepath.Join(m.Paths.Cellar, f.Name())
+		versions, err := os.ReadDir(formulaDir)
+		if err != nil {
+			return removed, freed, err
+		}
+		keep := ""
+		for _, v := range versions {
+			if v.IsDir() && (keep == "" || compareVersions(v.Name(), keep) > 0) {
+				if _, ok := m.readKegManifest(filepath.Join(formulaDir, v.Name())); ok {
+					keep = v.Name()
+				}
+			}
+		}
+		if keep == "" {
+			continue
+		}
+		before := removed
+		for _, v := range versions {
+			if !v.IsDir() || compareVersions(v.Name(), keep) >= 0 {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return removed, freed, err
+			}
+			kegDir := filepath.Join(formulaDir, v.Name())
+			_, size, _ := m.kegStats(ctx, kegDir)
+			if err := m.fs().RemoveAll(kegDir); err != nil {
+				return removed, freed, err
+			}
+			removed++
+			freed += size
+		}
+		if removed > before {
+			if err := m.recordFormula(f.Name()); err != nil {
+				return removed, freed, err
+			}
+		}
+	}
+	return removed, freed, nil
+}
@@ -0,0 +1,133 @@
+package native
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"ub/internal/fetch"
+	"ub/internal/homebrewapi"
+)
+
+// installedSizeRatio estimates a keg's size from its bottle's when the
+// registry publishes no installed size; bottles compress about 3:1.
+const installedSizeRatio = 3
+
+// FootprintItem is one keg installing a formula would pour.
+type FootprintItem struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// Download is the bottle's size and Installed the keg's; zero when
+	// unknown. Estimated marks an Installed derived from Download.
+	Download  int64 `json:"download_bytes"`
+	Installed int64 `json:"installed_bytes"`
+	Estimated bool  `json:"estimated,omitempty"`
+}
+
+// Footprint is what installing a formula would cost: the formula and each
+// dependency not installed yet, named formula first.
+type Footprint struct {
+	Name      string          `json:"name"`
+	Items     []FootprintItem `json:"items"`
+	Download  int64           `json:"download_bytes"`
+	Installed int64           `json:"installed_bytes"`
+	Estimated bool            `json:"estimated,omitempty"`
+	// AlreadyInstalled lists dependencies that are poured already and so
+	// cost nothing.
+	AlreadyInstalled []string `json:"already_installed"`
+}
+
+// Footprint sizes installing name without installing anything. Download
+// sizes come from the download cache or HEAD requests; installed sizes from
+// the bottle's OCI image index, which Homebrew's registry annotates with
+// them, or are estimated from the download size.
+func (m *Manager) Footprint(ctx context.Context, name string) (Footprint, error) {
+	closure, err := m.resolveClosure(ctx, []string{name})
+	if err != nil {
+		return Footprint{}, err
+	}
+	root := name
+	fp := Footprint{Name: closure[root].Name, AlreadyInstalled: []string{}}
+	pending := make([]string, 0, len(closure))
+	for n, f := range closure {
+		if n != root && m.isInstalled(n, f.Versions.Stable) {
+			fp.AlreadyInstalled = append(fp.AlreadyInstalled, n)
+			continue
+		}
+		pending = append(pending, n)
+	}
+	sort.Strings(fp.AlreadyInstalled)
+	sort.Slice(pending, func(i, j int) bool {
+		if (pending[i] == root) != (pending[j] == root) {
+			return pending[i] == root
+		}
+		return pending[i] < pending[j]
+	})
+
+	fp.Items = make([]FootprintItem, len(pending))
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, sizeLookups)
+	for i, n := range pending {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer func() { <-slots; wg.Done() }()
+			fp.Items[i] = m.footprintItem(ctx, closure[n])
+		}()
+	}
+	wg.Wait()
+	for _, item := range fp.Items {
+		fp.Download += item.Download
+		fp.Installed += item.Installed
+		fp.Estimated = fp.Estimated || item.Estimated
+	}
+	return fp, ctx.Err()
+}
+
+func (m *Manager) footprintItem(ctx context.Context, f homebrewapi.Formula) FootprintItem {
+	item := FootprintItem{Name: f.Name, Version: f.Versions.Stable}
+	bottle, _, err := selectBottle(f, m.bottleTags(), InstallOptions{})
+	if err != nil {
+		return item
+	}
+	url, err := m.Plugins.RewriteURL(f.Name, bottle.URL)
+	if err != nil {
+		return item
+	}
+	item.Download, _ = m.Fetch.RemoteSize(ctx, url)
+	if entries, err := m.Fetch.OCIIndex(ctx, url, bottleTag(f)); err == nil {
+		if size, ok := installedSizeFromIndex(entries, bottle.SHA256); ok {
+			item.Installed = size
+			return item
+		}
+	}
+	if item.Download > 0 {
+		item.Installed = item.Download * installedSizeRatio
+		item.Estimated = true
+	}
+	return item
+}
+
+// bottleTag is the registry tag of f's bottles.
+func bottleTag(f homebrewapi.Formula) string {
+	if f.Revision > 0 {
+		return fmt.Sprintf("%s_%d", f.Versions.Stable, f.Revision)
+	}
+	return f.Versions.Stable
+}
+
+// installedSizeFromIndex finds the installed size Homebrew annotates the
+// index entry of the bottle with digest sha256 with.
+func installedSizeFromIndex(entries []fetch.OCIIndexEntry, sha256 string) (int64, bool) {
+	for _, entry := range entries {
+		if !strings.EqualFold(entry.Annotations["sh.brew.bottle.digest"], sha256) {
+			continue
+		}
+		size, err := strconv.ParseInt(entry.Annotations["sh.brew.bottle.installed_size"], 10, 64)
+		return size, err == nil && size > 0
+	}
+	return 0, false
+}
@@ -0,0 +1,200 @@
+package native
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A group is a named set of formulae and casks, written @name on the command
+// line, that installs and uninstalls as a unit. Groups are defined in the
+// config file or as groups/<name>.json in a cloned tap. Installing one
+// records the members it installed in <prefix>/var/ub/groups.json, so
+// uninstalling it removes what it installed, and nothing that was there
+// before, even after the definition changes.
+
+// ErrUnknownGroup is returned for a group no config or tap defines.
+var ErrUnknownGroup = errors.New("unknown group")
+
+var groupNamePattern = regexp.MustCompile(`^([A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+/)?[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// InstalledGroup is a group as it was installed.
+type InstalledGroup struct {
+	Name        string    `json:"name"`
+	Members     []string  `json:"members"`
+	InstalledAt time.Time `json:"installed_at"`
+}
+
+// GroupName returns the group arg names, without its @, and whether it
+// names one.
+func GroupName(arg string) (string, bool) {
+	name, ok := strings.CutPrefix(arg, "@")
+	return name, ok && name != ""
+}
+
+// GroupMembers returns the members of group: the config's definition, or
+// else the one in a cloned tap. A tap-qualified name, user/repo/name, only
+// looks in that tap, and a name two taps define must be qualified.
+func (m *Manager) GroupMembers(group string) ([]string, error) {
+	if !groupNamePattern.MatchString(group) {
+		return nil, fmt.Errorf("invalid group name %q", group)
+	}
+	if members, ok := m.Groups[group]; ok {
+		return members, nil
+	}
+	var files []string
+	if strings.Count(group, "/") == 2 {
+		i := strings.LastIndex(group, "/")
+		dir, err := m.resolveTap(group[:i])
+		if err != nil {
+			return nil, err
+		}
+		files = []string{filepath.Join(dir, "groups", group[i+1:]+".json")}
+	} else {
+		var err error
+		if files, err = filepath.Glob(filepath.Join(m.Paths.Repo, "Library", "Taps", "*", "*", "groups", group+".json")); err != nil {
+			return nil, err
+		}
+	}
+	var found []string
+	var members []string
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &members); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", file, err)
+		}
+		found = append(found, tapOf(file))
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("@%s: %w", group, ErrUnknownGroup)
+	case 1:
+		return members, nil
+	}
+	return nil, fmt.Errorf("@%s is defined by %s; name one as @<tap>/%s", group, joinWithAnd(found), group)
+}
+
+// tapOf returns the user/repo name of the tap holding a groups/ file.
+func tapOf(file string) string {
+	repo := filepath.Dir(filepath.Dir(file))
+	return filepath.Base(filepath.Dir(repo)) + "/" + strings.TrimPrefix(filepath.Base(repo), "homebrew-")
+}
+
+func (m *Manager) groupsFile() string {
+	return filepath.Join(m.Paths.Prefix, "var", "ub", "groups.json")
+}
+
+// InstalledGroups lists the installed groups by name.
+func (m *Manager) InstalledGroups() ([]InstalledGroup, error) {
+	data, err := os.ReadFile(m.groupsFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []InstalledGroup{}, nil
+		}
+		return nil, err
+	}
+	var groups []InstalledGroup
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", m.groupsFile(), err)
+	}
+	return groups, nil
+}
+
+func (m *Manager) writeGroups(groups []InstalledGroup) error {
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	data, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.groupsFile()), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(m.groupsFile(), append(data, '\n'), 0o644)
+}
+
+// RecordGroup records that group was installed with members. Reinstalling
+// a group adds any new members to its record.
+func (m *Manager) RecordGroup(group string, members []string) error {
+	groups, err := m.InstalledGroups()
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(groups, func(g InstalledGroup) bool { return g.Name == group })
+	if i < 0 {
+		groups = append(groups, InstalledGroup{Name: group})
+		i = len(groups) - 1
+	}
+	for _, member := range members {
+		if !slices.Contains(groups[i].Members, member) {
+			groups[i].Members = append(groups[i].Members, member)
+		}
+	}
+	sort.Strings(groups[i].Members)
+	groups[i].InstalledAt = m.clock().Now().UTC()
+	return m.writeGroups(groups)
+}
+
+// GroupRemoval returns the members uninstalling group removes: those it was
+// installed with, or its definition if it was never installed, that are
+// installed and belong to no other installed group. Shared lists the rest.
+func (m *Manager) GroupRemoval(group string) (remove, shared []string, err error) {
+	groups, err := m.InstalledGroups()
+	if err != nil {
+		return nil, nil, err
+	}
+	var members []string
+	others := map[string]bool{}
+	for _, g := range groups {
+		if g.Name == group {
+			members = g.Members
+			continue
+		}
+		for _, member := range g.Members {
+			others[member] = true
+		}
+	}
+	if members == nil {
+		if members, err = m.GroupMembers(group); err != nil {
+			return nil, nil, err
+		}
+	}
+	formulae, casks, err := m.InstalledVersions()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, member := range members {
+		_, isFormula := formulae[member]
+		_, isCask := casks[member]
+		switch {
+		case !isFormula && !isCask:
+		case others[member]:
+			shared = append(shared, member)
+		default:
+			remove = append(remove, member)
+		}
+	}
+	return remove, shared, nil
+}
+
+// ForgetGroup drops group's record after it was uninstalled.
+func (m *Manager) ForgetGroup(group string) error {
+	groups, err := m.InstalledGroups()
+	if err != nil {
+		return err
+	}
+	kept := slices.DeleteFunc(groups, func(g InstalledGroup) bool { return g.Name == group })
+	return m.writeGroups(kept)
+}
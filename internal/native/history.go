@@ -0,0 +1,37 @@
+package native
+
+import (
+	"ub/internal/history"
+	"ub/internal/state"
+)
+
+// RecordHistory adds entry to the history log in the state store.
+func (m *Manager) RecordHistory(entry history.Entry) error {
+	return m.updateState(func(tx *state.Tx) error {
+		return tx.Append(historyBucket, entry)
+	})
+}
+
+// History returns the history log, oldest first.
+func (m *Manager) History() ([]history.Entry, error) {
+	var out []history.Entry
+	err := m.readState(func(tx *state.Tx) error {
+		if tx == nil {
+			var err error
+			out, err = history.Load(history.Path(m.Paths.Prefix))
+			return err
+		}
+		for _, key := range tx.Keys(historyBucket) {
+			var entry history.Entry
+			if _, err := tx.Get(historyBucket, key, &entry); err != nil {
+				return err
+			}
+			out = append(out, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
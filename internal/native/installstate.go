@@ -0,0 +1,475 @@
+package native
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"ub/internal/history"
+	"ub/internal/state"
+)
+
+// The receipts in each keg and cask directory stay what brew reads, but ub
+// takes its view of the prefix from the state store: installs and
+// uninstalls record what they change as they go, so listing, outdated
+// checks and autoremove read one file instead of walking the Cellar and
+// Caskroom. The store also holds the tap pins, the history log and keg
+// manifests, which older versions of ub kept in loose files; the store
+// takes those in the first time it is opened. Pins that hold a package at
+// its installed version were never kept anywhere else.
+
+const (
+	formulaeBucket  = "formulae"
+	casksBucket     = "casks"
+	manifestsBucket = "manifests"
+	tapPinsBucket   = "tap-pins"
+	pinsBucket      = "pins"
+	historyBucket   = "history"
+
+	// takenInMark is set once the store holds everything in the prefix.
+	takenInMark = "taken-in"
+)
+
+// InstallState is what the Cellar and Caskroom hold, keyed by name.
+type InstallState struct {
+	Formulae map[string]InstalledFormula `json:"formulae"`
+	Casks    map[string]InstalledCask    `json:"casks"`
+}
+
+type InstalledFormula struct {
+	// Versions are the installed kegs in order; Version is the newest, and
+	// empty for a Cellar directory without any.
+	Version   string   `json:"version"`
+	Versions  []string `json:"versions"`
+	OnRequest bool     `json:"on_request,omitempty"`
+}
+
+type InstalledCask struct {
+	Version  string   `json:"version"`
+	Versions []string `json:"versions"`
+}
+
+// ErrStateDiverged is returned by ub state verify when the state store does
+// not match the Cellar and Caskroom.
+var ErrStateDiverged = errors.New("state store differs from the prefix")
+
+// StateDivergence is one package the state store and the prefix disagree
+// about.
+type StateDivergence struct {
+	Name    string `json:"name"`
+	Cask    bool   `json:"cask,omitempty"`
+	Problem string `json:"problem"`
+}
+
+func (m *Manager) stateStore() *state.Store {
+	return state.New(state.Path(m.Paths.Prefix))
+}
+
+// readState runs fn over the state store without writing to it. fn gets a
+// nil Tx when the store cannot be used as is: the manager has no prefix,
+// or is read-only and the store has not taken in the prefix yet. It then
+// reads the prefix itself.
+func (m *Manager) readState(fn func(*state.Tx) error) error {
+	if m.Paths.Prefix == "" {
+		return fn(nil)
+	}
+	called := false
+	err := m.stateStore().View(func(tx *state.Tx) error {
+		if !tx.Marked(takenInMark) {
+			return nil
+		}
+		called = true
+		return fn(tx)
+	})
+	switch {
+	case called || errors.Is(err, state.ErrNewerSchema):
+		return err
+	case m.ReadOnly:
+		return fn(nil)
+	}
+	return m.updateState(fn)
+}
+
+// updateState runs fn in a read-write transaction over the state store,
+// taking in the prefix first when the store does not hold it yet. Without
+// a prefix fn gets a nil Tx, which cannot be written.
+func (m *Manager) updateState(fn func(*state.Tx) error) error {
+	if m.Paths.Prefix == "" {
+		return fn(nil)
+	}
+	var legacy []string
+	err := m.stateStore().Update(func(tx *state.Tx) error {
+		if !tx.Marked(takenInMark) {
+			var err error
+			if legacy, err = m.takeIn(tx); err != nil {
+				return err
+			}
+		}
+		return fn(tx)
+	})
+	if err != nil {
+		return err
+	}
+	for _, path := range legacy {
+		_ = os.Remove(path)
+	}
+	return nil
+}
+
+// takeIn fills the store from the prefix: the Cellar and Caskroom are
+// indexed, and the tap pins, history log and keg manifests older versions
+// of ub kept in files are moved in. It returns those files, to remove once
+// the transaction has committed.
+func (m *Manager) takeIn(tx *state.Tx) ([]string, error) {
+	st, err := m.indexInstalled(tx)
+	if err != nil {
+		return nil, err
+	}
+	legacy := []string{m.tapPinsFile(), history.Path(m.Paths.Prefix)}
+	pins, err := m.legacyTapPins()
+	if err != nil {
+		return nil, err
+	}
+	for name, pin := range pins {
+		if err := tx.Put(tapPinsBucket, name, pin); err != nil {
+			return nil, err
+		}
+	}
+	entries, err := history.Load(history.Path(m.Paths.Prefix))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if err := tx.Append(historyBucket, entry); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(st.Formulae)) {
+		for _, version := range st.Formulae[name].Versions {
+			kegDir := filepath.Join(m.Paths.Cellar, name, version)
+			manifest, ok := legacyKegManifest(kegDir)
+			if !ok {
+				continue
+			}
+			if err := tx.Put(manifestsBucket, name+"/"+version, manifest); err != nil {
+				return nil, err
+			}
+			legacy = append(legacy, filepath.Join(kegDir, kegManifestName))
+		}
+	}
+	return legacy, tx.Mark(takenInMark)
+}
+
+// InstallState returns what the Cellar and Caskroom hold, as the state
+// store records it. The prefix is read instead when the store cannot be
+// used: see readState, and when it cannot be opened at all.
+func (m *Manager) InstallState() (InstallState, error) {
+	var out InstallState
+	err := m.readState(func(tx *state.Tx) (err error) {
+		if tx == nil {
+			out, err = m.indexInstalled(nil)
+			return err
+		}
+		out, err = storedState(tx)
+		return err
+	})
+	if err != nil {
+		return m.indexInstalled(nil)
+	}
+	return out, nil
+}
+
+// StoredState returns what the state store holds, without taking in the
+// prefix first.
+func (m *Manager) StoredState() (InstallState, error) {
+	var out InstallState
+	err := m.stateStore().View(func(tx *state.Tx) (err error) {
+		out, err = storedState(tx)
+		return err
+	})
+	if err != nil {
+		return InstallState{}, err
+	}
+	return out, nil
+}
+
+func storedState(tx *state.Tx) (InstallState, error) {
+	out := InstallState{Formulae: map[string]InstalledFormula{}, Casks: map[string]InstalledCask{}}
+	for _, name := range tx.Keys(formulaeBucket) {
+		var record InstalledFormula
+		if _, err := tx.Get(formulaeBucket, name, &record); err != nil {
+			return InstallState{}, err
+		}
+		out.Formulae[name] = record
+	}
+	for _, token := range tx.Keys(casksBucket) {
+		var record InstalledCask
+		if _, err := tx.Get(casksBucket, token, &record); err != nil {
+			return InstallState{}, err
+		}
+		out.Casks[token] = record
+	}
+	return out, nil
+}
+
+// RebuildState indexes every receipt in the Cellar and Caskroom again,
+// replacing what the store recorded about them, for when something other
+// than ub changed the prefix. Tap pins, the history log and the manifests
+// of kegs still installed are kept. A store too damaged to open is moved
+// aside and started again.
+func (m *Manager) RebuildState() (InstallState, error) {
+	var out InstallState
+	err := m.updateState(func(tx *state.Tx) (err error) {
+		out, err = m.indexInstalled(tx)
+		return err
+	})
+	if err != nil {
+		return InstallState{}, err
+	}
+	return out, nil
+}
+
+// VerifyState compares the state store with the receipts in the Cellar and
+// Caskroom, changing neither.
+func (m *Manager) VerifyState() ([]StateDivergence, error) {
+	stored, err := m.StoredState()
+	if err != nil {
+		return nil, err
+	}
+	actual, err := m.indexInstalled(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []StateDivergence
+	for _, name := range slices.Sorted(maps.Keys(actual.Formulae)) {
+		want, got := actual.Formulae[name], stored.Formulae[name]
+		_, known := stored.Formulae[name]
+		if problem := versionDivergence(known, got.Versions, want.Versions); problem != "" {
+			out = append(out, StateDivergence{Name: name, Problem: problem})
+		} else if got.OnRequest != want.OnRequest {
+			out = append(out, StateDivergence{Name: name, Problem: fmt.Sprintf("indexed as %s, receipt says %s", requestKind(got.OnRequest), requestKind(want.OnRequest))})
+		}
+	}
+	for _, token := range slices.Sorted(maps.Keys(actual.Casks)) {
+		want, got := actual.Casks[token], stored.Casks[token]
+		_, known := stored.Casks[token]
+		if problem := versionDivergence(known, got.Versions, want.Versions); problem != "" {
+			out = append(out, StateDivergence{Name: token, Cask: true, Problem: problem})
+		} else if got.Version != want.Version {
+			out = append(out, StateDivergence{Name: token, Cask: true, Problem: fmt.Sprintf("indexed version %s, receipt says %s", got.Version, want.Version)})
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(stored.Formulae)) {
+		if _, ok := actual.Formulae[name]; !ok {
+			out = append(out, StateDivergence{Name: name, Problem: "indexed but not installed"})
+		}
+	}
+	for _, token := range slices.Sorted(maps.Keys(stored.Casks)) {
+		if _, ok := actual.Casks[token]; !ok {
+			out = append(out, StateDivergence{Name: token, Cask: true, Problem: "indexed but not installed"})
+		}
+	}
+	return out, nil
+}
+
+func versionDivergence(known bool, indexed, installed []string) string {
+	if !known {
+		return "installed but not indexed"
+	}
+	if !slices.Equal(indexed, installed) {
+		return fmt.Sprintf("indexed versions [%s], installed [%s]", strings.Join(indexed, ", "), strings.Join(installed, ", "))
+	}
+	return ""
+}
+
+func requestKind(onRequest bool) string {
+	if onRequest {
+		return "installed on request"
+	}
+	return "a dependency"
+}
+
+// installedKegs maps each directory in root to its version directories.
+func installedKegs(root string) (map[string][]string, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string][]string{}, nil
+		}
+		return nil, err
+	}
+	out := make(map[string][]string, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if out[e.Name()], err = kegVersions(filepath.Join(root, e.Name())); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// kegVersions lists the version directories in dir oldest first, or
+// returns nil when dir does not exist.
+func kegVersions(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	versions := []string{}
+	for _, v := range entries {
+		if v.IsDir() {
+			versions = append(versions, v.Name())
+		}
+	}
+	sortVersions(versions)
+	return versions, nil
+}
+
+// indexInstalled reads every receipt in the Cellar and Caskroom. With a
+// writable tx it replaces the store's records with what it read, and drops
+// the manifests of kegs that are gone.
+func (m *Manager) indexInstalled(tx *state.Tx) (InstallState, error) {
+	formulae, err := installedKegs(m.Paths.Cellar)
+	if err != nil {
+		return InstallState{}, err
+	}
+	casks, err := installedKegs(m.Paths.Caskroom)
+	if err != nil {
+		return InstallState{}, err
+	}
+	out := InstallState{
+		Formulae: make(map[string]InstalledFormula, len(formulae)),
+		Casks:    make(map[string]InstalledCask, len(casks)),
+	}
+	for name, versions := range formulae {
+		out.Formulae[name] = m.formulaRecord(name, versions)
+	}
+	for token, versions := range casks {
+		out.Casks[token] = m.caskRecord(token, versions)
+	}
+	if !tx.Writable() {
+		return out, nil
+	}
+	if err := tx.Clear(formulaeBucket); err != nil {
+		return InstallState{}, err
+	}
+	if err := tx.Clear(casksBucket); err != nil {
+		return InstallState{}, err
+	}
+	for name, record := range out.Formulae {
+		if err := tx.Put(formulaeBucket, name, record); err != nil {
+			return InstallState{}, err
+		}
+	}
+	for token, record := range out.Casks {
+		if err := tx.Put(casksBucket, token, record); err != nil {
+			return InstallState{}, err
+		}
+	}
+	for _, key := range tx.Keys(manifestsBucket) {
+		name, version, _ := strings.Cut(key, "/")
+		if !slices.Contains(formulae[name], version) {
+			if err := tx.Delete(manifestsBucket, key); err != nil {
+				return InstallState{}, err
+			}
+		}
+	}
+	return out, nil
+}
+
+func (m *Manager) formulaRecord(name string, versions []string) InstalledFormula {
+	record := InstalledFormula{Versions: versions}
+	if len(versions) > 0 {
+		record.Version = versions[len(versions)-1]
+		record.OnRequest = receiptOnRequest(filepath.Join(m.Paths.Cellar, name, record.Version))
+	}
+	return record
+}
+
+func (m *Manager) caskRecord(token string, versions []string) InstalledCask {
+	record := InstalledCask{Versions: versions}
+	if len(versions) > 0 {
+		record.Version = versions[len(versions)-1]
+	}
+	if receipt, err := m.readCaskReceipt(token); err == nil {
+		record.Version = receipt.Version
+	}
+	return record
+}
+
+// recordFormula brings the store's record of name in line with its Cellar
+// directory after an install or uninstall changed it, dropping the
+// manifests of kegs that are gone.
+func (m *Manager) recordFormula(name string) error {
+	err := m.updateState(func(tx *state.Tx) error {
+		if !tx.Writable() {
+			return nil
+		}
+		versions, err := kegVersions(filepath.Join(m.Paths.Cellar, name))
+		if err != nil {
+			return err
+		}
+		for _, key := range tx.Keys(manifestsBucket) {
+			if version, ok := strings.CutPrefix(key, name+"/"); ok && !slices.Contains(versions, version) {
+				if err := tx.Delete(manifestsBucket, key); err != nil {
+					return err
+				}
+			}
+		}
+		if versions == nil {
+			return tx.Delete(formulaeBucket, name)
+		}
+		return tx.Put(formulaeBucket, name, m.formulaRecord(name, versions))
+	})
+	if err != nil {
+		return fmt.Errorf("record %s in the state store: %w", name, err)
+	}
+	return nil
+}
+
+// recordCask brings the store's record of token in line with its Caskroom
+// directory after an install or uninstall changed it.
+func (m *Manager) recordCask(token string) error {
+	err := m.updateState(func(tx *state.Tx) error {
+		if !tx.Writable() {
+			return nil
+		}
+		versions, err := kegVersions(filepath.Join(m.Paths.Caskroom, token))
+		if err != nil {
+			return err
+		}
+		if versions == nil {
+			return tx.Delete(casksBucket, token)
+		}
+		return tx.Put(casksBucket, token, m.caskRecord(token, versions))
+	})
+	if err != nil {
+		return fmt.Errorf("record %s in the state store: %w", token, err)
+	}
+	return nil
+}
+
+func receiptOnRequest(kegDir string) bool {
+	data, err := os.ReadFile(filepath.Join(kegDir, "INSTALL_RECEIPT.json"))
+	if err != nil {
+		return false
+	}
+	var receipt struct {
+		InstalledOnRequest bool `json:"installed_on_request"`
+	}
+	if err := json.Unmarshal(data, &receipt); err != nil {
+		return false
+	}
+	return receipt.InstalledOnRequest
+}
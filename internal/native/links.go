@@ -0,0 +1,407 @@
+package native
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"ub/internal/messages"
+)
+
+// A formula's links are made as one transaction. The links about to be
+// made are written to a journal under <prefix>/var/ub/link-journal first,
+// and each link is then swapped in by renaming a fresh symlink over the old
+// one, so a link is never missing. A journal left by a crash or a failed
+// link is replayed by the next command that links, which finishes the job:
+// making a link twice is harmless. Generations need none of this, since
+// their links only go live when the generation is committed.
+
+type plannedLink struct {
+	Path   string `json:"path"`
+	Target string `json:"target"`
+}
+
+type linkJournal struct {
+	Formula string        `json:"formula"`
+	Version string        `json:"version"`
+	Links   []plannedLink `json:"links"`
+}
+
+func (m *Manager) linkJournalDir() string {
+	return filepath.Join(m.Paths.Prefix, "var", "ub", "link-journal")
+}
+
+func (m *Manager) applyLinkTxn(txn linkJournal) error {
+	if m.generation != nil {
+		return makeLinks(txn.Links)
+	}
+	for _, err := range m.replayLinkJournals() {
+		fmt.Fprintln(os.Stderr, messages.Sprintf(messages.Warning, err))
+	}
+	if len(txn.Links) == 0 {
+		return nil
+	}
+	journal := filepath.Join(m.linkJournalDir(), txn.Formula+".json")
+	if err := writeLinkJournal(journal, txn); err != nil {
+		return err
+	}
+	if err := makeLinks(txn.Links); err != nil {
+		return fmt.Errorf("link %s: %w", txn.Formula, err)
+	}
+	return os.Remove(journal)
+}
+
+func writeLinkJournal(path string, txn linkJournal) error {
+	data, err := json.MarshalIndent(txn, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write link journal: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("write link journal: %w", err)
+	}
+	return nil
+}
+
+// makeLinks points each link at its target, replacing whatever is there.
+func makeLinks(links []plannedLink) error {
+	for _, link := range links {
+		if current, err := os.Readlink(link.Path); err == nil && current == link.Target {
+			continue
+		}
+		tmp := filepath.Join(filepath.Dir(link.Path), ".ub-link-"+filepath.Base(link.Path))
+		_ = os.Remove(tmp)
+		if err := os.Symlink(link.Target, tmp); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, link.Path); err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+	}
+	return nil
+}
+
+// LinkConflictPolicy says what linking does about a file in bin or sbin that
+// ub did not link there, such as a script the user put in the prefix.
+type LinkConflictPolicy string
+
+const (
+	// LinkConflictFail links nothing and lists the conflicts.
+	LinkConflictFail LinkConflictPolicy = "error"
+	// LinkConflictOverwrite replaces conflicting links. Regular files are
+	// backed up rather than deleted.
+	LinkConflictOverwrite LinkConflictPolicy = "overwrite"
+	// LinkConflictSkip leaves conflicting files alone and links the rest.
+	LinkConflictSkip LinkConflictPolicy = "skip"
+	// LinkConflictBackup moves every conflicting file aside before linking.
+	LinkConflictBackup LinkConflictPolicy = "backup"
+)
+
+func ParseLinkConflictPolicy(s string) (LinkConflictPolicy, error) {
+	switch p := LinkConflictPolicy(s); p {
+	case LinkConflictFail, LinkConflictOverwrite, LinkConflictSkip, LinkConflictBackup:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid link conflict policy %q (want error, overwrite, skip or backup)", s)
+}
+
+// LinkConflictError lists the files in the way of linking a formula.
+type LinkConflictError struct {
+	Formula string
+	Paths   []string
+}
+
+func (e *LinkConflictError) Error() string {
+	return fmt.Sprintf("cannot link %s: %s not linked by ub; pass --overwrite to replace them, or --link-conflicts=skip|backup", e.Formula, joinWithAnd(e.Paths))
+}
+
+// resolveLinkConflicts applies m.LinkConflicts to the links in the way of
+// files ub did not link, and returns the links still to make.
+func (m *Manager) resolveLinkConflicts(name string, links []plannedLink) ([]plannedLink, error) {
+	var conflicts []string
+	for _, link := range links {
+		if m.linkConflicts(link) {
+			conflicts = append(conflicts, link.Path)
+		}
+	}
+	if len(conflicts) == 0 {
+		return links, nil
+	}
+	policy := m.LinkConflicts
+	switch policy {
+	case "", LinkConflictFail:
+		return nil, &LinkConflictError{Formula: name, Paths: conflicts}
+	case LinkConflictSkip:
+		kept := links[:0:0]
+		for _, link := range links {
+			if slices.Contains(conflicts, link.Path) {
+				fmt.Fprintln(os.Stderr, messages.Sprintf(messages.Warning, fmt.Sprintf("not linking %s: the file there was not linked by ub", link.Path)))
+				continue
+			}
+			kept = append(kept, link)
+		}
+		return kept, nil
+	}
+	stamp := m.clock().Now().UTC().Format("20060102T150405Z")
+	for _, path := range conflicts {
+		info, err := os.Lstat(path)
+		if err != nil {
+			return nil, err
+		}
+		if policy == LinkConflictOverwrite && info.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+		if err := m.backUpLinkConflict(path, stamp); err != nil {
+			return nil, err
+		}
+	}
+	return links, nil
+}
+
+// linkConflicts reports whether something other than one of ub's links sits
+// where link goes. Links into the Cellar are ub's, whichever formula they
+// belong to.
+func (m *Manager) linkConflicts(link plannedLink) bool {
+	info, err := os.Lstat(link.Path)
+	if err != nil {
+		return false
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return true
+	}
+	target, err := os.Readlink(link.Path)
+	if err != nil {
+		return true
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(link.Path), target)
+	}
+	cellar := filepath.Clean(m.Paths.Cellar) + string(os.PathSeparator)
+	return !strings.HasPrefix(filepath.Clean(target), cellar)
+}
+
+// backUpLinkConflict moves path to <prefix>/var/ub/link-backups/<stamp>.
+func (m *Manager) backUpLinkConflict(path, stamp string) error {
+	dir := filepath.Join(m.Paths.Prefix, "var", "ub", "link-backups", stamp, filepath.Base(filepath.Dir(path)))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	dst := filepath.Join(dir, filepath.Base(path))
+	if err := os.Rename(path, dst); err != nil {
+		return fmt.Errorf("back up %s: %w", path, err)
+	}
+	messages.Println(messages.BackedUpFile, path, dst)
+	return nil
+}
+
+// pendingLinkJournals reads the journals of link transactions that never
+// finished, by formula.
+func (m *Manager) pendingLinkJournals() ([]linkJournal, error) {
+	entries, err := os.ReadDir(m.linkJournalDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var journals []linkJournal
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(m.linkJournalDir(), entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var txn linkJournal
+		if err := json.Unmarshal(data, &txn); err != nil {
+			return nil, fmt.Errorf("parse link journal %s: %w", entry.Name(), err)
+		}
+		journals = append(journals, txn)
+	}
+	return journals, nil
+}
+
+// replayLinkJournals finishes the link transactions that never did. A keg
+// removed since is skipped, and its journal dropped.
+func (m *Manager) replayLinkJournals() []error {
+	journals, err := m.pendingLinkJournals()
+	if err != nil {
+		return []error{err}
+	}
+	var errs []error
+	for _, txn := range journals {
+		if m.isInstalled(txn.Formula, txn.Version) {
+			if err := makeLinks(txn.Links); err != nil {
+				errs = append(errs, fmt.Errorf("finish linking %s %s: %w", txn.Formula, txn.Version, err))
+				continue
+			}
+		}
+		_ = os.Remove(filepath.Join(m.linkJournalDir(), txn.Formula+".json"))
+	}
+	return errs
+}
+
+// LinkReport lists what is wrong with the link farm.
+type LinkReport struct {
+	// Pending are formulae whose linking was interrupted.
+	Pending []string
+	// Broken are links into the Cellar whose target is gone.
+	Broken []string
+	// Unlinked are the executables of the newest keg of each formula whose
+	// link is missing or points at another version of the formula.
+	Unlinked []string
+}
+
+func (r LinkReport) Problems() int {
+	return len(r.Pending) + len(r.Broken) + len(r.Unlinked)
+}
+
+// CheckLinks verifies that the link farm matches the Cellar.
+func (m *Manager) CheckLinks(ctx context.Context) (LinkReport, error) {
+	var report LinkReport
+	journals, err := m.pendingLinkJournals()
+	if err != nil {
+		return report, err
+	}
+	for _, txn := range journals {
+		report.Pending = append(report.Pending, txn.Formula)
+	}
+
+	cellar := filepath.Clean(m.Paths.Cellar) + string(os.PathSeparator)
+	for _, root := range []string{m.Paths.Bin, m.Paths.Sbin} {
+		entries, err := os.ReadDir(root)
+		if err != nil && !os.IsNotExist(err) {
+			return report, err
+		}
+		for _, entry := range entries {
+			path := filepath.Join(root, entry.Name())
+			target, err := os.Readlink(path)
+			if err != nil || !strings.HasPrefix(target, cellar) {
+				continue
+			}
+			if _, err := os.Stat(target); os.IsNotExist(err) {
+				report.Broken = append(report.Broken, path)
+			}
+		}
+	}
+
+	formulae, err := os.ReadDir(m.Paths.Cellar)
+	if err != nil && !os.IsNotExist(err) {
+		return report, err
+	}
+	for _, f := range formulae {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if !f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		version, err := m.latestInstalledVersion(f.Name())
+		if err != nil || version == "" {
+			continue
+		}
+		kegDir := filepath.Join(m.Paths.Cellar, f.Name(), version)
+		formulaDir := filepath.Join(m.Paths.Cellar, f.Name()) + string(os.PathSeparator)
+		for _, leaf := range []string{"bin", "sbin"} {
+			root := m.Paths.Bin
+			if leaf == "sbin" {
+				root = m.Paths.Sbin
+			}
+			links, err := planLinks(kegDir, root, leaf)
+			if err != nil {
+				return report, err
+			}
+			for _, link := range links {
+				target, err := os.Readlink(link.Path)
+				// A link to another formula's file of the same name is a
+				// conflict the last install won, not a half-made link.
+				if err != nil || target != link.Target && strings.HasPrefix(target, formulaDir) {
+					report.Unlinked = append(report.Unlinked, link.Path)
+				}
+			}
+		}
+	}
+	sort.Strings(report.Pending)
+	sort.Strings(report.Broken)
+	sort.Strings(report.Unlinked)
+	return report, nil
+}
+
+// RepairLinks finishes interrupted link transactions, removes broken links
+// into the Cellar and relinks the newest keg of every formula CheckLinks
+// finds half-linked.
+func (m *Manager) RepairLinks(ctx context.Context) (LinkReport, error) {
+	if err := m.EnsureLayout(); err != nil {
+		return LinkReport{}, err
+	}
+	handle, err := m.acquireLock(ctx, m.Paths.Cellar)
+	if err != nil {
+		return LinkReport{}, err
+	}
+	defer handle.Release()
+	if errs := m.replayLinkJournals(); len(errs) > 0 {
+		return LinkReport{}, errs[0]
+	}
+	report, err := m.CheckLinks(ctx)
+	if err != nil {
+		return report, err
+	}
+	for _, path := range report.Broken {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return report, err
+		}
+	}
+	relinked := map[string]bool{}
+	for _, path := range report.Unlinked {
+		name := m.unlinkedFormula(path)
+		if name == "" || relinked[name] {
+			continue
+		}
+		relinked[name] = true
+		version, err := m.latestInstalledVersion(name)
+		if err != nil {
+			return report, err
+		}
+		if _, err := m.linkFormula(name, version); err != nil {
+			return report, err
+		}
+	}
+	return m.CheckLinks(ctx)
+}
+
+// unlinkedFormula returns the formula whose newest keg provides the
+// executable a link in CheckLinks' Unlinked list should point at.
+func (m *Manager) unlinkedFormula(path string) string {
+	formulae, err := os.ReadDir(m.Paths.Cellar)
+	if err != nil {
+		return ""
+	}
+	for _, f := range formulae {
+		version, err := m.latestInstalledVersion(f.Name())
+		if err != nil || version == "" {
+			continue
+		}
+		leaf := "bin"
+		if filepath.Dir(path) == filepath.Clean(m.Paths.Sbin) {
+			leaf = "sbin"
+		}
+		if _, err := os.Lstat(filepath.Join(m.Paths.Cellar, f.Name(), version, leaf, filepath.Base(path))); err == nil {
+			return f.Name()
+		}
+	}
+	return ""
+}
@@ -3,31 +3,63 @@ package native
 import (
 	"archive/tar"
 	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
 	"compress/gzip"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net/url"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"ub/internal/fetch"
+	"ub/internal/formula"
 	"ub/internal/homebrewapi"
 	"ub/internal/lock"
+	"ub/internal/messages"
+	"ub/internal/pipeline"
+	"ub/internal/plugin"
 	"ub/internal/scheduler"
+	"ub/internal/state"
+	"ub/internal/stats"
+	"ub/internal/trace"
 
 	"golang.org/x/term"
 )
 
+var (
+	ErrNotInstalled     = errors.New("not installed")
+	ErrChecksumMismatch = errors.New("sha256 mismatch")
+	ErrHasDependents    = errors.New("required by installed formulae")
+)
+
+type PartialError struct {
+	Completed []string
+	Err       error
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("%v (completed: %s)", e.Err, joinWithAnd(e.Completed))
+}
+
+func (e *PartialError) Unwrap() error { return e.Err }
+
 type Paths struct {
 	BaseDir      string
 	Prefix       string
@@ -38,25 +70,242 @@ type Paths struct {
 	Bin          string
 	Sbin         string
 	Applications string
+	Fonts        string
+}
+
+// PathOverrides replaces single locations of the default layout; empty
+// fields keep the default. Cellar, Caskroom and the link farm follow
+// Prefix unless they are overridden too.
+type PathOverrides struct {
+	Prefix     string
+	Cellar     string
+	Caskroom   string
+	Cache      string
+	Repository string
 }
 
 func DefaultPaths() Paths {
+	return ResolvePaths(PathOverrides{})
+}
+
+// ResolvePaths builds the layout from UB_BASE_DIR, then fallback (usually
+// the config file), then the UB_PREFIX, UB_CELLAR, UB_CASKROOM,
+// UB_CACHE_DIR and UB_REPOSITORY environment variables, later ones winning.
+func ResolvePaths(fallback PathOverrides) Paths {
+	o := PathOverrides{
+		Prefix:     firstPath(os.Getenv("UB_PREFIX"), fallback.Prefix),
+		Cellar:     firstPath(os.Getenv("UB_CELLAR"), fallback.Cellar),
+		Caskroom:   firstPath(os.Getenv("UB_CASKROOM"), fallback.Caskroom),
+		Cache:      firstPath(os.Getenv("UB_CACHE_DIR"), fallback.Cache),
+		Repository: firstPath(os.Getenv("UB_REPOSITORY"), fallback.Repository),
+	}
 	base := os.Getenv("UB_BASE_DIR")
-	if strings.TrimSpace(base) == "" {
-		base = detectWritableBaseDir()
+	selfContained := strings.TrimSpace(base) != ""
+	if !selfContained {
+		if o.Prefix != "" {
+			base = filepath.Dir(o.Prefix)
+		} else {
+			base = detectWritableBaseDir()
+		}
 	}
-	prefix := filepath.Join(base, "ub")
+	prefix := firstPath(o.Prefix, filepath.Join(base, "ub"))
 	return Paths{
 		BaseDir:      base,
 		Prefix:       prefix,
-		Repo:         filepath.Join(base, "unbrew"),
+		Repo:         firstPath(o.Repository, filepath.Join(base, "unbrew")),
+		Cellar:       firstPath(o.Cellar, filepath.Join(prefix, "Cellar")),
+		Caskroom:     firstPath(o.Caskroom, filepath.Join(prefix, "Caskroom")),
+		Cache:        firstPath(o.Cache, defaultCacheDir(prefix, selfContained)),
+		Bin:          filepath.Join(prefix, "bin"),
+		Sbin:         filepath.Join(prefix, "sbin"),
+		Applications: filepath.Join(prefix, "Applications"),
+		Fonts:        defaultFontsDir(),
+	}
+}
+
+// defaultCacheDir keeps downloads out of the prefix on Linux, under
+// $XDG_CACHE_HOME/ub, so backups and cleanup tools treat them as a cache. A
+// tree rooted at UB_BASE_DIR keeps everything inside it.
+func defaultCacheDir(prefix string, selfContained bool) string {
+	if runtime.GOOS != "linux" || selfContained {
+		return legacyCacheDir(prefix)
+	}
+	cacheHome := os.Getenv("XDG_CACHE_HOME")
+	if !filepath.IsAbs(cacheHome) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return legacyCacheDir(prefix)
+		}
+		cacheHome = filepath.Join(home, ".cache")
+	}
+	return filepath.Join(cacheHome, "ub")
+}
+
+func legacyCacheDir(prefix string) string {
+	return filepath.Join(prefix, "cache")
+}
+
+// MigrateCache moves a download cache left inside the prefix by an older ub
+// to Paths.Cache. It returns the old location when something was moved.
+func (m *Manager) MigrateCache() (string, error) {
+	legacy := legacyCacheDir(m.Paths.Prefix)
+	if legacy == m.Paths.Cache {
+		return "", nil
+	}
+	if info, err := os.Stat(legacy); err != nil || !info.IsDir() {
+		return "", nil
+	}
+	if entries, err := os.ReadDir(m.Paths.Cache); err == nil && len(entries) > 0 {
+		return "", nil
+	}
+	if rel, err := filepath.Rel(legacy, m.Paths.Cache); err == nil && filepath.IsLocal(rel) {
+		return "", fmt.Errorf("the cache at %s is inside the old cache at %s, so the old cache was left in place", m.Paths.Cache, legacy)
+	}
+	fsys := m.fs()
+	if err := fsys.MkdirAll(filepath.Dir(m.Paths.Cache), 0o755); err != nil {
+		return "", fmt.Errorf("migrate cache: %w", err)
+	}
+	_ = os.Remove(m.Paths.Cache)
+	if err := fsys.Rename(legacy, m.Paths.Cache); err != nil {
+		// Typically a different filesystem. The cache holds the recorded
+		// bottle checksums, so copy it, and remove the old one only once
+		// every file is across.
+		if copyErr := copyTree(fsys, legacy, m.Paths.Cache); copyErr != nil {
+			// Drop the partial copy, which was empty before, so the next
+			// run tries again.
+			_ = fsys.RemoveAll(m.Paths.Cache)
+			return "", fmt.Errorf("could not move the cache at %s to %s, so it was left in place: %w", legacy, m.Paths.Cache, copyErr)
+		}
+		if rmErr := fsys.RemoveAll(legacy); rmErr != nil {
+			return "", fmt.Errorf("copied the cache at %s to %s but could not remove it: %w", legacy, m.Paths.Cache, rmErr)
+		}
+	}
+	return legacy, nil
+}
+
+// copyTree copies the directories, files and symlinks under src to dst.
+// Each file is written under a temporary name and renamed into place, so dst
+// never holds a partial file.
+func copyTree(fsys FS, src, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case entry.IsDir():
+			return fsys.MkdirAll(target, info.Mode().Perm()|0o700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case !info.Mode().IsRegular():
+			return fmt.Errorf("%s is not a regular file", path)
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		tmp := target + ".ub-copy"
+		out, err := fsys.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			_ = out.Close()
+			_ = os.Remove(tmp)
+			return err
+		}
+		if err := out.Close(); err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+		return fsys.Rename(tmp, target)
+	})
+}
+
+// firstPath returns the first non-empty path, with a leading ~ expanded and
+// made absolute.
+func firstPath(paths ...string) string {
+	for _, p := range paths {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if p == "~" || strings.HasPrefix(p, "~/") {
+			if home, err := os.UserHomeDir(); err == nil {
+				p = filepath.Join(home, p[1:])
+			}
+		}
+		if abs, err := filepath.Abs(p); err == nil {
+			p = abs
+		}
+		return p
+	}
+	return ""
+}
+
+// defaultFontsDir is where font casks go: ~/Library/Fonts on macOS and the
+// XDG user font directory elsewhere, both picked up without a cache rebuild.
+func defaultFontsDir() string {
+	home, _ := os.UserHomeDir()
+	if runtime.GOOS == "darwin" {
+		return filepath.Join(home, "Library", "Fonts")
+	}
+	dataHome := strings.TrimSpace(os.Getenv("XDG_DATA_HOME"))
+	if dataHome == "" {
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dataHome, "fonts")
+}
+
+// PathsForArch returns the layout for an x86_64 tree on Apple Silicon: a
+// parallel <base>/ub-x86_64 prefix with its own Cellar and link farm (like
+// /usr/local next to /opt/homebrew). The API repository and download cache are
+// shared with the native tree.
+func PathsForArch(native Paths, arch string) Paths {
+	prefix := filepath.Join(native.BaseDir, "ub-"+tagArch(arch))
+	return Paths{
+		BaseDir:      native.BaseDir,
+		Prefix:       prefix,
+		Repo:         native.Repo,
 		Cellar:       filepath.Join(prefix, "Cellar"),
 		Caskroom:     filepath.Join(prefix, "Caskroom"),
-		Cache:        filepath.Join(prefix, "cache"),
+		Cache:        native.Cache,
 		Bin:          filepath.Join(prefix, "bin"),
 		Sbin:         filepath.Join(prefix, "sbin"),
-		Applications: filepath.Join(prefix, "Applications"),
+		Applications: native.Applications,
+		Fonts:        native.Fonts,
+	}
+}
+
+// NormalizeArch maps user spellings (x86_64, aarch64, ...) to GOARCH names.
+func NormalizeArch(arch string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(arch)) {
+	case "x86_64", "amd64", "intel":
+		return "amd64", nil
+	case "arm64", "aarch64":
+		return "arm64", nil
+	}
+	return "", fmt.Errorf("unknown architecture %q (expected x86_64 or arm64)", arch)
+}
+
+func tagArch(goarch string) string {
+	if goarch == "amd64" {
+		return "x86_64"
 	}
+	return goarch
 }
 
 func detectWritableBaseDir() string {
@@ -87,6 +336,100 @@ type Manager struct {
 	Fetch   *fetch.Cache
 	Paths   Paths
 	Workers int
+	// DownloadWorkers bounds installs while they are downloading; zero
+	// means twice Workers. Workers still bounds extraction.
+	DownloadWorkers int
+	// MinWorkers and MaxWorkers bound what --jobs auto picks; zero is
+	// unbounded.
+	MinWorkers, MaxWorkers int
+	// OrderedOutput holds each install's lines until it finishes and prints
+	// them in dependency order, so parallel runs log the same way every time.
+	OrderedOutput bool
+	// LockWait is how long to queue behind another ub holding the Cellar or
+	// Caskroom lock: zero fails at once, negative waits indefinitely.
+	LockWait time.Duration
+	Plugins  *plugin.Host
+	Stats    *stats.Recorder
+	// Protected packages are never autoremoved.
+	Protected []string
+	// Arch is the GOARCH of the tree being managed when it differs from the host.
+	Arch string
+	// Workspace is the project-local prefix being managed, if any.
+	Workspace string
+	// ReadOnly is set by UseReadOnly; m then never writes to the prefix.
+	ReadOnly bool
+	// AllowSetuid keeps setuid/setgid bits when extracting archives.
+	AllowSetuid bool
+	// CompressCache stores downloads that are not compressed already, such
+	// as API documents, gzipped in the download cache.
+	CompressCache bool
+	// StallTimeout is how long a bottle or cask download may go without
+	// receiving data before the attempt is retried. Zero means
+	// fetch.DownloadStallTimeout; negative turns the check off. Set it
+	// with SetStallTimeout.
+	StallTimeout time.Duration
+	// Groups are the package groups defined in the config file, by name.
+	Groups map[string][]string
+	// LinkConflicts says what linking does about files in bin and sbin that
+	// ub did not put there; the zero value is LinkConflictFail.
+	LinkConflicts LinkConflictPolicy
+	// Progress, when set, receives the progress of each install as a
+	// whole whenever it changes.
+	Progress func(PlanProgress)
+	// ConfirmQuit asks whether a running app may be quit before it is
+	// replaced or removed. When nil, running apps are left alone and the
+	// operation fails.
+	ConfirmQuit func(app string) bool
+	// MinFreeBytes is the free space extraction needs on the Cellar's or
+	// Caskroom's filesystem; zero or negative turns the check off. Below it
+	// extraction pauses for up to SpaceWait, after ConfirmCleanup, when set,
+	// agrees to remove old kegs.
+	MinFreeBytes   int64
+	SpaceWait      time.Duration
+	ConfirmCleanup func() bool
+	// FS and Clock default to the real filesystem and time; tests swap them
+	// to inject failures such as a full disk.
+	FS    FS
+	Clock fetch.Clock
+	// FreeSpace reports the bytes available on dir's filesystem.
+	FreeSpace func(dir string) (int64, error)
+
+	generation     *generationTxn
+	spaceMu        sync.Mutex
+	cleanupOffered bool
+}
+
+// FS is the filesystem surface of the install pipeline: pouring files and
+// publishing or clearing kegs.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Rename(oldpath, newpath string) error
+	RemoveAll(path string) error
+}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+func (osFS) Rename(oldpath, newpath string) error         { return os.Rename(oldpath, newpath) }
+func (osFS) RemoveAll(path string) error                  { return os.RemoveAll(path) }
+
+func (m *Manager) fs() FS {
+	if m.FS != nil {
+		return m.FS
+	}
+	return osFS{}
+}
+
+func (m *Manager) clock() fetch.Clock {
+	if m.Clock != nil {
+		return m.Clock
+	}
+	return fetch.SystemClock
 }
 
 type UninstallRecord struct {
@@ -97,6 +440,41 @@ type UninstallRecord struct {
 	SizeHuman string
 }
 
+type CorruptDownload struct {
+	Path          string
+	URL           string
+	QuarantinedTo string
+	Err           error
+}
+
+type VerifySummary struct {
+	Verified  int
+	Corrupt   []CorruptDownload
+	Missing   []string
+	Untracked int
+}
+
+type BottleStatus struct {
+	Name string
+	// Tag is the bottle that would be poured, or empty when none fits.
+	Tag       string
+	Available []string
+}
+
+type UninstallOptions struct {
+	// Force removes every installed version, ignores dependents, and skips autoremove.
+	Force bool
+	// AllVersions removes every installed version of a formula rather than
+	// only the newest, while still refusing one that others depend on.
+	AllVersions bool
+	// Permanent deletes cask apps instead of moving them to the Trash.
+	Permanent bool
+	// Formula and Cask look every name up only among installed formulae,
+	// or only among installed casks.
+	Formula bool
+	Cask    bool
+}
+
 type UninstallSummary struct {
 	Removed    []UninstallRecord
 	AutoRemove []UninstallRecord
@@ -106,32 +484,208 @@ type caskInstallReceipt struct {
 	Token          string   `json:"token"`
 	Version        string   `json:"version"`
 	AppPath        string   `json:"app_path"`
+	AppPaths       []string `json:"app_paths,omitempty"`
+	Fonts          []string `json:"fonts,omitempty"`
 	LinkedBinaries []string `json:"linked_binaries"`
+	AutoUpdates    bool     `json:"auto_updates,omitempty"`
+	// Quit lists the bundle ids from the cask's uninstall quit stanza.
+	Quit []string `json:"quit,omitempty"`
+	// Greedy is set when the cask was upgraded only because --greedy was passed.
+	Greedy     bool        `json:"greedy,omitempty"`
+	Provenance *Provenance `json:"provenance,omitempty"`
 }
 
-type uninstallBatchJob struct {
-	id  string
-	run func(context.Context) error
+type OutdatedPackage struct {
+	Name             string
+	Cask             bool
+	InstalledVersion string
+	CurrentVersion   string
+	AutoUpdates      bool
+	// Homepage and ReleaseNotes are filled in for dry runs. ReleaseNotes is
+	// the GitHub release of CurrentVersion, when its source is on GitHub.
+	Homepage     string
+	ReleaseNotes string
 }
 
-func (j uninstallBatchJob) ID() string { return j.id }
+type InstallOptions struct {
+	// OnlyDependencies installs the dependency closure but not the named formulae.
+	OnlyDependencies bool
+	// IgnoreDependencies installs the named formulae without their dependencies.
+	IgnoreDependencies bool
+	// BottleTag requires this exact bottle tag instead of the platform fallback chain.
+	BottleTag string
+	// ForceBottle pours any available bottle when no tag in the chain matches.
+	ForceBottle bool
+	// BottleSHA256 is checked against bottles installed from a file or URL.
+	BottleSHA256 string
+	// HEAD builds the named formulae from their head VCS URL into HEAD-<sha> kegs.
+	HEAD bool
+	// TapDir holds formula JSON whose build steps override detection for HEAD builds.
+	TapDir string
+	// Casks are installed alongside names, as casks even when a formula
+	// has the same name.
+	Casks []string
+}
+
+type UpgradeOptions struct {
+	Greedy bool
+	// DryRun lists what would be upgraded, with links to what changed,
+	// and changes nothing.
+	DryRun bool
+	// Formula and Cask limit the upgrade to formulae or to casks.
+	Formula bool
+	Cask    bool
+}
 
-func (j uninstallBatchJob) Requires() []string { return nil }
+type UpgradeSummary struct {
+	Upgraded []OutdatedPackage
+	// Pending lists what a dry run would have upgraded.
+	Pending []OutdatedPackage
+	// Skipped lists auto-updating casks left alone because Greedy was not set.
+	Skipped []OutdatedPackage
+	// Pinned lists outdated packages left alone because they are pinned.
+	Pinned []OutdatedPackage
+}
 
-func (j uninstallBatchJob) Run(ctx context.Context) error { return j.run(ctx) }
+// independentJobs turns work keyed by job id into scheduler jobs with no
+// dependencies between them.
+func independentJobs(work map[string]func(context.Context) error) ([]scheduler.Job, error) {
+	graph := make(scheduler.Graph, len(work))
+	for id := range work {
+		graph[id] = nil
+	}
+	return graph.Jobs(func(id string) func(context.Context) error { return work[id] }, nil)
+}
 
 func New(workers int) *Manager {
-	paths := DefaultPaths()
-	cache := fetch.NewCache(filepath.Join(paths.Cache, "bottles"))
 	if workers <= 0 {
 		workers = defaultWorkers()
 	}
-	return &Manager{
-		API:     homebrewapi.New(paths.Cache, paths.Repo),
-		Fetch:   cache,
-		Paths:   paths,
-		Workers: workers,
+	m := &Manager{Workers: workers, MinFreeBytes: defaultMinFreeBytes, SpaceWait: defaultSpaceWait}
+	m.UsePaths(DefaultPaths())
+	return m
+}
+
+// UsePaths switches m to paths, with an API client and download cache to
+// match.
+func (m *Manager) UsePaths(paths Paths) {
+	m.Paths = paths
+	m.API = homebrewapi.New(paths.Cache, paths.Repo)
+	m.Fetch = fetch.NewCache(filepath.Join(paths.Cache, "bottles"))
+	if m.Stats != nil {
+		m.SetStats(m.Stats)
+	}
+	m.SetCompressCache(m.CompressCache)
+	m.SetStallTimeout(m.StallTimeout)
+}
+
+// UseArch switches the manager to the tree for arch. Only x86_64 on Apple
+// Silicon is supported, since those bottles run under Rosetta.
+func (m *Manager) UseArch(arch string) error {
+	return m.useArch(arch, runtime.GOOS, runtime.GOARCH)
+}
+
+func (m *Manager) useArch(arch, goos, hostArch string) error {
+	normalized, err := NormalizeArch(arch)
+	if err != nil {
+		return err
+	}
+	if normalized == hostArch {
+		return nil
+	}
+	if goos != "darwin" || hostArch != "arm64" || normalized != "amd64" {
+		return fmt.Errorf("--arch %s is only supported on Apple Silicon, where x86_64 bottles run under Rosetta", tagArch(normalized))
+	}
+	m.Paths = PathsForArch(m.Paths, normalized)
+	m.Arch = normalized
+	return nil
+}
+
+func (m *Manager) bottleTags() []string {
+	if m.Arch != "" {
+		return preferredTagsFor(runtime.GOOS, m.Arch)
+	}
+	return preferredTags()
+}
+
+func (m *Manager) SetStats(recorder *stats.Recorder) {
+	m.Stats = recorder
+	if m.Fetch != nil {
+		m.Fetch.Stats = recorder
+	}
+	if m.API != nil {
+		m.API.SetStats(recorder)
+	}
+}
+
+func (m *Manager) SetCompressCache(compress bool) {
+	m.CompressCache = compress
+	if m.Fetch != nil {
+		m.Fetch.Compress = compress
+	}
+	if m.API != nil {
+		m.API.SetCompress(compress)
+	}
+}
+
+// SetStallTimeout sets StallTimeout and applies it to the download cache.
+func (m *Manager) SetStallTimeout(timeout time.Duration) {
+	m.StallTimeout = timeout
+	if m.Fetch == nil {
+		return
+	}
+	switch {
+	case timeout == 0:
+		m.Fetch.StallTimeout = fetch.DownloadStallTimeout
+	case timeout < 0:
+		m.Fetch.StallTimeout = 0
+	default:
+		m.Fetch.StallTimeout = timeout
+	}
+}
+
+type jobObserver interface {
+	jobStarted(id string)
+	jobFinished(id string, failed bool)
+}
+
+func (m *Manager) runJobs(ctx context.Context, jobs []scheduler.Job, observers ...jobObserver) error {
+	return m.runExecutor(ctx, scheduler.Executor{Workers: m.Workers}, jobs, observers...)
+}
+
+// runInstallJobs runs jobs that download before they extract. Up to
+// DownloadWorkers run at once while they are network-bound, but only
+// Workers of them may be in their CPU phase.
+func (m *Manager) runInstallJobs(ctx context.Context, jobs []scheduler.Job, observers ...jobObserver) error {
+	downloads := m.DownloadWorkers
+	if downloads <= 0 {
+		downloads = 2 * m.Workers
+	}
+	return m.runExecutor(ctx, scheduler.Executor{Workers: max(m.Workers, downloads), CPUWorkers: m.Workers}, jobs, observers...)
+}
+
+func (m *Manager) runExecutor(ctx context.Context, exec scheduler.Executor, jobs []scheduler.Job, observers ...jobObserver) error {
+	exec.OnJobStart = func(_ int, id string) {
+		m.Stats.JobStarted(id)
+		for _, o := range observers {
+			o.jobStarted(id)
+		}
+	}
+	exec.OnJobComplete = func(_ int, id string) {
+		m.Stats.JobFinished(id, false)
+		for _, o := range observers {
+			o.jobFinished(id, false)
+		}
+	}
+	exec.OnJobError = func(_ int, id string, _ error) {
+		m.Stats.JobFinished(id, true)
+		for _, o := range observers {
+			o.jobFinished(id, true)
+		}
 	}
+	m.Stats.ExecutorStarted(exec.Workers)
+	defer m.Stats.ExecutorFinished()
+	return exec.Run(ctx, jobs)
 }
 
 func defaultWorkers() int {
@@ -158,6 +712,106 @@ func (m *Manager) EnsureLayout() error {
 	return nil
 }
 
+// networkProbeTimeout bounds CheckNetwork; a healthy API answers well
+// within it.
+const networkProbeTimeout = 5 * time.Second
+
+// CheckNetwork fails fast, with the likely cause, when the API cannot be
+// reached. Commands that fetch run it first so that being offline is an
+// error within seconds instead of a long hang. When a last-known-good index
+// is cached it warns instead, and the command carries on from that.
+func (m *Manager) CheckNetwork(ctx context.Context) error {
+	err := m.RequireNetwork(ctx)
+	if err != nil && m.API.Degrade(err) {
+		return nil
+	}
+	return err
+}
+
+// RequireNetwork is CheckNetwork without the fallback, for commands such as
+// update that are pointless without the API. UB_NO_NETWORK_CHECK=1 skips
+// both, for installs served entirely from the download cache.
+func (m *Manager) RequireNetwork(ctx context.Context) error {
+	if os.Getenv("UB_NO_NETWORK_CHECK") != "" {
+		return nil
+	}
+	if err := m.API.Probe(ctx, networkProbeTimeout); err != nil {
+		return fmt.Errorf("network check failed: %w", err)
+	}
+	return nil
+}
+
+// UseReadOnly prepares m for commands that only read the prefix, such as
+// list and info, so they work on read-only mounts and other users'
+// prefixes. When the download cache cannot be written, API metadata is
+// cached under the user's cache directory and the repository mirror is
+// skipped.
+func (m *Manager) UseReadOnly() {
+	m.ReadOnly = true
+	if dirWritable(m.Paths.Cache) {
+		return
+	}
+	dir, err := readOnlyCacheDir()
+	if err != nil {
+		return
+	}
+	m.API = homebrewapi.New(dir, "")
+	if m.Stats != nil {
+		m.API.SetStats(m.Stats)
+	}
+	m.API.SetCompress(m.CompressCache)
+}
+
+// readOnlyCacheDir is where a read-only command caches API metadata: the
+// user's cache directory, or else a directory under the temporary
+// directory that only this user can read and write.
+func readOnlyCacheDir() (string, error) {
+	if userCache, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(userCache, "ub"), nil
+	}
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("ub-%d", os.Getuid()))
+	if err := os.Mkdir(dir, 0o700); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	if privateDir(dir) {
+		return dir, nil
+	}
+	// Someone else made it first, perhaps to read or plant metadata, so
+	// use a directory of this run's own.
+	return os.MkdirTemp("", "ub-")
+}
+
+// privateDir reports whether dir is a directory, not a symlink, that
+// belongs to this user and no one else can use.
+func privateDir(dir string) bool {
+	info, err := os.Lstat(dir)
+	if err != nil || !info.IsDir() || info.Mode().Perm() != 0o700 {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && int(st.Uid) == os.Getuid()
+}
+
+// dirWritable reports whether files can be created in dir, or in the
+// directories MkdirAll would make for it, without creating anything.
+func dirWritable(dir string) bool {
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			// 3 is W_OK|X_OK: entries can be created in it.
+			return info.IsDir() && syscall.Access(dir, 3) == nil
+		}
+		if !os.IsNotExist(err) {
+			return false
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return false
+		}
+		dir = parent
+	}
+}
+
 func (m *Manager) Search(ctx context.Context, query string) ([]homebrewapi.FormulaSummary, error) {
 	list, err := m.API.FormulaList(ctx)
 	if err != nil {
@@ -187,40 +841,156 @@ func (m *Manager) Info(ctx context.Context, name string) (homebrewapi.Formula, e
 	return m.API.FormulaByName(ctx, name)
 }
 
+// InfoV2 is the document brew prints for `info --json=v2`.
+type InfoV2 struct {
+	Formulae []map[string]any `json:"formulae"`
+	Casks    []map[string]any `json:"casks"`
+}
+
+type InfoOptions struct {
+	// Formula and Cask restrict name lookup to one kind; with neither set a
+	// name is looked up as a formula first, then as a cask.
+	Formula   bool
+	Cask      bool
+	Analytics bool
+}
+
+// InfoJSON returns the API documents for names with the local install state
+// brew adds: installed kegs, the linked keg and whether each is outdated.
+func (m *Manager) InfoJSON(ctx context.Context, names []string, opts InfoOptions) (InfoV2, error) {
+	out := InfoV2{Formulae: []map[string]any{}, Casks: []map[string]any{}}
+	for _, name := range names {
+		var formulaErr error
+		if !opts.Cask {
+			doc, err := m.API.FormulaJSON(ctx, name)
+			if err == nil {
+				out.Formulae = append(out.Formulae, m.formulaInfo(name, doc, opts.Analytics))
+				continue
+			}
+			if opts.Formula {
+				return InfoV2{}, m.notFound(name, err)
+			}
+			formulaErr = err
+		}
+		doc, err := m.API.CaskJSON(ctx, name)
+		if err != nil {
+			if formulaErr != nil && !isNotFoundError(formulaErr) {
+				return InfoV2{}, formulaErr
+			}
+			return InfoV2{}, m.notFound(name, err)
+		}
+		out.Casks = append(out.Casks, m.caskInfo(name, doc, opts.Analytics))
+	}
+	return out, nil
+}
+
+func (m *Manager) formulaInfo(name string, doc map[string]any, analytics bool) map[string]any {
+	if !analytics {
+		delete(doc, "analytics")
+	}
+	stable := ""
+	if versions, ok := doc["versions"].(map[string]any); ok {
+		stable, _ = versions["stable"].(string)
+	}
+	versions, _ := kegVersions(filepath.Join(m.Paths.Cellar, name))
+	installed := []map[string]any{}
+	latest := ""
+	for _, version := range versions {
+		receipt := map[string]any{}
+		if data, err := os.ReadFile(filepath.Join(m.Paths.Cellar, name, version, "INSTALL_RECEIPT.json")); err == nil {
+			_ = json.Unmarshal(data, &receipt)
+		}
+		bottle := !strings.HasPrefix(version, headKegPrefix)
+		keg := map[string]any{
+			"version":                 version,
+			"used_options":            []string{},
+			"built_as_bottle":         bottle,
+			"poured_from_bottle":      bottle,
+			"time":                    nil,
+			"runtime_dependencies":    []any{},
+			"installed_as_dependency": false,
+			"installed_on_request":    false,
+		}
+		for key := range keg {
+			if value, ok := receipt[key]; ok && key != "version" {
+				keg[key] = value
+			}
+		}
+		installed = append(installed, keg)
+		latest = version
+	}
+	doc["installed"] = installed
+	// The newest keg is the one ub links.
+	doc["linked_keg"] = nil
+	if latest != "" {
+		doc["linked_keg"] = latest
+	}
+	formulae, _, _ := m.pins()
+	doc["pinned"] = formulae[name]
+	doc["outdated"] = latest != "" && stable != "" && !formulaVersionCurrent(latest, stable) && !strings.HasPrefix(latest, headKegPrefix)
+	return doc
+}
+
+func (m *Manager) caskInfo(token string, doc map[string]any, analytics bool) map[string]any {
+	if !analytics {
+		delete(doc, "analytics")
+	}
+	doc["installed"] = nil
+	doc["installed_time"] = nil
+	doc["outdated"] = false
+	receipt, err := m.readCaskReceipt(token)
+	if err != nil {
+		return doc
+	}
+	doc["installed"] = receipt.Version
+	if info, err := os.Stat(filepath.Join(m.Paths.Caskroom, token, receipt.Version)); err == nil {
+		doc["installed_time"] = info.ModTime().Unix()
+	}
+	current, _ := doc["version"].(string)
+	if current = strings.TrimSpace(current); current == "" {
+		current = "latest"
+	}
+	autoUpdates, _ := doc["auto_updates"].(bool)
+	doc["outdated"] = caskUpgradeDecision(receipt.Version, current, autoUpdates, false) == caskUpgrade
+	return doc
+}
+
 func (m *Manager) ListInstalled() ([]string, error) {
-	entries, err := os.ReadDir(m.Paths.Cellar)
+	st, err := m.InstallState()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
-		}
 		return nil, err
 	}
-	out := make([]string, 0)
-	for _, e := range entries {
-		if e.IsDir() {
-			out = append(out, e.Name())
+	return slices.Sorted(maps.Keys(st.Formulae)), nil
+}
+
+// InstalledVersions returns the newest installed version of every formula
+// and cask, keyed by name.
+func (m *Manager) InstalledVersions() (formulae, casks map[string]string, err error) {
+	st, err := m.InstallState()
+	if err != nil {
+		return nil, nil, err
+	}
+	formulae = make(map[string]string, len(st.Formulae))
+	for name, f := range st.Formulae {
+		if f.Version != "" {
+			formulae[name] = f.Version
 		}
 	}
-	sort.Strings(out)
-	return out, nil
+	casks = make(map[string]string, len(st.Casks))
+	for token, c := range st.Casks {
+		if len(c.Versions) > 0 {
+			casks[token] = c.Versions[len(c.Versions)-1]
+		}
+	}
+	return formulae, casks, nil
 }
 
 func (m *Manager) listInstalledCasks() ([]string, error) {
-	entries, err := os.ReadDir(m.Paths.Caskroom)
+	st, err := m.InstallState()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
-		}
 		return nil, err
 	}
-	out := make([]string, 0)
-	for _, e := range entries {
-		if e.IsDir() {
-			out = append(out, e.Name())
-		}
-	}
-	sort.Strings(out)
-	return out, nil
+	return slices.Sorted(maps.Keys(st.Casks)), nil
 }
 
 func (m *Manager) Uninstall(name string) error {
@@ -229,10 +999,14 @@ func (m *Manager) Uninstall(name string) error {
 }
 
 func (m *Manager) UninstallWithAutoremove(ctx context.Context, names []string) (UninstallSummary, error) {
+	return m.UninstallWithOptions(ctx, names, UninstallOptions{})
+}
+
+func (m *Manager) UninstallWithOptions(ctx context.Context, names []string, opts UninstallOptions) (UninstallSummary, error) {
 	if err := m.EnsureLayout(); err != nil {
 		return UninstallSummary{}, err
 	}
-	lockHandle, err := lock.Acquire(m.Paths.Cellar)
+	lockHandle, err := m.acquireLock(ctx, m.Paths.Cellar)
 	if err != nil {
 		return UninstallSummary{}, err
 	}
@@ -252,40 +1026,75 @@ func (m *Manager) UninstallWithAutoremove(ctx context.Context, names []string) (
 	caskTargets := make([]string, 0)
 	for _, name := range trimmed {
 		formulaDir := filepath.Join(m.Paths.Cellar, name)
-		if info, err := os.Stat(formulaDir); err == nil && info.IsDir() {
+		if info, err := os.Stat(formulaDir); err == nil && info.IsDir() && !opts.Cask {
 			formulaTargets = append(formulaTargets, name)
 			continue
 		}
 		caskDir := filepath.Join(m.Paths.Caskroom, name)
-		if info, err := os.Stat(caskDir); err == nil && info.IsDir() {
+		if info, err := os.Stat(caskDir); err == nil && info.IsDir() && !opts.Formula {
 			caskTargets = append(caskTargets, name)
 			continue
 		}
-		return UninstallSummary{}, fmt.Errorf("package %q is not installed", name)
+		return UninstallSummary{}, fmt.Errorf("package %q is %w", name, ErrNotInstalled)
 	}
 
-	candidateDeps := map[string]bool{}
-	rootSet := map[string]bool{}
-	for _, name := range formulaTargets {
-		rootSet[name] = true
-		closure, err := m.resolveClosure(ctx, []string{name})
+	if len(formulaTargets) > 0 {
+		dependents, err := m.installedDependents(ctx, formulaTargets)
 		if err != nil {
 			return UninstallSummary{}, err
 		}
-		for dep := range closure {
-			if dep != name {
-				candidateDeps[dep] = true
+		for _, name := range formulaTargets {
+			users := dependents[name]
+			if len(users) == 0 {
+				continue
+			}
+			if !opts.Force {
+				return UninstallSummary{}, fmt.Errorf("refusing to uninstall %s: %w: %s (use --force to remove it anyway)", name, ErrHasDependents, strings.Join(users, ", "))
+			}
+			fmt.Fprintln(os.Stderr, messages.Sprintf(messages.Warning, messages.Sprintf(messages.ForceRequiredBy, name, strings.Join(users, ", "))))
+		}
+	}
+
+	if opts.Force {
+		formulaRemoved, err := m.uninstallFormulaBatch(ctx, formulaTargets, true, reporter)
+		if err != nil {
+			return UninstallSummary{}, err
+		}
+		summary.Removed = append(summary.Removed, formulaRemoved...)
+		caskRemoved, err := m.uninstallCaskBatch(ctx, caskTargets, opts.Permanent, reporter)
+		if err != nil {
+			return UninstallSummary{}, err
+		}
+		summary.Removed = append(summary.Removed, caskRemoved...)
+		return summary, nil
+	}
+
+	before, err := m.InstallState()
+	if err != nil {
+		return UninstallSummary{}, err
+	}
+	candidateDeps := map[string]bool{}
+	rootSet := map[string]bool{}
+	for _, name := range formulaTargets {
+		rootSet[name] = true
+		closure, err := m.installedClosure(ctx, before, []string{name})
+		if err != nil {
+			return UninstallSummary{}, err
+		}
+		for dep := range closure {
+			if dep != name {
+				candidateDeps[dep] = true
 			}
 		}
 	}
 
-	formulaRemoved, err := m.uninstallFormulaBatch(ctx, formulaTargets, reporter)
+	formulaRemoved, err := m.uninstallFormulaBatch(ctx, formulaTargets, opts.AllVersions, reporter)
 	if err != nil {
 		return UninstallSummary{}, err
 	}
 	summary.Removed = append(summary.Removed, formulaRemoved...)
 
-	caskRemoved, err := m.uninstallCaskBatch(ctx, caskTargets, reporter)
+	caskRemoved, err := m.uninstallCaskBatch(ctx, caskTargets, opts.Permanent, reporter)
 	if err != nil {
 		return UninstallSummary{}, err
 	}
@@ -295,12 +1104,21 @@ func (m *Manager) UninstallWithAutoremove(ctx context.Context, names []string) (
 	if err != nil {
 		return UninstallSummary{}, err
 	}
-
 	remainingSet := make(map[string]bool, len(remaining))
 	for _, name := range remaining {
 		remainingSet[name] = true
 	}
 
+	st, err := m.InstallState()
+	if err != nil {
+		return UninstallSummary{}, err
+	}
+	for name := range candidateDeps {
+		if m.keepInstalled(st, name) {
+			delete(candidateDeps, name)
+		}
+	}
+
 	nonCandidateRoots := make([]string, 0)
 	for _, name := range remaining {
 		if !candidateDeps[name] {
@@ -310,7 +1128,7 @@ func (m *Manager) UninstallWithAutoremove(ctx context.Context, names []string) (
 
 	requiredByNonCandidates := map[string]bool{}
 	if len(nonCandidateRoots) > 0 {
-		closure, err := m.resolveClosure(ctx, nonCandidateRoots)
+		closure, err := m.installedClosure(ctx, st, nonCandidateRoots)
 		if err != nil {
 			return UninstallSummary{}, err
 		}
@@ -335,7 +1153,7 @@ func (m *Manager) UninstallWithAutoremove(ctx context.Context, names []string) (
 	}
 	sort.Strings(autoRemoveNames)
 
-	autoRemoved, err := m.uninstallFormulaBatch(ctx, autoRemoveNames, reporter)
+	autoRemoved, err := m.uninstallFormulaBatch(ctx, autoRemoveNames, true, reporter)
 	if err != nil {
 		return UninstallSummary{}, err
 	}
@@ -344,77 +1162,161 @@ func (m *Manager) UninstallWithAutoremove(ctx context.Context, names []string) (
 	return summary, nil
 }
 
-func (m *Manager) uninstallFormulaBatch(ctx context.Context, names []string, reporter *uninstallReporter) ([]UninstallRecord, error) {
+// installedDependents maps each target to the installed formulae that directly
+// depend on it, ignoring dependents that are themselves targets.
+func (m *Manager) installedDependents(ctx context.Context, targets []string) (map[string][]string, error) {
+	st, err := m.InstallState()
+	if err != nil {
+		return nil, err
+	}
+	targetSet := make(map[string]bool, len(targets))
+	for _, name := range targets {
+		targetSet[name] = true
+	}
+	out := map[string][]string{}
+	for _, name := range slices.Sorted(maps.Keys(st.Formulae)) {
+		if targetSet[name] {
+			continue
+		}
+		deps, err := m.installedDependencies(ctx, st, name)
+		if err != nil {
+			if isNotFoundError(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, dep := range deps {
+			if targetSet[dep] {
+				out[dep] = append(out[dep], name)
+			}
+		}
+	}
+	return out, nil
+}
+
+// installedDependencies returns the direct dependencies of name. The keg's
+// receipt says what it was built against, so uninstall works offline; only
+// formulae that are not installed, or kegs from before ub recorded that,
+// ask the API.
+func (m *Manager) installedDependencies(ctx context.Context, st InstallState, name string) ([]string, error) {
+	if record, ok := st.Formulae[name]; ok && record.Version != "" {
+		if deps, ok := receiptDependencies(filepath.Join(m.Paths.Cellar, name, record.Version)); ok {
+			return deps, nil
+		}
+	}
+	f, err := m.API.FormulaByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return f.Dependencies, nil
+}
+
+// installedClosure is roots and everything they depend on, read from the
+// receipts as installedDependencies does.
+func (m *Manager) installedClosure(ctx context.Context, st InstallState, roots []string) (map[string]bool, error) {
+	closure := map[string]bool{}
+	queue := append([]string(nil), roots...)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if closure[name] {
+			continue
+		}
+		closure[name] = true
+		deps, err := m.installedDependencies(ctx, st, name)
+		if err != nil {
+			return nil, err
+		}
+		queue = append(queue, deps...)
+	}
+	return closure, nil
+}
+
+func (m *Manager) uninstallFormulaBatch(ctx context.Context, names []string, allVersions bool, reporter *uninstallReporter) ([]UninstallRecord, error) {
 	if len(names) == 0 {
 		return nil, nil
 	}
 
-	jobs := make([]scheduler.Job, 0, len(names))
+	work := make(map[string]func(context.Context) error, len(names))
 	records := make([]UninstallRecord, len(names))
 	var recordsMu sync.Mutex
 
 	for idx, name := range names {
 		idx := idx
 		name := name
-		jobs = append(jobs, uninstallBatchJob{
-			id: fmt.Sprintf("formula:%s:%d", name, idx),
-			run: func(context.Context) error {
-				rec, err := m.uninstallFormulaLocked(name, reporter)
-				if err != nil {
-					return err
-				}
-				recordsMu.Lock()
-				records[idx] = rec
-				recordsMu.Unlock()
-				return nil
-			},
-		})
+		work[fmt.Sprintf("formula:%s:%d", name, idx)] = func(context.Context) error {
+			rec, err := m.uninstallFormulaLocked(ctx, name, allVersions, reporter)
+			if err != nil {
+				return err
+			}
+			recordsMu.Lock()
+			records[idx] = rec
+			recordsMu.Unlock()
+			return nil
+		}
 	}
 
-	exec := scheduler.Executor{Workers: m.Workers}
-	if err := exec.Run(ctx, jobs); err != nil {
+	jobs, err := independentJobs(work)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.runJobs(ctx, jobs); err != nil {
 		return nil, err
 	}
 
 	return records, nil
 }
 
-func (m *Manager) uninstallCaskBatch(ctx context.Context, names []string, reporter *uninstallReporter) ([]UninstallRecord, error) {
+func (m *Manager) uninstallCaskBatch(ctx context.Context, names []string, permanent bool, reporter *uninstallReporter) ([]UninstallRecord, error) {
 	if len(names) == 0 {
 		return nil, nil
 	}
 
-	jobs := make([]scheduler.Job, 0, len(names))
+	for _, name := range names {
+		receipt, err := m.readCaskReceipt(name)
+		if err != nil {
+			continue
+		}
+		for _, appPath := range receipt.apps() {
+			if err := m.ensureAppNotRunning(appPath, receipt.Quit); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	work := make(map[string]func(context.Context) error, len(names))
 	records := make([]UninstallRecord, len(names))
 	var recordsMu sync.Mutex
 
 	for idx, name := range names {
 		idx := idx
 		name := name
-		jobs = append(jobs, uninstallBatchJob{
-			id: fmt.Sprintf("cask:%s:%d", name, idx),
-			run: func(context.Context) error {
-				rec, err := m.uninstallCaskLocked(name, reporter)
-				if err != nil {
-					return err
-				}
-				recordsMu.Lock()
-				records[idx] = rec
-				recordsMu.Unlock()
-				return nil
-			},
-		})
+		work[fmt.Sprintf("cask:%s:%d", name, idx)] = func(context.Context) error {
+			rec, err := m.uninstallCaskLocked(ctx, name, permanent, reporter)
+			if err != nil {
+				return err
+			}
+			recordsMu.Lock()
+			records[idx] = rec
+			recordsMu.Unlock()
+			return nil
+		}
 	}
 
-	exec := scheduler.Executor{Workers: m.Workers}
-	if err := exec.Run(ctx, jobs); err != nil {
+	jobs, err := independentJobs(work)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.runJobs(ctx, jobs); err != nil {
 		return nil, err
 	}
 
 	return records, nil
 }
 
-func (m *Manager) uninstallFormulaLocked(name string, reporters ...*uninstallReporter) (UninstallRecord, error) {
+// uninstallFormulaLocked removes the newest keg of name, relinking the next
+// newest if one remains, or every keg when allVersions is set.
+func (m *Manager) uninstallFormulaLocked(ctx context.Context, name string, allVersions bool, reporters ...*uninstallReporter) (UninstallRecord, error) {
 	var reporter *uninstallReporter
 	if len(reporters) > 0 {
 		reporter = reporters[0]
@@ -422,7 +1324,7 @@ func (m *Manager) uninstallFormulaLocked(name string, reporters ...*uninstallRep
 	formulaDir := filepath.Join(m.Paths.Cellar, name)
 	if _, err := os.Stat(formulaDir); err != nil {
 		if os.IsNotExist(err) {
-			return UninstallRecord{}, fmt.Errorf("formula %q is not installed", name)
+			return UninstallRecord{}, fmt.Errorf("formula %q is %w", name, ErrNotInstalled)
 		}
 		return UninstallRecord{}, err
 	}
@@ -434,7 +1336,7 @@ func (m *Manager) uninstallFormulaLocked(name string, reporters ...*uninstallRep
 	displayPath := formulaDir
 	latest := ""
 	for _, version := range versions {
-		if version.IsDir() && version.Name() > latest {
+		if version.IsDir() && (latest == "" || compareVersions(version.Name(), latest) > 0) {
 			latest = version.Name()
 		}
 	}
@@ -442,25 +1344,56 @@ func (m *Manager) uninstallFormulaLocked(name string, reporters ...*uninstallRep
 		displayPath = filepath.Join(formulaDir, latest)
 	}
 
-	files, size, err := dirStats(displayPath)
+	removeDir := formulaDir
+	if !allVersions && latest != "" && countDirs(versions) > 1 {
+		removeDir = displayPath
+	}
+	var files int
+	var size int64
+	if removeDir == formulaDir {
+		files, size, err = m.formulaStats(ctx, formulaDir)
+	} else {
+		files, size, err = m.kegStats(ctx, removeDir)
+	}
 	if err != nil {
 		return UninstallRecord{}, err
 	}
 
-	if err := m.unlinkTree(filepath.Join(formulaDir), m.Paths.Bin, "bin"); err != nil {
+	if err := m.unlinkTree(filepath.Join(formulaDir), m.linkDir("bin"), "bin"); err != nil {
 		return UninstallRecord{}, err
 	}
-	if err := m.unlinkTree(filepath.Join(formulaDir), m.Paths.Sbin, "sbin"); err != nil {
+	if err := m.unlinkTree(filepath.Join(formulaDir), m.linkDir("sbin"), "sbin"); err != nil {
 		return UninstallRecord{}, err
 	}
 
 	var onProgress func(removed, total int, done bool)
 	if reporter != nil {
-		onProgress = reporter.progressCallback("Uninstall " + name)
+		onProgress = reporter.progressCallback(messages.Sprintf(messages.UninstallLabel, name))
+	}
+	kegDirs := []string{removeDir}
+	if removeDir == formulaDir {
+		kegDirs = kegDirs[:0]
+		for _, version := range versions {
+			if version.IsDir() {
+				kegDirs = append(kegDirs, filepath.Join(formulaDir, version.Name()))
+			}
+		}
+	}
+	if err := m.removeKegsWithProgress(ctx, removeDir, kegDirs, onProgress); err != nil {
+		return UninstallRecord{}, errors.Join(err, m.recordFormula(name))
 	}
-	if err := removeTreeWithProgress(formulaDir, onProgress); err != nil {
+	if err := m.recordFormula(name); err != nil {
 		return UninstallRecord{}, err
 	}
+	if removeDir != formulaDir {
+		next, err := m.latestInstalledVersion(name)
+		if err != nil {
+			return UninstallRecord{}, err
+		}
+		if _, err := m.linkFormula(name, next); err != nil {
+			return UninstallRecord{}, err
+		}
+	}
 
 	return UninstallRecord{
 		Name:      name,
@@ -471,7 +1404,7 @@ func (m *Manager) uninstallFormulaLocked(name string, reporters ...*uninstallRep
 	}, nil
 }
 
-func (m *Manager) uninstallCaskLocked(name string, reporters ...*uninstallReporter) (UninstallRecord, error) {
+func (m *Manager) uninstallCaskLocked(ctx context.Context, name string, permanent bool, reporters ...*uninstallReporter) (UninstallRecord, error) {
 	var reporter *uninstallReporter
 	if len(reporters) > 0 {
 		reporter = reporters[0]
@@ -480,13 +1413,13 @@ func (m *Manager) uninstallCaskLocked(name string, reporters ...*uninstallReport
 	entries, err := os.ReadDir(caskRoot)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return UninstallRecord{}, fmt.Errorf("cask %q is not installed", name)
+			return UninstallRecord{}, fmt.Errorf("cask %q is %w", name, ErrNotInstalled)
 		}
 		return UninstallRecord{}, err
 	}
 	latest := ""
 	for _, entry := range entries {
-		if entry.IsDir() && entry.Name() > latest {
+		if entry.IsDir() && (latest == "" || compareVersions(entry.Name(), latest) > 0) {
 			latest = entry.Name()
 		}
 	}
@@ -500,25 +1433,33 @@ func (m *Manager) uninstallCaskLocked(name string, reporters ...*uninstallReport
 	if err == nil {
 		var receipt caskInstallReceipt
 		if err := json.Unmarshal(receiptData, &receipt); err == nil {
-			for _, appPath := range caskAppRemovalCandidates(receipt.AppPath, m.Paths.Applications) {
-				_ = os.RemoveAll(appPath)
+			for _, app := range receipt.apps() {
+				for _, appPath := range caskAppRemovalCandidates(app, m.Paths.Applications) {
+					removeCaskApp(appPath, permanent)
+				}
+			}
+			for _, font := range receipt.Fonts {
+				_ = os.Remove(font)
 			}
 			for _, bin := range receipt.LinkedBinaries {
-				_ = os.Remove(bin)
+				_ = os.Remove(m.workingLinkPath(bin))
 			}
 		}
 	}
 
-	files, size, statErr := dirStats(versionDir)
+	files, size, statErr := dirStats(ctx, versionDir)
 	if statErr != nil {
 		return UninstallRecord{}, statErr
 	}
 
 	var onProgress func(removed, total int, done bool)
 	if reporter != nil {
-		onProgress = reporter.progressCallback("Uninstall cask " + name)
+		onProgress = reporter.progressCallback(messages.Sprintf(messages.UninstallCaskLabel, name))
 	}
-	if err := removeTreeWithProgress(caskRoot, onProgress); err != nil {
+	if err := removeTreeWithProgress(ctx, caskRoot, onProgress); err != nil {
+		return UninstallRecord{}, errors.Join(err, m.recordCask(name))
+	}
+	if err := m.recordCask(name); err != nil {
 		return UninstallRecord{}, err
 	}
 
@@ -531,267 +1472,2222 @@ func (m *Manager) uninstallCaskLocked(name string, reporters ...*uninstallReport
 	}, nil
 }
 
-func (m *Manager) Reset() error {
-	installedFormulae, err := m.ListInstalled()
+// VerifyDownloads re-hashes every cached download recorded in the checksum
+// database and quarantines the ones that no longer match.
+func (m *Manager) VerifyDownloads(ctx context.Context) (VerifySummary, error) {
+	db, err := m.Fetch.Checksums()
 	if err != nil {
-		return err
+		return VerifySummary{}, err
 	}
-	installedCasks, err := m.listInstalledCasks()
+	entries, err := m.Fetch.Entries()
 	if err != nil {
-		return err
-	}
-	targets := append(append([]string{}, installedFormulae...), installedCasks...)
-	if _, err := m.UninstallWithAutoremove(context.Background(), targets); err != nil {
-		return err
+		return VerifySummary{}, err
 	}
-	if err := os.RemoveAll(m.Paths.Cache); err != nil {
-		return err
-	}
-	return m.EnsureLayout()
-}
 
-func (m *Manager) Install(ctx context.Context, names []string) error {
-	formulaRoots := make([]string, 0, len(names))
-	casks := make([]homebrewapi.Cask, 0)
-	for _, raw := range names {
-		name := strings.TrimSpace(raw)
-		if name == "" {
-			continue
+	summary := VerifySummary{}
+	for _, path := range entries {
+		if _, ok := db[path]; !ok {
+			summary.Untracked++
 		}
-		if _, err := m.API.FormulaByName(ctx, name); err == nil {
-			formulaRoots = append(formulaRoots, name)
-			continue
-		} else if isNotFoundError(err) {
-			cask, caskErr := m.API.CaskByName(ctx, name)
-			if caskErr != nil {
-				return caskErr
+	}
+	paths := make([]string, 0, len(db))
+	for path := range db {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var mu sync.Mutex
+	work := make(map[string]func(context.Context) error, len(paths))
+	for _, path := range paths {
+		path := path
+		entry := db[path]
+		work["verify:"+path] = func(context.Context) error {
+			err := verifySHA256(path, entry.SHA256)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				summary.Verified++
+			case os.IsNotExist(err):
+				summary.Missing = append(summary.Missing, entry.URL)
+				return m.Fetch.ForgetChecksum(path)
+			case errors.Is(err, ErrChecksumMismatch):
+				dst, qErr := m.Fetch.Quarantine(path)
+				if qErr != nil {
+					return qErr
+				}
+				summary.Corrupt = append(summary.Corrupt, CorruptDownload{Path: path, URL: entry.URL, QuarantinedTo: dst, Err: err})
+			default:
+				return err
 			}
-			casks = append(casks, cask)
-			continue
-		} else {
-			return err
+			return nil
 		}
 	}
+	jobs, err := independentJobs(work)
+	if err != nil {
+		return summary, err
+	}
+	if err := m.runJobs(ctx, jobs); err != nil {
+		return summary, err
+	}
+	sort.Slice(summary.Corrupt, func(i, j int) bool { return summary.Corrupt[i].Path < summary.Corrupt[j].Path })
+	sort.Strings(summary.Missing)
+	return summary, nil
+}
 
-	if len(formulaRoots) > 0 {
-		if err := m.installFormulas(ctx, formulaRoots); err != nil {
-			return err
+// BottleReport checks names (or every installed formula) for a bottle
+// matching tag, or the host's fallback chain when tag is empty.
+func (m *Manager) BottleReport(ctx context.Context, names []string, tag string) ([]BottleStatus, error) {
+	if len(names) == 0 {
+		installed, err := m.ListInstalled()
+		if err != nil {
+			return nil, err
 		}
+		names = installed
 	}
-
-	for _, cask := range casks {
-		if err := m.installCask(ctx, cask); err != nil {
-			return err
+	tags := m.bottleTags()
+	if strings.TrimSpace(tag) != "" {
+		tags = []string{strings.TrimSpace(tag)}
+	}
+	out := make([]BottleStatus, 0, len(names))
+	for _, name := range names {
+		f, err := m.API.FormulaByName(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		status := BottleStatus{Name: f.Name, Available: sortedTags(f.Bottle.Stable.Files)}
+		if len(status.Available) > 0 {
+			if _, selected, err := selectBottle(f, tags, InstallOptions{}); err == nil {
+				status.Tag = selected
+			}
 		}
+		out = append(out, status)
 	}
-
-	return nil
+	return out, nil
 }
 
-func (m *Manager) installFormulas(ctx context.Context, names []string) error {
-	if err := m.EnsureLayout(); err != nil {
-		return err
-	}
-	lockHandle, err := lock.Acquire(m.Paths.Cellar)
+func (m *Manager) Reset(ctx context.Context) error {
+	installedFormulae, err := m.ListInstalled()
 	if err != nil {
 		return err
 	}
-	defer lockHandle.Release()
-
-	closure, err := m.resolveClosure(ctx, names)
+	installedCasks, err := m.listInstalledCasks()
 	if err != nil {
 		return err
 	}
-	reporter := newInstallReporter(m.Paths, names, closure)
-	reporter.workers = m.Workers
-	reporter.printPlan()
-
-	jobs := make([]scheduler.Job, 0, len(closure))
-	rootSet := make(map[string]bool, len(names))
-	for _, name := range names {
-		rootSet[name] = true
-	}
-	for _, f := range closure {
-		jobs = append(jobs, installJob{manager: m, formula: f, reporter: reporter, rootSet: rootSet})
+	targets := append(append([]string{}, installedFormulae...), installedCasks...)
+	if _, err := m.UninstallWithOptions(ctx, targets, UninstallOptions{Force: true}); err != nil {
+		return err
 	}
-
-	exec := scheduler.Executor{Workers: m.Workers}
-	if err := exec.Run(ctx, jobs); err != nil {
+	if err := os.RemoveAll(m.Paths.Cache); err != nil {
 		return err
 	}
-	reporter.printSummary()
-	return nil
+	return m.EnsureLayout()
 }
 
-func (m *Manager) installCask(ctx context.Context, cask homebrewapi.Cask) error {
-	if err := m.EnsureLayout(); err != nil {
-		return err
+type Snapshot struct {
+	Name     string            `json:"name"`
+	Created  time.Time         `json:"created"`
+	Formulae map[string]string `json:"formulae"`
+	Casks    map[string]string `json:"casks"`
+	// Cloned snapshots keep hard-linked copies of every keg, so versions
+	// removed after the snapshot can still be restored.
+	Cloned bool `json:"cloned,omitempty"`
+}
+
+type RestoreSummary struct {
+	Removed  []string
+	Relinked []string
+	// Unrestorable lists packages whose snapshot version is no longer on disk.
+	Unrestorable []string
+}
+
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func (m *Manager) snapshotsDir() string {
+	return filepath.Join(m.Paths.Prefix, "var", "ub", "snapshots")
+}
+
+// CreateSnapshot records the installed formulae and casks under name. With
+// clone set, each keg is also hard-linked into the snapshot.
+func (m *Manager) CreateSnapshot(ctx context.Context, name string, clone bool) (Snapshot, error) {
+	if name == "" {
+		name = m.clock().Now().Format("20060102-150405")
+	}
+	if !snapshotNamePattern.MatchString(name) {
+		return Snapshot{}, fmt.Errorf("invalid snapshot name %q", name)
 	}
-	lockHandle, err := lock.Acquire(m.Paths.Caskroom)
+	dir := filepath.Join(m.snapshotsDir(), name)
+	if _, err := os.Stat(dir); err == nil {
+		return Snapshot{}, fmt.Errorf("snapshot %q already exists", name)
+	}
+	lockHandle, err := m.acquireLock(ctx, m.Paths.Cellar)
 	if err != nil {
-		return err
+		return Snapshot{}, err
 	}
 	defer lockHandle.Release()
 
-	version := strings.TrimSpace(cask.Version)
-	if version == "" {
-		version = "latest"
-	}
-	caskDir := filepath.Join(m.Paths.Caskroom, cask.Token, version)
-	appName := cask.AppArtifact()
-	if strings.TrimSpace(appName) == "" {
-		return fmt.Errorf("cask %q has no app artifact", cask.Token)
+	formulae, casks, err := m.InstalledVersions()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	snap := Snapshot{Name: name, Created: m.clock().Now().UTC(), Formulae: formulae, Casks: casks, Cloned: clone}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return Snapshot{}, fmt.Errorf("create snapshot dir: %w", err)
+	}
+	if clone {
+		for formula, version := range formulae {
+			src := filepath.Join(m.Paths.Cellar, formula, version)
+			if err := cloneTree(ctx, src, filepath.Join(dir, "Cellar", formula, version)); err != nil {
+				_ = os.RemoveAll(dir)
+				return Snapshot{}, fmt.Errorf("clone %s: %w", formula, err)
+			}
+		}
 	}
-
-	reporter := &installReporter{}
-	fmt.Printf("==> Downloading Cask %s\n", cask.Token)
-	archive, err := m.Fetch.FetchWithProgress(ctx, cask.URL, reporter.progressCallback("Cask "+cask.Token))
+	data, err := json.MarshalIndent(snap, "", "  ")
 	if err != nil {
-		return err
+		_ = os.RemoveAll(dir)
+		return Snapshot{}, err
 	}
-	if err := verifySHA256(archive, cask.SHA256); err != nil {
-		return fmt.Errorf("verify cask checksum: %w", err)
+	if err := os.WriteFile(filepath.Join(dir, "snapshot.json"), append(data, '\n'), 0o644); err != nil {
+		_ = os.RemoveAll(dir)
+		return Snapshot{}, fmt.Errorf("write snapshot: %w", err)
 	}
+	return snap, nil
+}
 
-	if err := os.RemoveAll(caskDir); err != nil {
-		return err
+func (m *Manager) ListSnapshots() ([]Snapshot, error) {
+	entries, err := os.ReadDir(m.snapshotsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
 	}
-	if err := os.MkdirAll(caskDir, 0o755); err != nil {
-		return err
+	out := make([]Snapshot, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		snap, err := m.readSnapshot(e.Name())
+		if err != nil {
+			continue
+		}
+		out = append(out, snap)
 	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out, nil
+}
 
-	isZip, err := isZipArchive(archive)
-	if err != nil {
-		return err
+func (m *Manager) readSnapshot(name string) (Snapshot, error) {
+	if !snapshotNamePattern.MatchString(name) {
+		return Snapshot{}, fmt.Errorf("invalid snapshot name %q", name)
 	}
-	if isZip {
-		if err := extractZip(archive, caskDir); err != nil {
-			return err
+	data, err := os.ReadFile(filepath.Join(m.snapshotsDir(), name, "snapshot.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Snapshot{}, fmt.Errorf("snapshot %q does not exist", name)
 		}
-	} else if err := extractTarGz(archive, caskDir); err != nil {
-		return err
+		return Snapshot{}, err
 	}
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return Snapshot{}, fmt.Errorf("parse snapshot %q: %w", name, err)
+	}
+	return snap, nil
+}
 
-	appSource, err := findFileInTree(caskDir, filepath.Base(appName))
-	if err != nil {
+func (m *Manager) DeleteSnapshot(name string) error {
+	if _, err := m.readSnapshot(name); err != nil {
 		return err
 	}
-	appDest := filepath.Join(m.Paths.Applications, filepath.Base(appName))
+	return os.RemoveAll(filepath.Join(m.snapshotsDir(), name))
+}
 
-	fmt.Printf("==> Installing Cask %s\n", cask.Token)
-	if err := os.RemoveAll(appDest); err != nil {
-		return err
+// RestoreSnapshot rolls the prefix back to the snapshot: packages installed
+// since are removed, and each snapshot formula is relinked at its recorded
+// version, from the Cellar or the snapshot's clone. Nothing is downloaded.
+func (m *Manager) RestoreSnapshot(ctx context.Context, name string) (RestoreSummary, error) {
+	snap, err := m.readSnapshot(name)
+	if err != nil {
+		return RestoreSummary{}, err
 	}
-	if err := os.Rename(appSource, appDest); err != nil {
-		return err
+	formulae, casks, err := m.InstalledVersions()
+	if err != nil {
+		return RestoreSummary{}, err
 	}
-	fmt.Printf("==> Moving App '%s' to '%s'\n", filepath.Base(appName), appDest)
-
-	linked := make([]string, 0)
-	for _, bin := range cask.BinaryArtifacts() {
-		src := strings.ReplaceAll(bin.Source, "$APPDIR", m.Paths.Applications)
-		target := strings.TrimSpace(bin.Target)
-		if target == "" {
-			target = filepath.Base(src)
+	summary := RestoreSummary{}
+	var removeFormulae, removeCasks []string
+	for formula := range formulae {
+		if _, ok := snap.Formulae[formula]; !ok {
+			removeFormulae = append(removeFormulae, formula)
 		}
-		dst := filepath.Join(m.Paths.Bin, target)
-		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
-			return err
+	}
+	for token, version := range casks {
+		want, ok := snap.Casks[token]
+		switch {
+		case !ok:
+			removeCasks = append(removeCasks, token)
+		case want != version:
+			summary.Unrestorable = append(summary.Unrestorable, token+" "+want)
 		}
-		if err := os.Symlink(src, dst); err != nil {
-			return err
+	}
+	for token, version := range snap.Casks {
+		if _, ok := casks[token]; !ok {
+			summary.Unrestorable = append(summary.Unrestorable, token+" "+version)
 		}
-		fmt.Printf("==> Linking Binary '%s' to '%s'\n", filepath.Base(src), dst)
-		linked = append(linked, dst)
 	}
+	sort.Strings(removeFormulae)
+	sort.Strings(removeCasks)
 
-	if err := writeCaskReceipt(caskDir, cask.Token, version, appDest, linked); err != nil {
-		return err
+	lockHandle, err := m.acquireLock(ctx, m.Paths.Cellar)
+	if err != nil {
+		return summary, err
 	}
-
-	fmt.Printf("🍺  %s was successfully installed!\n", cask.Token)
-	return nil
-}
-
-func (m *Manager) resolveClosure(ctx context.Context, roots []string) (map[string]homebrewapi.Formula, error) {
-	seen := map[string]homebrewapi.Formula{}
-	visiting := map[string]bool{}
-
-	var dfs func(string) error
-	dfs = func(name string) error {
-		if _, ok := seen[name]; ok {
-			return nil
+	defer lockHandle.Release()
+	// The snapshot was a consistent set, so removals skip the dependents check.
+	reporter := newUninstallReporter()
+	if _, err := m.uninstallFormulaBatch(ctx, removeFormulae, true, reporter); err != nil {
+		return summary, err
+	}
+	if _, err := m.uninstallCaskBatch(ctx, removeCasks, false, reporter); err != nil {
+		return summary, err
+	}
+	summary.Removed = append(removeFormulae, removeCasks...)
+	sort.Strings(summary.Removed)
+	snapshotCellar := filepath.Join(m.snapshotsDir(), name, "Cellar")
+	for _, formula := range sortedKeys(snap.Formulae) {
+		if err := ctx.Err(); err != nil {
+			return summary, err
 		}
-		if visiting[name] {
-			return fmt.Errorf("dependency cycle detected at %q", name)
+		version := snap.Formulae[formula]
+		formulaDir := filepath.Join(m.Paths.Cellar, formula)
+		kegDir := filepath.Join(formulaDir, version)
+		if formulae[formula] == version && countVersionDirs(formulaDir) == 1 {
+			continue
+		}
+		if _, err := os.Stat(kegDir); err != nil {
+			clone := filepath.Join(snapshotCellar, formula, version)
+			if _, cloneErr := os.Stat(clone); cloneErr != nil {
+				summary.Unrestorable = append(summary.Unrestorable, formula+" "+version)
+				continue
+			}
+			if err := cloneTree(ctx, clone, kegDir); err != nil {
+				return summary, fmt.Errorf("restore %s from snapshot: %w", formula, err)
+			}
+		}
+		if err := m.unlinkTree(formulaDir, m.linkDir("bin"), "bin"); err != nil {
+			return summary, err
+		}
+		if err := m.unlinkTree(formulaDir, m.linkDir("sbin"), "sbin"); err != nil {
+			return summary, err
+		}
+		versions, err := os.ReadDir(formulaDir)
+		if err != nil {
+			return summary, err
+		}
+		for _, v := range versions {
+			if v.IsDir() && v.Name() != version {
+				if err := os.RemoveAll(filepath.Join(formulaDir, v.Name())); err != nil {
+					return summary, err
+				}
+			}
+		}
+		if err := m.recordFormula(formula); err != nil {
+			return summary, err
+		}
+		if _, err := m.linkFormula(formula, version); err != nil {
+			return summary, err
+		}
+		summary.Relinked = append(summary.Relinked, formula)
+	}
+	sort.Strings(summary.Unrestorable)
+	return summary, nil
+}
+
+// Generation mode keeps each version of the bin/sbin link farm in
+// <prefix>/var/ub/generations/N. <prefix>/bin and <prefix>/sbin are symlinks
+// through generations/current, so switching generations swaps one symlink.
+type Generation struct {
+	Number  int       `json:"number"`
+	Created time.Time `json:"created"`
+	Command string    `json:"command,omitempty"`
+	Current bool      `json:"-"`
+}
+
+type generationTxn struct {
+	lock *lock.FileLock
+	dir  string
+	gen  Generation
+}
+
+func (m *Manager) generationsDir() string {
+	return filepath.Join(m.Paths.Prefix, "var", "ub", "generations")
+}
+
+// linkDir returns where links for leaf ("bin" or "sbin") are written: the
+// generation being built when one is open, else the prefix directory.
+func (m *Manager) linkDir(leaf string) string {
+	if m.generation != nil {
+		return filepath.Join(m.generation.dir, leaf)
+	}
+	if leaf == "sbin" {
+		return m.Paths.Sbin
+	}
+	return m.Paths.Bin
+}
+
+// workingLinkPath maps a recorded <prefix>/bin path into the open generation.
+func (m *Manager) workingLinkPath(path string) string {
+	for _, leaf := range []string{"bin", "sbin"} {
+		root := m.Paths.Bin
+		if leaf == "sbin" {
+			root = m.Paths.Sbin
+		}
+		if rel, err := filepath.Rel(root, path); err == nil && !strings.HasPrefix(rel, "..") {
+			return filepath.Join(m.linkDir(leaf), rel)
+		}
+	}
+	return path
+}
+
+// acquireLock locks dir, queueing behind another process for LockWait.
+func (m *Manager) acquireLock(ctx context.Context, dir string) (*lock.FileLock, error) {
+	return lock.AcquireWait(ctx, dir, m.LockWait, func(holder lock.Holder) {
+		messages.Println(messages.WaitingForLock, filepath.Join(dir, ".ub.lock"), holder)
+	})
+}
+
+// BeginGeneration starts a new link farm generation copied from the current
+// one. Links made until CommitGeneration land in the new generation, so the
+// live prefix only changes when it is committed.
+func (m *Manager) BeginGeneration(ctx context.Context, command string) error {
+	root := m.generationsDir()
+	handle, err := lock.Acquire(root)
+	if err != nil {
+		return err
+	}
+	if err := m.adoptLinkFarm(); err != nil {
+		_ = handle.Release()
+		return err
+	}
+	gens, err := m.Generations()
+	if err != nil {
+		_ = handle.Release()
+		return err
+	}
+	next := Generation{Number: 1, Created: m.clock().Now().UTC(), Command: command}
+	current := ""
+	for _, g := range gens {
+		if g.Number >= next.Number {
+			next.Number = g.Number + 1
+		}
+		if g.Current {
+			current = filepath.Join(root, strconv.Itoa(g.Number))
+		}
+	}
+	dir := filepath.Join(root, strconv.Itoa(next.Number))
+	if err := writeGeneration(ctx, dir, next, current); err != nil {
+		_ = os.RemoveAll(dir)
+		_ = handle.Release()
+		return err
+	}
+	m.generation = &generationTxn{lock: handle, dir: dir, gen: next}
+	return nil
+}
+
+// CommitGeneration makes the open generation current, or discards it when
+// keep is false.
+func (m *Manager) CommitGeneration(keep bool) error {
+	txn := m.generation
+	if txn == nil {
+		return nil
+	}
+	m.generation = nil
+	defer txn.lock.Release()
+	if !keep {
+		return os.RemoveAll(txn.dir)
+	}
+	return m.switchGeneration(txn.gen.Number)
+}
+
+// RollbackGeneration makes generation number current, or the newest one
+// older than the current generation when number is 0.
+func (m *Manager) RollbackGeneration(number int) (Generation, error) {
+	handle, err := lock.Acquire(m.generationsDir())
+	if err != nil {
+		return Generation{}, err
+	}
+	defer handle.Release()
+	gens, err := m.Generations()
+	if err != nil {
+		return Generation{}, err
+	}
+	current := 0
+	for _, g := range gens {
+		if g.Current {
+			current = g.Number
+		}
+	}
+	var target *Generation
+	for i := range gens {
+		g := gens[i]
+		if (number == 0 && g.Number < current) || (number != 0 && g.Number == number) {
+			target = &gens[i]
+		}
+	}
+	if target == nil {
+		if number == 0 {
+			return Generation{}, fmt.Errorf("no generation older than %d", current)
+		}
+		return Generation{}, fmt.Errorf("generation %d does not exist", number)
+	}
+	if err := m.switchGeneration(target.Number); err != nil {
+		return Generation{}, err
+	}
+	return *target, nil
+}
+
+// Generations lists the recorded generations, oldest first.
+func (m *Manager) Generations() ([]Generation, error) {
+	root := m.generationsDir()
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	current, _ := os.Readlink(filepath.Join(root, "current"))
+	var out []Generation
+	for _, e := range entries {
+		number, err := strconv.Atoi(e.Name())
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		gen := Generation{Number: number}
+		if data, err := os.ReadFile(filepath.Join(root, e.Name(), "generation.json")); err == nil {
+			_ = json.Unmarshal(data, &gen)
+		}
+		gen.Current = e.Name() == current
+		out = append(out, gen)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Number < out[j].Number })
+	return out, nil
+}
+
+func writeGeneration(ctx context.Context, dir string, gen Generation, from string) error {
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return fmt.Errorf("create generation: %w", err)
+	}
+	for _, leaf := range []string{"bin", "sbin"} {
+		if from != "" {
+			if err := cloneTree(ctx, filepath.Join(from, leaf), filepath.Join(dir, leaf)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("copy %s links: %w", leaf, err)
+			}
+		}
+		if err := os.MkdirAll(filepath.Join(dir, leaf), 0o755); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(gen, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "generation.json"), append(data, '\n'), 0o644)
+}
+
+// adoptLinkFarm turns existing bin/sbin directories into generation 1 the
+// first time generation mode is used.
+func (m *Manager) adoptLinkFarm() error {
+	root := m.generationsDir()
+	if info, err := os.Lstat(m.Paths.Bin); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	first := filepath.Join(root, "1")
+	if err := os.MkdirAll(first, 0o755); err != nil {
+		return err
+	}
+	for _, leaf := range []string{"bin", "sbin"} {
+		live := m.Paths.Bin
+		if leaf == "sbin" {
+			live = m.Paths.Sbin
+		}
+		if err := os.Rename(live, filepath.Join(first, leaf)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("adopt %s: %w", live, err)
+		}
+		if err := os.MkdirAll(filepath.Join(first, leaf), 0o755); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(Generation{Number: 1, Created: m.clock().Now().UTC(), Command: "adopt"}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(first, "generation.json"), append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	if err := m.switchGeneration(1); err != nil {
+		return err
+	}
+	for _, leaf := range []string{"bin", "sbin"} {
+		live := m.Paths.Bin
+		if leaf == "sbin" {
+			live = m.Paths.Sbin
+		}
+		target, err := filepath.Rel(filepath.Dir(live), filepath.Join(root, "current", leaf))
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, live); err != nil {
+			return fmt.Errorf("link %s: %w", live, err)
+		}
+	}
+	return nil
+}
+
+// switchGeneration atomically repoints generations/current at number.
+func (m *Manager) switchGeneration(number int) error {
+	root := m.generationsDir()
+	tmp := filepath.Join(root, "current.new")
+	_ = os.Remove(tmp)
+	if err := os.Symlink(strconv.Itoa(number), tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(root, "current")); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("switch generation: %w", err)
+	}
+	return nil
+}
+
+func sortedKeys(values map[string]string) []string {
+	out := make([]string, 0, len(values))
+	for key := range values {
+		out = append(out, key)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func countVersionDirs(formulaDir string) int {
+	entries, err := os.ReadDir(formulaDir)
+	if err != nil {
+		return 0
+	}
+	return countDirs(entries)
+}
+
+// cloneTree copies src to dst using hard links, falling back to a byte copy
+// when src and dst are on different filesystems.
+func cloneTree(ctx context.Context, src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d os.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0o700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		}
+		if err := os.Link(path, target); err == nil {
+			return nil
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			_ = out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
+
+func (m *Manager) Install(ctx context.Context, names []string) error {
+	return m.InstallWithOptions(ctx, names, InstallOptions{})
+}
+
+func (m *Manager) InstallWithOptions(ctx context.Context, names []string, opts InstallOptions) error {
+	ctx, span := trace.Start(ctx, "ub.install", trace.Int("ub.requested", int64(len(names))))
+	err := m.install(ctx, names, opts)
+	span.End(err)
+	return err
+}
+
+// lookupRequested finds the formula or cask a requested name refers to: a
+// homebrew/cask/ name is always a cask, and any other name is a formula
+// unless only a cask has it.
+func (m *Manager) lookupRequested(ctx context.Context, name string) (*homebrewapi.Formula, *homebrewapi.Cask, error) {
+	if !strings.HasPrefix(strings.ToLower(name), "homebrew/cask/") {
+		f, err := m.API.FormulaByName(ctx, name)
+		if err == nil {
+			return &f, nil, nil
+		}
+		if !isNotFoundError(err) {
+			return nil, nil, err
+		}
+	}
+	cask, err := m.API.CaskByName(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, &cask, nil
+}
+
+func (m *Manager) install(ctx context.Context, names []string, opts InstallOptions) error {
+	if opts.OnlyDependencies && opts.IgnoreDependencies {
+		return fmt.Errorf("--only-dependencies and --ignore-dependencies are mutually exclusive")
+	}
+	formulaRoots := make([]string, 0, len(names))
+	known := make(map[string]homebrewapi.Formula, len(names))
+	casks := make([]homebrewapi.Cask, 0)
+	bottles := make([]string, 0)
+	seen := make(map[string]bool, len(names))
+	for _, raw := range names {
+		name := strings.TrimSpace(raw)
+		if name == "" {
+			continue
+		}
+		if isBottleReference(name) {
+			bottles = append(bottles, name)
+			continue
+		}
+		f, cask, err := m.lookupRequested(ctx, name)
+		if err != nil && !isNotFoundError(err) {
+			return err
+		}
+		// Plugins see the kind the name resolves to; a name found nowhere
+		// is asked about as a formula, which a plugin may rename.
+		kind := "formula"
+		if cask != nil {
+			kind = "cask"
+		}
+		resolved, resolveErr := m.Plugins.Resolve(name, kind)
+		if resolveErr != nil {
+			return resolveErr
+		}
+		if resolved != name {
+			name = resolved
+			f, cask, err = m.lookupRequested(ctx, name)
+		}
+		if err != nil {
+			return m.notFound(name, err)
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if cask != nil {
+			casks = append(casks, *cask)
+			continue
+		}
+		// A qualified name such as homebrew/core/wget installs as wget.
+		formulaRoots = append(formulaRoots, f.Name)
+		known[f.Name] = *f
+	}
+	for _, raw := range opts.Casks {
+		token := strings.TrimSpace(raw)
+		if token == "" || slices.ContainsFunc(casks, func(c homebrewapi.Cask) bool { return c.Token == token }) {
+			continue
+		}
+		cask, err := m.API.CaskByName(ctx, token)
+		if err != nil {
+			return err
+		}
+		casks = append(casks, cask)
+	}
+
+	if opts.HEAD && (len(casks) > 0 || len(bottles) > 0) {
+		return fmt.Errorf("--HEAD only applies to formulae")
+	}
+
+	completed := make([]string, 0, len(formulaRoots)+len(casks))
+	if opts.HEAD {
+		built, err := m.installHeads(ctx, formulaRoots, known, opts)
+		if err != nil {
+			if len(built) > 0 {
+				return &PartialError{Completed: built, Err: err}
+			}
+			return err
+		}
+		return nil
+	}
+	if len(formulaRoots) > 0 {
+		if err := m.installFormulas(ctx, formulaRoots, known, opts, true); err != nil {
+			return err
+		}
+		completed = append(completed, formulaRoots...)
+	}
+	if len(bottles) > 0 {
+		poured, err := m.installBottleFiles(ctx, bottles, opts)
+		completed = append(completed, poured...)
+		if err != nil {
+			if len(completed) > 0 {
+				return &PartialError{Completed: completed, Err: err}
+			}
+			return err
+		}
+	}
+
+	if opts.OnlyDependencies {
+		return nil
+	}
+	if len(casks) > 0 {
+		installed, err := m.installCasks(ctx, casks, false)
+		completed = append(completed, installed...)
+		if err != nil {
+			if len(completed) > 0 {
+				return &PartialError{Completed: completed, Err: err}
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bottleFilePattern matches brew's bottle filenames, such as
+// ffmpeg--8.0.1.arm64_sonoma.bottle.tar.gz or jq--1.7.1.all.bottle.1.tar.gz.
+var bottleFilePattern = regexp.MustCompile(`^(.+?)--(.+)\.([a-z0-9_]+)\.bottle(?:\.\d+)?\.tar\.gz$`)
+
+type bottleFile struct {
+	source  string
+	name    string
+	version string
+	tag     string
+	sha256  string
+}
+
+// isBottleReference reports whether an install argument names a bottle
+// archive or URL rather than a formula or cask.
+func isBottleReference(ref string) bool {
+	if u, err := url.Parse(ref); err == nil {
+		switch u.Scheme {
+		case "http", "https", "file":
+			return true
+		}
+	}
+	return strings.HasSuffix(ref, ".tar.gz")
+}
+
+// parseBottleReference infers the formula name, version and tag from the
+// bottle filename and, for local files, a sidecar written by brew bottle --json.
+func parseBottleReference(ref, sha string) (bottleFile, error) {
+	b := bottleFile{source: ref}
+	local := ref
+	if u, err := url.Parse(ref); err == nil && u.Scheme != "" {
+		local = ""
+		if u.Scheme == "file" {
+			local = u.Path
+			b.source = u.Path
+		}
+		ref = u.Path
+	}
+	if match := bottleFilePattern.FindStringSubmatch(path.Base(ref)); match != nil {
+		b.name, b.version, b.tag = match[1], match[2], match[3]
+	}
+	if local != "" {
+		if _, err := os.Stat(local); err != nil {
+			return bottleFile{}, err
+		}
+		if err := b.readSidecar(strings.TrimSuffix(local, ".tar.gz") + ".json"); err != nil {
+			return bottleFile{}, err
+		}
+	}
+	if strings.TrimSpace(sha) != "" {
+		b.sha256 = strings.TrimSpace(sha)
+	}
+	// The archive may still supply what the filename and sidecar did not.
+	if b.name != "" {
+		if err := validBottleName(b.name); err != nil {
+			return bottleFile{}, err
+		}
+	}
+	if b.version != "" {
+		if err := validBottleVersion(b.version); err != nil {
+			return bottleFile{}, err
+		}
+	}
+	return b, nil
+}
+
+// validBottleName checks a formula name taken from a bottle's filename,
+// sidecar or layout, which become a directory in the Cellar.
+func validBottleName(name string) error {
+	canonical, err := homebrewapi.CanonicalName("formula", name)
+	if err != nil {
+		return err
+	}
+	if canonical != name {
+		return fmt.Errorf("bottle formula name %q must not name a tap", name)
+	}
+	return nil
+}
+
+// validBottleVersion checks a version taken from a bottle, which becomes the
+// keg directory under the formula's.
+func validBottleVersion(version string) error {
+	if version == "" || version == "." || version == ".." || strings.ContainsAny(version, `/\`) {
+		return fmt.Errorf("invalid bottle version %q", version)
+	}
+	return nil
+}
+
+func (b *bottleFile) readSidecar(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var sidecar map[string]struct {
+		Formula struct {
+			Name       string `json:"name"`
+			PkgVersion string `json:"pkg_version"`
+		} `json:"formula"`
+		Bottle struct {
+			Tags map[string]struct {
+				SHA256 string `json:"sha256"`
+			} `json:"tags"`
+		} `json:"bottle"`
+	}
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		return fmt.Errorf("parse bottle sidecar %s: %w", path, err)
+	}
+	for _, entry := range sidecar {
+		if entry.Formula.Name != "" {
+			b.name = entry.Formula.Name
+		}
+		if entry.Formula.PkgVersion != "" {
+			b.version = entry.Formula.PkgVersion
+		}
+		if tag, ok := entry.Bottle.Tags[b.tag]; ok {
+			b.sha256 = tag.SHA256
+		} else if len(entry.Bottle.Tags) == 1 {
+			for name, tag := range entry.Bottle.Tags {
+				b.tag, b.sha256 = name, tag.SHA256
+			}
+		}
+	}
+	return nil
+}
+
+// installBottleFiles pours bottles given as paths or URLs. Dependencies are
+// taken from the API when it knows the formula, which private bottles may not.
+func (m *Manager) installBottleFiles(ctx context.Context, refs []string, opts InstallOptions) ([]string, error) {
+	bottles := make([]bottleFile, 0, len(refs))
+	for _, ref := range refs {
+		b, err := parseBottleReference(ref, opts.BottleSHA256)
+		if err != nil {
+			return nil, err
+		}
+		bottles = append(bottles, b)
+	}
+	if !opts.IgnoreDependencies {
+		var deps []string
+		for _, b := range bottles {
+			if b.name == "" {
+				continue
+			}
+			f, err := m.API.FormulaByName(ctx, b.name)
+			if err != nil {
+				if isNotFoundError(err) {
+					continue
+				}
+				return nil, err
+			}
+			deps = append(deps, f.Dependencies...)
+		}
+		if len(deps) > 0 {
+			depOpts := InstallOptions{ForceBottle: opts.ForceBottle}
+			if err := m.installFormulas(ctx, deps, nil, depOpts, false); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if opts.OnlyDependencies {
+		return nil, nil
+	}
+
+	if err := m.EnsureLayout(); err != nil {
+		return nil, err
+	}
+	lockHandle, err := m.acquireLock(ctx, m.Paths.Cellar)
+	if err != nil {
+		return nil, err
+	}
+	defer lockHandle.Release()
+
+	reporter := newInstallReporter(m.Paths, nil, nil)
+	for _, b := range bottles {
+		if err := m.pourBottleFile(ctx, b, reporter); err != nil {
+			return reporter.installedNames(), err
+		}
+	}
+	reporter.printSummary()
+	return reporter.installedNames(), nil
+}
+
+func (m *Manager) pourBottleFile(ctx context.Context, b bottleFile, reporter *installReporter) error {
+	archive, bottleURL := b.source, b.source
+	if strings.Contains(b.source, "://") {
+		var err error
+		if bottleURL, err = m.Plugins.RewriteURL(b.name, b.source); err != nil {
+			return err
+		}
+		label := messages.Sprintf(messages.BottleLabel, path.Base(b.source), b.version)
+		if archive, err = m.Fetch.FetchWithProgress(ctx, bottleURL, reporter.progressCallback("", label)); err != nil {
+			return err
+		}
+	}
+	if err := verifySHA256(archive, b.sha256); err != nil {
+		return fmt.Errorf("verify bottle checksum (%s): %w", filepath.Base(b.source), err)
+	}
+	provenance, err := m.provenance(bottleURL, archive, b.sha256, b.tag)
+	if err != nil {
+		return err
+	}
+
+	if err := m.waitForSpace(ctx, m.Paths.Cellar, reporter); err != nil {
+		return err
+	}
+	staging, err := os.MkdirTemp(m.Paths.Cellar, ".ub-pour-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	manifest, err := extractTar(ctx, archive, staging, m.extractOptions())
+	if err != nil {
+		return err
+	}
+	if b.name == "" {
+		if b.name, err = onlySubdir(staging); err != nil {
+			return fmt.Errorf("cannot infer formula name from %s: %w", filepath.Base(b.source), err)
+		}
+	}
+	if b.version == "" {
+		if b.version, err = onlySubdir(filepath.Join(staging, b.name)); err != nil {
+			return fmt.Errorf("cannot infer %s version from %s: %w", b.name, filepath.Base(b.source), err)
+		}
+	}
+	if err := validBottleName(b.name); err != nil {
+		return err
+	}
+	if err := validBottleVersion(b.version); err != nil {
+		return err
+	}
+	stagedKeg := filepath.Join(staging, b.name, b.version)
+	if info, err := os.Stat(stagedKeg); err != nil || !info.IsDir() {
+		return fmt.Errorf("bottle %s does not contain %s/%s", filepath.Base(b.source), b.name, b.version)
+	}
+	reporter.printInstalling(b.name, b.version, b.tag, true, b.source, 0)
+	manifest = manifest.relativeTo(stagedKeg)
+	if err := writeFormulaReceipt(stagedKeg, true); err != nil {
+		return err
+	}
+	if err := writeFormulaProvenance(stagedKeg, provenance); err != nil {
+		return err
+	}
+
+	installDir := filepath.Join(m.Paths.Cellar, b.name, b.version)
+	if rel, err := filepath.Rel(m.Paths.Cellar, installDir); err != nil || !filepath.IsLocal(rel) || len(strings.Split(rel, string(filepath.Separator))) != 2 {
+		return fmt.Errorf("refusing to replace %s: not a keg in %s", installDir, m.Paths.Cellar)
+	}
+	fsys := m.fs()
+	if err := fsys.RemoveAll(installDir); err != nil {
+		return fmt.Errorf("clear existing install dir: %w", err)
+	}
+	if err := fsys.MkdirAll(filepath.Dir(installDir), 0o755); err != nil {
+		return err
+	}
+	if err := fsys.Rename(stagedKeg, installDir); err != nil {
+		return err
+	}
+	if err := m.writeKegManifest(installDir, manifest); err != nil {
+		return err
+	}
+	if err := m.recordFormula(b.name); err != nil {
+		return err
+	}
+	linkedVersion, err := m.linkFormula(b.name, b.version)
+	if err != nil {
+		return err
+	}
+	kegDir := filepath.Join(m.Paths.Cellar, b.name, linkedVersion)
+	if err := m.Plugins.PostInstall(plugin.PostInstallRequest{Name: b.name, Version: linkedVersion, Kind: "formula", Path: kegDir}); err != nil {
+		return err
+	}
+	m.reportPoured(reporter, b.name, linkedVersion)
+	return nil
+}
+
+// headKegPrefix starts the version of kegs built from a head URL. Upgrade
+// leaves them alone, as brew does without --fetch-HEAD.
+const headKegPrefix = "HEAD-"
+
+// installHeads builds each formula from its head URL after pouring its
+// runtime and build dependencies as bottles.
+func (m *Manager) installHeads(ctx context.Context, names []string, known map[string]homebrewapi.Formula, opts InstallOptions) ([]string, error) {
+	if !opts.IgnoreDependencies {
+		roots := make(map[string]bool, len(names))
+		for _, name := range names {
+			roots[name] = true
+		}
+		var deps []string
+		for _, name := range names {
+			f := known[name]
+			for _, dep := range append(append([]string{}, f.Dependencies...), f.BuildDependencies...) {
+				if !roots[dep] {
+					deps = append(deps, dep)
+				}
+			}
+		}
+		if len(deps) > 0 {
+			if err := m.installFormulas(ctx, deps, nil, InstallOptions{ForceBottle: opts.ForceBottle}, false); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if opts.OnlyDependencies {
+		return nil, nil
+	}
+
+	if err := m.EnsureLayout(); err != nil {
+		return nil, err
+	}
+	lockHandle, err := m.acquireLock(ctx, m.Paths.Cellar)
+	if err != nil {
+		return nil, err
+	}
+	defer lockHandle.Release()
+
+	reporter := newInstallReporter(m.Paths, nil, nil)
+	for _, name := range names {
+		if err := m.buildHead(ctx, known[name], opts.TapDir, reporter); err != nil {
+			return reporter.installedNames(), err
+		}
+	}
+	reporter.printSummary()
+	return reporter.installedNames(), nil
+}
+
+// buildHead checks out the head branch, runs the tap's build steps or a detected
+// build system with PREFIX set to the final keg, and links the result.
+// Building in place keeps paths baked in by the build system valid; a
+// failed build removes the partial keg.
+func (m *Manager) buildHead(ctx context.Context, f homebrewapi.Formula, tapDir string, reporter *installReporter) error {
+	head := f.URLs.Head
+	if strings.TrimSpace(head.URL) == "" {
+		return fmt.Errorf("formula %q has no head URL", f.Name)
+	}
+	if head.Using != "" && head.Using != "git" {
+		return fmt.Errorf("formula %q: head download strategy %q is not supported", f.Name, head.Using)
+	}
+	workRoot := filepath.Join(m.Paths.Cache, "head")
+	if err := os.MkdirAll(workRoot, 0o755); err != nil {
+		return err
+	}
+	src, err := os.MkdirTemp(workRoot, f.Name+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(src)
+	rev, err := m.Fetch.FetchGit(ctx, head.URL, fetch.GitRef{Branch: head.Branch}, src)
+	if err != nil {
+		return fmt.Errorf("fetch %s head: %w", f.Name, err)
+	}
+	version := headKegPrefix + rev[:min(7, len(rev))]
+	installDir := filepath.Join(m.Paths.Cellar, f.Name, version)
+	if _, err := os.Stat(installDir); err == nil {
+		messages.Println(messages.AlreadyInstalled, f.Name, version)
+		return nil
+	}
+
+	steps, err := headBuildSteps(src, f.Name, tapDir)
+	if err != nil {
+		return err
+	}
+	messages.Println(messages.BuildingHead, f.Name, head.URL)
+	return m.buildKeg(ctx, f.Name, version, src, steps, true, "", reporter)
+}
+
+// buildKeg runs steps in src under sh with $PREFIX set to the keg for name
+// at version, then records, links and reports the keg. tap, when set, is
+// recorded in the receipt. A failed build removes the partial keg.
+func (m *Manager) buildKeg(ctx context.Context, name, version, src string, steps []string, onRequest bool, tap string, reporter *installReporter) error {
+	installDir := filepath.Join(m.Paths.Cellar, name, version)
+	if err := os.MkdirAll(installDir, 0o755); err != nil {
+		return err
+	}
+	env := append(os.Environ(),
+		"PREFIX="+installDir,
+		"UB_PREFIX="+m.Paths.Prefix,
+		"UB_FORMULA_NAME="+name,
+		"UB_FORMULA_VERSION="+version,
+		"PATH="+m.Paths.Bin+string(os.PathListSeparator)+os.Getenv("PATH"),
+		fmt.Sprintf("MAKEFLAGS=-j%d", runtime.NumCPU()),
+	)
+	for _, step := range steps {
+		cmd := exec.CommandContext(ctx, "sh", "-c", step)
+		cmd.Dir = src
+		cmd.Env = env
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			_ = os.RemoveAll(installDir)
+			return fmt.Errorf("build %s: step %q: %w", name, step, err)
+		}
+	}
+
+	var manifest kegManifest
+	err := filepath.WalkDir(installDir, func(path string, d os.DirEntry, walkErr error) error {
+		if walkErr != nil || d.IsDir() {
+			return walkErr
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		manifest.add(path, info.Size())
+		return nil
+	})
+	if err == nil && manifest.Files == 0 {
+		err = fmt.Errorf("build of %s installed nothing into %s", name, installDir)
+	}
+	if err == nil {
+		err = writeFormulaReceipt(installDir, onRequest)
+	}
+	if err == nil && tap != "" {
+		err = updateFormulaReceipt(installDir, func(receipt map[string]any) { receipt["tap"] = tap })
+	}
+	if err == nil {
+		err = m.writeKegManifest(installDir, manifest)
+	}
+	if err != nil {
+		_ = os.RemoveAll(installDir)
+		return err
+	}
+	if err := m.recordFormula(name); err != nil {
+		return err
+	}
+	if _, err := m.linkFormula(name, version); err != nil {
+		return err
+	}
+	if err := m.Plugins.PostInstall(plugin.PostInstallRequest{Name: name, Version: version, Kind: "formula", Path: installDir}); err != nil {
+		return err
+	}
+	m.reportPoured(reporter, name, version)
+	return nil
+}
+
+// headBuildSteps prefers build steps from the tap's formula JSON, then
+// guesses from the files at the top of the checkout. Steps run under sh
+// with $PREFIX set.
+func headBuildSteps(src, name, tapDir string) ([]string, error) {
+	if strings.TrimSpace(tapDir) != "" {
+		if f, err := formula.LoadByName(tapDir, name); err == nil && len(f.Build.Steps) > 0 {
+			return f.Build.Steps, nil
+		}
+	}
+	has := func(names ...string) bool {
+		for _, n := range names {
+			if _, err := os.Stat(filepath.Join(src, n)); err == nil {
+				return true
+			}
+		}
+		return false
+	}
+	configure := []string{`./configure --prefix="$PREFIX"`, "make", "make install"}
+	switch {
+	case has("meson.build"):
+		return []string{`meson setup build --prefix="$PREFIX" --buildtype=release`, "meson compile -C build", "meson install -C build"}, nil
+	case has("CMakeLists.txt"):
+		return []string{`cmake -S . -B build -DCMAKE_INSTALL_PREFIX="$PREFIX" -DCMAKE_BUILD_TYPE=Release`, "cmake --build build", "cmake --install build"}, nil
+	case has("configure"):
+		return configure, nil
+	case has("autogen.sh"):
+		return append([]string{"./autogen.sh"}, configure...), nil
+	case has("configure.ac", "configure.in"):
+		return append([]string{"autoreconf -fi"}, configure...), nil
+	case has("Makefile", "makefile", "GNUmakefile"):
+		return []string{`make PREFIX="$PREFIX"`, `make install PREFIX="$PREFIX"`}, nil
+	}
+	return nil, fmt.Errorf("cannot detect a build system for %s; add build steps to a tap formula and pass --tap", name)
+}
+
+func onlySubdir(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	if dirs := countDirs(entries); dirs != 1 {
+		return "", fmt.Errorf("expected one directory in the archive, found %d", dirs)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			return entry.Name(), nil
+		}
+	}
+	return "", nil
+}
+
+// installFormulas installs names and their dependencies. known holds metadata
+// already fetched for the roots. When markRequested is set, the names given
+// are recorded as installed on request, never the dependencies that
+// --only-dependencies installs in their place; upgrades leave the existing state alone.
+// Formulae pinned to a tap are built from it first.
+func (m *Manager) installFormulas(ctx context.Context, names []string, known map[string]homebrewapi.Formula, opts InstallOptions, markRequested bool) error {
+	names, err := m.installPinned(ctx, names, known, opts, markRequested)
+	if err != nil || len(names) == 0 {
+		return err
+	}
+	if err := m.EnsureLayout(); err != nil {
+		return err
+	}
+	lockHandle, err := m.acquireLock(ctx, m.Paths.Cellar)
+	if err != nil {
+		return err
+	}
+	defer lockHandle.Release()
+
+	plan, err := m.planInstall(ctx, names, known, opts)
+	if err != nil {
+		return err
+	}
+	closure := plan.formulae
+	roots := make([]string, 0, len(names))
+	if opts.OnlyDependencies {
+		for _, dep := range directDependencies(plan.metadata, names) {
+			if _, ok := closure[dep]; ok {
+				roots = append(roots, dep)
+			}
+		}
+	} else {
+		for _, name := range names {
+			if _, ok := closure[name]; ok {
+				roots = append(roots, name)
+			}
+		}
+	}
+	reporter := newInstallReporter(m.Paths, roots, closure)
+	reporter.workers = m.Workers
+	reporter.onProgress = m.Progress
+	reporter.ordered = m.OrderedOutput
+	for _, name := range names {
+		version, ok := plan.satisfied[name]
+		if !ok {
+			continue
+		}
+		if markRequested && !opts.OnlyDependencies {
+			if err := m.markRequested(name, version); err != nil {
+				return err
+			}
+		}
+		reporter.printAlreadyInstalled(name, version)
+	}
+	reporter.printPlan()
+
+	requested := map[string]bool{}
+	if markRequested && !opts.OnlyDependencies {
+		for _, name := range names {
+			requested[name] = true
+		}
+	}
+	packages := make(map[string]pipeline.Package, len(closure))
+	for name, f := range closure {
+		p := formulaPackage(name, f)
+		p.Cost = m.bottleCost(name, f, opts)
+		packages[name] = p
+	}
+	source := bottleSource{manager: m, formulae: closure, reporter: reporter, requested: requested, opts: opts, provenance: &provenanceLog{}}
+	jobs, err := pipeline.Jobs(source, packages, roots)
+	if err != nil {
+		return err
+	}
+
+	reporter.totalJobs = len(jobs)
+	reporter.statusBar = (len(jobs) > 1 || reporter.ordered) && term.IsTerminal(int(os.Stdout.Fd()))
+	reporter.expect(m.expectDownloads(ctx, m.bottleURLs(closure, opts)))
+	reporter.holdFor(installOrder(packages))
+	err = m.runInstallJobs(ctx, jobs, reporter)
+	reporter.flushHeld()
+	if err != nil {
+		if ctx.Err() != nil {
+			reporter.printInterrupted()
+		}
+		if completed := reporter.installedNames(); len(completed) > 0 {
+			return &PartialError{Completed: completed, Err: err}
+		}
+		return err
+	}
+	reporter.printSummary()
+	return nil
+}
+
+func (m *Manager) installCask(ctx context.Context, cask homebrewapi.Cask, greedy bool) error {
+	_, err := m.installCasks(ctx, []homebrewapi.Cask{cask}, greedy)
+	return err
+}
+
+// installCasks fetches and extracts casks in parallel on the install
+// worker pool, as bottles are. Moving apps into place may ask to quit a
+// running app, so that happens afterwards, one cask at a time in order.
+// It returns the tokens installed, which fall short of casks only when err
+// is set.
+func (m *Manager) installCasks(ctx context.Context, casks []homebrewapi.Cask, greedy bool) ([]string, error) {
+	if err := m.EnsureLayout(); err != nil {
+		return nil, err
+	}
+	lockHandle, err := m.acquireLock(ctx, m.Paths.Caskroom)
+	if err != nil {
+		return nil, err
+	}
+	defer lockHandle.Release()
+
+	tokens := make([]string, 0, len(casks))
+	for _, cask := range casks {
+		tokens = append(tokens, cask.Token)
+	}
+	reporter := newInstallReporter(m.Paths, tokens, nil)
+	reporter.workers = m.Workers
+	reporter.onProgress = m.Progress
+	reporter.ordered = m.OrderedOutput
+	reporter.showHeader = len(casks) > 1
+	reporter.printPlan()
+
+	work := make(map[string]func(context.Context) error, len(casks))
+	fetched := make(map[string]fetchedCask, len(casks))
+	var fetchedMu sync.Mutex
+	for _, cask := range casks {
+		cask := cask
+		work[cask.Token] = func(ctx context.Context) error {
+			f, err := m.fetchCask(ctx, cask, reporter)
+			if err != nil {
+				return err
+			}
+			fetchedMu.Lock()
+			fetched[cask.Token] = f
+			fetchedMu.Unlock()
+			return nil
+		}
+	}
+	jobs, err := independentJobs(work)
+	if err != nil {
+		return nil, err
+	}
+	reporter.totalJobs = len(jobs)
+	reporter.statusBar = (len(jobs) > 1 || reporter.ordered) && term.IsTerminal(int(os.Stdout.Fd()))
+	reporter.expect(m.expectDownloads(ctx, m.caskURLs(casks)))
+	reporter.holdFor(tokens)
+	fetchErr := m.runInstallJobs(ctx, jobs, reporter)
+	reporter.flushHeld()
+	reporter.clearProgress()
+	if fetchErr != nil && ctx.Err() != nil {
+		for token, f := range fetched {
+			_ = os.RemoveAll(f.dir)
+			_ = m.recordCask(token)
+		}
+		return nil, fetchErr
+	}
+
+	// Casks that fetched are installed even when another one failed, so a
+	// retry only has the failures left to do.
+	installed := make([]string, 0, len(casks))
+	for _, cask := range casks {
+		f, ok := fetched[cask.Token]
+		if !ok || slices.Contains(installed, cask.Token) {
+			continue
+		}
+		if err := m.placeCask(cask, f, greedy); err != nil {
+			return installed, err
+		}
+		installed = append(installed, cask.Token)
+	}
+	return installed, fetchErr
+}
+
+type fetchedCask struct {
+	dir        string
+	provenance Provenance
+}
+
+// fetchCask downloads cask and extracts it into its Caskroom directory.
+func (m *Manager) fetchCask(ctx context.Context, cask homebrewapi.Cask, reporter *installReporter) (fetchedCask, error) {
+	version := caskVersion(cask)
+	caskDir := filepath.Join(m.Paths.Caskroom, cask.Token, version)
+	if len(cask.AppArtifacts()) == 0 && len(cask.FontArtifacts()) == 0 {
+		return fetchedCask{}, fmt.Errorf("cask %q has no app or font artifact", cask.Token)
+	}
+
+	caskURL, err := m.Plugins.RewriteURL(cask.Token, cask.URL)
+	if err != nil {
+		return fetchedCask{}, err
+	}
+	reporter.println(cask.Token, messages.Sprintf(messages.DownloadingCask, cask.Token))
+	fetchArchive := m.Fetch.FetchWithProgress
+	if version == "latest" {
+		fetchArchive = m.Fetch.FetchRevalidated
+	}
+	archive, err := fetchArchive(ctx, caskURL, reporter.progressCallback(cask.Token, messages.Sprintf(messages.CaskLabel, cask.Token)))
+	if err != nil {
+		return fetchedCask{}, err
+	}
+	if err := verifySHA256(archive, cask.SHA256); err != nil {
+		return fetchedCask{}, fmt.Errorf("verify cask checksum: %w", err)
+	}
+	if hasChecksum(cask.SHA256) {
+		_ = m.Fetch.RecordChecksum(archive, caskURL, cask.SHA256)
+	}
+	provenance, err := m.provenance(caskURL, archive, cask.SHA256, "")
+	if err != nil {
+		return fetchedCask{}, err
+	}
+
+	if err := os.RemoveAll(caskDir); err != nil {
+		return fetchedCask{}, err
+	}
+	if err := os.MkdirAll(caskDir, 0o755); err != nil {
+		return fetchedCask{}, err
+	}
+
+	if err := m.waitForSpace(ctx, m.Paths.Caskroom, reporter); err != nil {
+		return fetchedCask{}, err
+	}
+	release, err := scheduler.EnterPhase(ctx, scheduler.PhaseCPU)
+	if err != nil {
+		return fetchedCask{}, err
+	}
+	defer release()
+	extractCtx, extractSpan := trace.Start(ctx, "ub.extract", trace.String("ub.cask", cask.Token))
+	reporter.extractStarted()
+	err = extractArchive(extractCtx, archive, caskDir, m.extractOptions())
+	reporter.extractFinished()
+	extractSpan.End(err)
+	if err != nil {
+		_ = os.RemoveAll(caskDir)
+		return fetchedCask{}, err
+	}
+	return fetchedCask{dir: caskDir, provenance: provenance}, nil
+}
+
+// caskAppDestination is where an app bundle is moved to. The target comes
+// from the cask, and the old bundle there is removed first, so it must stay
+// inside the Applications directory.
+func caskAppDestination(applications string, app homebrewapi.CaskAppArtifact) (string, error) {
+	name := strings.TrimSpace(app.Target)
+	if name == "" {
+		name = filepath.Base(app.Source)
+	}
+	name = filepath.Clean(name)
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("app target %q is not inside %s", name, applications)
+	}
+	return filepath.Join(applications, name), nil
+}
+
+func caskVersion(cask homebrewapi.Cask) string {
+	if version := strings.TrimSpace(cask.Version); version != "" {
+		return version
+	}
+	return "latest"
+}
+
+// placeCask moves the apps and fonts fetchCask extracted into place, links
+// the cask's binaries and writes its receipt.
+func (m *Manager) placeCask(cask homebrewapi.Cask, fetched fetchedCask, greedy bool) error {
+	caskDir := fetched.dir
+	version := caskVersion(cask)
+	apps := cask.AppArtifacts()
+	fonts := cask.FontArtifacts()
+	var err error
+
+	// Locate every bundle before moving any, so a cask missing one of its
+	// apps leaves the Applications directory untouched.
+	sources := make([]string, len(apps))
+	dests := make([]string, len(apps))
+	for i, app := range apps {
+		sources[i], err = findFileInTree(caskDir, filepath.Base(app.Source))
+		if err != nil {
+			return err
+		}
+		dests[i], err = caskAppDestination(m.Paths.Applications, app)
+		if err != nil {
+			return err
+		}
+		if err := m.ensureAppNotRunning(dests[i], cask.QuitBundleIDs()); err != nil {
+			return err
+		}
+	}
+	messages.Println(messages.InstallingCask, cask.Token)
+	for i := range apps {
+		if err := os.RemoveAll(dests[i]); err != nil {
+			return err
+		}
+		if err := os.Rename(sources[i], dests[i]); err != nil {
+			return err
+		}
+		messages.Println(messages.MovingApp, filepath.Base(sources[i]), dests[i])
+	}
+	installedFonts, err := m.installCaskFonts(caskDir, fonts)
+	if err != nil {
+		return err
+	}
+
+	linked := make([]string, 0)
+	for _, bin := range cask.BinaryArtifacts() {
+		src := m.expandCaskPath(bin.Source, caskDir)
+		target := strings.TrimSpace(bin.Target)
+		if target == "" {
+			target = filepath.Base(src)
+		}
+		linkSrc, err := prepareCaskBinary(src, target, caskDir, dests)
+		if err != nil {
+			return err
+		}
+		if linkSrc == "" {
+			fmt.Fprintln(os.Stderr, messages.Sprintf(messages.Warning, fmt.Sprintf("skipping binary %s: %s is written by the cask's preflight block, which ub does not run", target, src)))
+			continue
+		}
+		dst := filepath.Join(m.Paths.Bin, target)
+		working := filepath.Join(m.linkDir("bin"), target)
+		if err := os.Remove(working); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Symlink(linkSrc, working); err != nil {
+			return err
+		}
+		messages.Println(messages.LinkingBinary, filepath.Base(src), dst)
+		linked = append(linked, dst)
+	}
+
+	receipt := caskInstallReceipt{
+		Token:          cask.Token,
+		Version:        version,
+		AppPaths:       dests,
+		Fonts:          installedFonts,
+		LinkedBinaries: linked,
+		AutoUpdates:    cask.AutoUpdates,
+		Quit:           cask.QuitBundleIDs(),
+		Greedy:         greedy && (cask.AutoUpdates || version == "latest"),
+		Provenance:     &fetched.provenance,
+	}
+	if len(dests) > 0 {
+		receipt.AppPath = dests[0]
+	}
+	if err := saveCaskReceipt(caskDir, receipt); err != nil {
+		return err
+	}
+	if err := m.recordCask(cask.Token); err != nil {
+		return err
+	}
+	if err := m.Plugins.PostInstall(plugin.PostInstallRequest{Name: cask.Token, Version: version, Kind: "cask", Path: caskDir}); err != nil {
+		return err
+	}
+
+	messages.Println(messages.CaskInstalled, cask.Token)
+	return nil
+}
+
+func (m *Manager) Outdated(ctx context.Context, names []string, greedy bool) ([]OutdatedPackage, error) {
+	outdated, _, _, err := m.outdated(ctx, names, UpgradeOptions{Greedy: greedy})
+	return outdated, err
+}
+
+func (m *Manager) Upgrade(ctx context.Context, names []string, opts UpgradeOptions) (UpgradeSummary, error) {
+	outdated, skipped, pinned, err := m.outdated(ctx, names, opts)
+	if err != nil {
+		return UpgradeSummary{}, err
+	}
+	summary := UpgradeSummary{Skipped: skipped, Pinned: pinned}
+	if len(skipped) > 0 {
+		tokens := make([]string, 0, len(skipped))
+		for _, p := range skipped {
+			tokens = append(tokens, p.Name)
+		}
+		messages.Println(messages.SkippingAutoUpdates, strings.Join(tokens, ", "))
+	}
+	if len(pinned) > 0 {
+		held := make([]string, 0, len(pinned))
+		for _, p := range pinned {
+			held = append(held, p.Name)
+		}
+		messages.Println(messages.SkippingPinned, strings.Join(held, ", "))
+	}
+	if len(outdated) == 0 {
+		messages.Println(messages.NothingToUpgrade)
+		return summary, nil
+	}
+
+	if opts.DryRun {
+		messages.Println(messages.WouldUpgrade, len(outdated))
+		for _, p := range outdated {
+			p.Homepage, p.ReleaseNotes = m.upgradeLinks(ctx, p)
+			messages.Println(messages.UpgradeItem, p.Name, p.InstalledVersion, p.CurrentVersion)
+			if p.Homepage != "" {
+				messages.Println(messages.UpgradeHomepage, p.Homepage)
+			}
+			if p.ReleaseNotes != "" {
+				messages.Println(messages.UpgradeReleaseNotes, p.ReleaseNotes)
+			}
+			summary.Pending = append(summary.Pending, p)
+		}
+		return summary, nil
+	}
+
+	messages.Println(messages.UpgradingOutdated, len(outdated))
+	formulaNames := make([]string, 0, len(outdated))
+	casks := make([]OutdatedPackage, 0)
+	for _, p := range outdated {
+		messages.Println(messages.UpgradeItem, p.Name, p.InstalledVersion, p.CurrentVersion)
+		if p.Cask {
+			casks = append(casks, p)
+		} else {
+			formulaNames = append(formulaNames, p.Name)
+		}
+	}
+
+	completed := make([]string, 0, len(outdated))
+	if len(formulaNames) > 0 {
+		if err := m.installFormulas(ctx, formulaNames, nil, InstallOptions{}, false); err != nil {
+			return summary, err
+		}
+		completed = append(completed, formulaNames...)
+		for _, p := range outdated {
+			if !p.Cask {
+				summary.Upgraded = append(summary.Upgraded, p)
+			}
+		}
+	}
+	for _, p := range casks {
+		err := m.upgradeCask(ctx, p, opts.Greedy)
+		if err != nil {
+			if len(completed) > 0 {
+				return summary, &PartialError{Completed: completed, Err: err}
+			}
+			return summary, err
+		}
+		completed = append(completed, p.Name)
+		summary.Upgraded = append(summary.Upgraded, p)
+	}
+	return summary, nil
+}
+
+// upgradeLinks finds p's homepage and the release notes of its new
+// version. They only help decide whether to upgrade, so a lookup that
+// fails leaves them empty.
+func (m *Manager) upgradeLinks(ctx context.Context, p OutdatedPackage) (homepage, releaseNotes string) {
+	if p.Cask {
+		cask, err := m.API.CaskByName(ctx, p.Name)
+		if err != nil {
+			return "", ""
+		}
+		return cask.Homepage, releaseNotesURL(cask.URL, "")
+	}
+	f, err := m.API.FormulaByName(ctx, p.Name)
+	if err != nil {
+		return "", ""
+	}
+	return f.Homepage, releaseNotesURL(f.URLs.Stable.URL, f.URLs.Stable.Tag)
+}
+
+func (m *Manager) upgradeCask(ctx context.Context, p OutdatedPackage, greedy bool) error {
+	cask, err := m.API.CaskByName(ctx, p.Name)
+	if err != nil {
+		return err
+	}
+	if err := m.installCask(ctx, cask, greedy); err != nil {
+		return err
+	}
+	if p.InstalledVersion == p.CurrentVersion {
+		return nil
+	}
+	if err := os.RemoveAll(filepath.Join(m.Paths.Caskroom, p.Name, p.InstalledVersion)); err != nil {
+		return err
+	}
+	return m.recordCask(p.Name)
+}
+
+// outdated lists what ub upgrade would change. Pinned packages are left
+// out of it and listed in pinned instead.
+func (m *Manager) outdated(ctx context.Context, names []string, opts UpgradeOptions) (outdated, skipped, pinned []OutdatedPackage, err error) {
+	greedy := opts.Greedy
+	st, err := m.InstallState()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if opts.Formula {
+		st.Casks = nil
+	}
+	if opts.Cask {
+		st.Formulae = nil
+	}
+	formulae, casks, err := upgradeCandidates(st, names)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	explicit := len(names) > 0
+
+	pins, err := m.tapPins()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	heldFormulae, heldCasks, err := m.pins()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, name := range formulae {
+		if pin, ok := pins[name]; ok {
+			f, err := formula.LoadByName(pin.Dir, name)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("tap %s: %w", pin.Tap, err)
+			}
+			if !m.pinnedCurrent(pin, f) {
+				installed := st.Formulae[name].Version
+				outdated = append(outdated, OutdatedPackage{Name: name, InstalledVersion: installed, CurrentVersion: f.Version})
+			}
+			continue
 		}
-		visiting[name] = true
-
 		f, err := m.API.FormulaByName(ctx, name)
 		if err != nil {
-			return err
+			return nil, nil, nil, err
+		}
+		_, installed, err := resolveInstalledFormulaDir(m.Paths.Cellar, name, f.Versions.Stable)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if formulaVersionCurrent(installed, f.Versions.Stable) || strings.HasPrefix(installed, headKegPrefix) {
+			continue
 		}
-		for _, dep := range f.Dependencies {
-			if err := dfs(dep); err != nil {
-				return fmt.Errorf("resolve dependency %q for %q: %w", dep, name, err)
+		outdated = append(outdated, OutdatedPackage{Name: name, InstalledVersion: installed, CurrentVersion: f.Versions.Stable})
+	}
+
+	for _, token := range casks {
+		installed := st.Casks[token].Version
+		if installed == "" {
+			// Let the receipt say what is wrong.
+			if _, err := m.readCaskReceipt(token); err != nil {
+				return nil, nil, nil, err
 			}
 		}
+		cask, err := m.API.CaskByName(ctx, token)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		current := strings.TrimSpace(cask.Version)
+		if current == "" {
+			current = "latest"
+		}
+		p := OutdatedPackage{Name: token, Cask: true, InstalledVersion: installed, CurrentVersion: current, AutoUpdates: cask.AutoUpdates}
+		switch caskUpgradeDecision(installed, current, cask.AutoUpdates, greedy || explicit) {
+		case caskUpgrade:
+			outdated = append(outdated, p)
+		case caskSkipAutoUpdates:
+			skipped = append(skipped, p)
+		}
+	}
+	outdated = slices.DeleteFunc(outdated, func(p OutdatedPackage) bool {
+		held := (p.Cask && heldCasks[p.Name]) || (!p.Cask && heldFormulae[p.Name])
+		if held {
+			pinned = append(pinned, p)
+		}
+		return held
+	})
+	return outdated, skipped, pinned, nil
+}
 
-		visiting[name] = false
-		seen[name] = f
-		return nil
+func upgradeCandidates(st InstallState, names []string) (formulae, casks []string, err error) {
+	if len(names) == 0 {
+		return slices.Sorted(maps.Keys(st.Formulae)), slices.Sorted(maps.Keys(st.Casks)), nil
+	}
+	for _, raw := range names {
+		name := strings.TrimSpace(raw)
+		if name == "" {
+			continue
+		}
+		if _, ok := st.Formulae[name]; ok {
+			formulae = append(formulae, name)
+			continue
+		}
+		if _, ok := st.Casks[name]; ok {
+			casks = append(casks, name)
+			continue
+		}
+		return nil, nil, fmt.Errorf("%q is %w", name, ErrNotInstalled)
 	}
+	return formulae, casks, nil
+}
 
-	for _, root := range roots {
-		if err := dfs(root); err != nil {
-			return nil, err
+func formulaVersionCurrent(installed, stable string) bool {
+	return installed == stable || strings.HasPrefix(installed, stable+"_")
+}
+
+type caskDecision int
+
+const (
+	caskCurrent caskDecision = iota
+	caskUpgrade
+	caskSkipAutoUpdates
+)
+
+// caskUpgradeDecision mirrors brew: casks that update themselves (auto_updates
+// or version :latest) are only reinstalled when greedy.
+func caskUpgradeDecision(installed, current string, autoUpdates, greedy bool) caskDecision {
+	selfUpdating := autoUpdates || current == "latest"
+	if current != "latest" && installed == current {
+		return caskCurrent
+	}
+	if selfUpdating && !greedy {
+		return caskSkipAutoUpdates
+	}
+	return caskUpgrade
+}
+
+func (m *Manager) readCaskReceipt(token string) (caskInstallReceipt, error) {
+	caskRoot := filepath.Join(m.Paths.Caskroom, token)
+	entries, err := os.ReadDir(caskRoot)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return caskInstallReceipt{}, fmt.Errorf("cask %q is %w", token, ErrNotInstalled)
+		}
+		return caskInstallReceipt{}, err
+	}
+	latest := ""
+	for _, entry := range entries {
+		if entry.IsDir() && (latest == "" || compareVersions(entry.Name(), latest) > 0) {
+			latest = entry.Name()
+		}
+	}
+	if latest == "" {
+		return caskInstallReceipt{}, fmt.Errorf("cask %q has no installed versions", token)
+	}
+	receipt := caskInstallReceipt{Token: token, Version: latest}
+	data, err := os.ReadFile(filepath.Join(caskRoot, latest, "INSTALL_RECEIPT.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return receipt, nil
+		}
+		return caskInstallReceipt{}, err
+	}
+	if err := json.Unmarshal(data, &receipt); err != nil {
+		return caskInstallReceipt{}, fmt.Errorf("parse cask %q receipt: %w", token, err)
+	}
+	return receipt, nil
+}
+
+func (m *Manager) resolveClosure(ctx context.Context, roots []string) (closure map[string]homebrewapi.Formula, err error) {
+	ctx, span := trace.Start(ctx, "ub.resolve", trace.Int("ub.roots", int64(len(roots))))
+	defer func() {
+		span.SetAttributes(trace.Int("ub.closure_size", int64(len(closure))))
+		span.End(err)
+	}()
+	closure = map[string]homebrewapi.Formula{}
+	lookup := func(ctx context.Context, name string) (pipeline.Package, error) {
+		f, err := m.API.FormulaByName(ctx, name)
+		if err != nil {
+			return pipeline.Package{}, err
 		}
+		closure[name] = f
+		return formulaPackage(name, f), nil
+	}
+	if _, err := pipeline.Resolve(ctx, roots, lookup, pipeline.PlanOptions{}); err != nil {
+		return nil, err
 	}
-	return seen, nil
+	return closure, nil
 }
 
-type installJob struct {
-	manager  *Manager
-	formula  homebrewapi.Formula
-	reporter *installReporter
-	rootSet  map[string]bool
+func formulaPackage(name string, f homebrewapi.Formula) pipeline.Package {
+	return pipeline.Package{Name: name, Version: f.Versions.Stable, Deps: f.Dependencies}
 }
 
-func (j installJob) ID() string { return j.formula.Name }
+// installOrder lists packages dependencies first, breaking ties by name, so
+// the order does not depend on which worker gets to a job first.
+func installOrder(packages map[string]pipeline.Package) []string {
+	order := make([]string, 0, len(packages))
+	placed := make(map[string]bool, len(packages))
+	for len(order) < len(packages) {
+		layer := make([]string, 0)
+		for name, p := range packages {
+			if placed[name] {
+				continue
+			}
+			ready := true
+			for _, dep := range p.Deps {
+				if _, ok := packages[dep]; ok && !placed[dep] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				layer = append(layer, name)
+			}
+		}
+		if len(layer) == 0 {
+			// A cycle; the resolver rejects these, but never loop forever.
+			for name := range packages {
+				if !placed[name] {
+					layer = append(layer, name)
+				}
+			}
+		}
+		sort.Strings(layer)
+		for _, name := range layer {
+			placed[name] = true
+		}
+		order = append(order, layer...)
+	}
+	return order
+}
 
-func (j installJob) Requires() []string { return j.formula.Dependencies }
+type installPlan struct {
+	// formulae are the nodes that need a bottle poured.
+	formulae map[string]homebrewapi.Formula
+	// satisfied maps kegs that are already in place to their installed version.
+	satisfied map[string]string
+	// metadata holds every formula fetched while planning.
+	metadata map[string]homebrewapi.Formula
+}
 
-func (j installJob) Run(ctx context.Context) error {
-	if j.manager.isInstalled(j.formula.Name, j.formula.Versions.Stable) {
-		j.reporter.printAlreadyInstalled(j.formula.Name, j.formula.Versions.Stable)
-		return nil
+// planInstall walks the dependency graph from roots. Dependencies that already
+// have a keg are marked satisfied without fetching their metadata or descending
+// into them, and roots already at the current version are satisfied too, so
+// up-to-date kegs cost neither API requests nor downloads.
+func (m *Manager) planInstall(ctx context.Context, roots []string, known map[string]homebrewapi.Formula, opts InstallOptions) (plan installPlan, err error) {
+	ctx, span := trace.Start(ctx, "ub.resolve", trace.Int("ub.roots", int64(len(roots))))
+	defer func() {
+		span.SetAttributes(trace.Int("ub.closure_size", int64(len(plan.formulae))), trace.Int("ub.satisfied", int64(len(plan.satisfied))))
+		span.End(err)
+	}()
+	plan = installPlan{
+		formulae: map[string]homebrewapi.Formula{},
+		metadata: map[string]homebrewapi.Formula{},
+	}
+	for name, f := range known {
+		plan.metadata[name] = f
+	}
+	lookup := func(ctx context.Context, name string) (pipeline.Package, error) {
+		f, ok := plan.metadata[name]
+		if !ok {
+			fetched, err := m.API.FormulaByName(ctx, name)
+			if err != nil {
+				return pipeline.Package{}, err
+			}
+			f = fetched
+			plan.metadata[name] = f
+		}
+		return formulaPackage(name, f), nil
+	}
+	installed := func(name, version string) (string, bool) {
+		if version == "" {
+			latest, err := m.latestInstalledVersion(name)
+			return latest, err == nil && latest != ""
+		}
+		return version, m.isInstalled(name, version)
+	}
+	resolved, err := pipeline.Resolve(ctx, roots, lookup, pipeline.PlanOptions{
+		Installed:          installed,
+		IgnoreDependencies: opts.IgnoreDependencies,
+		OnlyDependencies:   opts.OnlyDependencies,
+	})
+	if err != nil {
+		return installPlan{}, err
+	}
+	for name := range resolved.Install {
+		plan.formulae[name] = plan.metadata[name]
+	}
+	plan.satisfied = resolved.Satisfied
+	return plan, nil
+}
+
+func directDependencies(closure map[string]homebrewapi.Formula, names []string) []string {
+	rootSet := make(map[string]bool, len(names))
+	for _, name := range names {
+		rootSet[name] = true
+	}
+	seen := map[string]bool{}
+	out := make([]string, 0)
+	for _, name := range names {
+		for _, dep := range closure[name].Dependencies {
+			if rootSet[dep] || seen[dep] {
+				continue
+			}
+			seen[dep] = true
+			out = append(out, dep)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// bottleCost estimates a pour's size for the scheduler: the cached bottle
+// when there is one, else the size of a keg installed earlier.
+func (m *Manager) bottleCost(name string, f homebrewapi.Formula, opts InstallOptions) int64 {
+	if bottle, _, err := selectBottle(f, m.bottleTags(), opts); err == nil {
+		if size, ok := m.Fetch.CachedSize(bottle.URL); ok {
+			return size
+		}
+	}
+	if version, err := m.latestInstalledVersion(name); err == nil && version != "" {
+		if manifest, ok := m.readKegManifest(filepath.Join(m.Paths.Cellar, name, version)); ok {
+			return manifest.Size
+		}
+	}
+	return 0
+}
+
+// bottleSource pours bottles from the API's bottle URLs through the shared
+// install pipeline.
+type bottleSource struct {
+	manager    *Manager
+	formulae   map[string]homebrewapi.Formula
+	reporter   *installReporter
+	requested  map[string]bool
+	opts       InstallOptions
+	provenance *provenanceLog
+}
+
+func (s bottleSource) Fetch(ctx context.Context, u *pipeline.Unit) error {
+	m := s.manager
+	u.Requested = s.requested[u.Name]
+	if m.isInstalled(u.Name, u.Version) {
+		if u.Requested {
+			if err := m.markRequested(u.Name, u.Version); err != nil {
+				return err
+			}
+		}
+		s.reporter.printAlreadyInstalled(u.Name, u.Version)
+		return pipeline.Skip
+	}
+	// The old keg's receipt is only readable before the new one is poured.
+	u.Requested = u.Requested || m.installedOnRequest(u.Name)
+	f := s.formulae[u.Name]
+	tags := m.bottleTags()
+	bottle, tag, err := selectBottle(f, tags, s.opts)
+	if err != nil {
+		return err
 	}
-	bottle, tag, err := selectBottle(j.formula)
+	if s.opts.BottleTag == "" && tag != tags[0] && tag != "all" {
+		s.reporter.printWarning(messages.Sprintf(messages.CrossTagBottle, u.Name, tag, tags[0]))
+	}
+	bottleURL, err := m.Plugins.RewriteURL(u.Name, bottle.URL)
 	if err != nil {
 		return err
 	}
-	label := fmt.Sprintf("Bottle %s (%s)", j.formula.Name, j.formula.Versions.Stable)
-	archive, err := j.manager.Fetch.FetchWithProgress(ctx, bottle.URL, j.reporter.progressCallback(label))
+	label := messages.Sprintf(messages.BottleLabel, u.Name, u.Version)
+	archive, err := m.Fetch.FetchWithProgress(ctx, bottleURL, s.reporter.progressCallback(u.Name, label))
 	if err != nil {
 		return err
 	}
 	workerID, _ := scheduler.WorkerID(ctx)
-	j.reporter.printInstalling(j.formula.Name, j.formula.Versions.Stable, tag, j.rootSet[j.formula.Name], bottle.URL, workerID)
+	s.reporter.printInstalling(u.Name, u.Version, tag, u.Root, bottle.URL, workerID)
 	if err := verifySHA256(archive, bottle.SHA256); err != nil {
 		return fmt.Errorf("verify bottle checksum (%s): %w", tag, err)
 	}
-	installDir := filepath.Join(j.manager.Paths.Cellar, j.formula.Name, j.formula.Versions.Stable)
-	if err := os.RemoveAll(installDir); err != nil {
+	if hasChecksum(bottle.SHA256) {
+		_ = m.Fetch.RecordChecksum(archive, bottleURL, bottle.SHA256)
+	}
+	p, err := m.provenance(bottleURL, archive, bottle.SHA256, tag)
+	if err != nil {
+		return err
+	}
+	s.provenance.set(u.Name, p)
+	u.Artifact = archive
+	return nil
+}
+
+func (s bottleSource) Materialize(ctx context.Context, u *pipeline.Unit) error {
+	m := s.manager
+	installDir := filepath.Join(m.Paths.Cellar, u.Name, u.Version)
+	if err := m.fs().RemoveAll(installDir); err != nil {
 		return fmt.Errorf("clear existing install dir: %w", err)
 	}
-	if err := extractTarGz(archive, j.manager.Paths.Cellar); err != nil {
+	if err := m.waitForSpace(ctx, m.Paths.Cellar, s.reporter); err != nil {
+		return err
+	}
+	release, err := scheduler.EnterPhase(ctx, scheduler.PhaseCPU)
+	if err != nil {
+		return err
+	}
+	defer release()
+	extractCtx, extractSpan := trace.Start(ctx, "ub.extract", trace.String("ub.formula", u.Name))
+	s.reporter.extractStarted()
+	manifest, err := extractTar(extractCtx, u.Artifact, m.Paths.Cellar, m.extractOptions())
+	s.reporter.extractFinished()
+	extractSpan.End(err)
+	if err != nil {
+		_ = m.fs().RemoveAll(installDir)
+		return errors.Join(err, m.recordFormula(u.Name))
+	}
+	kegDir, _, err := resolveInstalledFormulaDir(m.Paths.Cellar, u.Name, u.Version)
+	if err != nil {
 		return err
 	}
-	linkedVersion, err := j.manager.linkFormula(j.formula.Name, j.formula.Versions.Stable)
+	u.Dir = kegDir
+	return m.writeKegManifest(kegDir, manifest)
+}
+
+func (s bottleSource) Link(ctx context.Context, u *pipeline.Unit) error {
+	_, linkSpan := trace.Start(ctx, "ub.link", trace.String("ub.formula", u.Name))
+	linkedVersion, err := s.manager.linkFormula(u.Name, u.Version)
+	linkSpan.End(err)
+	var conflict *LinkConflictError
+	if errors.As(err, &conflict) && u.Dir != "" {
+		// Nothing was linked. Without the keg, a retry with --overwrite
+		// pours it again instead of skipping it as installed.
+		_ = s.manager.fs().RemoveAll(u.Dir)
+		_ = s.manager.recordFormula(u.Name)
+	}
 	if err != nil {
 		return err
 	}
-	j.reporter.printPoured(j.formula.Name, linkedVersion)
+	u.Dir = filepath.Join(s.manager.Paths.Cellar, u.Name, linkedVersion)
+	return nil
+}
+
+func (s bottleSource) Receipt(ctx context.Context, u *pipeline.Unit) error {
+	if err := writeFormulaReceipt(u.Dir, u.Requested); err != nil {
+		return err
+	}
+	if err := writeRuntimeDependencies(u.Dir, s.formulae[u.Name].Dependencies); err != nil {
+		return err
+	}
+	if p, ok := s.provenance.get(u.Name); ok {
+		if err := writeFormulaProvenance(u.Dir, p); err != nil {
+			return err
+		}
+	}
+	if err := s.manager.recordFormula(u.Name); err != nil {
+		return err
+	}
+	version := filepath.Base(u.Dir)
+	if err := s.manager.Plugins.PostInstall(plugin.PostInstallRequest{Name: u.Name, Version: version, Kind: "formula", Path: u.Dir}); err != nil {
+		return err
+	}
+	s.manager.reportPoured(s.reporter, u.Name, version)
 	return nil
 }
 
@@ -808,6 +3704,28 @@ type installReporter struct {
 	showProgress  bool
 	progressSeen  map[string]int
 	progressStart map[string]time.Time
+
+	// statusBar replaces per-file progress bars with one aggregated line
+	// when several jobs run at once on a terminal.
+	statusBar  bool
+	totalJobs  int
+	doneJobs   int
+	running    int
+	extracting int
+	downloads  map[string]fetch.Progress
+	// expected and fetched are the sizes of the install's downloads and
+	// the bytes of each done so far, by URL.
+	expected   map[string]int64
+	fetched    map[string]int64
+	onProgress func(PlanProgress)
+
+	// ordered holds the lines of each job named in order until it and
+	// every job before it have finished; progress stays on the status bar.
+	ordered  bool
+	order    []string
+	next     int
+	finished map[string]bool
+	held     map[string][]string
 }
 
 func newInstallReporter(paths Paths, roots []string, closure map[string]homebrewapi.Formula) *installReporter {
@@ -821,41 +3739,187 @@ func newInstallReporter(paths Paths, roots []string, closure map[string]homebrew
 			deps = append(deps, name)
 		}
 	}
-	sort.Strings(deps)
-	return &installReporter{
-		paths:         paths,
-		roots:         append([]string(nil), roots...),
-		rootSet:       rootSet,
-		deps:          deps,
-		showHeader:    len(roots) > 0,
-		progressSeen:  map[string]int{},
-		progressStart: map[string]time.Time{},
-	}
+	sort.Strings(deps)
+	return &installReporter{
+		paths:         paths,
+		roots:         append([]string(nil), roots...),
+		rootSet:       rootSet,
+		deps:          deps,
+		showHeader:    len(roots) > 0,
+		progressSeen:  map[string]int{},
+		progressStart: map[string]time.Time{},
+	}
+}
+
+func (r *installReporter) printPlan() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.showHeader {
+		return
+	}
+	r.clearProgressLocked()
+	messages.Println(messages.FetchingDownloads, strings.Join(r.roots, ", "))
+	messages.Println(messages.UsingWorkers, r.workers)
+	if len(r.deps) > 0 {
+		messages.Println(messages.InstallingDeps, strings.Join(r.roots, ", "), joinWithAnd(r.deps))
+	}
+}
+
+func (r *installReporter) progressCallback(name, label string) func(fetch.Progress) {
+	return func(p fetch.Progress) {
+		r.printDownloadProgress(name, label, p)
+	}
+}
+
+// holdFor starts buffering the lines of the named jobs when the reporter
+// is in ordered mode. Names are flushed in the order given.
+func (r *installReporter) holdFor(order []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.ordered {
+		return
+	}
+	r.order = order
+	r.next = 0
+	r.finished = map[string]bool{}
+	r.held = make(map[string][]string, len(order))
+	for _, name := range order {
+		r.held[name] = nil
+	}
+}
+
+// printlnLocked prints a line for the named job, or holds it until the
+// job's turn comes in ordered mode.
+func (r *installReporter) printlnLocked(name, line string) {
+	if lines, ok := r.held[name]; ok {
+		r.held[name] = append(lines, line)
+		return
+	}
+	r.clearProgressLocked()
+	fmt.Println(line)
+}
+
+func (r *installReporter) releaseLocked(name string) {
+	lines := r.held[name]
+	delete(r.held, name)
+	if len(lines) == 0 {
+		return
+	}
+	r.clearProgressLocked()
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+}
+
+// flushHeld prints whatever is still held, e.g. for jobs that finished
+// after a dependency failed, still in dependency order.
+func (r *installReporter) flushHeld() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for ; r.next < len(r.order); r.next++ {
+		r.releaseLocked(r.order[r.next])
+	}
+	r.renderStatusLocked()
+}
+
+func (r *installReporter) jobStarted(string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.running++
+	r.renderStatusLocked()
+}
+
+func (r *installReporter) jobFinished(name string, _ bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.running--
+	r.doneJobs++
+	if r.finished != nil {
+		r.finished[name] = true
+		for ; r.next < len(r.order) && r.finished[r.order[r.next]]; r.next++ {
+			r.releaseLocked(r.order[r.next])
+		}
+	}
+	r.renderStatusLocked()
 }
 
-func (r *installReporter) printPlan() {
+func (r *installReporter) extractStarted() {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	if !r.showHeader {
-		return
+	r.extracting++
+	r.renderStatusLocked()
+}
+
+func (r *installReporter) extractFinished() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.extracting--
+	r.renderStatusLocked()
+}
+
+func (r *installReporter) statusLine() string {
+	var speed float64
+	stalled := 0
+	for _, p := range r.downloads {
+		speed += p.SpeedBytesPerSec
+		if p.Stalled {
+			stalled++
+		}
 	}
-	r.clearProgressLocked()
-	fmt.Printf("==> Fetching downloads for: %s\n", strings.Join(r.roots, ", "))
-	fmt.Printf("==> Using %d worker(s)\n", r.workers)
-	if len(r.deps) > 0 {
-		fmt.Printf("==> Installing dependencies for %s: %s\n", strings.Join(r.roots, ", "), joinWithAnd(r.deps))
+	queued := r.totalJobs - r.doneJobs - r.running
+	if queued < 0 {
+		queued = 0
 	}
+	var line string
+	if plan := r.planLocked(); plan.Bytes > 0 {
+		eta := "--:--"
+		if remaining, ok := estimateRemaining(plan.DoneBytes, plan.Bytes, speed); ok {
+			eta = formatClockDuration(remaining)
+		}
+		line = messages.Sprintf(messages.InstallStatusBytes, r.doneJobs, r.totalJobs, len(r.downloads), r.extracting, queued, formatSize(plan.DoneBytes), formatSize(plan.Bytes), formatTransferRate(speed), eta)
+	} else {
+		line = messages.Sprintf(messages.InstallStatus, r.doneJobs, r.totalJobs, len(r.downloads), r.extracting, queued, formatTransferRate(speed))
+	}
+	if stalled > 0 {
+		line += messages.Sprintf(messages.InstallStatusStalled, stalled)
+	}
+	return line
 }
 
-func (r *installReporter) progressCallback(label string) func(fetch.Progress) {
-	return func(p fetch.Progress) {
-		r.printDownloadProgress(label, p)
+func (r *installReporter) renderStatusLocked() {
+	if r.onProgress != nil {
+		r.onProgress(r.planLocked())
+	}
+	if !r.statusBar {
+		return
 	}
+	printProgressLine(r.statusLine(), terminalWidth())
+	r.showProgress = true
 }
 
-func (r *installReporter) printDownloadProgress(label string, p fetch.Progress) {
+func (r *installReporter) printDownloadProgress(name, label string, p fetch.Progress) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.recordBytesLocked(p)
+	if !r.statusBar && r.onProgress != nil {
+		r.onProgress(r.planLocked())
+	}
+
+	if r.statusBar || r.ordered {
+		if r.downloads == nil {
+			r.downloads = map[string]fetch.Progress{}
+		}
+		if p.Cached {
+			r.printlnLocked(name, messages.Sprintf(messages.UsingCached, label))
+		}
+		if p.Done || p.Cached {
+			delete(r.downloads, label)
+		} else {
+			r.downloads[label] = p
+		}
+		r.renderStatusLocked()
+		return
+	}
 
 	if r.progressSeen == nil {
 		r.progressSeen = map[string]int{}
@@ -871,7 +3935,11 @@ func (r *installReporter) printDownloadProgress(label string, p fetch.Progress)
 
 	if p.Cached {
 		r.clearProgressLocked()
-		fmt.Printf("✔︎ %-64s Using cached file\n", label)
+		messages.Println(messages.UsingCached, label)
+		return
+	}
+	if p.Stalled {
+		r.renderDownloadStalledLine(label, p.DownloadedBytes, p.TotalBytes)
 		return
 	}
 
@@ -918,12 +3986,39 @@ func (r *installReporter) renderDownloadProgressLine(label string, downloaded, t
 		eta = formatClockDuration(remaining)
 	}
 
-	line := fmt.Sprintf("⬇ %-*s %s%s %8s elapsed %s eta %s", labelWidth, displayLabel, bar, percent, speed, formatClockDuration(elapsed), eta)
+	line := messages.Sprintf(messages.DownloadProgress, labelWidth, displayLabel, bar, percent, speed, formatClockDuration(elapsed), eta)
 	printProgressLine(line, termWidth)
 	r.showProgress = true
 	r.spinnerPos++
 }
 
+func (r *installReporter) renderDownloadStalledLine(label string, downloaded, total int64) {
+	termWidth := terminalWidth()
+	labelWidth, barWidth := progressLayout(termWidth, true)
+	bar := renderProgressBar(downloaded, total, r.spinnerPos, barWidth)
+	percent := " --.-%"
+	if total > 0 {
+		percent = fmt.Sprintf(" %5.1f%%", min(float64(downloaded)/float64(total)*100, 100))
+	}
+	line := messages.Sprintf(messages.DownloadStalled, labelWidth, truncateText(label, labelWidth), bar, percent)
+	printProgressLine(line, termWidth)
+	r.showProgress = true
+}
+
+// println prints a line for the named job, as printlnLocked does.
+func (r *installReporter) println(name, line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.printlnLocked(name, line)
+	r.renderStatusLocked()
+}
+
+func (r *installReporter) clearProgress() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clearProgressLocked()
+}
+
 func (r *installReporter) clearProgressLocked() {
 	if !r.showProgress {
 		return
@@ -934,41 +4029,73 @@ func (r *installReporter) clearProgressLocked() {
 
 func (r *installReporter) printInstalling(name, version, tag string, isRoot bool, bottleURL string, workerID int) {
 	bottleName := homebrewBottleFilename(name, version, tag, bottleURL)
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	prefix := "==>"
-	if workerID > 0 {
+	if workerID > 0 && !r.ordered {
 		prefix = fmt.Sprintf("==> [w%d]", workerID)
 	}
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	r.clearProgressLocked()
 	if isRoot {
-		fmt.Printf("%s Installing %s\n", prefix, name)
+		r.printlnLocked(name, messages.Sprintf(messages.Installing, prefix, name))
 	} else {
-		fmt.Printf("%s Installing dependency: %s\n", prefix, name)
+		r.printlnLocked(name, messages.Sprintf(messages.InstallingDependency, prefix, name))
 	}
 	if bottleName != "" {
-		fmt.Printf("%s Pouring %s\n", prefix, bottleName)
+		r.printlnLocked(name, messages.Sprintf(messages.Pouring, prefix, bottleName))
 	}
+	r.renderStatusLocked()
 }
 
-func (r *installReporter) printPoured(name, version string) {
-	installDir := filepath.Join(r.paths.Cellar, name, version)
-	files, size, err := dirStats(installDir)
+// reportPoured prints the keg's file count and size from its manifest.
+func (m *Manager) reportPoured(r *installReporter, name, version string) {
+	files, size, err := m.kegStats(context.Background(), filepath.Join(m.Paths.Cellar, name, version))
 	if err != nil {
 		return
 	}
+	r.printPoured(name, version, files, size)
+}
+
+func (r *installReporter) printPoured(name, version string, files int, size int64) {
+	installDir := filepath.Join(r.paths.Cellar, name, version)
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	r.clearProgressLocked()
-	fmt.Printf("🍺  %s: %d files, %s\n", installDir, files, formatSize(size))
+	r.printlnLocked(name, messages.Sprintf(messages.Poured, installDir, files, formatSize(size)))
 	r.installed = append(r.installed, name)
+	r.renderStatusLocked()
+}
+
+func (r *installReporter) printWarning(msg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clearProgressLocked()
+	fmt.Fprintln(os.Stderr, messages.Sprintf(messages.Warning, msg))
 }
 
 func (r *installReporter) printAlreadyInstalled(name, version string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.printlnLocked(name, messages.Sprintf(messages.AlreadyInstalled, name, version))
+	r.renderStatusLocked()
+}
+
+func (r *installReporter) installedNames() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := append([]string(nil), r.installed...)
+	sort.Strings(out)
+	return out
+}
+
+func (r *installReporter) printInterrupted() {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.clearProgressLocked()
-	fmt.Printf("==> %s (%s) already installed\n", name, version)
+	if len(r.installed) == 0 {
+		messages.Println(messages.InterruptedNone)
+		return
+	}
+	sort.Strings(r.installed)
+	messages.Println(messages.InterruptedSome, joinWithAnd(r.installed))
 }
 
 func (r *installReporter) printSummary() {
@@ -979,9 +4106,9 @@ func (r *installReporter) printSummary() {
 		return
 	}
 	sort.Strings(r.installed)
-	fmt.Println("==> Summary")
+	messages.Println(messages.SummaryHeader)
 	for _, name := range r.installed {
-		fmt.Printf("- %s\n", name)
+		messages.Println(messages.SummaryItem, name)
 	}
 }
 
@@ -1131,7 +4258,7 @@ func (r *uninstallReporter) renderUninstallProgressLine(label string, removed, t
 			eta = formatClockDuration(time.Duration(remainingUnits/unitsPerSecond) * time.Second)
 		}
 	}
-	line := fmt.Sprintf("🗑 %-*s %s %s elapsed %s eta %s", labelWidth, displayLabel, bar, percent, formatClockDuration(elapsed), eta)
+	line := messages.Sprintf(messages.UninstallProgress, labelWidth, displayLabel, bar, percent, formatClockDuration(elapsed), eta)
 	printProgressLine(line, termWidth)
 	r.showProgress = true
 	r.spinnerPos++
@@ -1217,13 +4344,16 @@ func estimateRemaining(downloaded, total int64, speedBytesPerSec float64) (time.
 	return time.Duration(seconds * float64(time.Second)), true
 }
 
-func removeTreeWithProgress(root string, onProgress func(removed, total int, done bool)) error {
+func removeTreeWithProgress(ctx context.Context, root string, onProgress func(removed, total int, done bool)) error {
 	files := make([]string, 0)
 	dirs := make([]string, 0)
 	err := filepath.WalkDir(root, func(path string, d os.DirEntry, walkErr error) error {
 		if walkErr != nil {
 			return walkErr
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if d.IsDir() {
 			dirs = append(dirs, path)
 			return nil
@@ -1235,20 +4365,8 @@ func removeTreeWithProgress(root string, onProgress func(removed, total int, don
 		return err
 	}
 
-	total := len(files)
-	removed := 0
-	if onProgress != nil {
-		onProgress(removed, total, false)
-	}
-
-	for _, file := range files {
-		if err := os.Remove(file); err != nil {
-			return err
-		}
-		removed++
-		if onProgress != nil {
-			onProgress(removed, total, false)
-		}
+	if err := removeFiles(ctx, files, onProgress); err != nil {
+		return err
 	}
 
 	for idx := len(dirs) - 1; idx >= 0; idx-- {
@@ -1258,16 +4376,19 @@ func removeTreeWithProgress(root string, onProgress func(removed, total int, don
 	}
 
 	if onProgress != nil {
-		onProgress(removed, total, true)
+		onProgress(len(files), len(files), true)
 	}
 	return nil
 }
 
-func dirStats(root string) (files int, size int64, err error) {
+func dirStats(ctx context.Context, root string) (files int, size int64, err error) {
 	err = filepath.WalkDir(root, func(path string, d os.DirEntry, walkErr error) error {
 		if walkErr != nil {
 			return walkErr
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if d.IsDir() {
 			return nil
 		}
@@ -1282,6 +4403,125 @@ func dirStats(root string) (files int, size int64, err error) {
 	return files, size, err
 }
 
+// writeFormulaReceipt records the request state in the keg's
+// INSTALL_RECEIPT.json using brew's keys, keeping any fields already present.
+func writeFormulaReceipt(kegDir string, onRequest bool) error {
+	return updateFormulaReceipt(kegDir, func(receipt map[string]any) {
+		receipt["installed_on_request"] = onRequest
+		receipt["installed_as_dependency"] = !onRequest
+	})
+}
+
+// markRequested marks the installed keg for name at version as installed
+// on request.
+func (m *Manager) markRequested(name, version string) error {
+	if err := writeFormulaReceipt(filepath.Join(m.Paths.Cellar, name, version), true); err != nil {
+		return err
+	}
+	return m.recordFormula(name)
+}
+
+// writeRuntimeDependencies records the formulae the keg depends on the way
+// brew does, so dependents can be found without the API.
+func writeRuntimeDependencies(kegDir string, deps []string) error {
+	return updateFormulaReceipt(kegDir, func(receipt map[string]any) {
+		list := make([]map[string]any, 0, len(deps))
+		for _, dep := range deps {
+			list = append(list, map[string]any{"full_name": dep, "declared_directly": true})
+		}
+		receipt["runtime_dependencies"] = list
+	})
+}
+
+// receiptDependencies returns the direct dependencies the keg's receipt
+// records, and false when it records none at all.
+func receiptDependencies(kegDir string) ([]string, bool) {
+	data, err := os.ReadFile(filepath.Join(kegDir, "INSTALL_RECEIPT.json"))
+	if err != nil {
+		return nil, false
+	}
+	var receipt struct {
+		RuntimeDependencies *[]struct {
+			FullName         string `json:"full_name"`
+			DeclaredDirectly *bool  `json:"declared_directly"`
+		} `json:"runtime_dependencies"`
+	}
+	if err := json.Unmarshal(data, &receipt); err != nil || receipt.RuntimeDependencies == nil {
+		return nil, false
+	}
+	deps := make([]string, 0, len(*receipt.RuntimeDependencies))
+	for _, dep := range *receipt.RuntimeDependencies {
+		// Brew lists indirect dependencies too, marked as such.
+		if dep.FullName != "" && (dep.DeclaredDirectly == nil || *dep.DeclaredDirectly) {
+			deps = append(deps, dep.FullName)
+		}
+	}
+	return deps, true
+}
+
+// updateFormulaReceipt rewrites the keg's receipt with edit applied,
+// keeping the fields ub does not know about.
+func updateFormulaReceipt(kegDir string, edit func(map[string]any)) error {
+	path := filepath.Join(kegDir, "INSTALL_RECEIPT.json")
+	receipt := map[string]any{}
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &receipt); err != nil {
+			return fmt.Errorf("parse install receipt %s: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	edit(receipt)
+	data, err := json.MarshalIndent(receipt, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// keepInstalled reports whether autoremove must leave name alone because the
+// user installed it explicitly or listed it as protected.
+func (m *Manager) keepInstalled(st InstallState, name string) bool {
+	for _, protected := range m.Protected {
+		if strings.TrimSpace(protected) == name {
+			return true
+		}
+	}
+	return st.Formulae[name].OnRequest
+}
+
+func (m *Manager) installedOnRequest(name string) bool {
+	version, err := m.latestInstalledVersion(name)
+	if err != nil || version == "" {
+		return false
+	}
+	return receiptOnRequest(filepath.Join(m.Paths.Cellar, name, version))
+}
+
+func countDirs(entries []os.DirEntry) int {
+	n := 0
+	for _, entry := range entries {
+		if entry.IsDir() {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *Manager) latestInstalledVersion(name string) (string, error) {
+	entries, err := os.ReadDir(filepath.Join(m.Paths.Cellar, name))
+	if err != nil {
+		return "", err
+	}
+	latest := ""
+	for _, entry := range entries {
+		if entry.IsDir() && (latest == "" || compareVersions(entry.Name(), latest) > 0) {
+			latest = entry.Name()
+		}
+	}
+	return latest, nil
+}
+
 func (m *Manager) isInstalled(name, version string) bool {
 	if strings.TrimSpace(version) == "" {
 		return false
@@ -1291,137 +4531,597 @@ func (m *Manager) isInstalled(name, version string) bool {
 	return err == nil
 }
 
-func selectBottle(f homebrewapi.Formula) (homebrewapi.BottleFile, string, error) {
-	files := f.Bottle.Stable.Files
-	if len(files) == 0 {
-		return homebrewapi.BottleFile{}, "", fmt.Errorf("formula %q has no stable bottle", f.Name)
+// selectBottle walks tags in order, newest compatible first, then the
+// architecture-independent "all" bottle. It never pours a tag outside the chain
+// unless opts.ForceBottle is set, and then picks the first in sorted order.
+func selectBottle(f homebrewapi.Formula, tags []string, opts InstallOptions) (homebrewapi.BottleFile, string, error) {
+	files := f.Bottle.Stable.Files
+	if len(files) == 0 {
+		return homebrewapi.BottleFile{}, "", fmt.Errorf("formula %q has no stable bottle", f.Name)
+	}
+
+	if tag := strings.TrimSpace(opts.BottleTag); tag != "" {
+		if bottle, ok := files[tag]; ok {
+			return bottle, tag, nil
+		}
+		return homebrewapi.BottleFile{}, "", fmt.Errorf("formula %q has no %s bottle (available: %s)", f.Name, tag, strings.Join(sortedTags(files), ", "))
+	}
+
+	for _, tag := range append(append([]string(nil), tags...), "all") {
+		if bottle, ok := files[tag]; ok {
+			return bottle, tag, nil
+		}
+	}
+
+	available := sortedTags(files)
+	if opts.ForceBottle {
+		return files[available[0]], available[0], nil
+	}
+	return homebrewapi.BottleFile{}, "", fmt.Errorf("formula %q has no bottle compatible with %s (available: %s); ub cannot build from source, pass --force-bottle to pour one anyway", f.Name, tags[0], strings.Join(available, ", "))
+}
+
+func sortedTags(files map[string]homebrewapi.BottleFile) []string {
+	tags := make([]string, 0, len(files))
+	for tag := range files {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// preferredTags lists bottle tags this host can run, best match first. Older
+// macOS bottles run on newer releases; bottles never cross architectures.
+func preferredTags() []string {
+	return preferredTagsFor(runtime.GOOS, runtime.GOARCH)
+}
+
+func preferredTagsFor(goos, goarch string) []string {
+	if goos == "darwin" && goarch == "arm64" {
+		return []string{"arm64_sequoia", "arm64_sonoma", "arm64_ventura", "arm64_monterey", "arm64_big_sur"}
+	}
+	if goos == "darwin" && goarch == "amd64" {
+		return []string{"sequoia", "sonoma", "ventura", "monterey", "big_sur"}
+	}
+	if goos == "linux" && goarch == "arm64" {
+		return []string{"arm64_linux"}
+	}
+	return []string{"x86_64_linux"}
+}
+
+// hasChecksum is false for empty digests and the "no_check" marker that
+// version :latest casks use.
+func hasChecksum(expected string) bool {
+	expected = strings.TrimSpace(expected)
+	return expected != "" && expected != "no_check"
+}
+
+func verifySHA256(path, expected string) error {
+	if !hasChecksum(expected) {
+		return nil
+	}
+	got, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(got, expected) {
+		return fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, expected, got)
+	}
+	return nil
+}
+
+type extractOptions struct {
+	allowSetuid bool
+	// preserveOwner applies the archive's uid/gid, which only works as root.
+	preserveOwner bool
+	// fs creates the extracted files; nil means the real filesystem.
+	fs FS
+}
+
+func (m *Manager) extractOptions() extractOptions {
+	return extractOptions{allowSetuid: m.AllowSetuid, preserveOwner: os.Geteuid() == 0, fs: m.fs()}
+}
+
+// tarFileMode converts tar header mode bits, dropping setuid/setgid unless allowed.
+func tarFileMode(mode int64, allowSetuid bool) os.FileMode {
+	out := os.FileMode(mode).Perm()
+	if allowSetuid && mode&0o4000 != 0 {
+		out |= os.ModeSetuid
+	}
+	if allowSetuid && mode&0o2000 != 0 {
+		out |= os.ModeSetgid
+	}
+	if mode&0o1000 != 0 {
+		out |= os.ModeSticky
+	}
+	return out
+}
+
+func applyTarMetadata(path string, hdr *tar.Header, opts extractOptions) error {
+	if opts.preserveOwner {
+		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+			return fmt.Errorf("chown %s: %w", hdr.Name, err)
+		}
+	}
+	// chmod after chown, which clears setuid bits.
+	if err := os.Chmod(path, tarFileMode(hdr.Mode, opts.allowSetuid)); err != nil {
+		return fmt.Errorf("chmod %s: %w", hdr.Name, err)
+	}
+	if !hdr.ModTime.IsZero() {
+		if err := os.Chtimes(path, tarAccessTime(hdr), hdr.ModTime); err != nil {
+			return fmt.Errorf("set mtime %s: %w", hdr.Name, err)
+		}
+	}
+	return nil
+}
+
+func tarAccessTime(hdr *tar.Header) time.Time {
+	if hdr.AccessTime.IsZero() {
+		return hdr.ModTime
+	}
+	return hdr.AccessTime
+}
+
+// mkdirWithin creates dir after checking that its deepest existing ancestor,
+// with symlinks resolved, is inside root. The string prefix check on entry
+// names is not enough: an archive can plant a symlink to somewhere else and
+// then write through it.
+func mkdirWithin(root, dir string) error {
+	existing := dir
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		existing = parent
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return err
+	}
+	if resolved != root && !strings.HasPrefix(resolved, root+string(os.PathSeparator)) {
+		return fmt.Errorf("archive entry %q resolves outside destination through a symlink", dir)
+	}
+	return os.MkdirAll(dir, 0o755)
+}
+
+// kegManifest is recorded in the state store for each keg after pouring so
+// reporters can show file counts and sizes without walking the tree again.
+type kegManifest struct {
+	Files int   `json:"files"`
+	Size  int64 `json:"size"`
+	// Paths lists every non-directory entry, relative to the keg, so
+	// uninstall can delete them without walking the tree first.
+	Paths []string `json:"paths,omitempty"`
+}
+
+// kegManifestName is the file in the keg where older versions of ub kept
+// its manifest, before the state store took them in.
+const kegManifestName = "UB_MANIFEST.json"
+
+func (k *kegManifest) add(path string, size int64) {
+	k.Files++
+	k.Size += size
+	k.Paths = append(k.Paths, path)
+}
+
+// relativeTo returns the manifest with paths made relative to kegDir;
+// extraction records them as absolute paths.
+func (k kegManifest) relativeTo(kegDir string) kegManifest {
+	relative := make([]string, 0, len(k.Paths))
+	for _, path := range k.Paths {
+		if !filepath.IsAbs(path) {
+			relative = append(relative, path)
+			continue
+		}
+		rel, err := filepath.Rel(kegDir, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		relative = append(relative, rel)
+	}
+	k.Paths = relative
+	return k
+}
+
+// kegKey is the state store key of the keg at kegDir: name/version.
+func (m *Manager) kegKey(kegDir string) (string, bool) {
+	rel, err := filepath.Rel(m.Paths.Cellar, kegDir)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", false
+	}
+	name, version, ok := strings.Cut(filepath.ToSlash(rel), "/")
+	if !ok || name == "" || version == "" || strings.Contains(version, "/") {
+		return "", false
+	}
+	return name + "/" + version, true
+}
+
+// writeKegManifest records the manifest of the keg at kegDir in the state
+// store.
+func (m *Manager) writeKegManifest(kegDir string, manifest kegManifest) error {
+	key, ok := m.kegKey(kegDir)
+	if !ok {
+		return fmt.Errorf("%s is not a keg in %s", kegDir, m.Paths.Cellar)
+	}
+	manifest = manifest.relativeTo(kegDir)
+	return m.updateState(func(tx *state.Tx) error {
+		if !tx.Writable() {
+			return nil
+		}
+		return tx.Put(manifestsBucket, key, manifest)
+	})
+}
+
+// kegStats reads the keg's manifest, walking the tree only when it is
+// missing (kegs poured before manifests existed).
+func (m *Manager) kegStats(ctx context.Context, kegDir string) (files int, size int64, err error) {
+	if manifest, ok := m.readKegManifest(kegDir); ok {
+		return manifest.Files, manifest.Size, nil
+	}
+	return dirStats(ctx, kegDir)
+}
+
+func (m *Manager) readKegManifest(kegDir string) (kegManifest, bool) {
+	key, ok := m.kegKey(kegDir)
+	if !ok {
+		return kegManifest{}, false
+	}
+	var manifest kegManifest
+	var found bool
+	_ = m.readState(func(tx *state.Tx) error {
+		if tx == nil {
+			manifest, found = legacyKegManifest(kegDir)
+			return nil
+		}
+		found, _ = tx.Get(manifestsBucket, key, &manifest)
+		return nil
+	})
+	return manifest, found
+}
+
+func legacyKegManifest(kegDir string) (kegManifest, bool) {
+	data, err := os.ReadFile(filepath.Join(kegDir, kegManifestName))
+	if err != nil {
+		return kegManifest{}, false
 	}
+	var manifest kegManifest
+	if json.Unmarshal(data, &manifest) != nil {
+		return kegManifest{}, false
+	}
+	return manifest, true
+}
 
-	for _, tag := range preferredTags() {
-		if bottle, ok := files[tag]; ok {
-			return bottle, tag, nil
+// removeKegsWithProgress deletes root, which holds kegDirs, driven by their
+// manifests: listed files are removed in parallel, then the nearly empty tree.
+// If any keg lacks a manifest, the whole root is walked instead.
+func (m *Manager) removeKegsWithProgress(ctx context.Context, root string, kegDirs []string, onProgress func(removed, total int, done bool)) error {
+	var paths []string
+	for _, kegDir := range kegDirs {
+		manifest, ok := m.readKegManifest(kegDir)
+		if !ok || len(manifest.Paths) == 0 {
+			return removeTreeWithProgress(ctx, root, onProgress)
+		}
+		for _, rel := range manifest.Paths {
+			if rel == "" || filepath.IsAbs(rel) || strings.HasPrefix(filepath.Clean(rel), "..") {
+				continue
+			}
+			paths = append(paths, filepath.Join(kegDir, rel))
 		}
 	}
-
-	for tag, bottle := range files {
-		return bottle, tag, nil
+	if err := removeFiles(ctx, paths, onProgress); err != nil {
+		return err
 	}
-
-	return homebrewapi.BottleFile{}, "", fmt.Errorf("no bottle files available for %q", f.Name)
+	if err := os.RemoveAll(root); err != nil {
+		return err
+	}
+	if onProgress != nil {
+		onProgress(len(paths), len(paths), true)
+	}
+	return nil
 }
 
-func preferredTags() []string {
-	if runtime.GOOS == "darwin" && runtime.GOARCH == "arm64" {
-		return []string{"arm64_sequoia", "arm64_sonoma", "arm64_ventura", "sonoma", "ventura"}
+// removeFiles deletes paths with a small pool of workers; large kegs and
+// cask payloads are dominated by per-file unlink latency.
+func removeFiles(ctx context.Context, paths []string, onProgress func(removed, total int, done bool)) error {
+	total := len(paths)
+	if onProgress != nil {
+		onProgress(0, total, false)
+	}
+	workers := min(runtime.NumCPU(), 8, total)
+	if workers < 1 {
+		return nil
+	}
+	var (
+		mu       sync.Mutex
+		removed  int
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	work := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range work {
+				err := os.Remove(path)
+				mu.Lock()
+				if err != nil && !os.IsNotExist(err) && firstErr == nil {
+					firstErr = err
+				}
+				removed++
+				if onProgress != nil {
+					onProgress(removed, total, false)
+				}
+				mu.Unlock()
+			}
+		}()
 	}
-	if runtime.GOOS == "darwin" && runtime.GOARCH == "amd64" {
-		return []string{"sonoma", "ventura", "monterey"}
+	var cancelErr error
+feed:
+	for _, path := range paths {
+		if cancelErr = ctx.Err(); cancelErr != nil {
+			break
+		}
+		select {
+		case work <- path:
+		case <-ctx.Done():
+			cancelErr = ctx.Err()
+			break feed
+		}
 	}
-	if runtime.GOOS == "linux" && runtime.GOARCH == "arm64" {
-		return []string{"arm64_linux", "x86_64_linux"}
+	close(work)
+	wg.Wait()
+	if cancelErr != nil {
+		return cancelErr
 	}
-	return []string{"x86_64_linux", "arm64_linux", "sonoma", "arm64_sonoma"}
+	return firstErr
 }
 
-func verifySHA256(path, expected string) error {
-	if strings.TrimSpace(expected) == "" {
-		return nil
+// formulaStats sums kegStats for every version of a formula.
+func (m *Manager) formulaStats(ctx context.Context, formulaDir string) (files int, size int64, err error) {
+	entries, err := os.ReadDir(formulaDir)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		f, n, err := m.kegStats(ctx, filepath.Join(formulaDir, e.Name()))
+		if err != nil {
+			return 0, 0, err
+		}
+		files += f
+		size += n
 	}
+	return files, size, nil
+}
+
+// ExtractSource unpacks a source archive (tar, optionally gzip, bzip2 or xz
+// compressed, or zip) into dst, which must exist. Setuid bits and
+// ownership are never restored.
+func ExtractSource(ctx context.Context, archivePath, dst string) error {
+	return extractArchive(ctx, archivePath, dst, extractOptions{})
+}
+
+func archiveFormatOf(path string) (fetch.ArchiveFormat, error) {
 	f, err := os.Open(path)
 	if err != nil {
-		return err
+		return fetch.FormatUnknown, err
 	}
 	defer f.Close()
+	header := make([]byte, fetch.SniffLen)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fetch.FormatUnknown, err
+	}
+	return fetch.SniffArchive(header[:n]), nil
+}
 
-	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
+// extractArchive unpacks a zip or a (compressed) tar into dst.
+func extractArchive(ctx context.Context, archivePath, dst string, opts extractOptions) error {
+	format, err := archiveFormatOf(archivePath)
+	if err != nil {
 		return err
 	}
-	got := hex.EncodeToString(h.Sum(nil))
-	if !strings.EqualFold(got, expected) {
-		return fmt.Errorf("sha256 mismatch: expected %s, got %s", expected, got)
+	switch format {
+	case fetch.FormatZip:
+		return extractZip(ctx, archivePath, dst)
+	case fetch.FormatUnknown:
+		return fmt.Errorf("%s: unrecognized archive format", filepath.Base(archivePath))
 	}
-	return nil
+	_, err = extractTar(ctx, archivePath, dst, opts)
+	return err
+}
+
+// tarStream returns the decompressed tar stream in r. The standard library
+// has no xz reader, so xz goes through the xz binary. closeStream is safe to
+// call more than once.
+func tarStream(ctx context.Context, r io.Reader) (stream io.Reader, closeStream func() error, err error) {
+	br := bufio.NewReader(r)
+	header, _ := br.Peek(fetch.SniffLen)
+	noop := func() error { return nil }
+	switch fetch.SniffArchive(header) {
+	case fetch.FormatGzip:
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gz, gz.Close, nil
+	case fetch.FormatBzip2:
+		return bzip2.NewReader(br), noop, nil
+	case fetch.FormatXz:
+		if _, err := exec.LookPath("xz"); err != nil {
+			return nil, nil, fmt.Errorf("xz archives need the xz command: %w", err)
+		}
+		cmd := exec.CommandContext(ctx, "xz", "-dc")
+		cmd.Stdin = br
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, nil, fmt.Errorf("decompress xz: %w", err)
+		}
+		var once sync.Once
+		var waitErr error
+		return out, func() error {
+			once.Do(func() {
+				// Drain first so xz is not left blocked on a full pipe.
+				_, _ = io.Copy(io.Discard, out)
+				if err := cmd.Wait(); err != nil {
+					waitErr = fmt.Errorf("decompress xz: %w: %s", err, strings.TrimSpace(stderr.String()))
+				}
+			})
+			return waitErr
+		}, nil
+	case fetch.FormatTar:
+		return br, noop, nil
+	}
+	return nil, nil, fmt.Errorf("not a tar archive")
 }
 
-func extractTarGz(archivePath, dst string) error {
+func extractTar(ctx context.Context, archivePath, dst string, opts extractOptions) (kegManifest, error) {
+	var manifest kegManifest
+	fsys := opts.fs
+	if fsys == nil {
+		fsys = osFS{}
+	}
 	f, err := os.Open(archivePath)
 	if err != nil {
-		return err
+		return manifest, err
 	}
 	defer f.Close()
 
-	gz, err := gzip.NewReader(f)
+	stream, closeStream, err := tarStream(ctx, f)
 	if err != nil {
-		return err
+		return manifest, err
 	}
-	defer gz.Close()
+	defer closeStream()
 
-	tr := tar.NewReader(gz)
+	cleanDst := filepath.Clean(dst)
+	root, err := filepath.EvalSymlinks(cleanDst)
+	if err != nil {
+		return manifest, err
+	}
+	tr := tar.NewReader(stream)
+	// Directory modes and mtimes are applied last: writing children would
+	// change the mtime, and a read-only directory could not be populated.
+	type dirEntry struct {
+		path string
+		hdr  *tar.Header
+	}
+	var dirs []dirEntry
+	extractedDirs := map[string]bool{}
+	// sizes lets hard links count their target's bytes, as a walk would.
+	sizes := map[string]int64{}
 	for {
+		if err := ctx.Err(); err != nil {
+			return manifest, err
+		}
 		hdr, err := tr.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return err
+			return manifest, err
 		}
 
 		target := filepath.Join(dst, hdr.Name)
-		cleanDst := filepath.Clean(dst)
 		cleanTarget := filepath.Clean(target)
 		if !strings.HasPrefix(cleanTarget, cleanDst+string(os.PathSeparator)) && cleanTarget != cleanDst {
-			return fmt.Errorf("tar entry escapes destination: %q", hdr.Name)
+			return manifest, fmt.Errorf("tar entry escapes destination: %q", hdr.Name)
 		}
 
+		// archive/tar folds PAX records and GNU long names/links into hdr and
+		// expands sparse entries (holes read back as zeros), so only the
+		// entry type is left to handle here.
 		switch hdr.Typeflag {
 		case tar.TypeDir:
-			if err := os.MkdirAll(cleanTarget, 0o755); err != nil {
-				return err
+			if err := mkdirWithin(root, cleanTarget); err != nil {
+				return manifest, err
 			}
-		case tar.TypeReg:
-			if err := os.MkdirAll(filepath.Dir(cleanTarget), 0o755); err != nil {
-				return err
+			dirs = append(dirs, dirEntry{path: cleanTarget, hdr: hdr})
+			extractedDirs[cleanTarget] = true
+		case tar.TypeReg, tar.TypeGNUSparse:
+			if err := mkdirWithin(root, filepath.Dir(cleanTarget)); err != nil {
+				return manifest, err
 			}
 			_ = os.Remove(cleanTarget)
-			out, err := os.OpenFile(cleanTarget, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode)&0o777)
+			out, err := fsys.OpenFile(cleanTarget, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode)&0o777)
 			if err != nil {
-				return err
+				return manifest, err
 			}
 			if _, err := io.Copy(out, tr); err != nil {
 				_ = out.Close()
-				return err
+				return manifest, err
 			}
 			if err := out.Close(); err != nil {
-				return err
+				return manifest, err
+			}
+			if err := applyTarMetadata(cleanTarget, hdr, opts); err != nil {
+				return manifest, err
 			}
+			manifest.add(cleanTarget, hdr.Size)
+			sizes[cleanTarget] = hdr.Size
 		case tar.TypeLink:
-			if err := os.MkdirAll(filepath.Dir(cleanTarget), 0o755); err != nil {
-				return err
+			if err := mkdirWithin(root, filepath.Dir(cleanTarget)); err != nil {
+				return manifest, err
 			}
 			_ = os.Remove(cleanTarget)
-			linkTarget := hdr.Linkname
-			if !filepath.IsAbs(linkTarget) {
-				linkTarget = filepath.Join(filepath.Dir(cleanTarget), linkTarget)
+			// Hard link names are relative to the archive root, not the entry.
+			linkTarget := filepath.Join(cleanDst, hdr.Linkname)
+			if !strings.HasPrefix(linkTarget, cleanDst+string(os.PathSeparator)) {
+				return manifest, fmt.Errorf("tar hard link escapes destination: %q -> %q", hdr.Name, hdr.Linkname)
+			}
+			if err := mkdirWithin(root, filepath.Dir(linkTarget)); err != nil {
+				return manifest, err
 			}
 			if err := os.Link(linkTarget, cleanTarget); err != nil {
-				return err
+				return manifest, err
 			}
+			manifest.add(cleanTarget, sizes[linkTarget])
 		case tar.TypeSymlink:
-			if err := os.MkdirAll(filepath.Dir(cleanTarget), 0o755); err != nil {
-				return err
+			if extractedDirs[cleanTarget] {
+				return manifest, fmt.Errorf("tar entry replaces a directory with a symlink: %q", hdr.Name)
+			}
+			if err := mkdirWithin(root, filepath.Dir(cleanTarget)); err != nil {
+				return manifest, err
 			}
 			_ = os.Remove(cleanTarget)
 			if err := os.Symlink(hdr.Linkname, cleanTarget); err != nil {
-				return err
+				return manifest, err
 			}
+			manifest.add(cleanTarget, int64(len(hdr.Linkname)))
+			if opts.preserveOwner {
+				_ = os.Lchown(cleanTarget, hdr.Uid, hdr.Gid)
+			}
+		case tar.TypeXGlobalHeader:
+			// Global PAX records carry no file.
+		default:
+			return manifest, fmt.Errorf("unsupported tar entry %q (type %q)", hdr.Name, string(hdr.Typeflag))
 		}
 	}
 
-	return nil
+	for i := len(dirs) - 1; i >= 0; i-- {
+		// The metadata is applied by path, so anything a later entry left
+		// there other than a real directory is skipped rather than followed.
+		if info, err := os.Lstat(dirs[i].path); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := applyTarMetadata(dirs[i].path, dirs[i].hdr, opts); err != nil {
+			return manifest, err
+		}
+	}
+	return manifest, closeStream()
 }
 
-func extractZip(archivePath, dst string) error {
+func extractZip(ctx context.Context, archivePath, dst string) error {
 	reader, err := zip.OpenReader(archivePath)
 	if err != nil {
 		return err
@@ -1429,7 +5129,14 @@ func extractZip(archivePath, dst string) error {
 	defer reader.Close()
 
 	cleanDst := filepath.Clean(dst)
+	root, err := filepath.EvalSymlinks(cleanDst)
+	if err != nil {
+		return err
+	}
 	for _, file := range reader.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		target := filepath.Join(dst, file.Name)
 		cleanTarget := filepath.Clean(target)
 		if !strings.HasPrefix(cleanTarget, cleanDst+string(os.PathSeparator)) && cleanTarget != cleanDst {
@@ -1437,15 +5144,16 @@ func extractZip(archivePath, dst string) error {
 		}
 
 		if file.FileInfo().IsDir() {
-			if err := os.MkdirAll(cleanTarget, 0o755); err != nil {
+			if err := mkdirWithin(root, cleanTarget); err != nil {
 				return err
 			}
 			continue
 		}
 
-		if err := os.MkdirAll(filepath.Dir(cleanTarget), 0o755); err != nil {
+		if err := mkdirWithin(root, filepath.Dir(cleanTarget)); err != nil {
 			return err
 		}
+		_ = os.Remove(cleanTarget)
 		rc, err := file.Open()
 		if err != nil {
 			return err
@@ -1472,43 +5180,210 @@ func extractZip(archivePath, dst string) error {
 	return nil
 }
 
+// maxFindDepth bounds findFileInTree; real cask archives nest the app at
+// most a few directories down.
+const maxFindDepth = 8
+
+// findFileInTree returns the shallowest entry named baseName under root,
+// breadth first in name order. Symlinked directories are followed only
+// while they resolve inside root, and each directory is visited once, so
+// link cycles terminate. When baseName is an .app the match must be a
+// directory and the walk does not descend into other bundles, whose
+// Contents often carry helper apps.
 func findFileInTree(root, baseName string) (string, error) {
 	baseName = strings.TrimSpace(baseName)
 	if baseName == "" {
 		return "", fmt.Errorf("file name is required")
 	}
-	candidate := filepath.Join(root, baseName)
-	if _, err := os.Stat(candidate); err == nil {
-		return candidate, nil
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	wantApp := strings.HasSuffix(strings.ToLower(baseName), ".app")
+	visited := map[string]bool{}
+	level := []string{root}
+	for depth := 0; depth <= maxFindDepth && len(level) > 0; depth++ {
+		var next []string
+		for _, dir := range level {
+			real, err := filepath.EvalSymlinks(dir)
+			if err != nil || visited[real] {
+				continue
+			}
+			if real != realRoot && !strings.HasPrefix(real, realRoot+string(os.PathSeparator)) {
+				continue
+			}
+			visited[real] = true
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				if dir == root {
+					return "", err
+				}
+				continue
+			}
+			for _, entry := range entries {
+				path := filepath.Join(dir, entry.Name())
+				info, err := os.Stat(path)
+				if err != nil {
+					continue
+				}
+				if entry.Name() == baseName && (!wantApp || info.IsDir()) {
+					return path, nil
+				}
+				if !info.IsDir() || (wantApp && strings.HasSuffix(strings.ToLower(entry.Name()), ".app")) {
+					continue
+				}
+				next = append(next, path)
+			}
+		}
+		level = next
 	}
+	return "", fmt.Errorf("could not find %q in %s", baseName, root)
+}
 
-	found := ""
-	err := filepath.WalkDir(root, func(path string, d os.DirEntry, walkErr error) error {
-		if walkErr != nil {
-			return walkErr
+// installCaskFonts moves each font out of the extracted archive into the
+// fonts directory, replacing an older copy, and returns where they went.
+// Sources are relative to the archive root; a bare file name is searched for.
+func (m *Manager) installCaskFonts(caskDir string, fonts []string) ([]string, error) {
+	if len(fonts) == 0 {
+		return nil, nil
+	}
+	fontsDir := m.Paths.Fonts
+	if fontsDir == "" {
+		fontsDir = defaultFontsDir()
+	}
+	if err := os.MkdirAll(fontsDir, 0o755); err != nil {
+		return nil, err
+	}
+	installed := make([]string, 0, len(fonts))
+	for _, font := range fonts {
+		src := filepath.Join(caskDir, filepath.FromSlash(font))
+		if _, err := os.Stat(src); err != nil {
+			found, findErr := findFileInTree(caskDir, filepath.Base(font))
+			if findErr != nil {
+				return installed, fmt.Errorf("font %s: %w", font, findErr)
+			}
+			src = found
 		}
-		if d.Name() == baseName {
-			found = path
-			return io.EOF
+		dst := filepath.Join(fontsDir, filepath.Base(src))
+		if err := os.RemoveAll(dst); err != nil {
+			return installed, err
 		}
-		return nil
-	})
-	if err == io.EOF && found != "" {
-		return found, nil
+		if err := os.Rename(src, dst); err != nil {
+			return installed, err
+		}
+		messages.Println(messages.MovingFont, filepath.Base(src), dst)
+		installed = append(installed, dst)
+	}
+	return installed, nil
+}
+
+// expandCaskPath resolves the placeholders the API uses in artifact paths.
+// Homebrew's staged path, $HOMEBREW_PREFIX/Caskroom/<token>/<version>, maps
+// to the version directory ub extracted into.
+func (m *Manager) expandCaskPath(raw, caskDir string) string {
+	path := strings.ReplaceAll(raw, "$APPDIR", m.Paths.Applications)
+	staged := "$HOMEBREW_PREFIX/Caskroom/" + filepath.Base(filepath.Dir(caskDir)) + "/" + filepath.Base(caskDir)
+	path = strings.ReplaceAll(path, staged, caskDir)
+	path = strings.ReplaceAll(path, "$HOMEBREW_PREFIX/Caskroom", m.Paths.Caskroom)
+	return strings.ReplaceAll(path, "$HOMEBREW_PREFIX", m.Paths.Prefix)
+}
+
+// prepareCaskBinary makes src runnable and returns what bin/<target> should
+// point at. Non-executable files are chmodded as brew does; a script
+// without a shebang, or one that cannot be chmodded, gets a wrapper in
+// caskDir/.ub-wrappers instead. A missing *.wrapper.sh is a shimscript the
+// cask's preflight would have written; ub writes the usual exec shim when
+// an installed app has a matching executable, and otherwise returns "".
+func prepareCaskBinary(src, target, caskDir string, apps []string) (string, error) {
+	info, err := os.Stat(src)
+	if os.IsNotExist(err) && strings.HasSuffix(src, ".wrapper.sh") {
+		name := strings.TrimSuffix(filepath.Base(src), ".wrapper.sh")
+		for _, app := range apps {
+			exe := filepath.Join(app, "Contents", "MacOS", name)
+			if fi, err := os.Stat(exe); err == nil && !fi.IsDir() {
+				return src, writeCaskWrapper(src, "exec "+shellQuote(exe)+` "$@"`)
+			}
+		}
+		return "", nil
 	}
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("cask binary %s: %w", target, err)
 	}
-	return "", fmt.Errorf("could not find %q in %s", baseName, root)
+	if info.IsDir() || info.Mode()&0o111 != 0 {
+		return src, nil
+	}
+	interpreter, script := scriptInterpreter(src)
+	if script && interpreter != "" {
+		if err := os.Chmod(src, info.Mode()|0o111); err == nil {
+			return src, nil
+		}
+	} else if !script {
+		if err := os.Chmod(src, info.Mode()|0o111); err != nil {
+			return "", fmt.Errorf("make cask binary %s executable: %w", target, err)
+		}
+		return src, nil
+	}
+	if interpreter == "" {
+		interpreter = "/bin/sh"
+	}
+	wrapper := filepath.Join(caskDir, ".ub-wrappers", target)
+	return wrapper, writeCaskWrapper(wrapper, "exec "+interpreter+" "+shellQuote(src)+` "$@"`)
+}
+
+// scriptInterpreter reports whether path looks like text rather than a
+// Mach-O or ELF binary, and returns its shebang line without the "#!".
+func scriptInterpreter(path string) (string, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	if bytes.IndexByte(head, 0) >= 0 {
+		return "", false
+	}
+	if !bytes.HasPrefix(head, []byte("#!")) {
+		return "", true
+	}
+	line, _, _ := bytes.Cut(head[2:], []byte("\n"))
+	return strings.TrimSpace(string(line)), true
+}
+
+func writeCaskWrapper(path, command string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte("#!/bin/sh\n"+command+"\n"), 0o755)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// apps returns every installed bundle. AppPath repeats the first one for
+// older readers; receipts written before multi-app casks only have it.
+func (r caskInstallReceipt) apps() []string {
+	if len(r.AppPaths) > 0 {
+		return r.AppPaths
+	}
+	if strings.TrimSpace(r.AppPath) == "" {
+		return nil
+	}
+	return []string{r.AppPath}
 }
 
 func writeCaskReceipt(caskDir, token, version, appPath string, linkedBinaries []string) error {
-	receipt := caskInstallReceipt{
+	return saveCaskReceipt(caskDir, caskInstallReceipt{
 		Token:          token,
 		Version:        version,
 		AppPath:        appPath,
 		LinkedBinaries: linkedBinaries,
-	}
+	})
+}
+
+func saveCaskReceipt(caskDir string, receipt caskInstallReceipt) error {
 	data, err := json.MarshalIndent(receipt, "", "  ")
 	if err != nil {
 		return err
@@ -1517,6 +5392,170 @@ func writeCaskReceipt(caskDir, token, version, appPath string, linkedBinaries []
 	return os.WriteFile(path, data, 0o644)
 }
 
+var (
+	runningAppPIDs = findRunningAppPIDs
+	quitApp        = quitRunningApp
+	appQuitTimeout = 10 * time.Second
+)
+
+// ensureAppNotRunning refuses to touch an app bundle that has running
+// processes unless ConfirmQuit agrees to quit it first.
+func (m *Manager) ensureAppNotRunning(appPath string, bundleIDs []string) error {
+	if strings.TrimSpace(appPath) == "" {
+		return nil
+	}
+	pids := runningAppPIDs(appPath)
+	if len(pids) == 0 {
+		return nil
+	}
+	app := filepath.Base(appPath)
+	if m.ConfirmQuit == nil || !m.ConfirmQuit(app) {
+		return fmt.Errorf("%s is running; quit it and try again", app)
+	}
+	quitApp(bundleIDs, pids)
+	clock := m.clock()
+	deadline := clock.Now().Add(appQuitTimeout)
+	for len(runningAppPIDs(appPath)) > 0 {
+		if clock.Now().After(deadline) {
+			return fmt.Errorf("%s did not quit within %s", app, appQuitTimeout)
+		}
+		<-clock.After(200 * time.Millisecond)
+	}
+	return nil
+}
+
+// findRunningAppPIDs lists processes whose executable lives inside appPath.
+func findRunningAppPIDs(appPath string) []int {
+	prefix := filepath.Clean(appPath) + string(filepath.Separator)
+	var pids []int
+	if runtime.GOOS == "linux" {
+		entries, err := os.ReadDir("/proc")
+		if err != nil {
+			return nil
+		}
+		for _, entry := range entries {
+			pid, err := strconv.Atoi(entry.Name())
+			if err != nil {
+				continue
+			}
+			exe, err := os.Readlink(filepath.Join("/proc", entry.Name(), "exe"))
+			if err == nil && strings.HasPrefix(exe, prefix) {
+				pids = append(pids, pid)
+			}
+		}
+		return pids
+	}
+	out, err := exec.Command("ps", "-axww", "-o", "pid=,comm=").Output()
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		pidField, command, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if !ok {
+			continue
+		}
+		pid, err := strconv.Atoi(pidField)
+		if err == nil && strings.HasPrefix(strings.TrimSpace(command), prefix) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// quitRunningApp asks each bundle id to quit through AppleScript, the way the
+// cask quit stanza does, and falls back to SIGTERM for the remaining pids.
+func quitRunningApp(bundleIDs []string, pids []int) {
+	if runtime.GOOS == "darwin" && len(bundleIDs) > 0 {
+		quit := true
+		for _, id := range bundleIDs {
+			script := fmt.Sprintf("tell application id %q to quit", id)
+			if err := exec.Command("osascript", "-e", script).Run(); err != nil {
+				quit = false
+			}
+		}
+		if quit {
+			return
+		}
+	}
+	for _, pid := range pids {
+		if proc, err := os.FindProcess(pid); err == nil {
+			_ = proc.Signal(syscall.SIGTERM)
+		}
+	}
+}
+
+// removeCaskApp moves an .app bundle to the Trash, like the cask trash
+// stanza, or deletes it when permanent is set or trashing fails.
+func removeCaskApp(path string, permanent bool) {
+	if _, err := os.Lstat(path); err != nil {
+		return
+	}
+	if !permanent && strings.EqualFold(filepath.Ext(path), ".app") {
+		dst, err := trashPath(path)
+		if err == nil {
+			messages.Println(messages.MovedToTrash, filepath.Base(path), dst)
+			return
+		}
+		fmt.Fprintln(os.Stderr, messages.Sprintf(messages.Warning, fmt.Sprintf("could not move %s to the Trash, deleting it: %v", path, err)))
+	}
+	_ = os.RemoveAll(path)
+}
+
+// trashPath moves path into ~/.Trash on macOS or the XDG trash elsewhere,
+// writing the .trashinfo record the XDG spec requires, and returns where it went.
+func trashPath(path string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if runtime.GOOS == "darwin" {
+		dir := filepath.Join(home, ".Trash")
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return "", err
+		}
+		dst := uniqueTrashName(dir, filepath.Base(abs))
+		return dst, os.Rename(abs, dst)
+	}
+	dataHome := strings.TrimSpace(os.Getenv("XDG_DATA_HOME"))
+	if dataHome == "" {
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+	filesDir := filepath.Join(dataHome, "Trash", "files")
+	infoDir := filepath.Join(dataHome, "Trash", "info")
+	for _, dir := range []string{filesDir, infoDir} {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return "", err
+		}
+	}
+	dst := uniqueTrashName(filesDir, filepath.Base(abs))
+	info := fmt.Sprintf("[Trash Info]\nPath=%s\nDeletionDate=%s\n", (&url.URL{Path: abs}).EscapedPath(), time.Now().Format("2006-01-02T15:04:05"))
+	infoPath := filepath.Join(infoDir, filepath.Base(dst)+".trashinfo")
+	if err := os.WriteFile(infoPath, []byte(info), 0o600); err != nil {
+		return "", err
+	}
+	if err := os.Rename(abs, dst); err != nil {
+		_ = os.Remove(infoPath)
+		return "", err
+	}
+	return dst, nil
+}
+
+func uniqueTrashName(dir, base string) string {
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	candidate := filepath.Join(dir, base)
+	for n := 2; ; n++ {
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+		candidate = filepath.Join(dir, fmt.Sprintf("%s %d%s", stem, n, ext))
+	}
+}
+
 func caskAppRemovalCandidates(appPath, managedApplications string) []string {
 	seen := map[string]bool{}
 	out := make([]string, 0, 4)
@@ -1532,7 +5571,11 @@ func caskAppRemovalCandidates(appPath, managedApplications string) []string {
 		out = append(out, cleaned)
 	}
 
-	add(appPath)
+	// The receipt's own path is only trusted inside the managed directory;
+	// elsewhere just the bundle name is looked for.
+	if rel, err := filepath.Rel(managedApplications, filepath.Clean(strings.TrimSpace(appPath))); err == nil && filepath.IsLocal(rel) {
+		add(appPath)
+	}
 
 	base := filepath.Base(strings.TrimSpace(appPath))
 	if base == "" || base == "." {
@@ -1557,37 +5600,32 @@ func isNotFoundError(err error) bool {
 	if err == nil {
 		return false
 	}
+	var statusErr *fetch.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == 404
+	}
 	msg := strings.ToLower(err.Error())
 	return strings.Contains(msg, "status 404")
 }
 
-func isZipArchive(path string) (bool, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return false, err
-	}
-	defer f.Close()
-
-	header := make([]byte, 4)
-	n, err := f.Read(header)
-	if err != nil && err != io.EOF {
-		return false, err
-	}
-	if n < 4 {
-		return false, nil
-	}
-	return header[0] == 'P' && header[1] == 'K' && header[2] == 0x03 && header[3] == 0x04, nil
-}
-
 func (m *Manager) linkFormula(name, version string) (string, error) {
 	installDir, linkedVersion, err := resolveInstalledFormulaDir(m.Paths.Cellar, name, version)
 	if err != nil {
 		return "", err
 	}
-	if err := m.linkTree(installDir, m.Paths.Bin, "bin"); err != nil {
+	var links []plannedLink
+	for _, leaf := range []string{"bin", "sbin"} {
+		planned, err := planLinks(installDir, m.linkDir(leaf), leaf)
+		if err != nil {
+			return "", err
+		}
+		links = append(links, planned...)
+	}
+	links, err = m.resolveLinkConflicts(name, links)
+	if err != nil {
 		return "", err
 	}
-	if err := m.linkTree(installDir, m.Paths.Sbin, "sbin"); err != nil {
+	if err := m.applyLinkTxn(linkJournal{Formula: name, Version: linkedVersion, Links: links}); err != nil {
 		return "", err
 	}
 	return linkedVersion, nil
@@ -1603,7 +5641,7 @@ func resolveInstalledFormulaDir(cellar, name, version string) (string, string, e
 	entries, err := os.ReadDir(formulaDir)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return "", "", fmt.Errorf("formula %q is not installed", name)
+			return "", "", fmt.Errorf("formula %q is %w", name, ErrNotInstalled)
 		}
 		return "", "", err
 	}
@@ -1631,32 +5669,29 @@ func resolveInstalledFormulaDir(cellar, name, version string) (string, string, e
 		return "", "", fmt.Errorf("formula %q has no installed versions", name)
 	}
 
-	sort.Strings(matches)
-	resolvedVersion := matches[len(matches)-1]
+	resolvedVersion := newestVersion(matches)
 	return filepath.Join(formulaDir, resolvedVersion), resolvedVersion, nil
 }
 
-func (m *Manager) linkTree(installDir, linkRoot, leaf string) error {
+// planLinks lists the links from linkRoot to the files in the keg's leaf
+// directory.
+func planLinks(installDir, linkRoot, leaf string) ([]plannedLink, error) {
 	srcDir := filepath.Join(installDir, leaf)
 	entries, err := os.ReadDir(srcDir)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil
+			return nil, nil
 		}
-		return err
+		return nil, err
 	}
+	links := make([]plannedLink, 0, len(entries))
 	for _, entry := range entries {
 		if entry.IsDir() {
 			continue
 		}
-		src := filepath.Join(srcDir, entry.Name())
-		dst := filepath.Join(linkRoot, entry.Name())
-		_ = os.Remove(dst)
-		if err := os.Symlink(src, dst); err != nil {
-			return err
-		}
+		links = append(links, plannedLink{Path: filepath.Join(linkRoot, entry.Name()), Target: filepath.Join(srcDir, entry.Name())})
 	}
-	return nil
+	return links, nil
 }
 
 func (m *Manager) unlinkTree(formulaDir, linkRoot, leaf string) error {
@@ -0,0 +1,333 @@
+package native
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"ub/internal/apitest"
+)
+
+func TestLoadManifest(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "manifest.json")
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"formulae": ["jq", {"name": "node", "version": "22", "pinned": true}], "casks": [{"name": "slack", "state": "absent"}]}`)
+	manifest, err := LoadManifest(path)
+	if err != nil {
+		t.Fatalf("LoadManifest: %v", err)
+	}
+	want := Manifest{
+		Formulae: []ManifestEntry{{Name: "jq"}, {Name: "node", Version: "22", Pinned: true}},
+		Casks:    []ManifestEntry{{Name: "slack", State: StateAbsent}},
+	}
+	if !reflect.DeepEqual(manifest, want) {
+		t.Fatalf("manifest = %+v, want %+v", manifest, want)
+	}
+
+	for data, wantErr := range map[string]string{
+		`{"formulae": [{"name": "jq", "sate": "absent"}]}`:                       "unknown field",
+		`{"formulae": ["jq", "jq"]}`:                                             "listed twice",
+		`{"formulae": [{"name": "jq", "state": "gone"}]}`:                        "unknown state",
+		`{"taps": ["cask-fonts"]}`:                                               "not a user/repo name",
+		`{"casks": [{"name": "slack", "tap": "acme/tools"}]}`:                    "cannot be built from a tap",
+		`{"formulae": [{"name": "jq", "state": "absent", "tap": "acme/tools"}]}`: "absent but has",
+	} {
+		write(data)
+		if _, err := LoadManifest(path); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("LoadManifest(%s) error = %v, want %q", data, err, wantErr)
+		}
+	}
+}
+
+func TestLoadManifestYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "manifest.yaml")
+	data := `formulae:
+  - jq
+  - {name: node, version: 22, pinned: true}
+  - {name: libgreet, tap: acme/tools}
+casks: [{name: slack, state: absent}]
+taps:
+  - acme/tools
+  - {name: acme/more, url: "https://example.com/more.git"}
+`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := LoadManifest(path)
+	if err != nil {
+		t.Fatalf("LoadManifest: %v", err)
+	}
+	want := Manifest{
+		Formulae: []ManifestEntry{{Name: "jq"}, {Name: "node", Version: "22", Pinned: true}, {Name: "libgreet", Tap: "acme/tools"}},
+		Casks:    []ManifestEntry{{Name: "slack", State: StateAbsent}},
+		Taps:     []ManifestTap{{Name: "acme/tools"}, {Name: "acme/more", URL: "https://example.com/more.git"}},
+	}
+	if !reflect.DeepEqual(manifest, want) {
+		t.Fatalf("manifest = %+v, want %+v", manifest, want)
+	}
+
+	if err := os.WriteFile(path, []byte("formulae:\n  - {name: jq, sate: absent}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadManifest(path); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("expected an unknown field error, got %v", err)
+	}
+}
+
+func TestVersionMatches(t *testing.T) {
+	for _, tt := range []struct {
+		version, want string
+		ok            bool
+	}{
+		{"22.1.0", "", true},
+		{"22.1.0", "22", true},
+		{"22.1.0", "22.1", true},
+		{"2.12.2_1", "2.12.2", true},
+		{"221.0", "22", false},
+		{"23.0.0", "22", false},
+	} {
+		if got := versionMatches(tt.version, tt.want); got != tt.ok {
+			t.Errorf("versionMatches(%q, %q) = %v", tt.version, tt.want, got)
+		}
+	}
+}
+
+func TestApplyConvergesAndIsIdempotent(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+	ctx := context.Background()
+
+	m := New(1)
+	if err := os.MkdirAll(filepath.Join(m.Paths.Cellar, "hello", "2.12.1", "bin"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := Manifest{
+		Formulae: []ManifestEntry{{Name: "hello", State: StateLatest}},
+		Casks:    []ManifestEntry{{Name: "greeter"}},
+	}
+	plan, err := m.PlanApply(ctx, manifest)
+	if err != nil {
+		t.Fatalf("PlanApply: %v", err)
+	}
+	if len(plan.Install) != 0 || !reflect.DeepEqual(plan.InstallCasks, []string{"greeter"}) ||
+		len(plan.Upgrade) != 1 || plan.Upgrade[0].Name != "hello" || plan.Upgrade[0].CurrentVersion != "2.12.2" {
+		t.Fatalf("plan = %+v", plan)
+	}
+	actions, err := m.PlanActions(ctx, plan)
+	if err != nil {
+		t.Fatalf("PlanActions: %v", err)
+	}
+	if len(actions) != 2 || actions[0].Action != "install" || actions[0].Kind != "cask" || actions[0].Bytes <= 0 ||
+		actions[1] != (PlanAction{Action: "upgrade", Kind: "formula", Name: "hello", From: "2.12.1", To: "2.12.2", Bytes: actions[1].Bytes}) ||
+		actions[1].Bytes <= 0 {
+		t.Fatalf("actions = %+v", actions)
+	}
+	if err := m.Apply(ctx, plan); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if plan, err := m.PlanApply(ctx, manifest); err != nil || !plan.Empty() {
+		t.Fatalf("second PlanApply = %+v, %v; want nothing to do", plan, err)
+	}
+
+	manifest.Formulae[0].Version = "3"
+	if _, err := m.PlanApply(ctx, manifest); err == nil || !strings.Contains(err.Error(), "wants version 3") {
+		t.Fatalf("expected an unsatisfiable version error, got %v", err)
+	}
+
+	manifest = Manifest{Casks: []ManifestEntry{{Name: "greeter", State: StateAbsent}}}
+	if plan, err = m.PlanApply(ctx, manifest); err != nil || !reflect.DeepEqual(plan.RemoveCasks, []string{"greeter"}) {
+		t.Fatalf("PlanApply absent = %+v, %v", plan, err)
+	}
+	if err := m.Apply(ctx, plan); err != nil {
+		t.Fatalf("Apply absent: %v", err)
+	}
+	if plan, err := m.PlanApply(ctx, manifest); err != nil || !plan.Empty() {
+		t.Fatalf("PlanApply after removal = %+v, %v", plan, err)
+	}
+}
+
+func TestApplyPersistsPins(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+	ctx := context.Background()
+
+	m := New(1)
+	if err := os.MkdirAll(filepath.Join(m.Paths.Cellar, "hello", "2.12.1", "bin"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	manifest := Manifest{Formulae: []ManifestEntry{{Name: "hello", Pinned: true}}}
+	plan, err := m.PlanApply(ctx, manifest)
+	if err != nil || !reflect.DeepEqual(plan.Pin, []string{"hello"}) || len(plan.Upgrade) != 0 {
+		t.Fatalf("PlanApply = %+v, %v", plan, err)
+	}
+	if err := m.Apply(ctx, plan); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if plan, err := m.PlanApply(ctx, manifest); err != nil || !plan.Empty() {
+		t.Fatalf("second PlanApply = %+v, %v; want nothing to do", plan, err)
+	}
+
+	summary, err := m.Upgrade(ctx, nil, UpgradeOptions{})
+	if err != nil {
+		t.Fatalf("Upgrade: %v", err)
+	}
+	if len(summary.Upgraded) != 0 || len(summary.Pinned) != 1 || summary.Pinned[0].Name != "hello" {
+		t.Fatalf("Upgrade of a pinned formula = %+v", summary)
+	}
+
+	manifest.Formulae[0] = ManifestEntry{Name: "hello", State: StateLatest}
+	if plan, err = m.PlanApply(ctx, manifest); err != nil || !reflect.DeepEqual(plan.Unpin, []string{"hello"}) || len(plan.Upgrade) != 1 {
+		t.Fatalf("PlanApply unpinned = %+v, %v", plan, err)
+	}
+	if err := m.Apply(ctx, plan); err != nil {
+		t.Fatalf("Apply unpinned: %v", err)
+	}
+	if !m.isInstalled("hello", "2.12.2") {
+		t.Fatal("expected hello upgraded once unpinned")
+	}
+}
+
+func TestApplyRemovesFormulaeAndCasksByKind(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+	ctx := context.Background()
+
+	m := New(1)
+	if err := m.InstallWithOptions(ctx, nil, InstallOptions{Casks: []string{"greeter"}}); err != nil {
+		t.Fatalf("install cask: %v", err)
+	}
+	// A formula that shares the cask's name.
+	keg := filepath.Join(m.Paths.Cellar, "greeter", "1.0")
+	if err := os.MkdirAll(keg, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateFormulaReceipt(keg, func(receipt map[string]any) {
+		receipt["installed_on_request"] = true
+		receipt["runtime_dependencies"] = []any{}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.recordFormula("greeter"); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := m.PlanApply(ctx, Manifest{Casks: []ManifestEntry{{Name: "greeter", State: StateAbsent}}})
+	if err != nil || !reflect.DeepEqual(plan.RemoveCasks, []string{"greeter"}) || len(plan.Remove) != 0 {
+		t.Fatalf("PlanApply = %+v, %v", plan, err)
+	}
+	if err := m.Apply(ctx, plan); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(m.Paths.Caskroom, "greeter")); !os.IsNotExist(err) {
+		t.Fatalf("expected the cask removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(m.Paths.Cellar, "greeter", "1.0")); err != nil {
+		t.Fatalf("expected the formula kept: %v", err)
+	}
+}
+
+func TestApplyRemovesEveryKegOfAnAbsentFormula(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+	ctx := context.Background()
+
+	m := New(1)
+	if err := m.Install(ctx, []string{"hello"}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	old := filepath.Join(m.Paths.Cellar, "hello", "2.11")
+	if err := os.MkdirAll(old, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.recordFormula("hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dependents still stop a removal.
+	manifest := Manifest{Formulae: []ManifestEntry{{Name: "libgreet", State: StateAbsent}}}
+	plan, err := m.PlanApply(ctx, manifest)
+	if err != nil {
+		t.Fatalf("PlanApply: %v", err)
+	}
+	if err := m.Apply(ctx, plan); !errors.Is(err, ErrHasDependents) {
+		t.Fatalf("expected libgreet to be refused while hello needs it, got %v", err)
+	}
+
+	manifest = Manifest{Formulae: []ManifestEntry{{Name: "hello", State: StateAbsent}}}
+	if plan, err = m.PlanApply(ctx, manifest); err != nil {
+		t.Fatalf("PlanApply: %v", err)
+	}
+	if err := m.Apply(ctx, plan); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(m.Paths.Cellar, "hello")); !os.IsNotExist(err) {
+		t.Fatalf("expected every hello keg removed, got %v", err)
+	}
+	if plan, err = m.PlanApply(ctx, manifest); err != nil || !plan.Empty() {
+		t.Fatalf("second PlanApply = %+v, %v; want no changes", plan, err)
+	}
+}
+
+func TestApplyClonesTapsAndBuildsFromThem(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+	ctx := context.Background()
+
+	repo := writePinTap(t)
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"-c", "user.name=ub", "-c", "user.email=ub@example.com", "commit", "-qm", "libgreet"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+
+	m := New(1)
+	manifest := Manifest{
+		Formulae: []ManifestEntry{{Name: "libgreet", Tap: "acme/tools"}},
+		Taps:     []ManifestTap{{Name: "acme/tools", URL: repo}},
+	}
+	plan, err := m.PlanApply(ctx, manifest)
+	if err != nil || len(plan.Taps) != 1 || len(plan.TapPins) != 1 || !reflect.DeepEqual(plan.Install, []string{"libgreet"}) {
+		t.Fatalf("PlanApply = %+v, %v", plan, err)
+	}
+	if err := m.Apply(ctx, plan); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if kegTap(filepath.Join(m.Paths.Cellar, "libgreet", "1.0")) != "acme/tools" {
+		t.Fatal("expected libgreet built from the cloned tap")
+	}
+	if plan, err := m.PlanApply(ctx, manifest); err != nil || !plan.Empty() {
+		t.Fatalf("second PlanApply = %+v, %v; want nothing to do", plan, err)
+	}
+}
@@ -0,0 +1,58 @@
+package native
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestUseArchSwitchesToParallelPrefix(t *testing.T) {
+	base := t.TempDir()
+	m := New(1)
+	m.Paths = Paths{
+		BaseDir:      base,
+		Prefix:       filepath.Join(base, "ub"),
+		Repo:         filepath.Join(base, "ub", "Library", "ub"),
+		Cellar:       filepath.Join(base, "ub", "Cellar"),
+		Caskroom:     filepath.Join(base, "ub", "Caskroom"),
+		Cache:        filepath.Join(base, "ub", "cache"),
+		Bin:          filepath.Join(base, "ub", "bin"),
+		Sbin:         filepath.Join(base, "ub", "sbin"),
+		Applications: filepath.Join(base, "Applications"),
+	}
+
+	if err := m.useArch("x86_64", "darwin", "arm64"); err != nil {
+		t.Fatalf("useArch: %v", err)
+	}
+	if m.Arch != "amd64" {
+		t.Fatalf("Arch = %q, want amd64", m.Arch)
+	}
+	if want := filepath.Join(base, "ub-x86_64", "Cellar"); m.Paths.Cellar != want {
+		t.Fatalf("Cellar = %q, want %q", m.Paths.Cellar, want)
+	}
+	if want := filepath.Join(base, "ub-x86_64", "bin"); m.Paths.Bin != want {
+		t.Fatalf("Bin = %q, want %q", m.Paths.Bin, want)
+	}
+	if want := filepath.Join(base, "ub", "cache"); m.Paths.Cache != want {
+		t.Fatalf("Cache = %q, want shared %q", m.Paths.Cache, want)
+	}
+	if tags := preferredTagsFor("darwin", m.Arch); len(tags) == 0 || tags[0] != "sequoia" {
+		t.Fatalf("tags = %v, want intel macOS tags", tags)
+	}
+}
+
+func TestUseArchRejectsUnsupportedHosts(t *testing.T) {
+	m := New(1)
+	before := m.Paths
+	if err := m.useArch("arm64", "linux", "arm64"); err != nil || m.Arch != "" || m.Paths != before {
+		t.Fatalf("host arch should be a no-op, got %v (arch %q)", err, m.Arch)
+	}
+	if err := m.useArch("x86_64", "linux", "arm64"); err == nil {
+		t.Fatalf("expected x86_64 on linux/arm64 to fail")
+	}
+	if err := m.useArch("arm64", "darwin", "amd64"); err == nil {
+		t.Fatalf("expected arm64 on intel macOS to fail")
+	}
+	if err := m.useArch("ppc", "darwin", "arm64"); err == nil {
+		t.Fatalf("expected unknown arch to fail")
+	}
+}
@@ -0,0 +1,159 @@
+package native
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newBottleFileTestManager(t *testing.T) *Manager {
+	t.Helper()
+	tmp := t.TempDir()
+	prefix := filepath.Join(tmp, "ub")
+	return &Manager{Paths: Paths{
+		BaseDir:      tmp,
+		Prefix:       prefix,
+		Repo:         filepath.Join(tmp, "unbrew"),
+		Cellar:       filepath.Join(prefix, "Cellar"),
+		Caskroom:     filepath.Join(prefix, "Caskroom"),
+		Cache:        filepath.Join(prefix, "cache"),
+		Bin:          filepath.Join(prefix, "bin"),
+		Sbin:         filepath.Join(prefix, "sbin"),
+		Applications: filepath.Join(prefix, "Applications"),
+	}}
+}
+
+func writeBottleFile(t *testing.T, dir, filename, name, version string) string {
+	t.Helper()
+	archive := writeTarGz(t,
+		tarEntry{hdr: tar.Header{Name: name + "/", Typeflag: tar.TypeDir, Mode: 0o755}},
+		tarEntry{hdr: tar.Header{Name: name + "/" + version + "/", Typeflag: tar.TypeDir, Mode: 0o755}},
+		tarEntry{hdr: tar.Header{Name: name + "/" + version + "/bin/", Typeflag: tar.TypeDir, Mode: 0o755}},
+		tarEntry{hdr: tar.Header{Name: name + "/" + version + "/bin/" + name, Typeflag: tar.TypeReg, Mode: 0o755}, body: "#!/bin/sh\n"},
+	)
+	dst := filepath.Join(dir, filename)
+	if err := os.Rename(archive, dst); err != nil {
+		t.Fatalf("move bottle: %v", err)
+	}
+	return dst
+}
+
+func TestParseBottleReference(t *testing.T) {
+	b, err := parseBottleReference("https://example.com/bottles/ffmpeg--8.0.1_2.arm64_sonoma.bottle.1.tar.gz", "")
+	if err != nil {
+		t.Fatalf("parseBottleReference: %v", err)
+	}
+	if b.name != "ffmpeg" || b.version != "8.0.1_2" || b.tag != "arm64_sonoma" {
+		t.Fatalf("parsed %+v", b)
+	}
+	if isBottleReference("ffmpeg") || isBottleReference("user/tap/ffmpeg") || !isBottleReference("./x.tar.gz") {
+		t.Fatal("isBottleReference misclassified an argument")
+	}
+}
+
+func TestBottleFileNamesStayInsideTheCellar(t *testing.T) {
+	for _, ref := range []string{
+		"foo--...all.bottle.tar.gz",
+		"foo--..all.bottle.tar.gz",
+		"..--1.0.all.bottle.tar.gz",
+		".--1.0.all.bottle.tar.gz",
+	} {
+		if _, err := parseBottleReference("https://example.com/"+ref, ""); err == nil {
+			t.Errorf("parseBottleReference(%q) succeeded", ref)
+		}
+	}
+
+	// Nor may a sidecar point the keg at the Cellar itself.
+	m := newBottleFileTestManager(t)
+	keg := filepath.Join(m.Paths.Cellar, "jq", "1.7.1")
+	if err := os.MkdirAll(keg, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	bottle := writeBottleFile(t, dir, "private.bottle.tar.gz", "foo", "1.0")
+	for _, version := range []string{"..", "."} {
+		sidecar := `{"foo":{"formula":{"name":"foo","pkg_version":"` + version + `"}}}`
+		if err := os.WriteFile(filepath.Join(dir, "private.bottle.json"), []byte(sidecar), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.InstallWithOptions(context.Background(), []string{bottle}, InstallOptions{IgnoreDependencies: true}); err == nil {
+			t.Errorf("installing a bottle with version %q succeeded", version)
+		}
+	}
+	if _, err := os.Stat(keg); err != nil {
+		t.Fatalf("expected the installed keg to survive: %v", err)
+	}
+}
+
+func TestInstallBottleFilePoursAndLinks(t *testing.T) {
+	m := newBottleFileTestManager(t)
+	dir := t.TempDir()
+	bottle := writeBottleFile(t, dir, "hello--2.12.arm64_sonoma.bottle.tar.gz", "hello", "2.12")
+
+	err := m.InstallWithOptions(context.Background(), []string{bottle}, InstallOptions{IgnoreDependencies: true, BottleSHA256: "00"})
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+
+	data, err := os.ReadFile(bottle)
+	if err != nil {
+		t.Fatalf("read bottle: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	if err := m.InstallWithOptions(context.Background(), []string{bottle}, InstallOptions{IgnoreDependencies: true, BottleSHA256: hex.EncodeToString(sum[:])}); err != nil {
+		t.Fatalf("install bottle file: %v", err)
+	}
+	kegDir := filepath.Join(m.Paths.Cellar, "hello", "2.12")
+	if _, ok := m.readKegManifest(kegDir); !ok {
+		t.Fatal("expected keg manifest")
+	}
+	if !m.installedOnRequest("hello") {
+		t.Fatal("expected bottle install to be marked on request")
+	}
+	if _, err := os.Readlink(filepath.Join(m.Paths.Bin, "hello")); err != nil {
+		t.Fatalf("expected hello linked into bin: %v", err)
+	}
+	entries, _ := os.ReadDir(m.Paths.Cellar)
+	for _, entry := range entries {
+		if entry.Name() != "hello" {
+			t.Fatalf("unexpected leftover in Cellar: %s", entry.Name())
+		}
+	}
+}
+
+func TestInstallBottleFileUsesSidecarAndArchiveLayout(t *testing.T) {
+	m := newBottleFileTestManager(t)
+	dir := t.TempDir()
+	bottle := writeBottleFile(t, dir, "private.bottle.tar.gz", "secret-tool", "1.0_1")
+	data, err := os.ReadFile(bottle)
+	if err != nil {
+		t.Fatalf("read bottle: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	sidecar := `{"secret-tool":{"formula":{"name":"secret-tool","pkg_version":"1.0_1"},"bottle":{"tags":{"sonoma":{"sha256":"` + hex.EncodeToString(sum[:]) + `"}}}}}`
+	if err := os.WriteFile(filepath.Join(dir, "private.bottle.json"), []byte(sidecar), 0o644); err != nil {
+		t.Fatalf("write sidecar: %v", err)
+	}
+	b, err := parseBottleReference(bottle, "")
+	if err != nil {
+		t.Fatalf("parseBottleReference: %v", err)
+	}
+	if b.name != "secret-tool" || b.version != "1.0_1" || b.tag != "sonoma" || b.sha256 == "" {
+		t.Fatalf("sidecar not applied: %+v", b)
+	}
+	if err := os.Remove(filepath.Join(dir, "private.bottle.json")); err != nil {
+		t.Fatalf("remove sidecar: %v", err)
+	}
+
+	if err := m.InstallWithOptions(context.Background(), []string{"file://" + bottle}, InstallOptions{IgnoreDependencies: true}); err != nil {
+		t.Fatalf("install bottle inferred from archive: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(m.Paths.Cellar, "secret-tool", "1.0_1", "bin", "secret-tool")); err != nil {
+		t.Fatalf("expected keg from archive layout: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package native
+
+import (
+	"strings"
+	"testing"
+
+	"ub/internal/homebrewapi"
+)
+
+func bottleFormula(tags ...string) homebrewapi.Formula {
+	var f homebrewapi.Formula
+	f.Name = "jq"
+	f.Bottle.Stable.Files = map[string]homebrewapi.BottleFile{}
+	for _, tag := range tags {
+		f.Bottle.Stable.Files[tag] = homebrewapi.BottleFile{URL: "https://example.com/" + tag}
+	}
+	return f
+}
+
+func TestSelectBottleFollowsChain(t *testing.T) {
+	chain := []string{"arm64_sequoia", "arm64_sonoma", "arm64_ventura"}
+	_, tag, err := selectBottle(bottleFormula("arm64_ventura", "arm64_sonoma", "x86_64_linux"), chain, InstallOptions{})
+	if err != nil {
+		t.Fatalf("selectBottle: %v", err)
+	}
+	if tag != "arm64_sonoma" {
+		t.Fatalf("tag = %q, want arm64_sonoma", tag)
+	}
+
+	_, tag, err = selectBottle(bottleFormula("all", "x86_64_linux"), chain, InstallOptions{})
+	if err != nil || tag != "all" {
+		t.Fatalf("expected all bottle, got %q, %v", tag, err)
+	}
+}
+
+func TestSelectBottleRefusesIncompatibleTags(t *testing.T) {
+	chain := []string{"arm64_linux"}
+	f := bottleFormula("x86_64_linux", "sonoma")
+	if _, _, err := selectBottle(f, chain, InstallOptions{}); err == nil || !strings.Contains(err.Error(), "--force-bottle") {
+		t.Fatalf("expected incompatible bottle error, got %v", err)
+	}
+
+	_, tag, err := selectBottle(f, chain, InstallOptions{ForceBottle: true})
+	if err != nil {
+		t.Fatalf("selectBottle with force: %v", err)
+	}
+	if tag != "sonoma" {
+		t.Fatalf("tag = %q, want deterministic first tag sonoma", tag)
+	}
+}
+
+func TestSelectBottleExactTag(t *testing.T) {
+	chain := []string{"x86_64_linux"}
+	f := bottleFormula("x86_64_linux", "sonoma")
+	_, tag, err := selectBottle(f, chain, InstallOptions{BottleTag: "sonoma"})
+	if err != nil || tag != "sonoma" {
+		t.Fatalf("expected sonoma bottle, got %q, %v", tag, err)
+	}
+	if _, _, err := selectBottle(f, chain, InstallOptions{BottleTag: "ventura"}); err == nil {
+		t.Fatalf("expected missing exact tag to fail")
+	}
+}
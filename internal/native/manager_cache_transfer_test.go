@@ -0,0 +1,89 @@
+package native
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ub/internal/apitest"
+)
+
+func TestCacheExportSeedsAnotherMachine(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+	ctx := context.Background()
+
+	m := New(1)
+	if _, err := m.ExportCache(ctx, filepath.Join(t.TempDir(), "x"), []string{"hello"}); err == nil || !strings.Contains(err.Error(), "no cached download for hello and libgreet") {
+		t.Fatalf("expected an error for uncached packages, got %v", err)
+	}
+	if err := m.Install(ctx, []string{"hello", "greeter"}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	archive := filepath.Join(t.TempDir(), "seed.tar.gz")
+	summary, err := m.ExportCache(ctx, archive, []string{"hello", "greeter"})
+	if err != nil {
+		t.Fatalf("ExportCache: %v", err)
+	}
+	if len(summary.Entries) != 3 {
+		t.Fatalf("exported %+v, want hello, libgreet and greeter", summary.Entries)
+	}
+	for _, entry := range summary.Entries {
+		if !entry.Verified || len(entry.SHA256) != 64 || entry.Provenance.DownloadedAt.IsZero() {
+			t.Fatalf("entry %+v", entry)
+		}
+	}
+
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	other := New(1)
+	imported, err := other.ImportCache(ctx, archive)
+	if err != nil || len(imported.Entries) != 3 {
+		t.Fatalf("ImportCache = %+v, %v", imported, err)
+	}
+	if err := other.Install(ctx, []string{"hello", "greeter"}); err != nil {
+		t.Fatalf("install from imported cache: %v", err)
+	}
+	for _, p := range []string{"/bottles/hello.tar.gz", "/bottles/libgreet.tar.gz"} {
+		if hits := server.Hits(p); hits != 1 {
+			t.Fatalf("%s downloaded %d times, want 1", p, hits)
+		}
+	}
+	if verify, err := other.VerifyDownloads(ctx); err != nil || verify.Verified != 3 {
+		t.Fatalf("VerifyDownloads = %+v, %v", verify, err)
+	}
+}
+
+func TestCacheImportRejectsTamperedFiles(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+	ctx := context.Background()
+
+	m := New(1)
+	if err := m.Install(ctx, []string{"libgreet"}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	dir := filepath.Join(t.TempDir(), "seed")
+	summary, err := m.ExportCache(ctx, dir, nil)
+	if err != nil || len(summary.Entries) != 1 {
+		t.Fatalf("ExportCache = %+v, %v", summary, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, summary.Entries[0].File), []byte("tampered"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	other := New(1)
+	if _, err := other.ImportCache(ctx, dir); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	if _, ok := other.Fetch.Lookup(summary.Entries[0].URL); ok {
+		t.Fatal("tampered download was cached")
+	}
+}
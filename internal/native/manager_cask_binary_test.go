@@ -0,0 +1,92 @@
+package native
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrepareCaskBinaryChmodsShebangScripts(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "tool")
+	if err := os.WriteFile(src, []byte("#!/bin/sh\necho hi\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	got, err := prepareCaskBinary(src, "tool", tmp, nil)
+	if err != nil {
+		t.Fatalf("prepareCaskBinary: %v", err)
+	}
+	if got != src {
+		t.Fatalf("link source = %q, want %q", got, src)
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if info.Mode()&0o111 == 0 {
+		t.Fatalf("mode = %v, want executable", info.Mode())
+	}
+}
+
+func TestPrepareCaskBinaryWrapsScriptsWithoutShebang(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "it's.sh")
+	if err := os.WriteFile(src, []byte("echo hi\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	got, err := prepareCaskBinary(src, "tool", tmp, nil)
+	if err != nil {
+		t.Fatalf("prepareCaskBinary: %v", err)
+	}
+	if got != filepath.Join(tmp, ".ub-wrappers", "tool") {
+		t.Fatalf("link source = %q, want wrapper", got)
+	}
+	data, err := os.ReadFile(got)
+	if err != nil {
+		t.Fatalf("read wrapper: %v", err)
+	}
+	want := "exec /bin/sh " + shellQuote(src) + ` "$@"`
+	if !strings.Contains(string(data), want) {
+		t.Fatalf("wrapper = %q, want line %q", data, want)
+	}
+}
+
+func TestPrepareCaskBinaryWritesMissingShimscript(t *testing.T) {
+	tmp := t.TempDir()
+	app := filepath.Join(tmp, "Applications", "Foo.app")
+	exe := filepath.Join(app, "Contents", "MacOS", "foo")
+	if err := os.MkdirAll(filepath.Dir(exe), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(exe, []byte{0xcf, 0xfa, 0xed, 0xfe, 0}, 0o755); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	caskDir := filepath.Join(tmp, "Caskroom", "foo", "1.0")
+	manager := &Manager{Paths: Paths{Prefix: tmp, Caskroom: filepath.Join(tmp, "Caskroom"), Applications: filepath.Join(tmp, "Applications")}}
+	src := manager.expandCaskPath("$HOMEBREW_PREFIX/Caskroom/foo/1.0/foo.wrapper.sh", caskDir)
+	if src != filepath.Join(caskDir, "foo.wrapper.sh") {
+		t.Fatalf("expandCaskPath = %q", src)
+	}
+
+	got, err := prepareCaskBinary(src, "foo", caskDir, []string{app})
+	if err != nil {
+		t.Fatalf("prepareCaskBinary: %v", err)
+	}
+	if got != src {
+		t.Fatalf("link source = %q, want %q", got, src)
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatalf("read shim: %v", err)
+	}
+	if !strings.Contains(string(data), "exec "+shellQuote(exe)) {
+		t.Fatalf("shim = %q", data)
+	}
+
+	if got, err := prepareCaskBinary(filepath.Join(caskDir, "bar.wrapper.sh"), "bar", caskDir, []string{app}); err != nil || got != "" {
+		t.Fatalf("unknown shimscript = %q, %v; want skipped", got, err)
+	}
+}
@@ -0,0 +1,65 @@
+package native
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"ub/internal/apitest"
+	"ub/internal/homebrewapi"
+)
+
+func TestInstallFetchesCasksInParallel(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+
+	m := New(2)
+	if err := m.InstallWithOptions(context.Background(), []string{"greeter", "font-greeter"}, InstallOptions{}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	for _, token := range []string{"greeter", "font-greeter"} {
+		if _, err := m.readCaskReceipt(token); err != nil {
+			t.Fatalf("expected %s installed: %v", token, err)
+		}
+	}
+}
+
+func TestInstallCasksKeepsTheOnesThatFetched(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+	ctx := context.Background()
+
+	// One worker fetches in token order, so the broken cask fails last.
+	m := New(1)
+	m.DownloadWorkers = 1
+	greeter, err := m.API.CaskByName(ctx, "greeter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fonts, err := m.API.CaskByName(ctx, "font-greeter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := greeter
+	broken.Token = "zz-broken"
+	broken.SHA256 = strings.Repeat("0", 64)
+
+	installed, err := m.installCasks(ctx, []homebrewapi.Cask{broken, greeter, fonts}, false)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	if !reflect.DeepEqual(installed, []string{"greeter", "font-greeter"}) {
+		t.Fatalf("installed = %v", installed)
+	}
+	if _, err := os.Stat(filepath.Join(m.Paths.Caskroom, "zz-broken")); !os.IsNotExist(err) {
+		t.Fatalf("expected no Caskroom entry for the broken cask, got err=%v", err)
+	}
+}
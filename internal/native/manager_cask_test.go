@@ -1,10 +1,14 @@
 package native
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"ub/internal/homebrewapi"
 )
 
 func TestIsNotFoundError(t *testing.T) {
@@ -17,31 +21,13 @@ func TestIsNotFoundError(t *testing.T) {
 	}
 }
 
-func TestIsZipArchive(t *testing.T) {
-	tmp := t.TempDir()
-	zipPath := filepath.Join(tmp, "a.src")
-	if err := os.WriteFile(zipPath, []byte{'P', 'K', 0x03, 0x04, 0x00}, 0o644); err != nil {
-		t.Fatalf("write zip: %v", err)
-	}
-	tarPath := filepath.Join(tmp, "b.src")
-	if err := os.WriteFile(tarPath, []byte{0x1f, 0x8b, 0x08, 0x00}, 0o644); err != nil {
-		t.Fatalf("write tar: %v", err)
-	}
-
-	isZip, err := isZipArchive(zipPath)
-	if err != nil {
-		t.Fatalf("isZipArchive(zip): %v", err)
+func TestExtractArchiveRejectsUnknownFormats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "download")
+	if err := os.WriteFile(path, []byte("not an archive"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
 	}
-	if !isZip {
-		t.Fatal("expected zip header to be detected")
-	}
-
-	isZip, err = isZipArchive(tarPath)
-	if err != nil {
-		t.Fatalf("isZipArchive(tar): %v", err)
-	}
-	if isZip {
-		t.Fatal("expected non-zip header to be false")
+	if err := extractArchive(context.Background(), path, t.TempDir(), extractOptions{}); err == nil || !strings.Contains(err.Error(), "unrecognized archive format") {
+		t.Fatalf("expected unrecognized format error, got %v", err)
 	}
 }
 
@@ -74,3 +60,90 @@ func TestIsNotFoundErrorFalseOnOtherStatus(t *testing.T) {
 		t.Fatal("expected false for non-404 error")
 	}
 }
+
+func TestFindFileInTreePrefersShallowestAppBundle(t *testing.T) {
+	root := t.TempDir()
+	helper := filepath.Join(root, "a", "Outer.app", "Contents", "Frameworks", "Cursor.app")
+	main := filepath.Join(root, "b", "c", "Cursor.app")
+	for _, dir := range []string{helper, main} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	// A plain file with the bundle's name is not an app.
+	if err := os.WriteFile(filepath.Join(root, "a", "Cursor.app"), nil, 0o644); err != nil {
+		t.Fatalf("write decoy: %v", err)
+	}
+
+	found, err := findFileInTree(root, "Cursor.app")
+	if err != nil {
+		t.Fatalf("findFileInTree: %v", err)
+	}
+	if found != main {
+		t.Fatalf("found = %q, want %q", found, main)
+	}
+}
+
+func TestFindFileInTreeSurvivesSymlinkCycles(t *testing.T) {
+	root := t.TempDir()
+	loop := filepath.Join(root, "a", "b")
+	if err := os.MkdirAll(loop, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "a"), filepath.Join(loop, "again")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if err := os.Symlink("/", filepath.Join(root, "escape")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	if _, err := findFileInTree(root, "missing.app"); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+
+	linked := filepath.Join(t.TempDir(), "Cursor.app")
+	if err := os.MkdirAll(linked, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.Symlink(filepath.Dir(linked), filepath.Join(loop, "outside")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if found, err := findFileInTree(root, "Cursor.app"); err == nil {
+		t.Fatalf("followed a link out of the tree to %q", found)
+	}
+}
+
+func TestCaskAppDestinationStaysInApplications(t *testing.T) {
+	apps := filepath.Join(t.TempDir(), "Applications")
+	for _, tc := range []struct {
+		app  homebrewapi.CaskAppArtifact
+		want string
+	}{
+		{homebrewapi.CaskAppArtifact{Source: "dist/Tool.app"}, "Tool.app"},
+		{homebrewapi.CaskAppArtifact{Source: "Tool.app", Target: "Tools/Renamed.app"}, "Tools/Renamed.app"},
+		{homebrewapi.CaskAppArtifact{Source: "Tool.app", Target: "Tools/../Tool.app"}, "Tool.app"},
+	} {
+		got, err := caskAppDestination(apps, tc.app)
+		if err != nil || got != filepath.Join(apps, tc.want) {
+			t.Fatalf("caskAppDestination(%+v) = %q, %v; want %q", tc.app, got, err, tc.want)
+		}
+	}
+	for _, target := range []string{"/etc", "../Tool.app", "Tools/../../Tool.app", ".."} {
+		if got, err := caskAppDestination(apps, homebrewapi.CaskAppArtifact{Source: "Tool.app", Target: target}); err == nil {
+			t.Fatalf("caskAppDestination(target %q) = %q, want an error", target, got)
+		}
+	}
+}
+
+func TestCaskAppRemovalCandidatesIgnoreReceiptPathsOutsideApplications(t *testing.T) {
+	apps := filepath.Join(t.TempDir(), "Applications")
+	for _, candidate := range caskAppRemovalCandidates("/usr/local/lib", apps) {
+		if candidate == "/usr/local/lib" {
+			t.Fatalf("candidates %v include a receipt path outside %s", caskAppRemovalCandidates("/usr/local/lib", apps), apps)
+		}
+	}
+	inside := filepath.Join(apps, "Tool.app")
+	if got := caskAppRemovalCandidates(inside, apps); len(got) == 0 || got[0] != inside {
+		t.Fatalf("candidates = %v, want %s first", got, inside)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -46,7 +48,7 @@ func TestUninstallCaskLockedRemovesReceiptTargets(t *testing.T) {
 		t.Fatalf("write receipt: %v", err)
 	}
 
-	rec, err := manager.uninstallCaskLocked("cursor")
+	rec, err := manager.uninstallCaskLocked(context.Background(), "cursor", true)
 	if err != nil {
 		t.Fatalf("uninstallCaskLocked: %v", err)
 	}
@@ -149,7 +151,7 @@ func TestUninstallCaskLockedRemovesHomeApplicationsFallback(t *testing.T) {
 		t.Fatalf("write receipt: %v", err)
 	}
 
-	if _, err := manager.uninstallCaskLocked("cursor"); err != nil {
+	if _, err := manager.uninstallCaskLocked(context.Background(), "cursor", true); err != nil {
 		t.Fatalf("uninstallCaskLocked: %v", err)
 	}
 
@@ -157,3 +159,53 @@ func TestUninstallCaskLockedRemovesHomeApplicationsFallback(t *testing.T) {
 		t.Fatalf("expected app removed from home Applications, got err=%v", err)
 	}
 }
+
+func TestUninstallCaskLockedMovesAppToTrash(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skip("exercises the XDG trash layout")
+	}
+	tmp := t.TempDir()
+	t.Setenv("HOME", filepath.Join(tmp, "home"))
+	t.Setenv("XDG_DATA_HOME", filepath.Join(tmp, "data"))
+	paths := Paths{
+		Prefix:       filepath.Join(tmp, "ub"),
+		Caskroom:     filepath.Join(tmp, "ub", "Caskroom"),
+		Bin:          filepath.Join(tmp, "ub", "bin"),
+		Applications: filepath.Join(tmp, "ub", "Applications"),
+	}
+	manager := &Manager{Paths: paths}
+
+	versionDir := filepath.Join(paths.Caskroom, "cursor", "2.5.17")
+	appPath := filepath.Join(paths.Applications, "Cursor.app")
+	if err := os.MkdirAll(versionDir, 0o755); err != nil {
+		t.Fatalf("mkdir version dir: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(appPath, "Contents"), 0o755); err != nil {
+		t.Fatalf("mkdir app path: %v", err)
+	}
+	if err := writeCaskReceipt(versionDir, "cursor", "2.5.17", appPath, nil); err != nil {
+		t.Fatalf("write receipt: %v", err)
+	}
+
+	if _, err := manager.uninstallCaskLocked(context.Background(), "cursor", false); err != nil {
+		t.Fatalf("uninstallCaskLocked: %v", err)
+	}
+	if _, err := os.Stat(appPath); !os.IsNotExist(err) {
+		t.Fatalf("expected app moved away, got err=%v", err)
+	}
+	trash := filepath.Join(tmp, "data", "Trash")
+	if _, err := os.Stat(filepath.Join(trash, "files", "Cursor.app", "Contents")); err != nil {
+		t.Fatalf("expected app in trash: %v", err)
+	}
+	info, err := os.ReadFile(filepath.Join(trash, "info", "Cursor.app.trashinfo"))
+	if err != nil {
+		t.Fatalf("read trashinfo: %v", err)
+	}
+	if !strings.Contains(string(info), "Path="+appPath) {
+		t.Fatalf("trashinfo missing original path:\n%s", info)
+	}
+
+	if got := uniqueTrashName(filepath.Join(trash, "files"), "Cursor.app"); filepath.Base(got) != "Cursor 2.app" {
+		t.Fatalf("uniqueTrashName = %q, want Cursor 2.app", got)
+	}
+}
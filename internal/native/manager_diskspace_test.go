@@ -0,0 +1,107 @@
+package native
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ub/internal/apitest"
+)
+
+type instantClock struct{}
+
+func (instantClock) Now() time.Time { return time.Now() }
+
+func (instantClock) After(time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- time.Now()
+	return ch
+}
+
+func TestInstallPausesUntilSpaceIsFreed(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+	ctx := context.Background()
+
+	m := New(1)
+	if err := m.Install(ctx, []string{"libgreet"}); err != nil {
+		t.Fatalf("install libgreet: %v", err)
+	}
+	oldKeg := filepath.Join(m.Paths.Cellar, "libgreet", "0.9")
+	if err := os.MkdirAll(oldKeg, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	var checks atomic.Int32
+	m.FreeSpace = func(string) (int64, error) {
+		if checks.Add(1) <= 3 {
+			return 1 << 20, nil
+		}
+		return 1 << 30, nil
+	}
+	m.Clock = instantClock{}
+	var offers int
+	m.ConfirmCleanup = func() bool {
+		offers++
+		return true
+	}
+	if err := m.Install(ctx, []string{"hello"}); err != nil {
+		t.Fatalf("install hello: %v", err)
+	}
+	if offers != 1 {
+		t.Fatalf("cleanup offered %d times, want 1", offers)
+	}
+	if _, err := os.Stat(oldKeg); !os.IsNotExist(err) {
+		t.Fatalf("expected old keg removed, got err=%v", err)
+	}
+	if !m.isInstalled("libgreet", "1.0") || !m.isInstalled("hello", "2.12.2") {
+		t.Fatal("expected libgreet 1.0 kept and hello installed")
+	}
+}
+
+func TestInstallFailsWhenSpaceDoesNotRecover(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+
+	m := New(1)
+	m.FreeSpace = func(string) (int64, error) { return 1 << 20, nil }
+	m.SpaceWait = 0
+	err := m.Install(context.Background(), []string{"libgreet"})
+	if !errors.Is(err, ErrLowDiskSpace) {
+		t.Fatalf("expected ErrLowDiskSpace, got %v", err)
+	}
+	if m.isInstalled("libgreet", "1.0") {
+		t.Fatal("expected nothing extracted")
+	}
+}
+
+func TestRemoveOldKegsKeepsTheNewestVersion(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	m := New(1)
+	for _, version := range []string{"1.9", "1.10"} {
+		keg := filepath.Join(m.Paths.Cellar, "jq", version)
+		if err := os.MkdirAll(keg, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.writeKegManifest(keg, kegManifest{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, _, err := m.removeOldKegs(context.Background())
+	if err != nil || removed != 1 {
+		t.Fatalf("removeOldKegs = %d, %v", removed, err)
+	}
+	if _, err := os.Stat(filepath.Join(m.Paths.Cellar, "jq", "1.10")); err != nil {
+		t.Fatalf("expected 1.10 kept: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(m.Paths.Cellar, "jq", "1.9")); !os.IsNotExist(err) {
+		t.Fatalf("expected 1.9 removed, got %v", err)
+	}
+}
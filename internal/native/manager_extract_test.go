@@ -0,0 +1,256 @@
+package native
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type tarEntry struct {
+	hdr  tar.Header
+	body string
+}
+
+func writeTarGz(t *testing.T, entries ...tarEntry) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "archive.tar.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create archive: %v", err)
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		hdr := entry.hdr
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(entry.body))
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("write header %s: %v", hdr.Name, err)
+		}
+		if entry.body != "" {
+			if _, err := tw.Write([]byte(entry.body)); err != nil {
+				t.Fatalf("write body %s: %v", hdr.Name, err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("close gzip: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("close archive: %v", err)
+	}
+	return path
+}
+
+func TestExtractTarGzPreservesModesAndMtimes(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	archive := writeTarGz(t,
+		tarEntry{hdr: tar.Header{Name: "pkg/", Typeflag: tar.TypeDir, Mode: 0o750, ModTime: mtime}},
+		tarEntry{hdr: tar.Header{Name: "pkg/tool", Typeflag: tar.TypeReg, Mode: 0o4755, ModTime: mtime}, body: "#!/bin/sh\n"},
+		tarEntry{hdr: tar.Header{Name: "pkg/data", Typeflag: tar.TypeReg, Mode: 0o640, ModTime: mtime}, body: "data"},
+	)
+
+	dst := t.TempDir()
+	if _, err := extractTar(context.Background(), archive, dst, extractOptions{}); err != nil {
+		t.Fatalf("extractTarGz: %v", err)
+	}
+	tool, err := os.Stat(filepath.Join(dst, "pkg", "tool"))
+	if err != nil {
+		t.Fatalf("stat tool: %v", err)
+	}
+	if tool.Mode() != 0o755 {
+		t.Fatalf("tool mode = %v, want setuid stripped 0755", tool.Mode())
+	}
+	if !tool.ModTime().Equal(mtime) {
+		t.Fatalf("tool mtime = %v, want %v", tool.ModTime(), mtime)
+	}
+	data, err := os.Stat(filepath.Join(dst, "pkg", "data"))
+	if err != nil || data.Mode() != 0o640 {
+		t.Fatalf("data mode = %v, %v; want 0640", data.Mode(), err)
+	}
+	dir, err := os.Stat(filepath.Join(dst, "pkg"))
+	if err != nil {
+		t.Fatalf("stat dir: %v", err)
+	}
+	if dir.Mode().Perm() != 0o750 || !dir.ModTime().Equal(mtime) {
+		t.Fatalf("dir mode/mtime = %v %v, want 0750 %v", dir.Mode().Perm(), dir.ModTime(), mtime)
+	}
+
+	allowed := t.TempDir()
+	if _, err := extractTar(context.Background(), archive, allowed, extractOptions{allowSetuid: true}); err != nil {
+		t.Fatalf("extractTarGz allowing setuid: %v", err)
+	}
+	tool, err = os.Stat(filepath.Join(allowed, "pkg", "tool"))
+	if err != nil {
+		t.Fatalf("stat tool: %v", err)
+	}
+	if tool.Mode()&os.ModeSetuid == 0 {
+		t.Fatalf("tool mode = %v, want setuid kept", tool.Mode())
+	}
+}
+
+func TestExtractTarGzLongNamesAndHardLinks(t *testing.T) {
+	longDir := "pkg/" + strings.Repeat("nested-directory/", 8)
+	longName := longDir + "file-with-a-long-name.txt"
+	archive := writeTarGz(t,
+		tarEntry{hdr: tar.Header{Name: longName, Typeflag: tar.TypeReg, Mode: 0o644, Format: tar.FormatGNU}, body: "gnu"},
+		tarEntry{hdr: tar.Header{Name: longDir + "pax-" + strings.Repeat("x", 120), Typeflag: tar.TypeReg, Mode: 0o644, Format: tar.FormatPAX}, body: "pax"},
+		tarEntry{hdr: tar.Header{Name: "pkg/bin/hardlink", Typeflag: tar.TypeLink, Linkname: longName, Format: tar.FormatGNU}},
+	)
+
+	dst := t.TempDir()
+	if _, err := extractTar(context.Background(), archive, dst, extractOptions{}); err != nil {
+		t.Fatalf("extractTarGz: %v", err)
+	}
+	for path, want := range map[string]string{
+		longName: "gnu",
+		longDir + "pax-" + strings.Repeat("x", 120): "pax",
+		"pkg/bin/hardlink":                          "gnu",
+	} {
+		data, err := os.ReadFile(filepath.Join(dst, path))
+		if err != nil || string(data) != want {
+			t.Fatalf("%s = %q, %v; want %q", path, data, err, want)
+		}
+	}
+}
+
+func TestExtractTarGzRejectsUnsupportedEntries(t *testing.T) {
+	archive := writeTarGz(t, tarEntry{hdr: tar.Header{Name: "pkg/fifo", Typeflag: tar.TypeFifo, Mode: 0o644}})
+	if _, err := extractTar(context.Background(), archive, t.TempDir(), extractOptions{}); err == nil || !strings.Contains(err.Error(), "unsupported tar entry") {
+		t.Fatalf("expected unsupported entry error, got %v", err)
+	}
+
+	escaping := writeTarGz(t, tarEntry{hdr: tar.Header{Name: "pkg/link", Typeflag: tar.TypeLink, Linkname: "../outside"}})
+	if _, err := extractTar(context.Background(), escaping, t.TempDir(), extractOptions{}); err == nil {
+		t.Fatalf("expected escaping hard link to fail")
+	}
+}
+
+func TestExtractTarGzRefusesWritesThroughSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	archive := writeTarGz(t,
+		tarEntry{hdr: tar.Header{Name: "pkg/evil", Typeflag: tar.TypeSymlink, Linkname: outside}},
+		tarEntry{hdr: tar.Header{Name: "pkg/evil/pwned", Typeflag: tar.TypeReg, Mode: 0o644}, body: "x"},
+	)
+	if _, err := extractTar(context.Background(), archive, t.TempDir(), extractOptions{}); err == nil || !strings.Contains(err.Error(), "through a symlink") {
+		t.Fatalf("expected symlink escape error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "pwned")); !os.IsNotExist(err) {
+		t.Fatalf("file was written outside the destination: %v", err)
+	}
+
+	inside := writeTarGz(t,
+		tarEntry{hdr: tar.Header{Name: "pkg/real/", Typeflag: tar.TypeDir, Mode: 0o755}},
+		tarEntry{hdr: tar.Header{Name: "pkg/alias", Typeflag: tar.TypeSymlink, Linkname: "real"}},
+		tarEntry{hdr: tar.Header{Name: "pkg/alias/file", Typeflag: tar.TypeReg, Mode: 0o644}, body: "ok"},
+	)
+	dst := t.TempDir()
+	if _, err := extractTar(context.Background(), inside, dst, extractOptions{}); err != nil {
+		t.Fatalf("symlink inside destination should be allowed: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dst, "pkg", "real", "file")); err != nil || string(data) != "ok" {
+		t.Fatalf("file = %q, %v", data, err)
+	}
+}
+
+func TestExtractTarGzManifestMatchesWalk(t *testing.T) {
+	archive := writeTarGz(t,
+		tarEntry{hdr: tar.Header{Name: "jq/1.7/", Typeflag: tar.TypeDir, Mode: 0o755}},
+		tarEntry{hdr: tar.Header{Name: "jq/1.7/bin/jq", Typeflag: tar.TypeReg, Mode: 0o755}, body: "binary"},
+		tarEntry{hdr: tar.Header{Name: "jq/1.7/bin/jq-hard", Typeflag: tar.TypeLink, Linkname: "jq/1.7/bin/jq"}},
+		tarEntry{hdr: tar.Header{Name: "jq/1.7/bin/jq-sym", Typeflag: tar.TypeSymlink, Linkname: "jq"}},
+	)
+	dst := t.TempDir()
+	manifest, err := extractTar(context.Background(), archive, dst, extractOptions{})
+	if err != nil {
+		t.Fatalf("extractTarGz: %v", err)
+	}
+	files, size, err := dirStats(context.Background(), filepath.Join(dst, "jq", "1.7"))
+	if err != nil {
+		t.Fatalf("dirStats: %v", err)
+	}
+	if manifest.Files != files || manifest.Size != size {
+		t.Fatalf("manifest = %+v, walk = %d files %d bytes", manifest, files, size)
+	}
+
+	m := &Manager{Paths: Paths{Prefix: t.TempDir(), Cellar: dst}}
+	kegDir := filepath.Join(dst, "jq", "1.7")
+	if err := m.writeKegManifest(kegDir, kegManifest{Files: 42, Size: 4096}); err != nil {
+		t.Fatalf("writeKegManifest: %v", err)
+	}
+	if files, size, err := m.kegStats(context.Background(), kegDir); err != nil || files != 42 || size != 4096 {
+		t.Fatalf("kegStats = %d, %d, %v; want manifest values", files, size, err)
+	}
+}
+
+func TestExtractSourceHandlesCompressionFormats(t *testing.T) {
+	plain := strings.TrimSuffix(writeTarGz(t,
+		tarEntry{hdr: tar.Header{Name: "src-1.0/", Typeflag: tar.TypeDir, Mode: 0o755}},
+		tarEntry{hdr: tar.Header{Name: "src-1.0/configure", Typeflag: tar.TypeReg, Mode: 0o755}, body: "#!/bin/sh\n"},
+	), ".gz")
+	if out, err := exec.Command("gzip", "-dk", plain+".gz").CombinedOutput(); err != nil {
+		t.Fatalf("gunzip: %v: %s", err, out)
+	}
+	archives := map[string]string{"gzip": plain + ".gz", "tar": plain}
+	for tool, ext := range map[string]string{"bzip2": ".bz2", "xz": ".xz"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			continue
+		}
+		if out, err := exec.Command(tool, "-k", plain).CombinedOutput(); err != nil {
+			t.Fatalf("%s: %v: %s", tool, err, out)
+		}
+		archives[tool] = plain + ext
+	}
+	for format, archive := range archives {
+		dst := t.TempDir()
+		if err := ExtractSource(context.Background(), archive, dst); err != nil {
+			t.Fatalf("%s: ExtractSource: %v", format, err)
+		}
+		data, err := os.ReadFile(filepath.Join(dst, "src-1.0", "configure"))
+		if err != nil || string(data) != "#!/bin/sh\n" {
+			t.Fatalf("%s: configure = %q, %v", format, data, err)
+		}
+	}
+}
+
+func TestExtractTarGzKeepsDirectoryMetadataOffSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	if err := os.Chmod(outside, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	replaced := writeTarGz(t,
+		tarEntry{hdr: tar.Header{Name: "pkg/", Typeflag: tar.TypeDir, Mode: 0o777}},
+		tarEntry{hdr: tar.Header{Name: "pkg", Typeflag: tar.TypeSymlink, Linkname: outside}},
+	)
+	if _, err := extractTar(context.Background(), replaced, t.TempDir(), extractOptions{}); err == nil || !strings.Contains(err.Error(), "replaces a directory") {
+		t.Fatalf("expected directory replacement error, got %v", err)
+	}
+
+	// A directory entry naming a symlink made earlier must not chmod its
+	// target when the deferred metadata is applied.
+	dst := t.TempDir()
+	target := filepath.Join(dst, "real")
+	if err := os.Mkdir(target, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	planted := writeTarGz(t,
+		tarEntry{hdr: tar.Header{Name: "pkg", Typeflag: tar.TypeSymlink, Linkname: "real"}},
+		tarEntry{hdr: tar.Header{Name: "pkg/", Typeflag: tar.TypeDir, Mode: 0o700}},
+	)
+	if _, err := extractTar(context.Background(), planted, dst, extractOptions{}); err != nil {
+		t.Fatalf("extractTar: %v", err)
+	}
+	if info, err := os.Stat(target); err != nil || info.Mode().Perm() != 0o755 {
+		t.Fatalf("symlink target mode = %v, %v; want 0755 untouched", info.Mode().Perm(), err)
+	}
+}
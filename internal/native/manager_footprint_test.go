@@ -0,0 +1,64 @@
+package native
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"ub/internal/apitest"
+	"ub/internal/fetch"
+)
+
+func TestFootprintSizesMissingKegs(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+	ctx := context.Background()
+
+	m := New(1)
+	fp, err := m.Footprint(ctx, "hello")
+	if err != nil {
+		t.Fatalf("Footprint: %v", err)
+	}
+	if len(fp.Items) != 2 || fp.Items[0].Name != "hello" || fp.Items[1].Name != "libgreet" || len(fp.AlreadyInstalled) != 0 {
+		t.Fatalf("footprint = %+v", fp)
+	}
+	for _, item := range fp.Items {
+		// The fixture bottles are not in a registry, so installed sizes
+		// are estimated.
+		if item.Download == 0 || item.Installed != item.Download*installedSizeRatio || !item.Estimated {
+			t.Fatalf("item = %+v", item)
+		}
+	}
+	if fp.Download != fp.Items[0].Download+fp.Items[1].Download || !fp.Estimated {
+		t.Fatalf("totals = %+v", fp)
+	}
+	if hits := server.Hits("/bottles/hello.tar.gz"); hits != 0 {
+		t.Fatalf("sizing downloaded the bottle %d times", hits)
+	}
+
+	if err := m.Install(ctx, []string{"libgreet"}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	fp, err = m.Footprint(ctx, "hello")
+	if err != nil {
+		t.Fatalf("Footprint: %v", err)
+	}
+	if len(fp.Items) != 1 || fp.Items[0].Name != "hello" || !reflect.DeepEqual(fp.AlreadyInstalled, []string{"libgreet"}) {
+		t.Fatalf("footprint after installing libgreet = %+v", fp)
+	}
+}
+
+func TestInstalledSizeFromIndex(t *testing.T) {
+	entries := []fetch.OCIIndexEntry{
+		{Annotations: map[string]string{"sh.brew.bottle.digest": "aa", "sh.brew.bottle.installed_size": "100"}},
+		{Annotations: map[string]string{"sh.brew.bottle.digest": "bb", "sh.brew.bottle.installed_size": "200"}},
+	}
+	if size, ok := installedSizeFromIndex(entries, "BB"); !ok || size != 200 {
+		t.Fatalf("installedSizeFromIndex(bb) = %d, %v", size, ok)
+	}
+	if _, ok := installedSizeFromIndex(entries, "cc"); ok {
+		t.Fatal("expected no size for an unknown digest")
+	}
+}
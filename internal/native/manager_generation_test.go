@@ -0,0 +1,61 @@
+package native
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerationsCommitAndRollback(t *testing.T) {
+	m := newSnapshotTestManager(t)
+	writeKeg(t, m, "jq", "1.6")
+
+	if err := m.BeginGeneration(context.Background(), "install wget"); err != nil {
+		t.Fatalf("BeginGeneration: %v", err)
+	}
+	writeKeg(t, m, "wget", "1.24")
+	if _, err := os.Lstat(filepath.Join(m.Paths.Bin, "wget")); !os.IsNotExist(err) {
+		t.Fatalf("live bin changed before commit: %v", err)
+	}
+	if err := m.CommitGeneration(true); err != nil {
+		t.Fatalf("CommitGeneration: %v", err)
+	}
+
+	if info, err := os.Lstat(m.Paths.Bin); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("expected %s to become a symlink: %v", m.Paths.Bin, err)
+	}
+	for _, name := range []string{"jq", "wget"} {
+		if _, err := os.Stat(filepath.Join(m.Paths.Bin, name)); err != nil {
+			t.Fatalf("expected %s linked in generation 2: %v", name, err)
+		}
+	}
+	gens, err := m.Generations()
+	if err != nil || len(gens) != 2 || !gens[1].Current || gens[1].Command != "install wget" {
+		t.Fatalf("Generations = %+v, %v", gens, err)
+	}
+
+	if err := m.BeginGeneration(context.Background(), "uninstall jq"); err != nil {
+		t.Fatalf("BeginGeneration: %v", err)
+	}
+	if err := m.CommitGeneration(false); err != nil {
+		t.Fatalf("discard generation: %v", err)
+	}
+	if gens, _ := m.Generations(); len(gens) != 2 {
+		t.Fatalf("discarded generation should be removed, got %+v", gens)
+	}
+
+	gen, err := m.RollbackGeneration(0)
+	if err != nil || gen.Number != 1 {
+		t.Fatalf("RollbackGeneration = %+v, %v", gen, err)
+	}
+	if _, err := os.Lstat(filepath.Join(m.Paths.Bin, "wget")); !os.IsNotExist(err) {
+		t.Fatalf("wget should be gone after rollback: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(m.Paths.Bin, "jq")); err != nil {
+		t.Fatalf("jq should remain after rollback: %v", err)
+	}
+	if _, err := m.RollbackGeneration(9); err == nil {
+		t.Fatalf("expected unknown generation to fail")
+	}
+}
@@ -0,0 +1,74 @@
+package native
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGroupMembersFromConfigAndTaps(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	m := New(1)
+	m.Groups = map[string][]string{"media": {"ffmpeg", "vlc"}}
+	for tap, members := range map[string]string{"acme/homebrew-tools": `["jq", "wget"]`, "other/homebrew-tools": `["curl"]`} {
+		dir := filepath.Join(m.Paths.Repo, "Library", "Taps", filepath.FromSlash(tap), "groups")
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "cli.json"), []byte(members), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(m.Paths.Repo, "Library", "Taps", "acme", "homebrew-tools", "groups", "net.json"), []byte(`["curl"]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for group, want := range map[string][]string{
+		"media":           {"ffmpeg", "vlc"},
+		"net":             {"curl"},
+		"acme/tools/cli":  {"jq", "wget"},
+		"other/tools/cli": {"curl"},
+	} {
+		if got, err := m.GroupMembers(group); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("GroupMembers(%q) = %q, %v; want %q", group, got, err, want)
+		}
+	}
+	if _, err := m.GroupMembers("cli"); err == nil {
+		t.Error("expected a group two taps define to need qualifying")
+	}
+	if _, err := m.GroupMembers("games"); !errors.Is(err, ErrUnknownGroup) {
+		t.Errorf("GroupMembers(games) = %v, want ErrUnknownGroup", err)
+	}
+	if _, err := m.GroupMembers("../etc"); err == nil || errors.Is(err, ErrUnknownGroup) {
+		t.Errorf("GroupMembers(../etc) = %v, want an invalid name", err)
+	}
+}
+
+func TestGroupRemovalKeepsSharedMembers(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	m := New(1)
+	for _, keg := range []string{"ffmpeg/7.0", "x265/4.0"} {
+		if err := os.MkdirAll(filepath.Join(m.Paths.Cellar, filepath.FromSlash(keg)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.RecordGroup("media", []string{"x265", "ffmpeg", "vlc"}); err != nil {
+		t.Fatalf("RecordGroup: %v", err)
+	}
+	if err := m.RecordGroup("codecs", []string{"x265"}); err != nil {
+		t.Fatalf("RecordGroup: %v", err)
+	}
+	remove, shared, err := m.GroupRemoval("media")
+	if err != nil || !reflect.DeepEqual(remove, []string{"ffmpeg"}) || !reflect.DeepEqual(shared, []string{"x265"}) {
+		t.Fatalf("GroupRemoval = %q, %q, %v", remove, shared, err)
+	}
+	if err := m.ForgetGroup("media"); err != nil {
+		t.Fatalf("ForgetGroup: %v", err)
+	}
+	groups, err := m.InstalledGroups()
+	if err != nil || len(groups) != 1 || groups[0].Name != "codecs" {
+		t.Fatalf("InstalledGroups = %+v, %v", groups, err)
+	}
+}
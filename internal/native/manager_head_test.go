@@ -0,0 +1,104 @@
+package native
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ub/internal/fetch"
+	"ub/internal/homebrewapi"
+)
+
+func TestHeadBuildStepsDetection(t *testing.T) {
+	cases := map[string]string{
+		"meson.build":    "meson setup",
+		"CMakeLists.txt": "cmake -S .",
+		"configure":      "./configure",
+		"configure.ac":   "autoreconf -fi",
+		"Makefile":       `make PREFIX="$PREFIX"`,
+	}
+	for file, want := range cases {
+		src := t.TempDir()
+		if err := os.WriteFile(filepath.Join(src, file), nil, 0o644); err != nil {
+			t.Fatalf("write %s: %v", file, err)
+		}
+		steps, err := headBuildSteps(src, "tool", "")
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		if !strings.HasPrefix(steps[0], want) {
+			t.Fatalf("%s: first step = %q, want prefix %q", file, steps[0], want)
+		}
+	}
+
+	if _, err := headBuildSteps(t.TempDir(), "tool", ""); err == nil {
+		t.Fatal("expected an error when no build system is present")
+	}
+
+	tap := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tap, "tool.json"), []byte(`{"name":"tool","version":"HEAD","build":{"steps":["./build.sh"]}}`), 0o644); err != nil {
+		t.Fatalf("write tap formula: %v", err)
+	}
+	steps, err := headBuildSteps(t.TempDir(), "tool", tap)
+	if err != nil || len(steps) != 1 || steps[0] != "./build.sh" {
+		t.Fatalf("tap steps = %q, %v", steps, err)
+	}
+}
+
+func TestBuildHeadInstallsShaKeg(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	if _, err := exec.LookPath("make"); err != nil {
+		t.Skip("make not available")
+	}
+	repo := t.TempDir()
+	makefile := "install:\n\tmkdir -p $(PREFIX)/bin\n\tprintf '#!/bin/sh\\necho head\\n' > $(PREFIX)/bin/tool\n\tchmod +x $(PREFIX)/bin/tool\n"
+	if err := os.WriteFile(filepath.Join(repo, "Makefile"), []byte(makefile), 0o644); err != nil {
+		t.Fatalf("write Makefile: %v", err)
+	}
+	for _, args := range [][]string{
+		{"init", "--quiet", "--initial-branch", "main"},
+		{"add", "Makefile"},
+		{"-c", "user.name=ub", "-c", "user.email=ub@example.com", "commit", "--quiet", "-m", "init"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	rev, err := exec.Command("git", "-C", repo, "rev-parse", "--short=7", "HEAD").Output()
+	if err != nil {
+		t.Fatalf("rev-parse: %v", err)
+	}
+
+	m := newBottleFileTestManager(t)
+	m.Fetch = fetch.NewCache(filepath.Join(m.Paths.Cache, "bottles"))
+	if err := m.EnsureLayout(); err != nil {
+		t.Fatalf("EnsureLayout: %v", err)
+	}
+	f := homebrewapi.Formula{Name: "tool"}
+	f.URLs.Head.URL = "file://" + repo
+	f.URLs.Head.Branch = "main"
+	if err := m.buildHead(context.Background(), f, "", newInstallReporter(m.Paths, nil, nil)); err != nil {
+		t.Fatalf("buildHead: %v", err)
+	}
+
+	version := headKegPrefix + strings.TrimSpace(string(rev))
+	if _, err := os.Stat(filepath.Join(m.Paths.Cellar, "tool", version, "bin", "tool")); err != nil {
+		t.Fatalf("expected %s keg: %v", version, err)
+	}
+	if _, ok := m.readKegManifest(filepath.Join(m.Paths.Cellar, "tool", version)); !ok {
+		t.Fatal("expected a keg manifest")
+	}
+	if _, err := os.Lstat(filepath.Join(m.Paths.Bin, "tool")); err != nil {
+		t.Fatalf("expected tool linked: %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(m.Paths.Cache, "head")); len(entries) != 0 {
+		t.Fatalf("expected checkout cleaned up, found %d entries", len(entries))
+	}
+}
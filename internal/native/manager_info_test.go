@@ -0,0 +1,108 @@
+package native
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ub/internal/homebrewapi"
+)
+
+func TestInfoJSONMatchesBrewV2Shape(t *testing.T) {
+	mirror := t.TempDir()
+	files := map[string]string{
+		"formula/jq.json":  `{"name":"jq","full_name":"jq","tap":"homebrew/core","versions":{"stable":"1.7.1","head":"HEAD","bottle":true},"revision":0,"analytics":{"install":{"30d":{"jq":12345}}}}`,
+		"cask/cursor.json": `{"token":"cursor","full_token":"cursor","version":"2.5.17","auto_updates":false}`,
+		"formula.jws.json": `{}`,
+		"cask.jws.json":    `{}`,
+	}
+	for rel, body := range files {
+		path := filepath.Join(mirror, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatalf("write %s: %v", rel, err)
+		}
+	}
+	t.Setenv("UB_API_FIXTURES", "")
+	t.Setenv("UB_API_DOMAIN", "file://"+filepath.ToSlash(mirror))
+
+	tmp := t.TempDir()
+	manager := &Manager{
+		Paths: Paths{Cellar: filepath.Join(tmp, "Cellar"), Caskroom: filepath.Join(tmp, "Caskroom")},
+		API:   homebrewapi.New(filepath.Join(tmp, "cache"), filepath.Join(tmp, "repo")),
+	}
+	keg := filepath.Join(manager.Paths.Cellar, "jq", "1.6")
+	if err := os.MkdirAll(keg, 0o755); err != nil {
+		t.Fatalf("mkdir keg: %v", err)
+	}
+	if err := writeFormulaReceipt(keg, true); err != nil {
+		t.Fatalf("write receipt: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(manager.Paths.Caskroom, "cursor", "2.5.17"), 0o755); err != nil {
+		t.Fatalf("mkdir cask: %v", err)
+	}
+
+	info, err := manager.InfoJSON(context.Background(), []string{"jq", "cursor"}, InfoOptions{})
+	if err != nil {
+		t.Fatalf("InfoJSON: %v", err)
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	got := string(data)
+	for _, want := range []string{
+		`"formulae":[{`,
+		`"casks":[{`,
+		`"tap":"homebrew/core"`,
+		`"revision":0`,
+		`"installed":[{`,
+		`"installed_on_request":true`,
+		`"linked_keg":"1.6"`,
+		`"outdated":true`,
+		`"pinned":false`,
+		`"token":"cursor"`,
+		`"installed":"2.5.17"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("info JSON missing %s:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, `"analytics"`) {
+		t.Errorf("analytics should be left out without --analytics:\n%s", got)
+	}
+
+	info, err = manager.InfoJSON(context.Background(), []string{"jq"}, InfoOptions{Formula: true, Analytics: true})
+	if err != nil {
+		t.Fatalf("InfoJSON with analytics: %v", err)
+	}
+	if _, ok := info.Formulae[0]["analytics"]; !ok || len(info.Casks) != 0 {
+		t.Fatalf("unexpected analytics info: %+v", info)
+	}
+	if _, err := manager.InfoJSON(context.Background(), []string{"cursor"}, InfoOptions{Formula: true}); err == nil {
+		t.Fatal("expected --formula lookup of a cask to fail")
+	}
+}
+
+func TestFormulaInfoLinksTheNewestKeg(t *testing.T) {
+	tmp := t.TempDir()
+	manager := &Manager{Paths: Paths{Cellar: filepath.Join(tmp, "Cellar")}}
+	for _, version := range []string{"1.10", "1.9"} {
+		if err := os.MkdirAll(filepath.Join(manager.Paths.Cellar, "jq", version), 0o755); err != nil {
+			t.Fatalf("mkdir keg: %v", err)
+		}
+	}
+	doc := manager.formulaInfo("jq", map[string]any{"versions": map[string]any{"stable": "1.10"}}, false)
+	if doc["linked_keg"] != "1.10" || doc["outdated"] != false {
+		t.Fatalf("linked_keg = %v, outdated = %v", doc["linked_keg"], doc["outdated"])
+	}
+	installed := doc["installed"].([]map[string]any)
+	if len(installed) != 2 || installed[0]["version"] != "1.9" || installed[1]["version"] != "1.10" {
+		t.Fatalf("installed = %v", installed)
+	}
+}
@@ -0,0 +1,56 @@
+package native
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"ub/internal/apitest"
+)
+
+// fullDiskFS accepts file creation but fails every write, like a full disk.
+type fullDiskFS struct{ osFS }
+
+type fullDiskFile struct{ io.Closer }
+
+func (fullDiskFile) Write([]byte) (int, error) { return 0, syscall.ENOSPC }
+
+func (f fullDiskFS) OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return fullDiskFile{file}, nil
+}
+
+func TestInstallSurfacesDiskFullAndCleansUp(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+
+	m := New(1)
+	m.FS = fullDiskFS{}
+	err := m.Install(context.Background(), []string{"libgreet"})
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expected ENOSPC, got %v", err)
+	}
+	kegDir := filepath.Join(m.Paths.Cellar, "libgreet", "1.0")
+	if _, err := os.Stat(kegDir); !os.IsNotExist(err) {
+		t.Fatalf("expected partial keg removed, got err=%v", err)
+	}
+
+	m.FS = nil
+	if err := m.Install(context.Background(), []string{"libgreet"}); err != nil {
+		t.Fatalf("retry install: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(kegDir, "lib", "libgreet.txt")); err != nil {
+		t.Fatalf("expected keg after retry: %v", err)
+	}
+	if hits := server.Hits("/bottles/libgreet.tar.gz"); hits != 1 {
+		t.Fatalf("bottle downloaded %d times, want 1 (retry should use the cache)", hits)
+	}
+}
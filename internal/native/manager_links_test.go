@@ -0,0 +1,154 @@
+package native
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ub/internal/apitest"
+)
+
+func TestInterruptedLinkingIsFinished(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+	ctx := context.Background()
+
+	m := New(1)
+	if err := m.Install(ctx, []string{"hello"}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	if report, err := m.CheckLinks(ctx); err != nil || report.Problems() != 0 {
+		t.Fatalf("CheckLinks after install = %+v, %v", report, err)
+	}
+	version, err := m.latestInstalledVersion("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	links, err := planLinks(filepath.Join(m.Paths.Cellar, "hello", version), m.Paths.Bin, "bin")
+	if err != nil || len(links) == 0 {
+		t.Fatalf("planLinks = %v, %v", links, err)
+	}
+
+	// A crash after the journal was written and before the links were made.
+	journal := filepath.Join(m.linkJournalDir(), "hello.json")
+	if err := writeLinkJournal(journal, linkJournal{Formula: "hello", Version: version, Links: links}); err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range links {
+		if err := os.Remove(link.Path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := m.CheckLinks(ctx)
+	if err != nil || len(report.Pending) != 1 || len(report.Unlinked) != len(links) {
+		t.Fatalf("CheckLinks = %+v, %v", report, err)
+	}
+
+	// The next link transaction replays the journal first.
+	if _, err := m.linkFormula("libgreet", "1.0"); err != nil {
+		t.Fatalf("linkFormula: %v", err)
+	}
+	for _, link := range links {
+		if target, err := os.Readlink(link.Path); err != nil || target != link.Target {
+			t.Fatalf("%s -> %q, %v; want %s", link.Path, target, err, link.Target)
+		}
+	}
+	if _, err := os.Stat(journal); !os.IsNotExist(err) {
+		t.Fatalf("journal left behind: %v", err)
+	}
+}
+
+func TestRepairLinks(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+	ctx := context.Background()
+
+	m := New(1)
+	if err := m.Install(ctx, []string{"hello"}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	version, err := m.latestInstalledVersion("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	links, err := planLinks(filepath.Join(m.Paths.Cellar, "hello", version), m.Paths.Bin, "bin")
+	if err != nil || len(links) == 0 {
+		t.Fatalf("planLinks = %v, %v", links, err)
+	}
+	if err := os.Remove(links[0].Path); err != nil {
+		t.Fatal(err)
+	}
+	broken := filepath.Join(m.Paths.Bin, "gone")
+	if err := os.Symlink(filepath.Join(m.Paths.Cellar, "gone", "1.0", "bin", "gone"), broken); err != nil {
+		t.Fatal(err)
+	}
+	report, err := m.CheckLinks(ctx)
+	if err != nil || len(report.Broken) != 1 || len(report.Unlinked) != 1 {
+		t.Fatalf("CheckLinks = %+v, %v", report, err)
+	}
+
+	report, err = m.RepairLinks(ctx)
+	if err != nil || report.Problems() != 0 {
+		t.Fatalf("RepairLinks = %+v, %v", report, err)
+	}
+	if target, err := os.Readlink(links[0].Path); err != nil || target != links[0].Target {
+		t.Fatalf("%s -> %q, %v", links[0].Path, target, err)
+	}
+	if _, err := os.Lstat(broken); !os.IsNotExist(err) {
+		t.Fatalf("broken link not removed: %v", err)
+	}
+}
+
+func TestLinkConflictPolicies(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+	ctx := context.Background()
+
+	m := New(1)
+	if err := os.MkdirAll(m.Paths.Bin, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(m.Paths.Bin, "hello")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho mine\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	var conflict *LinkConflictError
+	if err := m.Install(ctx, []string{"hello"}); !errors.As(err, &conflict) || len(conflict.Paths) != 1 || conflict.Paths[0] != script {
+		t.Fatalf("expected a conflict on %s, got %v", script, err)
+	}
+	if data, err := os.ReadFile(script); err != nil || string(data) != "#!/bin/sh\necho mine\n" {
+		t.Fatalf("user script changed: %q, %v", data, err)
+	}
+
+	m.LinkConflicts = LinkConflictSkip
+	if err := m.Install(ctx, []string{"hello"}); err != nil {
+		t.Fatalf("install with skip: %v", err)
+	}
+	if info, err := os.Lstat(script); err != nil || info.Mode()&os.ModeSymlink != 0 {
+		t.Fatalf("skip replaced the user script: %v", err)
+	}
+
+	m.LinkConflicts = LinkConflictOverwrite
+	if _, err := m.linkFormula("hello", "2.12.2"); err != nil {
+		t.Fatalf("linkFormula with overwrite: %v", err)
+	}
+	if target, err := os.Readlink(script); err != nil || !strings.HasPrefix(target, m.Paths.Cellar) {
+		t.Fatalf("%s -> %q, %v", script, target, err)
+	}
+	backups, err := filepath.Glob(filepath.Join(m.Paths.Prefix, "var", "ub", "link-backups", "*", "bin", "hello"))
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("backups = %v, %v", backups, err)
+	}
+	if data, err := os.ReadFile(backups[0]); err != nil || string(data) != "#!/bin/sh\necho mine\n" {
+		t.Fatalf("backup = %q, %v", data, err)
+	}
+}
@@ -1,6 +1,7 @@
 package native
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"testing"
@@ -67,15 +68,15 @@ func TestDirStats(t *testing.T) {
 		t.Fatalf("write b: %v", err)
 	}
 
-	files, size, err := dirStats(tmpDir)
+	files, size, err := dirStats(context.Background(), tmpDir)
 	if err != nil {
-		t.Fatalf("dirStats() error: %v", err)
+		t.Fatalf("dirStats(context.Background(), ) error: %v", err)
 	}
 	if files != 2 {
-		t.Fatalf("dirStats() files = %d, want 2", files)
+		t.Fatalf("dirStats(context.Background(), ) files = %d, want 2", files)
 	}
 	if size != int64(len("hello")+len("world!")) {
-		t.Fatalf("dirStats() size = %d, want %d", size, len("hello")+len("world!"))
+		t.Fatalf("dirStats(context.Background(), ) size = %d, want %d", size, len("hello")+len("world!"))
 	}
 }
 
@@ -124,14 +125,14 @@ func TestRemoveTreeWithProgress(t *testing.T) {
 	lastRemoved := -1
 	lastTotal := -1
 	lastDone := false
-	err := removeTreeWithProgress(root, func(removed, total int, done bool) {
+	err := removeTreeWithProgress(context.Background(), root, func(removed, total int, done bool) {
 		callbackCount++
 		lastRemoved = removed
 		lastTotal = total
 		lastDone = done
 	})
 	if err != nil {
-		t.Fatalf("removeTreeWithProgress() error: %v", err)
+		t.Fatalf("removeTreeWithProgress(context.Background(), ) error: %v", err)
 	}
 	if callbackCount == 0 {
 		t.Fatal("expected progress callback")
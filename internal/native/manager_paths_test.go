@@ -0,0 +1,133 @@
+package native
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestResolvePathsOverrides(t *testing.T) {
+	base := t.TempDir()
+	scratch := t.TempDir()
+	t.Setenv("UB_BASE_DIR", base)
+	for _, key := range []string{"UB_PREFIX", "UB_CELLAR", "UB_CASKROOM", "UB_CACHE_DIR", "UB_REPOSITORY"} {
+		t.Setenv(key, "")
+	}
+
+	paths := ResolvePaths(PathOverrides{Prefix: filepath.Join(base, "ssd"), Cache: filepath.Join(scratch, "config-cache")})
+	if paths.Cellar != filepath.Join(base, "ssd", "Cellar") || paths.Bin != filepath.Join(base, "ssd", "bin") {
+		t.Fatalf("Cellar and bin should follow the prefix: %+v", paths)
+	}
+	if paths.Cache != filepath.Join(scratch, "config-cache") || paths.Repo != filepath.Join(base, "unbrew") {
+		t.Fatalf("unexpected cache or repository: %+v", paths)
+	}
+
+	t.Setenv("UB_CACHE_DIR", filepath.Join(scratch, "env-cache"))
+	t.Setenv("UB_CASKROOM", filepath.Join(scratch, "Caskroom"))
+	paths = ResolvePaths(PathOverrides{Cache: filepath.Join(scratch, "config-cache")})
+	if paths.Cache != filepath.Join(scratch, "env-cache") {
+		t.Fatalf("UB_CACHE_DIR should win over the config file, got %s", paths.Cache)
+	}
+	if paths.Prefix != filepath.Join(base, "ub") || paths.Caskroom != filepath.Join(scratch, "Caskroom") || paths.Cellar != filepath.Join(base, "ub", "Cellar") {
+		t.Fatalf("unexpected layout: %+v", paths)
+	}
+}
+
+func TestMigrateCacheMovesLegacyCache(t *testing.T) {
+	tmp := t.TempDir()
+	m := &Manager{Paths: Paths{Prefix: filepath.Join(tmp, "ub"), Cache: filepath.Join(tmp, "xdg", "ub")}}
+	legacyFile := filepath.Join(tmp, "ub", "cache", "bottles", "jq.tar.gz")
+	if err := os.MkdirAll(filepath.Dir(legacyFile), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(legacyFile, []byte("bottle"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	from, err := m.MigrateCache()
+	if err != nil || from != filepath.Join(tmp, "ub", "cache") {
+		t.Fatalf("MigrateCache() = %q, %v", from, err)
+	}
+	if _, err := os.Stat(filepath.Join(m.Paths.Cache, "bottles", "jq.tar.gz")); err != nil {
+		t.Fatalf("cache was not moved: %v", err)
+	}
+	if from, err := m.MigrateCache(); from != "" || err != nil {
+		t.Fatalf("second MigrateCache() = %q, %v; want a no-op", from, err)
+	}
+}
+
+// crossDeviceFS fails to rename directories, as when the cache moves to
+// another filesystem.
+type crossDeviceFS struct{ osFS }
+
+func (f crossDeviceFS) Rename(oldpath, newpath string) error {
+	if info, err := os.Stat(oldpath); err == nil && info.IsDir() {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	return f.osFS.Rename(oldpath, newpath)
+}
+
+// fullCrossDeviceFS is a crossDeviceFS whose disk is full.
+type fullCrossDeviceFS struct{ crossDeviceFS }
+
+func (fullCrossDeviceFS) OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error) {
+	return fullDiskFS{}.OpenFile(name, flag, perm)
+}
+
+func TestMigrateCacheCopiesAcrossFilesystems(t *testing.T) {
+	tmp := t.TempDir()
+	legacy := filepath.Join(tmp, "ub", "cache")
+	files := map[string]string{"checksums.json": `{"jq":"abc"}`, "bottles/jq.tar.gz": "bottle"}
+	writeLegacy := func() {
+		t.Helper()
+		for name, body := range files {
+			path := filepath.Join(legacy, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	writeLegacy()
+
+	m := &Manager{Paths: Paths{Prefix: filepath.Join(tmp, "ub"), Cache: filepath.Join(tmp, "scratch", "ub")}, FS: crossDeviceFS{}}
+	if from, err := m.MigrateCache(); err != nil || from != legacy {
+		t.Fatalf("MigrateCache() = %q, %v", from, err)
+	}
+	for name, body := range files {
+		if data, err := os.ReadFile(filepath.Join(m.Paths.Cache, filepath.FromSlash(name))); err != nil || string(data) != body {
+			t.Fatalf("copied %s = %q, %v", name, data, err)
+		}
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Fatalf("expected the old cache removed after copying, got %v", err)
+	}
+
+	// A copy that fails part way leaves the old cache alone.
+	writeLegacy()
+	m.Paths.Cache = filepath.Join(tmp, "full", "ub")
+	m.FS = fullCrossDeviceFS{}
+	if _, err := m.MigrateCache(); err == nil {
+		t.Fatal("expected a failed copy to be reported")
+	}
+	if data, err := os.ReadFile(filepath.Join(legacy, "checksums.json")); err != nil || string(data) != files["checksums.json"] {
+		t.Fatalf("old cache after a failed copy: %q, %v", data, err)
+	}
+	if _, err := os.Stat(m.Paths.Cache); !os.IsNotExist(err) {
+		t.Fatalf("expected the partial copy dropped so the next run retries, got %v", err)
+	}
+
+	// Nor is a cache configured inside the old one moved into itself.
+	m.Paths.Cache = filepath.Join(legacy, "ub")
+	m.FS = nil
+	if _, err := m.MigrateCache(); err == nil {
+		t.Fatal("expected a warning for a cache inside the old cache")
+	}
+	if _, err := os.Stat(filepath.Join(legacy, "checksums.json")); err != nil {
+		t.Fatalf("old cache was touched: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package native
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ub/internal/homebrewapi"
+)
+
+func planTestFormula(name, version string, deps ...string) homebrewapi.Formula {
+	f := homebrewapi.Formula{Name: name, Dependencies: deps}
+	f.Versions.Stable = version
+	return f
+}
+
+// The manager has no API client, so any metadata fetch for a satisfied
+// dependency would panic.
+func newPlanTestManager(t *testing.T, installed ...string) *Manager {
+	t.Helper()
+	manager := &Manager{Paths: Paths{Cellar: t.TempDir()}}
+	for _, keg := range installed {
+		if err := os.MkdirAll(filepath.Join(manager.Paths.Cellar, keg), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	return manager
+}
+
+func TestPlanInstallSkipsInstalledDependencies(t *testing.T) {
+	manager := newPlanTestManager(t, filepath.Join("oniguruma", "6.9.9"))
+	known := map[string]homebrewapi.Formula{"jq": planTestFormula("jq", "1.7.1", "oniguruma")}
+
+	plan, err := manager.planInstall(context.Background(), []string{"jq"}, known, InstallOptions{})
+	if err != nil {
+		t.Fatalf("planInstall: %v", err)
+	}
+	if _, ok := plan.formulae["jq"]; !ok || len(plan.formulae) != 1 {
+		t.Fatalf("expected only jq to install, got %v", plan.formulae)
+	}
+	if plan.satisfied["oniguruma"] != "6.9.9" {
+		t.Fatalf("expected oniguruma satisfied, got %v", plan.satisfied)
+	}
+}
+
+func TestPlanInstallSatisfiesCurrentRoot(t *testing.T) {
+	manager := newPlanTestManager(t, filepath.Join("jq", "1.7.1"))
+	known := map[string]homebrewapi.Formula{"jq": planTestFormula("jq", "1.7.1", "oniguruma")}
+
+	plan, err := manager.planInstall(context.Background(), []string{"jq"}, known, InstallOptions{})
+	if err != nil {
+		t.Fatalf("planInstall: %v", err)
+	}
+	if len(plan.formulae) != 0 || plan.satisfied["jq"] != "1.7.1" {
+		t.Fatalf("expected up-to-date root to be satisfied, got %v %v", plan.formulae, plan.satisfied)
+	}
+}
+
+func TestPlanInstallDependencyOptions(t *testing.T) {
+	known := map[string]homebrewapi.Formula{"jq": planTestFormula("jq", "1.7.1", "oniguruma")}
+
+	manager := newPlanTestManager(t)
+	plan, err := manager.planInstall(context.Background(), []string{"jq"}, known, InstallOptions{IgnoreDependencies: true})
+	if err != nil {
+		t.Fatalf("planInstall: %v", err)
+	}
+	if len(plan.formulae) != 1 {
+		t.Fatalf("expected dependencies ignored, got %v", plan.formulae)
+	}
+
+	manager = newPlanTestManager(t, filepath.Join("oniguruma", "6.9.9"))
+	plan, err = manager.planInstall(context.Background(), []string{"jq"}, known, InstallOptions{OnlyDependencies: true})
+	if err != nil {
+		t.Fatalf("planInstall: %v", err)
+	}
+	if len(plan.formulae) != 0 {
+		t.Fatalf("expected root excluded with only-dependencies, got %v", plan.formulae)
+	}
+}
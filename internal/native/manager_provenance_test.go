@@ -0,0 +1,42 @@
+package native
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ub/internal/apitest"
+)
+
+func TestInstallRecordsProvenance(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+	ctx := context.Background()
+
+	m := New(1)
+	if err := m.Install(ctx, []string{"hello", "greeter"}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	f, err := m.API.FormulaByName(ctx, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, ok := kegProvenance(filepath.Join(m.Paths.Cellar, "hello", "2.12.2"))
+	if !ok {
+		t.Fatal("hello receipt has no provenance")
+	}
+	if !strings.HasSuffix(p.URL, "/bottles/hello.tar.gz") || p.BottleTag != "all" || p.SHA256 != f.Bottle.Stable.Files["all"].SHA256 || p.DownloadedAt.IsZero() {
+		t.Fatalf("hello provenance = %+v", p)
+	}
+
+	receipt, err := m.readCaskReceipt("greeter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Provenance == nil || receipt.Provenance.URL == "" || len(receipt.Provenance.SHA256) != 64 {
+		t.Fatalf("greeter provenance = %+v", receipt.Provenance)
+	}
+}
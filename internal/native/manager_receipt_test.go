@@ -0,0 +1,78 @@
+package native
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"ub/internal/homebrewapi"
+)
+
+func TestWriteFormulaReceiptPreservesExistingFields(t *testing.T) {
+	tmp := t.TempDir()
+	manager := &Manager{Paths: Paths{Cellar: filepath.Join(tmp, "Cellar")}}
+	kegDir := filepath.Join(manager.Paths.Cellar, "oniguruma", "6.9.9")
+	if err := os.MkdirAll(kegDir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	bottleReceipt := `{"homebrew_version":"4.3.0","installed_on_request":false,"poured_from_bottle":true}`
+	if err := os.WriteFile(filepath.Join(kegDir, "INSTALL_RECEIPT.json"), []byte(bottleReceipt), 0o644); err != nil {
+		t.Fatalf("write receipt: %v", err)
+	}
+
+	if manager.installedOnRequest("oniguruma") {
+		t.Fatalf("expected bottle receipt to read as dependency")
+	}
+	if err := writeFormulaReceipt(kegDir, true); err != nil {
+		t.Fatalf("writeFormulaReceipt: %v", err)
+	}
+	if !manager.installedOnRequest("oniguruma") {
+		t.Fatalf("expected keg to be marked installed on request")
+	}
+
+	data, err := os.ReadFile(filepath.Join(kegDir, "INSTALL_RECEIPT.json"))
+	if err != nil {
+		t.Fatalf("read receipt: %v", err)
+	}
+	var receipt map[string]any
+	if err := json.Unmarshal(data, &receipt); err != nil {
+		t.Fatalf("decode receipt: %v", err)
+	}
+	if receipt["homebrew_version"] != "4.3.0" || receipt["poured_from_bottle"] != true {
+		t.Fatalf("expected existing receipt fields preserved, got %s", data)
+	}
+	if receipt["installed_as_dependency"] != false {
+		t.Fatalf("expected installed_as_dependency=false, got %s", data)
+	}
+}
+
+func TestInstalledOnRequestMissingKeg(t *testing.T) {
+	manager := &Manager{Paths: Paths{Cellar: t.TempDir()}}
+	if manager.installedOnRequest("jq") {
+		t.Fatalf("expected missing keg to report false")
+	}
+}
+
+func TestDependencySelection(t *testing.T) {
+	closure := map[string]homebrewapi.Formula{
+		"jq":        {Name: "jq", Dependencies: []string{"oniguruma"}},
+		"oniguruma": {Name: "oniguruma", Dependencies: []string{"pkgconf"}},
+		"pkgconf":   {Name: "pkgconf"},
+	}
+
+	if got := directDependencies(closure, []string{"jq"}); !reflect.DeepEqual(got, []string{"oniguruma"}) {
+		t.Fatalf("directDependencies() = %v", got)
+	}
+}
+
+func TestKeepInstalledHonorsProtectedList(t *testing.T) {
+	manager := &Manager{Paths: Paths{Cellar: t.TempDir()}, Protected: []string{"coreutils"}}
+	if !manager.keepInstalled(InstallState{}, "coreutils") {
+		t.Fatalf("expected protected package to be kept")
+	}
+	if manager.keepInstalled(InstallState{}, "oniguruma") {
+		t.Fatalf("expected unprotected dependency to be removable")
+	}
+}
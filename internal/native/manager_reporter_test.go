@@ -1,13 +1,19 @@
 package native
 
 import (
+	"context"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 
+	"ub/internal/apitest"
+	"ub/internal/fetch"
 	"ub/internal/homebrewapi"
+	"ub/internal/messages"
+	"ub/internal/pipeline"
 )
 
 func TestInstallReporterPlanOutput(t *testing.T) {
@@ -34,19 +40,10 @@ func TestInstallReporterPlanOutput(t *testing.T) {
 }
 
 func TestInstallReporterSummaryOutput(t *testing.T) {
-	tmp := t.TempDir()
-	paths := Paths{Cellar: filepath.Join(tmp, "Cellar")}
-	installDir := filepath.Join(paths.Cellar, "ffmpeg", "8.0.1")
-	if err := os.MkdirAll(installDir, 0o755); err != nil {
-		t.Fatalf("mkdir install dir: %v", err)
-	}
-	if err := os.WriteFile(filepath.Join(installDir, "a.txt"), []byte("x"), 0o644); err != nil {
-		t.Fatalf("write payload: %v", err)
-	}
-
+	paths := Paths{Cellar: filepath.Join(t.TempDir(), "Cellar")}
 	r := newInstallReporter(paths, []string{"ffmpeg"}, map[string]homebrewapi.Formula{"ffmpeg": {Name: "ffmpeg"}})
 	out := captureStdout(t, func() {
-		r.printPoured("ffmpeg", "8.0.1")
+		r.printPoured("ffmpeg", "8.0.1", 1, 1)
 		r.printSummary()
 	})
 
@@ -61,6 +58,24 @@ func TestInstallReporterSummaryOutput(t *testing.T) {
 	}
 }
 
+func TestInstallReporterInterruptedOutput(t *testing.T) {
+	r := newInstallReporter(Paths{}, []string{"ffmpeg"}, map[string]homebrewapi.Formula{"ffmpeg": {Name: "ffmpeg"}})
+	out := captureStdout(t, func() {
+		r.printInterrupted()
+	})
+	if !strings.Contains(out, "Interrupted before any formula was installed") {
+		t.Fatalf("missing interrupted line: %q", out)
+	}
+
+	r.installed = []string{"opus", "lame"}
+	out = captureStdout(t, func() {
+		r.printInterrupted()
+	})
+	if !strings.Contains(out, "==> Interrupted; completed: lame and opus") {
+		t.Fatalf("missing completed list: %q", out)
+	}
+}
+
 func captureStdout(t *testing.T, fn func()) string {
 	t.Helper()
 	old := os.Stdout
@@ -87,3 +102,139 @@ func captureStdout(t *testing.T, fn func()) string {
 	}
 	return string(data)
 }
+
+func TestInstallReporterStatusBarAggregatesJobs(t *testing.T) {
+	r := newInstallReporter(Paths{}, []string{"ffmpeg"}, nil)
+	r.statusBar = true
+	r.totalJobs = 4
+
+	out := captureStdout(t, func() {
+		r.jobStarted("lame")
+		r.jobStarted("opus")
+		r.printDownloadProgress("lame", "lame", fetch.Progress{DownloadedBytes: 10, TotalBytes: 100, SpeedBytesPerSec: 1024})
+		r.printDownloadProgress("opus", "opus", fetch.Progress{DownloadedBytes: 10, TotalBytes: 100, SpeedBytesPerSec: 1024})
+		r.printDownloadProgress("opus", "opus", fetch.Progress{DownloadedBytes: 100, TotalBytes: 100, Done: true})
+		r.extractStarted()
+		r.jobFinished("lame", false)
+	})
+
+	if strings.Contains(out, "elapsed") {
+		t.Fatalf("status bar mode should not render per-file bars: %q", out)
+	}
+	if !strings.Contains(out, "0/4 done, 2 downloading, 0 extracting, 2 queued") {
+		t.Fatalf("missing aggregated download status: %q", out)
+	}
+	if !strings.Contains(out, "2.0KB/s") {
+		t.Fatalf("missing aggregate throughput: %q", out)
+	}
+	if got := r.statusLine(); !strings.Contains(got, "1/4 done, 1 downloading, 1 extracting, 2 queued") {
+		t.Fatalf("status line = %q", got)
+	}
+}
+
+func TestInstallReporterOrderedOutputFollowsDependencyOrder(t *testing.T) {
+	packages := map[string]pipeline.Package{
+		"ffmpeg": {Name: "ffmpeg", Deps: []string{"opus", "lame"}},
+		"lame":   {Name: "lame"},
+		"opus":   {Name: "opus"},
+	}
+	order := installOrder(packages)
+	if got := strings.Join(order, " "); got != "lame opus ffmpeg" {
+		t.Fatalf("installOrder = %s", got)
+	}
+
+	r := newInstallReporter(Paths{}, []string{"ffmpeg"}, nil)
+	r.ordered = true
+	r.holdFor(order)
+	out := captureStdout(t, func() {
+		r.jobStarted("opus")
+		r.jobStarted("lame")
+		r.printInstalling("opus", "1.5", "arm64_sonoma", false, "", 2)
+		r.printDownloadProgress("lame", "lame", fetch.Progress{Cached: true})
+		r.printInstalling("lame", "3.100", "arm64_sonoma", false, "", 1)
+		r.jobFinished("opus", false)
+		r.jobFinished("lame", false)
+		r.jobStarted("ffmpeg")
+		r.printInstalling("ffmpeg", "8.0", "arm64_sonoma", true, "", 1)
+	})
+	want := messages.Sprintf(messages.UsingCached, "lame") + "\n" +
+		"==> Installing dependency: lame\n==> Pouring lame--3.100.arm64_sonoma.bottle.tar.gz\n" +
+		"==> Installing dependency: opus\n==> Pouring opus--1.5.arm64_sonoma.bottle.tar.gz\n"
+	if out != want {
+		t.Fatalf("output = %q\nwant %q", out, want)
+	}
+
+	out = captureStdout(t, r.flushHeld)
+	if !strings.Contains(out, "==> Installing ffmpeg") || strings.Contains(out, "[w1]") {
+		t.Fatalf("flushed output = %q", out)
+	}
+}
+
+func TestInstallReportsPlanProgress(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+
+	var mu sync.Mutex
+	var last PlanProgress
+	m := New(1)
+	m.Progress = func(p PlanProgress) {
+		mu.Lock()
+		defer mu.Unlock()
+		if p.Bytes < last.Bytes || p.DoneBytes < last.DoneBytes {
+			t.Errorf("progress went backwards: %+v after %+v", p, last)
+		}
+		last = p
+	}
+	if err := m.Install(context.Background(), []string{"hello"}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if last.Jobs != 2 || last.DoneJobs != 2 || last.Bytes == 0 || last.DoneBytes != last.Bytes {
+		t.Fatalf("final progress = %+v", last)
+	}
+}
+
+func TestInstallReporterStatusLineCountsBytes(t *testing.T) {
+	r := newInstallReporter(Paths{}, []string{"ffmpeg"}, nil)
+	r.totalJobs = 2
+	r.expect(map[string]int64{"https://example.com/lame": 100, "https://example.com/opus": 300})
+	r.printDownloadProgress("lame", "lame", fetch.Progress{URL: "https://example.com/lame", DownloadedBytes: 50, TotalBytes: -1})
+
+	if plan := r.planLocked(); plan.Bytes != 400 || plan.DoneBytes != 50 {
+		t.Fatalf("plan = %+v", plan)
+	}
+	if got := r.statusLine(); !strings.Contains(got, "0/2 done") || !strings.Contains(got, ", 50B/400B") {
+		t.Fatalf("status line = %q", got)
+	}
+}
+
+func TestInstallReporterShowsStalledDownloads(t *testing.T) {
+	r := newInstallReporter(Paths{}, []string{"ffmpeg"}, nil)
+	r.statusBar = true
+	r.totalJobs = 2
+
+	captureStdout(t, func() {
+		r.jobStarted("lame")
+		r.printDownloadProgress("lame", "lame", fetch.Progress{URL: "lame", DownloadedBytes: 10, TotalBytes: 100, Stalled: true})
+	})
+	if got := r.statusLine(); !strings.HasSuffix(got, ", 1 stalled, retrying") {
+		t.Fatalf("status line = %q", got)
+	}
+	captureStdout(t, func() {
+		r.printDownloadProgress("lame", "lame", fetch.Progress{URL: "lame", DownloadedBytes: 20, TotalBytes: 100, SpeedBytesPerSec: 1024})
+	})
+	if got := r.statusLine(); strings.Contains(got, "stalled") {
+		t.Fatalf("stalled status outlived the retry: %q", got)
+	}
+
+	r = newInstallReporter(Paths{}, []string{"lame"}, nil)
+	out := captureStdout(t, func() {
+		r.printDownloadProgress("lame", "lame", fetch.Progress{URL: "lame", DownloadedBytes: 50, TotalBytes: 100, Stalled: true})
+	})
+	if !strings.Contains(out, "50.0%") || !strings.Contains(out, "stalled, retrying") {
+		t.Fatalf("missing stalled progress line: %q", out)
+	}
+}
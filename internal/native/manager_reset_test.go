@@ -1,6 +1,7 @@
 package native
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"testing"
@@ -39,7 +40,7 @@ func TestResetRemovesCachedFiles(t *testing.T) {
 		t.Fatalf("write api cache: %v", err)
 	}
 
-	if err := manager.Reset(); err != nil {
+	if err := manager.Reset(context.Background()); err != nil {
 		t.Fatalf("reset: %v", err)
 	}
 
@@ -92,7 +93,7 @@ func TestResetRemovesInstalledCasks(t *testing.T) {
 		t.Fatalf("write receipt: %v", err)
 	}
 
-	if err := manager.Reset(); err != nil {
+	if err := manager.Reset(context.Background()); err != nil {
 		t.Fatalf("reset: %v", err)
 	}
 
@@ -0,0 +1,67 @@
+package native
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func stubRunningApp(t *testing.T, running *bool) *[]string {
+	t.Helper()
+	origRunning, origQuit, origTimeout := runningAppPIDs, quitApp, appQuitTimeout
+	t.Cleanup(func() {
+		runningAppPIDs, quitApp, appQuitTimeout = origRunning, origQuit, origTimeout
+	})
+	var quitIDs []string
+	runningAppPIDs = func(string) []int {
+		if *running {
+			return []int{4242}
+		}
+		return nil
+	}
+	quitApp = func(bundleIDs []string, pids []int) {
+		quitIDs = append(quitIDs, bundleIDs...)
+		*running = false
+	}
+	appQuitTimeout = time.Second
+	return &quitIDs
+}
+
+func TestEnsureAppNotRunningRefusesWithoutConfirmation(t *testing.T) {
+	running := true
+	quitIDs := stubRunningApp(t, &running)
+
+	m := &Manager{}
+	err := m.ensureAppNotRunning("/Applications/Cursor.app", []string{"com.cursor"})
+	if err == nil || !strings.Contains(err.Error(), "Cursor.app is running") {
+		t.Fatalf("expected running app error, got %v", err)
+	}
+	m.ConfirmQuit = func(string) bool { return false }
+	if err := m.ensureAppNotRunning("/Applications/Cursor.app", nil); err == nil {
+		t.Fatal("expected declined quit to fail")
+	}
+	if len(*quitIDs) != 0 || !running {
+		t.Fatalf("app should not have been quit: %v", *quitIDs)
+	}
+}
+
+func TestEnsureAppNotRunningQuitsConfirmedApp(t *testing.T) {
+	running := true
+	quitIDs := stubRunningApp(t, &running)
+
+	var asked string
+	m := &Manager{ConfirmQuit: func(app string) bool { asked = app; return true }}
+	if err := m.ensureAppNotRunning("/Applications/Cursor.app", []string{"com.cursor"}); err != nil {
+		t.Fatalf("ensureAppNotRunning: %v", err)
+	}
+	if asked != "Cursor.app" {
+		t.Fatalf("asked about %q", asked)
+	}
+	if len(*quitIDs) != 1 || (*quitIDs)[0] != "com.cursor" {
+		t.Fatalf("quit ids = %v", *quitIDs)
+	}
+
+	if err := m.ensureAppNotRunning("/Applications/Cursor.app", nil); err != nil {
+		t.Fatalf("not running app should pass: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package native
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeKeg(t *testing.T, m *Manager, name, version string) {
+	t.Helper()
+	binDir := filepath.Join(m.Paths.Cellar, name, version, "bin")
+	if err := os.MkdirAll(binDir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(binDir, name), []byte(version), 0o755); err != nil {
+		t.Fatalf("write binary: %v", err)
+	}
+	if _, err := m.linkFormula(name, version); err != nil {
+		t.Fatalf("link: %v", err)
+	}
+	if err := m.recordFormula(name); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+}
+
+func newSnapshotTestManager(t *testing.T) *Manager {
+	t.Helper()
+	tmp := t.TempDir()
+	m := &Manager{Paths: Paths{
+		Prefix:   tmp,
+		Cellar:   filepath.Join(tmp, "Cellar"),
+		Caskroom: filepath.Join(tmp, "Caskroom"),
+		Bin:      filepath.Join(tmp, "bin"),
+		Sbin:     filepath.Join(tmp, "sbin"),
+	}}
+	for _, dir := range []string{m.Paths.Cellar, m.Paths.Caskroom, m.Paths.Bin, m.Paths.Sbin} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	return m
+}
+
+func TestSnapshotRestoreRollsBackUpgradeAndInstalls(t *testing.T) {
+	m := newSnapshotTestManager(t)
+	writeKeg(t, m, "jq", "1.6")
+	if _, err := m.CreateSnapshot(context.Background(), "before", false); err != nil {
+		t.Fatalf("CreateSnapshot: %v", err)
+	}
+	writeKeg(t, m, "jq", "1.7.1")
+	writeKeg(t, m, "wget", "1.24")
+
+	summary, err := m.RestoreSnapshot(context.Background(), "before")
+	if err != nil {
+		t.Fatalf("RestoreSnapshot: %v", err)
+	}
+	if len(summary.Removed) != 1 || summary.Removed[0] != "wget" || len(summary.Relinked) != 1 || len(summary.Unrestorable) != 0 {
+		t.Fatalf("summary = %+v", summary)
+	}
+	if _, err := os.Stat(filepath.Join(m.Paths.Cellar, "wget")); !os.IsNotExist(err) {
+		t.Fatalf("expected wget removed, stat err: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(m.Paths.Cellar, "jq", "1.7.1")); !os.IsNotExist(err) {
+		t.Fatalf("expected jq 1.7.1 keg removed, stat err: %v", err)
+	}
+	target, err := os.Readlink(filepath.Join(m.Paths.Bin, "jq"))
+	if err != nil || target != filepath.Join(m.Paths.Cellar, "jq", "1.6", "bin", "jq") {
+		t.Fatalf("jq link = %q, %v; want 1.6", target, err)
+	}
+}
+
+func TestSnapshotCloneRestoresRemovedKeg(t *testing.T) {
+	m := newSnapshotTestManager(t)
+	writeKeg(t, m, "jq", "1.6")
+	if _, err := m.CreateSnapshot(context.Background(), "cloned", true); err != nil {
+		t.Fatalf("CreateSnapshot: %v", err)
+	}
+	if _, err := m.CreateSnapshot(context.Background(), "plain", false); err != nil {
+		t.Fatalf("CreateSnapshot: %v", err)
+	}
+	if _, err := m.uninstallFormulaLocked(context.Background(), "jq", true); err != nil {
+		t.Fatalf("uninstall: %v", err)
+	}
+
+	summary, err := m.RestoreSnapshot(context.Background(), "plain")
+	if err != nil || len(summary.Unrestorable) != 1 || summary.Unrestorable[0] != "jq 1.6" {
+		t.Fatalf("plain restore = %+v, %v; want jq unrestorable", summary, err)
+	}
+	if _, err := m.RestoreSnapshot(context.Background(), "cloned"); err != nil {
+		t.Fatalf("RestoreSnapshot: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(m.Paths.Bin, "jq"))
+	if err != nil || string(data) != "1.6" {
+		t.Fatalf("restored jq = %q, %v", data, err)
+	}
+
+	snaps, err := m.ListSnapshots()
+	if err != nil || len(snaps) != 2 {
+		t.Fatalf("ListSnapshots = %+v, %v", snaps, err)
+	}
+	if _, err := m.CreateSnapshot(context.Background(), "../escape", false); err == nil {
+		t.Fatalf("expected invalid snapshot name to fail")
+	}
+}
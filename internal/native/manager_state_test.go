@@ -0,0 +1,236 @@
+package native
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"ub/internal/history"
+	"ub/internal/state"
+)
+
+func TestInstallStateReadsTheStore(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	m := New(1)
+	keg := filepath.Join(m.Paths.Cellar, "jq", "1.7.1")
+	if err := os.MkdirAll(keg, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(m.Paths.Caskroom, "greeter", "1.0"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFormulaReceipt(keg, true); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := m.InstallState()
+	if err != nil {
+		t.Fatalf("InstallState: %v", err)
+	}
+	if jq := st.Formulae["jq"]; jq.Version != "1.7.1" || !jq.OnRequest || st.Casks["greeter"].Version != "1.0" {
+		t.Fatalf("InstallState = %+v", st)
+	}
+	if _, err := os.Stat(state.Path(m.Paths.Prefix)); err != nil {
+		t.Fatalf("expected the state store created: %v", err)
+	}
+
+	// Once the store holds the prefix, queries no longer look at the
+	// Cellar; installs and uninstalls record what they change.
+	if err := writeFormulaReceipt(keg, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(m.Paths.Cellar, "wget", "1.24"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := m.InstallState(); err != nil || !st.Formulae["jq"].OnRequest || len(st.Formulae) != 1 {
+		t.Fatalf("expected the stored records, got %+v, %v", st.Formulae, err)
+	}
+	if err := m.recordFormula("jq"); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := m.InstallState(); err != nil || st.Formulae["jq"].OnRequest {
+		t.Fatalf("expected the recorded receipt, got %+v, %v", st.Formulae["jq"], err)
+	}
+
+	if err := os.RemoveAll(filepath.Join(m.Paths.Cellar, "jq")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.recordFormula("jq"); err != nil {
+		t.Fatal(err)
+	}
+	names, err := m.ListInstalled()
+	if err != nil || len(names) != 0 {
+		t.Fatalf("ListInstalled after removing jq = %q, %v", names, err)
+	}
+	if err := m.stateStore().View(func(tx *state.Tx) error {
+		if keys := tx.Keys(formulaeBucket); len(keys) != 0 {
+			t.Fatalf("indexed formulae = %q, want none", keys)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("View: %v", err)
+	}
+}
+
+func TestInstallStateRecordsTheNewestKeg(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	m := New(1)
+	for _, version := range []string{"1.9", "1.10"} {
+		if err := os.MkdirAll(filepath.Join(m.Paths.Cellar, "jq", version), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st, err := m.InstallState()
+	if err != nil {
+		t.Fatalf("InstallState: %v", err)
+	}
+	if jq := st.Formulae["jq"]; jq.Version != "1.10" || !slices.Equal(jq.Versions, []string{"1.9", "1.10"}) {
+		t.Fatalf("jq = %+v", jq)
+	}
+}
+
+func TestStateTakesInLegacyFiles(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	m := New(1)
+	keg := filepath.Join(m.Paths.Cellar, "jq", "1.7.1")
+	if err := os.MkdirAll(keg, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	legacy := map[string]string{
+		filepath.Join(keg, kegManifestName): `{"files":1,"size":3,"paths":["bin/jq"]}`,
+		m.tapPinsFile():                     `[{"formula":"jq","tap":"acme/tools","dir":"/taps/acme"}]`,
+		history.Path(m.Paths.Prefix):        `{"command":"install","args":["jq"],"success":true}` + "\n",
+	}
+	for path, data := range legacy {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := m.InstallState(); err != nil {
+		t.Fatalf("InstallState: %v", err)
+	}
+	for path := range legacy {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected %s moved into the store, stat err: %v", path, err)
+		}
+	}
+	if manifest, ok := m.readKegManifest(keg); !ok || manifest.Files != 1 || manifest.Paths[0] != "bin/jq" {
+		t.Fatalf("manifest = %+v, %v", manifest, ok)
+	}
+	if pins, err := m.TapPins(); err != nil || len(pins) != 1 || pins[0].Tap != "acme/tools" {
+		t.Fatalf("TapPins = %+v, %v", pins, err)
+	}
+	if err := m.RecordHistory(history.Entry{Command: "upgrade", Success: true}); err != nil {
+		t.Fatalf("RecordHistory: %v", err)
+	}
+	entries, err := m.History()
+	if err != nil || len(entries) != 2 || entries[0].Command != "install" || entries[1].Command != "upgrade" {
+		t.Fatalf("History = %+v, %v", entries, err)
+	}
+}
+
+func TestInstallStateReadOnlyLeavesThePrefixAlone(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	m := New(1)
+	if err := os.MkdirAll(filepath.Join(m.Paths.Cellar, "jq", "1.7.1"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	m.UseReadOnly()
+	formulae, _, err := m.InstalledVersions()
+	if err != nil || formulae["jq"] != "1.7.1" {
+		t.Fatalf("InstalledVersions = %v, %v", formulae, err)
+	}
+	if _, err := os.Stat(state.Path(m.Paths.Prefix)); !os.IsNotExist(err) {
+		t.Fatalf("expected no state store from a read-only command, got %v", err)
+	}
+	if _, err := os.Stat(m.Paths.Cache); !os.IsNotExist(err) {
+		t.Fatalf("expected UseReadOnly not to create the cache, got %v", err)
+	}
+}
+
+func TestReadOnlyCacheDirIsPrivate(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	t.Setenv("XDG_CACHE_HOME", "")
+	t.Setenv("HOME", "")
+
+	dir, err := readOnlyCacheDir()
+	if err != nil || filepath.Dir(dir) != tmp || !privateDir(dir) {
+		t.Fatalf("readOnlyCacheDir() = %q, %v", dir, err)
+	}
+	if again, err := readOnlyCacheDir(); err != nil || again != dir {
+		t.Fatalf("second readOnlyCacheDir() = %q, %v, want %q", again, err, dir)
+	}
+
+	// A directory someone else could use is not trusted.
+	if err := os.Chmod(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	other, err := readOnlyCacheDir()
+	if err != nil || other == dir || !privateDir(other) {
+		t.Fatalf("readOnlyCacheDir() with a shared dir = %q, %v", other, err)
+	}
+}
+
+func TestVerifyAndRebuildState(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	m := New(1)
+	for _, keg := range []string{"jq/1.7.1", "wget/1.24"} {
+		if err := os.MkdirAll(filepath.Join(m.Paths.Cellar, filepath.FromSlash(keg)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.InstallState(); err != nil {
+		t.Fatalf("InstallState: %v", err)
+	}
+	if divergences, err := m.VerifyState(); err != nil || len(divergences) != 0 {
+		t.Fatalf("VerifyState after indexing = %+v, %v", divergences, err)
+	}
+
+	// Change the prefix behind the store's back.
+	if err := os.RemoveAll(filepath.Join(m.Paths.Cellar, "wget")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(m.Paths.Cellar, "jq", "1.8.0"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(m.Paths.Caskroom, "greeter", "1.0"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	divergences, err := m.VerifyState()
+	if err != nil {
+		t.Fatalf("VerifyState: %v", err)
+	}
+	want := []StateDivergence{
+		{Name: "jq", Problem: "indexed versions [1.7.1], installed [1.7.1, 1.8.0]"},
+		{Name: "greeter", Cask: true, Problem: "installed but not indexed"},
+		{Name: "wget", Problem: "indexed but not installed"},
+	}
+	if !reflect.DeepEqual(divergences, want) {
+		t.Fatalf("VerifyState = %+v, want %+v", divergences, want)
+	}
+
+	if err := os.WriteFile(state.Path(m.Paths.Prefix), []byte("garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.VerifyState(); err == nil {
+		t.Fatal("expected a damaged store to fail verification")
+	}
+	st, err := m.RebuildState()
+	if err != nil || len(st.Formulae) != 1 || len(st.Casks) != 1 {
+		t.Fatalf("RebuildState = %+v, %v", st, err)
+	}
+	if divergences, err := m.VerifyState(); err != nil || len(divergences) != 0 {
+		t.Fatalf("VerifyState after rebuilding = %+v, %v", divergences, err)
+	}
+	if stored, err := m.StoredState(); err != nil || stored.Formulae["jq"].Version != "1.8.0" {
+		t.Fatalf("StoredState = %+v, %v", stored, err)
+	}
+}
@@ -0,0 +1,58 @@
+package native
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"ub/internal/apitest"
+	"ub/internal/fetch"
+)
+
+func TestSuggest(t *testing.T) {
+	candidates := []string{"ffmpeg", "ffmpeg@6", "ffmpegthumbnailer", "hello", "wget", "wgetpaste"}
+	tests := map[string][]string{
+		"ffmpg":  {"ffmpeg"},
+		"helo":   {"hello"},
+		"wgte":   {"wget"},
+		"xyzzy":  {},
+		"ffmpeg": {"ffmpeg@6"},
+	}
+	for name, want := range tests {
+		if got := Suggest(name, candidates); !reflect.DeepEqual(got, want) {
+			t.Errorf("Suggest(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestUnknownNameSuggestsKnownNames(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+	ctx := context.Background()
+
+	m := New(1)
+	// The fixture indexes are empty, so installed packages are the only
+	// candidates here.
+	if err := m.Install(ctx, []string{"hello", "greeter"}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	err := m.Install(ctx, []string{"helo"})
+	var notFound *NotFoundError
+	if !errors.As(err, &notFound) || !reflect.DeepEqual(notFound.Suggestions, []string{"hello"}) {
+		t.Fatalf("expected a suggestion of hello, got %v", err)
+	}
+	if !strings.Contains(err.Error(), `no formula or cask named "helo"; did you mean hello?`) {
+		t.Fatalf("message = %q", err)
+	}
+	var status *fetch.StatusError
+	if !errors.As(err, &status) || status.StatusCode != 404 {
+		t.Fatalf("expected the 404 to stay visible, got %v", err)
+	}
+	if _, err := m.InfoJSON(ctx, []string{"greter"}, InfoOptions{}); !errors.As(err, &notFound) || len(notFound.Suggestions) == 0 || notFound.Suggestions[0] != "greeter" {
+		t.Fatalf("InfoJSON(greter) = %v", err)
+	}
+}
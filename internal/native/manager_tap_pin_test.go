@@ -0,0 +1,172 @@
+package native
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ub/internal/apitest"
+)
+
+// writePinTap writes a tap whose libgreet builds from a local source
+// archive, and returns the tap directory.
+func writePinTap(t *testing.T) string {
+	t.Helper()
+	tmp := t.TempDir()
+	archive := filepath.Join(tmp, "libgreet-1.0.tar.gz")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	body := "patched\n"
+	if err := tw.WriteHeader(&tar.Header{Name: "libgreet-1.0/greet.txt", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(body))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []interface{ Close() error }{tw, gz, f} {
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+
+	tap := filepath.Join(tmp, "tap")
+	if err := os.MkdirAll(tap, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	formula := fmt.Sprintf(`{
+  "name": "libgreet",
+  "version": "1.0",
+  "deps": [],
+  "source": {"url": "file://%s", "sha256": "%s"},
+  "build": {"steps": ["mkdir -p \"$PREFIX/lib\"", "cp greet.txt \"$PREFIX/lib/greet.txt\""]}
+}`, archive, hex.EncodeToString(sum[:]))
+	if err := os.WriteFile(filepath.Join(tap, "libgreet.json"), []byte(formula), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return tap
+}
+
+func TestPinnedDependencyBuildsFromTap(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+	ctx := context.Background()
+	tap := writePinTap(t)
+
+	m := New(1)
+	if _, err := m.PinTap("hello", tap); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("expected pinning a formula the tap lacks to fail, got %v", err)
+	}
+	if _, err := m.PinTap("libgreet", tap); err != nil {
+		t.Fatalf("PinTap: %v", err)
+	}
+	if err := m.Install(ctx, []string{"hello"}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	keg := filepath.Join(m.Paths.Cellar, "libgreet", "1.0")
+	if data, err := os.ReadFile(filepath.Join(keg, "lib", "greet.txt")); err != nil || string(data) != "patched\n" {
+		t.Fatalf("libgreet keg = %q, %v", data, err)
+	}
+	if got := kegTap(keg); got != tap {
+		t.Fatalf("receipt tap = %q, want %q", got, tap)
+	}
+	if n := server.Hits("/bottles/libgreet.tar.gz"); n != 0 {
+		t.Fatalf("libgreet bottle downloaded %d times", n)
+	}
+	if !m.isInstalled("hello", "2.12.2") {
+		t.Fatal("expected hello poured from core")
+	}
+	outdated, err := m.Outdated(ctx, nil, false)
+	if err != nil || len(outdated) != 0 {
+		t.Fatalf("Outdated = %+v, %v", outdated, err)
+	}
+
+	if err := m.UnpinTap("libgreet"); err != nil {
+		t.Fatalf("UnpinTap: %v", err)
+	}
+	if pins, err := m.TapPins(); err != nil || len(pins) != 0 {
+		t.Fatalf("TapPins = %+v, %v", pins, err)
+	}
+}
+
+func TestPinningReplacesCoreKeg(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+	ctx := context.Background()
+
+	m := New(1)
+	if err := m.Install(ctx, []string{"libgreet"}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	if _, err := m.PinTap("libgreet", writePinTap(t)); err != nil {
+		t.Fatalf("PinTap: %v", err)
+	}
+	outdated, err := m.Outdated(ctx, nil, false)
+	if err != nil || len(outdated) != 1 || outdated[0].Name != "libgreet" {
+		t.Fatalf("Outdated = %+v, %v", outdated, err)
+	}
+	if _, err := m.Upgrade(ctx, nil, UpgradeOptions{}); err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+	keg := filepath.Join(m.Paths.Cellar, "libgreet", "1.0")
+	if _, err := os.Stat(filepath.Join(keg, "lib", "greet.txt")); err != nil {
+		t.Fatalf("expected the tap build in place of the bottle: %v", err)
+	}
+	if !m.installedOnRequest("libgreet") {
+		t.Fatal("upgrade lost the installed-on-request mark")
+	}
+}
+
+func TestFailedPinnedBuildKeepsInstalledKeg(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+	ctx := context.Background()
+
+	m := New(1)
+	if err := m.Install(ctx, []string{"libgreet"}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	tap := writePinTap(t)
+	file := filepath.Join(tap, "libgreet.json")
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := strings.Replace(string(data), `"cp greet.txt`, `"exit 1; cp greet.txt`, 1)
+	if err := os.WriteFile(file, []byte(broken), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.PinTap("libgreet", tap); err != nil {
+		t.Fatalf("PinTap: %v", err)
+	}
+	if _, err := m.Upgrade(ctx, nil, UpgradeOptions{}); err == nil {
+		t.Fatal("expected the failing build to fail the upgrade")
+	}
+	if _, err := os.Stat(filepath.Join(m.Paths.Cellar, "libgreet", "1.0", "lib", "libgreet.txt")); err != nil {
+		t.Fatalf("the failed build removed the bottle's keg: %v", err)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(m.Paths.Prefix, "var", "ub", "previous-keg-*")); len(leftovers) != 0 {
+		t.Fatalf("left %v behind", leftovers)
+	}
+}
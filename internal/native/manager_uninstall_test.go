@@ -0,0 +1,180 @@
+package native
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ub/internal/apitest"
+)
+
+func newUninstallTestManager(t *testing.T) *Manager {
+	t.Helper()
+	tmp := t.TempDir()
+	manager := &Manager{Paths: Paths{
+		Cellar: filepath.Join(tmp, "Cellar"),
+		Bin:    filepath.Join(tmp, "bin"),
+		Sbin:   filepath.Join(tmp, "sbin"),
+	}}
+	for _, version := range []string{"1.6", "1.7.1"} {
+		binDir := filepath.Join(manager.Paths.Cellar, "jq", version, "bin")
+		if err := os.MkdirAll(binDir, 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(binDir, "jq"), []byte(version), 0o755); err != nil {
+			t.Fatalf("write binary: %v", err)
+		}
+	}
+	for _, dir := range []string{manager.Paths.Bin, manager.Paths.Sbin} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	if _, err := manager.linkFormula("jq", "1.7.1"); err != nil {
+		t.Fatalf("link: %v", err)
+	}
+	return manager
+}
+
+func TestUninstallFormulaLockedRemovesNewestAndRelinks(t *testing.T) {
+	manager := newUninstallTestManager(t)
+
+	rec, err := manager.uninstallFormulaLocked(context.Background(), "jq", false)
+	if err != nil {
+		t.Fatalf("uninstallFormulaLocked: %v", err)
+	}
+	if rec.Path != filepath.Join(manager.Paths.Cellar, "jq", "1.7.1") {
+		t.Fatalf("unexpected record path %q", rec.Path)
+	}
+	if _, err := os.Stat(filepath.Join(manager.Paths.Cellar, "jq", "1.7.1")); !os.IsNotExist(err) {
+		t.Fatalf("expected newest keg removed, stat err: %v", err)
+	}
+	target, err := os.Readlink(filepath.Join(manager.Paths.Bin, "jq"))
+	if err != nil {
+		t.Fatalf("readlink: %v", err)
+	}
+	if target != filepath.Join(manager.Paths.Cellar, "jq", "1.6", "bin", "jq") {
+		t.Fatalf("expected jq relinked to 1.6, got %q", target)
+	}
+}
+
+func TestUninstallFormulaLockedAllVersions(t *testing.T) {
+	manager := newUninstallTestManager(t)
+
+	if _, err := manager.uninstallFormulaLocked(context.Background(), "jq", true); err != nil {
+		t.Fatalf("uninstallFormulaLocked: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(manager.Paths.Cellar, "jq")); !os.IsNotExist(err) {
+		t.Fatalf("expected all kegs removed, stat err: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(manager.Paths.Bin, "jq")); !os.IsNotExist(err) {
+		t.Fatalf("expected link removed, stat err: %v", err)
+	}
+}
+
+func TestRemoveKegsWithProgressUsesManifest(t *testing.T) {
+	m := &Manager{Paths: Paths{Prefix: t.TempDir(), Cellar: t.TempDir()}}
+	formulaDir := filepath.Join(m.Paths.Cellar, "jq")
+	kegDir := filepath.Join(formulaDir, "1.7")
+	var paths []string
+	for _, rel := range []string{"bin/jq", "share/doc/README", "lib/libjq.dylib"} {
+		path := filepath.Join(kegDir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(rel), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		paths = append(paths, path)
+	}
+	if err := m.writeKegManifest(kegDir, kegManifest{Files: len(paths), Paths: paths}); err != nil {
+		t.Fatalf("writeKegManifest: %v", err)
+	}
+
+	lastTotal := -1
+	done := false
+	err := m.removeKegsWithProgress(context.Background(), formulaDir, []string{kegDir}, func(removed, total int, isDone bool) {
+		lastTotal = total
+		done = done || isDone
+	})
+	if err != nil {
+		t.Fatalf("removeKegsWithProgress: %v", err)
+	}
+	if lastTotal != len(paths) || !done {
+		t.Fatalf("progress total = %d (done %v), want %d from the manifest", lastTotal, done, len(paths))
+	}
+	if _, err := os.Stat(formulaDir); !os.IsNotExist(err) {
+		t.Fatalf("expected formula dir removed, stat err: %v", err)
+	}
+}
+
+func TestRemoveKegsWithProgressFallsBackToWalk(t *testing.T) {
+	m := &Manager{Paths: Paths{Prefix: t.TempDir(), Cellar: t.TempDir()}}
+	kegDir := filepath.Join(m.Paths.Cellar, "jq", "1.6")
+	if err := os.MkdirAll(filepath.Join(kegDir, "bin"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(kegDir, "bin", "jq"), []byte("jq"), 0o755); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := m.removeKegsWithProgress(context.Background(), kegDir, []string{kegDir}, nil); err != nil {
+		t.Fatalf("removeKegsWithProgress: %v", err)
+	}
+	if _, err := os.Stat(kegDir); !os.IsNotExist(err) {
+		t.Fatalf("expected keg removed, stat err: %v", err)
+	}
+}
+
+func TestRemoveTreeWithProgressStopsWhenCancelled(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "tree")
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := os.WriteFile(filepath.Join(root, fmt.Sprintf("f%d", i)), nil, 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := removeTreeWithProgress(ctx, root, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("removeTreeWithProgress err = %v, want context.Canceled", err)
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatalf("read tree: %v", err)
+	}
+	if len(entries) != 50 {
+		t.Fatalf("expected no files removed after cancel, %d remain", len(entries))
+	}
+
+	files := []string{filepath.Join(root, "f0"), filepath.Join(root, "f1")}
+	if err := removeFiles(ctx, files, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("removeFiles err = %v, want context.Canceled", err)
+	}
+}
+
+func TestUninstallFindsDependentsOffline(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+	ctx := context.Background()
+	if err := New(1).Install(ctx, []string{"hello"}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+
+	// An API that knows nothing stands in for being offline.
+	t.Setenv("UB_API_FIXTURES", t.TempDir())
+	m := New(1)
+	if _, err := m.UninstallWithAutoremove(ctx, []string{"libgreet"}); !errors.Is(err, ErrHasDependents) {
+		t.Fatalf("uninstall libgreet = %v, want ErrHasDependents", err)
+	}
+	if _, err := m.UninstallWithAutoremove(ctx, []string{"hello", "libgreet"}); err != nil {
+		t.Fatalf("uninstall hello and libgreet offline: %v", err)
+	}
+}
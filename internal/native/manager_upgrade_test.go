@@ -0,0 +1,151 @@
+package native
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ub/internal/apitest"
+)
+
+func TestCaskUpgradeDecision(t *testing.T) {
+	cases := []struct {
+		name        string
+		installed   string
+		current     string
+		autoUpdates bool
+		greedy      bool
+		want        caskDecision
+	}{
+		{"current", "1.0", "1.0", false, false, caskCurrent},
+		{"outdated", "1.0", "1.1", false, false, caskUpgrade},
+		{"auto updates skipped", "1.0", "1.1", true, false, caskSkipAutoUpdates},
+		{"auto updates greedy", "1.0", "1.1", true, true, caskUpgrade},
+		{"auto updates current", "1.1", "1.1", true, true, caskCurrent},
+		{"latest skipped", "latest", "latest", false, false, caskSkipAutoUpdates},
+		{"latest greedy", "latest", "latest", false, true, caskUpgrade},
+	}
+	for _, tc := range cases {
+		if got := caskUpgradeDecision(tc.installed, tc.current, tc.autoUpdates, tc.greedy); got != tc.want {
+			t.Errorf("%s: caskUpgradeDecision() = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFormulaVersionCurrent(t *testing.T) {
+	if !formulaVersionCurrent("1.7.1", "1.7.1") {
+		t.Fatalf("expected exact version to be current")
+	}
+	if !formulaVersionCurrent("1.7.1_1", "1.7.1") {
+		t.Fatalf("expected revision to be current")
+	}
+	if formulaVersionCurrent("1.6", "1.7.1") {
+		t.Fatalf("expected older version to be outdated")
+	}
+}
+
+func TestReadCaskReceiptRecordsAutoUpdates(t *testing.T) {
+	tmp := t.TempDir()
+	manager := &Manager{Paths: Paths{Caskroom: filepath.Join(tmp, "Caskroom")}}
+	versionDir := filepath.Join(manager.Paths.Caskroom, "firefox", "130.0")
+	if err := os.MkdirAll(versionDir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := saveCaskReceipt(versionDir, caskInstallReceipt{Token: "firefox", Version: "130.0", AutoUpdates: true, Greedy: true}); err != nil {
+		t.Fatalf("save receipt: %v", err)
+	}
+
+	receipt, err := manager.readCaskReceipt("firefox")
+	if err != nil {
+		t.Fatalf("read receipt: %v", err)
+	}
+	if !receipt.AutoUpdates || !receipt.Greedy || receipt.Version != "130.0" {
+		t.Fatalf("unexpected receipt: %+v", receipt)
+	}
+
+	data, err := os.ReadFile(filepath.Join(versionDir, "INSTALL_RECEIPT.json"))
+	if err != nil {
+		t.Fatalf("read receipt file: %v", err)
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatalf("decode receipt: %v", err)
+	}
+	if raw["auto_updates"] != true {
+		t.Fatalf("expected auto_updates in receipt, got %s", data)
+	}
+}
+
+func TestUpgradeCandidatesRejectsUnknown(t *testing.T) {
+	tmp := t.TempDir()
+	manager := &Manager{Paths: Paths{Cellar: filepath.Join(tmp, "Cellar"), Caskroom: filepath.Join(tmp, "Caskroom")}}
+	if err := os.MkdirAll(filepath.Join(manager.Paths.Cellar, "jq", "1.7.1"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	st, err := manager.InstallState()
+	if err != nil {
+		t.Fatalf("InstallState: %v", err)
+	}
+	formulae, casks, err := upgradeCandidates(st, []string{"jq"})
+	if err != nil {
+		t.Fatalf("upgradeCandidates: %v", err)
+	}
+	if len(formulae) != 1 || formulae[0] != "jq" || len(casks) != 0 {
+		t.Fatalf("unexpected candidates: %v %v", formulae, casks)
+	}
+
+	if _, _, err := upgradeCandidates(st, []string{"wget"}); !errors.Is(err, ErrNotInstalled) {
+		t.Fatalf("expected ErrNotInstalled, got %v", err)
+	}
+}
+
+func TestUpgradeDryRunListsLinksWithoutUpgrading(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+
+	m := New(1)
+	if err := os.MkdirAll(filepath.Join(m.Paths.Cellar, "hello", "2.12.1", "bin"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	summary, err := m.Upgrade(context.Background(), nil, UpgradeOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("Upgrade: %v", err)
+	}
+	if len(summary.Upgraded) != 0 || len(summary.Pending) != 1 {
+		t.Fatalf("summary = %+v", summary)
+	}
+	if p := summary.Pending[0]; p.Name != "hello" || p.CurrentVersion != "2.12.2" || p.Homepage != "https://www.gnu.org/software/hello/" || p.ReleaseNotes != "" {
+		t.Fatalf("pending = %+v", p)
+	}
+	if _, err := os.Stat(filepath.Join(m.Paths.Cellar, "hello", "2.12.2")); !os.IsNotExist(err) {
+		t.Fatalf("dry run poured hello 2.12.2: %v", err)
+	}
+	if hits := server.Hits("/bottles/hello.tar.gz"); hits != 0 {
+		t.Fatalf("dry run downloaded the bottle %d times", hits)
+	}
+}
+
+func TestReleaseNotesURL(t *testing.T) {
+	for _, tt := range []struct {
+		source, tag, want string
+	}{
+		{"https://github.com/jqlang/jq/releases/download/jq-1.7.1/jq-1.7.1.tar.gz", "", "https://github.com/jqlang/jq/releases/tag/jq-1.7.1"},
+		{"https://github.com/BurntSushi/ripgrep/archive/refs/tags/14.1.0.tar.gz", "", "https://github.com/BurntSushi/ripgrep/releases/tag/14.1.0"},
+		{"https://github.com/junegunn/fzf/archive/v0.54.0.zip", "", "https://github.com/junegunn/fzf/releases/tag/v0.54.0"},
+		{"https://github.com/neovim/neovim.git", "v0.10.1", "https://github.com/neovim/neovim/releases/tag/v0.10.1"},
+		{"https://github.com/example/tool/archive/refs/heads/main.tar.gz", "", ""},
+		{"https://github.com/example/tool/archive/0123456789abcdef0123456789abcdef01234567.tar.gz", "", ""},
+		{"https://github.com/neovim/neovim.git", "", ""},
+		{"https://ftpmirror.gnu.org/gnu/hello/hello-2.12.2.tar.gz", "", ""},
+	} {
+		if got := releaseNotesURL(tt.source, tt.tag); got != tt.want {
+			t.Errorf("releaseNotesURL(%q, %q) = %q, want %q", tt.source, tt.tag, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package native
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ub/internal/fetch"
+)
+
+func TestVerifyDownloadsQuarantinesCorruptEntries(t *testing.T) {
+	cache := fetch.NewCache(t.TempDir())
+	manager := &Manager{Fetch: cache, Workers: 2}
+
+	write := func(name, content string) string {
+		t.Helper()
+		path := filepath.Join(cache.Dir, "archive-v0", name[:2], name+".src")
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		return path
+	}
+	digest := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])
+	}
+
+	good := write("aa01", "good")
+	bad := write("bb02", "corrupted")
+	write("cc03", "untracked")
+	if err := cache.RecordChecksum(good, "https://example.com/good", digest("good")); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if err := cache.RecordChecksum(bad, "https://example.com/bad", digest("original")); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if err := cache.RecordChecksum(filepath.Join(cache.Dir, "archive-v0", "dd", "dd04.src"), "https://example.com/gone", digest("gone")); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+
+	summary, err := manager.VerifyDownloads(context.Background())
+	if err != nil {
+		t.Fatalf("VerifyDownloads: %v", err)
+	}
+	if summary.Verified != 1 || summary.Untracked != 1 {
+		t.Fatalf("unexpected summary: %+v", summary)
+	}
+	if len(summary.Missing) != 1 || summary.Missing[0] != "https://example.com/gone" {
+		t.Fatalf("unexpected missing: %v", summary.Missing)
+	}
+	if len(summary.Corrupt) != 1 || summary.Corrupt[0].URL != "https://example.com/bad" {
+		t.Fatalf("unexpected corrupt: %+v", summary.Corrupt)
+	}
+	if _, err := os.Stat(bad); !os.IsNotExist(err) {
+		t.Fatalf("expected corrupt entry moved, stat err: %v", err)
+	}
+	if _, err := os.Stat(summary.Corrupt[0].QuarantinedTo); err != nil {
+		t.Fatalf("expected quarantined file: %v", err)
+	}
+
+	db, err := cache.Checksums()
+	if err != nil {
+		t.Fatalf("Checksums: %v", err)
+	}
+	if len(db) != 1 {
+		t.Fatalf("expected only the good entry to remain, got %v", db)
+	}
+	if _, ok := db[good]; !ok {
+		t.Fatalf("expected good entry in database, got %v", db)
+	}
+}
+
+func TestVerifyDownloadsLeavesMirrorFilesAlone(t *testing.T) {
+	cache := fetch.NewCache(t.TempDir())
+	manager := &Manager{Fetch: cache, Workers: 1}
+
+	mirror := filepath.Join(t.TempDir(), "hello.tar.gz")
+	if err := os.WriteFile(mirror, []byte("changed since"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.RecordChecksum(mirror, "file://"+mirror, "0000"); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if db, err := cache.Checksums(); err != nil || len(db) != 0 {
+		t.Fatalf("Checksums = %v, %v; want a mirror file left out", db, err)
+	}
+	summary, err := manager.VerifyDownloads(context.Background())
+	if err != nil || len(summary.Corrupt) != 0 {
+		t.Fatalf("VerifyDownloads = %+v, %v", summary, err)
+	}
+	if _, err := os.Stat(mirror); err != nil {
+		t.Fatalf("mirror file was moved: %v", err)
+	}
+}
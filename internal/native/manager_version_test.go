@@ -0,0 +1,69 @@
+package native
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"1.10", "1.9", 1},
+		{"2.12.2", "2.12.10", -1},
+		{"1.0", "1.0", 0},
+		{"1.0_1", "1.0", 1},
+		{"1.0_10", "1.0_9", 1},
+		{"1.02", "1.2", 0},
+		{"130.0", "99.0.1", 1},
+		{"1.0", "1.0.1", -1},
+		{"HEAD-abc1234", "9.9", 1},
+	}
+	for _, tc := range cases {
+		if got := compareVersions(tc.a, tc.b); got != tc.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+		if got := compareVersions(tc.b, tc.a); got != -tc.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tc.b, tc.a, got, -tc.want)
+		}
+	}
+	if got := newestVersion([]string{"1.9", "1.10", "1.2"}); got != "1.10" {
+		t.Fatalf("newestVersion = %q, want 1.10", got)
+	}
+}
+
+func TestReadCaskReceiptPicksTheNewestVersion(t *testing.T) {
+	tmp := t.TempDir()
+	manager := &Manager{Paths: Paths{Caskroom: filepath.Join(tmp, "Caskroom")}}
+	for _, version := range []string{"9.0", "10.0"} {
+		if err := os.MkdirAll(filepath.Join(manager.Paths.Caskroom, "firefox", version), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	receipt, err := manager.readCaskReceipt("firefox")
+	if err != nil {
+		t.Fatalf("read receipt: %v", err)
+	}
+	if receipt.Version != "10.0" {
+		t.Fatalf("expected 10.0, got %q", receipt.Version)
+	}
+}
+
+func TestLatestInstalledVersionIsTheNewestKeg(t *testing.T) {
+	tmp := t.TempDir()
+	m := &Manager{Paths: Paths{Cellar: filepath.Join(tmp, "Cellar")}}
+	for _, version := range []string{"2.12.2", "2.12.10", "2.9"} {
+		if err := os.MkdirAll(filepath.Join(m.Paths.Cellar, "hello", version), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	version, err := m.latestInstalledVersion("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "2.12.10" {
+		t.Fatalf("expected 2.12.10, got %q", version)
+	}
+}
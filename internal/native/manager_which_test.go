@@ -0,0 +1,35 @@
+package native
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"ub/internal/apitest"
+)
+
+func TestWhichFollowsTheLinkFarm(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	server := apitest.New(t)
+	server.Setenv(t)
+	ctx := context.Background()
+
+	m := New(1)
+	if err := m.Install(ctx, []string{"hello", "greeter"}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	w, err := m.Which("hello")
+	if err != nil {
+		t.Fatalf("Which: %v", err)
+	}
+	if w.Formula != "hello" || w.Version != "2.12.2" || len(w.Chain) != 1 {
+		t.Fatalf("Which(hello) = %+v", w)
+	}
+	if w, err := m.Which("greeter"); err != nil || w.Cask != "greeter" || w.Formula != "" {
+		t.Fatalf("Which(greeter) = %+v, %v", w, err)
+	}
+	if _, err := m.Which("nope"); !errors.Is(err, ErrNotInstalled) {
+		t.Fatalf("expected ErrNotInstalled, got %v", err)
+	}
+}
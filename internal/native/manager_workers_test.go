@@ -0,0 +1,37 @@
+package native
+
+import "testing"
+
+func TestAutoWorkers(t *testing.T) {
+	const gib = 1 << 30
+	tests := []struct {
+		name              string
+		policy            WorkerPolicy
+		workers, download int
+	}{
+		{"unknown machine", WorkerPolicy{}, 1, 2},
+		{"cpu bound", WorkerPolicy{CPUs: 8, MemoryBytes: 32 * gib}, 8, 16},
+		{"memory bound", WorkerPolicy{CPUs: 8, MemoryBytes: 1 * gib}, 2, 4},
+		{"little memory still runs one", WorkerPolicy{CPUs: 8, MemoryBytes: 100 << 20}, 1, 2},
+		{"slow network", WorkerPolicy{CPUs: 4, Throughput: 1 << 20}, 4, 16},
+		{"fast network", WorkerPolicy{CPUs: 4, Throughput: 64 << 20}, 4, 4},
+		{"medium network", WorkerPolicy{CPUs: 2, Throughput: 10 << 20}, 2, 7},
+		{"many cpus", WorkerPolicy{CPUs: 32, Throughput: 1 << 20}, 32, 32},
+		{"max clamps both", WorkerPolicy{CPUs: 8, Throughput: 1 << 20, MaxJobs: 3}, 3, 3},
+		{"min raises both", WorkerPolicy{CPUs: 1, MemoryBytes: 100 << 20, MinJobs: 4}, 4, 8},
+	}
+	for _, tt := range tests {
+		workers, downloads := AutoWorkers(tt.policy)
+		if workers != tt.workers || downloads != tt.download {
+			t.Errorf("%s: AutoWorkers = %d, %d; want %d, %d", tt.name, workers, downloads, tt.workers, tt.download)
+		}
+	}
+}
+
+func TestUseAutoWorkersKeepsConfiguredDownloads(t *testing.T) {
+	m := &Manager{DownloadWorkers: 5, MaxWorkers: 2}
+	m.UseAutoWorkers(0)
+	if m.Workers < 1 || m.Workers > 2 || m.DownloadWorkers != 5 {
+		t.Fatalf("Workers = %d, DownloadWorkers = %d", m.Workers, m.DownloadWorkers)
+	}
+}
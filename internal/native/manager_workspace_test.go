@@ -0,0 +1,43 @@
+package native
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindWorkspaceLooksUpward(t *testing.T) {
+	root := t.TempDir()
+	nested := filepath.Join(root, "app", "src", "cmd")
+	if err := os.MkdirAll(nested, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := FindWorkspace(nested); ok {
+		t.Fatal("found a workspace before one was made")
+	}
+	workspace := filepath.Join(root, "app", WorkspaceDir)
+	if err := os.Mkdir(workspace, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if dir, ok := FindWorkspace(nested); !ok || dir != workspace {
+		t.Fatalf("FindWorkspace = %q, %v, want %q", dir, ok, workspace)
+	}
+}
+
+func TestUseWorkspaceKeepsTheDownloadCache(t *testing.T) {
+	t.Setenv("UB_BASE_DIR", t.TempDir())
+	m := New(1)
+	global := m.Paths
+	workspace := filepath.Join(t.TempDir(), WorkspaceDir)
+	m.UseWorkspace(workspace)
+
+	if m.Workspace != workspace || m.Paths.Cellar != filepath.Join(workspace, "Cellar") || m.Paths.Bin != filepath.Join(workspace, "bin") {
+		t.Fatalf("workspace paths = %+v", m.Paths)
+	}
+	if m.Paths.Repo != workspace {
+		t.Fatalf("expected taps kept in the workspace, got %s", m.Paths.Repo)
+	}
+	if m.Paths.Cache != global.Cache {
+		t.Fatalf("cache = %s, want the shared %s", m.Paths.Cache, global.Cache)
+	}
+}
@@ -0,0 +1,50 @@
+package native
+
+import (
+	"strings"
+
+	"ub/internal/state"
+)
+
+// A pin holds a formula or cask at its installed version: ub upgrade leaves
+// it alone until it is unpinned. ub apply pins what its manifest marks
+// pinned. This is unrelated to a tap pin, which picks where a formula is
+// built from.
+
+func pinKey(name string, cask bool) string {
+	if cask {
+		return "cask/" + name
+	}
+	return "formula/" + name
+}
+
+// Pin holds name at its installed version.
+func (m *Manager) Pin(name string, cask bool) error {
+	return m.updateState(func(tx *state.Tx) error {
+		return tx.Put(pinsBucket, pinKey(name, cask), true)
+	})
+}
+
+// Unpin lets ub upgrade name again. Unpinning what is not pinned does
+// nothing.
+func (m *Manager) Unpin(name string, cask bool) error {
+	return m.updateState(func(tx *state.Tx) error {
+		return tx.Delete(pinsBucket, pinKey(name, cask))
+	})
+}
+
+// pins returns the pinned formulae and casks by name.
+func (m *Manager) pins() (formulae, casks map[string]bool, err error) {
+	formulae, casks = map[string]bool{}, map[string]bool{}
+	err = m.readState(func(tx *state.Tx) error {
+		for _, key := range tx.Keys(pinsBucket) {
+			if name, ok := strings.CutPrefix(key, "cask/"); ok {
+				casks[name] = true
+			} else if name, ok := strings.CutPrefix(key, "formula/"); ok {
+				formulae[name] = true
+			}
+		}
+		return nil
+	})
+	return formulae, casks, err
+}
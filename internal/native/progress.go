@@ -0,0 +1,120 @@
+package native
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"ub/internal/fetch"
+	"ub/internal/homebrewapi"
+)
+
+// PlanProgress is the progress of one install across all of its jobs.
+type PlanProgress struct {
+	Jobs     int
+	DoneJobs int
+	// Bytes is the size of every download the install needs, as far as it
+	// is known, and DoneBytes how much of that is downloaded or cached.
+	Bytes     int64
+	DoneBytes int64
+}
+
+const (
+	// sizeLookups bounds the HEAD requests sizing an install's downloads.
+	sizeLookups       = 8
+	sizeLookupTimeout = 5 * time.Second
+)
+
+// expectDownloads sizes the downloads at urls before any starts, from the
+// cache or with HEAD requests, so progress has byte totals even for servers
+// that stream without a Content-Length. Sizes it cannot find are left out.
+func (m *Manager) expectDownloads(ctx context.Context, urls []string) map[string]int64 {
+	ctx, cancel := context.WithTimeout(ctx, sizeLookupTimeout)
+	defer cancel()
+	sizes := make(map[string]int64, len(urls))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, sizeLookups)
+	for _, url := range urls {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer func() { <-slots; wg.Done() }()
+			size, ok := m.Fetch.RemoteSize(ctx, url)
+			if !ok {
+				return
+			}
+			m.Fetch.ExpectSize(url, size)
+			mu.Lock()
+			sizes[url] = size
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return sizes
+}
+
+// bottleURLs lists the bottle downloads installing closure needs: none for
+// formulae whose keg is installed already.
+func (m *Manager) bottleURLs(closure map[string]homebrewapi.Formula, opts InstallOptions) []string {
+	urls := make([]string, 0, len(closure))
+	for name, f := range closure {
+		if m.isInstalled(name, f.Versions.Stable) {
+			continue
+		}
+		bottle, _, err := selectBottle(f, m.bottleTags(), opts)
+		if err != nil {
+			continue
+		}
+		if url, err := m.Plugins.RewriteURL(name, bottle.URL); err == nil {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// caskURLs is bottleURLs for casks.
+func (m *Manager) caskURLs(casks []homebrewapi.Cask) []string {
+	urls := make([]string, 0, len(casks))
+	for _, cask := range casks {
+		if url, err := m.Plugins.RewriteURL(cask.Token, cask.URL); err == nil {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// expect records the sizes of the install's downloads.
+func (r *installReporter) expect(sizes map[string]int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expected = sizes
+}
+
+// recordBytesLocked counts p towards the install's byte totals. A
+// download nothing sized ahead of time counts once it reports its size.
+func (r *installReporter) recordBytesLocked(p fetch.Progress) {
+	if r.expected == nil {
+		r.expected = map[string]int64{}
+	}
+	if r.fetched == nil {
+		r.fetched = map[string]int64{}
+	}
+	if _, ok := r.expected[p.URL]; !ok && p.TotalBytes > 0 {
+		r.expected[p.URL] = p.TotalBytes
+	}
+	done := p.DownloadedBytes
+	if p.Cached {
+		done = p.TotalBytes
+	}
+	r.fetched[p.URL] = done
+}
+
+func (r *installReporter) planLocked() PlanProgress {
+	p := PlanProgress{Jobs: r.totalJobs, DoneJobs: r.doneJobs}
+	for url, size := range r.expected {
+		p.Bytes += size
+		p.DoneBytes += min(r.fetched[url], size)
+	}
+	return p
+}
@@ -0,0 +1,96 @@
+package native
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"ub/internal/fetch"
+)
+
+// Provenance records where the bytes of a keg or cask came from, so an
+// audit can tell exactly what was installed. Receipts keep it under
+// "provenance".
+type Provenance struct {
+	fetch.Provenance
+	SHA256    string `json:"sha256"`
+	BottleTag string `json:"bottle_tag,omitempty"`
+}
+
+// provenance describes archive, fetched from url. sum is the sha256 it was
+// verified against; without one the archive is hashed.
+func (m *Manager) provenance(url, archive, sum, tag string) (Provenance, error) {
+	if !hasChecksum(sum) {
+		var err error
+		if sum, err = fileSHA256(archive); err != nil {
+			return Provenance{}, err
+		}
+	}
+	p := Provenance{Provenance: fetch.Provenance{URL: url}, SHA256: strings.ToLower(sum), BottleTag: tag}
+	// A local bottle file is read in place, not through the cache.
+	if strings.Contains(url, "://") {
+		p.Provenance = m.Fetch.Provenance(url)
+	}
+	return p, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := fetch.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func writeFormulaProvenance(kegDir string, p Provenance) error {
+	return updateFormulaReceipt(kegDir, func(receipt map[string]any) { receipt["provenance"] = p })
+}
+
+// kegProvenance reads the provenance from a keg's receipt. It is false for
+// kegs poured before ub recorded it and for kegs built from source.
+func kegProvenance(kegDir string) (Provenance, bool) {
+	data, err := os.ReadFile(filepath.Join(kegDir, "INSTALL_RECEIPT.json"))
+	if err != nil {
+		return Provenance{}, false
+	}
+	var receipt struct {
+		Provenance *Provenance `json:"provenance"`
+	}
+	if json.Unmarshal(data, &receipt) != nil || receipt.Provenance == nil {
+		return Provenance{}, false
+	}
+	return *receipt.Provenance, true
+}
+
+// provenanceLog carries provenance from a pipeline's fetch stage to its
+// receipt stage.
+type provenanceLog struct {
+	mu     sync.Mutex
+	byName map[string]Provenance
+}
+
+func (l *provenanceLog) set(name string, p Provenance) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.byName == nil {
+		l.byName = map[string]Provenance{}
+	}
+	l.byName[name] = p
+}
+
+func (l *provenanceLog) get(name string) (Provenance, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p, ok := l.byName[name]
+	return p, ok
+}
@@ -0,0 +1,45 @@
+package native
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	archiveExtension = regexp.MustCompile(`\.(tar\.gz|tar\.bz2|tar\.xz|tgz|zip)$`)
+	commitHash       = regexp.MustCompile(`^[0-9a-f]{40}$`)
+)
+
+// releaseNotesURL returns the GitHub release page of the tag source, a
+// formula's stable URL or a cask's download URL, was published from: an
+// archive of the tag, a release asset, or a git URL with tag. It is empty
+// when source is not on GitHub or names a branch or commit.
+func releaseNotesURL(source, tag string) string {
+	u, err := url.Parse(source)
+	if err != nil || !strings.EqualFold(u.Host, "github.com") {
+		return ""
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	owner, repo := parts[0], strings.TrimSuffix(parts[1], ".git")
+	switch {
+	case len(parts) == 2:
+	case len(parts) >= 4 && parts[2] == "archive":
+		ref := archiveExtension.ReplaceAllString(strings.Join(parts[3:], "/"), "")
+		if strings.HasPrefix(ref, "refs/heads/") {
+			return ""
+		}
+		tag = strings.TrimPrefix(ref, "refs/tags/")
+	case len(parts) >= 6 && parts[2] == "releases" && parts[3] == "download":
+		tag = parts[4]
+	default:
+		return ""
+	}
+	if tag == "" || commitHash.MatchString(tag) {
+		return ""
+	}
+	return "https://github.com/" + owner + "/" + repo + "/releases/tag/" + url.PathEscape(tag)
+}
@@ -0,0 +1,110 @@
+package native
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// NotFoundError is a name that is neither a formula nor a cask. It wraps
+// the API's error, so it still reads as a 404.
+type NotFoundError struct {
+	Name        string
+	Suggestions []string
+	Err         error
+}
+
+func (e *NotFoundError) Error() string {
+	msg := fmt.Sprintf("no formula or cask named %q", e.Name)
+	if len(e.Suggestions) > 0 {
+		msg += "; did you mean " + joinWithOr(e.Suggestions) + "?"
+	}
+	return msg
+}
+
+func (e *NotFoundError) Unwrap() error { return e.Err }
+
+// notFound turns the API's 404 for name into a NotFoundError suggesting the
+// formulae, casks and installed kegs spelled like it. Suggestions come from
+// the last-known-good indexes, so they cost no requests.
+func (m *Manager) notFound(name string, err error) error {
+	if !isNotFoundError(err) {
+		return err
+	}
+	candidates := append(m.API.IndexNames("formula"), m.API.IndexNames("cask")...)
+	for _, root := range []string{m.Paths.Cellar, m.Paths.Caskroom} {
+		entries, _ := os.ReadDir(root)
+		for _, entry := range entries {
+			if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+				candidates = append(candidates, entry.Name())
+			}
+		}
+	}
+	return &NotFoundError{Name: name, Suggestions: Suggest(name, candidates), Err: err}
+}
+
+// Suggest returns up to three candidates spelled like name, closest first.
+// A candidate qualifies within one edit for every three letters of name.
+func Suggest(name string, candidates []string) []string {
+	limit := max(1, min(3, len(name)/3))
+	type scored struct {
+		name string
+		dist int
+	}
+	var close []scored
+	seen := map[string]bool{}
+	for _, candidate := range candidates {
+		if candidate == name || seen[candidate] {
+			continue
+		}
+		seen[candidate] = true
+		if d := editDistance(strings.ToLower(name), strings.ToLower(candidate)); d <= limit {
+			close = append(close, scored{candidate, d})
+		}
+	}
+	sort.Slice(close, func(i, j int) bool {
+		if close[i].dist != close[j].dist {
+			return close[i].dist < close[j].dist
+		}
+		return close[i].name < close[j].name
+	})
+	out := make([]string, 0, 3)
+	for _, s := range close[:min(3, len(close))] {
+		out = append(out, s.name)
+	}
+	return out
+}
+
+// editDistance counts the insertions, deletions, substitutions and swaps of
+// neighbouring letters that turn a into b.
+func editDistance(a, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+func joinWithOr(items []string) string {
+	if len(items) < 2 {
+		return strings.Join(items, "")
+	}
+	return strings.Join(items[:len(items)-1], ", ") + " or " + items[len(items)-1]
+}
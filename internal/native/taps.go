@@ -0,0 +1,415 @@
+package native
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"ub/internal/fetch"
+	"ub/internal/formula"
+	"ub/internal/homebrewapi"
+	"ub/internal/messages"
+	"ub/internal/state"
+)
+
+// A tap pin makes ub build one formula from a local tap instead of pouring
+// the homebrew-core bottle, so an organization can ship a patched build of
+// a few tools while everything else still comes from core. The tap holds
+// formulae in the format under "Formula format" in the README.
+
+type TapPin struct {
+	Formula string `json:"formula"`
+	// Tap is the tap as given to PinTap; Dir is where it was found.
+	Tap string `json:"tap"`
+	Dir string `json:"dir"`
+}
+
+var tapNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+$`)
+
+// tapPinsFile is where older versions of ub kept the tap pins, before the
+// state store took them in.
+func (m *Manager) tapPinsFile() string {
+	return filepath.Join(m.Paths.Prefix, "var", "ub", "tap-pins.json")
+}
+
+// TapPins lists the pinned formulae by name.
+func (m *Manager) TapPins() ([]TapPin, error) {
+	pins, err := m.tapPins()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]TapPin, 0, len(pins))
+	for _, pin := range pins {
+		out = append(out, pin)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Formula < out[j].Formula })
+	return out, nil
+}
+
+func (m *Manager) tapPins() (map[string]TapPin, error) {
+	pins := map[string]TapPin{}
+	err := m.readState(func(tx *state.Tx) error {
+		if tx == nil {
+			var err error
+			pins, err = m.legacyTapPins()
+			return err
+		}
+		for _, name := range tx.Keys(tapPinsBucket) {
+			var pin TapPin
+			if _, err := tx.Get(tapPinsBucket, name, &pin); err != nil {
+				return err
+			}
+			pins[name] = pin
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pins, nil
+}
+
+func (m *Manager) legacyTapPins() (map[string]TapPin, error) {
+	data, err := os.ReadFile(m.tapPinsFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]TapPin{}, nil
+		}
+		return nil, err
+	}
+	var list []TapPin
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", m.tapPinsFile(), err)
+	}
+	pins := make(map[string]TapPin, len(list))
+	for _, pin := range list {
+		pins[pin.Formula] = pin
+	}
+	return pins, nil
+}
+
+// PinTap makes name build from tap, which is a directory or a user/repo
+// tap cloned under <repository>/Library/Taps/user/homebrew-repo. The tap
+// must hold a formula for name.
+func (m *Manager) PinTap(name, tap string) (TapPin, error) {
+	if err := formula.ValidName(name); err != nil {
+		return TapPin{}, fmt.Errorf("formula name %w", err)
+	}
+	dir, err := m.resolveTap(tap)
+	if err != nil {
+		return TapPin{}, err
+	}
+	if _, err := formula.LoadByName(dir, name); err != nil {
+		return TapPin{}, fmt.Errorf("tap %s: %w", tap, err)
+	}
+	pin := TapPin{Formula: name, Tap: tap, Dir: dir}
+	return pin, m.updateState(func(tx *state.Tx) error {
+		return tx.Put(tapPinsBucket, name, pin)
+	})
+}
+
+// UnpinTap returns name to homebrew-core. Kegs already built from the tap
+// stay installed until core has a newer version.
+func (m *Manager) UnpinTap(name string) error {
+	return m.updateState(func(tx *state.Tx) error {
+		ok, err := tx.Get(tapPinsBucket, name, &TapPin{})
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("formula %q is not pinned to a tap", name)
+		}
+		return tx.Delete(tapPinsBucket, name)
+	})
+}
+
+// tapDir is where the user/repo tap is cloned.
+func (m *Manager) tapDir(tap string) string {
+	user, repo, _ := strings.Cut(tap, "/")
+	return filepath.Join(m.Paths.Repo, "Library", "Taps", user, "homebrew-"+strings.TrimPrefix(repo, "homebrew-"))
+}
+
+func (m *Manager) resolveTap(tap string) (string, error) {
+	if info, err := os.Stat(tap); err == nil && info.IsDir() {
+		return filepath.Abs(tap)
+	}
+	if tapNamePattern.MatchString(tap) {
+		dir := m.tapDir(tap)
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir, nil
+		}
+		return "", fmt.Errorf("tap %s is not cloned at %s", tap, dir)
+	}
+	return "", fmt.Errorf("tap %s is not a directory", tap)
+}
+
+// CloneTap clones the user/repo tap from url, or from
+// github.com/user/homebrew-repo when url is empty, unless it is cloned
+// already.
+func (m *Manager) CloneTap(ctx context.Context, tap, url string) error {
+	if !tapNamePattern.MatchString(tap) {
+		return fmt.Errorf("tap %s is not a user/repo name", tap)
+	}
+	dir := m.tapDir(tap)
+	if info, err := os.Stat(dir); err == nil && info.IsDir() {
+		return nil
+	}
+	if url == "" {
+		url = "https://github.com/" + filepath.Base(filepath.Dir(dir)) + "/" + filepath.Base(dir)
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+		return err
+	}
+	if _, err := m.Fetch.FetchGit(ctx, url, fetch.GitRef{}, dir); err != nil {
+		return fmt.Errorf("clone tap %s: %w", tap, err)
+	}
+	return nil
+}
+
+// kegTap returns the tap a keg was built from, or "" for a bottle.
+func kegTap(kegDir string) string {
+	data, err := os.ReadFile(filepath.Join(kegDir, "INSTALL_RECEIPT.json"))
+	if err != nil {
+		return ""
+	}
+	var receipt struct {
+		Tap string `json:"tap"`
+	}
+	if json.Unmarshal(data, &receipt) != nil {
+		return ""
+	}
+	return receipt.Tap
+}
+
+// pinnedCurrent reports whether a pinned formula is installed at the tap's
+// version from a keg built from the tap.
+func (m *Manager) pinnedCurrent(pin TapPin, f formula.Formula) bool {
+	return m.isInstalled(pin.Formula, f.Version) && kegTap(filepath.Join(m.Paths.Cellar, pin.Formula, f.Version)) == pin.Tap
+}
+
+// installPinned builds the pinned formulae among names, and the pinned
+// formulae they depend on, from their taps. It returns the names left for
+// homebrew-core.
+func (m *Manager) installPinned(ctx context.Context, names []string, known map[string]homebrewapi.Formula, opts InstallOptions, markRequested bool) ([]string, error) {
+	pins, err := m.tapPins()
+	if err != nil || len(pins) == 0 {
+		return names, err
+	}
+	var pinned, rest []string
+	for _, name := range names {
+		if _, ok := pins[name]; ok {
+			pinned = append(pinned, name)
+		} else {
+			rest = append(rest, name)
+		}
+	}
+	var deps []string
+	if len(rest) > 0 && !opts.IgnoreDependencies {
+		plan, err := m.planInstall(ctx, rest, known, opts)
+		if err != nil {
+			return nil, err
+		}
+		for name := range plan.formulae {
+			if _, ok := pins[name]; ok && !slices.Contains(rest, name) {
+				deps = append(deps, name)
+			}
+		}
+		sort.Strings(deps)
+	}
+	if len(pinned) == 0 && len(deps) == 0 {
+		return names, nil
+	}
+
+	reporter := newInstallReporter(m.Paths, nil, nil)
+	b := pinBuild{manager: m, pins: pins, opts: opts, reporter: reporter, visiting: map[string]bool{}}
+	for _, name := range deps {
+		if err = b.build(ctx, name, false, true); err != nil {
+			break
+		}
+	}
+	for _, name := range pinned {
+		if err != nil {
+			break
+		}
+		err = b.build(ctx, name, markRequested && !opts.OnlyDependencies, !opts.OnlyDependencies)
+	}
+	if err != nil {
+		if completed := reporter.installedNames(); len(completed) > 0 {
+			return nil, &PartialError{Completed: completed, Err: err}
+		}
+		return nil, err
+	}
+	return rest, nil
+}
+
+type pinBuild struct {
+	manager  *Manager
+	pins     map[string]TapPin
+	opts     InstallOptions
+	reporter *installReporter
+	visiting map[string]bool
+}
+
+// build installs the dependencies of the pinned formula name, pinned ones
+// from their taps and the rest from homebrew-core, and then, when self is
+// set, builds name itself.
+func (b pinBuild) build(ctx context.Context, name string, onRequest, self bool) error {
+	m := b.manager
+	pin := b.pins[name]
+	if b.visiting[name] {
+		return fmt.Errorf("pinned formula %q depends on itself", name)
+	}
+	b.visiting[name] = true
+	defer delete(b.visiting, name)
+
+	f, err := formula.LoadByName(pin.Dir, name)
+	if err != nil {
+		return fmt.Errorf("tap %s: %w", pin.Tap, err)
+	}
+	if self && m.pinnedCurrent(pin, f) {
+		if onRequest {
+			if err := m.markRequested(name, f.Version); err != nil {
+				return err
+			}
+		}
+		b.reporter.printAlreadyInstalled(name, f.Version)
+		return nil
+	}
+	if !b.opts.IgnoreDependencies {
+		var core []string
+		for _, dep := range f.Deps {
+			if _, ok := b.pins[dep]; !ok {
+				core = append(core, dep)
+			} else if err := b.build(ctx, dep, false, true); err != nil {
+				return err
+			}
+		}
+		if len(core) > 0 {
+			if err := m.installFormulas(ctx, core, nil, InstallOptions{ForceBottle: b.opts.ForceBottle}, false); err != nil {
+				return err
+			}
+		}
+	}
+	if !self {
+		return nil
+	}
+
+	if err := m.EnsureLayout(); err != nil {
+		return err
+	}
+	lockHandle, err := m.acquireLock(ctx, m.Paths.Cellar)
+	if err != nil {
+		return err
+	}
+	defer lockHandle.Release()
+	workRoot := filepath.Join(m.Paths.Cache, "build")
+	if err := os.MkdirAll(workRoot, 0o755); err != nil {
+		return err
+	}
+	workDir, err := os.MkdirTemp(workRoot, strings.ReplaceAll(name, "/", "-")+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+	src, err := m.fetchTapSource(ctx, f, workDir)
+	if err != nil {
+		return fmt.Errorf("fetch %s source: %w", name, err)
+	}
+	// A bottle of the same version is replaced by the tap's build, which
+	// keeps its installed-on-request mark.
+	onRequest = onRequest || m.installedOnRequest(name)
+	restore, err := m.setKegAside(name, f.Version)
+	if err != nil {
+		return err
+	}
+	messages.Println(messages.BuildingHead, name, pin.Tap)
+	if err := m.buildKeg(ctx, name, f.Version, src, f.Build.Steps, onRequest, pin.Tap, b.reporter); err != nil {
+		return errors.Join(err, restore(false))
+	}
+	if err := restore(true); err != nil {
+		return err
+	}
+	return writeRuntimeDependencies(filepath.Join(m.Paths.Cellar, name, f.Version), f.Deps)
+}
+
+// setKegAside moves the keg for name at version out of the Cellar, so a
+// build can install into its place: the build's $PREFIX is the keg itself.
+// The returned func drops the old keg once the build succeeded, or puts it
+// back when it failed.
+func (m *Manager) setKegAside(name, version string) (func(built bool) error, error) {
+	kegDir := filepath.Join(m.Paths.Cellar, name, version)
+	if _, err := os.Lstat(kegDir); os.IsNotExist(err) {
+		return func(bool) error { return nil }, nil
+	}
+	stateDir := filepath.Join(m.Paths.Prefix, "var", "ub")
+	if err := os.MkdirAll(stateDir, 0o755); err != nil {
+		return nil, err
+	}
+	aside, err := os.MkdirTemp(stateDir, "previous-keg-")
+	if err != nil {
+		return nil, err
+	}
+	previous := filepath.Join(aside, version)
+	if err := os.Rename(kegDir, previous); err != nil {
+		_ = os.RemoveAll(aside)
+		return nil, fmt.Errorf("move %s aside: %w", kegDir, err)
+	}
+	return func(built bool) error {
+		if !built {
+			// buildKeg removed whatever the failed build left behind.
+			if err := os.RemoveAll(kegDir); err != nil {
+				return err
+			}
+			if err := os.Rename(previous, kegDir); err != nil {
+				return fmt.Errorf("restore %s: %w", kegDir, err)
+			}
+		}
+		return os.RemoveAll(aside)
+	}, nil
+}
+
+// fetchTapSource checks out or downloads and unpacks the formula's source
+// under workDir, applies its patches, and returns the directory to build
+// in: an archive's single top-level directory when it has one.
+func (m *Manager) fetchTapSource(ctx context.Context, f formula.Formula, workDir string) (string, error) {
+	src := f.Source
+	srcDir := filepath.Join(workDir, "src")
+	if src.Branch != "" || src.Tag != "" || src.Revision != "" || fetch.IsGitURL(src.URL) {
+		ref := fetch.GitRef{Branch: src.Branch, Tag: src.Tag, Revision: src.Revision}
+		if _, err := m.Fetch.FetchGit(ctx, src.URL, ref, srcDir); err != nil {
+			return "", err
+		}
+	} else {
+		archive, err := m.Fetch.Fetch(ctx, src.URL)
+		if err != nil {
+			return "", err
+		}
+		if err := verifySHA256(archive, src.SHA256); err != nil {
+			return "", err
+		}
+		if err := os.MkdirAll(srcDir, 0o755); err != nil {
+			return "", err
+		}
+		if err := extractArchive(ctx, archive, srcDir, m.extractOptions()); err != nil {
+			return "", fmt.Errorf("unpack source: %w", err)
+		}
+		entries, err := os.ReadDir(srcDir)
+		if err != nil {
+			return "", err
+		}
+		if len(entries) == 1 && entries[0].IsDir() {
+			srcDir = filepath.Join(srcDir, entries[0].Name())
+		}
+	}
+	if err := formula.ApplyPatches(ctx, m.Fetch, f.Patches, srcDir); err != nil {
+		return "", err
+	}
+	return srcDir, nil
+}
@@ -0,0 +1,58 @@
+package native
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+)
+
+// compareVersions orders two keg or cask version directory names, reading
+// runs of digits as numbers so 1.10 is newer than 1.9 and 2.12.10 than
+// 2.12.2. Everything else, including the _N revision separator, compares
+// byte by byte.
+func compareVersions(a, b string) int {
+	for a != "" && b != "" {
+		ra, restA := versionRun(a)
+		rb, restB := versionRun(b)
+		if isDigit(ra[0]) && isDigit(rb[0]) {
+			na, nb := strings.TrimLeft(ra, "0"), strings.TrimLeft(rb, "0")
+			if len(na) != len(nb) {
+				return cmp.Compare(len(na), len(nb))
+			}
+			if c := strings.Compare(na, nb); c != 0 {
+				return c
+			}
+		} else if c := strings.Compare(ra, rb); c != 0 {
+			return c
+		}
+		a, b = restA, restB
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+// newestVersion returns the newest of versions, or "" when there are none.
+func newestVersion(versions []string) string {
+	if len(versions) == 0 {
+		return ""
+	}
+	return slices.MaxFunc(versions, compareVersions)
+}
+
+// sortVersions orders versions oldest first.
+func sortVersions(versions []string) {
+	slices.SortFunc(versions, compareVersions)
+}
+
+// versionRun splits s after its leading run of digits or of non-digits.
+func versionRun(s string) (run, rest string) {
+	digits := isDigit(s[0])
+	i := 1
+	for i < len(s) && isDigit(s[i]) == digits {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
@@ -0,0 +1,100 @@
+package native
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Which describes an executable in the link farm.
+type Which struct {
+	// Path is the entry in bin or sbin.
+	Path string
+	// Chain is every symlink hop from Path to the file that runs.
+	Chain []string
+	// Formula and Version name the keg the executable belongs to, or Cask
+	// and Version the cask. Both are empty when ub did not put it there.
+	Formula string
+	Cask    string
+	Version string
+}
+
+// maxLinkHops bounds Which on a symlink loop.
+const maxLinkHops = 40
+
+// Which looks name up in bin, then sbin, and follows its links to the keg
+// or cask providing it.
+func (m *Manager) Which(name string) (Which, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return Which{}, fmt.Errorf("invalid executable name %q", name)
+	}
+	var w Which
+	for _, dir := range []string{m.Paths.Bin, m.Paths.Sbin} {
+		path := filepath.Join(dir, name)
+		if _, err := os.Lstat(path); err == nil {
+			w.Path = path
+			break
+		}
+	}
+	if w.Path == "" {
+		return Which{}, fmt.Errorf("%s is %w in %s or %s", name, ErrNotInstalled, m.Paths.Bin, m.Paths.Sbin)
+	}
+	path := w.Path
+	for range maxLinkHops {
+		target, err := os.Readlink(path)
+		if err != nil {
+			break
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		path = filepath.Clean(target)
+		w.Chain = append(w.Chain, path)
+		if w.Formula == "" && w.Cask == "" {
+			w.Formula, w.Version = kegOf(m.Paths.Cellar, path)
+			if w.Formula == "" {
+				w.Cask, w.Version = kegOf(m.Paths.Caskroom, path)
+			}
+		}
+	}
+	if w.Formula == "" && w.Cask == "" {
+		w.Cask, w.Version = m.caskLinking(w.Path)
+	}
+	return w, nil
+}
+
+// caskLinking returns the installed cask whose receipt lists path among its
+// linked binaries, which point into the app rather than the Caskroom.
+func (m *Manager) caskLinking(path string) (string, string) {
+	entries, err := os.ReadDir(m.Paths.Caskroom)
+	if err != nil {
+		return "", ""
+	}
+	for _, entry := range entries {
+		receipt, err := m.readCaskReceipt(entry.Name())
+		if err != nil {
+			continue
+		}
+		for _, linked := range receipt.LinkedBinaries {
+			if filepath.Clean(linked) == path {
+				return receipt.Token, receipt.Version
+			}
+		}
+	}
+	return "", ""
+}
+
+// kegOf returns the package and version directories path lies under in
+// root, a Cellar or Caskroom.
+func kegOf(root, path string) (string, string) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", ""
+	}
+	parts := strings.SplitN(filepath.ToSlash(rel), "/", 3)
+	if len(parts) < 3 {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
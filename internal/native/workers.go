@@ -0,0 +1,104 @@
+package native
+
+import (
+	"bufio"
+	"math"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	// extractMemory is the memory one extraction job is budgeted.
+	extractMemory = 512 << 20
+	// targetThroughput is the combined download rate auto tuning aims for;
+	// more connections than that needs are wasted on a fast link.
+	targetThroughput = 64 << 20
+	maxAutoDownloads = 16
+)
+
+// WorkerPolicy is what --jobs auto tunes from. Zero fields are unknown, or
+// for MinJobs and MaxJobs, unset.
+type WorkerPolicy struct {
+	CPUs        int
+	MemoryBytes int64
+	// Throughput is the measured bytes per second of one download.
+	Throughput float64
+	MinJobs    int
+	MaxJobs    int
+}
+
+// AutoWorkers picks extraction and download worker counts for p. Extraction
+// is CPU and memory bound, so it gets at most one job per CPU and per
+// extractMemory of free memory. Downloads are network bound and get as many
+// connections as it takes to reach targetThroughput, but never fewer than
+// the extraction jobs they feed. MinJobs and MaxJobs clamp both counts.
+func AutoWorkers(p WorkerPolicy) (workers, downloads int) {
+	workers = max(p.CPUs, 1)
+	if p.MemoryBytes > 0 {
+		workers = min(workers, max(int(p.MemoryBytes/extractMemory), 1))
+	}
+	workers = clampJobs(workers, p)
+
+	downloads = 2 * workers
+	if p.Throughput > 0 {
+		downloads = int(math.Ceil(targetThroughput / p.Throughput))
+		downloads = min(max(downloads, workers), max(maxAutoDownloads, workers))
+	}
+	return workers, clampJobs(downloads, p)
+}
+
+func clampJobs(n int, p WorkerPolicy) int {
+	if p.MaxJobs > 0 {
+		n = min(n, p.MaxJobs)
+	}
+	return max(n, p.MinJobs, 1)
+}
+
+// UseAutoWorkers sets Workers, and DownloadWorkers unless it was configured,
+// from this machine's CPUs and free memory and the given throughput, within
+// MinWorkers and MaxWorkers.
+func (m *Manager) UseAutoWorkers(throughput float64) {
+	workers, downloads := AutoWorkers(WorkerPolicy{
+		CPUs:        runtime.NumCPU(),
+		MemoryBytes: availableMemory(),
+		Throughput:  throughput,
+		MinJobs:     m.MinWorkers,
+		MaxJobs:     m.MaxWorkers,
+	})
+	m.Workers = workers
+	if m.DownloadWorkers <= 0 {
+		m.DownloadWorkers = downloads
+	}
+}
+
+// availableMemory is the memory free for new work in bytes, or 0 where it
+// cannot be read. macOS does not report it cheaply, so half of physical
+// memory stands in.
+func availableMemory() int64 {
+	switch runtime.GOOS {
+	case "linux":
+		f, err := os.Open("/proc/meminfo")
+		if err != nil {
+			return 0
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+				kb, _ := strconv.ParseInt(fields[1], 10, 64)
+				return kb << 10
+			}
+		}
+	case "darwin":
+		out, err := exec.Command("sysctl", "-n", "hw.memsize").Output()
+		if err == nil {
+			total, _ := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+			return total / 2
+		}
+	}
+	return 0
+}
@@ -0,0 +1,55 @@
+package native
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// WorkspaceDir is the name of a project-local prefix, found by looking in
+// the working directory and each directory above it, like a virtualenv.
+const WorkspaceDir = ".ub"
+
+// FindWorkspace returns the nearest WorkspaceDir directory at or above start.
+func FindWorkspace(start string) (string, bool) {
+	dir, err := filepath.Abs(start)
+	if err != nil {
+		return "", false
+	}
+	for {
+		candidate := filepath.Join(dir, WorkspaceDir)
+		if info, err := os.Stat(candidate); err == nil && info.IsDir() {
+			return candidate, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// PathsForWorkspace returns the layout of a project-local prefix at dir: its
+// own Cellar, Caskroom, link farm, taps and install state, all inside dir.
+// Downloads are the same whatever the prefix, so the download cache is
+// shared with global, and fonts only work in the user font directory.
+func PathsForWorkspace(global Paths, dir string) Paths {
+	dir = firstPath(dir)
+	return Paths{
+		BaseDir:      dir,
+		Prefix:       dir,
+		Repo:         dir,
+		Cellar:       filepath.Join(dir, "Cellar"),
+		Caskroom:     filepath.Join(dir, "Caskroom"),
+		Cache:        global.Cache,
+		Bin:          filepath.Join(dir, "bin"),
+		Sbin:         filepath.Join(dir, "sbin"),
+		Applications: filepath.Join(dir, "Applications"),
+		Fonts:        global.Fonts,
+	}
+}
+
+// UseWorkspace switches m to the project-local prefix at dir.
+func (m *Manager) UseWorkspace(dir string) {
+	m.UsePaths(PathsForWorkspace(m.Paths, dir))
+	m.Workspace = m.Paths.Prefix
+}
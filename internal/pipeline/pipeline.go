@@ -0,0 +1,182 @@
+// Package pipeline is the install flow shared by the native manager and the
+// tap engine: resolve → plan → fetch → materialize → link → receipt. The
+// caller plugs in a Source that knows how to turn one package into an
+// installed tree (pouring a bottle, or building a tap formula); the pipeline
+// owns dependency walking, job ordering and the stage sequence.
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"ub/internal/scheduler"
+	"ub/internal/trace"
+)
+
+type Package struct {
+	Name    string
+	Version string
+	Deps    []string
+	// Cost is a hint for the scheduler, such as the download size in bytes;
+	// zero means unknown.
+	Cost int64
+}
+
+// Lookup returns the metadata for one package.
+type Lookup func(ctx context.Context, name string) (Package, error)
+
+type PlanOptions struct {
+	// Installed reports the version of name already in place. Roots are
+	// asked for their wanted version, dependencies with an empty version
+	// (any keg will do). Nil means nothing is installed.
+	Installed func(name, version string) (string, bool)
+	// IgnoreDependencies skips the dependencies of roots.
+	IgnoreDependencies bool
+	// OnlyDependencies plans the dependencies of roots but not the roots.
+	OnlyDependencies bool
+}
+
+type Plan struct {
+	// Install holds the packages that need to go through the stages.
+	Install map[string]Package
+	// Satisfied maps packages already in place to their installed version.
+	Satisfied map[string]string
+}
+
+// Resolve walks the dependency graph from roots. Dependencies that are
+// already installed are satisfied without being looked up or descended
+// into, so up-to-date kegs cost no metadata requests.
+func Resolve(ctx context.Context, roots []string, lookup Lookup, opts PlanOptions) (Plan, error) {
+	plan := Plan{Install: map[string]Package{}, Satisfied: map[string]string{}}
+	installed := opts.Installed
+	if installed == nil {
+		installed = func(string, string) (string, bool) { return "", false }
+	}
+	rootSet := make(map[string]bool, len(roots))
+	for _, name := range roots {
+		rootSet[name] = true
+	}
+	visited := map[string]bool{}
+	visiting := map[string]bool{}
+
+	var visit func(string) error
+	visit = func(name string) error {
+		if visited[name] {
+			return nil
+		}
+		if visiting[name] {
+			return fmt.Errorf("dependency cycle detected at %q", name)
+		}
+		isRoot := rootSet[name]
+		if !isRoot {
+			if version, ok := installed(name, ""); ok {
+				plan.Satisfied[name] = version
+				visited[name] = true
+				return nil
+			}
+		}
+		visiting[name] = true
+
+		p, err := lookup(ctx, name)
+		if err != nil {
+			return err
+		}
+		if version, ok := installed(name, p.Version); isRoot && !opts.OnlyDependencies && ok {
+			plan.Satisfied[name] = version
+		} else {
+			if !(isRoot && opts.IgnoreDependencies) {
+				for _, dep := range p.Deps {
+					if err := visit(dep); err != nil {
+						return fmt.Errorf("resolve dependency %q for %q: %w", dep, name, err)
+					}
+				}
+			}
+			if !(isRoot && opts.OnlyDependencies) {
+				plan.Install[name] = p
+			}
+		}
+
+		visiting[name] = false
+		visited[name] = true
+		return nil
+	}
+
+	for _, root := range roots {
+		if err := visit(root); err != nil {
+			return Plan{}, err
+		}
+	}
+	return plan, nil
+}
+
+// Unit is one package moving through the stages. Stages record on it what
+// later stages need.
+type Unit struct {
+	Package
+	// Root is set for packages the caller named; Requested starts out equal
+	// to it and a Source may widen it, e.g. to keep an earlier keg's flag.
+	Root      bool
+	Requested bool
+	// Artifact is what Fetch produced: an archive or a source checkout.
+	Artifact string
+	// Dir is the installed tree, set by Materialize and updated by Link.
+	Dir string
+}
+
+// Skip may be returned by any stage to end a unit early without failing,
+// for instance when the package turns out to be installed already.
+var Skip = errors.New("skip remaining stages")
+
+// Source implements the stages for one kind of package.
+type Source interface {
+	Fetch(ctx context.Context, u *Unit) error
+	Materialize(ctx context.Context, u *Unit) error
+	Link(ctx context.Context, u *Unit) error
+	Receipt(ctx context.Context, u *Unit) error
+}
+
+// Jobs turns the packages of a plan into scheduler jobs that run the stages
+// of src in order. Dependencies outside packages are assumed satisfied.
+func Jobs(src Source, packages map[string]Package, roots []string) ([]scheduler.Job, error) {
+	rootSet := make(map[string]bool, len(roots))
+	for _, name := range roots {
+		rootSet[name] = true
+	}
+	graph := make(scheduler.Graph, len(packages))
+	for name, p := range packages {
+		requires := make([]string, 0, len(p.Deps))
+		for _, dep := range p.Deps {
+			if _, ok := packages[dep]; ok {
+				requires = append(requires, dep)
+			}
+		}
+		graph[name] = requires
+	}
+	run := func(name string) func(context.Context) error {
+		p := packages[name]
+		return func(ctx context.Context) error {
+			ctx, span := trace.Start(ctx, "ub.install.formula", trace.String("ub.formula", p.Name), trace.String("ub.version", p.Version))
+			u := &Unit{Package: p, Root: rootSet[name], Requested: rootSet[name]}
+			err := runStages(ctx, u, src.Fetch, src.Materialize, src.Link, src.Receipt)
+			span.End(err)
+			return err
+		}
+	}
+	return graph.Jobs(run, func(name string) int64 { return packages[name].Cost })
+}
+
+func runStages(ctx context.Context, u *Unit, stages ...func(context.Context, *Unit) error) error {
+	for _, stage := range stages {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := stage(ctx, u); err != nil {
+			if errors.Is(err, Skip) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"ub/internal/scheduler"
+)
+
+func testLookup(graph map[string][]string, looked *[]string) Lookup {
+	return func(_ context.Context, name string) (Package, error) {
+		*looked = append(*looked, name)
+		deps, ok := graph[name]
+		if !ok {
+			return Package{}, fmt.Errorf("no formula %q", name)
+		}
+		return Package{Name: name, Version: "1.0", Deps: deps}, nil
+	}
+}
+
+func TestResolveSkipsInstalledDependencies(t *testing.T) {
+	graph := map[string][]string{"jq": {"oniguruma"}, "oniguruma": {"pcre"}, "pcre": nil}
+	var looked []string
+	plan, err := Resolve(context.Background(), []string{"jq"}, testLookup(graph, &looked), PlanOptions{
+		Installed: func(name, version string) (string, bool) {
+			return "6.9.9", name == "oniguruma" && version == ""
+		},
+	})
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if len(plan.Install) != 1 || plan.Install["jq"].Name != "jq" {
+		t.Fatalf("install = %v, want only jq", plan.Install)
+	}
+	if plan.Satisfied["oniguruma"] != "6.9.9" {
+		t.Fatalf("satisfied = %v", plan.Satisfied)
+	}
+	if strings.Join(looked, ",") != "jq" {
+		t.Fatalf("looked up %v, want only jq", looked)
+	}
+
+	looked = nil
+	plan, err = Resolve(context.Background(), []string{"jq"}, testLookup(graph, &looked), PlanOptions{OnlyDependencies: true})
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if _, ok := plan.Install["jq"]; ok || len(plan.Install) != 2 {
+		t.Fatalf("install = %v, want the dependencies only", plan.Install)
+	}
+}
+
+func TestResolveReportsCycles(t *testing.T) {
+	var looked []string
+	_, err := Resolve(context.Background(), []string{"a"}, testLookup(map[string][]string{"a": {"b"}, "b": {"a"}}, &looked), PlanOptions{})
+	if err == nil || !strings.Contains(err.Error(), "dependency cycle detected") {
+		t.Fatalf("expected cycle error, got %v", err)
+	}
+}
+
+type recordingSource struct {
+	mu    sync.Mutex
+	calls []string
+	skip  string
+}
+
+func (s *recordingSource) record(stage string, u *Unit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, stage+":"+u.Name)
+	if stage == "fetch" && u.Name == s.skip {
+		return Skip
+	}
+	return nil
+}
+
+func (s *recordingSource) Fetch(_ context.Context, u *Unit) error {
+	return s.record("fetch", u)
+}
+
+func (s *recordingSource) Materialize(_ context.Context, u *Unit) error {
+	return s.record("materialize", u)
+}
+
+func (s *recordingSource) Link(_ context.Context, u *Unit) error {
+	return s.record("link", u)
+}
+
+func (s *recordingSource) Receipt(_ context.Context, u *Unit) error {
+	return s.record("receipt", u)
+}
+
+func TestJobsRunStagesInDependencyOrder(t *testing.T) {
+	src := &recordingSource{skip: "libfoo"}
+	packages := map[string]Package{
+		"app":    {Name: "app", Version: "1.0", Deps: []string{"libbar", "libfoo", "preinstalled"}},
+		"libbar": {Name: "libbar", Version: "1.0"},
+		"libfoo": {Name: "libfoo", Version: "1.0", Deps: []string{"libbar"}},
+	}
+	jobs, err := Jobs(src, packages, []string{"app"})
+	if err != nil {
+		t.Fatalf("Jobs: %v", err)
+	}
+	if err := (scheduler.Executor{Workers: 1}).Run(context.Background(), jobs); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	want := "fetch:libbar materialize:libbar link:libbar receipt:libbar fetch:libfoo fetch:app materialize:app link:app receipt:app"
+	if got := strings.Join(src.calls, " "); got != want {
+		t.Fatalf("calls = %s\nwant %s", got, want)
+	}
+}
@@ -0,0 +1,311 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	HookResolve     = "resolve"
+	HookFetch       = "fetch"
+	HookPostInstall = "post_install"
+
+	serviceName = "Plugin"
+)
+
+type ManifestRequest struct{}
+
+type ManifestResponse struct {
+	Name  string
+	Hooks []string
+}
+
+type ResolveRequest struct {
+	Name string
+	Kind string
+}
+
+type ResolveResponse struct {
+	// Name replaces the requested package name when non-empty.
+	Name string
+}
+
+type FetchRequest struct {
+	Name string
+	URL  string
+}
+
+type FetchResponse struct {
+	// URL replaces the artifact URL when non-empty.
+	URL string
+}
+
+type PostInstallRequest struct {
+	Name    string
+	Version string
+	Kind    string
+	Path    string
+}
+
+type PostInstallResponse struct{}
+
+// Hooks is implemented by plugin executables and served with Serve.
+// Returning an error from any hook aborts the operation it guards.
+type Hooks interface {
+	Manifest() ManifestResponse
+	Resolve(ResolveRequest) (ResolveResponse, error)
+	Fetch(FetchRequest) (FetchResponse, error)
+	PostInstall(PostInstallRequest) error
+}
+
+type rpcService struct {
+	impl Hooks
+}
+
+func (s *rpcService) Manifest(_ *ManifestRequest, resp *ManifestResponse) error {
+	*resp = s.impl.Manifest()
+	return nil
+}
+
+func (s *rpcService) Resolve(req *ResolveRequest, resp *ResolveResponse) error {
+	out, err := s.impl.Resolve(*req)
+	*resp = out
+	return err
+}
+
+func (s *rpcService) Fetch(req *FetchRequest, resp *FetchResponse) error {
+	out, err := s.impl.Fetch(*req)
+	*resp = out
+	return err
+}
+
+func (s *rpcService) PostInstall(req *PostInstallRequest, _ *PostInstallResponse) error {
+	return s.impl.PostInstall(*req)
+}
+
+// Serve runs a plugin over stdin/stdout until ub closes the connection.
+func Serve(impl Hooks) {
+	ServeConn(impl, stdioConn{})
+}
+
+func ServeConn(impl Hooks, conn io.ReadWriteCloser) {
+	server := rpc.NewServer()
+	if err := server.RegisterName(serviceName, &rpcService{impl: impl}); err != nil {
+		panic(err)
+	}
+	server.ServeCodec(jsonrpc.NewServerCodec(conn))
+}
+
+type stdioConn struct{}
+
+func (stdioConn) Read(p []byte) (int, error)  { return os.Stdin.Read(p) }
+func (stdioConn) Write(p []byte) (int, error) { return os.Stdout.Write(p) }
+func (stdioConn) Close() error {
+	_ = os.Stdin.Close()
+	return os.Stdout.Close()
+}
+
+type client struct {
+	name  string
+	hooks map[string]bool
+	rpc   *rpc.Client
+	cmd   *exec.Cmd
+}
+
+func newClient(name string, conn io.ReadWriteCloser) (*client, error) {
+	c := &client{name: name, rpc: jsonrpc.NewClient(conn), hooks: map[string]bool{}}
+	var manifest ManifestResponse
+	if err := c.rpc.Call(serviceName+".Manifest", &ManifestRequest{}, &manifest); err != nil {
+		_ = c.rpc.Close()
+		return nil, fmt.Errorf("plugin %q manifest: %w", name, err)
+	}
+	if strings.TrimSpace(manifest.Name) != "" {
+		c.name = manifest.Name
+	}
+	for _, hook := range manifest.Hooks {
+		c.hooks[hook] = true
+	}
+	return c, nil
+}
+
+func (c *client) close() error {
+	err := c.rpc.Close()
+	if c.cmd != nil {
+		_ = c.cmd.Wait()
+	}
+	return err
+}
+
+// Host fans hook calls out to every loaded plugin in name order. A nil Host
+// is valid and behaves as if no plugins were installed.
+type Host struct {
+	mu      sync.Mutex
+	clients []*client
+}
+
+func DefaultDir(configDir string) string {
+	if dir := strings.TrimSpace(os.Getenv("UB_PLUGIN_DIR")); dir != "" {
+		return dir
+	}
+	return filepath.Join(configDir, "plugins")
+}
+
+func Load(ctx context.Context, dir string) (*Host, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Host{}, nil
+		}
+		return nil, fmt.Errorf("read plugin dir: %w", err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.Mode()&0o111 == 0 {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	host := &Host{}
+	for _, name := range names {
+		c, err := startPlugin(ctx, name, filepath.Join(dir, name))
+		if err != nil {
+			_ = host.Close()
+			return nil, err
+		}
+		host.clients = append(host.clients, c)
+	}
+	return host, nil
+}
+
+func startPlugin(ctx context.Context, name, path string) (*client, error) {
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("plugin %q stdin: %w", name, err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("plugin %q stdout: %w", name, err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start plugin %q: %w", name, err)
+	}
+	c, err := newClient(name, pipeConn{ReadCloser: stdout, WriteCloser: stdin})
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, err
+	}
+	c.cmd = cmd
+	return c, nil
+}
+
+type pipeConn struct {
+	io.ReadCloser
+	io.WriteCloser
+}
+
+func (p pipeConn) Close() error {
+	werr := p.WriteCloser.Close()
+	rerr := p.ReadCloser.Close()
+	if werr != nil {
+		return werr
+	}
+	return rerr
+}
+
+func (h *Host) Names() []string {
+	if h == nil {
+		return nil
+	}
+	out := make([]string, 0, len(h.clients))
+	for _, c := range h.clients {
+		out = append(out, c.name)
+	}
+	return out
+}
+
+func (h *Host) Resolve(name, kind string) (string, error) {
+	if h == nil {
+		return name, nil
+	}
+	for _, c := range h.clients {
+		if !c.hooks[HookResolve] {
+			continue
+		}
+		var resp ResolveResponse
+		if err := c.rpc.Call(serviceName+".Resolve", &ResolveRequest{Name: name, Kind: kind}, &resp); err != nil {
+			return "", fmt.Errorf("plugin %q rejected %q: %w", c.name, name, err)
+		}
+		if strings.TrimSpace(resp.Name) != "" {
+			name = resp.Name
+		}
+	}
+	return name, nil
+}
+
+func (h *Host) RewriteURL(name, url string) (string, error) {
+	if h == nil {
+		return url, nil
+	}
+	for _, c := range h.clients {
+		if !c.hooks[HookFetch] {
+			continue
+		}
+		var resp FetchResponse
+		if err := c.rpc.Call(serviceName+".Fetch", &FetchRequest{Name: name, URL: url}, &resp); err != nil {
+			return "", fmt.Errorf("plugin %q rejected download of %q: %w", c.name, name, err)
+		}
+		if strings.TrimSpace(resp.URL) != "" {
+			url = resp.URL
+		}
+	}
+	return url, nil
+}
+
+func (h *Host) PostInstall(req PostInstallRequest) error {
+	if h == nil {
+		return nil
+	}
+	for _, c := range h.clients {
+		if !c.hooks[HookPostInstall] {
+			continue
+		}
+		if err := c.rpc.Call(serviceName+".PostInstall", &req, &PostInstallResponse{}); err != nil {
+			return fmt.Errorf("plugin %q post-install for %q: %w", c.name, req.Name, err)
+		}
+	}
+	return nil
+}
+
+func (h *Host) Close() error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var firstErr error
+	for _, c := range h.clients {
+		if err := c.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	h.clients = nil
+	return firstErr
+}
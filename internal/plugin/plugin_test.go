@@ -0,0 +1,99 @@
+package plugin
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+type fakeHooks struct {
+	posted []PostInstallRequest
+}
+
+func (f *fakeHooks) Manifest() ManifestResponse {
+	return ManifestResponse{Name: "policy", Hooks: []string{HookResolve, HookFetch, HookPostInstall}}
+}
+
+func (f *fakeHooks) Resolve(req ResolveRequest) (ResolveResponse, error) {
+	if req.Name == "forbidden" {
+		return ResolveResponse{}, errors.New("blocked by policy")
+	}
+	if req.Name == "rg" {
+		return ResolveResponse{Name: "ripgrep"}, nil
+	}
+	return ResolveResponse{}, nil
+}
+
+func (f *fakeHooks) Fetch(req FetchRequest) (FetchResponse, error) {
+	return FetchResponse{URL: "https://mirror.internal/" + req.Name}, nil
+}
+
+func (f *fakeHooks) PostInstall(req PostInstallRequest) error {
+	f.posted = append(f.posted, req)
+	return nil
+}
+
+func newPipeHost(t *testing.T, impl Hooks) *Host {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	go ServeConn(impl, serverConn)
+	c, err := newClient("fake", clientConn)
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	host := &Host{clients: []*client{c}}
+	t.Cleanup(func() { _ = host.Close() })
+	return host
+}
+
+func TestHostDispatchesHooks(t *testing.T) {
+	impl := &fakeHooks{}
+	host := newPipeHost(t, impl)
+
+	if got := host.Names(); len(got) != 1 || got[0] != "policy" {
+		t.Fatalf("Names() = %v", got)
+	}
+	name, err := host.Resolve("rg", "")
+	if err != nil || name != "ripgrep" {
+		t.Fatalf("Resolve() = %q, %v", name, err)
+	}
+	if _, err := host.Resolve("forbidden", ""); err == nil {
+		t.Fatal("expected policy rejection")
+	}
+	url, err := host.RewriteURL("jq", "https://ghcr.io/jq")
+	if err != nil || url != "https://mirror.internal/jq" {
+		t.Fatalf("RewriteURL() = %q, %v", url, err)
+	}
+	if err := host.PostInstall(PostInstallRequest{Name: "jq", Version: "1.7", Kind: "formula"}); err != nil {
+		t.Fatalf("PostInstall: %v", err)
+	}
+	if len(impl.posted) != 1 || impl.posted[0].Name != "jq" {
+		t.Fatalf("posted = %+v", impl.posted)
+	}
+}
+
+func TestNilHostIsNoop(t *testing.T) {
+	var host *Host
+	if name, err := host.Resolve("jq", ""); err != nil || name != "jq" {
+		t.Fatalf("Resolve() = %q, %v", name, err)
+	}
+	if url, err := host.RewriteURL("jq", "u"); err != nil || url != "u" {
+		t.Fatalf("RewriteURL() = %q, %v", url, err)
+	}
+	if err := host.PostInstall(PostInstallRequest{}); err != nil {
+		t.Fatalf("PostInstall: %v", err)
+	}
+	if err := host.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestLoadMissingDirReturnsEmptyHost(t *testing.T) {
+	host, err := Load(t.Context(), t.TempDir()+"/missing")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(host.Names()) != 0 {
+		t.Fatalf("expected no plugins, got %v", host.Names())
+	}
+}
@@ -0,0 +1,105 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Graph maps each job id to the ids it requires. It is how callers that
+// already hold a dependency graph, such as a resolved install plan, get
+// jobs without building Job types of their own.
+type Graph map[string][]string
+
+// Check reports a requirement on an id missing from the graph, or a cycle.
+// Executor.Run calls it before starting anything, so a bad graph fails the
+// same way whoever built it.
+func (g Graph) Check() error {
+	ids := g.ids()
+	for _, id := range ids {
+		for _, dep := range g[id] {
+			if _, ok := g[dep]; !ok {
+				return fmt.Errorf("job %q requires unknown job %q", id, dep)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int, len(g))
+	var stack []string
+	var visit func(string) error
+	visit = func(id string) error {
+		switch state[id] {
+		case done:
+			return nil
+		case visiting:
+			start := len(stack) - 1
+			for stack[start] != id {
+				start--
+			}
+			return fmt.Errorf("dependency cycle: %s -> %s", strings.Join(stack[start:], " -> "), id)
+		}
+		state[id] = visiting
+		stack = append(stack, id)
+		for _, dep := range g[id] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[id] = done
+		return nil
+	}
+	for _, id := range ids {
+		if err := visit(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Jobs checks the graph and returns one job per id, sorted by id, that runs
+// work(id). cost may be nil; otherwise it is the job's Coster hint.
+func (g Graph) Jobs(work func(id string) func(context.Context) error, cost func(id string) int64) ([]Job, error) {
+	if err := g.Check(); err != nil {
+		return nil, err
+	}
+	jobs := make([]Job, 0, len(g))
+	for _, id := range g.ids() {
+		j := graphJob{id: id, requires: g[id], run: work(id)}
+		if cost != nil {
+			j.cost = cost(id)
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+func (g Graph) ids() []string {
+	ids := make([]string, 0, len(g))
+	for id := range g {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+type graphJob struct {
+	id       string
+	requires []string
+	run      func(context.Context) error
+	cost     int64
+}
+
+func (j graphJob) ID() string { return j.id }
+
+func (j graphJob) Requires() []string { return j.requires }
+
+func (j graphJob) Run(ctx context.Context) error { return j.run(ctx) }
+
+func (j graphJob) Cost() int64 { return j.cost }
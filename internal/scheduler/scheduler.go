@@ -1,6 +1,7 @@
 package scheduler
 
 import (
+	"container/heap"
 	"context"
 	"fmt"
 	"sync"
@@ -20,6 +21,34 @@ func WorkerID(ctx context.Context) (int, bool) {
 	return workerID, ok
 }
 
+// Phase is what a running job is bound by. Jobs start in PhaseNetwork and
+// call EnterPhase around CPU- or disk-heavy work such as extraction.
+type Phase int
+
+const (
+	PhaseNetwork Phase = iota
+	PhaseCPU
+)
+
+const phaseGateContextKey contextKey = "ub.scheduler.phaseGate"
+
+// EnterPhase blocks until the job may run in phase and returns a function
+// that leaves it again. Outside an Executor, or with no CPUWorkers limit,
+// it returns immediately.
+func EnterPhase(ctx context.Context, phase Phase) (release func(), err error) {
+	gate, _ := ctx.Value(phaseGateContextKey).(chan struct{})
+	if phase != PhaseCPU || gate == nil {
+		return func() {}, nil
+	}
+	select {
+	case gate <- struct{}{}:
+		var once sync.Once
+		return func() { once.Do(func() { <-gate }) }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 type Job interface {
 	ID() string
 	Requires() []string
@@ -27,10 +56,13 @@ type Job interface {
 }
 
 type Executor struct {
-	Workers        int
-	OnJobStart     func(workerID int, jobID string)
-	OnJobComplete  func(workerID int, jobID string)
-	OnJobError     func(workerID int, jobID string, err error)
+	Workers       int
+	OnJobStart    func(workerID int, jobID string)
+	OnJobComplete func(workerID int, jobID string)
+	OnJobError    func(workerID int, jobID string, err error)
+	// CPUWorkers caps how many jobs may be in PhaseCPU at once, so Workers
+	// can be set higher for network-bound work; zero means no extra cap.
+	CPUWorkers int
 }
 
 func (e Executor) Run(ctx context.Context, jobs []Job) error {
@@ -41,6 +73,7 @@ func (e Executor) Run(ctx context.Context, jobs []Job) error {
 	jobByID := make(map[string]Job, len(jobs))
 	dependents := make(map[string][]string, len(jobs))
 	inDegree := make(map[string]int, len(jobs))
+	graph := make(Graph, len(jobs))
 
 	for _, j := range jobs {
 		id := j.ID()
@@ -49,22 +82,34 @@ func (e Executor) Run(ctx context.Context, jobs []Job) error {
 		}
 		jobByID[id] = j
 		inDegree[id] = len(j.Requires())
+		graph[id] = j.Requires()
+	}
+	if err := graph.Check(); err != nil {
+		return err
 	}
 
 	for _, j := range jobs {
 		for _, dep := range j.Requires() {
-			if _, ok := jobByID[dep]; !ok {
-				return fmt.Errorf("job %q requires unknown job %q", j.ID(), dep)
-			}
 			dependents[dep] = append(dependents[dep], j.ID())
 		}
 	}
 
+	priority := priorities(jobByID, dependents)
+
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	if e.CPUWorkers > 0 && e.CPUWorkers < e.Workers {
+		// Workers bounds network-bound jobs; only CPUWorkers of them may
+		// be in PhaseCPU at once.
+		ctx = context.WithValue(ctx, phaseGateContextKey, make(chan struct{}, e.CPUWorkers))
+	}
 
-	ready := make(chan string, len(jobs))
-	completed := make(chan string, len(jobs))
+	// Both channels are unbuffered: a job leaves the ready queue only when a
+	// worker is free to take it, and a worker's completion is processed
+	// before it can take another, so the dependents it unblocks compete for
+	// that slot.
+	dispatch := make(chan string)
+	completed := make(chan string)
 	errs := make(chan error, 1)
 
 	var workerWG sync.WaitGroup
@@ -76,7 +121,7 @@ func (e Executor) Run(ctx context.Context, jobs []Job) error {
 				select {
 				case <-ctx.Done():
 					return
-				case id, ok := <-ready:
+				case id, ok := <-dispatch:
 					if !ok {
 						return
 					}
@@ -108,29 +153,30 @@ func (e Executor) Run(ctx context.Context, jobs []Job) error {
 		}(workerID)
 	}
 
-	queued := map[string]bool{}
+	ready := &readyQueue{priority: priority}
 	for id, deg := range inDegree {
 		if deg == 0 {
-			queued[id] = true
-			ready <- id
+			heap.Push(ready, id)
 		}
 	}
 
-	if len(queued) == 0 && len(jobs) > 0 {
-		close(ready)
-		workerWG.Wait()
-		return fmt.Errorf("no initial runnable jobs; cycle likely present")
-	}
-
 	finished := 0
 	for finished < len(jobs) {
+		var out chan string
+		var next string
+		if ready.Len() > 0 {
+			out = dispatch
+			next = ready.ids[0]
+		}
 		select {
+		case out <- next:
+			heap.Pop(ready)
 		case err := <-errs:
-			close(ready)
+			close(dispatch)
 			workerWG.Wait()
 			return err
 		case <-ctx.Done():
-			close(ready)
+			close(dispatch)
 			workerWG.Wait()
 			if len(errs) > 0 {
 				return <-errs
@@ -141,16 +187,85 @@ func (e Executor) Run(ctx context.Context, jobs []Job) error {
 			for _, dependent := range dependents[id] {
 				inDegree[dependent]--
 				if inDegree[dependent] == 0 {
-					if !queued[dependent] {
-						queued[dependent] = true
-						ready <- dependent
-					}
+					heap.Push(ready, dependent)
 				}
 			}
 		}
 	}
 
-	close(ready)
+	close(dispatch)
 	workerWG.Wait()
 	return nil
 }
+
+// Coster is implemented by jobs that can estimate their cost, such as a
+// bottle's download size. Jobs without it, or with a non-positive cost,
+// count as 1.
+type Coster interface {
+	Cost() int64
+}
+
+func jobCost(j Job) int64 {
+	if c, ok := j.(Coster); ok {
+		if cost := c.Cost(); cost > 0 {
+			return cost
+		}
+	}
+	return 1
+}
+
+// priorities gives each job its own cost plus that of the most expensive
+// chain of jobs waiting on it. Dispatching the highest first starts the
+// long poles early instead of leaving them for the end of the run.
+func priorities(jobByID map[string]Job, dependents map[string][]string) map[string]int64 {
+	priority := make(map[string]int64, len(jobByID))
+	visiting := map[string]bool{}
+	var visit func(string) int64
+	visit = func(id string) int64 {
+		if p, ok := priority[id]; ok {
+			return p
+		}
+		if visiting[id] {
+			// Cycles never become ready; their priority does not matter.
+			return 0
+		}
+		visiting[id] = true
+		var longest int64
+		for _, dependent := range dependents[id] {
+			longest = max(longest, visit(dependent))
+		}
+		priority[id] = jobCost(jobByID[id]) + longest
+		return priority[id]
+	}
+	for id := range jobByID {
+		visit(id)
+	}
+	return priority
+}
+
+// readyQueue is a max-heap of runnable job ids by priority, ties broken by
+// id so runs are reproducible.
+type readyQueue struct {
+	ids      []string
+	priority map[string]int64
+}
+
+func (q *readyQueue) Len() int { return len(q.ids) }
+
+func (q *readyQueue) Less(i, j int) bool {
+	pi, pj := q.priority[q.ids[i]], q.priority[q.ids[j]]
+	if pi != pj {
+		return pi > pj
+	}
+	return q.ids[i] < q.ids[j]
+}
+
+func (q *readyQueue) Swap(i, j int) { q.ids[i], q.ids[j] = q.ids[j], q.ids[i] }
+
+func (q *readyQueue) Push(x any) { q.ids = append(q.ids, x.(string)) }
+
+func (q *readyQueue) Pop() any {
+	last := q.ids[len(q.ids)-1]
+	q.ids = q.ids[:len(q.ids)-1]
+	return last
+}
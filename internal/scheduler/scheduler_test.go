@@ -77,6 +77,65 @@ func TestExecutorStopsOnFailure(t *testing.T) {
 	}
 }
 
+func TestExecutorRejectsBadGraphs(t *testing.T) {
+	cases := map[string]struct {
+		jobs []Job
+		want string
+	}{
+		"unknown": {
+			jobs: []Job{testJob{id: "a", requires: []string{"missing"}}},
+			want: `job "a" requires unknown job "missing"`,
+		},
+		// b and c form a cycle behind a runnable job, which used to hang.
+		"cycle": {
+			jobs: []Job{
+				testJob{id: "a"},
+				testJob{id: "b", requires: []string{"a", "c"}},
+				testJob{id: "c", requires: []string{"b"}},
+			},
+			want: "dependency cycle: b -> c -> b",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := Executor{Workers: 2}.Run(context.Background(), tc.jobs)
+			if err == nil || err.Error() != tc.want {
+				t.Fatalf("Run error = %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestGraphJobsRunWork(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	graph := Graph{"app": {"lib"}, "lib": nil}
+	jobs, err := graph.Jobs(func(id string) func(context.Context) error {
+		return func(context.Context) error {
+			mu.Lock()
+			order = append(order, id)
+			mu.Unlock()
+			return nil
+		}
+	}, func(id string) int64 { return int64(len(id)) })
+	if err != nil {
+		t.Fatalf("Jobs: %v", err)
+	}
+	if len(jobs) != 2 || jobs[0].ID() != "app" || jobs[0].(Coster).Cost() != 3 {
+		t.Fatalf("unexpected jobs: %+v", jobs)
+	}
+	if err := (Executor{Workers: 2}).Run(context.Background(), jobs); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(order) != 2 || order[0] != "lib" {
+		t.Fatalf("run order = %v, want lib first", order)
+	}
+
+	if _, err := (Graph{"a": {"a"}}).Jobs(nil, nil); err == nil || err.Error() != "dependency cycle: a -> a" {
+		t.Fatalf("Jobs error = %v", err)
+	}
+}
+
 func TestExecutorRunsJobsInParallel(t *testing.T) {
 	jobs := []Job{
 		testJob{id: "a", delay: 200 * time.Millisecond},
@@ -94,3 +153,83 @@ func TestExecutorRunsJobsInParallel(t *testing.T) {
 		t.Fatalf("expected parallel execution to finish faster, elapsed=%s", elapsed)
 	}
 }
+
+type costedJob struct {
+	testJob
+	cost int64
+}
+
+func (j costedJob) Cost() int64 { return j.cost }
+
+func TestExecutorStartsLongPolesFirst(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	record := func(id string) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, id)
+	}
+	jobs := []Job{
+		costedJob{testJob{id: "small", onRun: record}, 1},
+		costedJob{testJob{id: "medium", onRun: record}, 100},
+		// lib is cheap but unblocks the most expensive job.
+		costedJob{testJob{id: "lib", onRun: record}, 1},
+		costedJob{testJob{id: "huge", requires: []string{"lib"}, onRun: record}, 1000},
+		testJob{id: "plain", onRun: record},
+	}
+	if err := (Executor{Workers: 1}).Run(context.Background(), jobs); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"lib", "huge", "medium", "plain", "small"}
+	for i := range want {
+		if i >= len(order) || order[i] != want[i] {
+			t.Fatalf("order = %v, want %v", order, want)
+		}
+	}
+}
+
+func TestExecutorCapsJobsInCPUPhase(t *testing.T) {
+	var mu sync.Mutex
+	var inCPU, maxCPU, running, maxRunning int
+	track := func(counter, peak *int, delta int) {
+		mu.Lock()
+		defer mu.Unlock()
+		*counter += delta
+		*peak = max(*peak, *counter)
+	}
+	jobs := make([]Job, 0, 6)
+	for _, id := range []string{"a", "b", "c", "d", "e", "f"} {
+		jobs = append(jobs, phasedJob{id: id, run: func(ctx context.Context) error {
+			track(&running, &maxRunning, 1)
+			defer track(&running, &maxRunning, -1)
+			time.Sleep(20 * time.Millisecond) // downloading
+			release, err := EnterPhase(ctx, PhaseCPU)
+			if err != nil {
+				return err
+			}
+			defer release()
+			track(&inCPU, &maxCPU, 1)
+			defer track(&inCPU, &maxCPU, -1)
+			time.Sleep(20 * time.Millisecond)
+			return nil
+		}})
+	}
+	if err := (Executor{Workers: 6, CPUWorkers: 2}).Run(context.Background(), jobs); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if maxCPU > 2 {
+		t.Fatalf("%d jobs were in the CPU phase at once, want at most 2", maxCPU)
+	}
+	if maxRunning < 3 {
+		t.Fatalf("only %d jobs ran at once, want network phases to overlap", maxRunning)
+	}
+}
+
+type phasedJob struct {
+	id  string
+	run func(context.Context) error
+}
+
+func (j phasedJob) ID() string                    { return j.id }
+func (j phasedJob) Requires() []string            { return nil }
+func (j phasedJob) Run(ctx context.Context) error { return j.run(ctx) }
@@ -0,0 +1,332 @@
+package selfupdate
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultRepo    = "JadenMajid/ub"
+	DefaultAPIBase = "https://api.github.com"
+	ChannelStable  = "stable"
+	ChannelDev     = "dev"
+	checksumsAsset = "checksums.txt"
+	signatureAsset = "checksums.txt.sig"
+)
+
+// releaseKey is the base64 ed25519 key whose private half signs every
+// release's checksums.txt; scripts/release.sh refuses to sign with any other.
+//
+//go:embed release_key.pub
+var releaseKey string
+
+// PublicKey replaces the embedded key for a build of a fork that publishes
+// its own releases: -ldflags "-X ub/internal/selfupdate.PublicKey=...".
+var PublicKey string
+
+func publicKey() string {
+	if key := strings.TrimSpace(PublicKey); key != "" {
+		return key
+	}
+	return strings.TrimSpace(releaseKey)
+}
+
+var ErrNoAsset = errors.New("no release asset for this platform")
+
+type Asset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+type Release struct {
+	Tag        string  `json:"tag_name"`
+	Draft      bool    `json:"draft"`
+	Prerelease bool    `json:"prerelease"`
+	Assets     []Asset `json:"assets"`
+}
+
+func (r Release) Version() string {
+	return strings.TrimPrefix(r.Tag, "v")
+}
+
+func (r Release) asset(name string) (Asset, bool) {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a, true
+		}
+	}
+	return Asset{}, false
+}
+
+type Updater struct {
+	Repo    string
+	APIBase string
+	Client  *http.Client
+}
+
+func New() *Updater {
+	repo := strings.TrimSpace(os.Getenv("UB_REPO"))
+	if repo == "" {
+		repo = DefaultRepo
+	}
+	return &Updater{Repo: repo, APIBase: DefaultAPIBase, Client: &http.Client{Timeout: 2 * time.Minute}}
+}
+
+func AssetName(goos, goarch string) string {
+	return fmt.Sprintf("ub-%s-%s.tar.gz", goos, goarch)
+}
+
+// LatestRelease returns the newest published release on channel: the latest
+// stable release, or the newest release including prereleases for dev.
+func (u *Updater) LatestRelease(ctx context.Context, channel string) (Release, error) {
+	switch channel {
+	case "", ChannelStable:
+		var rel Release
+		if err := u.getJSON(ctx, fmt.Sprintf("%s/repos/%s/releases/latest", u.APIBase, u.Repo), &rel); err != nil {
+			return Release{}, err
+		}
+		return rel, nil
+	case ChannelDev:
+		var releases []Release
+		if err := u.getJSON(ctx, fmt.Sprintf("%s/repos/%s/releases?per_page=20", u.APIBase, u.Repo), &releases); err != nil {
+			return Release{}, err
+		}
+		for _, rel := range releases {
+			if !rel.Draft {
+				return rel, nil
+			}
+		}
+		return Release{}, fmt.Errorf("no releases published for %s", u.Repo)
+	default:
+		return Release{}, fmt.Errorf("unknown channel %q (expected %s or %s)", channel, ChannelStable, ChannelDev)
+	}
+}
+
+// Install downloads the platform archive from rel, verifies it against the
+// release checksums and their signature, and atomically replaces executable
+// with the binary inside. A release without a valid signature is refused.
+func (u *Updater) Install(ctx context.Context, rel Release, goos, goarch, executable string) error {
+	name := AssetName(goos, goarch)
+	archiveAsset, ok := rel.asset(name)
+	if !ok {
+		return fmt.Errorf("%w: %s in %s", ErrNoAsset, name, rel.Tag)
+	}
+	sumsAsset, ok := rel.asset(checksumsAsset)
+	if !ok {
+		return fmt.Errorf("release %s has no %s", rel.Tag, checksumsAsset)
+	}
+
+	key := publicKey()
+	if key == "" {
+		return fmt.Errorf("this ub was built without a release key, so it cannot verify updates")
+	}
+	sigAsset, ok := rel.asset(signatureAsset)
+	if !ok {
+		return fmt.Errorf("release %s is unsigned", rel.Tag)
+	}
+
+	sums, err := u.download(ctx, sumsAsset.URL)
+	if err != nil {
+		return err
+	}
+	sig, err := u.download(ctx, sigAsset.URL)
+	if err != nil {
+		return err
+	}
+	if err := verifySignature(key, sums, sig); err != nil {
+		return err
+	}
+	expected, err := checksumFor(sums, name)
+	if err != nil {
+		return err
+	}
+
+	archive, err := u.download(ctx, archiveAsset.URL)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(archive)
+	if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, expected) {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", name, expected, got)
+	}
+
+	binary, err := binaryFromArchive(archive)
+	if err != nil {
+		return err
+	}
+	return replaceExecutable(executable, binary)
+}
+
+// CompareVersions orders two release versions such as 0.2.0 and 0.3.0-rc1
+// the way semver does: numerically field by field, with a prerelease older
+// than the release it leads up to.
+func CompareVersions(a, b string) int {
+	coreA, preA, _ := strings.Cut(strings.TrimPrefix(a, "v"), "-")
+	coreB, preB, _ := strings.Cut(strings.TrimPrefix(b, "v"), "-")
+	if c := compareFields(coreA, coreB); c != 0 {
+		return c
+	}
+	switch {
+	case preA == preB:
+		return 0
+	case preA == "":
+		return 1
+	case preB == "":
+		return -1
+	}
+	return compareFields(preA, preB)
+}
+
+// compareFields compares dot-separated fields, numerically when both are
+// numbers. A version with more fields is newer than its prefix.
+func compareFields(a, b string) int {
+	fieldsA, fieldsB := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(fieldsA) && i < len(fieldsB); i++ {
+		na, errA := strconv.Atoi(fieldsA[i])
+		nb, errB := strconv.Atoi(fieldsB[i])
+		var c int
+		if errA == nil && errB == nil {
+			c = cmp.Compare(na, nb)
+		} else {
+			c = strings.Compare(fieldsA[i], fieldsB[i])
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(fieldsA), len(fieldsB))
+}
+
+func (u *Updater) getJSON(ctx context.Context, url string, out any) error {
+	data, err := u.download(ctx, url)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("parse release metadata: %w", err)
+	}
+	return nil
+}
+
+func (u *Updater) download(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("User-Agent", "ub-self-update")
+	client := u.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("download %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("download %s: unexpected status %d", url, resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("download %s: %w", url, err)
+	}
+	return data, nil
+}
+
+func verifySignature(publicKey string, message, signature []byte) error {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid embedded release public key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("decode release signature: %w", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), message, sig) {
+		return fmt.Errorf("release signature does not match")
+	}
+	return nil
+}
+
+// checksumFor reads a sha256sum-style file ("<hex>  <name>" per line).
+func checksumFor(sums []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("%s is not listed in %s", name, checksumsAsset)
+}
+
+func binaryFromArchive(archive []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, fmt.Errorf("open release archive: %w", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("release archive does not contain ub")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read release archive: %w", err)
+		}
+		if header.Typeflag == tar.TypeReg && filepath.Base(header.Name) == "ub" {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+// replaceExecutable writes binary next to path and renames it into place, so
+// the running process keeps its old inode and nothing sees a partial file.
+func replaceExecutable(path string, binary []byte) error {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".ub-update-*")
+	if err != nil {
+		return fmt.Errorf("create temp executable: %w", err)
+	}
+	tmpPath := tmp.Name()
+	if _, err := tmp.Write(binary); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("write temp executable: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("write temp executable: %w", err)
+	}
+	if err := os.Chmod(tmpPath, 0o755); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("chmod temp executable: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("replace executable: %w", err)
+	}
+	return nil
+}
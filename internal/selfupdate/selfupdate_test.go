@@ -0,0 +1,224 @@
+package selfupdate
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func releaseArchive(t *testing.T, content string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: "ub", Mode: 0o755, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+	if _, err := tw.Write([]byte(content)); err != nil {
+		t.Fatalf("write body: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("close gzip: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// releaseKeyForTest replaces the release key with a fresh one and returns
+// its private half.
+func releaseKeyForTest(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	old := PublicKey
+	PublicKey = base64.StdEncoding.EncodeToString(pub)
+	t.Cleanup(func() { PublicKey = old })
+	return priv
+}
+
+func sign(priv ed25519.PrivateKey, sums string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte(sums)))
+}
+
+func newReleaseServer(t *testing.T, archive []byte, sums string, sig string) *httptest.Server {
+	t.Helper()
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asset := func(name string) Asset { return Asset{Name: name, URL: server.URL + "/download/" + name} }
+		stable := Release{Tag: "v0.2.0", Assets: []Asset{asset(AssetName("linux", "amd64")), asset("checksums.txt")}}
+		if sig != "" {
+			stable.Assets = append(stable.Assets, asset("checksums.txt.sig"))
+		}
+		switch r.URL.Path {
+		case "/repos/o/ub/releases/latest":
+			_ = json.NewEncoder(w).Encode(stable)
+		case "/repos/o/ub/releases":
+			_ = json.NewEncoder(w).Encode([]Release{{Tag: "v0.3.0-rc1", Draft: true}, {Tag: "v0.3.0-rc0", Prerelease: true}, stable})
+		case "/download/" + AssetName("linux", "amd64"):
+			_, _ = w.Write(archive)
+		case "/download/checksums.txt":
+			_, _ = w.Write([]byte(sums))
+		case "/download/checksums.txt.sig":
+			_, _ = w.Write([]byte(sig))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestLatestReleaseChannels(t *testing.T) {
+	server := newReleaseServer(t, nil, "", "")
+	u := &Updater{Repo: "o/ub", APIBase: server.URL}
+
+	rel, err := u.LatestRelease(context.Background(), ChannelStable)
+	if err != nil || rel.Version() != "0.2.0" {
+		t.Fatalf("stable release = %q, %v", rel.Tag, err)
+	}
+	rel, err = u.LatestRelease(context.Background(), ChannelDev)
+	if err != nil || rel.Tag != "v0.3.0-rc0" {
+		t.Fatalf("dev release = %q, %v", rel.Tag, err)
+	}
+	if _, err := u.LatestRelease(context.Background(), "nightly"); err == nil {
+		t.Fatalf("expected unknown channel error")
+	}
+}
+
+func TestInstallVerifiesAndReplacesExecutable(t *testing.T) {
+	archive := releaseArchive(t, "new-binary")
+	sum := sha256.Sum256(archive)
+	sums := fmt.Sprintf("%s  %s\n", hex.EncodeToString(sum[:]), AssetName("linux", "amd64"))
+	server := newReleaseServer(t, archive, sums, sign(releaseKeyForTest(t), sums))
+	u := &Updater{Repo: "o/ub", APIBase: server.URL}
+
+	exe := filepath.Join(t.TempDir(), "ub")
+	if err := os.WriteFile(exe, []byte("old-binary"), 0o755); err != nil {
+		t.Fatalf("write exe: %v", err)
+	}
+	rel, err := u.LatestRelease(context.Background(), ChannelStable)
+	if err != nil {
+		t.Fatalf("LatestRelease: %v", err)
+	}
+	if err := u.Install(context.Background(), rel, "linux", "amd64", exe); err != nil {
+		t.Fatalf("Install: %v", err)
+	}
+	data, err := os.ReadFile(exe)
+	if err != nil || string(data) != "new-binary" {
+		t.Fatalf("executable = %q, %v", data, err)
+	}
+	if err := u.Install(context.Background(), rel, "darwin", "arm64", exe); err == nil {
+		t.Fatalf("expected missing asset error")
+	}
+}
+
+func TestInstallRejectsBadChecksum(t *testing.T) {
+	archive := releaseArchive(t, "tampered")
+	sums := fmt.Sprintf("%s  %s\n", strings.Repeat("0", 64), AssetName("linux", "amd64"))
+	server := newReleaseServer(t, archive, sums, sign(releaseKeyForTest(t), sums))
+	u := &Updater{Repo: "o/ub", APIBase: server.URL}
+
+	exe := filepath.Join(t.TempDir(), "ub")
+	if err := os.WriteFile(exe, []byte("old-binary"), 0o755); err != nil {
+		t.Fatalf("write exe: %v", err)
+	}
+	rel, _ := u.LatestRelease(context.Background(), ChannelStable)
+	if err := u.Install(context.Background(), rel, "linux", "amd64", exe); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	if data, _ := os.ReadFile(exe); string(data) != "old-binary" {
+		t.Fatalf("executable replaced despite bad checksum")
+	}
+}
+
+func TestInstallRequiresASignature(t *testing.T) {
+	priv := releaseKeyForTest(t)
+
+	archive := releaseArchive(t, "signed")
+	sum := sha256.Sum256(archive)
+	sums := fmt.Sprintf("%s  %s\n", hex.EncodeToString(sum[:]), AssetName("linux", "amd64"))
+	exe := filepath.Join(t.TempDir(), "ub")
+	if err := os.WriteFile(exe, []byte("old"), 0o755); err != nil {
+		t.Fatalf("write exe: %v", err)
+	}
+
+	unsigned := &Updater{Repo: "o/ub", APIBase: newReleaseServer(t, archive, sums, "").URL}
+	rel, _ := unsigned.LatestRelease(context.Background(), ChannelStable)
+	if err := unsigned.Install(context.Background(), rel, "linux", "amd64", exe); err == nil {
+		t.Fatalf("expected unsigned release to be rejected")
+	}
+
+	_, other, _ := ed25519.GenerateKey(nil)
+	forged := &Updater{Repo: "o/ub", APIBase: newReleaseServer(t, archive, sums, sign(other, sums)).URL}
+	rel, _ = forged.LatestRelease(context.Background(), ChannelStable)
+	if err := forged.Install(context.Background(), rel, "linux", "amd64", exe); err == nil {
+		t.Fatalf("expected a release signed with another key to be rejected")
+	}
+
+	signed := &Updater{Repo: "o/ub", APIBase: newReleaseServer(t, archive, sums, sign(priv, sums)).URL}
+	rel, _ = signed.LatestRelease(context.Background(), ChannelStable)
+	if err := signed.Install(context.Background(), rel, "linux", "amd64", exe); err != nil {
+		t.Fatalf("Install signed: %v", err)
+	}
+}
+
+func TestInstallFailsClosedWithoutAKey(t *testing.T) {
+	oldKey, oldEmbedded := PublicKey, releaseKey
+	PublicKey, releaseKey = "", ""
+	defer func() { PublicKey, releaseKey = oldKey, oldEmbedded }()
+
+	archive := releaseArchive(t, "signed")
+	sum := sha256.Sum256(archive)
+	sums := fmt.Sprintf("%s  %s\n", hex.EncodeToString(sum[:]), AssetName("linux", "amd64"))
+	_, priv, _ := ed25519.GenerateKey(nil)
+	u := &Updater{Repo: "o/ub", APIBase: newReleaseServer(t, archive, sums, sign(priv, sums)).URL}
+	rel, _ := u.LatestRelease(context.Background(), ChannelStable)
+	exe := filepath.Join(t.TempDir(), "ub")
+	if err := u.Install(context.Background(), rel, "linux", "amd64", exe); err == nil || !strings.Contains(err.Error(), "without a release key") {
+		t.Fatalf("expected Install to refuse without a key, got %v", err)
+	}
+}
+
+func TestEmbeddedReleaseKeyIsValid(t *testing.T) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(releaseKey))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		t.Fatalf("release_key.pub is not a base64 ed25519 public key: %v", err)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"0.2.0", "0.2.0", 0},
+		{"0.10.0", "0.9.0", 1},
+		{"v0.2.1", "0.2.0", 1},
+		{"0.3.0-rc1", "0.3.0", -1},
+		{"0.3.0-rc1", "0.2.0", 1},
+		{"0.3.0-rc.10", "0.3.0-rc.9", 1},
+		{"1.0", "1.0.1", -1},
+	}
+	for _, tc := range cases {
+		if got := CompareVersions(tc.a, tc.b); got != tc.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
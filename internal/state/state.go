@@ -0,0 +1,258 @@
+// Package state is ub's embedded store: a bbolt database under the prefix
+// that records what is installed, tap pins, the history log and keg
+// manifests, so commands read one file instead of walking the prefix, and
+// concurrent ub processes take turns updating it.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	bolterrors "go.etcd.io/bbolt/errors"
+)
+
+// schemaVersion is bumped when the layout of a bucket changes. Version 1
+// only indexed the receipts, so its buckets are dropped and taken in from
+// the prefix again; later versions hold records kept nowhere else, so a
+// migration from them must rewrite the records in place.
+const schemaVersion = 2
+
+var (
+	metaBucket = []byte("meta")
+	schemaKey  = []byte("schema")
+)
+
+// openTimeout bounds how long Update and View wait for another process to
+// finish with the store.
+var openTimeout = 10 * time.Second
+
+func Path(prefix string) string {
+	return filepath.Join(prefix, "var", "ub", "state.db")
+}
+
+type Store struct {
+	path string
+}
+
+func New(path string) *Store {
+	return &Store{path: path}
+}
+
+// Update runs fn in a read-write transaction, creating the store or
+// migrating it to the current schema first. Nothing fn wrote is kept when
+// it returns an error.
+func (s *Store) Update(fn func(*Tx) error) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		if err := migrate(tx); err != nil {
+			return err
+		}
+		return fn(&Tx{tx: tx})
+	})
+}
+
+// View runs fn in a read-only transaction without creating or migrating
+// the store, so it works on a read-only prefix. A store that does not exist
+// yet, or has an older schema, reads as empty; one with a newer schema is
+// an error.
+func (s *Store) View(fn func(*Tx) error) error {
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		return fn(nil)
+	}
+	db, err := bolt.Open(s.path, 0o644, &bolt.Options{Timeout: openTimeout, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("open %s: %w", s.path, err)
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		var version int
+		if meta := tx.Bucket(metaBucket); meta != nil {
+			version, _ = strconv.Atoi(string(meta.Get(schemaKey)))
+		}
+		switch {
+		case version > schemaVersion:
+			return fmt.Errorf("%s: %w", s.path, ErrNewerSchema)
+		case version < schemaVersion:
+			return fn(nil)
+		}
+		return fn(&Tx{tx: tx})
+	})
+}
+
+func (s *Store) open() (*bolt.DB, error) {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return nil, fmt.Errorf("create state dir: %w", err)
+	}
+	db, err := bolt.Open(s.path, 0o644, &bolt.Options{Timeout: openTimeout})
+	if errors.Is(err, bolterrors.ErrInvalid) || errors.Is(err, bolterrors.ErrVersionMismatch) || errors.Is(err, bolterrors.ErrChecksum) {
+		// Start a damaged store again, keeping the old one for whatever
+		// can still be read from it.
+		if mvErr := os.Rename(s.path, s.path+".damaged"); mvErr == nil {
+			db, err = bolt.Open(s.path, 0o644, &bolt.Options{Timeout: openTimeout})
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", s.path, err)
+	}
+	return db, nil
+}
+
+// ErrNewerSchema is returned for a store written by a newer ub, which this
+// one must not drop or rewrite.
+var ErrNewerSchema = errors.New("state store was written by a newer version of ub")
+
+func migrate(tx *bolt.Tx) error {
+	meta, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+	version, _ := strconv.Atoi(string(meta.Get(schemaKey)))
+	switch {
+	case version == schemaVersion:
+		return nil
+	case version > schemaVersion:
+		return ErrNewerSchema
+	}
+	var stale [][]byte
+	if err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if string(name) != string(metaBucket) {
+			stale = append(stale, append([]byte(nil), name...))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, name := range stale {
+		if err := tx.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+	return meta.Put(schemaKey, []byte(strconv.Itoa(schemaVersion)))
+}
+
+// Tx is a transaction over named buckets of JSON records. A nil Tx is an
+// empty store that cannot be written.
+type Tx struct {
+	tx *bolt.Tx
+}
+
+func (t *Tx) Writable() bool {
+	return t != nil && t.tx.Writable()
+}
+
+// Get decodes the record at key into v, reporting whether there was one.
+func (t *Tx) Get(bucket, key string, v any) (bool, error) {
+	if t == nil {
+		return false, nil
+	}
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return false, nil
+	}
+	data := b.Get([]byte(key))
+	if data == nil {
+		return false, nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("state %s/%s: %w", bucket, key, err)
+	}
+	return true, nil
+}
+
+func (t *Tx) Put(bucket, key string, v any) error {
+	if !t.Writable() {
+		return bolterrors.ErrTxNotWritable
+	}
+	b, err := t.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+func (t *Tx) Delete(bucket, key string) error {
+	if !t.Writable() {
+		return bolterrors.ErrTxNotWritable
+	}
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.Delete([]byte(key))
+}
+
+// Append stores v under the bucket's next sequence number, so Keys lists
+// appended records in the order they were added.
+func (t *Tx) Append(bucket string, v any) error {
+	if !t.Writable() {
+		return bolterrors.ErrTxNotWritable
+	}
+	b, err := t.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(fmt.Sprintf("%020d", seq)), data)
+}
+
+// Clear deletes every record in bucket.
+func (t *Tx) Clear(bucket string) error {
+	if !t.Writable() {
+		return bolterrors.ErrTxNotWritable
+	}
+	if err := t.tx.DeleteBucket([]byte(bucket)); err != nil && !errors.Is(err, bolterrors.ErrBucketNotFound) {
+		return err
+	}
+	return nil
+}
+
+// Mark records that something happened to the store once, such as a
+// migration of older files into it.
+func (t *Tx) Mark(key string) error {
+	return t.Put(string(metaBucket), key, true)
+}
+
+// Marked reports whether Mark was called for key.
+func (t *Tx) Marked(key string) bool {
+	var marked bool
+	ok, err := t.Get(string(metaBucket), key, &marked)
+	return ok && err == nil && marked
+}
+
+// Keys lists the keys in bucket, in order.
+func (t *Tx) Keys(bucket string) []string {
+	if t == nil {
+		return nil
+	}
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	var keys []string
+	_ = b.ForEach(func(k, _ []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	})
+	return keys
+}
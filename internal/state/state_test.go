@@ -0,0 +1,199 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+type record struct {
+	Version string `json:"version"`
+}
+
+func TestUpdateAndView(t *testing.T) {
+	store := New(Path(t.TempDir()))
+	if err := store.View(func(tx *Tx) error {
+		if ok, err := tx.Get("formulae", "jq", &record{}); ok || err != nil {
+			t.Fatalf("missing store Get = %v, %v", ok, err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("View of a missing store: %v", err)
+	}
+
+	if err := store.Update(func(tx *Tx) error {
+		if err := tx.Put("formulae", "jq", record{Version: "1.7.1"}); err != nil {
+			return err
+		}
+		return tx.Put("formulae", "wget", record{Version: "1.24"})
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := store.Update(func(tx *Tx) error { return tx.Delete("formulae", "wget") }); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := store.View(func(tx *Tx) error {
+		var got record
+		if ok, err := tx.Get("formulae", "jq", &got); !ok || err != nil || got.Version != "1.7.1" {
+			t.Fatalf("Get = %+v, %v, %v", got, ok, err)
+		}
+		if keys := tx.Keys("formulae"); len(keys) != 1 || keys[0] != "jq" {
+			t.Fatalf("Keys = %q", keys)
+		}
+		if err := tx.Put("formulae", "curl", record{}); err == nil {
+			t.Fatal("expected a read-only transaction to refuse writes")
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("View: %v", err)
+	}
+}
+
+func TestUpdateDropsAnOlderSchema(t *testing.T) {
+	path := Path(t.TempDir())
+	store := New(path)
+	if err := store.Update(func(tx *Tx) error { return tx.Put("formulae", "jq", record{Version: "1.7.1"}) }); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	db, err := bolt.Open(path, 0o644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error { return tx.Bucket(metaBucket).Put(schemaKey, []byte("0")) }); err != nil {
+		t.Fatal(err)
+	}
+	_ = db.Close()
+
+	if err := store.View(func(tx *Tx) error {
+		if tx != nil {
+			t.Fatal("expected an older schema to read as empty")
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("View: %v", err)
+	}
+	if err := store.Update(func(tx *Tx) error {
+		if ok, _ := tx.Get("formulae", "jq", &record{}); ok {
+			t.Fatal("expected the old records dropped")
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+}
+
+func TestUpdateReplacesADamagedStore(t *testing.T) {
+	path := Path(t.TempDir())
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("not a database"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := New(path).Update(func(tx *Tx) error { return tx.Put("casks", "greeter", record{Version: "1.0"}) }); err != nil {
+		t.Fatalf("Update over a damaged store: %v", err)
+	}
+	if data, err := os.ReadFile(path + ".damaged"); err != nil || string(data) != "not a database" {
+		t.Fatalf("expected the damaged store kept aside, got %q, %v", data, err)
+	}
+}
+
+func TestUpdateRefusesANewerSchema(t *testing.T) {
+	path := Path(t.TempDir())
+	store := New(path)
+	if err := store.Update(func(tx *Tx) error { return tx.Put("history", "1", record{}) }); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	db, err := bolt.Open(path, 0o644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error { return tx.Bucket(metaBucket).Put(schemaKey, []byte("99")) }); err != nil {
+		t.Fatal(err)
+	}
+	_ = db.Close()
+
+	if err := store.Update(func(*Tx) error { return nil }); !errors.Is(err, ErrNewerSchema) {
+		t.Fatalf("Update = %v, want ErrNewerSchema", err)
+	}
+	if err := store.View(func(*Tx) error { return nil }); !errors.Is(err, ErrNewerSchema) {
+		t.Fatalf("View = %v, want ErrNewerSchema", err)
+	}
+}
+
+func TestAppendClearAndMark(t *testing.T) {
+	store := New(Path(t.TempDir()))
+	if err := store.Update(func(tx *Tx) error {
+		for i := range 12 {
+			if err := tx.Append("history", i); err != nil {
+				return err
+			}
+		}
+		if err := tx.Put("formulae", "jq", record{Version: "1.7.1"}); err != nil {
+			return err
+		}
+		return tx.Mark("taken-in")
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := store.Update(func(tx *Tx) error {
+		if !tx.Marked("taken-in") || tx.Marked("other") {
+			t.Fatal("Marked does not match what was marked")
+		}
+		var got []int
+		for _, key := range tx.Keys("history") {
+			var n int
+			if _, err := tx.Get("history", key, &n); err != nil {
+				return err
+			}
+			got = append(got, n)
+		}
+		if len(got) != 12 || got[9] != 9 || got[11] != 11 {
+			t.Fatalf("appended records = %v, want them in order", got)
+		}
+		if err := tx.Clear("formulae"); err != nil {
+			return err
+		}
+		if keys := tx.Keys("formulae"); len(keys) != 0 {
+			t.Fatalf("Keys after Clear = %q", keys)
+		}
+		return tx.Clear("missing")
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+}
+
+func TestConcurrentUpdatesTakeTurns(t *testing.T) {
+	store := New(Path(t.TempDir()))
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := store.Update(func(tx *Tx) error {
+				var count int
+				if _, err := tx.Get("counts", "n", &count); err != nil {
+					return err
+				}
+				return tx.Put("counts", "n", count+1)
+			})
+			if err != nil {
+				t.Errorf("Update: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := store.View(func(tx *Tx) error {
+		var count int
+		if _, err := tx.Get("counts", "n", &count); err != nil || count != 8 {
+			t.Fatalf("count = %d, %v, want 8", count, err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("View: %v", err)
+	}
+}
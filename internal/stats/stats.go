@@ -0,0 +1,303 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ub/internal/lock"
+)
+
+type Recorder struct {
+	cacheHits       atomic.Int64
+	cacheMisses     atomic.Int64
+	bytesDownloaded atomic.Int64
+	downloadNanos   atomic.Int64
+
+	mu         sync.Mutex
+	jobStarts  map[string]time.Time
+	busyNanos  int64
+	workers    int
+	execStart  time.Time
+	execNanos  int64
+	jobsRun    int64
+	jobsFailed int64
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{jobStarts: map[string]time.Time{}}
+}
+
+func (r *Recorder) CacheHit() {
+	if r != nil {
+		r.cacheHits.Add(1)
+	}
+}
+
+func (r *Recorder) CacheMiss() {
+	if r != nil {
+		r.cacheMisses.Add(1)
+	}
+}
+
+func (r *Recorder) AddDownloaded(n int64) {
+	if r != nil && n > 0 {
+		r.bytesDownloaded.Add(n)
+	}
+}
+
+// AddDownloadTime records how long one download took, so the throughput of
+// a single connection can be estimated.
+func (r *Recorder) AddDownloadTime(d time.Duration) {
+	if r != nil && d > 0 {
+		r.downloadNanos.Add(int64(d))
+	}
+}
+
+func (r *Recorder) ExecutorStarted(workers int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if workers > r.workers {
+		r.workers = workers
+	}
+	r.execStart = time.Now()
+}
+
+func (r *Recorder) ExecutorFinished() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.execStart.IsZero() {
+		r.execNanos += int64(time.Since(r.execStart)) * int64(max(r.workers, 1))
+		r.execStart = time.Time{}
+	}
+}
+
+func (r *Recorder) JobStarted(id string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.jobStarts[id] = time.Now()
+	r.mu.Unlock()
+}
+
+func (r *Recorder) JobFinished(id string, failed bool) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if start, ok := r.jobStarts[id]; ok {
+		r.busyNanos += int64(time.Since(start))
+		delete(r.jobStarts, id)
+	}
+	r.jobsRun++
+	if failed {
+		r.jobsFailed++
+	}
+}
+
+type Snapshot struct {
+	CacheHits       int64
+	CacheMisses     int64
+	BytesDownloaded int64
+	DownloadTime    time.Duration
+	WorkerBusy      time.Duration
+	WorkerCapacity  time.Duration
+	Jobs            int64
+	JobsFailed      int64
+}
+
+func (r *Recorder) Snapshot() Snapshot {
+	if r == nil {
+		return Snapshot{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return Snapshot{
+		CacheHits:       r.cacheHits.Load(),
+		CacheMisses:     r.cacheMisses.Load(),
+		BytesDownloaded: r.bytesDownloaded.Load(),
+		DownloadTime:    time.Duration(r.downloadNanos.Load()),
+		WorkerBusy:      time.Duration(r.busyNanos),
+		WorkerCapacity:  time.Duration(r.execNanos),
+		Jobs:            r.jobsRun,
+		JobsFailed:      r.jobsFailed,
+	}
+}
+
+type CommandStats struct {
+	Runs          int64         `json:"runs"`
+	Failures      int64         `json:"failures"`
+	TotalDuration time.Duration `json:"total_duration_ns"`
+	MaxDuration   time.Duration `json:"max_duration_ns"`
+	LastDuration  time.Duration `json:"last_duration_ns"`
+	LastRun       time.Time     `json:"last_run"`
+}
+
+func (c CommandStats) Average() time.Duration {
+	if c.Runs == 0 {
+		return 0
+	}
+	return c.TotalDuration / time.Duration(c.Runs)
+}
+
+type Database struct {
+	Since           time.Time               `json:"since"`
+	Commands        map[string]CommandStats `json:"commands"`
+	CacheHits       int64                   `json:"cache_hits"`
+	CacheMisses     int64                   `json:"cache_misses"`
+	BytesDownloaded int64                   `json:"bytes_downloaded"`
+	DownloadTime    time.Duration           `json:"download_time_ns"`
+	WorkerBusy      time.Duration           `json:"worker_busy_ns"`
+	WorkerCapacity  time.Duration           `json:"worker_capacity_ns"`
+	Jobs            int64                   `json:"jobs"`
+	JobsFailed      int64                   `json:"jobs_failed"`
+}
+
+func (db Database) CacheHitRate() float64 {
+	total := db.CacheHits + db.CacheMisses
+	if total == 0 {
+		return 0
+	}
+	return float64(db.CacheHits) / float64(total)
+}
+
+// Throughput is the average bytes per second of one download, or zero when
+// no download was timed.
+func (db Database) Throughput() float64 {
+	if db.DownloadTime <= 0 {
+		return 0
+	}
+	return float64(db.BytesDownloaded) / db.DownloadTime.Seconds()
+}
+
+func (db Database) WorkerUtilization() float64 {
+	if db.WorkerCapacity <= 0 {
+		return 0
+	}
+	ratio := float64(db.WorkerBusy) / float64(db.WorkerCapacity)
+	if ratio > 1 {
+		ratio = 1
+	}
+	return ratio
+}
+
+func Path(prefix string) string {
+	return filepath.Join(prefix, "var", "ub", "stats.json")
+}
+
+func Load(path string) (Database, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Database{Commands: map[string]CommandStats{}}, nil
+		}
+		return Database{}, fmt.Errorf("read stats: %w", err)
+	}
+	var db Database
+	if err := json.Unmarshal(data, &db); err != nil {
+		return Database{}, fmt.Errorf("parse stats: %w", err)
+	}
+	if db.Commands == nil {
+		db.Commands = map[string]CommandStats{}
+	}
+	return db, nil
+}
+
+func Save(path string, db Database) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("create stats dir: %w", err)
+	}
+	data, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal stats: %w", err)
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("write stats: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("publish stats: %w", err)
+	}
+	return nil
+}
+
+// lockWait bounds how long Record and Reset wait for another ub process to
+// finish with the stats file.
+var lockWait = 5 * time.Second
+
+// locked runs fn holding the lock on the stats file's directory, so the
+// load-modify-save of concurrent ub processes cannot lose each other's
+// counts.
+func locked(path string, fn func() error) error {
+	handle, err := lock.AcquireWait(context.Background(), filepath.Dir(path), lockWait, nil)
+	if err != nil {
+		return fmt.Errorf("lock stats: %w", err)
+	}
+	defer handle.Release()
+	return fn()
+}
+
+// Reset removes the recorded stats.
+func Reset(path string) error {
+	return locked(path, func() error {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// Record adds one run of command, and what snap counted during it, to the
+// stats at path.
+func Record(path, command string, duration time.Duration, failed bool, snap Snapshot) error {
+	return locked(path, func() error {
+		return record(path, command, duration, failed, snap)
+	})
+}
+
+func record(path, command string, duration time.Duration, failed bool, snap Snapshot) error {
+	db, err := Load(path)
+	if err != nil {
+		db = Database{Commands: map[string]CommandStats{}}
+	}
+	now := time.Now().UTC()
+	if db.Since.IsZero() {
+		db.Since = now
+	}
+	entry := db.Commands[command]
+	entry.Runs++
+	if failed {
+		entry.Failures++
+	}
+	entry.TotalDuration += duration
+	if duration > entry.MaxDuration {
+		entry.MaxDuration = duration
+	}
+	entry.LastDuration = duration
+	entry.LastRun = now
+	db.Commands[command] = entry
+
+	db.CacheHits += snap.CacheHits
+	db.CacheMisses += snap.CacheMisses
+	db.BytesDownloaded += snap.BytesDownloaded
+	db.DownloadTime += snap.DownloadTime
+	db.WorkerBusy += snap.WorkerBusy
+	db.WorkerCapacity += snap.WorkerCapacity
+	db.Jobs += snap.Jobs
+	db.JobsFailed += snap.JobsFailed
+	return Save(path, db)
+}
@@ -0,0 +1,109 @@
+package stats
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRecorderSnapshot(t *testing.T) {
+	r := NewRecorder()
+	r.CacheHit()
+	r.CacheMiss()
+	r.CacheMiss()
+	r.AddDownloaded(2048)
+	r.AddDownloadTime(time.Second)
+	r.ExecutorStarted(2)
+	r.JobStarted("a")
+	time.Sleep(5 * time.Millisecond)
+	r.JobFinished("a", false)
+	r.JobStarted("b")
+	r.JobFinished("b", true)
+	r.ExecutorFinished()
+
+	snap := r.Snapshot()
+	if snap.CacheHits != 1 || snap.CacheMisses != 2 {
+		t.Fatalf("cache counters = %d/%d", snap.CacheHits, snap.CacheMisses)
+	}
+	if snap.BytesDownloaded != 2048 || snap.DownloadTime != time.Second {
+		t.Fatalf("bytes = %d in %s", snap.BytesDownloaded, snap.DownloadTime)
+	}
+	if snap.Jobs != 2 || snap.JobsFailed != 1 {
+		t.Fatalf("jobs = %d failed = %d", snap.Jobs, snap.JobsFailed)
+	}
+	if snap.WorkerBusy <= 0 || snap.WorkerCapacity < snap.WorkerBusy {
+		t.Fatalf("busy = %s capacity = %s", snap.WorkerBusy, snap.WorkerCapacity)
+	}
+}
+
+func TestNilRecorderIsSafe(t *testing.T) {
+	var r *Recorder
+	r.CacheHit()
+	r.AddDownloaded(10)
+	r.JobStarted("a")
+	r.JobFinished("a", false)
+	if snap := r.Snapshot(); snap != (Snapshot{}) {
+		t.Fatalf("expected empty snapshot, got %+v", snap)
+	}
+}
+
+func TestRecordAccumulates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "var", "ub", "stats.json")
+	if err := Record(path, "install", 2*time.Second, false, Snapshot{CacheHits: 1, CacheMisses: 3, BytesDownloaded: 100, DownloadTime: time.Second}); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	if err := Record(path, "install", 4*time.Second, true, Snapshot{CacheHits: 3, BytesDownloaded: 50, DownloadTime: 2 * time.Second}); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	db, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	install := db.Commands["install"]
+	if install.Runs != 2 || install.Failures != 1 {
+		t.Fatalf("install stats = %+v", install)
+	}
+	if install.Average() != 3*time.Second || install.MaxDuration != 4*time.Second {
+		t.Fatalf("durations avg=%s max=%s", install.Average(), install.MaxDuration)
+	}
+	if db.CacheHitRate() != float64(4)/float64(7) {
+		t.Fatalf("hit rate = %f", db.CacheHitRate())
+	}
+	if db.BytesDownloaded != 150 {
+		t.Fatalf("bytes = %d", db.BytesDownloaded)
+	}
+	if db.Throughput() != 50 {
+		t.Fatalf("throughput = %f", db.Throughput())
+	}
+}
+
+func TestConcurrentRecordsAreAllKept(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "var", "ub", "stats.json")
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := Record(path, "list", time.Millisecond, false, Snapshot{CacheHits: 1}); err != nil {
+				t.Errorf("Record: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	db, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if db.Commands["list"].Runs != 4 || db.CacheHits != 4 {
+		t.Fatalf("stats = %+v, want all 4 runs", db)
+	}
+
+	if err := Reset(path); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected stats removed, stat err: %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingExporter struct {
+	spans []*Span
+}
+
+func (e *recordingExporter) Export(_ context.Context, spans []*Span) error {
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func TestStartWithoutProviderIsNoop(t *testing.T) {
+	SetProvider(nil)
+	ctx, span := Start(context.Background(), "ub.install")
+	if span != nil {
+		t.Fatalf("expected nil span without provider")
+	}
+	span.SetAttributes(String("k", "v"))
+	span.End(nil)
+	if ctx == nil {
+		t.Fatalf("expected context to be returned")
+	}
+}
+
+func TestChildSpanSharesTrace(t *testing.T) {
+	exporter := &recordingExporter{}
+	p := NewProvider(exporter)
+	SetProvider(p)
+	defer SetProvider(nil)
+
+	ctx, root := Start(context.Background(), "ub.install")
+	_, child := Start(ctx, "ub.fetch", String("url.full", "https://example.com/a.tar.gz"))
+	child.End(errors.New("boom"))
+	root.End(nil)
+	if err := p.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	if len(exporter.spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(exporter.spans))
+	}
+	gotChild, gotRoot := exporter.spans[0], exporter.spans[1]
+	if gotChild.traceID != gotRoot.traceID {
+		t.Fatalf("expected shared trace id, got %s and %s", gotChild.traceID, gotRoot.traceID)
+	}
+	if gotChild.parentID != gotRoot.spanID {
+		t.Fatalf("expected child parent %s, got %s", gotRoot.spanID, gotChild.parentID)
+	}
+	if gotRoot.parentID != "" {
+		t.Fatalf("expected root span without parent, got %s", gotRoot.parentID)
+	}
+	if gotChild.err == nil {
+		t.Fatalf("expected child span error to be recorded")
+	}
+}
+
+func TestFlushEveryExportsWhileRunningAndOnStop(t *testing.T) {
+	exporter := &recordingExporter{}
+	p := NewProvider(exporter)
+	SetProvider(p)
+	defer SetProvider(nil)
+
+	stop := FlushEvery(time.Millisecond, func(err error) { t.Errorf("flush: %v", err) })
+	_, span := Start(context.Background(), "ub.daemon.install")
+	span.End(nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mu.Lock()
+		pending := len(p.finished)
+		p.mu.Unlock()
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the span exported while running")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	_, last := Start(context.Background(), "ub.daemon.install")
+	last.End(nil)
+	stop()
+	stop()
+	if len(exporter.spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(exporter.spans))
+	}
+}
+
+func TestOTLPExporterPostsJSON(t *testing.T) {
+	var body map[string]any
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		data, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Errorf("decode body: %v", err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", server.URL)
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "Authorization=Bearer token")
+	t.Setenv("OTEL_SERVICE_NAME", "ub-test")
+	p := ConfigureFromEnv()
+	defer SetProvider(nil)
+
+	_, span := Start(context.Background(), "ub.link", String("ub.formula", "jq"))
+	span.End(nil)
+	if err := p.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	if auth != "Bearer token" {
+		t.Fatalf("expected auth header, got %q", auth)
+	}
+	encoded, _ := json.Marshal(body)
+	for _, want := range []string{`"ub-test"`, `"ub.link"`, `"ub.formula"`, `"jq"`} {
+		if !strings.Contains(string(encoded), want) {
+			t.Fatalf("expected payload to contain %s, got %s", want, encoded)
+		}
+	}
+}
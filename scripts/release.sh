@@ -17,6 +17,11 @@ Options:
   --skip-tests          Skip go test ./...
   --allow-dirty         Allow running with uncommitted changes
   -h, --help            Show this help
+
+Environment:
+  UB_RELEASE_KEY        ed25519 private key (PEM) that signs checksums.txt.
+                        Its public half must match
+                        internal/selfupdate/release_key.pub.
 EOF
 }
 
@@ -99,10 +104,24 @@ require_cmd go
 require_cmd gh
 require_cmd tar
 require_cmd shasum
+require_cmd openssl
+
+if [[ -z "${UB_RELEASE_KEY:-}" || ! -f "$UB_RELEASE_KEY" ]]; then
+  echo "error: UB_RELEASE_KEY must name the release signing key" >&2
+  exit 1
+fi
 
 REPO_ROOT="$(git rev-parse --show-toplevel)"
 cd "$REPO_ROOT"
 
+# ub verifies releases against the key built into it, so a release signed
+# with any other key could never be installed by ub self-update.
+SIGNING_PUBLIC_KEY="$(openssl pkey -in "$UB_RELEASE_KEY" -pubout -outform DER | tail -c 32 | base64)"
+if [[ "$SIGNING_PUBLIC_KEY" != "$(tr -d '[:space:]' < internal/selfupdate/release_key.pub)" ]]; then
+  echo "error: UB_RELEASE_KEY does not match internal/selfupdate/release_key.pub" >&2
+  exit 1
+fi
+
 if [[ "$ALLOW_DIRTY" != "yes" ]]; then
   if [[ -n "$(git status --porcelain)" ]]; then
     echo "error: working tree is dirty. Commit or stash changes, or use --allow-dirty." >&2
@@ -137,7 +156,7 @@ for entry in "${MATRIX[@]}"; do
   mkdir -p "$BUILD_DIR"
 
   echo "==> Building $NAME"
-  CGO_ENABLED=0 GOOS="$GOOS" GOARCH="$GOARCH" go build -trimpath -ldflags="-s -w" -o "$BUILD_DIR/ub" ./cmd/ub/main.go
+  CGO_ENABLED=0 GOOS="$GOOS" GOARCH="$GOARCH" go build -trimpath -ldflags="-s -w -X main.version=${TAG#v}" -o "$BUILD_DIR/ub" ./cmd/ub
 
   ARCHIVE="$DIST_DIR/${NAME}.tar.gz"
   tar -C "$BUILD_DIR" -czf "$ARCHIVE" ub
@@ -152,6 +171,10 @@ for asset in "${ASSETS[@]}"; do
 done
 ASSETS+=("$CHECKSUMS")
 
+echo "==> Signing checksums.txt"
+openssl pkeyutl -sign -inkey "$UB_RELEASE_KEY" -rawin -in "$CHECKSUMS" | base64 | tr -d '\n' > "$CHECKSUMS.sig"
+ASSETS+=("$CHECKSUMS.sig")
+
 echo "==> Ensuring tag exists locally and remotely"
 if ! git rev-parse "$TAG" >/dev/null 2>&1; then
   git tag -a "$TAG" -m "Release $TAG"